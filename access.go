@@ -0,0 +1,337 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+// Access is a set of permissions granted by an access key.
+type Access uint8
+
+// Permissions granted by an access key.
+const (
+	AccessRead      Access = 1 << iota // Key allows to get messages of topics matching the topic of the key.
+	AccessWrite                        // Key allows to put and delete messages of topics matching the topic of the key.
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+const (
+	accessKeyVersion = 1
+	accessKeyIDSize  = 8
+	accessKeyMacSize = 16
+	// accessKeyHeaderSize is the size of the version, ID, contract, access and expiry of the key before its topic.
+	accessKeyHeaderSize = 1 + accessKeyIDSize + 4 + 1 + 8
+	accessSecretSize    = 32
+)
+
+type (
+	// AccessKey is an access key granting permissions on topics of a contract, see DB.NewAccessKey.
+	AccessKey struct {
+		ID        string    // The ID of the key, it is used to revoke the key.
+		Contract  uint32    // The contract of topics the key grants access to.
+		Topic     []byte    // The topic or wildcard topic the key grants access to.
+		Access    Access    // The permissions granted by the key.
+		ExpiresAt time.Time // The expiry of the key, zero if the key does not expire.
+	}
+
+	// _RevokedKey is a revoked access key persisted to the access file until the key expires.
+	_RevokedKey struct {
+		ID        string `json:"id"`
+		ExpiresAt int64  `json:"expires_at,omitempty"`
+	}
+	// _AccessRecord is the secret access keys are signed with and revoked keys persisted to the access file.
+	_AccessRecord struct {
+		Secret  []byte        `json:"secret"`
+		Revoked []_RevokedKey `json:"revoked,omitempty"`
+	}
+	// _AccessTable holds the secret access keys are signed with and revoked keys, and persists these to the access file.
+	_AccessTable struct {
+		mu      sync.RWMutex
+		fsys    fs.FileSystem
+		path    string
+		secret  []byte
+		revoked map[string]int64 // expiry of revoked keys by key ID.
+	}
+)
+
+func accessPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.access", prefix))
+}
+
+// openAccessTable reads the access file from the DB directory. The secret is generated
+// when the first access key is signed, so the access file is not created until then.
+func openAccessTable(fsys fs.FileSystem, dirName string) (*_AccessTable, error) {
+	t := &_AccessTable{fsys: fsys, path: accessPath(dirName), revoked: make(map[string]int64)}
+	data, err := fs.ReadFile(fsys, t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var r _AccessRecord
+	if err := json.Unmarshal(data, &r); err != nil || len(r.Secret) != accessSecretSize {
+		return nil, ErrCorrupted
+	}
+	t.secret = r.Secret
+	for _, k := range r.Revoked {
+		t.revoked[k.ID] = k.ExpiresAt
+	}
+	return t, nil
+}
+
+// write writes the secret and revoked keys to a temporary file renamed over the access file.
+// Revoked keys that have expired are no longer persisted. Caller must hold the lock.
+func (t *_AccessTable) write() error {
+	now := time.Now().Unix()
+	r := _AccessRecord{Secret: t.secret}
+	for id, expiresAt := range t.revoked {
+		if expiresAt != 0 && expiresAt <= now {
+			delete(t.revoked, id)
+			continue
+		}
+		r.Revoked = append(r.Revoked, _RevokedKey{ID: id, ExpiresAt: expiresAt})
+	}
+	sort.Slice(r.Revoked, func(i, j int) bool {
+		return r.Revoked[i].ID < r.Revoked[j].ID
+	})
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(t.fsys, t.path, data, os.FileMode(0600))
+}
+
+// sign signs the key, the secret is generated and persisted if it is not set.
+func (t *_AccessTable) sign(key []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.secret == nil {
+		secret := make([]byte, accessSecretSize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		t.secret = secret
+		if err := t.write(); err != nil {
+			t.secret = nil
+			return nil, err
+		}
+	}
+	return t.mac(key), nil
+}
+
+// mac returns the signature of the key. Caller must hold the lock.
+func (t *_AccessTable) mac(key []byte) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write(key)
+	return h.Sum(nil)[:accessKeyMacSize]
+}
+
+// verify returns true if the key is signed with the secret and it is not revoked.
+func (t *_AccessTable) verify(key, mac []byte, id string) (signed, revoked bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.secret == nil || !hmac.Equal(mac, t.mac(key)) {
+		return false, false
+	}
+	_, revoked = t.revoked[id]
+	return true, revoked
+}
+
+func (t *_AccessTable) revoke(k AccessKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.revoked[k.ID]; ok {
+		return nil
+	}
+	var expiresAt int64
+	if !k.ExpiresAt.IsZero() {
+		expiresAt = k.ExpiresAt.Unix()
+	}
+	t.revoked[k.ID] = expiresAt
+	if err := t.write(); err != nil {
+		delete(t.revoked, k.ID)
+		return err
+	}
+	return nil
+}
+
+// splitTopicPattern splits the topic into its parts, the generic flag is set if the topic ends with
+// the generic symbol "..." or the subtree symbol "#" and matches any number of parts that follow.
+func splitTopicPattern(topic []byte) (parts [][]byte, generic bool) {
+	topic = topicName(topic)
+	if n := len(topic); n > 0 && topic[n-1] == message.TopicSubtreeSymbol && (n == 1 || topic[n-2] == message.TopicSeparator) {
+		topic, generic = topic[:n-1], true
+	}
+	if bytes.HasSuffix(topic, []byte(message.TopicGenericSymbol)) {
+		topic, generic = bytes.TrimSuffix(topic, []byte(message.TopicGenericSymbol)), true
+	}
+	parts = bytes.FieldsFunc(topic, func(c rune) bool { return c == message.TopicSeparator })
+	return parts, generic
+}
+
+// matchTopicPattern returns true if all topics matching the topic also match the pattern. A wildcard
+// part of the pattern matches any part, and a generic pattern matches topics with any number of parts that follow.
+func matchTopicPattern(pattern, topic []byte) bool {
+	pp, pGeneric := splitTopicPattern(pattern)
+	tp, tGeneric := splitTopicPattern(topic)
+	if tGeneric && !pGeneric {
+		return false
+	}
+	isWildcard := func(p []byte) bool {
+		return bytes.HasSuffix(p, []byte{message.TopicWildcardSymbol}) || bytes.Equal(p, []byte{message.TopicSingleLevelSymbol})
+	}
+	for i, p := range tp {
+		if i >= len(pp) {
+			return pGeneric
+		}
+		switch {
+		case isWildcard(pp[i]):
+		case isWildcard(p), !bytes.Equal(p, pp[i]):
+			return false
+		}
+	}
+	if len(tp) < len(pp) {
+		return false
+	}
+	return len(tp) == len(pp) || pGeneric
+}
+
+// NewAccessKey generates a signed access key granting access to topics of the contract matching the topic,
+// use zero contract for the master contract. The topic may be a wildcard topic, such as "teams.alpha.*"
+// or "teams.alpha...". A zero ttl generates a key that does not expire. Keys are not stored in the DB,
+// only revoked keys are recorded, see RevokeAccessKey.
+func (db *DB) NewAccessKey(contract uint32, topic []byte, access Access, ttl time.Duration) (string, error) {
+	if err := db.ok(); err != nil {
+		return "", err
+	}
+	switch {
+	case len(topic) == 0:
+		return "", errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return "", errTopicTooLarge
+	case access == 0 || access&^AccessReadWrite != 0:
+		return "", errAccessInvalid
+	case ttl < 0:
+		return "", errTtlNegative
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	if _, _, err := db.parseTopic(contract, topic); err != nil {
+		return "", err
+	}
+	key := make([]byte, accessKeyHeaderSize, accessKeyHeaderSize+len(topic)+accessKeyMacSize)
+	key[0] = accessKeyVersion
+	if _, err := rand.Read(key[1 : 1+accessKeyIDSize]); err != nil {
+		return "", err
+	}
+	binary.LittleEndian.PutUint32(key[9:13], contract)
+	key[13] = byte(access)
+	if ttl > 0 {
+		binary.LittleEndian.PutUint64(key[14:22], uint64(time.Now().Add(ttl).Unix()))
+	}
+	key = append(key, topic...)
+	mac, err := db.internal.access.sign(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(key, mac...)), nil
+}
+
+// ParseAccessKey verifies the access key and returns the permissions it grants. It returns an error
+// if the key is not signed by the DB, or if the key is expired or revoked.
+func (db *DB) ParseAccessKey(key string) (AccessKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(data) <= accessKeyHeaderSize+accessKeyMacSize || data[0] != accessKeyVersion {
+		return AccessKey{}, errAccessKeyInvalid
+	}
+	n := len(data) - accessKeyMacSize
+	k := AccessKey{
+		ID:       hex.EncodeToString(data[1 : 1+accessKeyIDSize]),
+		Contract: binary.LittleEndian.Uint32(data[9:13]),
+		Access:   Access(data[13]),
+		Topic:    data[accessKeyHeaderSize:n],
+	}
+	if expiresAt := int64(binary.LittleEndian.Uint64(data[14:22])); expiresAt != 0 {
+		k.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	signed, revoked := db.internal.access.verify(data[:n], data[n:], k.ID)
+	switch {
+	case !signed:
+		return AccessKey{}, errAccessKeyInvalid
+	case revoked:
+		return AccessKey{}, errAccessKeyRevoked
+	case !k.ExpiresAt.IsZero() && !time.Now().Before(k.ExpiresAt):
+		return AccessKey{}, errAccessKeyExpired
+	}
+	return k, nil
+}
+
+// RevokeAccessKey revokes the access key. Revoked keys are persisted until the key expires.
+func (db *DB) RevokeAccessKey(key string) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	k, err := db.ParseAccessKey(key)
+	switch {
+	case err == errAccessKeyRevoked || err == errAccessKeyExpired:
+		return nil
+	case err != nil:
+		return err
+	}
+	return db.internal.access.revoke(k)
+}
+
+// checkAccess checks the access key grants access to the topic of the contract. If access control is enabled
+// a key is required, otherwise only a key that is set is checked, see WithAccessControl.
+func (db *DB) checkAccess(key string, contract uint32, topic []byte, access Access) error {
+	if key == "" {
+		if db.opts.accessControl {
+			return errAccessKeyRequired
+		}
+		return nil
+	}
+	k, err := db.ParseAccessKey(key)
+	if err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	if k.Contract != contract || k.Access&access != access || !matchTopicPattern(k.Topic, topic) {
+		return errAccessDenied
+	}
+	return nil
+}
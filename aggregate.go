@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+// Aggregation sets how messages of a time bucket are aggregated, see DB.Aggregate.
+type Aggregation uint8
+
+const (
+	// AggCount counts messages of each time bucket.
+	AggCount Aggregation = iota
+	// AggFirst counts messages and samples the first message of each time bucket.
+	AggFirst
+	// AggLast counts messages and samples the last message of each time bucket.
+	AggLast
+)
+
+// Bucket is the aggregate of messages written within a time bucket.
+type Bucket struct {
+	Start   time.Time // The start of the time bucket.
+	Count   int64     // The number of messages written within the time bucket.
+	ID      []byte    // The ID of the message sampled by AggFirst or AggLast.
+	Payload []byte    // The payload of the message sampled by AggFirst or AggLast.
+}
+
+// Aggregate counts messages of topics matching the query per time bucket, buckets are aligned to
+// multiples of the bucket duration since the unix epoch and returned oldest first. Messages are counted
+// from the window index and the time of their ID, so payloads are not decoded except the message
+// sampled from each bucket by AggFirst or AggLast. Use Query.WithLast to aggregate recent messages,
+// the limit of the query does not apply to messages aggregated.
+func (db *DB) Aggregate(q *Query, agg Aggregation, bucket time.Duration) ([]Bucket, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(q.Topic) == 0:
+		return nil, errTopicEmpty
+	case len(q.Topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	case agg > AggLast:
+		return nil, errAggregationInvalid
+	case bucket < time.Second:
+		return nil, errBucketTooSmall
+	}
+	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
+	if err := q.parse(); err != nil {
+		return nil, err
+	}
+	if err := db.checkAccess(q.AccessKey, q.Contract, q.Topic, AccessRead); err != nil {
+		return nil, err
+	}
+	q.internal.stats = QueryStats{}
+	defer func(start time.Time) {
+		q.internal.stats.Duration = time.Since(start)
+	}(time.Now())
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+
+	// All entries of matching topics are looked up, the limit of the query only applies to messages returned.
+	sq := &Query{internal: q.internal, Topic: q.Topic, Contract: q.Contract, Limit: math.MaxInt32}
+	sq.internal.winEntries = nil
+	sq.internal.before = 0
+	if err := db.lookup(sq); err != nil {
+		return nil, err
+	}
+	q.internal.stats.BlocksRead += sq.internal.stats.BlocksRead
+	q.internal.stats.Visited += sq.internal.stats.Visited
+
+	type sample struct {
+		bucket Bucket
+		ts     int64
+		seq    uint64
+		e      _IndexEntry
+	}
+	size := int64(bucket / time.Second)
+	buckets := make(map[int64]*sample)
+	seen := make(map[uint64]struct{}, len(sq.internal.winEntries))
+	now := uint32(time.Now().Unix())
+	for _, wq := range sq.internal.winEntries {
+		if _, ok := seen[wq.seq]; ok {
+			continue
+		}
+		seen[wq.seq] = struct{}{}
+		if wq.expiresAt != 0 && wq.expiresAt <= now {
+			continue
+		}
+		e, err := db.readEntry(wq)
+		if err == errMsgIDDeleted || err == errEntryInvalid {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := db.internal.reader.readID(e)
+		if err != nil {
+			return nil, err
+		}
+		if !message.ID(id).EvalPrefix(q.Contract, q.internal.cutoff) {
+			continue
+		}
+		ts := uid.Time(id[0:4])
+		start := ts - ts%size
+		s, ok := buckets[start]
+		if !ok {
+			s = &sample{bucket: Bucket{Start: time.Unix(start, 0)}, ts: ts, seq: wq.seq, e: e}
+			buckets[start] = s
+		}
+		s.bucket.Count++
+		// Messages written within the same second are ordered by seq.
+		switch {
+		case agg == AggFirst && (ts < s.ts || ts == s.ts && wq.seq < s.seq),
+			agg == AggLast && (ts > s.ts || ts == s.ts && wq.seq > s.seq):
+			s.ts, s.seq, s.e = ts, wq.seq, e
+		}
+	}
+
+	result := make([]Bucket, 0, len(buckets))
+	for _, s := range buckets {
+		if agg != AggCount {
+			id, val, err := db.internal.reader.readMessage(s.e)
+			if err != nil {
+				return nil, err
+			}
+			_, payload, err := decodeMessage(db.internal.keyring, db.internal.plugins, id, val)
+			if err != nil && err != errMsgShredded {
+				return nil, err
+			}
+			s.bucket.ID = make([]byte, message.ID(nil).Size())
+			copy(s.bucket.ID, id[:8])
+			binary.LittleEndian.PutUint64(s.bucket.ID[8:], s.seq)
+			s.bucket.Payload = payload
+		}
+		result = append(result, s.bucket)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	q.internal.stats.Returned = len(result)
+	return result, nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Alert is a threshold alert on the state of the DB, so corrective action such as a forced sync
+// or a compaction can be automated by the application, see WithAlert and WithAlertHook.
+type Alert uint8
+
+const (
+	// AlertLogSize alerts if size of the write ahead logs not yet applied exceeds the threshold in bytes.
+	AlertLogSize Alert = iota
+	// AlertSyncLag alerts if the DB was last in sync more than the threshold in seconds ago.
+	AlertSyncLag
+	// AlertDeadSpace alerts if space of deleted entries exceeds the threshold in percent of the data file size.
+	AlertDeadSpace
+
+	nAlerts
+)
+
+// String returns name of the alert.
+func (a Alert) String() string {
+	switch a {
+	case AlertLogSize:
+		return "log_size"
+	case AlertSyncLag:
+		return "sync_lag"
+	case AlertDeadSpace:
+		return "dead_space"
+	default:
+		return "unknown"
+	}
+}
+
+// AlertEvent is passed to the alert hook when an alert fires.
+type AlertEvent struct {
+	Alert     Alert
+	Value     int64
+	Threshold int64
+	Time      time.Time
+}
+
+// _Alerts holds the alert thresholds and the hook. Zero threshold disables an alert.
+type _Alerts struct {
+	thresholds [nAlerts]int64
+	hook       func(AlertEvent)
+}
+
+func (a *_Alerts) enabled() bool {
+	for _, threshold := range a.thresholds {
+		if threshold > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// alertValue returns the current value of the alert.
+func (db *DB) alertValue(a Alert) int64 {
+	switch a {
+	case AlertLogSize:
+		return db.internal.mem.LogSize()
+	case AlertSyncLag:
+		return int64(time.Since(time.Unix(0, atomic.LoadInt64(&db.internal.syncedAt))) / time.Second)
+	case AlertDeadSpace:
+		// Compaction swaps the data file, so the data file is read as by readers.
+		db.internal.compactLock.RLock()
+		defer db.internal.compactLock.RUnlock()
+		dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+		if err != nil {
+			return 0
+		}
+		size := dataFile.Size()
+		if size == 0 {
+			return 0
+		}
+		return db.internal.freeList.freeSize() * 100 / size
+	}
+	return 0
+}
+
+// checkAlerts fires an alert once its value exceeds the threshold. The alert fires again
+// only after its value has dropped to the threshold.
+func (db *DB) checkAlerts(firing *[nAlerts]bool) {
+	for a := Alert(0); a < nAlerts; a++ {
+		threshold := db.opts.alerts.thresholds[a]
+		if threshold == 0 {
+			continue
+		}
+		value := db.alertValue(a)
+		if value <= threshold {
+			firing[a] = false
+			continue
+		}
+		if firing[a] {
+			continue
+		}
+		firing[a] = true
+		db.internal.logger.Warn().Str("context", "db.checkAlerts").Str("alert", a.String()).Int64("value", value).Int64("threshold", threshold).Msg("alert threshold exceeded")
+		if db.opts.alerts.hook != nil {
+			db.opts.alerts.hook(AlertEvent{Alert: a, Value: value, Threshold: threshold, Time: time.Now()})
+		}
+	}
+}
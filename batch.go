@@ -25,6 +25,22 @@ import (
 	"github.com/unit-io/unitdb/message"
 )
 
+// ConflictPolicy sets how an entry of a batch is written if an entry with the same
+// message ID is already written to the DB by another batch or put, or by an earlier entry
+// of the batch, see Entry.WithID. A batch does not otherwise deduplicate its entries, entries
+// without a message ID are all written even if these have the same topic and payload.
+type ConflictPolicy uint8
+
+const (
+	// ConflictLastWriterWins writes the entry without checking for a conflict, an entry replaces an earlier
+	// entry of the batch with the same message ID. It is the default policy.
+	ConflictLastWriterWins ConflictPolicy = iota
+	// ConflictFirstWriterWins skips the entry of the batch, other entries of the batch are written.
+	ConflictFirstWriterWins
+	// ConflictError fails writing the batch, so none of the entries of the batch not yet written are written.
+	ConflictError
+)
+
 // SetOptions sets batch options.
 func (b *Batch) SetOptions(opts ...Options) {
 	for _, opt := range opts {
@@ -41,6 +57,12 @@ type (
 		offset  int64
 	}
 
+	// _BatchMessage is a message of the batch delivered to subscriptions once the batch is committed.
+	_BatchMessage struct {
+		topicHash uint64
+		msg       Message
+	}
+
 	Batch struct {
 		db         *DB
 		mem        *memdb.Batch
@@ -52,11 +74,33 @@ type (
 		buffer *bpool.Buffer
 		size   int64
 
+		// pending are messages by index of entries in the batch, written are messages of entries
+		// written to the memdb to deliver to subscriptions on commit.
+		pending map[int]_BatchMessage
+		written []_BatchMessage
+
+		// names are names of topics first written by the batch, these are replicated with the batch record.
+		names map[uint64]_TopicName
+		// counts are number of messages put to the batch by contract, to check rate limits on write.
+		counts map[uint32]int64
+		// replicated is set on a batch applying a record committed to the replicated log, see DB.ApplyBatch.
+		replicated bool
+
 		// commitComplete is used to signal if batch commit is complete and batch is fully written to DB.
 		commitComplete chan struct{}
+
+		// commitCallback is called with the commit error once the batch commit is complete.
+		commitCallback func(error)
 	}
 )
 
+// SetCommitCallback sets the function called once the batch commit is complete. The function is called
+// with nil if entries of the batch are written to the write ahead log, durable as set by the sync policy
+// (see WithSyncPolicy), or with the error the commit or the managed batch function failed with.
+func (b *Batch) SetCommitCallback(fn func(error)) {
+	b.commitCallback = fn
+}
+
 // Put adds entry to batch for given topic->key/value.
 // Client must provide Topic to the BatchOptions.
 // It is safe to modify the contents of the argument after Put returns but not
@@ -70,6 +114,8 @@ func (b *Batch) Put(topic, payload []byte) error {
 // before.
 func (b *Batch) PutEntry(e *Entry) error {
 	switch {
+	case b.db == nil:
+		return ErrBatchClosed
 	case len(e.Topic) == 0:
 		return errTopicEmpty
 	case len(e.Topic) > maxTopicLength:
@@ -78,11 +124,48 @@ func (b *Batch) PutEntry(e *Entry) error {
 		return errValueEmpty
 	case len(e.Payload) > maxValueLength:
 		return errValueTooLarge
+	case b.full():
+		return ErrBatchFull
+	}
+	if err := b.db.checkEntryLimits(e); err != nil {
+		return err
 	}
 	e.Encryption = e.Encryption || b.opts.batchOptions.encryption
-	if err := b.db.setEntry(e); err != nil {
+	if err := b.db.encodeEntry(e); err != nil {
+		return err
+	}
+	if err := b.checkSize(e); err != nil {
+		return err
+	}
+	if err := b.db.checkTopicLimit(e); err != nil {
 		return err
 	}
+	if err := b.db.checkQuota(e); err != nil {
+		return err
+	}
+	// Names of topics of a replicated DB are added once the batch record is applied, see DB.ApplyBatch.
+	if b.db.opts.replicator != nil {
+		e.entry.newTopic = false
+	}
+	if err := b.db.commitEntry(e); err != nil {
+		return err
+	}
+	if b.db.internal.subscriptions.active() {
+		if b.pending == nil {
+			b.pending = make(map[int]_BatchMessage)
+		}
+		b.pending[len(b.index)] = _BatchMessage{topicHash: e.entry.topicHash, msg: newMessage(e)}
+	}
+	if b.db.opts.replicator != nil && e.entry.topicSize != 0 {
+		if b.names == nil {
+			b.names = make(map[uint64]_TopicName)
+		}
+		b.names[e.entry.topicHash] = _TopicName{contract: e.Contract, name: string(topicName(e.Topic))}
+	}
+	if b.counts == nil {
+		b.counts = make(map[uint32]int64)
+	}
+	b.counts[e.Contract]++
 
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(e.entry.cache)+4))
@@ -114,17 +197,27 @@ func (b *Batch) Delete(id, topic []byte) error {
 // not before.
 func (b *Batch) DeleteEntry(e *Entry) error {
 	switch {
+	case b.db == nil:
+		return ErrBatchClosed
 	case b.db.opts.flags.immutable:
-		return errImmutable
+		return ErrImmutable
 	case len(e.ID) == 0:
 		return errMsgIDEmpty
 	case len(e.Topic) == 0:
 		return errTopicEmpty
 	case len(e.Topic) > maxTopicLength:
 		return errTopicTooLarge
+	case b.full():
+		return ErrBatchFull
 	}
 
-	if err := b.db.setEntry(e); err != nil {
+	if err := b.db.encodeEntry(e); err != nil {
+		return err
+	}
+	if err := b.checkSize(e); err != nil {
+		return err
+	}
+	if err := b.db.commitEntry(e); err != nil {
 		return err
 	}
 
@@ -146,6 +239,66 @@ func (b *Batch) DeleteEntry(e *Entry) error {
 	return nil
 }
 
+// Get gets the message of the topic and ID from entries of the batch not yet written, the message
+// of the last entry of the batch with the ID is returned. If the batch has no entry with the ID then
+// it gets the message from the DB.
+func (b *Batch) Get(topic, id []byte) ([]byte, error) {
+	switch {
+	case b.db == nil:
+		return nil, ErrBatchClosed
+	case len(id) != message.ID(nil).Size():
+		return nil, errMsgIDSize
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	contract := b.opts.batchOptions.contract
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := b.db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(contract)
+	topicHash := t.GetHash(contract)
+	seq := message.ID(id).Sequence()
+
+	var e _Entry
+	for i := len(b.index) - 1; i >= 0; i-- {
+		off := b.index[i].offset
+		data, err := b.buffer.Slice(off, off+entrySize+4)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.UnmarshalBinary(data[4:]); err != nil {
+			return nil, err
+		}
+		if e.seq != seq {
+			continue
+		}
+		switch {
+		case e.topicHash != topicHash:
+			return nil, errMsgIDPrefixMismatch
+		case b.index[i].delFlag:
+			return nil, errMsgIDDoesNotExist
+		}
+		dataLen := int64(binary.LittleEndian.Uint32(data[:4]))
+		data, err = b.buffer.Slice(off+4+entrySize, off+dataLen)
+		if err != nil {
+			return nil, err
+		}
+		return b.db.decodeValue(data[:idSize], data[idSize+uint32(e.topicSize):])
+	}
+
+	items, err := b.db.Get(NewQuery(topic).WithContract(contract).WithID(id))
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
 func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error {
 	if err := b.db.ok(); err != nil {
 		return err
@@ -168,11 +321,10 @@ func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error
 			return err
 		}
 		if index.delFlag && e.seq != 0 {
-			/// Test filter block for presence.
-			if !b.db.internal.filter.Test(e.seq) {
-				return nil
+			// delete removes the entry from the memdb and tests the filter for the synced entry.
+			if err := b.db.delete(e.topicHash, e.seq); err != nil {
+				return err
 			}
-			b.db.delete(e.topicHash, e.seq)
 			continue
 		}
 
@@ -191,8 +343,35 @@ func (b *Batch) writeInternal(fn func(i int, e _Entry, data []byte) error) error
 	return nil
 }
 
+// conflict returns true if an entry of the batch has the message ID of an entry already written to the DB
+// or of an earlier entry of the batch.
+func (b *Batch) conflict() (bool, error) {
+	var e _Entry
+	seen := make(map[uint64]struct{}, len(b.index))
+	for _, index := range b.index {
+		if index.delFlag {
+			continue
+		}
+		data, err := b.buffer.Slice(index.offset+4, index.offset+entrySize+4)
+		if err != nil {
+			return false, err
+		}
+		if err := e.UnmarshalBinary(data); err != nil {
+			return false, err
+		}
+		if _, ok := seen[e.seq]; ok || b.db.exists(e.seq) {
+			return true, nil
+		}
+		seen[e.seq] = struct{}{}
+	}
+	return false, nil
+}
+
 // Write starts writing entries into DB. It returns an error if batch write fails.
 func (b *Batch) Write() error {
+	if b.db == nil {
+		return ErrBatchClosed
+	}
 	// write happens synchronously
 	b.writeLockC <- struct{}{}
 	defer func() {
@@ -201,10 +380,53 @@ func (b *Batch) Write() error {
 	if b.len() == 0 {
 		return nil
 	}
+	// A batch applying a replicated record is limited when the record is proposed.
+	var rate *_RateTake
+	if !b.replicated {
+		var err error
+		if rate, err = b.db.checkRate(b.counts); err != nil {
+			return err
+		}
+	}
+	// Entries of a replicated DB are written once the batch record is committed to the replicated log.
+	if r := b.db.opts.replicator; r != nil && !b.replicated {
+		record, err := b.record()
+		b.reset()
+		if err != nil {
+			return err
+		}
+		if err := r.Propose(record); err != nil {
+			return err
+		}
+		rate.take()
+		return nil
+	}
+	if err := b.db.waitMemdb(); err != nil {
+		return err
+	}
+	policy := b.opts.batchOptions.conflict
+	if policy != ConflictLastWriterWins {
+		b.db.internal.batchLock.Lock()
+		defer b.db.internal.batchLock.Unlock()
+	}
+	if policy == ConflictError {
+		conflict, err := b.conflict()
+		if err != nil {
+			return err
+		}
+		if conflict {
+			return ErrWriteConflict
+		}
+	}
 	topics := make(map[uint64]*message.Topic)
 	timeID := b.mem.TimeID()
 	var seqs []uint64
-	b.writeInternal(func(i int, e _Entry, data []byte) error {
+	written := make(map[uint64]struct{}, len(b.index))
+	err := b.writeInternal(func(i int, e _Entry, data []byte) error {
+		_, dup := written[e.seq]
+		if policy == ConflictFirstWriterWins && (dup || b.db.exists(e.seq)) {
+			return nil
+		}
 		if e.topicSize != 0 {
 			t, ok := topics[e.topicHash]
 			if !ok {
@@ -218,29 +440,54 @@ func (b *Batch) Write() error {
 		if err := b.mem.Put(e.seq, data); err != nil {
 			return err
 		}
+		if m, ok := b.pending[i]; ok {
+			b.written = append(b.written, m)
+		}
+		// The entry replaces an earlier entry of the batch with the same message ID, the message is already in the time window.
+		if dup {
+			return nil
+		}
 		if ok := b.db.internal.timeWindow.add(timeID, e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
-			return errForbidden
+			return ErrForbidden
 		}
+		b.db.internal.lastValues.set(e.topicHash, e.seq, e.expiresAt)
+		written[e.seq] = struct{}{}
 		seqs = append(seqs, e.seq)
 		return nil
 	})
 
-	b.mem.Write()
+	if err1 := b.mem.Write(); err1 != nil {
+		err = err1
+	}
+	if err == nil {
+		rate.take()
+	}
 	b.reset()
 
-	return nil
+	return err
 }
 
 // Commit commits changes to the DB. In batch operation commit is managed and client is not allowed to call Commit.
 // On Commit complete batch operation signal to the caller if the batch is fully committed to DB.
-func (b *Batch) Commit() error {
+func (b *Batch) Commit() (err error) {
 	_assert(!b.managed, "managed batch commit not allowed")
+	if b.db == nil {
+		return ErrBatchClosed
+	}
+	if err := b.db.startWrite(); err != nil {
+		b.done(err)
+		return err
+	}
 
-	b.db.internal.closeW.Add(1)
+	return b.commit()
+}
+
+// commit commits a batch registered as a write in progress by startWrite.
+func (b *Batch) commit() (err error) {
+	db := b.db
 	defer func() {
-		close(b.commitComplete)
-		b.db.internal.closeW.Done()
-		b.Abort()
+		b.done(err)
+		db.finishWrite()
 	}()
 
 	// Write if any pending entries in batch.
@@ -253,11 +500,69 @@ func (b *Batch) Commit() error {
 		return err
 	}
 
+	for _, m := range b.written {
+		b.db.internal.subscriptions.publish(b.db.internal.trie, m.topicHash, m.msg)
+	}
+
 	return nil
 }
 
+// CommitFuture is the pending commit of a batch returned by CommitAsync.
+type CommitFuture struct {
+	done chan struct{}
+	err  error
+}
+
+// Done returns a channel closed once the batch commit is complete.
+func (f *CommitFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err waits for the batch commit to complete and returns the commit error.
+func (f *CommitFuture) Err() error {
+	<-f.done
+	return f.err
+}
+
+// CommitAsync commits changes to the DB without waiting for the commit to complete. It returns
+// a future to wait on the commit and check the commit error. The batch must not be used afterwards.
+func (b *Batch) CommitAsync() *CommitFuture {
+	_assert(!b.managed, "managed batch commit not allowed")
+
+	f := &CommitFuture{done: make(chan struct{})}
+	if b.db == nil {
+		f.err = ErrBatchClosed
+		close(f.done)
+		return f
+	}
+	// The commit is registered before it is queued, so Close drains it.
+	if err := b.db.startWrite(); err != nil {
+		b.done(err)
+		f.err = err
+		close(f.done)
+		return f
+	}
+	go func() {
+		f.err = b.commit()
+		close(f.done)
+	}()
+	return f
+}
+
+// done completes the batch commit, it calls the commit callback and releases the batch.
+func (b *Batch) done(err error) {
+	if b.commitCallback != nil {
+		b.commitCallback(err)
+	}
+	close(b.commitComplete)
+	b.Abort()
+}
+
 func (b *Batch) reset() {
 	b.index = b.index[:0]
+	b.pending = nil
+	b.names = nil
+	b.counts = nil
 	b.size = 0
 	b.buffer.Reset()
 }
@@ -265,8 +570,12 @@ func (b *Batch) reset() {
 //Abort abort is a batch cleanup operation on batch complete.
 func (b *Batch) Abort() {
 	_assert(!b.managed, "managed batch abort not allowed")
+	if b.db == nil {
+		return
+	}
 
 	b.reset()
+	b.written = nil
 	b.mem.Abort()
 	b.db.internal.bufPool.Put(b.buffer)
 	b.db = nil
@@ -283,6 +592,25 @@ func (b *Batch) len() int {
 	return len(b.index)
 }
 
+// Size returns size in bytes of entries in the batch not yet written.
+func (b *Batch) Size() int64 {
+	return b.size
+}
+
+// full returns true if the batch has the maximum entries.
+func (b *Batch) full() bool {
+	return b.opts.batchOptions.maxEntries > 0 && b.len() >= b.opts.batchOptions.maxEntries
+}
+
+// checkSize checks the entry fits into the batch size limit. It is checked once the entry is encoded
+// and before it is committed, so an entry rejected does not lease a seq or add its topic.
+func (b *Batch) checkSize(e *Entry) error {
+	if b.opts.batchOptions.maxBytes > 0 && b.size+int64(len(e.entry.cache)+4) > b.opts.batchOptions.maxBytes {
+		return ErrBatchFull
+	}
+	return nil
+}
+
 // setManaged sets batch managed.
 func (b *Batch) setManaged() {
 	b.managed = true
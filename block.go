@@ -17,12 +17,9 @@
 package unitdb
 
 import (
-	"encoding/binary"
 	"fmt"
-)
 
-const (
-	blockSize int32 = 4096
+	"github.com/unit-io/unitdb/block"
 )
 
 type (
@@ -31,11 +28,15 @@ type (
 		topicSize uint16
 		valueSize uint32
 		msgOffset int64
+		// valueLog is set if the value is stored in the value log, the data file holds the value pointer.
+		valueLog bool
+		// chunked is set if the value is stored in chunks, the message holds the value pointers of the chunks.
+		chunked bool
 
 		cache []byte // block from memdb if it exist
 	}
 	_IndexBlock struct {
-		entries  [entriesPerIndexBlock]_IndexEntry
+		entries  []_IndexEntry
 		baseSeq  uint64
 		entryIdx uint16
 
@@ -44,70 +45,112 @@ type (
 	}
 )
 
-func blockIndex(seq uint64) int32 {
-	return int32(float64(seq-1) / float64(entriesPerIndexBlock))
+// blockSize returns size of the blocks of the index or window file.
+func (f *_File) blockSize() int64 {
+	return int64(f.layout.Size)
 }
 
-func blockOffset(idx int32) int64 {
-	if idx == -1 {
-		return int64(0)
-	}
-	return int64(blockSize * idx)
+// blockIndex returns index of the index block of the sequence.
+func (f *_File) blockIndex(seq uint64) int32 {
+	return f.layout.Index(seq)
+}
+
+// blockOffset returns offset of the block at index.
+func (f *_File) blockOffset(idx int32) int64 {
+	return f.layout.Offset(idx)
+}
+
+// newIndexBlock returns an empty index block of the layout of the index file.
+func (f *_File) newIndexBlock() _IndexBlock {
+	return _IndexBlock{entries: make([]_IndexEntry, f.layout.EntriesPerIndexBlock)}
 }
 
+// mSize returns size of the message in the data file, see block.IndexEntry.MessageSize.
 func (e _IndexEntry) mSize() uint32 {
-	return idSize + uint32(e.topicSize) + e.valueSize
+	return block.IndexEntry{TopicSize: e.topicSize, ValueSize: e.valueSize, ValueLog: e.valueLog, Chunked: e.chunked}.MessageSize()
+}
+
+// isDeleted checks whether the entry was deleted. A deleted entry carrying the topic keeps
+// its offset with zero value size so that the topic can be read to load the trie.
+func (e _IndexEntry) isDeleted() bool {
+	return e.msgOffset == -1 || e.valueSize == 0
+}
+
+// tombstone marks the entry deleted and returns offset and size of the data block to free.
+func (e *_IndexEntry) tombstone() (int64, uint32) {
+	if e.topicSize != 0 {
+		// The value is freed with checksum of the message. A value stored in the value log is
+		// reclaimed by compaction, the value pointer is freed in the data file. Chunks of a value
+		// are freed by the caller.
+		off, size := e.msgOffset+int64(idSize)+int64(e.topicSize), e.mSize()-idSize-uint32(e.topicSize)
+		e.valueSize = 0
+		e.valueLog = false
+		e.chunked = false
+		return off, size
+	}
+	off, size := e.msgOffset, e.mSize()
+	e.msgOffset = -1
+	return off, size
 }
 
 func (b _IndexBlock) validation(blockIdx int32) error {
-	bIdx := blockIndex(b.entries[0].seq)
+	bIdx := int32((b.entries[0].seq - 1) / uint64(len(b.entries)))
 	if bIdx != blockIdx {
 		return fmt.Errorf("validation failed blockIdx %d, startBlockIdx %d", blockIdx, bIdx)
 	}
 	return nil
 }
 
-// marshalBinary serialized entries block into binary data.
+// marshalBinary serialized entries block into binary data, see block.IndexBlock.
 func (b _IndexBlock) marshalBinary() []byte {
-	buf := make([]byte, blockSize)
-	data := buf
-
-	b.baseSeq = b.entries[0].seq
-	binary.LittleEndian.PutUint64(buf[:8], b.baseSeq)
-	buf = buf[8:]
-	for i := 0; i < entriesPerIndexBlock; i++ {
-		s := b.entries[i]
-		seq := uint16(0)
-		if s.seq != 0 {
-			seq = uint16(int16(s.seq-b.baseSeq) + entriesPerIndexBlock)
-		}
-		binary.LittleEndian.PutUint16(buf[:2], seq) // marshal relative seq
-		binary.LittleEndian.PutUint16(buf[2:4], s.topicSize)
-		binary.LittleEndian.PutUint32(buf[4:8], s.valueSize)
-		binary.LittleEndian.PutUint64(buf[8:16], uint64(s.msgOffset))
-		buf = buf[16:]
+	ib := block.IndexBlock{Entries: make([]block.IndexEntry, len(b.entries))}
+	for i, e := range b.entries {
+		ib.Entries[i] = block.IndexEntry{Seq: e.seq, TopicSize: e.topicSize, ValueSize: e.valueSize, MsgOffset: e.msgOffset, ValueLog: e.valueLog, Chunked: e.chunked}
 	}
-	binary.LittleEndian.PutUint16(buf[:2], b.entryIdx)
+	ib.EntryIdx = b.entryIdx
+	data, _ := ib.MarshalBinary()
 	return data
 }
 
-// unmarshalBinary de-serialized entries block from binary data.
+// unmarshalBinary de-serialized entries block from binary data, see block.IndexBlock.
+// The layout of the block is of the size of the data.
 func (b *_IndexBlock) unmarshalBinary(data []byte) error {
-	b.baseSeq = binary.LittleEndian.Uint64(data[:8])
-	data = data[8:]
-	for i := 0; i < entriesPerIndexBlock; i++ {
-		_ = data[16] // bounds check hint to compiler; see golang.org/issue/14808
-		seq := int16(binary.LittleEndian.Uint16(data[:2]))
-		if seq == 0 {
-			b.entries[i].seq = uint64(seq)
-		} else {
-			b.entries[i].seq = b.baseSeq + uint64(seq) - entriesPerIndexBlock // unmarshal from relative sequence
-		}
-		b.entries[i].topicSize = binary.LittleEndian.Uint16(data[2:4])
-		b.entries[i].valueSize = binary.LittleEndian.Uint32(data[4:8])
-		b.entries[i].msgOffset = int64(binary.LittleEndian.Uint64(data[8:16]))
-		data = data[16:]
+	layout, err := block.NewLayout(int32(len(data)))
+	if err != nil {
+		return err
+	}
+	ib := layout.NewIndexBlock()
+	if err := ib.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	b.setBlock(ib)
+	return nil
+}
+
+// unmarshalTorn de-serialized entries of an index block torn by a crash, see block.IndexBlock.UnmarshalTorn.
+func (b *_IndexBlock) unmarshalTorn(data []byte) error {
+	layout, err := block.NewLayout(int32(len(data)))
+	if err != nil {
+		return err
+	}
+	ib := layout.NewIndexBlock()
+	if err := ib.UnmarshalTorn(data); err != nil {
+		return err
 	}
-	b.entryIdx = binary.LittleEndian.Uint16(data[:2])
+	b.setBlock(ib)
 	return nil
 }
+
+func (b *_IndexBlock) setBlock(ib block.IndexBlock) {
+	b.baseSeq = ib.BaseSeq
+	b.entries = make([]_IndexEntry, len(ib.Entries))
+	for i, e := range ib.Entries {
+		b.entries[i].seq = e.Seq
+		b.entries[i].topicSize = e.TopicSize
+		b.entries[i].valueSize = e.ValueSize
+		b.entries[i].msgOffset = e.MsgOffset
+		b.entries[i].valueLog = e.ValueLog
+		b.entries[i].chunked = e.Chunked
+	}
+	b.entryIdx = ib.EntryIdx
+}
@@ -0,0 +1,578 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package block decodes the index, data and window files of a DB, so tools can read
+// the files of a DB without opening the DB. The format of the files is stable, a change
+// to it changes version of the DB.
+//
+// The files of a DB are in the DB directory:
+//
+//	index/unitdb0000.index   index blocks, entry of a message is found by its sequence.
+//	data/unitdb0000.data     messages at offsets stored in their index entries.
+//	data/unitdb0000.vlog     value log, large values of messages if the DB stores values in the value log.
+//	window/unitdb0000.win    window blocks, the sequences of a topic in time order.
+//	unitdb.info              DB info, the block size of the DB is at InfoBlockSizeOffset.
+//
+// All integers are little endian. Index and window files are a sequence of blocks of the block size
+// of the DB, Size bytes unless the DB was created with another block size, see Layout. The offsets
+// below are of a block of Size bytes, a larger block holds more entries.
+// Blocks and messages end with a CRC-32 checksum (Castagnoli polynomial) of their data. A block of
+// zero bytes has zero checksum, it is a block the DB allocated but not yet written.
+//
+// An index block holds the entries of EntriesPerIndexBlock sequences, entry of the sequence
+// seq is in the block at index (seq-1)/EntriesPerIndexBlock:
+//
+//	0:8        sequence of the first entry of the block.
+//	8:4088     EntriesPerIndexBlock entries of 16 bytes.
+//	4088:4090  number of entries in the block.
+//	4090:4094  checksum of bytes 0:4090.
+//
+// An index entry:
+//
+//	0:2   sequence relative to the first entry of the block plus EntriesPerIndexBlock, 0 if the entry is empty.
+//	2:4   size of the topic, the topic is stored with the first message of a topic only.
+//	4:8   size of the value, 0 if the message is deleted and its topic is kept. The high bit is set if
+//	      the value is stored in the value log, the next bit is set if the value is stored in chunks.
+//	8:16  offset of the message in the data file, -1 if the message is deleted.
+//
+// A message in the data file is its ID of IDSize bytes, followed by the topic, the value and
+// the checksum of ID, topic and value. The low 7 bits of the last byte of the ID are version of the
+// encryption key of the value, 0 if the value is not encrypted, and the high bit is set if the value
+// starts with the headers of the message. The value is encoded by the codec of the DB, then encrypted. The value and the checksum of a deleted message that keeps its topic are freed.
+//
+// A message with the value stored in the value log holds a value pointer of ValuePointerSize bytes
+// in place of the value, the offset (0:8) and the size (8:12) of the value in the value log. The value
+// log is a sequence of values, each followed by the checksum of the value.
+//
+// A value larger than ChunkSize that is not stored in the value log is stored in chunks of ChunkSize
+// bytes in the data file, the last chunk holds the rest of the value. Each chunk is followed by the
+// checksum of the chunk. The message holds the value pointers of the chunks in place of the value,
+// in order of the chunks, see ChunkCount.
+//
+// A window block holds the sequences of a topic, the window blocks of a topic are linked
+// from the most recent block:
+//
+//	0:4020     EntriesPerWindowBlock entries of 12 bytes, sequence (0:8) and expiry time in unix seconds (8:12).
+//	4020:4028  cutoff time in unix seconds, time the block was filled.
+//	4028:4036  hash of the topic.
+//	4036:4044  offset of the previous window block of the topic, 0 for the oldest block.
+//	4044:4046  number of entries in the block.
+//	4046:4050  checksum of bytes 0:4046.
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	// Size is the default size of index and window blocks.
+	Size = 4096
+
+	// MinSize and MaxSize bound the block size of a DB, the block size is a power of two.
+	MinSize = 1 << 10
+	MaxSize = 1 << 16
+
+	// EntriesPerIndexBlock is the number of entries of an index block of Size bytes.
+	EntriesPerIndexBlock = 255 // (4096 i.e blocksize - 14 fixed/16 i.e entry size)
+
+	// EntriesPerWindowBlock is the number of entries of a window block of Size bytes.
+	EntriesPerWindowBlock = 335 // ((4096 i.e. blocksize - 26 fixed)/12 i.e. window entry size)
+
+	// IDSize is the size of message ID prefix stored with a message, with the encryption key version.
+	IDSize = 9
+
+	// KeyVersionMask masks version of the encryption key in the last byte of the message ID.
+	KeyVersionMask = 0x3f
+
+	// DictionaryFlag is set in the last byte of the message ID if the payload is compressed with a dictionary,
+	// the payload then starts with the uvarint ID of the dictionary.
+	DictionaryFlag = 0x40
+
+	// HeadersFlag is set in the last byte of the message ID if the value starts with headers of the message.
+	HeadersFlag = 0x80
+
+	// ChecksumSize is the size of the checksum of a block or a message.
+	ChecksumSize = 4
+
+	// ValuePointerSize is the size of the value pointer stored in the data file in place of a value
+	// stored in the value log.
+	ValuePointerSize = 12
+
+	// ChunkSize is the size of chunks of a value stored in chunks in the data file.
+	ChunkSize = 64 << 10
+
+	// valueLogFlag is set in the value size of an index entry of a message with the value stored in the value log.
+	valueLogFlag = 1 << 31
+
+	// chunkFlag is set in the value size of an index entry of a message with the value stored in chunks.
+	chunkFlag = 1 << 30
+
+	// MaxValueSize is the size of the largest value, the high bits of the value size of an index entry are flags.
+	MaxValueSize = chunkFlag - 1
+
+	// InfoBlockSizeOffset is the offset of the block size of the DB in the info file,
+	// a uint32 which is zero if the DB is of blocks of Size bytes.
+	InfoBlockSizeOffset = 28
+
+	// indexFixedSize and windowFixedSize are sizes of the fields of a block other than its entries.
+	indexFixedSize  = 8 + 2
+	windowFixedSize = 26
+)
+
+var (
+	errShortBlock = errors.New("block: block is shorter than block size")
+
+	// ErrBlockSize is returned by NewLayout if the block size is not a power of two between MinSize and MaxSize.
+	ErrBlockSize = errors.New("block: invalid block size")
+
+	// ErrChecksum is returned if checksum of a block or a message does not match its data.
+	ErrChecksum = errors.New("block: checksum mismatch")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// CorruptionError is returned by readers if checksum of a block or a message does not match its data.
+type CorruptionError struct {
+	File   string // File is index, data, vlog or window.
+	Offset int64  // Offset of the block or the message in the file.
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("block: %s file is corrupted at offset %d, checksum mismatch", e.File, e.Offset)
+}
+
+// Unwrap returns ErrChecksum, so errors.Is(err, ErrChecksum) reports a CorruptionError.
+func (e *CorruptionError) Unwrap() error {
+	return ErrChecksum
+}
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// putChecksum puts checksum of the first n bytes of the block after these.
+func putChecksum(data []byte, n int) {
+	binary.LittleEndian.PutUint32(data[n:n+ChecksumSize], checksum(data[:n]))
+}
+
+// verifyChecksum verifies checksum of the first n bytes of the block, a block of zero bytes is not written.
+func verifyChecksum(data []byte, n int) error {
+	sum := binary.LittleEndian.Uint32(data[n : n+ChecksumSize])
+	if sum == checksum(data[:n]) {
+		return nil
+	}
+	if sum == 0 {
+		for _, c := range data[:n] {
+			if c != 0 {
+				return ErrChecksum
+			}
+		}
+		return nil
+	}
+	return ErrChecksum
+}
+
+// AppendChecksum appends checksum of the message to the message, as the message is stored in the data file.
+func AppendChecksum(msg []byte) []byte {
+	var buf [ChecksumSize]byte
+	binary.LittleEndian.PutUint32(buf[:], checksum(msg))
+	return append(msg, buf[:]...)
+}
+
+// VerifyMessage verifies checksum of the message read from the data file and returns the message without its checksum.
+func VerifyMessage(data []byte) ([]byte, error) {
+	if len(data) < ChecksumSize {
+		return nil, ErrChecksum
+	}
+	msg := data[:len(data)-ChecksumSize]
+	if binary.LittleEndian.Uint32(data[len(msg):]) != checksum(msg) {
+		return nil, ErrChecksum
+	}
+	return msg, nil
+}
+
+// ValuePointer is the offset and size of a value stored in the value log. A value is stored in the
+// value log followed by its checksum, the message in the data file holds the value pointer instead.
+type ValuePointer struct {
+	Offset int64
+	Size   uint32
+}
+
+// MarshalBinary serializes the value pointer into binary data.
+func (p ValuePointer) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, ValuePointerSize)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(p.Offset))
+	binary.LittleEndian.PutUint32(buf[8:12], p.Size)
+	return buf, nil
+}
+
+// UnmarshalBinary de-serializes the value pointer from binary data.
+func (p *ValuePointer) UnmarshalBinary(data []byte) error {
+	if len(data) != ValuePointerSize {
+		return ErrChecksum
+	}
+	p.Offset = int64(binary.LittleEndian.Uint64(data[:8]))
+	p.Size = binary.LittleEndian.Uint32(data[8:12])
+	return nil
+}
+
+// Layout is the block size of a DB and the number of entries of its index and window blocks.
+type Layout struct {
+	Size                  int32
+	EntriesPerIndexBlock  int
+	EntriesPerWindowBlock int
+}
+
+// DefaultLayout is the layout of blocks of Size bytes.
+var DefaultLayout = Layout{Size: Size, EntriesPerIndexBlock: EntriesPerIndexBlock, EntriesPerWindowBlock: EntriesPerWindowBlock}
+
+// NewLayout returns the layout of blocks of the size. It returns ErrBlockSize if the size is not
+// a power of two between MinSize and MaxSize.
+func NewLayout(size int32) (Layout, error) {
+	if size < MinSize || size > MaxSize || size&(size-1) != 0 {
+		return Layout{}, ErrBlockSize
+	}
+	if size == Size {
+		return DefaultLayout, nil
+	}
+	return Layout{
+		Size:                  size,
+		EntriesPerIndexBlock:  int(size-indexFixedSize-ChecksumSize) / 16,
+		EntriesPerWindowBlock: int(size-windowFixedSize-ChecksumSize) / 12,
+	}, nil
+}
+
+// Index returns index of the index block of the sequence.
+func (l Layout) Index(seq uint64) int32 {
+	return int32((seq - 1) / uint64(l.EntriesPerIndexBlock))
+}
+
+// Offset returns offset of the block at index.
+func (l Layout) Offset(idx int32) int64 {
+	if idx == -1 {
+		return int64(0)
+	}
+	return int64(l.Size) * int64(idx)
+}
+
+// NewIndexBlock returns an empty index block of the layout.
+func (l Layout) NewIndexBlock() IndexBlock {
+	return IndexBlock{Entries: make([]IndexEntry, l.EntriesPerIndexBlock)}
+}
+
+// NewWindowBlock returns an empty window block of the layout.
+func (l Layout) NewWindowBlock() WindowBlock {
+	return WindowBlock{Entries: make([]WindowEntry, l.EntriesPerWindowBlock)}
+}
+
+// blockSize returns size of the block holding used bytes.
+func blockSize(used int) int {
+	size := MinSize
+	for size < used {
+		size <<= 1
+	}
+	return size
+}
+
+type (
+	// IndexEntry is the entry of a message in an index block. ValueLog is set if the value of
+	// the message is stored in the value log and Chunked if it is stored in chunks, ValueSize
+	// is the size of the value in either case.
+	IndexEntry struct {
+		Seq       uint64
+		TopicSize uint16
+		ValueSize uint32
+		MsgOffset int64
+		ValueLog  bool
+		Chunked   bool
+	}
+	// IndexBlock is a block of the index file. It holds the entries of a block of Size bytes
+	// unless it is created by Layout.NewIndexBlock.
+	IndexBlock struct {
+		Entries  []IndexEntry
+		BaseSeq  uint64
+		EntryIdx uint16
+	}
+)
+
+// Index returns index of the index block of the sequence in blocks of Size bytes.
+func Index(seq uint64) int32 {
+	return DefaultLayout.Index(seq)
+}
+
+// Offset returns offset of the block at index in blocks of Size bytes.
+func Offset(idx int32) int64 {
+	return DefaultLayout.Offset(idx)
+}
+
+// MessageSize returns size of the message in the data file, including its checksum unless the message is
+// deleted and keeps its topic.
+func (e IndexEntry) MessageSize() uint32 {
+	if e.ValueSize == 0 {
+		return IDSize + uint32(e.TopicSize)
+	}
+	if e.ValueLog {
+		return IDSize + uint32(e.TopicSize) + ValuePointerSize + ChecksumSize
+	}
+	if e.Chunked {
+		return IDSize + uint32(e.TopicSize) + uint32(ChunkCount(e.ValueSize))*ValuePointerSize + ChecksumSize
+	}
+	return IDSize + uint32(e.TopicSize) + e.ValueSize + ChecksumSize
+}
+
+// ChunkCount returns number of chunks of a value of the size stored in chunks.
+func ChunkCount(size uint32) int {
+	return int((size + ChunkSize - 1) / ChunkSize)
+}
+
+// UnmarshalChunks de-serializes value pointers of chunks of a value from the message in the data file.
+func UnmarshalChunks(data []byte) ([]ValuePointer, error) {
+	if len(data)%ValuePointerSize != 0 {
+		return nil, ErrChecksum
+	}
+	ptrs := make([]ValuePointer, len(data)/ValuePointerSize)
+	for i := range ptrs {
+		if err := ptrs[i].UnmarshalBinary(data[i*ValuePointerSize : (i+1)*ValuePointerSize]); err != nil {
+			return nil, err
+		}
+	}
+	return ptrs, nil
+}
+
+// IsDeleted checks whether the message was deleted. A deleted entry carrying the topic keeps
+// its offset with zero value size so that the topic can be read.
+func (e IndexEntry) IsDeleted() bool {
+	return e.MsgOffset == -1 || e.ValueSize == 0
+}
+
+// MarshalBinary serializes index block into binary data.
+func (b IndexBlock) MarshalBinary() ([]byte, error) {
+	if b.Entries == nil {
+		b.Entries = make([]IndexEntry, EntriesPerIndexBlock)
+	}
+	n := len(b.Entries)
+	buf := make([]byte, blockSize(indexFixedSize+n*16+ChecksumSize))
+	data := buf
+
+	b.BaseSeq = b.Entries[0].Seq
+	binary.LittleEndian.PutUint64(buf[:8], b.BaseSeq)
+	buf = buf[8:]
+	for i := 0; i < n; i++ {
+		s := b.Entries[i]
+		seq := uint16(0)
+		if s.Seq != 0 {
+			seq = uint16(int(s.Seq-b.BaseSeq) + n)
+		}
+		binary.LittleEndian.PutUint16(buf[:2], seq) // marshal relative seq
+		binary.LittleEndian.PutUint16(buf[2:4], s.TopicSize)
+		valueSize := s.ValueSize
+		if s.ValueLog {
+			valueSize |= valueLogFlag
+		}
+		if s.Chunked {
+			valueSize |= chunkFlag
+		}
+		binary.LittleEndian.PutUint32(buf[4:8], valueSize)
+		binary.LittleEndian.PutUint64(buf[8:16], uint64(s.MsgOffset))
+		buf = buf[16:]
+	}
+	binary.LittleEndian.PutUint16(buf[:2], b.EntryIdx)
+	putChecksum(data, indexFixedSize+n*16)
+	return data, nil
+}
+
+// UnmarshalBinary de-serializes index block from binary data. The block is of the layout of its entries,
+// a block without entries is of Size bytes. It returns ErrChecksum if checksum of the block does not match.
+func (b *IndexBlock) UnmarshalBinary(data []byte) error {
+	if b.Entries == nil {
+		b.Entries = make([]IndexEntry, EntriesPerIndexBlock)
+	}
+	n := len(b.Entries)
+	if len(data) < blockSize(indexFixedSize+n*16+ChecksumSize) {
+		return errShortBlock
+	}
+	if err := verifyChecksum(data, indexFixedSize+n*16); err != nil {
+		return err
+	}
+	b.unmarshal(data)
+	return nil
+}
+
+// UnmarshalTorn de-serializes an index block torn by a crash without verifying its checksum. A block is
+// rewritten in place as entries are appended to it, so entries up to the entry index of the block are
+// the entries it held before it was torn. Entries past the entry index or a zero sequence are cleared.
+func (b *IndexBlock) UnmarshalTorn(data []byte) error {
+	if b.Entries == nil {
+		b.Entries = make([]IndexEntry, EntriesPerIndexBlock)
+	}
+	if len(data) < blockSize(indexFixedSize+len(b.Entries)*16+ChecksumSize) {
+		return errShortBlock
+	}
+	b.unmarshal(data)
+	n := 0
+	for n < int(b.EntryIdx) && n < len(b.Entries) && b.Entries[n].Seq != 0 {
+		n++
+	}
+	for i := n; i < len(b.Entries); i++ {
+		b.Entries[i] = IndexEntry{}
+	}
+	b.EntryIdx = uint16(n)
+	return nil
+}
+
+func (b *IndexBlock) unmarshal(data []byte) {
+	n := len(b.Entries)
+	b.BaseSeq = binary.LittleEndian.Uint64(data[:8])
+	data = data[8:]
+	for i := 0; i < n; i++ {
+		_ = data[16] // bounds check hint to compiler; see golang.org/issue/14808
+		seq := binary.LittleEndian.Uint16(data[:2])
+		if seq == 0 {
+			b.Entries[i].Seq = uint64(seq)
+		} else {
+			b.Entries[i].Seq = b.BaseSeq + uint64(seq) - uint64(n) // unmarshal from relative sequence
+		}
+		b.Entries[i].TopicSize = binary.LittleEndian.Uint16(data[2:4])
+		valueSize := binary.LittleEndian.Uint32(data[4:8])
+		b.Entries[i].ValueSize = valueSize &^ (valueLogFlag | chunkFlag)
+		b.Entries[i].ValueLog = valueSize&valueLogFlag != 0
+		b.Entries[i].Chunked = valueSize&chunkFlag != 0
+		b.Entries[i].MsgOffset = int64(binary.LittleEndian.Uint64(data[8:16]))
+		data = data[16:]
+	}
+	b.EntryIdx = binary.LittleEndian.Uint16(data[:2])
+}
+
+type (
+	// WindowEntry is the entry of a message in a window block.
+	WindowEntry struct {
+		Seq       uint64
+		ExpiresAt uint32
+	}
+	// WindowBlock is a block of the window file. It holds the entries of a block of Size bytes
+	// unless it is created by Layout.NewWindowBlock.
+	WindowBlock struct {
+		TopicHash  uint64
+		Entries    []WindowEntry
+		Next       int64
+		CutoffTime int64
+		EntryIdx   uint16
+	}
+)
+
+// IsExpired checks whether the message of the entry is expired.
+func (e WindowEntry) IsExpired() bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= uint32(time.Now().Unix())
+}
+
+// MarshalBinary serializes window block into binary data.
+func (b WindowBlock) MarshalBinary() ([]byte, error) {
+	if b.Entries == nil {
+		b.Entries = make([]WindowEntry, EntriesPerWindowBlock)
+	}
+	n := len(b.Entries)
+	buf := make([]byte, blockSize(windowFixedSize+n*12+ChecksumSize))
+	data := buf
+	for i := 0; i < n; i++ {
+		e := b.Entries[i]
+		binary.LittleEndian.PutUint64(buf[:8], e.Seq)
+		binary.LittleEndian.PutUint32(buf[8:12], e.ExpiresAt)
+		buf = buf[12:]
+	}
+	binary.LittleEndian.PutUint64(buf[:8], uint64(b.CutoffTime))
+	binary.LittleEndian.PutUint64(buf[8:16], b.TopicHash)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(b.Next))
+	binary.LittleEndian.PutUint16(buf[24:26], b.EntryIdx)
+	putChecksum(data, windowFixedSize+n*12)
+	return data, nil
+}
+
+// UnmarshalBinary de-serializes window block from binary data. The block is of the layout of its entries,
+// a block without entries is of Size bytes. It returns ErrChecksum if checksum of the block does not match.
+func (b *WindowBlock) UnmarshalBinary(data []byte) error {
+	if b.Entries == nil {
+		b.Entries = make([]WindowEntry, EntriesPerWindowBlock)
+	}
+	n := len(b.Entries)
+	if len(data) < blockSize(windowFixedSize+n*12+ChecksumSize) {
+		return errShortBlock
+	}
+	if err := verifyChecksum(data, windowFixedSize+n*12); err != nil {
+		return err
+	}
+	b.unmarshal(data)
+	return nil
+}
+
+// UnmarshalTorn de-serializes a window block torn by a crash without verifying its checksum, see IndexBlock.UnmarshalTorn.
+func (b *WindowBlock) UnmarshalTorn(data []byte) error {
+	if b.Entries == nil {
+		b.Entries = make([]WindowEntry, EntriesPerWindowBlock)
+	}
+	if len(data) < blockSize(windowFixedSize+len(b.Entries)*12+ChecksumSize) {
+		return errShortBlock
+	}
+	b.unmarshal(data)
+	n := 0
+	for n < int(b.EntryIdx) && n < len(b.Entries) && b.Entries[n].Seq != 0 {
+		n++
+	}
+	for i := n; i < len(b.Entries); i++ {
+		b.Entries[i] = WindowEntry{}
+	}
+	b.EntryIdx = uint16(n)
+	return nil
+}
+
+func (b *WindowBlock) unmarshal(data []byte) {
+	n := len(b.Entries)
+	for i := 0; i < n; i++ {
+		_ = data[12] // bounds check hint to compiler; see golang.org/issue/14808.
+		b.Entries[i].Seq = binary.LittleEndian.Uint64(data[:8])
+		b.Entries[i].ExpiresAt = binary.LittleEndian.Uint32(data[8:12])
+		data = data[12:]
+	}
+	b.CutoffTime = int64(binary.LittleEndian.Uint64(data[:8]))
+	b.TopicHash = binary.LittleEndian.Uint64(data[8:16])
+	b.Next = int64(binary.LittleEndian.Uint64(data[16:24]))
+	b.EntryIdx = binary.LittleEndian.Uint16(data[24:26])
+}
+
+// Message is a message read from the data file.
+type Message struct {
+	ID    []byte // ID is the message ID prefix of IDSize bytes.
+	Topic []byte // Topic is the topic marshaled by message.Topic, it is stored with the first message of a topic only.
+	Value []byte // Value is the value encoded by the codec of the DB and encrypted if the key version is not zero.
+}
+
+// KeyVersion returns version of the encryption key of the value, or zero if the value is not encrypted.
+func (m Message) KeyVersion() uint8 {
+	return m.ID[IDSize-1] & KeyVersionMask
+}
+
+// HasHeaders returns true if the value starts with headers of the message.
+func (m Message) HasHeaders() bool {
+	return m.ID[IDSize-1]&HeadersFlag != 0
+}
+
+// HasDictionary returns true if the payload is compressed with a dictionary.
+func (m Message) HasDictionary() bool {
+	return m.ID[IDSize-1]&DictionaryFlag != 0
+}
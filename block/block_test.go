@@ -0,0 +1,232 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package block
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestIndexBlock(t *testing.T) {
+	b := DefaultLayout.NewIndexBlock()
+	for i := 0; i < 10; i++ {
+		b.Entries[i] = IndexEntry{Seq: uint64(256 + i), TopicSize: uint16(i), ValueSize: uint32(10 * i), MsgOffset: int64(100 * i)}
+	}
+	b.Entries[3].MsgOffset = -1
+	b.Entries[5].ValueLog = true
+	b.EntryIdx = 10
+	data, err := b.MarshalBinary()
+	if err != nil || len(data) != Size {
+		t.Fatalf("expected block of %d bytes; got %d, %v", Size, len(data), err)
+	}
+	var got IndexBlock
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	b.BaseSeq = b.Entries[0].Seq
+	if !reflect.DeepEqual(got, b) {
+		t.Fatalf("expected %+v; got %+v", b.Entries[:b.EntryIdx], got.Entries[:got.EntryIdx])
+	}
+	if !got.Entries[3].IsDeleted() || got.Entries[4].IsDeleted() {
+		t.Fatal("expected only entry 3 deleted")
+	}
+	if got.Entries[5].MessageSize() != IDSize+5+ValuePointerSize+ChecksumSize {
+		t.Fatalf("expected message of entry 5 to hold the value pointer; got %d bytes", got.Entries[5].MessageSize())
+	}
+	if Index(256) != 1 || Offset(Index(256)) != Size {
+		t.Fatalf("expected seq 256 in second block; got %d", Index(256))
+	}
+	if err := got.UnmarshalBinary(data[:Size-1]); err != errShortBlock {
+		t.Fatalf("expected short block error; got %v", err)
+	}
+}
+
+func TestWindowBlock(t *testing.T) {
+	b := DefaultLayout.NewWindowBlock()
+	b.TopicHash, b.Next, b.CutoffTime, b.EntryIdx = 42, 2*Size, 1600000000, 2
+	b.Entries[0] = WindowEntry{Seq: 1, ExpiresAt: 1}
+	b.Entries[1] = WindowEntry{Seq: 2}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got WindowBlock
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, b) {
+		t.Fatalf("expected %+v; got %+v", b.Entries[:b.EntryIdx], got.Entries[:got.EntryIdx])
+	}
+	if !got.Entries[0].IsExpired() || got.Entries[1].IsExpired() {
+		t.Fatal("expected only entry 0 expired")
+	}
+}
+
+func TestTornBlock(t *testing.T) {
+	b := DefaultLayout.NewIndexBlock()
+	for i := 0; i < 5; i++ {
+		b.Entries[i] = IndexEntry{Seq: uint64(256 + i), ValueSize: 10, MsgOffset: int64(100 * i)}
+	}
+	b.EntryIdx = 5
+	old, _ := b.MarshalBinary()
+	for i := 5; i < 8; i++ {
+		b.Entries[i] = IndexEntry{Seq: uint64(256 + i), ValueSize: 10, MsgOffset: int64(100 * i)}
+	}
+	b.EntryIdx = 8
+	data, _ := b.MarshalBinary()
+	// The block is torn in the entry 7 as it is rewritten, its entry index is of the old block.
+	torn := append(data[:8+6*16+4:8+6*16+4], old[8+6*16+4:]...)
+	var got IndexBlock
+	if err := got.UnmarshalBinary(torn); err != ErrChecksum {
+		t.Fatalf("expected checksum error; got %v", err)
+	}
+	if err := got.UnmarshalTorn(torn); err != nil {
+		t.Fatal(err)
+	}
+	if got.EntryIdx != 5 || !reflect.DeepEqual(got.Entries[:5], b.Entries[:5]) || got.Entries[5] != (IndexEntry{}) {
+		t.Fatalf("expected 5 entries of the old block; got %+v", got.Entries[:8])
+	}
+
+	w := DefaultLayout.NewWindowBlock()
+	w.TopicHash, w.EntryIdx = 42, 2
+	w.Entries[0], w.Entries[1] = WindowEntry{Seq: 1}, WindowEntry{Seq: 2}
+	old, _ = w.MarshalBinary()
+	w.Entries[2], w.EntryIdx = WindowEntry{Seq: 3}, 3
+	data, _ = w.MarshalBinary()
+	torn = append(data[:2*12+4:2*12+4], old[2*12+4:]...)
+	var gotw WindowBlock
+	if err := gotw.UnmarshalTorn(torn); err != nil {
+		t.Fatal(err)
+	}
+	if gotw.EntryIdx != 2 || gotw.TopicHash != 42 || gotw.Entries[2] != (WindowEntry{}) {
+		t.Fatalf("expected 2 entries of the old block; got %+v", gotw)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	b := DefaultLayout.NewIndexBlock()
+	b.EntryIdx = 1
+	b.Entries[0] = IndexEntry{Seq: 1, ValueSize: 10}
+	data, _ := b.MarshalBinary()
+	data[20] ^= 0xff
+	if err := b.UnmarshalBinary(data); err != ErrChecksum {
+		t.Fatalf("expected checksum mismatch; got %v", err)
+	}
+	// A block of zero bytes is a block not yet written.
+	if err := b.UnmarshalBinary(make([]byte, Size)); err != nil {
+		t.Fatal(err)
+	}
+	var wb WindowBlock
+	if err := wb.UnmarshalBinary(make([]byte, Size)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("message")
+	stored := AppendChecksum(append([]byte(nil), msg...))
+	if got, err := VerifyMessage(stored); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expected %s; got %s, %v", msg, got, err)
+	}
+	stored[0] ^= 0xff
+	if _, err := VerifyMessage(stored); err != ErrChecksum {
+		t.Fatalf("expected checksum mismatch; got %v", err)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	for _, size := range []int32{0, MinSize / 2, 3000, 2 * MaxSize} {
+		if _, err := NewLayout(size); err != ErrBlockSize {
+			t.Fatalf("expected block size error for %d; got %v", size, err)
+		}
+	}
+	l, err := NewLayout(Size)
+	if err != nil || l != DefaultLayout {
+		t.Fatalf("expected default layout; got %+v, %v", l, err)
+	}
+	for _, size := range []int32{MinSize, 16 << 10, MaxSize} {
+		l, err := NewLayout(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := l.NewIndexBlock()
+		n := l.EntriesPerIndexBlock
+		for i := 0; i < n; i++ {
+			b.Entries[i] = IndexEntry{Seq: uint64(n + 1 + i), MsgOffset: int64(i)}
+		}
+		b.EntryIdx = uint16(n)
+		data, err := b.MarshalBinary()
+		if err != nil || len(data) != int(size) {
+			t.Fatalf("expected block of %d bytes; got %d, %v", size, len(data), err)
+		}
+		got := l.NewIndexBlock()
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		b.BaseSeq = b.Entries[0].Seq
+		if !reflect.DeepEqual(got, b) {
+			t.Fatalf("expected index block of %d bytes to round trip", size)
+		}
+		if l.Index(uint64(n+1)) != 1 || l.Offset(1) != int64(size) {
+			t.Fatalf("expected seq %d in second block of %d bytes; got %d", n+1, size, l.Index(uint64(n+1)))
+		}
+
+		wb := l.NewWindowBlock()
+		wb.Entries[len(wb.Entries)-1] = WindowEntry{Seq: 1}
+		wb.EntryIdx = uint16(len(wb.Entries))
+		if data, err = wb.MarshalBinary(); err != nil || len(data) != int(size) {
+			t.Fatalf("expected window block of %d bytes; got %d, %v", size, len(data), err)
+		}
+		gotw := l.NewWindowBlock()
+		if err := gotw.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(gotw, wb) {
+			t.Fatalf("expected window block of %d bytes to round trip; got %v", size, err)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	if ChunkCount(ChunkSize) != 1 || ChunkCount(ChunkSize+1) != 2 {
+		t.Fatalf("expected 1 and 2 chunks; got %d and %d", ChunkCount(ChunkSize), ChunkCount(ChunkSize+1))
+	}
+	b := DefaultLayout.NewIndexBlock()
+	b.Entries[0] = IndexEntry{Seq: 1, TopicSize: 5, ValueSize: 2*ChunkSize + 1, MsgOffset: 100, Chunked: true}
+	b.EntryIdx = 1
+	data, _ := b.MarshalBinary()
+	got := DefaultLayout.NewIndexBlock()
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	e := got.Entries[0]
+	if !e.Chunked || e.ValueLog || e.ValueSize != 2*ChunkSize+1 {
+		t.Fatalf("expected chunked entry; got %+v", e)
+	}
+	if e.MessageSize() != IDSize+5+3*ValuePointerSize+ChecksumSize {
+		t.Fatalf("expected message to hold 3 value pointers; got %d bytes", e.MessageSize())
+	}
+
+	var ptrs []byte
+	for i := 0; i < 3; i++ {
+		ptr, _ := ValuePointer{Offset: int64(i * ChunkSize), Size: ChunkSize}.MarshalBinary()
+		ptrs = append(ptrs, ptr...)
+	}
+	p, err := UnmarshalChunks(ptrs)
+	if err != nil || len(p) != 3 || p[2].Offset != 2*ChunkSize {
+		t.Fatalf("expected 3 value pointers; got %+v, %v", p, err)
+	}
+	if _, err := UnmarshalChunks(ptrs[1:]); err != ErrChecksum {
+		t.Fatalf("expected checksum mismatch; got %v", err)
+	}
+}
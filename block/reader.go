@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+var errEntryNotFound = errors.New("block: entry not found")
+
+// Reader reads blocks and messages from the files of a DB. A Reader does not lock the DB directory,
+// so a Reader opened on the files of an open DB may read blocks while the DB writes these.
+type Reader struct {
+	index, data, window fs.File
+	// vlog is the value log, it is nil if the DB has not stored values in the value log.
+	vlog fs.File
+
+	layout Layout
+}
+
+// Open opens the index, data and window files of the DB in the directory for reading.
+func Open(fsys fs.FileSystem, dir string) (*Reader, error) {
+	r := &Reader{}
+	for _, f := range []struct {
+		file *fs.File
+		name string
+	}{
+		{&r.index, path.Join(dir, "index", "unitdb0000.index")},
+		{&r.data, path.Join(dir, "data", "unitdb0000.data")},
+		{&r.window, path.Join(dir, "window", "unitdb0000.win")},
+	} {
+		file, err := fsys.OpenFile(f.name, os.O_RDONLY, 0)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		*f.file = file
+	}
+	vlog, err := fsys.OpenFile(path.Join(dir, "data", "unitdb0000.vlog"), os.O_RDONLY, 0)
+	if err != nil && !os.IsNotExist(err) {
+		r.Close()
+		return nil, err
+	}
+	if err == nil {
+		r.vlog = vlog
+	}
+	layout, err := readLayout(fsys, path.Join(dir, "unitdb.info"))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.layout = layout
+	return r, nil
+}
+
+// readLayout reads the block size of the DB from the info file, see InfoBlockSizeOffset.
+func readLayout(fsys fs.FileSystem, name string) (Layout, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return Layout{}, err
+	}
+	defer f.Close()
+	var buf [4]byte
+	if _, err := f.ReadAt(buf[:], InfoBlockSizeOffset); err != nil && err != io.EOF {
+		return Layout{}, err
+	}
+	size := int32(binary.LittleEndian.Uint32(buf[:]))
+	if size == 0 {
+		return DefaultLayout, nil
+	}
+	return NewLayout(size)
+}
+
+// Layout returns the layout of blocks of the DB.
+func (r *Reader) Layout() Layout {
+	return r.layout
+}
+
+// Close closes the files of the Reader.
+func (r *Reader) Close() error {
+	var err error
+	for _, f := range []fs.File{r.index, r.data, r.window, r.vlog} {
+		if f == nil {
+			continue
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *Reader) blocks(f fs.File) (int32, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int32(stat.Size() / int64(r.layout.Size)), nil
+}
+
+func (r *Reader) readBlock(f fs.File, off int64) ([]byte, error) {
+	buf := make([]byte, r.layout.Size)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// IndexBlocks returns number of blocks in the index file.
+func (r *Reader) IndexBlocks() (int32, error) {
+	return r.blocks(r.index)
+}
+
+// ReadIndexBlock reads the index block at index. It returns a CorruptionError if checksum of the block does not match.
+func (r *Reader) ReadIndexBlock(idx int32) (IndexBlock, error) {
+	b := r.layout.NewIndexBlock()
+	buf, err := r.readBlock(r.index, r.layout.Offset(idx))
+	if err != nil {
+		return b, err
+	}
+	if err := b.UnmarshalBinary(buf); err != nil {
+		if err == ErrChecksum {
+			return b, &CorruptionError{File: "index", Offset: r.layout.Offset(idx)}
+		}
+		return b, err
+	}
+	return b, nil
+}
+
+// ReadIndexEntry reads the index entry of the sequence, including entry of a deleted message.
+func (r *Reader) ReadIndexEntry(seq uint64) (IndexEntry, error) {
+	b, err := r.ReadIndexBlock(r.layout.Index(seq))
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	for _, e := range b.Entries {
+		if e.Seq == seq {
+			return e, nil
+		}
+	}
+	return IndexEntry{}, errEntryNotFound
+}
+
+// ReadMessage reads the message of the index entry from the data file. It returns a CorruptionError
+// if checksum of the message does not match, the value of a deleted message is empty.
+func (r *Reader) ReadMessage(e IndexEntry) (Message, error) {
+	if e.MsgOffset == -1 {
+		return Message{}, errEntryNotFound
+	}
+	buf := make([]byte, e.MessageSize())
+	if _, err := r.data.ReadAt(buf, e.MsgOffset); err != nil {
+		return Message{}, err
+	}
+	if e.ValueSize != 0 {
+		var err error
+		if buf, err = VerifyMessage(buf); err != nil {
+			return Message{}, &CorruptionError{File: "data", Offset: e.MsgOffset}
+		}
+	}
+	m := Message{
+		ID:    buf[:IDSize],
+		Topic: buf[IDSize : IDSize+int(e.TopicSize)],
+		Value: buf[IDSize+int(e.TopicSize):],
+	}
+	if e.ValueLog && e.ValueSize != 0 {
+		var err error
+		if m.Value, err = r.readValue(m.Value); err != nil {
+			return Message{}, err
+		}
+	}
+	if e.Chunked && e.ValueSize != 0 {
+		var err error
+		if m.Value, err = r.readChunks(m.Value); err != nil {
+			return Message{}, err
+		}
+	}
+	return m, nil
+}
+
+// readChunks reads the value stored in chunks of the value pointers from the data file.
+func (r *Reader) readChunks(data []byte) ([]byte, error) {
+	ptrs, err := UnmarshalChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	for _, p := range ptrs {
+		buf := make([]byte, p.Size+ChecksumSize)
+		if _, err := r.data.ReadAt(buf, p.Offset); err != nil {
+			return nil, err
+		}
+		chunk, err := VerifyMessage(buf)
+		if err != nil {
+			return nil, &CorruptionError{File: "data", Offset: p.Offset}
+		}
+		val = append(val, chunk...)
+	}
+	return val, nil
+}
+
+// readValue reads the value of the value pointer from the value log.
+func (r *Reader) readValue(data []byte) ([]byte, error) {
+	var p ValuePointer
+	if err := p.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if r.vlog == nil {
+		return nil, &CorruptionError{File: "vlog", Offset: p.Offset}
+	}
+	buf := make([]byte, p.Size+ChecksumSize)
+	if _, err := r.vlog.ReadAt(buf, p.Offset); err != nil {
+		return nil, err
+	}
+	val, err := VerifyMessage(buf)
+	if err != nil {
+		return nil, &CorruptionError{File: "vlog", Offset: p.Offset}
+	}
+	return val, nil
+}
+
+// WindowBlocks returns number of blocks in the window file.
+func (r *Reader) WindowBlocks() (int32, error) {
+	return r.blocks(r.window)
+}
+
+// ReadWindowBlock reads the window block at the offset, a window block links to the offset of the previous block of its topic.
+// It returns a CorruptionError if checksum of the block does not match.
+func (r *Reader) ReadWindowBlock(off int64) (WindowBlock, error) {
+	b := r.layout.NewWindowBlock()
+	buf, err := r.readBlock(r.window, off)
+	if err != nil {
+		return b, err
+	}
+	if err := b.UnmarshalBinary(buf); err != nil {
+		if err == ErrChecksum {
+			return b, &CorruptionError{File: "window", Offset: off}
+		}
+		return b, err
+	}
+	return b, nil
+}
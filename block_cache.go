@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/metrics"
+)
+
+// blockCachePageSize is the size of the pages of the index and data files held in the block cache.
+const blockCachePageSize = int64(block.Size)
+
+type (
+	_BlockCacheKey struct {
+		fileType _FileType
+		page     int64
+	}
+	_BlockCacheItem struct {
+		key  _BlockCacheKey
+		data []byte
+	}
+	// _BlockCache is a LRU cache of pages of the index and data files read by queries, so reads of hot
+	// topics do not hit the file system. Pages are invalidated when these are written or truncated.
+	_BlockCache struct {
+		mu       sync.Mutex
+		capacity int64
+		size     int64
+		ll       *list.List
+		items    map[_BlockCacheKey]*list.Element
+
+		// gen is incremented on every invalidation, a page read from the file is
+		// not added to the cache if a write raced with the read.
+		gen uint64
+
+		hits, misses metrics.Counter
+	}
+)
+
+// newBlockCache returns a block cache holding pages up to the capacity in bytes.
+func newBlockCache(capacity int64, hits, misses metrics.Counter) *_BlockCache {
+	return &_BlockCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[_BlockCacheKey]*list.Element),
+		hits:     hits,
+		misses:   misses,
+	}
+}
+
+// get returns the pages of the range, the generation is returned so pages read on a miss are added
+// to the cache only if the cache was not invalidated since.
+func (c *_BlockCache) get(fileType _FileType, first, last int64) ([][]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pages := make([][]byte, 0, last-first+1)
+	for p := first; p <= last; p++ {
+		el, ok := c.items[_BlockCacheKey{fileType: fileType, page: p}]
+		if !ok {
+			c.misses.Inc(1)
+			return nil, c.gen, false
+		}
+		c.ll.MoveToFront(el)
+		pages = append(pages, el.Value.(*_BlockCacheItem).data)
+	}
+	c.hits.Inc(1)
+	return pages, c.gen, true
+}
+
+// add adds pages read from the file at the generation to the cache, evicting the least recently used pages.
+func (c *_BlockCache) add(fileType _FileType, first int64, pages [][]byte, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	for i, data := range pages {
+		key := _BlockCacheKey{fileType: fileType, page: first + int64(i)}
+		if el, ok := c.items[key]; ok {
+			c.ll.MoveToFront(el)
+			continue
+		}
+		c.items[key] = c.ll.PushFront(&_BlockCacheItem{key: key, data: data})
+		c.size += int64(len(data))
+	}
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *_BlockCache) removeElement(el *list.Element) {
+	item := c.ll.Remove(el).(*_BlockCacheItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.data))
+}
+
+// invalidate removes pages of the file overlapping the range written.
+func (c *_BlockCache) invalidate(fileType _FileType, off, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if n <= 0 {
+		return
+	}
+	for p := off / blockCachePageSize; p <= (off+n-1)/blockCachePageSize; p++ {
+		if el, ok := c.items[_BlockCacheKey{fileType: fileType, page: p}]; ok {
+			c.removeElement(el)
+		}
+	}
+}
+
+// invalidateFrom removes pages of the file from the offset, i.e. on truncate or if the file is replaced.
+func (c *_BlockCache) invalidateFrom(fileType _FileType, off int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, el := range c.items {
+		if key.fileType == fileType && (key.page+1)*blockCachePageSize > off {
+			c.removeElement(el)
+		}
+	}
+}
+
+// readCached reads the range from the block cache of the file, pages missing in the
+// cache are read from the file and added to the cache.
+func (f *_File) readCached(start, end int64) ([]byte, error) {
+	if f.cache == nil || end <= start {
+		return f.slice(start, end)
+	}
+	first, last := start/blockCachePageSize, (end-1)/blockCachePageSize
+	pages, gen, ok := f.cache.get(f.fd.fileType, first, last)
+	if !ok {
+		buf := make([]byte, (last-first+1)*blockCachePageSize)
+		n, err := f.ReadAt(buf, first*blockCachePageSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if int64(n) < end-first*blockCachePageSize {
+			return nil, io.EOF
+		}
+		// The last page is partial at the end of the file, it is not cached as the file is appended to.
+		pages = pages[:0]
+		for off := int64(0); off+blockCachePageSize <= int64(n); off += blockCachePageSize {
+			pages = append(pages, buf[off:off+blockCachePageSize])
+		}
+		f.cache.add(f.fd.fileType, first, pages, gen)
+		data := make([]byte, end-start)
+		copy(data, buf[start-first*blockCachePageSize:])
+		return data, nil
+	}
+	data := make([]byte, 0, end-start)
+	for i, page := range pages {
+		lo, hi := int64(0), blockCachePageSize
+		if i == 0 {
+			lo = start - first*blockCachePageSize
+		}
+		if i == len(pages)-1 {
+			hi = end - last*blockCachePageSize
+		}
+		data = append(data, page[lo:hi]...)
+	}
+	return data, nil
+}
+
+// setCache sets the block cache of the files of the file types in the file set.
+func (fs *_FileSet) setCache(c *_BlockCache, fileTypes ..._FileType) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, files := range fs.list {
+		for _, ft := range fileTypes {
+			if files.fd.fileType != ft {
+				continue
+			}
+			files._File.cache = c
+			for num, f := range files.fileMap {
+				f.cache = c
+				files.fileMap[num] = f
+			}
+		}
+	}
+}
@@ -16,11 +16,17 @@
 
 package unitdb
 
+import (
+	"io"
+
+	"github.com/unit-io/unitdb/block"
+)
+
 type _BlockReader struct {
-	indexBlock          _IndexBlock
-	fs                  *_FileSet
-	indexFile, dataFile *_File
-	offset              int64
+	indexBlock                    _IndexBlock
+	fs                            *_FileSet
+	indexFile, dataFile, vlogFile *_File
+	offset                        int64
 }
 
 func newBlockReader(fs *_FileSet) *_BlockReader {
@@ -38,15 +44,24 @@ func newBlockReader(fs *_FileSet) *_BlockReader {
 	}
 	r.dataFile = dataFile
 
+	vlogFile, err := fs.getFile(_FileDesc{fileType: typeValueLog})
+	if err != nil {
+		return nil
+	}
+	r.vlogFile = vlogFile
+
 	return r
 }
 
 func (r *_BlockReader) readIndexBlock() (_IndexBlock, error) {
-	buf, err := r.indexFile.slice(r.offset, r.offset+int64(blockSize))
+	buf, err := r.indexFile.readCached(r.offset, r.offset+r.indexFile.blockSize())
 	if err != nil {
 		return _IndexBlock{}, err
 	}
 	if err := r.indexBlock.unmarshalBinary(buf); err != nil {
+		if err == block.ErrChecksum {
+			return _IndexBlock{}, &block.CorruptionError{File: "index", Offset: r.offset}
+		}
 		return _IndexBlock{}, err
 	}
 
@@ -54,19 +69,30 @@ func (r *_BlockReader) readIndexBlock() (_IndexBlock, error) {
 }
 
 func (r *_BlockReader) readEntry(seq uint64) (_IndexEntry, error) {
-	bIdx := blockIndex(seq)
-	r.offset = blockOffset(bIdx)
-	b, err := r.readIndexBlock()
+	e, err := r.readIndexEntry(seq)
+	if err != nil {
+		return _IndexEntry{}, err
+	}
+	if e.isDeleted() {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+
+	return e, nil
+}
+
+// readIndexEntry reads index entry for the seq, unlike readEntry it also returns a deleted entry.
+// The DB reader is shared by concurrent queries, so the index block is read by a reader of the call.
+func (r *_BlockReader) readIndexEntry(seq uint64) (_IndexEntry, error) {
+	bIdx := r.indexFile.blockIndex(seq)
+	br := _BlockReader{indexFile: r.indexFile, offset: r.indexFile.blockOffset(bIdx)}
+	b, err := br.readIndexBlock()
 	if err != nil {
 		return _IndexEntry{}, err
 	}
 	entryIdx := -1
-	for i := 0; i < entriesPerIndexBlock; i++ {
+	for i := 0; i < len(b.entries); i++ {
 		e := b.entries[i]
 		if e.seq == seq { //topic exist in db
-			if e.msgOffset == -1 {
-				return _IndexEntry{}, errMsgIDDeleted
-			}
 			entryIdx = i
 			break
 		}
@@ -82,16 +108,105 @@ func (r *_BlockReader) readMessage(e _IndexEntry) ([]byte, []byte, error) {
 	if e.cache != nil {
 		return e.cache[:idSize], e.cache[e.topicSize+idSize:], nil
 	}
-	message, err := r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+	message, err := readMessageData(r.dataFile, r.vlogFile, e)
 	if err != nil {
 		return nil, nil, err
 	}
 	return message[:idSize], message[e.topicSize+idSize:], nil
 }
 
+// readID reads the ID of the message of the entry without reading its value.
+func (r *_BlockReader) readID(e _IndexEntry) ([]byte, error) {
+	if e.cache != nil {
+		return e.cache[:idSize], nil
+	}
+	return r.dataFile.readCached(e.msgOffset, e.msgOffset+idSize)
+}
+
+// readMessageData reads the message of the entry from the data file and verifies its checksum.
+// It returns the message without the checksum, the value stored in the value log or in chunks is
+// read in place of the value pointers.
+func readMessageData(dataFile, vlogFile *_File, e _IndexEntry) ([]byte, error) {
+	msg, err := dataFile.readCached(e.msgOffset, e.msgOffset+int64(e.mSize()))
+	if err != nil {
+		return nil, err
+	}
+	if e.valueSize == 0 {
+		return msg, nil
+	}
+	if msg, err = block.VerifyMessage(msg); err != nil {
+		return nil, &block.CorruptionError{File: "data", Offset: e.msgOffset}
+	}
+	if !e.valueLog && !e.chunked {
+		return msg, nil
+	}
+	n := idSize + int(e.topicSize)
+	if e.chunked {
+		ptrs, err := block.UnmarshalChunks(msg[n:])
+		if err != nil {
+			return nil, &block.CorruptionError{File: "data", Offset: e.msgOffset}
+		}
+		val, err := readChunks(dataFile, ptrs)
+		if err != nil {
+			return nil, err
+		}
+		return append(msg[:n:n], val...), nil
+	}
+	var p block.ValuePointer
+	if err := p.UnmarshalBinary(msg[n:]); err != nil {
+		return nil, &block.CorruptionError{File: "data", Offset: e.msgOffset}
+	}
+	val, err := readValueLog(vlogFile, p)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg[:n:n], val...), nil
+}
+
+// readChunks reads the value stored in chunks of the value pointers from the data file and verifies
+// checksums of the chunks.
+func readChunks(dataFile *_File, ptrs []block.ValuePointer) ([]byte, error) {
+	var size int
+	for _, p := range ptrs {
+		size += int(p.Size)
+	}
+	val := make([]byte, 0, size)
+	for _, p := range ptrs {
+		rec, err := dataFile.slice(p.Offset, p.Offset+int64(p.Size)+block.ChecksumSize)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &block.CorruptionError{File: "data", Offset: p.Offset}
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := block.VerifyMessage(rec)
+		if err != nil {
+			return nil, &block.CorruptionError{File: "data", Offset: p.Offset}
+		}
+		val = append(val, chunk...)
+	}
+	return val, nil
+}
+
+// readValueLog reads the value of the value pointer from the value log and verifies its checksum.
+func readValueLog(vlogFile *_File, p block.ValuePointer) ([]byte, error) {
+	rec, err := vlogFile.slice(p.Offset, p.Offset+int64(p.Size)+block.ChecksumSize)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &block.CorruptionError{File: "vlog", Offset: p.Offset}
+	}
+	if err != nil {
+		return nil, err
+	}
+	val, err := block.VerifyMessage(rec)
+	if err != nil {
+		return nil, &block.CorruptionError{File: "vlog", Offset: p.Offset}
+	}
+	return val, nil
+}
+
 func (r *_BlockReader) readTopic(e _IndexEntry) ([]byte, error) {
 	if e.cache != nil {
 		return e.cache[idSize : e.topicSize+idSize], nil
 	}
-	return r.dataFile.slice(e.msgOffset+int64(idSize), e.msgOffset+int64(e.topicSize)+int64(idSize))
+	return r.dataFile.readCached(e.msgOffset+int64(idSize), e.msgOffset+int64(e.topicSize)+int64(idSize))
 }
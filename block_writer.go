@@ -18,9 +18,11 @@ package unitdb
 
 import (
 	"fmt"
+	"io"
 	"sort"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/block"
 )
 
 type _BlockWriter struct {
@@ -33,12 +35,15 @@ type _BlockWriter struct {
 
 	indexLeases                     map[uint64]struct{} //map[seq]struct
 	dataLeases                      map[int64]uint32    // map[offset]size
-	indexFile, dataFile             *_File
+	indexFile, dataFile, vlogFile   *_File
 	offset, indexOffset, dataOffset int64
+
+	// valueThreshold is the size of values appended to the value log, it is 0 if values are stored in the data file.
+	valueThreshold int
 }
 
-func newBlockWriter(fs *_FileSet, lease *_Lease, buf *bpool.Buffer) (*_BlockWriter, error) {
-	w := &_BlockWriter{blockIdx: -1, indexBlocks: make(map[int32]_IndexBlock), fs: fs, lease: lease, buffer: buf}
+func newBlockWriter(fs *_FileSet, lease *_Lease, buf *bpool.Buffer, valueThreshold int) (*_BlockWriter, error) {
+	w := &_BlockWriter{blockIdx: -1, indexBlocks: make(map[int32]_IndexBlock), fs: fs, lease: lease, buffer: buf, valueThreshold: valueThreshold}
 	w.indexLeases = make(map[uint64]struct{})
 	w.dataLeases = make(map[int64]uint32)
 
@@ -49,10 +54,10 @@ func newBlockWriter(fs *_FileSet, lease *_Lease, buf *bpool.Buffer) (*_BlockWrit
 	w.indexFile = indexFile
 	w.indexOffset = indexFile.currSize()
 	if w.indexOffset > 0 {
-		w.blockIdx = int32(w.indexOffset / int64(blockSize))
+		w.blockIdx = int32(w.indexOffset / indexFile.blockSize())
 		// read final block from index file.
-		if w.indexOffset > int64(w.blockIdx*blockSize) {
-			r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(w.blockIdx)}
+		if w.indexOffset > indexFile.blockOffset(w.blockIdx) {
+			r := _BlockReader{indexFile: w.indexFile, offset: indexFile.blockOffset(w.blockIdx)}
 			b, err := r.readIndexBlock()
 			if err != nil {
 				return nil, err
@@ -68,27 +73,39 @@ func newBlockWriter(fs *_FileSet, lease *_Lease, buf *bpool.Buffer) (*_BlockWrit
 	w.dataFile = dataFile
 	w.offset = dataFile.currSize()
 	w.dataOffset = dataFile.currSize()
+
+	vlogFile, err := fs.getFile(_FileDesc{fileType: typeValueLog})
+	if err != nil {
+		return nil, err
+	}
+	w.vlogFile = vlogFile
 	return w, nil
 }
 
 func (w *_BlockWriter) extend(upperSeq uint64) (int64, error) {
-	off := blockOffset(blockIndex(upperSeq))
+	off := w.indexFile.blockOffset(w.indexFile.blockIndex(upperSeq))
 	if off <= w.indexFile.currSize() {
 		return w.indexFile.currSize(), nil
 	}
 	return w.indexFile.extend(uint32(off - w.indexFile.currSize()))
 }
 
-func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
-	var delEntry _IndexEntry
-	bIdx := blockIndex(seq)
+// del marks entry deleted in the index block and returns offset and size of the data block to free.
+// The size is zero if entry does not exist or it was already deleted. Chunks of the value of the entry
+// are freed by del.
+func (w *_BlockWriter) del(seq uint64) (int64, uint32, error) {
+	bIdx := w.indexFile.blockIndex(seq)
 	if bIdx > w.blockIdx {
-		return delEntry, nil // no entry in db to delete
+		return 0, 0, nil // no entry in db to delete
 	}
-	r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
-	b, err := r.readIndexBlock()
-	if err != nil {
-		return _IndexEntry{}, err
+	b, ok := w.indexBlocks[bIdx]
+	if !ok {
+		var err error
+		r := _BlockReader{indexFile: w.indexFile, offset: w.indexFile.blockOffset(bIdx)}
+		b, err = r.readIndexBlock()
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 	entryIdx := -1
 	for i := 0; i < int(b.entryIdx); i++ {
@@ -98,16 +115,58 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 			break
 		}
 	}
-	if entryIdx == -1 {
-		return delEntry, nil // no entry in db to delete
+	if entryIdx == -1 || b.entries[entryIdx].isDeleted() {
+		return 0, 0, nil // no entry in db to delete
 	}
-	delEntry = b.entries[entryIdx]
-	delEntry.msgOffset = -1
-	b.entries[entryIdx] = delEntry
+	if err := w.freeChunks(b.entries[entryIdx]); err != nil {
+		return 0, 0, err
+	}
+	off, size := b.entries[entryIdx].tombstone()
 	b.dirty = true
 	w.indexBlocks[bIdx] = b
 
-	return delEntry, nil
+	return off, size, nil
+}
+
+// freeChunks frees chunks of the value of the entry stored in chunks. Chunks of a message not yet
+// written to the data file or failing its checksum are left to compaction.
+func (w *_BlockWriter) freeChunks(e _IndexEntry) error {
+	if !e.chunked {
+		return nil
+	}
+	msg, err := w.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if msg, err = block.VerifyMessage(msg); err != nil {
+		return nil
+	}
+	ptrs, err := block.UnmarshalChunks(msg[idSize+int(e.topicSize):])
+	if err != nil {
+		return nil
+	}
+	for _, p := range ptrs {
+		w.lease.freeBlock(p.Offset, p.Size+block.ChecksumSize)
+	}
+	return nil
+}
+
+// writeIndex writes index blocks updated by del to the index file.
+func (w *_BlockWriter) writeIndex() error {
+	for bIdx, b := range w.indexBlocks {
+		if !b.dirty {
+			continue
+		}
+		if _, err := w.indexFile.WriteAt(b.marshalBinary(), w.indexFile.blockOffset(bIdx)); err != nil {
+			return err
+		}
+		b.dirty = false
+		w.indexBlocks[bIdx] = b
+	}
+	return nil
 }
 
 func (w *_BlockWriter) append(e _IndexEntry) (err error) {
@@ -116,16 +175,18 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 	if e.seq == 0 {
 		panic("unable to append zero sequence")
 	}
-	bIdx := blockIndex(e.seq)
+	bIdx := w.indexFile.blockIndex(e.seq)
 	b, ok = w.indexBlocks[bIdx]
 	if !ok {
 		if bIdx < w.blockIdx {
-			r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
+			r := _BlockReader{indexFile: w.indexFile, offset: w.indexFile.blockOffset(bIdx)}
 			b, err = r.readIndexBlock()
 			if err != nil {
 				return err
 			}
 			b.leased = true
+		} else {
+			b = w.indexFile.newIndexBlock()
 		}
 	}
 	entryIdx := 0
@@ -143,25 +204,44 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 		return errEntryInvalid
 	}
 
-	dataLen := len(e.cache)
-	off := w.lease.allocate(uint32(dataLen))
-	if off != -1 {
-		buf := make([]byte, dataLen)
-		copy(buf, e.cache)
-		if _, err = w.dataFile.WriteAt(buf, off); err != nil {
+	msg := e.cache
+	if n := idSize + int(e.topicSize); w.valueThreshold > 0 && len(msg)-n >= w.valueThreshold {
+		// The value is appended to the value log with its checksum, the message holds the value pointer.
+		val := msg[n:]
+		p := block.ValuePointer{Offset: w.vlogFile.currSize(), Size: uint32(len(val))}
+		if _, err := w.vlogFile.write(block.AppendChecksum(append(make([]byte, 0, len(val)+block.ChecksumSize), val...))); err != nil {
 			return err
 		}
-		w.dataLeases[off] = uint32(dataLen)
-	} else {
-		off = w.offset
-		offset, err := w.buffer.Extend(int64(dataLen))
-		if err != nil {
-			return err
-		}
-		if _, err := w.buffer.WriteAt(e.cache, offset); err != nil {
-			return err
+		ptr, _ := p.MarshalBinary()
+		msg = append(msg[:n:n], ptr...)
+		e.valueLog = true
+	} else if len(msg)-n > block.ChunkSize {
+		// The value is written in chunks with their checksums, the message holds the value pointers
+		// of the chunks. Chunks are allocated from free blocks as messages are, so a large value
+		// does not need a free block of its size.
+		val := msg[n:]
+		ptrs := make([]byte, 0, block.ChunkCount(uint32(len(val)))*block.ValuePointerSize)
+		for len(val) > 0 {
+			size := len(val)
+			if size > block.ChunkSize {
+				size = block.ChunkSize
+			}
+			off, err := w.writeData(block.AppendChecksum(append(make([]byte, 0, size+block.ChecksumSize), val[:size]...)))
+			if err != nil {
+				return err
+			}
+			ptr, _ := block.ValuePointer{Offset: off, Size: uint32(size)}.MarshalBinary()
+			ptrs = append(ptrs, ptr...)
+			val = val[size:]
 		}
-		w.offset += int64(dataLen)
+		msg = append(msg[:n:n], ptrs...)
+		e.chunked = true
+	}
+
+	// The message is written with its checksum.
+	off, err := w.writeData(block.AppendChecksum(append(make([]byte, 0, len(msg)+block.ChecksumSize), msg...)))
+	if err != nil {
+		return err
 	}
 	e.msgOffset = off
 
@@ -180,6 +260,30 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 	return nil
 }
 
+// writeData writes the data to a free block of the data file, or appends it to the buffer if
+// there is no free block of its size. It returns offset of the data in the data file.
+func (w *_BlockWriter) writeData(data []byte) (int64, error) {
+	dataLen := len(data)
+	off := w.lease.allocate(uint32(dataLen))
+	if off != -1 {
+		if _, err := w.dataFile.WriteAt(data, off); err != nil {
+			return 0, err
+		}
+		w.dataLeases[off] = uint32(dataLen)
+		return off, nil
+	}
+	off = w.offset
+	offset, err := w.buffer.Extend(int64(dataLen))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.buffer.WriteAt(data, offset); err != nil {
+		return 0, err
+	}
+	w.offset += int64(dataLen)
+	return off, nil
+}
+
 func (w *_BlockWriter) write() error {
 	// write data blocks
 	if _, err := w.dataFile.write(w.buffer.Bytes()); err != nil {
@@ -195,7 +299,7 @@ func (w *_BlockWriter) write() error {
 		if err := b.validation(bIdx); err != nil {
 			return err
 		}
-		off := blockOffset(bIdx)
+		off := w.indexFile.blockOffset(bIdx)
 		buf := b.marshalBinary()
 		if _, err := w.indexFile.WriteAt(buf, off); err != nil {
 			return err
@@ -221,7 +325,7 @@ func (w *_BlockWriter) write() error {
 	for _, blocks := range blockRange {
 		if len(blocks) == 1 {
 			bIdx := blocks[0]
-			off := blockOffset(bIdx)
+			off := w.indexFile.blockOffset(bIdx)
 			b := w.indexBlocks[bIdx]
 			if err := b.validation(bIdx); err != nil {
 				return err
@@ -234,7 +338,7 @@ func (w *_BlockWriter) write() error {
 			w.indexBlocks[bIdx] = b
 			continue
 		}
-		blockOff := blockOffset(blocks[0])
+		blockOff := w.indexFile.blockOffset(blocks[0])
 		for bIdx := blocks[0]; bIdx <= blocks[1]; bIdx++ {
 			b := w.indexBlocks[bIdx]
 			if err := b.validation(bIdx); err != nil {
@@ -296,7 +400,7 @@ func (w *_BlockWriter) rollback() error {
 
 	// roll back index leases
 	for seq := range w.indexLeases {
-		if _, err := w.del(seq); err != nil {
+		if _, _, err := w.del(seq); err != nil {
 			return err
 		}
 	}
@@ -307,7 +411,7 @@ func (w *_BlockWriter) reset() error {
 	w.buffer.Reset()
 
 	w.indexOffset = w.indexFile.currSize()
-	w.blockIdx = int32(w.indexOffset / int64(blockSize))
+	w.blockIdx = int32(w.indexOffset / w.indexFile.blockSize())
 
 	w.dataOffset = w.dataFile.currSize()
 
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/uid"
+)
+
+// changesSettle is the default time a change cursor waits for entries leased a seq
+// but not yet written, see ChangeCursor.WithSettle.
+const changesSettle = 5 * time.Second
+
+type (
+	// Change is an entry committed to the DB, see DB.Changes.
+	Change struct {
+		Seq uint64
+		Message
+	}
+
+	// ChangeCursor reads entries committed to the DB in seq order, see DB.Changes.
+	ChangeCursor struct {
+		db     *DB
+		seq    uint64
+		settle time.Duration
+	}
+
+	_ChangeEntry struct {
+		seq       uint64
+		topicHash uint64
+		expiresAt uint32
+	}
+)
+
+// Changes returns a cursor reading entries committed to the DB with seq greater than fromSeq,
+// in seq order. Use zero fromSeq to read all entries, or ChangeCursor.Seq of a previous cursor to resume it.
+//
+// Entries are read from the window index and the memdb, so a consumer feeding another system may lag behind
+// without blocking writes. Deleted and expired entries are skipped, as are entries removed by compaction
+// before the cursor reads them.
+func (db *DB) Changes(fromSeq uint64) (*ChangeCursor, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	return &ChangeCursor{db: db, seq: fromSeq, settle: changesSettle}, nil
+}
+
+// WithSettle sets time the cursor waits for entries with a lower seq than an entry written to the DB.
+// A seq is leased before the entry is written, and a batch writes its entries on commit, so entries are not
+// always written in seq order. The cursor does not read past a missing seq until the next entry is older than
+// the settle time, entries written later than the settle time after a higher seq are not read by the cursor.
+func (c *ChangeCursor) WithSettle(d time.Duration) *ChangeCursor {
+	c.settle = d
+	return c
+}
+
+// Seq returns seq of the last change read by the cursor, persist it to resume the cursor using DB.Changes.
+func (c *ChangeCursor) Seq() uint64 {
+	return c.seq
+}
+
+// Next returns up to limit changes following the last change read by the cursor.
+// It returns no changes if the cursor has read all entries committed to the DB.
+func (c *ChangeCursor) Next(limit int) ([]Change, error) {
+	db := c.db
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || c.seq >= db.seq() {
+		return nil, nil
+	}
+
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	entries, err := db.changeEntries(c.seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	cutoff := time.Now().Add(-c.settle).Unix()
+	for _, ce := range entries {
+		e, err := db.readEntry(_Query{seq: ce.seq})
+		if err != nil {
+			if err == errMsgIDDeleted || err == errEntryInvalid {
+				c.seq = ce.seq
+				continue
+			}
+			return changes, err
+		}
+		id, val, err := db.internal.reader.readMessage(e)
+		if err != nil {
+			return changes, err
+		}
+		// Wait for entries with missing seqs, unless the entry was written before the settle time.
+		if ce.seq != c.seq+1 && uid.Time(id[0:4]) > cutoff {
+			break
+		}
+		c.seq = ce.seq
+		if ce.expiresAt != 0 && ce.expiresAt <= uint32(time.Now().Unix()) {
+			continue
+		}
+		m, err := db.storedMessage(ce.seq, ce.topicHash, ce.expiresAt, id, val)
+		if err == errMsgShredded {
+			continue
+		}
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, Change{Seq: ce.seq, Message: m})
+	}
+	db.internal.meter.OutMsgs.Inc(int64(len(changes)))
+	return changes, nil
+}
+
+// changeEntries returns up to limit window entries with seq greater than the seq in seq order,
+// from the memdb and window blocks of all topics.
+func (db *DB) changeEntries(seq uint64, limit int) ([]_ChangeEntry, error) {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint64]struct{})
+	var entries []_ChangeEntry
+	add := func(topicHash uint64, we _WinEntry) {
+		if we.seq() <= seq {
+			return
+		}
+		if _, ok := seen[we.seq()]; ok {
+			return
+		}
+		seen[we.seq()] = struct{}{}
+		entries = append(entries, _ChangeEntry{seq: we.seq(), topicHash: topicHash, expiresAt: we.expiryTime()})
+	}
+	// truncate keeps entries with the lowest seqs so the memory used is bounded for a consumer lagging behind.
+	truncate := func() {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+		if len(entries) > limit {
+			for _, ce := range entries[limit:] {
+				delete(seen, ce.seq)
+			}
+			entries = entries[:limit]
+		}
+	}
+	for _, tp := range db.internal.trie.all() {
+		for _, we := range db.internal.timeWindow.ilookup(tp.hash, math.MaxInt32) {
+			add(tp.hash, we)
+		}
+		// Window blocks of the topic are chained from the last block written.
+		for off := tp.offset; off != 0 && off+winFile.blockSize() <= winFile.currSize(); {
+			r := _WindowReader{winFile: winFile, offset: off}
+			b, err := r.readWindowBlock()
+			if err != nil {
+				return nil, err
+			}
+			if b.topicHash != tp.hash {
+				break
+			}
+			var last uint64
+			for _, we := range b.entries[:b.entryIdx] {
+				add(tp.hash, we)
+				if we.seq() > last {
+					last = we.seq()
+				}
+			}
+			if last <= seq {
+				break
+			}
+			off = b.next
+		}
+		if len(entries) > 2*limit {
+			truncate()
+		}
+	}
+	truncate()
+	return entries, nil
+}
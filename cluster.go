@@ -0,0 +1,209 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	// replicationVersion is the version of the format of a batch record.
+	replicationVersion = 1
+
+	// recordHeaderSize is the size of the header of a batch record, i.e. version, conflict policy and number of topic names.
+	recordHeaderSize = 4
+)
+
+// Replicator replicates writes of the DB through a consensus log run by the application, such as a Raft library,
+// so nodes of a cluster apply the same writes in the same order. unitdb does not implement the consensus log,
+// leader election or membership: writes to the leader are proposed to the log using Replicator, and the state
+// machine of each node applies records committed to the log using DB.ApplyBatch.
+//
+// Only batch commits, puts and deletes are replicated, reads and other writes such as DB.ReplaceTopic are local to the node.
+//
+// A record holds entries as written to the memdb, i.e. with message ID, encoded value and seq of the leader,
+// so nodes applying the record store the same entries.
+type Replicator interface {
+	// Propose appends the batch record to the replicated log. It returns once the record is committed and
+	// applied to the DB of the node proposing the record, with the error DB.ApplyBatch returned on the node.
+	// It returns an error if the record is not committed, e.g. the node is not the leader of the cluster.
+	Propose(record []byte) error
+}
+
+// record encodes entries of the batch to a batch record, see DB.ApplyBatch. The record starts with a header
+// followed by names of topics first written by the batch. Each entry of the batch is written as a delete flag,
+// size of the entry and the entry as written to the memdb.
+func (b *Batch) record() ([]byte, error) {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+int(b.size)+len(b.index))
+	record[0] = replicationVersion
+	record[1] = byte(b.opts.batchOptions.conflict)
+	binary.LittleEndian.PutUint16(record[2:4], uint16(len(b.names)))
+	var scratch [topicNameHeaderSize]byte
+	for topicHash, n := range b.names {
+		binary.LittleEndian.PutUint64(scratch[0:8], topicHash)
+		binary.LittleEndian.PutUint32(scratch[8:12], n.contract)
+		binary.LittleEndian.PutUint16(scratch[12:14], uint16(len(n.name)))
+		record = append(record, scratch[:]...)
+		record = append(record, n.name...)
+	}
+	for _, index := range b.index {
+		data, err := b.buffer.Slice(index.offset, index.offset+4)
+		if err != nil {
+			return nil, err
+		}
+		dataLen := int64(binary.LittleEndian.Uint32(data))
+		if data, err = b.buffer.Slice(index.offset+4, index.offset+dataLen); err != nil {
+			return nil, err
+		}
+		var flag byte
+		if index.delFlag {
+			flag = 1
+		}
+		binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(data)))
+		record = append(record, flag)
+		record = append(record, scratch[0:4]...)
+		record = append(record, data...)
+	}
+	return record, nil
+}
+
+// replicate proposes a write to the replicated log as a batch of a single entry.
+func (db *DB) replicate(fn func(b *Batch) error) error {
+	b := db.batch()
+	if err := fn(b); err != nil {
+		b.Abort()
+		return err
+	}
+	return b.Commit()
+}
+
+// ApplyBatch applies a batch record committed to the replicated log, see Replicator. The state machine
+// of each node calls ApplyBatch with records in the order of the log, including the node proposing the record.
+//
+// Entries are written using the conflict policy of the batch proposed. Entries already in the DB are skipped,
+// so a record applied again once a node is restarted does not change the DB, unless the conflict policy of the
+// batch is ConflictError, in which case ApplyBatch returns the write conflict and the DB is not changed. The seq of the DB is
+// advanced to the last seq of the record, so a node promoted to leader does not reuse seqs of applied entries.
+func (db *DB) ApplyBatch(record []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if len(record) < recordHeaderSize || record[0] != replicationVersion {
+		return errRecordInvalid
+	}
+	b := db.batch()
+	b.replicated = true
+	b.opts.batchOptions.conflict = ConflictPolicy(record[1])
+	n := int(binary.LittleEndian.Uint16(record[2:4]))
+	off := recordHeaderSize
+	// Names of topics are added once the record is applied.
+	names := make(map[uint64]_TopicName, n)
+	for i := 0; i < n; i++ {
+		if len(record) < off+topicNameHeaderSize {
+			b.Abort()
+			return errRecordInvalid
+		}
+		topicHash := binary.LittleEndian.Uint64(record[off : off+8])
+		contract := binary.LittleEndian.Uint32(record[off+8 : off+12])
+		size := int(binary.LittleEndian.Uint16(record[off+12 : off+14]))
+		off += topicNameHeaderSize
+		if len(record) < off+size {
+			b.Abort()
+			return errRecordInvalid
+		}
+		names[topicHash] = _TopicName{contract: contract, name: string(record[off : off+size])}
+		off += size
+	}
+	var last uint64
+	for off < len(record) {
+		if len(record) < off+5 {
+			b.Abort()
+			return errRecordInvalid
+		}
+		delFlag := record[off] == 1
+		size := int(binary.LittleEndian.Uint32(record[off+1 : off+5]))
+		off += 5
+		if size < entrySize+idSize || len(record) < off+size {
+			b.Abort()
+			return errRecordInvalid
+		}
+		data := record[off : off+size]
+		off += size
+		var e _Entry
+		if err := e.UnmarshalBinary(data[:entrySize]); err != nil {
+			b.Abort()
+			return err
+		}
+		if e.seq == 0 || size != entrySize+idSize+int(e.topicSize)+int(e.valueSize) {
+			b.Abort()
+			return errRecordInvalid
+		}
+		if !delFlag {
+			if b.opts.batchOptions.conflict == ConflictLastWriterWins && db.exists(e.seq) {
+				// The entry of a record applied again.
+				continue
+			}
+			if e.seq > last {
+				last = e.seq
+			}
+			if db.internal.subscriptions.active() {
+				m, err := db.storedMessage(e.seq, e.topicHash, e.expiresAt, data[entrySize:entrySize+idSize], data[entrySize+idSize+int(e.topicSize):])
+				if err != nil {
+					// The entry is applied even if the node cannot decode its value, e.g. it is encrypted with a key the node does not have.
+					db.internal.logger.Error().Err(err).Str("context", "db.ApplyBatch").Uint64("seq", e.seq).Msg("message is not delivered to subscriptions")
+				} else {
+					if n, ok := names[e.topicHash]; ok && m.Topic == nil {
+						m.Topic = []byte(n.name)
+					}
+					if b.pending == nil {
+						b.pending = make(map[int]_BatchMessage)
+					}
+					b.pending[len(b.index)] = _BatchMessage{topicHash: e.topicHash, msg: m}
+				}
+			}
+		}
+		var scratch [4]byte
+		binary.LittleEndian.PutUint32(scratch[:], uint32(size+4))
+		if _, err := b.buffer.Write(scratch[:]); err != nil {
+			b.Abort()
+			return err
+		}
+		if _, err := b.buffer.Write(data); err != nil {
+			b.Abort()
+			return err
+		}
+		b.index = append(b.index, _BatchIndex{delFlag: delFlag, offset: b.size})
+		b.size += int64(size + 4)
+	}
+	// Advance the DB sequence so new entries do not reuse sequence of the applied entries.
+	for {
+		seq := db.seq()
+		if seq >= last || atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, seq, last) {
+			break
+		}
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	for topicHash, n := range names {
+		if err := db.internal.topicNames.add(topicHash, n.contract, []byte(n.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/fs"
+)
+
+const (
+	// compactionExt is the extension of files written by a compaction before these are swapped in.
+	compactionExt = ".compact"
+)
+
+// compactionFiles are the files rewritten by a compaction, the value log is rewritten only if
+// more than half of it is taken by values of deleted entries.
+var compactionFiles = []_FileDesc{{fileType: typeIndex}, {fileType: typeData}, {fileType: typeValueLog}}
+
+type (
+	// _CompactionProgress tracks progress of a running compaction in number of blocks processed.
+	_CompactionProgress struct {
+		running int32
+		done    int64
+		total   int64
+	}
+	// _CompactionEntry is a live entry copied to the compacted data file.
+	_CompactionEntry struct {
+		blockIdx  int32
+		entryIdx  int
+		msgOffset int64
+		size      uint32
+	}
+)
+
+func (p *_CompactionProgress) start(total int64) {
+	atomic.StoreInt64(&p.done, 0)
+	atomic.StoreInt64(&p.total, total)
+	atomic.StoreInt32(&p.running, 1)
+}
+
+func (p *_CompactionProgress) step() {
+	atomic.AddInt64(&p.done, 1)
+}
+
+func (p *_CompactionProgress) finish() {
+	atomic.StoreInt32(&p.running, 0)
+}
+
+// status returns whether compaction is running and the fraction of blocks processed.
+func (p *_CompactionProgress) status() (bool, float64) {
+	if atomic.LoadInt32(&p.running) == 0 {
+		return false, 0
+	}
+	total := atomic.LoadInt64(&p.total)
+	if total == 0 {
+		return true, 0
+	}
+	return true, float64(atomic.LoadInt64(&p.done)) / float64(total)
+}
+
+func compactionPath(dirName string, fd _FileDesc) string {
+	return filePath(dirName, fd) + compactionExt
+}
+
+func compactionMarker(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s%s", prefix, compactionExt))
+}
+
+// recoverCompaction completes a compaction interrupted after it was committed or removes
+// the partially written files otherwise. The marker file is the commit point of a compaction.
+func recoverCompaction(fsys fs.FileSystem, dirName string) error {
+	marker := compactionMarker(dirName)
+	_, err := fsys.Stat(marker)
+	committed := err == nil
+	for _, fd := range compactionFiles {
+		name := compactionPath(dirName, fd)
+		if _, err := fsys.Stat(name); os.IsNotExist(err) {
+			continue
+		}
+		if !committed {
+			if err := fsys.Remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fsys.Rename(name, filePath(dirName, fd)); err != nil {
+			return err
+		}
+		if err := syncDir(fsys, path.Dir(name)); err != nil {
+			return err
+		}
+	}
+	if !committed {
+		return nil
+	}
+	// Free blocks refer to offsets in the data file before compaction.
+	if lease, err := fsys.OpenFile(filePath(dirName, _FileDesc{fileType: typeLease}), os.O_RDWR, 0); err == nil {
+		err = lease.Truncate(0)
+		lease.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return fsys.Remove(marker)
+}
+
+// Compact reclaims disk space used by deleted entries and entries with an expired TTL.
+// It rewrites the data file with live entries only, updates the index and window blocks and
+// truncates the data file. Readers are blocked only while compacted files are swapped in.
+// Deltas of counters and committed offsets are collapsed before compaction, see Counter and DB.CommitOffset.
+func (db *DB) Compact() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	if !db.opts.flags.immutable {
+		if err := db.collapseCounters(); err != nil {
+			return err
+		}
+		if err := db.collapseOffsets(); err != nil {
+			return err
+		}
+	}
+
+	// Compaction excludes sync, expirer and deletes.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	return db.compact()
+}
+
+func (db *DB) compact() (err error) {
+	run := db.internal.runHistory.startRun(RunCompaction)
+	defer func() {
+		run.finish(err)
+	}()
+
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	vlogFile, err := db.fs.getFile(_FileDesc{fileType: typeValueLog})
+	if err != nil {
+		return err
+	}
+	nWinBlocks := int32(winFile.currSize() / winFile.blockSize())
+	nIndexBlocks := int32(indexFile.currSize() / indexFile.blockSize())
+	dataSize, vlogSize := dataFile.currSize(), vlogFile.currSize()
+
+	progress := &db.internal.compaction
+	progress.start(int64(2*nWinBlocks + nIndexBlocks))
+	defer progress.finish()
+
+	// Collect entries with an expired TTL from window blocks.
+	expired := make(map[uint64]struct{})
+	for wIdx := int32(0); wIdx < nWinBlocks; wIdx++ {
+		r := _WindowReader{winFile: winFile, offset: winFile.blockOffset(wIdx)}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.isExpired() {
+				expired[we.seq()] = struct{}{}
+			}
+		}
+		progress.step()
+	}
+
+	// Delete expired entries and collect live entries from index blocks.
+	blocks := make([]_IndexBlock, nIndexBlocks)
+	dropped := make(map[uint64]struct{})
+	var live []_CompactionEntry
+	var liveVlog int64
+	var expiredCount, filteredCount uint64
+	filter := db.internal.plugins.compactionFilter
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		r := _BlockReader{indexFile: indexFile, offset: indexFile.blockOffset(bIdx)}
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			e := &b.entries[i]
+			if e.seq == 0 {
+				continue
+			}
+			if _, ok := expired[e.seq]; ok && !e.isDeleted() {
+				e.tombstone()
+				expiredCount++
+			}
+			if filter != nil && !e.isDeleted() {
+				drop, err := db.filterEntry(filter, dataFile, vlogFile, *e)
+				if err != nil {
+					return err
+				}
+				if drop {
+					e.tombstone()
+					filteredCount++
+				}
+			}
+			if e.msgOffset == -1 {
+				dropped[e.seq] = struct{}{}
+				continue
+			}
+			live = append(live, _CompactionEntry{blockIdx: bIdx, entryIdx: i, msgOffset: e.msgOffset, size: e.mSize()})
+			if e.valueLog && !e.isDeleted() {
+				liveVlog += int64(e.valueSize) + block.ChecksumSize
+			}
+		}
+		blocks[bIdx] = b
+		progress.step()
+	}
+
+	// Copy live entries to the compacted data file.
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].msgOffset < live[j].msgOffset
+	})
+	// Live values are copied to the compacted value log with messages holding the value pointer, and chunks
+	// of live values are copied ahead of their messages. A message failing its checksum is copied as is,
+	// so the corruption is reported when the message is read.
+	copyLive := func(w, vw *bufio.Writer) error {
+		off, vlogOff := int64(0), int64(0)
+		for _, le := range live {
+			buf, err := dataFile.slice(le.msgOffset, le.msgOffset+int64(le.size))
+			if err != nil {
+				return err
+			}
+			e := &blocks[le.blockIdx].entries[le.entryIdx]
+			if msg, err := block.VerifyMessage(buf); vw != nil && e.valueLog && !e.isDeleted() && err == nil {
+				n := idSize + int(e.topicSize)
+				var p block.ValuePointer
+				if err := p.UnmarshalBinary(msg[n:]); err != nil {
+					return err
+				}
+				rec, err := vlogFile.slice(p.Offset, p.Offset+int64(p.Size)+block.ChecksumSize)
+				if err != nil {
+					return err
+				}
+				if _, err := vw.Write(rec); err != nil {
+					return err
+				}
+				p.Offset = vlogOff
+				vlogOff += int64(len(rec))
+				ptr, _ := p.MarshalBinary()
+				buf = block.AppendChecksum(append(msg[:n:n], ptr...))
+			}
+			if msg, err := block.VerifyMessage(buf); e.chunked && !e.isDeleted() && err == nil {
+				n := idSize + int(e.topicSize)
+				ptrs, err := block.UnmarshalChunks(msg[n:])
+				if err != nil {
+					return err
+				}
+				chunks := msg[:n:n]
+				for _, p := range ptrs {
+					rec, err := dataFile.slice(p.Offset, p.Offset+int64(p.Size)+block.ChecksumSize)
+					if err != nil {
+						return err
+					}
+					if _, err := w.Write(rec); err != nil {
+						return err
+					}
+					p.Offset = off
+					off += int64(len(rec))
+					ptr, _ := p.MarshalBinary()
+					chunks = append(chunks, ptr...)
+				}
+				buf = block.AppendChecksum(chunks)
+			}
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			e.msgOffset = off
+			off += int64(le.size)
+		}
+		return nil
+	}
+	dataName := compactionPath(db.path, _FileDesc{fileType: typeData})
+	vlogName := compactionPath(db.path, _FileDesc{fileType: typeValueLog})
+	rewriteVlog := vlogSize > 0 && 2*liveVlog < vlogSize
+	var dataOffset, vlogOffset int64
+	if rewriteVlog {
+		vlogOffset, err = writeCompactionFile(db.opts.fileSystem, vlogName, func(vw *bufio.Writer) error {
+			var err error
+			dataOffset, err = writeCompactionFile(db.opts.fileSystem, dataName, func(w *bufio.Writer) error {
+				return copyLive(w, vw)
+			})
+			return err
+		})
+	} else {
+		vlogOffset = vlogSize
+		dataOffset, err = writeCompactionFile(db.opts.fileSystem, dataName, func(w *bufio.Writer) error {
+			return copyLive(w, nil)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	indexName := compactionPath(db.path, _FileDesc{fileType: typeIndex})
+	if _, err := writeCompactionFile(db.opts.fileSystem, indexName, func(w *bufio.Writer) error {
+		for _, b := range blocks {
+			if _, err := w.Write(b.marshalBinary()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Commit the compaction and swap in the compacted files.
+	marker, err := fs.Create(db.opts.fileSystem, compactionMarker(db.path))
+	if err != nil {
+		return err
+	}
+	if err := marker.Sync(); err != nil {
+		marker.Close()
+		return err
+	}
+	if err := marker.Close(); err != nil {
+		return err
+	}
+	if err := syncDir(db.opts.fileSystem, db.path); err != nil {
+		return err
+	}
+
+	db.internal.compactLock.Lock()
+	defer db.internal.compactLock.Unlock()
+	if err := db.fs.replaceFile(db.opts.fileSystem, db.path, _FileDesc{fileType: typeIndex}, indexName); err != nil {
+		return err
+	}
+	if err := db.fs.replaceFile(db.opts.fileSystem, db.path, _FileDesc{fileType: typeData}, dataName); err != nil {
+		return err
+	}
+	if rewriteVlog {
+		if err := db.fs.replaceFile(db.opts.fileSystem, db.path, _FileDesc{fileType: typeValueLog}, vlogName); err != nil {
+			return err
+		}
+	}
+	db.internal.freeList.reset()
+	if err := db.internal.freeList.write(); err != nil {
+		return err
+	}
+	if err := db.opts.fileSystem.Remove(compactionMarker(db.path)); err != nil {
+		return err
+	}
+
+	// Remove deleted entries from window blocks. Entries carrying a topic are kept in the window
+	// as these are needed to load the trie. A crash here leaves entries that are removed on next compaction.
+	var droppedCount int64
+	for wIdx := int32(0); wIdx < nWinBlocks; wIdx++ {
+		r := _WindowReader{winFile: winFile, offset: winFile.blockOffset(wIdx)}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		entries := make([]_WinEntry, len(b.entries))
+		entryIdx := 0
+		for _, we := range b.entries[:b.entryIdx] {
+			if _, ok := dropped[we.seq()]; ok {
+				continue
+			}
+			entries[entryIdx] = we
+			entryIdx++
+		}
+		if entryIdx != int(b.entryIdx) {
+			droppedCount += int64(int(b.entryIdx) - entryIdx)
+			b.entries = entries
+			b.entryIdx = uint16(entryIdx)
+			if _, err := winFile.WriteAt(b.marshalBinary(), winFile.blockOffset(wIdx)); err != nil {
+				return err
+			}
+		}
+		progress.step()
+	}
+
+	db.decount(expiredCount + filteredCount)
+	if err := db.writeInfo(); err != nil {
+		return err
+	}
+	if err := db.rebuildWindowCounts(); err != nil {
+		return err
+	}
+	run.reclaim(droppedCount, dataSize-dataOffset+vlogSize-vlogOffset)
+
+	return nil
+}
+
+// filterEntry reads the message of the entry and returns true if the compaction filter drops the entry.
+func (db *DB) filterEntry(filter CompactionFilter, dataFile, vlogFile *_File, e _IndexEntry) (bool, error) {
+	msg, err := readMessageData(dataFile, vlogFile, e)
+	if err != nil {
+		return false, err
+	}
+	id := msg[:idSize]
+	val, err := db.decodeValue(id, msg[idSize+int(e.topicSize):])
+	switch {
+	case err == errMsgShredded || err == errContractKeyNotSet:
+		// Messages that cannot be decrypted are kept as the filter cannot decide on these.
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return filter(id, val), nil
+}
+
+// writeCompactionFile writes a compacted file and syncs it to disk. It returns size of the file written.
+func writeCompactionFile(fsys fs.FileSystem, name string, f func(*bufio.Writer) error) (int64, error) {
+	file, err := fsys.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(0666))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if err := f(w); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// ContractInfo is metadata of a contract created by DB.NewContract, see DB.Contracts.
+	ContractInfo struct {
+		Contract  uint32    `json:"contract"`
+		Name      string    `json:"name,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		DeletedAt time.Time `json:"deleted_at,omitempty"` // Zero unless the contract is deleted, see DB.DeleteContract.
+	}
+
+	// _ContractTable holds metadata of contracts and persists it to the contracts file.
+	_ContractTable struct {
+		mu        sync.RWMutex
+		fsys      fs.FileSystem
+		path      string
+		contracts map[uint32]ContractInfo
+	}
+)
+
+func contractsPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.contracts", prefix))
+}
+
+// openContractTable reads metadata of contracts from the contracts file in the DB directory.
+func openContractTable(fsys fs.FileSystem, dirName string) (*_ContractTable, error) {
+	t := &_ContractTable{fsys: fsys, path: contractsPath(dirName), contracts: make(map[uint32]ContractInfo)}
+	data, err := fs.ReadFile(fsys, t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var records []ContractInfo
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, ErrCorrupted
+	}
+	for _, c := range records {
+		t.contracts[c.Contract] = c
+	}
+	return t, nil
+}
+
+// write writes contracts to a temporary file renamed over the contracts file. Caller must hold the lock.
+func (t *_ContractTable) write() error {
+	data, err := json.MarshalIndent(t.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(t.fsys, t.path, data, os.FileMode(0666))
+}
+
+// add records a new contract, it returns false if the contract already exists.
+func (t *_ContractTable) add(contract uint32) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.contracts[contract]; ok {
+		return false, nil
+	}
+	t.contracts[contract] = ContractInfo{Contract: contract, CreatedAt: time.Now().UTC()}
+	return true, t.write()
+}
+
+func (t *_ContractTable) setName(contract uint32, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.contracts[contract]
+	if !ok {
+		return errContractNotFound
+	}
+	if !c.DeletedAt.IsZero() {
+		return errContractDeleted
+	}
+	c.Name = name
+	t.contracts[contract] = c
+	return t.write()
+}
+
+// remove marks the contract deleted, the contract is recorded if it is not created by NewContract.
+func (t *_ContractTable) remove(contract uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.contracts[contract]
+	if !ok {
+		c = ContractInfo{Contract: contract}
+	}
+	if !c.DeletedAt.IsZero() {
+		return nil
+	}
+	c.DeletedAt = time.Now().UTC()
+	t.contracts[contract] = c
+	return t.write()
+}
+
+// deleted returns true if the contract is deleted.
+func (t *_ContractTable) deleted(contract uint32) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c, ok := t.contracts[contract]
+	return ok && !c.DeletedAt.IsZero()
+}
+
+// listLocked returns contracts sorted by creation time and contract. Caller must hold the lock.
+func (t *_ContractTable) listLocked() []ContractInfo {
+	contracts := make([]ContractInfo, 0, len(t.contracts))
+	for _, c := range t.contracts {
+		contracts = append(contracts, c)
+	}
+	sort.Slice(contracts, func(i, j int) bool {
+		if !contracts[i].CreatedAt.Equal(contracts[j].CreatedAt) {
+			return contracts[i].CreatedAt.Before(contracts[j].CreatedAt)
+		}
+		return contracts[i].Contract < contracts[j].Contract
+	})
+	return contracts
+}
+
+func (t *_ContractTable) list() []ContractInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.listLocked()
+}
+
+// NewContract generates a new Contract and records it with its creation time, see DB.Contracts.
+func (db *DB) NewContract() (uint32, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	raw := make([]byte, 4)
+	for {
+		if _, err := rand.Read(raw); err != nil {
+			return 0, err
+		}
+		contract := binary.LittleEndian.Uint32(raw)
+		if contract == 0 || contract == message.MasterContract {
+			continue
+		}
+		ok, err := db.internal.contracts.add(contract)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return contract, nil
+		}
+	}
+}
+
+// SetContractName labels the contract with a name. The contract must be created by NewContract and not deleted.
+func (db *DB) SetContractName(contract uint32, name string) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return db.internal.contracts.setName(contract, name)
+}
+
+// Contracts returns contracts created by NewContract, including deleted contracts, sorted by creation time.
+func (db *DB) Contracts() []ContractInfo {
+	return db.internal.contracts.list()
+}
+
+// DeleteContract deletes the contract and all of its data. The contract is marked deleted first, so writes
+// to the contract are refused, then all topics of the contract are deleted, its quota, policies and rollups
+// are removed and the contract is unbound from its encryption key, see DeleteContractKey.
+// A deleted contract is kept in Contracts so it is not reused by NewContract. The master contract cannot be deleted.
+func (db *DB) DeleteContract(contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.flags.immutable:
+		return ErrImmutable
+	case contract == 0 || contract == message.MasterContract:
+		return errContractMaster
+	}
+	if err := db.internal.contracts.remove(contract); err != nil {
+		return err
+	}
+	for _, topic := range db.internal.topicNames.topics(contract) {
+		if err := db.deleteTopic([]byte(topic), contract); err != nil {
+			return err
+		}
+	}
+	for _, p := range db.internal.policies.list() {
+		if p.Contract != contract {
+			continue
+		}
+		if err := db.internal.policies.remove(contract, p.Topic); err != nil {
+			return err
+		}
+	}
+	for _, r := range db.internal.rollups.list() {
+		if r.Contract != contract {
+			continue
+		}
+		if err := db.internal.rollups.remove(contract, r.Topic); err != nil {
+			return err
+		}
+	}
+	if err := db.internal.keyring.deleteContractKey(contract); err != nil {
+		return err
+	}
+	return db.internal.quotas.remove(contract)
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// maxCounterDeltas is the number of deltas added to a counter before these are collapsed into a single entry.
+const maxCounterDeltas = 1000
+
+// Counter is a persistent counter stored in a topic. Each Add appends a delta entry to the topic,
+// so concurrent adds do not read and write back the counter value. Get sums the deltas of the topic.
+// Deltas are collapsed into a single entry once a counter has maxCounterDeltas deltas and on DB.Compact
+// if the DB is mutable, see WithMutable.
+type Counter struct {
+	db       *DB
+	topic    []byte
+	contract uint32
+}
+
+// _Counters tracks number of deltas added to counters since the DB is opened.
+// Adds hold the read lock while a collapse holds the write lock, so a delta is not lost
+// while deltas of a counter are replaced by their sum.
+type _Counters struct {
+	mu sync.RWMutex
+
+	deltasMu sync.Mutex
+	deltas   map[uint64]*_CounterDeltas
+}
+
+type _CounterDeltas struct {
+	topic    []byte
+	contract uint32
+	count    int
+}
+
+func newCounters() *_Counters {
+	return &_Counters{deltas: make(map[uint64]*_CounterDeltas)}
+}
+
+// add counts a delta added to the counter and returns number of deltas of the counter.
+func (cs *_Counters) add(topicHash uint64, c *Counter) int {
+	cs.deltasMu.Lock()
+	defer cs.deltasMu.Unlock()
+	d, ok := cs.deltas[topicHash]
+	if !ok {
+		d = &_CounterDeltas{topic: c.topic, contract: c.contract}
+		cs.deltas[topicHash] = d
+	}
+	d.count++
+	return d.count
+}
+
+// collapsed resets number of deltas of the counter after its deltas are replaced by their sum.
+func (cs *_Counters) collapsed(topicHash uint64) {
+	cs.deltasMu.Lock()
+	defer cs.deltasMu.Unlock()
+	if d, ok := cs.deltas[topicHash]; ok {
+		d.count = 1
+	}
+}
+
+// Counter returns the counter stored in the topic. The topic must be a static topic
+// used only for the counter.
+func (db *DB) Counter(topic []byte) *Counter {
+	return &Counter{db: db, topic: topic, contract: message.MasterContract}
+}
+
+// WithContract sets contract on counter.
+func (c *Counter) WithContract(contract uint32) *Counter {
+	c.contract = contract
+	return c
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n int64) error {
+	db := c.db
+	if err := db.ok(); err != nil {
+		return err
+	}
+	topicHash, err := c.topicHash()
+	if err != nil {
+		return err
+	}
+	counters := db.internal.counters
+	counters.mu.RLock()
+	e := NewEntry(c.topic, encodeDelta(n)).WithContract(c.contract)
+	e.entry.trusted = true
+	err = db.PutEntry(e)
+	counters.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	// Collapse replaces entries of the topic, so deltas of an immutable DB are not collapsed.
+	if counters.add(topicHash, c) < maxCounterDeltas || db.opts.flags.immutable {
+		return nil
+	}
+	return c.collapse(topicHash)
+}
+
+// Get returns the value of the counter.
+func (c *Counter) Get() (int64, error) {
+	q := NewQuery(c.topic).WithContract(c.contract).WithLimit(c.db.opts.queryOptions.maxQueryLimit)
+	q.internal.trusted = true
+	items, err := c.db.Get(q)
+	if err != nil {
+		return 0, err
+	}
+	var sum int64
+	for _, item := range items {
+		if len(item) != 8 {
+			return 0, errEntryInvalid
+		}
+		sum += int64(binary.LittleEndian.Uint64(item))
+	}
+	return sum, nil
+}
+
+func (c *Counter) topicHash() (uint64, error) {
+	t, _, err := c.db.parseTopic(c.contract, c.topic)
+	if err != nil {
+		return 0, err
+	}
+	if t.TopicType != message.TopicStatic {
+		return 0, errTopicNotStatic
+	}
+	t.AddContract(c.contract)
+	return t.GetHash(c.contract), nil
+}
+
+// collapse replaces deltas of the counter with a single entry of their sum.
+func (c *Counter) collapse(topicHash uint64) error {
+	counters := c.db.internal.counters
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	sum, err := c.Get()
+	if err != nil {
+		return err
+	}
+	e := NewEntry(c.topic, encodeDelta(sum)).WithContract(c.contract)
+	e.entry.trusted = true
+	if err := c.db.ReplaceTopic(c.topic, []*Entry{e}); err != nil {
+		return err
+	}
+	counters.collapsed(topicHash)
+	return nil
+}
+
+// collapseCounters collapses deltas of counters added to since the DB is opened.
+func (db *DB) collapseCounters() error {
+	counters := db.internal.counters
+	counters.deltasMu.Lock()
+	var pending []*Counter
+	var hashes []uint64
+	for topicHash, d := range counters.deltas {
+		if d.count > 1 {
+			pending = append(pending, &Counter{db: db, topic: d.topic, contract: d.contract})
+			hashes = append(hashes, topicHash)
+		}
+	}
+	counters.deltasMu.Unlock()
+	for i, c := range pending {
+		if err := c.collapse(hashes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeDelta(n int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+	return buf
+}
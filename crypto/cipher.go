@@ -0,0 +1,58 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import "errors"
+
+// Cipher encrypts and decrypts message values stored in the DB. Implement Cipher to use
+// an external key management, for example envelope encryption using a KMS or a hardware HSM.
+// The additional data is authenticated but not encrypted, the DB passes message ID prefix
+// (epoch and contract) as additional data so a value cannot be moved to another message.
+type Cipher interface {
+	// Encrypt encrypts plaintext and appends the result to dst, returning the resulting byte slice.
+	Encrypt(dst, plaintext, additionalData []byte) ([]byte, error)
+
+	// Decrypt decrypts ciphertext and appends the result to dst, returning the resulting
+	// byte slice or an error if the ciphertext cannot be authenticated.
+	Decrypt(dst, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// macCipher is the default Cipher. It ignores additional data so values encrypted
+// by earlier versions of the DB are still decrypted.
+type macCipher struct {
+	mac *MAC
+}
+
+// NewCipher returns the default Cipher using a 256-bit/32 byte encryption key.
+func NewCipher(key []byte) (Cipher, error) {
+	mac, err := New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &macCipher{mac: mac}, nil
+}
+
+func (c *macCipher) Encrypt(dst, plaintext, _ []byte) ([]byte, error) {
+	if len(plaintext) < EpochSize {
+		return dst, errors.New("Plaintext is too short.")
+	}
+	return c.mac.Encrypt(dst, plaintext), nil
+}
+
+func (c *macCipher) Decrypt(dst, ciphertext, _ []byte) ([]byte, error) {
+	return c.mac.Decrypt(dst, ciphertext)
+}
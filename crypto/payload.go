@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PayloadCipher encrypts payloads on the client using a contract key before these are
+// published to the server, so the server stores ciphertext it cannot read. Only payload
+// is encrypted, topic and message ID are left in clear so that the server assigns sequence
+// and looks up messages as usual.
+//
+// Ciphertext is bound to the contract but not to the topic, so a client holding the contract key,
+// or the server, can replay a sealed payload to another topic of the same contract. Clients which
+// need payloads bound to the topic include the topic in the payload and check it once it is opened.
+type PayloadCipher struct {
+	aead cipher.AEAD
+}
+
+// DeriveContractKey derives a 256-bit key for the contract from a secret shared by clients of the contract.
+func DeriveContractKey(secret []byte, contract uint32) ([]byte, error) {
+	info := make([]byte, 4)
+	binary.LittleEndian.PutUint32(info, contract)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewPayloadCipher builds a new PayloadCipher using a 256-bit/32 byte contract key.
+func NewPayloadCipher(key []byte) (*PayloadCipher, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &PayloadCipher{aead: aead}, nil
+}
+
+// Overhead returns the difference between the lengths of a payload and its ciphertext.
+func (c *PayloadCipher) Overhead() int { return c.aead.NonceSize() + c.aead.Overhead() }
+
+// Seal encrypts payload for the contract and appends it to dst, returning the resulting byte slice.
+// A random nonce is prepended to the ciphertext.
+func (c *PayloadCipher) Seal(dst, payload []byte, contract uint32) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return dst, err
+	}
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, payload, contractData(contract)), nil
+}
+
+// SealBatch encrypts payloads of a batch for the contract before the batch is submitted to the server.
+func (c *PayloadCipher) SealBatch(payloads [][]byte, contract uint32) ([][]byte, error) {
+	sealed := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		var err error
+		if sealed[i], err = c.Seal(nil, payload, contract); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// Open decrypts ciphertext for the contract and appends payload to dst, returning the
+// resulting byte slice or an error if the ciphertext cannot be authenticated.
+func (c *PayloadCipher) Open(dst, ciphertext []byte, contract uint32) ([]byte, error) {
+	if len(ciphertext) < c.Overhead() {
+		return dst, errors.New("Authentication failed.")
+	}
+	nonce := ciphertext[:c.aead.NonceSize()]
+	dst, err := c.aead.Open(dst, nonce, ciphertext[c.aead.NonceSize():], contractData(contract))
+	if err != nil {
+		return dst, errors.New("Authentication failed.")
+	}
+	return dst, nil
+}
+
+// contractData binds ciphertext to the contract so a payload cannot be replayed to another contract,
+// a payload can be replayed to another topic of the contract, see PayloadCipher.
+func contractData(contract uint32) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, contract)
+	return data
+}
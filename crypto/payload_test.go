@@ -0,0 +1,152 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestCipher(t *testing.T, contract uint32) *PayloadCipher {
+	t.Helper()
+	key, err := DeriveContractKey([]byte("secret"), contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewPayloadCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDeriveContractKey(t *testing.T) {
+	key, err := DeriveContractKey([]byte("secret"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("expected 32 byte key; got %d", len(key))
+	}
+	again, err := DeriveContractKey([]byte("secret"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Fatal("expected same key for the same secret and contract")
+	}
+	for _, other := range [][]byte{mustDerive(t, []byte("secret"), 2), mustDerive(t, []byte("other"), 1)} {
+		if bytes.Equal(key, other) {
+			t.Fatal("expected different key for another secret or contract")
+		}
+	}
+	if _, err := NewPayloadCipher(key[:16]); err == nil {
+		t.Fatal("expected error on short key")
+	}
+}
+
+func mustDerive(t *testing.T, secret []byte, contract uint32) []byte {
+	t.Helper()
+	key, err := DeriveContractKey(secret, contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestPayloadCipher(t *testing.T) {
+	c := newTestCipher(t, 1)
+	payload := []byte("payload")
+	sealed, err := c.Seal([]byte("prefix"), payload, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, []byte("prefix")) || len(sealed) != len("prefix")+len(payload)+c.Overhead() {
+		t.Fatalf("unexpected sealed payload %x", sealed)
+	}
+	sealed = sealed[len("prefix"):]
+	if bytes.Contains(sealed, payload) {
+		t.Fatal("expected payload encrypted")
+	}
+	opened, err := c.Open(nil, sealed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, payload) {
+		t.Fatalf("expected %s; got %s", payload, opened)
+	}
+	// A random nonce is used for each payload.
+	if again, err := c.Seal(nil, payload, 1); err != nil || bytes.Equal(again, sealed) {
+		t.Fatalf("expected different ciphertext sealing the payload again, %v", err)
+	}
+
+	// Tampered ciphertext, another contract, another key and short input are not authenticated.
+	for i := range sealed {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		if _, err := c.Open(nil, tampered, 1); err == nil {
+			t.Fatalf("expected error opening ciphertext tampered at %d", i)
+		}
+	}
+	if _, err := c.Open(nil, sealed, 2); err == nil {
+		t.Fatal("expected error opening ciphertext for another contract")
+	}
+	if _, err := newTestCipher(t, 2).Open(nil, sealed, 1); err == nil {
+		t.Fatal("expected error opening ciphertext with another key")
+	}
+	for _, n := range []int{0, 1, c.Overhead() - 1} {
+		if _, err := c.Open(nil, sealed[:n], 1); err == nil {
+			t.Fatalf("expected error opening %d bytes", n)
+		}
+	}
+
+	// An empty payload is sealed.
+	sealed, err = c.Seal(nil, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := c.Open(nil, sealed, 1); err != nil || len(opened) != 0 {
+		t.Fatalf("expected empty payload; got %x, %v", opened, err)
+	}
+}
+
+func TestSealBatch(t *testing.T) {
+	c := newTestCipher(t, 1)
+	payloads := [][]byte{[]byte("msg.1"), []byte("msg.2"), nil}
+	sealed, err := c.SealBatch(payloads, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(payloads) {
+		t.Fatalf("expected %d payloads; got %d", len(payloads), len(sealed))
+	}
+	for i, s := range sealed {
+		opened, err := c.Open(nil, s, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, payloads[i]) {
+			t.Fatalf("expected %s; got %s", payloads[i], opened)
+		}
+		if _, err := c.Open(nil, s, 2); err == nil {
+			t.Fatal("expected error opening ciphertext for another contract")
+		}
+	}
+	if sealed, err := c.SealBatch(nil, 1); err != nil || len(sealed) != 0 {
+		t.Fatalf("expected empty batch; got %d, %v", len(sealed), err)
+	}
+}
@@ -18,19 +18,21 @@ package unitdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"math"
 	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
-	"github.com/unit-io/unitdb/crypto"
-	fltr "github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
 )
@@ -39,6 +41,7 @@ import (
 // All DB methods are safe for concurrent use by multiple goroutines.
 type DB struct {
 	opts *_Options
+	path string
 
 	lock _LockFile
 	fs   *_FileSet
@@ -48,25 +51,49 @@ type DB struct {
 
 // Open opens or creates a new DB.
 func Open(path string, opts ...Options) (*DB, error) {
-	options := &_Options{}
-	WithDefaultOptions().set(options)
-	WithDefaultFlags().set(options)
-	WithDefaultQueryOptions().set(options)
-	for _, opt := range opts {
-		if opt != nil {
-			opt.set(options)
-		}
+	options := newOptions(opts...)
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	dbLogger := *options.logger
+	if options.logLevel != nil {
+		dbLogger = dbLogger.Level(*options.logLevel)
 	}
 
-	lock, err := createLockFile(path)
+	lock, err := createLockFile(options.fileSystem, path)
 	if err != nil {
 		if err == os.ErrExist {
-			err = errLocked
+			err = ErrLocked
 		}
 		return nil, err
 	}
 
-	infoFile, err := newFile(path, 1, _FileDesc{fileType: typeInfo})
+	// Complete or rollback compaction if it was interrupted.
+	if err := recoverCompaction(options.fileSystem, path); err != nil {
+		return nil, err
+	}
+
+	// Check plugins against plugins the DB was created with.
+	created := !fs.Exists(options.fileSystem, filePath(path, _FileDesc{fileType: typeInfo}))
+	plugins, err := openPlugins(options.fileSystem, path, options, created)
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+
+	// Open keyring of encryption keys, the key is the active key.
+	keyring, err := openKeyring(options.fileSystem, path, options.encryptionKey, options.cipher, plugins.cipherSuite)
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	if err := keyring.openContractKeys(path, options.contractKeys); err != nil {
+		lock.unlock()
+		return nil, err
+	}
+
+	infoFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeInfo})
 	if err != nil {
 		return nil, err
 	}
@@ -76,18 +103,24 @@ func Open(path string, opts ...Options) (*DB, error) {
 		expDurationType:     time.Minute,
 		maxExpDurations:     maxExpDur,
 		backgroundKeyExpiry: options.flags.backgroundKeyExpiry,
+		logger:              dbLogger,
 	}
-	winFile, err := newFile(path, 1, _FileDesc{fileType: typeTimeWindow})
+	winFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeIndex})
 	if err != nil {
 		return nil, err
 	}
 
-	indexFile, err := newFile(path, 1, _FileDesc{fileType: typeIndex})
+	dataFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeData})
 	if err != nil {
 		return nil, err
 	}
 
-	dataFile, err := newFile(path, 1, _FileDesc{fileType: typeData})
+	vlogFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeValueLog})
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +132,10 @@ func Open(path string, opts ...Options) (*DB, error) {
 				signature: signature,
 				version:   version,
 			},
+			blockSize: options.blockSize,
+		}
+		if dbInfo.blockSize == 0 {
+			dbInfo.blockSize = block.Size
 		}
 		if _, err = infoFile.extend(fixed); err != nil {
 			return nil, err
@@ -106,46 +143,119 @@ func Open(path string, opts ...Options) (*DB, error) {
 		if err := infoFile.writeMarshalableAt(dbInfo, 0); err != nil {
 			return nil, err
 		}
+		// Sync the header so a crash does not leave the info file of a new DB torn.
+		if err := infoFile.Sync(); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := infoFile.readUnmarshalableAt(&dbInfo, fixed, 0); err != nil {
-		logger.Error().Err(err).Str("context", "db.readHeader")
+		dbLogger.Error().Err(err).Str("context", "db.readHeader")
 		return nil, err
 	}
 	if !bytes.Equal(dbInfo.header.signature[:], signature[:]) {
-		return nil, errCorrupted
+		return nil, ErrCorrupted
+	}
+	if dbInfo.header.version != version {
+		return nil, errVersion
+	}
+	layout, err := dbInfo.layout(options.blockSize)
+	if err != nil {
+		lock.unlock()
+		return nil, err
 	}
 
-	leaseFile, err := newFile(path, 1, _FileDesc{fileType: typeLease})
+	leaseFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeLease})
 	if err != nil {
 		return nil, err
 	}
 	lease := newLease(leaseFile, options.freeBlockSize)
 
-	filterFile, err := newFile(path, 1, _FileDesc{fileType: typeFilter})
+	filterFile, err := newFile(options.fileSystem, path, 1, _FileDesc{fileType: typeFilter})
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := openPolicyTable(options.fileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups, err := openRollupTable(options.fileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	topicNames, err := openTopicNames(options.fileSystem, path)
 	if err != nil {
 		return nil, err
 	}
 
-	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile}}
+	quotas, err := openQuotaTable(options.fileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	contracts, err := openContractTable(options.fileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := openAccessTable(options.fileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile, vlogFile}}
+	fileset.setLayout(layout, typeTimeWindow, typeIndex)
+	if options.ioReads > 0 || options.ioWrites > 0 {
+		fileset.setScheduler(newIOScheduler(options.ioReads, options.ioWrites))
+	}
+	meter := NewMeter()
+	if options.metrics != nil {
+		meter.setSink(options.metrics)
+	}
+	if options.blockCacheSize > 0 {
+		fileset.setCache(newBlockCache(options.blockCacheSize, meter.BlockCacheHits, meter.BlockCacheMisses), typeIndex, typeData)
+	}
 	internal := &_DB{
 		mutex: newMutex(),
 		start: time.Now(),
-		meter: NewMeter(),
+		meter: meter,
 
-		dbInfo: dbInfo,
+		runHistory: newRunHistory(),
+		logger:     dbLogger,
+		plugins:    plugins,
+
+		dbInfo:  dbInfo,
+		keyring: keyring,
 
 		bufPool: bpool.NewBufferPool(options.bufferSize, &bpool.Options{MaxElapsedTime: 10 * time.Second}),
 
 		info:     infoFile,
-		filter:   Filter{file: filterFile, filterBlock: fltr.NewFilterGenerator()},
+		filter:   Filter{file: filterFile, bits: options.filterBits, hashes: options.filterHashes},
 		freeList: lease,
 
 		timeWindow: newTimeWindowBucket(timeOptions),
+		winCounts:  newWindowCounts(options.fileSystem, path),
 
 		// Trie
 		trie: newTrie(),
 
+		// Topic policies.
+		policies:    policies,
+		rollups:     rollups,
+		topicNames:  topicNames,
+		quotas:      quotas,
+		contracts:   contracts,
+		access:      access,
+		rateLimiter: newRateLimiter(options.rateLimit, options.rateBurst),
+		topicClocks: newTopicClocks(),
+		counters:    newCounters(),
+		offsets:     newOffsets(),
+
+		subscriptions: newSubscriptions(options.ackTimeout),
+
 		// Block reader
 		reader: newBlockReader(fileset),
 
@@ -156,27 +266,29 @@ func Open(path string, opts ...Options) (*DB, error) {
 		closeC: make(chan struct{}),
 	}
 
-	// Create a new MAC from the key.
-	if internal.mac, err = crypto.New(options.encryptionKey); err != nil {
-		return nil, err
-	}
-
 	// set encryption flag to encrypt messages.
 	if options.flags.encryption {
 		internal.dbInfo.encryption = 1
 	}
 
+	if options.flags.lastValueCache {
+		internal.lastValues = newLastValues()
+	}
+
 	// Create a blockcache.
-	memdb, err := memdb.Open(memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize), memdb.WithBufferSize(options.bufferSize))
+	memOpts := []memdb.Options{memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize), memdb.WithBufferSize(options.bufferSize), memdb.WithLogSyncPolicy(options.syncPolicy), memdb.WithLogArchive(options.logArchive), memdb.WithFileSystem(options.fileSystem), memdb.WithLogMaxBytes(options.tinyBatchMaxBytes), memdb.WithLogPreallocate(options.logPreallocate), memdb.WithLogRecycle(options.logRecycle)}
+	if options.tinyBatchFlushInterval > 0 {
+		memOpts = append(memOpts, memdb.WithLogInterval(options.tinyBatchFlushInterval))
+	}
+	memdb, err := memdb.Open(memOpts...)
 	if err != nil {
 		return nil, err
 	}
 	internal.mem = memdb
 
-	internal.filter.blockCache = internal.mem
-
 	db := &DB{
 		opts: options,
+		path: path,
 
 		lock: lock,
 		fs:   fileset,
@@ -184,26 +296,86 @@ func Open(path string, opts ...Options) (*DB, error) {
 		internal: internal,
 	}
 
+	if size, err := db.fs.size(); err == nil {
+		db.internal.fileSize = size
+	}
+
+	// Window counts are written when the DB is closed, blocks torn by a crash are repaired otherwise.
+	if !fs.Exists(db.internal.winCounts.fsys, db.internal.winCounts.path) {
+		if err := db.recoverBlocks(); err != nil {
+			db.internal.mem.Close()
+			db.fs.close()
+			lock.unlock()
+			return nil, err
+		}
+	}
+
 	if err := db.loadTrie(); err != nil {
-		logger.Error().Err(err).Str("context", "db.loadTrie")
+		db.internal.logger.Error().Err(err).Str("context", "db.loadTrie")
 	}
 
 	// Read freeList.
 	if err := db.internal.freeList.read(); err != nil {
-		logger.Error().Err(err).Str("context", "db.readHeader")
+		db.internal.logger.Error().Err(err).Str("context", "db.readHeader")
+		return nil, err
+	}
+
+	if err := db.loadFilter(); err != nil {
+		db.internal.mem.Close()
+		db.fs.close()
+		lock.unlock()
+		return nil, err
+	}
+
+	if err := db.loadWindowCounts(); err != nil {
+		db.internal.mem.Close()
+		db.fs.close()
+		lock.unlock()
 		return nil, err
 	}
 
 	if err := db.recoverLog(); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			db.internal.mem.Close()
+			db.fs.close()
+			lock.unlock()
+			return nil, err
+		}
 		// if unable to recover db then close db.
 		panic(fmt.Sprintf("Unable to recover db on sync error %v. Closing db...", err))
 	}
 
 	db.internal.syncHandle = _SyncHandle{DB: db}
+	db.internal.syncedAt = time.Now().UnixNano()
 	db.startSyncer(options.syncDurationType * time.Duration(options.maxSyncDurations))
 
+	if db.opts.alerts.enabled() {
+		db.startAlerter(options.syncDurationType * time.Duration(options.maxSyncDurations))
+	}
+
 	if db.opts.flags.backgroundKeyExpiry {
-		db.startExpirer(time.Minute, maxExpDur)
+		db.startExpirer(db.opts.expiryScanInterval)
+	}
+
+	if db.opts.compactionInterval > 0 {
+		db.startCompactor(db.opts.compactionInterval)
+	}
+
+	db.startRetainer(db.opts.retentionInterval)
+
+	// Messages of consumer groups are redelivered within half the ack timeout once it is passed.
+	db.startRedeliverer(db.opts.ackTimeout / 2)
+
+	if db.opts.tieredStore != nil {
+		db.startOffloader(offloadInterval)
+	}
+
+	if db.opts.meterHistoryInterval > 0 {
+		db.startMeterSnapshots(db.opts.meterHistoryInterval)
+	}
+
+	if db.opts.reencryptInterval > 0 {
+		db.startReencrypter(db.opts.reencryptInterval)
 	}
 
 	return db, nil
@@ -218,27 +390,123 @@ func (db *DB) Close() error {
 	return nil
 }
 
-// Get return items matching the query paramater.
+// Get return items matching the query paramater, payloads of a query with StreamValues set are read whole.
 func (db *DB) Get(q *Query) (items [][]byte, err error) {
+	var readErr error
+	err = db.query(q, func(_ _Query, _ []byte, _ map[string][]byte, payload []byte, value func() io.Reader) {
+		if value != nil && readErr == nil {
+			payload, readErr = io.ReadAll(value())
+		}
+		items = append(items, payload)
+	})
+	if err == nil && readErr != nil {
+		return nil, readErr
+	}
+	return items, err
+}
+
+// GetMessages returns messages matching the query, with the ID, topic and headers of each message.
+func (db *DB) GetMessages(q *Query) (msgs []Message, err error) {
+	err = db.query(q, func(wq _Query, id []byte, headers map[string][]byte, payload []byte, value func() io.Reader) {
+		msgs = append(msgs, db.queryMessage(q, wq, id, headers, payload, value))
+	})
+	return msgs, err
+}
+
+// queryMessage returns the message of the query with the ID, topic and headers of the message.
+func (db *DB) queryMessage(q *Query, wq _Query, id []byte, headers map[string][]byte, payload []byte, value func() io.Reader) Message {
+	m := Message{
+		ID:        make([]byte, message.ID(nil).Size()),
+		Payload:   payload,
+		Headers:   headers,
+		Contract:  binary.LittleEndian.Uint32(id[4:8]),
+		ExpiresAt: wq.expiresAt,
+		value:     value,
+	}
+	copy(m.ID, id[:8])
+	binary.LittleEndian.PutUint64(m.ID[8:], wq.seq)
+	if n, ok := db.internal.topicNames.get(wq.topicHash); ok {
+		m.Topic = []byte(n.name)
+	} else if len(q.ID) != 0 {
+		m.Topic = []byte(topicName(q.Topic))
+	}
+	return m
+}
+
+// filter returns false if the filter of the query rejects the message.
+func (db *DB) filter(q *Query, wq _Query, id []byte, headers map[string][]byte, payload []byte, value func() io.Reader) bool {
+	if q.Filter == nil {
+		return true
+	}
+	m := db.queryMessage(q, wq, id, headers, payload, value)
+	if q.Filter(&m) {
+		return true
+	}
+	q.internal.stats.Filtered++
+	return false
+}
+
+// query looks up messages matching the query and calls add for each message, newest message first.
+func (db *DB) query(q *Query, add func(wq _Query, id []byte, headers map[string][]byte, payload []byte, value func() io.Reader)) (err error) {
 	if err := db.ok(); err != nil {
-		return nil, err
+		return err
 	}
 	switch {
 	case len(q.Topic) == 0:
-		return nil, errTopicEmpty
+		return errTopicEmpty
 	case len(q.Topic) > maxTopicLength:
-		return nil, errTopicTooLarge
+		return errTopicTooLarge
 	}
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
 	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
 	if err := q.parse(); err != nil {
-		return nil, err
+		return err
 	}
+	if !q.internal.trusted {
+		if err := db.checkAccess(q.AccessKey, q.Contract, q.Topic, AccessRead); err != nil {
+			return err
+		}
+	}
+	q.internal.stats = QueryStats{}
+	q.internal.winEntries = q.internal.winEntries[:0]
+	q.internal.last = 0
+	count := 0
+	defer func(start time.Time) {
+		q.internal.stats.Returned = count
+		q.internal.stats.Duration = time.Since(start)
+	}(time.Now())
 	mu := db.internal.mutex.getMutex(q.internal.prefix)
 	mu.RLock()
 	defer mu.RUnlock()
-	db.lookup(q)
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	if len(q.ID) != 0 {
+		id, headers, payload, value, err := db.getEntry(q)
+		if err != nil {
+			return err
+		}
+		wq := _Query{seq: message.ID(q.ID).Sequence()}
+		if !db.filter(q, wq, id, headers, payload, value) {
+			return nil
+		}
+		count++
+		add(wq, id, headers, payload, value)
+		return nil
+	}
+	if q.internal.seekTime != 0 {
+		if err := db.seek(q); err != nil {
+			return err
+		}
+	}
+	if q.Filter != nil {
+		// Messages rejected by the filter are not counted against the limit, so all entries of the topics are looked up.
+		sq := &Query{internal: q.internal, Topic: q.Topic, Contract: q.Contract, Limit: math.MaxInt32}
+		db.lookup(sq)
+		q.internal.winEntries, q.internal.stats = sq.internal.winEntries, sq.internal.stats
+	} else {
+		db.lookup(q)
+	}
 	if len(q.internal.winEntries) == 0 {
 		return
 	}
@@ -258,18 +526,27 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 				if query.seq == 0 {
 					return nil
 				}
+				if _, ok := q.internal.skip[query.seq]; ok {
+					invalidCount++
+					return nil
+				}
 				s, err := db.readEntry(query)
 				if err != nil {
 					if err == errMsgIDDeleted {
 						invalidCount++
 						return nil
 					}
-					logger.Error().Err(err).Str("context", "db.readEntry")
+					db.internal.logger.Error().Err(err).Str("context", "db.readEntry")
 					return err
 				}
+				if s.cache != nil {
+					q.internal.stats.CacheHits++
+				} else {
+					q.internal.stats.BlocksRead++
+				}
 				id, val, err := db.internal.reader.readMessage(s)
 				if err != nil {
-					logger.Error().Err(err).Str("context", "data.readMessage")
+					db.internal.logger.Error().Err(err).Str("context", "data.readMessage")
 					return err
 				}
 				msgID := message.ID(id)
@@ -278,34 +555,39 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 					return nil
 				}
 
-				// last bit of ID is an encryption flag.
-				if uint8(id[idSize-1]) == 1 {
-					val, err = db.internal.mac.Decrypt(nil, val)
-					if err != nil {
-						logger.Error().Err(err).Str("context", "mac.decrypt")
-						return err
-					}
+				headers, val, value, err := db.decodeQueryMessage(q, id, val)
+				if err == errMsgShredded {
+					invalidCount++
+					return nil
 				}
-				var buffer []byte
-				val, err = snappy.Decode(buffer, val)
 				if err != nil {
-					logger.Error().Err(err).Str("context", "snappy.Decode")
+					db.internal.logger.Error().Err(err).Str("context", "db.decodeValue")
 					return err
 				}
-				items = append(items, val)
+				q.internal.stats.BytesDecompressed += int64(len(val))
+				if !db.filter(q, query, id, headers, val, value) {
+					invalidCount++
+					return nil
+				}
+				count++
+				add(query, id, headers, val, value)
+				q.internal.last = query.seq
+				if q.internal.skip != nil {
+					q.internal.seqs = append(q.internal.seqs, query.seq)
+				}
 				db.internal.meter.OutBytes.Inc(int64(s.valueSize))
 				return nil
 			}()
 			if err != nil {
-				return items, err
+				return err
 			}
 		}
 
-		if invalidCount == 0 || len(items) == int(q.Limit) || len(q.internal.winEntries) == limit {
+		if invalidCount == 0 || count == int(q.Limit) || len(q.internal.winEntries) == limit {
 			break
 		}
 
-		if len(q.internal.winEntries) <= int(q.Limit+invalidCount) {
+		if len(q.internal.winEntries) <= limit+invalidCount {
 			start = limit
 			limit = len(q.internal.winEntries)
 		} else {
@@ -313,18 +595,13 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 			limit = limit + invalidCount
 		}
 	}
-	db.internal.meter.Gets.Inc(int64(len(items)))
-	db.internal.meter.OutMsgs.Inc(int64(len(items)))
-	return items, nil
-}
-
-// NewContract generates a new Contract.
-func (db *DB) NewContract() (uint32, error) {
-	raw := make([]byte, 4)
-	rand.Read(raw)
-
-	contract := uint32(binary.LittleEndian.Uint32(raw[:4]))
-	return contract, nil
+	// There are no older messages to continue the query from.
+	if count < q.Limit {
+		q.internal.last = 0
+	}
+	db.internal.meter.Gets.Inc(int64(count))
+	db.internal.meter.OutMsgs.Inc(int64(count))
+	return nil
 }
 
 // NewID generates new ID that is later used to put entry or delete entry.
@@ -344,9 +621,13 @@ func (db *DB) Put(topic, payload []byte) error {
 // It is safe to modify the contents of the argument after PutEntry returns but not
 // before.
 func (db *DB) PutEntry(e *Entry) error {
-	if err := db.ok(); err != nil {
+	if err := db.startWrite(); err != nil {
 		return err
 	}
+	defer db.finishWrite()
+	if db.opts.replicator != nil {
+		return db.replicate(func(b *Batch) error { return b.PutEntry(e) })
+	}
 
 	switch {
 	case len(e.Topic) == 0:
@@ -358,8 +639,31 @@ func (db *DB) PutEntry(e *Entry) error {
 	case len(e.Payload) > maxValueLength:
 		return errValueTooLarge
 	}
+	if err := db.checkEntryLimits(e); err != nil {
+		return err
+	}
+	contract := e.Contract
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	rate, err := db.checkRate(map[uint32]int64{contract: 1})
+	if err != nil {
+		return err
+	}
+	if err := db.waitMemdb(); err != nil {
+		return err
+	}
 
-	if err := db.setEntry(e); err != nil {
+	if err := db.encodeEntry(e); err != nil {
+		return err
+	}
+	if err := db.checkTopicLimit(e); err != nil {
+		return err
+	}
+	if err := db.checkQuota(e); err != nil {
+		return err
+	}
+	if err := db.commitEntry(e); err != nil {
 		return err
 	}
 
@@ -367,10 +671,12 @@ func (db *DB) PutEntry(e *Entry) error {
 	if err != nil {
 		return err
 	}
+	rate.take()
 
 	if ok := db.internal.timeWindow.add(timeID, e.entry.topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt)); !ok {
-		return errForbidden
+		return ErrForbidden
 	}
+	db.internal.lastValues.set(e.entry.topicHash, e.entry.seq, e.entry.expiresAt)
 
 	if e.entry.topicSize != 0 {
 		t := new(message.Topic)
@@ -381,6 +687,10 @@ func (db *DB) PutEntry(e *Entry) error {
 
 	db.internal.meter.Puts.Inc(1)
 
+	if db.internal.subscriptions.active() {
+		db.internal.subscriptions.publish(db.internal.trie, e.entry.topicHash, newMessage(e))
+	}
+
 	// reset message entry.
 	e.reset()
 	return nil
@@ -397,9 +707,13 @@ func (db *DB) Delete(id, topic []byte) error {
 // It is safe to modify the contents of the argument after Delete returns but
 // not before.
 func (db *DB) DeleteEntry(e *Entry) error {
+	if err := db.startWrite(); err != nil {
+		return err
+	}
+	defer db.finishWrite()
 	switch {
 	case db.opts.flags.immutable:
-		return errImmutable
+		return ErrImmutable
 	case len(e.ID) == 0:
 		return errMsgIDEmpty
 	case len(e.Topic) == 0:
@@ -407,13 +721,21 @@ func (db *DB) DeleteEntry(e *Entry) error {
 	case len(e.Topic) > maxTopicLength:
 		return errTopicTooLarge
 	}
+	if db.opts.replicator != nil {
+		return db.replicate(func(b *Batch) error { return b.DeleteEntry(e) })
+	}
 	id := message.ID(e.ID)
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
 	topic, _, err := db.parseTopic(e.Contract, e.Topic)
 	if err != nil {
 		return err
 	}
-	if e.Contract == 0 {
-		e.Contract = message.MasterContract
+	if !e.entry.trusted {
+		if err := db.checkAccess(e.AccessKey, e.Contract, e.Topic, AccessWrite); err != nil {
+			return err
+		}
 	}
 	topic.AddContract(e.Contract)
 
@@ -424,6 +746,68 @@ func (db *DB) DeleteEntry(e *Entry) error {
 	return nil
 }
 
+// DeleteTopic deletes all messages of the topic and removes the topic from the DB, if the contract is
+// zero then it uses master Contract. The access key must grant write access to the topic, see WithAccessControl.
+// Data blocks of the messages are freed to reuse for new messages.
+// Messages put to the topic concurrently with DeleteTopic may or may not be deleted.
+// If Immutable flag is set when DB is open then DeleteTopic returns an error.
+func (db *DB) DeleteTopic(topic []byte, contract uint32, accessKey string) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if err := db.checkAccess(accessKey, contract, topic, AccessWrite); err != nil {
+		return err
+	}
+	return db.deleteTopic(topic, contract)
+}
+
+// deleteTopic deletes all messages of the topic and removes the topic from the DB, see DeleteTopic.
+func (db *DB) deleteTopic(topic []byte, contract uint32) error {
+	switch {
+	case db.opts.flags.immutable:
+		return ErrImmutable
+	case len(topic) == 0:
+		return errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return err
+	}
+	if t.TopicType != message.TopicStatic {
+		return errTopicNotStatic
+	}
+	t.AddContract(contract)
+	topicHash := t.GetHash(contract)
+
+	// Deleting a topic deletes persisted entries so it excludes sync, and readers are blocked while the topic is removed.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	db.internal.compactLock.Lock()
+	defer db.internal.compactLock.Unlock()
+
+	if err := db.deleteTopicEntries(topicHash); err != nil {
+		return err
+	}
+	db.internal.trie.remove(topicHash)
+	c := db.internal.topicClocks
+	c.mu.Lock()
+	delete(c.newest, topicHash)
+	c.mu.Unlock()
+	return nil
+}
+
+// NewBatch returns unmanaged Batch so caller can perform Put, Write, Commit, CommitAsync and Abort to the Batch.
+func (db *DB) NewBatch() *Batch {
+	return db.batch()
+}
+
 // Batch executes a function within the context of a read-write managed transaction.
 // If no error is returned from the function then the transaction is written.
 // If an error is returned then the entire transaction is rolled back.
@@ -437,12 +821,12 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 	b.setManaged()
 
 	// If an error is returned from the function then rollback and return error.
-	if err := fn(b, b.commitComplete); err != nil {
-		b.Abort()
-		close(b.commitComplete)
+	err := fn(b, b.commitComplete)
+	b.unsetManaged()
+	if err != nil {
+		b.done(err)
 		return err
 	}
-	b.unsetManaged()
 	return b.Commit()
 }
 
@@ -456,6 +840,25 @@ func (db *DB) Sync() error {
 		return nil
 	}
 
+	return db.syncEntries()
+}
+
+// Flush writes entries put to the DB before the call to the write ahead log and syncs these
+// to the DB files, e.g. before taking a snapshot of the file system. Unlike Sync it waits for
+// a sync in progress to complete and it returns once the entries are durable.
+func (db *DB) Flush() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if err := db.internal.mem.Flush(); err != nil {
+		return err
+	}
+
+	return db.syncEntries()
+}
+
+// syncEntries syncs entries written to the write ahead log into the DB files.
+func (db *DB) syncEntries() error {
 	// Sync happens synchronously.
 	db.internal.syncLockC <- struct{}{}
 	defer func() {
@@ -463,12 +866,17 @@ func (db *DB) Sync() error {
 	}()
 
 	if ok := db.internal.syncHandle.startSync(); !ok {
+		atomic.StoreInt64(&db.internal.syncedAt, time.Now().UnixNano())
 		return nil
 	}
 	defer func() {
 		db.internal.syncHandle.finish()
 	}()
-	return db.internal.syncHandle.Sync()
+	if err := db.internal.syncHandle.Sync(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&db.internal.syncedAt, time.Now().UnixNano())
+	return nil
 }
 
 // FileSize returns the total size of the disk storage used by the DB.
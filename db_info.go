@@ -18,6 +18,8 @@ package unitdb
 
 import (
 	"encoding/binary"
+
+	"github.com/unit-io/unitdb/block"
 )
 
 var (
@@ -35,6 +37,9 @@ type (
 		encryption int8
 		sequence   uint64
 		count      uint64
+		// blockSize is the size of index and window blocks, it is zero for a DB created
+		// before the block size was recorded, see block.InfoBlockSizeOffset.
+		blockSize int32
 	}
 )
 
@@ -43,9 +48,10 @@ func (inf _DBInfo) MarshalBinary() ([]byte, error) {
 	buf := make([]byte, fixed)
 	copy(buf[:7], inf.header.signature[:])
 	binary.LittleEndian.PutUint32(buf[7:11], inf.header.version)
-	buf[12] = uint8(inf.encryption)
+	buf[11] = uint8(inf.encryption)
 	binary.LittleEndian.PutUint64(buf[12:20], inf.sequence)
 	binary.LittleEndian.PutUint64(buf[20:28], inf.count)
+	binary.LittleEndian.PutUint32(buf[block.InfoBlockSizeOffset:32], uint32(inf.blockSize))
 
 	return buf, nil
 }
@@ -54,9 +60,26 @@ func (inf _DBInfo) MarshalBinary() ([]byte, error) {
 func (inf *_DBInfo) UnmarshalBinary(data []byte) error {
 	copy(inf.header.signature[:], data[:7])
 	inf.header.version = binary.LittleEndian.Uint32(data[7:11])
-	inf.encryption = int8(data[7])
+	inf.encryption = int8(data[11])
 	inf.sequence = binary.LittleEndian.Uint64(data[12:20])
 	inf.count = binary.LittleEndian.Uint64(data[20:28])
+	inf.blockSize = int32(binary.LittleEndian.Uint32(data[block.InfoBlockSizeOffset:32]))
 
 	return nil
 }
+
+// layout returns the block layout of the DB. It returns errBlockSizeMismatch if the block size
+// is set and it does not match the block size the DB was created with.
+func (inf _DBInfo) layout(blockSize int32) (block.Layout, error) {
+	if inf.blockSize == 0 {
+		inf.blockSize = block.Size
+	}
+	if blockSize != 0 && blockSize != inf.blockSize {
+		return block.Layout{}, errBlockSizeMismatch
+	}
+	layout, err := block.NewLayout(inf.blockSize)
+	if err != nil {
+		return block.Layout{}, ErrCorrupted
+	}
+	return layout, nil
+}
@@ -17,7 +17,10 @@
 package unitdb
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"io"
 	"math"
 	"sort"
@@ -25,28 +28,30 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
+	"github.com/rs/zerolog"
 	"github.com/unit-io/bpool"
-	"github.com/unit-io/unitdb/crypto"
+	"github.com/unit-io/unitdb/block"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 const (
-	entriesPerIndexBlock  = 255 // (4096 i.e blocksize - 14 fixed/16 i.e entry size)
-	entriesPerWindowBlock = 335 // ((4096 i.e. blocksize - 26 fixed)/12 i.e. window entry size)
-	nBlocks               = 100000
-	nShards               = 27
-	nPoolSize             = 27
-	lockPostfix           = ".lock"
-	idSize                = 9 // message ID prefix with additional encryption bit.
-	version               = 1 // file format version.
+	nBlocks     = 100000
+	nShards     = 27
+	nPoolSize   = 27
+	lockPostfix = ".lock"
+	idSize      = block.IDSize // message ID prefix with additional encryption bit.
+	version     = 2            // file format version.
 
 	// maxExpDur expired keys are deleted from DB after durType*maxExpDur.
 	// For example if durType is Minute and maxExpDur then
 	// all expired keys are deleted from db in 1 minutes
 	maxExpDur = 1
 
+	// maxExpiryScanBlocks is the maximum number of window blocks scanned for expired entries in an expirer run.
+	maxExpiryScanBlocks = 1024
+
 	// maxWindowDur duration in hours to save summary of records to timewindow files
 	maxWindowDur = 24 * 7
 
@@ -56,8 +61,8 @@ const (
 	// maxTopicLength is the maximum size of a topic in bytes.
 	maxTopicLength = 1 << 16
 
-	// maxValueLength is the maximum size of a value in bytes.
-	maxValueLength = 1 << 30
+	// maxValueLength is the maximum size of a value in bytes, see block.MaxValueSize.
+	maxValueLength = block.MaxValueSize
 
 	// maxKeys is the maximum numbers of keys in the DB.
 	maxKeys = math.MaxInt64
@@ -74,9 +79,15 @@ type (
 		start time.Time
 		// The metrics to measure timeseries on message events.
 		meter *Meter
+		// The run history of maintenance jobs.
+		runHistory *_RunHistory
+		// The logger of the DB, see WithLogger.
+		logger zerolog.Logger
+		// Codec, cipher suite and compaction filter of the DB.
+		plugins *_Plugins
 
-		dbInfo _DBInfo
-		mac    *crypto.MAC
+		dbInfo  _DBInfo
+		keyring *_Keyring
 
 		mem      *memdb.DB
 		bufPool  *bpool.BufferPool
@@ -85,13 +96,65 @@ type (
 		freeList *_Lease
 
 		timeWindow *_TimeWindowBucket
+		// Entry counts of window blocks.
+		winCounts *_WindowCounts
 
 		// Trie
 		trie *_Trie
 
+		// Topic policies.
+		policies *_PolicyTable
+
+		// Rollups downsampling raw messages of topics.
+		rollups *_RollupTable
+
+		// Names of topics by topic hash.
+		topicNames *_TopicNames
+
+		// Quotas and usage by contract.
+		quotas *_QuotaTable
+
+		// Metadata of contracts created by DB.NewContract.
+		contracts *_ContractTable
+
+		// Secret access keys are signed with and revoked keys, see DB.NewAccessKey.
+		access *_AccessTable
+
+		// Token buckets of the DB and contracts limiting rate of writes.
+		rateLimiter *_RateLimiter
+
+		// Subscriptions to topics, see DB.Subscribe.
+		subscriptions *_Subscriptions
+
+		// Timestamp of the newest entry per topic, see WithMonotonicTime.
+		topicClocks *_TopicClocks
+
+		// Number of deltas added to counters, see Counter.
+		counters *_Counters
+
+		// Number of offsets committed by consumer groups, see DB.CommitOffset.
+		offsets *_Offsets
+
+		// Most recent message of topics, nil unless the DB is opened with WithLastValueCache.
+		lastValues *_LastValues
+
 		// Block reader
 		reader *_BlockReader
 
+		// compactLock blocks readers while compaction swaps the index and data files.
+		compactLock sync.RWMutex
+		compaction  _CompactionProgress
+
+		// Size of the DB files at last sync and number of writes exceeding each limit.
+		fileSize       int64
+		limitsExceeded [nLimits]int64
+
+		// Time the DB was last in sync in unix nanoseconds, see AlertSyncLag.
+		syncedAt int64
+
+		// batchLock serializes conflict checks and writes of batches resolving write conflicts.
+		batchLock sync.Mutex
+
 		// sync handler
 		syncLockC  chan struct{}
 		syncWrites bool
@@ -102,6 +165,11 @@ type (
 		closeC chan struct{}
 		closed uint32
 		closer io.Closer
+
+		// writeW tracks puts, deletes and batch commits in progress, these are drained on close.
+		// closeMu excludes registering a write while the DB is being closed.
+		writeW  sync.WaitGroup
+		closeMu sync.RWMutex
 	}
 )
 
@@ -114,6 +182,7 @@ func (db *DB) writeInfo() error {
 		encryption: db.internal.dbInfo.encryption,
 		sequence:   atomic.LoadUint64(&db.internal.dbInfo.sequence),
 		count:      atomic.LoadUint64(&db.internal.dbInfo.count),
+		blockSize:  db.internal.dbInfo.blockSize,
 	}
 
 	return db.internal.info.writeMarshalableAt(inf, 0)
@@ -121,8 +190,18 @@ func (db *DB) writeInfo() error {
 
 // Close closes the DB.
 func (db *DB) close() error {
-	if !db.setClosed() {
-		return errClosed
+	db.internal.closeMu.Lock()
+	closed := db.setClosed()
+	db.internal.closeMu.Unlock()
+	if !closed {
+		return ErrClosed
+	}
+
+	// New writes are refused, wait for writes in progress so acknowledged writes are in the memdb
+	// and written to the log when the memdb is closed.
+	drainErr := db.drainWrites()
+	if drainErr != nil {
+		db.internal.logger.Warn().Str("context", "db.close").Err(drainErr).Msg("closing with writes in progress")
 	}
 
 	// Signal all goroutines.
@@ -134,12 +213,22 @@ func (db *DB) close() error {
 	// Wait for all goroutines to exit.
 	db.internal.closeW.Wait()
 
+	db.internal.subscriptions.closeAll()
+
 	// close memdb.
 	db.internal.mem.Close()
 
 	if err := db.writeInfo(); err != nil {
 		return err
 	}
+	if err := db.internal.filter.writeFilterBlock(); err != nil {
+		return err
+	}
+	if winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow}); err == nil {
+		if err := db.internal.winCounts.write(winFile.currSize()); err != nil {
+			return err
+		}
+	}
 	db.internal.freeList.defrag()
 	if err := db.internal.freeList.write(); err != nil {
 		return err
@@ -147,6 +236,12 @@ func (db *DB) close() error {
 	if err := db.fs.close(); err != nil {
 		return err
 	}
+	if err := db.internal.topicNames.close(); err != nil {
+		return err
+	}
+	if err := db.internal.quotas.close(); err != nil {
+		return err
+	}
 	if err := db.lock.unlock(); err != nil {
 		return err
 	}
@@ -161,18 +256,60 @@ func (db *DB) close() error {
 
 	db.internal.meter.UnregisterAll()
 
+	if err == nil {
+		err = drainErr
+	}
 	return err
 }
 
+// startWrite registers a write in progress, it fails once the DB is closed.
+// The caller must call finishWrite once the write is complete.
+func (db *DB) startWrite() error {
+	db.internal.closeMu.RLock()
+	defer db.internal.closeMu.RUnlock()
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.internal.writeW.Add(1)
+	return nil
+}
+
+// finishWrite completes a write registered by startWrite.
+func (db *DB) finishWrite() {
+	db.internal.writeW.Done()
+}
+
+// drainWrites waits for writes in progress to complete. It returns ErrDrainTimeout
+// if writes are still in progress once the drain timeout is reached.
+func (db *DB) drainWrites() error {
+	done := make(chan struct{})
+	go func() {
+		db.internal.writeW.Wait()
+		close(done)
+	}()
+	if db.opts.drainTimeout == 0 {
+		<-done
+		return nil
+	}
+	timer := time.NewTimer(db.opts.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrDrainTimeout
+	}
+}
+
 // loadTopicHash loads topic and offset from window blocks on stored on disk.
 func (db *DB) loadTrie() error {
 	r := newWindowReader(db.fs)
 	err := r.blockIterator(func(startSeq, topicHash uint64, off int64) (bool, error) {
-		e, err := db.internal.reader.readEntry(startSeq)
+		e, err := db.internal.reader.readIndexEntry(startSeq)
 		if err != nil {
 			return true, err
 		}
-		if e.topicSize == 0 {
+		if e.topicSize == 0 || e.msgOffset == -1 {
 			return false, nil
 		}
 		rawtopic, err := db.internal.reader.readTopic(e)
@@ -185,7 +322,7 @@ func (db *DB) loadTrie() error {
 			return true, err
 		}
 		if ok := db.internal.trie.add(newTopic(topicHash, off), t.Parts, t.Depth); !ok {
-			logger.Info().Str("context", "db.loadTrie: topic exist in the trie")
+			db.internal.logger.Info().Str("context", "db.loadTrie: topic exist in the trie")
 			return false, nil
 		}
 		return false, nil
@@ -207,6 +344,10 @@ func (db *DB) readEntry(q _Query) (_IndexEntry, error) {
 		}
 		return e, nil
 	}
+	// An entry deleted from the memdb before sync is not in the index.
+	if !db.internal.filter.Test(q.seq) {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
 
 	return db.internal.reader.readEntry(q.seq)
 }
@@ -219,17 +360,131 @@ func (db *DB) lookup(q *Query) error {
 	sort.Slice(topics[:], func(i, j int) bool {
 		return topics[i].offset > topics[j].offset
 	})
+	// Entries are looked up to the limit from each topic, as the newest entries of a wildcard query can be of any topic.
 	for _, topic := range topics {
-		if len(q.internal.winEntries) > q.Limit {
-			break
+		wEntries, blocks := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, q.internal.cutoff, q.internal.before, q.Limit)
+		q.internal.stats.BlocksRead += blocks
+		q.internal.stats.Visited += len(wEntries)
+		for _, we := range wEntries {
+			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime()})
 		}
-		limit := q.Limit - len(q.internal.winEntries)
-		wEntries := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, q.internal.cutoff, limit)
+	}
+
+	return nil
+}
+
+// topicHasEntry returns true if the entry of the seq is an entry of the topic of the query. Topics of a contract
+// share the ID prefix, so the entry is looked up in window entries of the topic, the newest entry not after
+// the seq is the entry of the seq if it is an entry of the topic.
+func (db *DB) topicHasEntry(q *Query, seq uint64) bool {
+	for _, topic := range db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType) {
+		wEntries, _ := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, 0, seq+1, 1)
 		for _, we := range wEntries {
-			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq()})
+			if we.seq() == seq {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getEntry gets the message of the query ID from the memdb or the block index using the seq of the ID,
+// it returns the ID prefix, headers and payload of the message, see decodeQueryMessage.
+// The index does not keep topic of the entries, so the message is matched by prefix of its ID and looked up
+// in window entries of the topic, see topicHasEntry.
+func (db *DB) getEntry(q *Query) (msgID []byte, headers map[string][]byte, val []byte, value func() io.Reader, err error) {
+	switch {
+	case len(q.ID) != message.ID(nil).Size():
+		return nil, nil, nil, nil, errMsgIDSize
+	case q.internal.topicType != message.TopicStatic:
+		return nil, nil, nil, nil, errTopicNotStatic
+	}
+	id := message.ID(q.ID)
+	id.SetContract(q.Contract)
+	q.internal.stats.Visited++
+	e, err := db.readEntry(_Query{seq: id.Sequence()})
+	if err != nil {
+		if err == errMsgIDDeleted || err == errEntryInvalid {
+			return nil, nil, nil, nil, errMsgIDDoesNotExist
 		}
+		return nil, nil, nil, nil, err
+	}
+	if e.cache != nil {
+		q.internal.stats.CacheHits++
+	} else {
+		q.internal.stats.BlocksRead++
+	}
+	msgID, val, err = db.internal.reader.readMessage(e)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if !bytes.Equal(msgID[:8], id.Prefix()) {
+		return nil, nil, nil, nil, errMsgIDPrefixMismatch
+	}
+	if !db.topicHasEntry(q, id.Sequence()) {
+		return nil, nil, nil, nil, errMsgIDDoesNotExist
+	}
+	headers, val, value, err = db.decodeQueryMessage(q, msgID, val)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	q.internal.stats.BytesDecompressed += int64(len(val))
+	db.internal.meter.OutBytes.Inc(int64(e.valueSize))
+	return msgID, headers, val, value, nil
+}
+
+// decodeQueryMessage decodes the value of the message read by the query. The payload of a query with
+// StreamValues set is not decoded, it returns a function opening readers of the payload in place of it.
+func (db *DB) decodeQueryMessage(q *Query, id, val []byte) (map[string][]byte, []byte, func() io.Reader, error) {
+	if q.StreamValues {
+		headers, value, err := decodeMessageReader(db.internal.keyring, db.internal.plugins, id, val)
+		return headers, nil, value, err
 	}
+	headers, payload, err := decodeMessage(db.internal.keyring, db.internal.plugins, id, val)
+	return headers, payload, nil, err
+}
 
+// seek sets the before seq of the query to the seq of the oldest message written after the seek time of the query.
+// Messages of the query are sorted by seq and searched for the time, deleted messages are skipped.
+func (db *DB) seek(q *Query) error {
+	sq := &Query{internal: q.internal, Topic: q.Topic, Contract: q.Contract, Limit: math.MaxInt32}
+	sq.internal.winEntries = nil
+	if err := db.lookup(sq); err != nil {
+		return err
+	}
+	entries := sq.internal.winEntries
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	var err error
+	// after returns true if the message i, or the next message not deleted, is written after the seek time.
+	after := func(i int) bool {
+		for ; i < len(entries) && err == nil; i++ {
+			e, rerr := db.readEntry(entries[i])
+			if rerr == errMsgIDDeleted || rerr == errEntryInvalid {
+				continue
+			}
+			if rerr != nil {
+				err = rerr
+				break
+			}
+			id, _, rerr := db.internal.reader.readMessage(e)
+			if rerr != nil {
+				err = rerr
+				break
+			}
+			return uid.Time(id[0:4]) > q.internal.seekTime
+		}
+		return true
+	}
+	i := sort.Search(len(entries), after)
+	if err != nil {
+		return err
+	}
+	q.internal.stats.BlocksRead += sq.internal.stats.BlocksRead
+	if i < len(entries) && (q.internal.before == 0 || entries[i].seq < q.internal.before) {
+		q.internal.before = entries[i].seq
+	}
 	return nil
 }
 
@@ -241,7 +496,7 @@ func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32,
 	// Parse the topic.
 	t.Parse(contract, true)
 	if t.TopicType == message.TopicInvalid {
-		return nil, 0, errBadRequest
+		return nil, 0, ErrTopicInvalid
 	}
 	// In case of ttl, add ttl to the msg and store to the db.
 	if ttl, ok := t.TTL(); ok {
@@ -250,7 +505,18 @@ func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32,
 	return t, 0, nil
 }
 
+// setEntry encodes the entry and commits it, for entries written by the DB that are not checked against limits
+// and quotas, see encodeEntry and commitEntry.
 func (db *DB) setEntry(e *Entry) error {
+	if err := db.encodeEntry(e); err != nil {
+		return err
+	}
+	return db.commitEntry(e)
+}
+
+// encodeEntry parses the topic of the entry and encodes the entry to write to the memdb. It does not change the DB,
+// so a write rejected by limits and quotas checked once the entry is encoded leaves nothing behind, see commitEntry.
+func (db *DB) encodeEntry(e *Entry) error {
 	var id message.ID
 	var eBit uint8
 	var seq uint64
@@ -259,40 +525,111 @@ func (db *DB) setEntry(e *Entry) error {
 		if e.Contract == 0 {
 			e.Contract = message.MasterContract
 		}
+		if db.internal.contracts.deleted(e.Contract) {
+			return errContractDeleted
+		}
+		if !e.entry.trusted {
+			if err := db.checkAccess(e.AccessKey, e.Contract, e.Topic, AccessWrite); err != nil {
+				return err
+			}
+		}
 		t, ttl, err := db.parseTopic(e.Contract, e.Topic)
 		if err != nil {
 			return err
 		}
+		for _, p := range t.Parts {
+			if p.Hash == message.SingleLevel {
+				return errTopicSingleLevel
+			}
+		}
+		if e.ExpiresAt == 0 && e.TTL != 0 {
+			expiresAt := time.Now().Add(e.TTL).Unix()
+			switch {
+			case e.TTL < 0:
+				return errTtlNegative
+			case expiresAt > math.MaxUint32:
+				return errTtlTooLarge
+			}
+			e.ExpiresAt = uint32(expiresAt)
+		}
 		if e.ExpiresAt == 0 && ttl > 0 {
 			e.ExpiresAt = ttl
 		}
+		// Inherit default TTL from policy of the topic.
+		if e.ExpiresAt == 0 {
+			if ttl, ok := db.internal.policies.ttl(e.Contract, t.Topic); ok {
+				e.ExpiresAt = uint32(time.Now().Add(ttl).Unix())
+			}
+		}
 		t.AddContract(e.Contract)
 		e.entry.topicHash = t.GetHash(e.Contract)
 		// topic is packed if it is new topic entry
-		if _, ok := db.internal.trie.getOffset(e.entry.topicHash); !ok {
+		_, ok := db.internal.trie.getOffset(e.entry.topicHash)
+		if !ok {
+			if len(e.Payload) != 0 {
+				if err := db.checkTopicQuota(e.Contract); err != nil {
+					return err
+				}
+			}
+			e.entry.newTopic = true
+		}
+		if !ok || e.entry.withTopic {
 			rawTopic = t.Marshal()
 			e.entry.topicSize = uint16(len(rawTopic))
 		}
 		e.entry.parsed = true
 	}
+	// The seq of an entry without seq in its ID is leased once the entry is committed.
 	if e.ID != nil {
 		id = message.ID(e.ID)
 		seq = id.Sequence()
 	} else {
-		seq = db.nextSeq()
-		id = message.NewID(seq)
-	}
-	if seq == 0 {
-		panic("db.setEntry: seq is zero")
+		id = message.NewID(0)
 	}
 
 	id.SetContract(e.Contract)
+	// Deletes in a batch also set the entry, only writes are checked for time order.
+	if len(e.Payload) != 0 {
+		if err := db.checkTime(e.entry.topicHash, id); err != nil {
+			return err
+		}
+	}
 	e.entry.seq = seq
 	e.entry.expiresAt = e.ExpiresAt
-	val := snappy.Encode(nil, e.Payload)
-	if db.internal.dbInfo.encryption == 1 || e.Encryption {
-		eBit = 1
-		val = db.internal.mac.Encrypt(nil, val)
+	payload := e.Payload
+	e.entry.sample = false
+	if len(e.Payload) != 0 {
+		var compressed bool
+		payload, compressed, e.entry.sample = db.compressPayload(e)
+		if compressed {
+			eBit |= block.DictionaryFlag
+		}
+	}
+	if len(e.Headers) != 0 {
+		// headers are encoded in the value before the payload, the headers flag of the ID is set.
+		value := encodeHeaders(nil, e.Headers)
+		if len(value) > maxHeadersSize {
+			return errHeadersTooLarge
+		}
+		payload = append(value, payload...)
+		eBit |= block.HeadersFlag
+	}
+	val := db.internal.plugins.encode(payload)
+	cc, bound, err := db.internal.keyring.contractCipher(e.Contract)
+	if err != nil {
+		return err
+	}
+	if bound || db.internal.dbInfo.encryption == 1 || e.Encryption {
+		// encryption flag of the ID is set to the key version used to encrypt the message.
+		version, c := db.internal.keyring.cipher()
+		if bound {
+			version, c = contractKeyVersion, cc
+		}
+		encVal, err := c.Encrypt(nil, val, id.Prefix())
+		if err != nil {
+			return err
+		}
+		eBit, val = eBit|version, encVal
 	}
 	e.entry.valueSize = uint32(len(val))
 	mLen := entrySize + idSize + uint32(e.entry.topicSize) + uint32(e.entry.valueSize)
@@ -312,11 +649,157 @@ func (db *DB) setEntry(e *Entry) error {
 	return nil
 }
 
+// commitEntry leases the seq of the entry without ID and records the topic of the entry, the newest time of
+// the topic and the payload sampled to train a dictionary, once the entry is accepted to write to the memdb.
+func (db *DB) commitEntry(e *Entry) error {
+	if e.entry.seq == 0 {
+		e.entry.seq = db.nextSeq()
+		entryData, err := e.entry.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		copy(e.entry.cache, entryData)
+	}
+	if e.entry.newTopic {
+		if err := db.internal.topicNames.add(e.entry.topicHash, e.Contract, topicName(e.Topic)); err != nil {
+			return err
+		}
+		e.entry.newTopic = false
+	}
+	if len(e.Payload) != 0 {
+		db.advanceTime(e.entry.topicHash, e.entry.cache[entrySize:entrySize+idSize])
+	}
+	if e.entry.sample {
+		if err := db.internal.plugins.dictionaries.sample(e.entry.topicHash, e.Payload, db.opts.dictionarySamples); err != nil {
+			return err
+		}
+		e.entry.sample = false
+	}
+	return nil
+}
+
+// decodeValue decrypts the value of the message if it is encrypted and decodes it using the codec of the DB.
+func (db *DB) decodeValue(id, val []byte) ([]byte, error) {
+	return decodeValue(db.internal.keyring, db.internal.plugins, id, val)
+}
+
+func decodeValue(kr *_Keyring, p *_Plugins, id, val []byte) ([]byte, error) {
+	_, payload, err := decodeMessage(kr, p, id, val)
+	return payload, err
+}
+
+// decryptMessage decrypts the value of the message by the key of its version.
+func decryptMessage(kr *_Keyring, id, val []byte) ([]byte, error) {
+	// last byte of ID holds the version of the encryption key and the headers flag.
+	switch v := uint8(id[idSize-1]) & block.KeyVersionMask; v {
+	case 0:
+		return val, nil
+	case contractKeyVersion:
+		c, bound, err := kr.contractCipher(binary.LittleEndian.Uint32(id[4:8]))
+		if err != nil {
+			return nil, err
+		}
+		// A message of a contract unbound from its key, or bound to another key, cannot be decrypted.
+		if !bound {
+			return nil, errMsgShredded
+		}
+		if val, err = c.Decrypt(nil, val, id[:idSize-1]); err != nil {
+			return nil, errMsgShredded
+		}
+		return val, nil
+	default:
+		c, err := kr.cipherOf(v)
+		if err != nil {
+			return nil, err
+		}
+		return c.Decrypt(nil, val, id[:idSize-1])
+	}
+}
+
+// decodeMessage decodes the value of the message, it returns headers and payload of the message.
+func decodeMessage(kr *_Keyring, p *_Plugins, id, val []byte) (map[string][]byte, []byte, error) {
+	val, err := decryptMessage(kr, id, val)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := p.decode(val)
+	if err != nil {
+		return nil, nil, err
+	}
+	var headers map[string][]byte
+	if uint8(id[idSize-1])&block.HeadersFlag != 0 {
+		if headers, payload, err = decodeHeaders(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	if uint8(id[idSize-1])&block.DictionaryFlag != 0 {
+		if payload, err = decompressPayload(p.dictionaries, payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	return headers, payload, nil
+}
+
+// decodeMessageReader decodes headers of the message, it returns the headers and a function opening
+// readers of the payload. The payload is decoded and decompressed by each reader as it is read, see
+// _Plugins.decodeReader, an encrypted value is decrypted in memory as its cipher authenticates it whole.
+func decodeMessageReader(kr *_Keyring, p *_Plugins, id, val []byte) (map[string][]byte, func() io.Reader, error) {
+	val, err := decryptMessage(kr, id, val)
+	if err != nil {
+		return nil, nil, err
+	}
+	open, err := p.decodeReader(val)
+	if err != nil || uint8(id[idSize-1])&(block.HeadersFlag|block.DictionaryFlag) == 0 {
+		return nil, open, err
+	}
+	r := bufio.NewReader(open())
+	var headers map[string][]byte
+	var size int
+	if uint8(id[idSize-1])&block.HeadersFlag != 0 {
+		if headers, size, err = readHeaders(r); err != nil {
+			return nil, nil, err
+		}
+	}
+	var dict []byte
+	if uint8(id[idSize-1])&block.DictionaryFlag != 0 {
+		// The dictionary ID is at most a few bytes, it is peeked at the start of the payload.
+		prefix, _ := r.Peek(binary.MaxVarintLen32)
+		var n int
+		if dict, n, err = readDictionaryID(p.dictionaries, prefix); err != nil {
+			return nil, nil, err
+		}
+		size += n
+	}
+	return headers, func() io.Reader {
+		r := bufio.NewReader(open())
+		r.Discard(size)
+		if dict != nil {
+			return flate.NewReaderDict(r, dict)
+		}
+		return r
+	}, nil
+}
+
+// exists returns true if an entry of the seq is in the memdb or synced to the DB.
+func (db *DB) exists(seq uint64) bool {
+	if data, _ := db.internal.mem.Get(seq); data != nil {
+		return true
+	}
+	if !db.internal.filter.Test(seq) {
+		return false
+	}
+	_, err := db.internal.reader.readIndexEntry(seq)
+	return err == nil
+}
+
 // delete deletes the given key from the DB.
 func (db *DB) delete(topicHash, seq uint64) error {
 	if db.opts.flags.immutable {
 		return nil
 	}
+	if err := db.ok(); err != nil {
+		return err
+	}
 
 	db.internal.meter.Dels.Inc(1)
 	db.internal.mem.Delete(seq)
@@ -326,22 +809,67 @@ func (db *DB) delete(topicHash, seq uint64) error {
 		return nil
 	}
 
-	w, err := newBlockWriter(db.fs, db.internal.freeList, nil)
+	// Index blocks are also written during sync.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	count, _, err := db.reclaim([]uint64{seq})
 	if err != nil {
 		return err
 	}
-	e, err := w.del(seq)
-	if err != nil {
-		return err
+	if count > 0 {
+		if err := db.uncount(topicHash, seq); err != nil {
+			return err
+		}
 	}
-	db.internal.freeList.freeBlock(e.msgOffset, e.mSize())
-	db.decount(1)
 	if db.internal.syncWrites {
 		return db.sync()
 	}
 	return nil
 }
 
+// reclaim marks entries deleted in the index and frees their data blocks to reuse for new entries.
+// It returns number of entries deleted and size of data blocks freed. Caller must hold the sync lock.
+//
+// Data blocks are freed once the index is written, so entries are left in the DB if the index is not written.
+func (db *DB) reclaim(seqs []uint64) (count, size int64, err error) {
+	w, err := newBlockWriter(db.fs, db.internal.freeList, nil, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	return db.reclaimEntries(w, seqs)
+}
+
+// reclaimEntries deletes entries using the block writer, so index blocks of the writer are not stale, see reclaim.
+func (db *DB) reclaimEntries(w *_BlockWriter, seqs []uint64) (count, size int64, err error) {
+	type free struct {
+		off int64
+		n   uint32
+	}
+	frees := make([]free, 0, len(seqs))
+	for _, seq := range seqs {
+		off, n, err := w.del(seq)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		frees = append(frees, free{off: off, n: n})
+	}
+	if err := w.writeIndex(); err != nil {
+		return 0, 0, err
+	}
+	for _, f := range frees {
+		db.internal.freeList.freeBlock(f.off, f.n)
+		count++
+		size += int64(f.n)
+	}
+	db.decount(uint64(count))
+	return count, size, nil
+}
+
 // batch starts a new batch.
 func (db *DB) batch() *Batch {
 	opts := &_Options{}
@@ -384,7 +912,7 @@ func (db *DB) isClosed() bool {
 // ok checks read ok status.
 func (db *DB) ok() error {
 	if db.isClosed() {
-		return errors.New("db is closed")
+		return ErrClosed
 	}
 	return nil
 }
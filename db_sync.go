@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/bpool"
@@ -29,7 +30,7 @@ type (
 	_SyncInfo struct {
 		lastSyncSeq    uint64
 		upperSeq       uint64
-		syncStatusOk   bool
+		syncStatusOk   int32 // syncStatusOk is read by Sync while the syncer writes it, so it is accessed atomically.
 		syncComplete   bool
 		inBytes        int64
 		count          int64
@@ -49,8 +50,8 @@ type (
 
 func (db *_SyncHandle) startSync() bool {
 	if db.syncInfo.lastSyncSeq == db.seq() {
-		db.syncInfo.syncStatusOk = false
-		return db.syncInfo.syncStatusOk
+		atomic.StoreInt32(&db.syncInfo.syncStatusOk, 0)
+		return false
 	}
 
 	db.rawWindow = db.internal.bufPool.Get()
@@ -59,33 +60,33 @@ func (db *_SyncHandle) startSync() bool {
 	var err error
 	db.windowWriter, err = newWindowWriter(db.fs, db.rawWindow)
 	if err != nil {
-		logger.Error().Err(err).Str("context", "startSync").Msg("Error syncing to db")
+		db.internal.logger.Error().Err(err).Str("context", "startSync").Msg("Error syncing to db")
 		return false
 	}
-	db.blockWriter, err = newBlockWriter(db.fs, db.internal.freeList, db.rawBlock)
+	db.blockWriter, err = newBlockWriter(db.fs, db.internal.freeList, db.rawBlock, db.opts.valueThreshold)
 	if err != nil {
-		logger.Error().Err(err).Str("context", "startSync").Msg("Error syncing to db")
+		db.internal.logger.Error().Err(err).Str("context", "startSync").Msg("Error syncing to db")
 		return false
 	}
-	db.syncInfo.syncStatusOk = true
+	atomic.StoreInt32(&db.syncInfo.syncStatusOk, 1)
 
-	return db.syncInfo.syncStatusOk
+	return true
 }
 
 func (db *_SyncHandle) finish() error {
-	if !db.syncInfo.syncStatusOk {
+	if atomic.LoadInt32(&db.syncInfo.syncStatusOk) == 0 {
 		return nil
 	}
 
 	db.internal.bufPool.Put(db.rawWindow)
 	db.internal.bufPool.Put(db.rawBlock)
 
-	db.syncInfo.syncStatusOk = false
+	atomic.StoreInt32(&db.syncInfo.syncStatusOk, 0)
 	return nil
 }
 
 func (db *_SyncHandle) status() (ok bool) {
-	return db.syncInfo.syncStatusOk
+	return atomic.LoadInt32(&db.syncInfo.syncStatusOk) == 1
 }
 
 func (db *_SyncHandle) reset() error {
@@ -137,7 +138,7 @@ func (db *DB) startSyncer(interval time.Duration) {
 				return
 			case <-syncTicker.C:
 				if err := db.Sync(); err != nil {
-					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error syncing to db")
+					db.internal.logger.Error().Err(err).Str("context", "startSyncer").Msg("Error syncing to db")
 					panic(err)
 				}
 			}
@@ -145,8 +146,24 @@ func (db *DB) startSyncer(interval time.Duration) {
 	}()
 }
 
-func (db *DB) startExpirer(durType time.Duration, maxDur int) {
-	expirerTicker := time.NewTicker(durType * time.Duration(maxDur))
+func (db *DB) startAlerter(interval time.Duration) {
+	alerterTicker := time.NewTicker(interval)
+	go func() {
+		var firing [nAlerts]bool
+		for {
+			select {
+			case <-alerterTicker.C:
+				db.checkAlerts(&firing)
+			case <-db.internal.closeC:
+				alerterTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startExpirer(interval time.Duration) {
+	expirerTicker := time.NewTicker(interval)
 	go func() {
 		for {
 			select {
@@ -160,13 +177,113 @@ func (db *DB) startExpirer(durType time.Duration, maxDur int) {
 	}()
 }
 
+func (db *DB) startCompactor(interval time.Duration) {
+	compactorTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-compactorTicker.C:
+				if err := db.Compact(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startCompactor").Msg("Error compacting db")
+				}
+			case <-db.internal.closeC:
+				compactorTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startReencrypter(interval time.Duration) {
+	reencrypterTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-reencrypterTicker.C:
+				if _, err := db.Reencrypt(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startReencrypter").Msg("Error re-encrypting db")
+				}
+			case <-db.internal.closeC:
+				reencrypterTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startMeterSnapshots(interval time.Duration) {
+	snapshotTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-snapshotTicker.C:
+				if err := db.snapshotMeter(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startMeterSnapshots").Msg("Error writing meter snapshot")
+				}
+			case <-db.internal.closeC:
+				snapshotTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startRetainer(interval time.Duration) {
+	retainerTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-retainerTicker.C:
+				if err := db.enforceRollups(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startRetainer").Msg("Error rolling up messages")
+				}
+				if err := db.enforceRetention(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startRetainer").Msg("Error enforcing retention")
+				}
+				if err := db.recountQuotas(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startRetainer").Msg("Error recounting quotas")
+				}
+			case <-db.internal.closeC:
+				retainerTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) startOffloader(interval time.Duration) {
+	offloaderTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-offloaderTicker.C:
+				if err := db.offload(); err != nil {
+					db.internal.logger.Error().Err(err).Str("context", "startOffloader").Msg("Error offloading cold segments")
+				}
+			case <-db.internal.closeC:
+				offloaderTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
 func (db *DB) sync() error {
 	// writeInfo information to persist correct seq information to disk.
 	if err := db.writeInfo(); err != nil {
 		return err
 	}
+	if n := db.internal.filter.expire(uint32(time.Now().Unix())); n > 0 {
+		db.internal.logger.Debug().Str("context", "db.sync").Int("generations", n).Msg("expired filter generations dropped")
+	}
+	if err := db.internal.filter.writeFilterBlock(); err != nil {
+		return err
+	}
 	if err := db.fs.sync(); err != nil {
-		return nil
+		return err
+	}
+	if size, err := db.fs.size(); err == nil {
+		atomic.StoreInt64(&db.internal.fileSize, size)
 	}
 
 	return nil
@@ -178,17 +295,18 @@ func (db *_SyncHandle) sync(recovery bool) error {
 	}
 	db.syncInfo.syncComplete = false
 	defer db.abort()
+	start := time.Now()
 
 	if _, err := db.blockWriter.extend(db.syncInfo.upperSeq); err != nil {
-		logger.Error().Err(err).Str("context", "db.extendBlocks")
+		db.internal.logger.Error().Err(err).Str("context", "db.extendBlocks")
 		return err
 	}
 	if err := db.windowWriter.write(); err != nil {
-		logger.Error().Err(err).Str("context", "timeWindow.write")
+		db.internal.logger.Error().Err(err).Str("context", "timeWindow.write")
 		return err
 	}
 	if err := db.blockWriter.write(); err != nil {
-		logger.Error().Err(err).Str("context", "block.write")
+		db.internal.logger.Error().Err(err).Str("context", "block.write")
 		return err
 	}
 
@@ -202,6 +320,11 @@ func (db *_SyncHandle) sync(recovery bool) error {
 	db.internal.meter.Syncs.Inc(db.syncInfo.count)
 	db.internal.meter.InMsgs.Inc(db.syncInfo.count)
 	db.internal.meter.InBytes.Inc(db.syncInfo.inBytes)
+	db.internal.meter.histogram("sync_seconds", time.Since(start).Seconds())
+	db.internal.meter.gauge("seq", float64(db.seq()))
+	db.internal.meter.gauge("count", float64(db.Count()))
+	db.internal.meter.gauge("file_size", float64(atomic.LoadInt64(&db.internal.fileSize)))
+	db.internal.winCounts.merge(db.windowWriter)
 	db.syncInfo.syncComplete = true
 	return nil
 }
@@ -213,7 +336,6 @@ func (db *_SyncHandle) Sync() error {
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
 	var err1 error
-	timeRelease := db.internal.timeWindow.release()
 	err := db.internal.mem.BlockIterator(func(timeID int64, seqs []uint64) (bool, error) {
 		winEntries := make(map[uint64]_WindowEntries)
 		sort.Slice(seqs[:], func(i, j int) bool {
@@ -226,7 +348,7 @@ func (db *_SyncHandle) Sync() error {
 			memdata, err := db.internal.mem.Lookup(timeID, seq)
 			if err != nil || memdata == nil {
 				db.syncInfo.entriesInvalid++
-				logger.Error().Err(err).Str("context", "mem.Get")
+				db.internal.logger.Error().Err(err).Str("context", "mem.Get")
 				err1 = err
 				continue
 			}
@@ -236,6 +358,10 @@ func (db *_SyncHandle) Sync() error {
 				err1 = err
 				continue
 			}
+			// A replace marker is applied once it is written to the log, see ReplaceTopic.
+			if m.valueSize == 0 {
+				continue
+			}
 			e := _IndexEntry{
 				seq:       m.seq,
 				topicSize: m.topicSize,
@@ -245,6 +371,8 @@ func (db *_SyncHandle) Sync() error {
 			}
 			if err := db.blockWriter.append(e); err != nil {
 				if err == errEntryExist {
+					// The entry was synced before the filter was written.
+					db.internal.filter.Append(e.seq, m.expiresAt)
 					continue
 				}
 				return true, err
@@ -257,10 +385,14 @@ func (db *_SyncHandle) Sync() error {
 				winEntries[m.topicHash] = _WindowEntries{we}
 			}
 
-			db.internal.filter.Append(we.seq())
+			db.internal.filter.Append(we.seq(), we.expiryTime())
 			db.syncInfo.count++
 			db.syncInfo.inBytes += int64(e.valueSize)
 		}
+		// Readers look up entries not yet synced from the time window and synced entries from the window file,
+		// so readers are blocked until the entries written to the window file are released from the time window.
+		db.internal.compactLock.Lock()
+		defer db.internal.compactLock.Unlock()
 		for h := range winEntries {
 			topicOff, ok := db.internal.trie.getOffset(h)
 			if !ok {
@@ -284,7 +416,7 @@ func (db *_SyncHandle) Sync() error {
 			return true, err
 		}
 		if db.syncInfo.syncComplete {
-			if err := timeRelease(timeID); err != nil {
+			if err := db.internal.timeWindow.release(timeID); err != nil {
 				return false, err
 			}
 			if err := db.internal.mem.Free(timeID); err != nil {
@@ -303,26 +435,38 @@ func (db *_SyncHandle) Sync() error {
 }
 
 // expireEntries run expirer to delete entries from db if ttl was set on entries and that has expired.
-func (db *DB) expireEntries() error {
+// It scans window blocks for expired entries, marks these deleted in the index and frees their data blocks.
+func (db *DB) expireEntries() (err error) {
 	// sync happens synchronously.
 	db.internal.syncLockC <- struct{}{}
 	defer func() {
 		<-db.internal.syncLockC
 	}()
-	expiredEntries := db.internal.timeWindow.expiryWindowBucket.getExpiredEntries(db.opts.queryOptions.defaultQueryLimit)
-	for _, expiredEntry := range expiredEntries {
-		we := expiredEntry.(_WinEntry)
-		/// Test filter block if message hash presence.
-		if !db.internal.filter.Test(we.seq()) {
-			continue
+	run := db.internal.runHistory.startRun(RunExpiry)
+	defer func() {
+		run.finish(err)
+	}()
+	if err := db.internal.timeWindow.scanExpiry(db.fs, maxExpiryScanBlocks); err != nil {
+		return err
+	}
+	for {
+		expiredEntries := db.internal.timeWindow.expiryWindowBucket.getExpiredEntries(db.opts.queryOptions.defaultQueryLimit)
+		if len(expiredEntries) == 0 {
+			return nil
 		}
-		e, err := db.internal.reader.readEntry(we.seq())
+		seqs := make([]uint64, 0, len(expiredEntries))
+		for _, expiredEntry := range expiredEntries {
+			we := expiredEntry.(_WinEntry)
+			/// Test filter block if message hash presence.
+			if !db.internal.filter.Test(we.seq()) {
+				continue
+			}
+			seqs = append(seqs, we.seq())
+		}
+		count, size, err := db.reclaim(seqs)
+		run.reclaim(count, size)
 		if err != nil {
 			return err
 		}
-		db.internal.freeList.free(e.seq, e.msgOffset, e.mSize())
-		db.decount(1)
 	}
-
-	return nil
 }
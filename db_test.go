@@ -17,15 +17,41 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/crypto"
+	"github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 var (
 	dbPath = "test"
+
+	soakDuration = flag.Duration("soak", 0, "run TestSoak for the duration, e.g. -soak=4h")
 )
 
 func cleanup() {
@@ -34,7 +60,7 @@ func cleanup() {
 
 func TestSimple(t *testing.T) {
 	cleanup()
-	db, err := Open(dbPath, WithBufferSize(1<<4), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	db, err := Open(dbPath, WithBufferSize(1<<12), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -197,6 +223,196 @@ func TestBatch(t *testing.T) {
 	verifyMsgsAndClose()
 }
 
+func TestBatchLimits(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit2.limits")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.SetOptions(WithBatchMaxEntries(3))
+		for i := 0; i < 3; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Put(topic, []byte("msg.full")); err != ErrBatchFull {
+			t.Fatalf("expected batch full error; got %v", err)
+		}
+		size := b.Size()
+		if size == 0 {
+			t.Fatal("expected batch size")
+		}
+		if err := b.Write(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Size() != 0 {
+			t.Fatalf("expected empty batch; got %d", b.Size())
+		}
+
+		b.SetOptions(WithBatchMaxEntries(0), WithBatchMaxBytes(size))
+		for i := 3; i < 6; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Put(topic, []byte("msg.full")); err != ErrBatchFull {
+			t.Fatalf("expected batch full error; got %v", err)
+		}
+		seq, topics := db.seq(), db.internal.topicNames.count(message.MasterContract)
+		if err := b.Put([]byte("unit2.limits.new"), []byte("msg.full")); err != ErrBatchFull {
+			t.Fatalf("expected batch full error; got %v", err)
+		}
+		if db.seq() != seq || db.internal.topicNames.count(message.MasterContract) != topics {
+			t.Fatal("expected entry rejected by batch size to not lease a seq or add its topic")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 6 {
+		t.Fatalf("expected 6 messages; got %d", len(v))
+	}
+}
+
+func TestBatchCommitCallback(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var calls int
+	var commitErr error
+	callback := func(err error) {
+		calls++
+		commitErr = err
+	}
+	topic := []byte("unit2.callback")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.SetCommitCallback(callback)
+		for i := 0; i < 10; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || commitErr != nil {
+		t.Fatalf("expected one successful commit callback; got %d calls, %v", calls, commitErr)
+	}
+
+	// The callback is called with the error of a rolled back batch.
+	errRollback := errors.New("rollback")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.SetCommitCallback(callback)
+		if err := b.Put(topic, []byte("msg.rollback")); err != nil {
+			t.Fatal(err)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("expected rollback error; got %v", err)
+	}
+	if calls != 2 || commitErr != errRollback {
+		t.Fatalf("expected commit callback with rollback error; got %d calls, %v", calls, commitErr)
+	}
+}
+
+func TestBatchConflict(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit2.conflict")
+	id := db.NewID()
+	put := func(policy ConflictPolicy, vals ...string) error {
+		return db.Batch(func(b *Batch, completed <-chan struct{}) error {
+			b.SetOptions(WithBatchConflict(policy))
+			if err := b.PutEntry(NewEntry(topic, []byte(vals[0])).WithID(id)); err != nil {
+				return err
+			}
+			for _, val := range vals[1:] {
+				if err := b.Put(topic, []byte(val)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	get := func() [][]byte {
+		v, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if err := put(ConflictLastWriterWins, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ConflictError, "error", "error.other"); err != ErrWriteConflict {
+		t.Fatalf("expected write conflict error; got %v", err)
+	}
+	if v := get(); !reflect.DeepEqual(v, [][]byte{[]byte("first")}) {
+		t.Fatalf("expected first entry; got %s", v)
+	}
+	if err := put(ConflictFirstWriterWins, "skipped", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(); !reflect.DeepEqual(v, [][]byte{[]byte("other"), []byte("first")}) {
+		t.Fatalf("expected first and other entries; got %s", v)
+	}
+}
+
+func TestCommitAsync(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit2.async")
+	b := db.NewBatch()
+	for i := 0; i < 10; i++ {
+		if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := b.CommitAsync()
+	select {
+	case <-f.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected commit to complete")
+	}
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d", len(v))
+	}
+}
+
 func TestExpiry(t *testing.T) {
 	cleanup()
 	db, err := Open(dbPath, WithMutable(), WithBackgroundKeyExpiry())
@@ -236,82 +452,6492 @@ func TestExpiry(t *testing.T) {
 	if data, err := db.Get(query.WithLimit(int(n))); len(data) != 0 || err != nil {
 		t.Fatal()
 	}
-	db.expireEntries()
+	if err := db.expireEntries(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.LastRun(RunExpiry); !ok {
+		t.Fatal("expected expiry run in the run history")
+	}
 }
 
-func TestLeasing(t *testing.T) {
+func TestExpiryScan(t *testing.T) {
 	cleanup()
-	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<4), WithMutable(), WithBackgroundKeyExpiry())
+	db, err := Open(dbPath, WithMutable())
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
 
+	topic := []byte("unit6.test")
 	var i uint16
 	var n uint16 = 100
 
-	topic := []byte("unit1.test")
-	var ids [][]byte
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
 	for i = 0; i < n; i++ {
-		messageID := db.NewID()
 		val := []byte(fmt.Sprintf("msg.%2d", i))
-		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+		if err := db.PutEntry(&Entry{Topic: topic, Payload: val, ExpiresAt: expiresAt}); err != nil {
 			t.Fatal(err)
 		}
-		ids = append(ids, messageID)
 	}
-	if err := db.Sync(); err != nil {
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
 		t.Fatal(err)
 	}
-	for _, id := range ids {
-		db.Delete(id, topic)
+	db, err = Open(dbPath, WithMutable(), WithBackgroundKeyExpiry(), WithExpiryScanInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries; got %d", n, count)
+	}
+	if err := db.expireEntries(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected expired entries deleted; got %d entries", count)
+	}
+	if r, ok := db.LastRun(RunExpiry); !ok || r.EntriesDropped != int64(n) || r.BytesReclaimed == 0 {
+		t.Fatalf("expected %d expired entries reclaimed; got %v", n, r)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
 	}
+
+	topic := []byte("unit5.test")
+	var i int
+	var n int = 100
+	var ids [][]byte
 	for i = 0; i < n; i++ {
 		messageID := db.NewID()
 		val := []byte(fmt.Sprintf("msg.%2d", i))
-		if err := db.Put(topic, val); err != nil {
-			t.Fatal(err)
-		}
 		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
 			t.Fatal(err)
 		}
 		ids = append(ids, messageID)
 	}
-	if err := db.Sync(); err != nil {
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
 		t.Fatal(err)
 	}
-	for _, id := range ids {
-		db.Delete(id, topic)
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals [][]byte
+	for i = n - 1; i >= 0; i-- {
+		if i%2 == 0 {
+			if err := db.Delete(ids[i], topic); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		vals = append(vals, []byte(fmt.Sprintf("msg.%2d", i)))
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := db.LastRun(RunCompaction)
+	if !ok || r.Err != "" {
+		t.Fatalf("expected compaction run in the run history; got %v", r)
+	}
+	if r.BytesReclaimed <= 0 || r.EntriesDropped == 0 {
+		t.Fatalf("expected compaction to reclaim space; got %v", r)
+	}
+	verifyMsgs := func() {
+		v, err := db.Get(NewQuery(topic).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("expected %v; got %v", vals, v)
+		}
+	}
+	verifyMsgs()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer db.Close()
+	verifyMsgs()
 }
 
-func TestWildcardTopics(t *testing.T) {
+func TestLimits(t *testing.T) {
 	cleanup()
-	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry())
+	db, err := Open(dbPath, WithMutable(), WithLimit(LimitValueSize, 8), WithLimit(LimitTopics, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit7.test"), []byte("msg.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit7.test"), []byte("msg.large")); err != errValueTooLarge {
+		t.Fatalf("expected %v; got %v", errValueTooLarge, err)
+	}
+	if err := db.Put([]byte("unit7.test2"), []byte("msg.1")); err != errTooManyTopics {
+		t.Fatalf("expected %v; got %v", errTooManyTopics, err)
+	}
+	// Rejected writes leave neither the topic nor a seq behind.
+	seq := db.internal.dbInfo.sequence
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit7.test3"), []byte("msg.1")); err != errTooManyTopics {
+			t.Fatalf("expected %v; got %v", errTooManyTopics, err)
+		}
+	}
+	if n := db.internal.topicNames.count(message.MasterContract); n != 1 {
+		t.Fatalf("expected 1 topic name; got %d", n)
+	}
+	if db.internal.dbInfo.sequence != seq {
+		t.Fatalf("expected seq %d; got %d", seq, db.internal.dbInfo.sequence)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// In observe mode writes exceeding the limits are accepted and counted.
+	db, err = Open(dbPath, WithMutable(), WithLimit(LimitValueSize, 8), WithLimit(LimitTopics, 1), WithLimitMode(LimitObserve))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
+	if err := db.Put([]byte("unit7.test"), []byte("msg.large")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit7.test2"), []byte("msg.1")); err != nil {
+		t.Fatal(err)
+	}
+	exceeded := db.LimitsExceeded()
+	if exceeded[LimitValueSize] != 1 || exceeded[LimitTopics] != 1 {
+		t.Fatalf("expected exceeded limits to be counted; got %v", exceeded)
+	}
+	if v, err := db.Varz(); err != nil || v.LimitsExceeded[LimitTopics.String()] != 1 {
+		t.Fatalf("expected exceeded limits in varz; got %v", v.LimitsExceeded)
+	}
+}
 
-	tests := []struct {
-		wtopic []byte
-		topic  []byte
-		msg    []byte
-	}{
-		{[]byte("..."), []byte("unit.b.b1"), []byte("...1")},
-		{[]byte("unit.b..."), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.b...1")},
-		{[]byte("unit.*.b1.b11.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.b11.*.*.b11111.*.1")},
-		{[]byte("unit.*.b1.*.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.*.*.*.b11111.*.1")},
-		{[]byte("unit.b.b1"), []byte("unit.b.b1"), []byte("unit.b.b1.1")},
-		{[]byte("unit.b.b1.b11"), []byte("unit.b.b1.b11"), []byte("unit.b.b1.b11.1")},
-		{[]byte("unit.b"), []byte("unit.b"), []byte("unit.b.1")},
+func TestAlerts(t *testing.T) {
+	cleanup()
+	var events []AlertEvent
+	hook := func(e AlertEvent) {
+		events = append(events, e)
 	}
-	for _, tt := range tests {
-		db.Put(tt.wtopic, tt.msg)
-		if msg, err := db.Get(NewQuery(tt.wtopic).WithLimit(10)); len(msg) == 0 || err != nil {
+	// Alerts are checked by the test, so background checks are not run during the test.
+	opts := []Options{WithMutable(), WithMaxSyncDuration(time.Hour, 1), WithAlert(AlertLogSize, 1), WithAlert(AlertDeadSpace, 10), WithAlertHook(hook)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit15.alert")
+	var ids [][]byte
+	for i := 0; i < 10; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
 			t.Fatal(err)
 		}
-		if msg, err := db.Get(NewQuery(tt.topic).WithLimit(10)); len(msg) == 0 || err != nil {
+		ids = append(ids, id)
+	}
+	// Entries are written to the log in the background.
+	for deadline := time.Now().Add(time.Second); db.internal.mem.LogSize() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var firing [nAlerts]bool
+	db.checkAlerts(&firing)
+	db.checkAlerts(&firing)
+	if len(events) != 1 || events[0].Alert != AlertLogSize || events[0].Value <= 1 {
+		t.Fatalf("expected log size alert to fire once; got %v", events)
+	}
+
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, id := range ids[:5] {
+		if err := db.Delete(id, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, firing = nil, [nAlerts]bool{}
+	db.checkAlerts(&firing)
+	if !firing[AlertDeadSpace] || events[len(events)-1].Alert != AlertDeadSpace || events[len(events)-1].Value < 10 {
+		t.Fatalf("expected dead space alert; got %v", events)
+	}
+}
+
+var registerTestPlugins sync.Once
+
+func TestPlugins(t *testing.T) {
+	cleanup()
+	registerTestPlugins.Do(func() {
+		RegisterCompactionFilter("test.odd", func(id, value []byte) bool {
+			return (value[len(value)-1]-'0')%2 == 1
+		})
+	})
+	db, err := Open(dbPath, WithCodec("none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit16.plugin")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dbPath); err != errPluginMismatch {
+		t.Fatalf("expected %v opening DB with other codec; got %v", errPluginMismatch, err)
+	}
+	if _, err := Open(dbPath, WithCodec("unknown")); err != errPluginNotRegistered {
+		t.Fatalf("expected %v; got %v", errPluginNotRegistered, err)
+	}
+	db, err = Open(dbPath, WithMutable(), WithCodec("none"), WithCompactionFilter("test.odd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var vals [][]byte
+	for i := 8; i >= 0; i -= 2 {
+		vals = append(vals, []byte(fmt.Sprintf("msg.%d", i)))
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	cleanup()
+	var buf bytes.Buffer
+	db, err := Open(dbPath, WithMutable(), WithLogger(zerolog.New(&buf)), WithLimit(LimitValueSize, 8), WithLimitMode(LimitObserve))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit8.test"), []byte("msg.large")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("limit exceeded")) {
+		t.Fatalf("expected warning to be logged to the DB logger; got %q", buf.String())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Warnings are not logged if log level of the DB is error.
+	buf.Reset()
+	db, err = Open(dbPath, WithMutable(), WithLogger(zerolog.New(&buf)), WithLogLevel(zerolog.ErrorLevel), WithLimit(LimitValueSize, 8), WithLimitMode(LimitObserve))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("unit8.test"), []byte("msg.large")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no warning to be logged; got %q", buf.String())
+	}
+}
+
+func TestRetention(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hourTopic := []byte("unit9.hour")
+	weekTopic := []byte("unit9.week")
+	var n int = 50
+	for i := 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.PutEntry(NewEntry(hourTopic, val)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(weekTopic, val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetPolicy(NewPolicy(hourTopic).WithRetention(Retention{MaxCount: 10})); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPolicy(NewPolicy([]byte("unit9...")).WithRetention(Retention{MaxAge: time.Hour})); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if policies := db.Policies(); len(policies) != 2 {
+		t.Fatalf("expected policies to persist; got %v", policies)
+	}
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	r, ok := db.LastRun(RunRetention)
+	if !ok || r.Err != "" {
+		t.Fatalf("expected retention run in the run history; got %v", r)
+	}
+	if r.EntriesDropped != int64(n-10) {
+		t.Fatalf("expected %d entries dropped; got %d", n-10, r.EntriesDropped)
+	}
+	var vals [][]byte
+	for i := n - 1; i >= n-10; i-- {
+		vals = append(vals, []byte(fmt.Sprintf("msg.%2d", i)))
+	}
+	v, err := db.Get(NewQuery(hourTopic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+	v, err = db.Get(NewQuery(weekTopic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != n {
+		t.Fatalf("expected %d messages; got %d", n, len(v))
+	}
+	if err := db.DeletePolicy(hourTopic, 0); err != nil {
+		t.Fatal(err)
+	}
+	if policies := db.Policies(); len(policies) != 1 {
+		t.Fatalf("expected policy to be deleted; got %v", policies)
+	}
+}
+
+type testCipher struct {
+	crypto.Cipher
+	encrypts, decrypts int
+}
+
+func (c *testCipher) Encrypt(dst, plaintext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) != 8 {
+		return dst, ErrBadRequest
+	}
+	c.encrypts++
+	return c.Cipher.Encrypt(dst, plaintext, additionalData)
+}
+
+func (c *testCipher) Decrypt(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) != 8 {
+		return dst, ErrBadRequest
+	}
+	c.decrypts++
+	return c.Cipher.Decrypt(dst, ciphertext, additionalData)
+}
+
+func TestCustomCipher(t *testing.T) {
+	cleanup()
+	parent, err := crypto.NewCipher([]byte("kbO0sBNsFjmAPXtrXjcLeT4ZfYZMTwNw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCipher{Cipher: parent}
+	db, err := Open(dbPath, WithEncryption(), WithCipher(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit15.test")
+	var vals [][]byte
+	var n int = 10
+	for i := 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+	if c.encrypts != n || c.decrypts != n {
+		t.Fatalf("expected custom cipher to encrypt and decrypt %d messages; got %d, %d", n, c.encrypts, c.decrypts)
+	}
+	if err := db.RotateKey([]byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")); err != errCustomCipher {
+		t.Fatalf("expected %v; got %v", errCustomCipher, err)
+	}
+}
+
+func TestTopicTTL(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.SetPolicy(NewPolicy([]byte("unit13...")).WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPolicy(NewPolicy([]byte("unit13.*.ch1")).WithTTL(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		topic    []byte
+		contract uint32
+		ttl      time.Duration
+	}{
+		{[]byte("unit13.alpha"), 0, time.Hour},
+		{[]byte("unit13.alpha.ch1"), 0, 2 * time.Hour},
+		{[]byte("unit13.alpha.ch1?ttl=1m"), 0, time.Minute},
+		{[]byte("unit13.alpha.ch1"), 1, 0},
+		{[]byte("unit14.alpha"), 0, 0},
+	}
+	for _, tt := range tests {
+		e := NewEntry(tt.topic, []byte("msg")).WithContract(tt.contract)
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		var want uint32
+		if tt.ttl > 0 {
+			want = uint32(now.Add(tt.ttl).Unix())
+		}
+		if e.ExpiresAt < want || e.ExpiresAt > want+1 {
+			t.Fatalf("%s: expected expiresAt %d; got %d", tt.topic, want, e.ExpiresAt)
+		}
+	}
+}
+
+func TestEntryTTL(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	expiresAt := uint32(now.Add(3 * time.Hour).Unix())
+	tests := []struct {
+		entry *Entry
+		ttl   time.Duration
+	}{
+		{&Entry{Topic: []byte("unit36.a"), TTL: time.Hour}, time.Hour},
+		{&Entry{Topic: []byte("unit36.a?ttl=1m"), TTL: time.Hour}, time.Hour},
+		{&Entry{Topic: []byte("unit36.a"), TTL: time.Hour, ExpiresAt: expiresAt}, 3 * time.Hour},
+	}
+	for _, tt := range tests {
+		tt.entry.Payload = []byte("msg")
+		if err := db.PutEntry(tt.entry); err != nil {
+			t.Fatal(err)
+		}
+		want := uint32(now.Add(tt.ttl).Unix())
+		if tt.entry.ExpiresAt < want || tt.entry.ExpiresAt > want+1 {
+			t.Fatalf("%s: expected expiresAt %d; got %d", tt.entry.Topic, want, tt.entry.ExpiresAt)
+		}
+	}
+
+	b := db.NewBatch()
+	e := &Entry{Topic: []byte("unit36.b"), Payload: []byte("msg"), TTL: time.Minute}
+	if err := b.PutEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint32(now.Add(time.Minute).Unix()); e.ExpiresAt < want || e.ExpiresAt > want+1 {
+		t.Fatalf("expected expiresAt %d; got %d", want, e.ExpiresAt)
+	}
+
+	if err := db.PutEntry(&Entry{Topic: []byte("unit36.c"), Payload: []byte("msg"), TTL: -time.Minute}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	cleanup()
+	oldKey := []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
+	newKey := []byte("kbO0sBNsFjmAPXtrXjcLeT4ZfYZMTwNw")
+	db, err := Open(dbPath, WithMutable(), WithEncryption(), WithEncryptionKey(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit10.test")
+	var vals [][]byte
+	var n int = 20
+	for i := 0; i < n; i++ {
+		if i == n/2 {
+			if err := db.RotateKey(newKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.PutEntry(NewEntry(topic, val)); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath, WithMutable(), WithEncryption(), WithEncryptionKey(oldKey)); err != errBadEncryptionKey {
+		t.Fatalf("expected %v; got %v", errBadEncryptionKey, err)
+	}
+	db, err = Open(dbPath, WithMutable(), WithEncryption(), WithEncryptionKey(newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verifyMsgs := func() {
+		v, err := db.Get(NewQuery(topic).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("expected %v; got %v", vals, v)
+		}
+	}
+	verifyMsgs()
+	count, err := db.Reencrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != int64(n/2) {
+		t.Fatalf("expected %d messages re-encrypted; got %d", n/2, count)
+	}
+	verifyMsgs()
+	if count, err = db.Reencrypt(); err != nil || count != 0 {
+		t.Fatalf("expected no messages to re-encrypt; got %d, %v", count, err)
+	}
+}
+
+func TestMeterHistory(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit11.test")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.snapshotMeter(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := db.MeterHistory("1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected 3 meter snapshots; got %d", len(history))
+	}
+	// Snapshots are returned most recent first and each snapshot counts the puts before it, including previous snapshots.
+	for i, v := range history {
+		if want := int64(2*(3-i) - 1); v.Puts != want {
+			t.Fatalf("expected %d puts in snapshot %d; got %d", want, i, v.Puts)
+		}
+	}
+	if v, err := db.Get(NewQuery(topic)); err != nil || len(v) != 3 {
+		t.Fatalf("expected meter snapshots to be isolated from user topics; got %d, %v", len(v), err)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	cleanup()
+	replicaPath := dbPath + ".replica"
+	os.RemoveAll(replicaPath)
+	defer os.RemoveAll(replicaPath)
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit12.test")
+	var vals [][]byte
+	var n int = 10
+	for i := 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+	}
+	var buf bytes.Buffer
+	if count, err := db.WriteHandoff(&buf); err != nil || count != n {
+		t.Fatalf("expected %d entries written; got %d, %v", n, count, err)
+	}
+
+	replica, err := Open(replicaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	handoff := buf.Bytes()
+	if count, err := replica.ApplyHandoff(bytes.NewReader(handoff)); err != nil || count != n {
+		t.Fatalf("expected %d entries applied; got %d, %v", n, count, err)
+	}
+	if count, err := replica.ApplyHandoff(bytes.NewReader(handoff)); err != nil || count != 0 {
+		t.Fatalf("expected applied entries to be skipped; got %d, %v", count, err)
+	}
+	v, err := replica.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+	if replica.seq() != db.seq() {
+		t.Fatalf("expected replica seq %d; got %d", db.seq(), replica.seq())
+	}
+}
+
+func TestWindows(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit16.test")
+	var n int = 1000
+	put := func(count int) {
+		for i := 0; i < count; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%4d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(n)
+	// Reopen DB to recover entries from the log into window blocks.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	put(5)
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	windows, err := db.Windows(topic, 0, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) < 4 {
+		t.Fatalf("expected a memdb window and 3 window blocks; got %d windows", len(windows))
+	}
+	var count, size int64
+	for _, w := range windows {
+		count += w.Count
+		size += w.Bytes
+		if w.FirstSeq > w.LastSeq {
+			t.Fatalf("expected first seq before last seq; got %v", w)
+		}
+	}
+	if count != int64(n+5) {
+		t.Fatalf("expected %d entries; got %d", n+5, count)
+	}
+	if size <= count {
+		t.Fatalf("expected byte count of values; got %d", size)
+	}
+	if windows[0].Count != 5 || windows[0].LastSeq != db.seq()-3 {
+		t.Fatalf("expected most recent window first; got %v", windows[0])
+	}
+	if windows, err := db.Windows(topic, 0, "", time.Now().Add(time.Hour), time.Time{}); err != nil || len(windows) != 0 {
+		t.Fatalf("expected no windows; got %v, %v", windows, err)
+	}
+	if windows, err := db.Windows(topic, contract, "", time.Time{}, time.Time{}); err != nil || len(windows) != 1 || windows[0].Count != 3 || windows[0].LastSeq != db.seq() {
+		t.Fatalf("expected window of the contract; got %v, %v", windows, err)
+	}
+}
+
+func TestMonotonicTime(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithMonotonicTime(MonotonicReject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit11.sensor")
+	if err := db.Put(topic, []byte("msg.new")); err != nil {
+		t.Fatal(err)
+	}
+	// Entry with ID of a source with clock skew.
+	oldID := func() []byte {
+		id := db.NewID()
+		binary.LittleEndian.PutUint32(id[0:4], uid.Apoch(time.Now().Add(-time.Hour).Unix()))
+		return id
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.old")).WithID(oldID())); err != errNotMonotonic {
+		t.Fatalf("expected %v; got %v", errNotMonotonic, err)
+	}
+	if v, err := db.Varz(); err != nil || v.TimeRejected != 1 {
+		t.Fatalf("expected rejected write in varz; got %v", v.TimeRejected)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest timestamp of the topic is read from the DB after reopen.
+	db, err = Open(dbPath, WithMutable(), WithMonotonicTime(MonotonicAdjust))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.old")).WithID(oldID())); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Varz(); err != nil || v.TimeAdjusted != 1 {
+		t.Fatalf("expected adjusted write in varz; got %v", v.TimeAdjusted)
+	}
+	vals := [][]byte{[]byte("msg.old"), []byte("msg.new")}
+	v, err := db.Get(NewQuery(topic).WithLast("1m").WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+}
+
+func TestReplaceTopic(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := []byte("unit10.config")
+	for i := 0; i < 5; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("old.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entry not yet synced to the DB is also replaced.
+	if err := db.Put(topic, []byte("old.5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceTopic(topic, []*Entry{NewEntry(nil, []byte("new.0")), NewEntry(nil, []byte("new.1"))}); err != nil {
+		t.Fatal(err)
+	}
+	vals := [][]byte{[]byte("new.1"), []byte("new.0")}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+	if err := db.ReplaceTopic([]byte("unit10.*"), nil); !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected error replacing wildcard topic; got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err = db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v after reopen; got %v", vals, v)
+	}
+}
+
+// _FailingFS fails writes to files with the suffix of an in-memory file system once armed.
+type _FailingFS struct {
+	*fs.Mem
+	suffix atomic.Value
+}
+
+type _FailingFile struct {
+	fs.File
+	fsys *_FailingFS
+}
+
+func (f *_FailingFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	file, err := f.Mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &_FailingFile{File: file, fsys: f}, nil
+}
+
+func (f *_FailingFile) WriteAt(p []byte, off int64) (int, error) {
+	if suffix, _ := f.fsys.suffix.Load().(string); suffix != "" && strings.HasSuffix(f.Name(), suffix) {
+		return 0, errors.New("write failed")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestReplaceTopicFailure(t *testing.T) {
+	failing := &_FailingFS{Mem: fs.NewMem()}
+	db, err := Open(dbPath, WithMutable(), WithFileSystem(failing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit10.failure")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("old.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable(), WithFileSystem(failing)); err != nil {
+		t.Fatal(err)
+	}
+	// Entry not yet synced to the DB is written to the log.
+	if err := db.Put(topic, []byte("old.3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.internal.mem.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	vals := [][]byte{[]byte("old.3"), []byte("old.2"), []byte("old.1"), []byte("old.0")}
+	verify := func(db *DB, vals [][]byte) {
+		t.Helper()
+		v, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("expected %v; got %v", vals, v)
+		}
+	}
+
+	// New entries are not written to the log, or persisted entries are not deleted. The topic keeps its entries.
+	for _, suffix := range []string{".tmp", ".index"} {
+		failing.suffix.Store(suffix)
+		if err := db.ReplaceTopic(topic, []*Entry{NewEntry(nil, []byte("new.0"))}); err == nil {
+			t.Fatalf("expected error replacing topic on failed %s write", suffix)
+		}
+		failing.suffix.Store("")
+		verify(db, vals)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable(), WithFileSystem(failing)); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db, vals)
+
+	if err := db.ReplaceTopic(topic, []*Entry{NewEntry(nil, []byte("new.0"))}); err != nil {
+		t.Fatal(err)
+	}
+	verify(db, [][]byte{[]byte("new.0")})
+}
+
+func TestReplaceTopicCrash(t *testing.T) {
+	topic := []byte("unit10.crash")
+	oldVals := [][]byte{[]byte("old.3"), []byte("old.2"), []byte("old.1"), []byte("old.0")}
+	newVals := [][]byte{[]byte("new.1"), []byte("new.0")}
+	open := func(fsys fs.FileSystem) *DB {
+		t.Helper()
+		db, err := Open(dbPath, WithMutable(), WithMaxSyncDuration(time.Hour, 1), WithSyncPolicy(SyncPolicy{Mode: SyncAlways}), WithFileSystem(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	// The DB crashes on the nth write, truncate or sync of ReplaceTopic, the topic is either replaced or keeps its entries.
+	for n := 1; ; n++ {
+		mem := fs.NewMem()
+		db := open(mem)
+		for i := 0; i < 3; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("old.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Reopen DB to recover entries from the log into the index and data files.
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		faulty := fs.NewFaulty(mem, fs.FaultOptions{Mode: fs.FaultDrop, Seed: int64(n)})
+		db = open(faulty)
+		// Entry not yet synced to the DB is written to the log.
+		if err := db.Put(topic, []byte("old.3")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.internal.mem.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		faulty.CrashAfter(n)
+		err := db.ReplaceTopic(topic, []*Entry{NewEntry(nil, []byte("new.0")), NewEntry(nil, []byte("new.1"))})
+		crashed := faulty.Crashed()
+		if !crashed && err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		// The lock file is left behind by the crashed process.
+		mem.Remove(dbPath + "/" + prefix + ".lock")
+
+		db = open(mem)
+		v, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(newVals, v) && (!crashed || !reflect.DeepEqual(oldVals, v)) {
+			t.Fatalf("expected topic replaced or keeping its entries on crash after %d operations; got %s", n, v)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !crashed {
+			break
+		}
+	}
+}
+
+func TestReplaceTopicQuota(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota(contract, Quota{MaxMessagesPerDay: 3}); err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit10.quota")
+	for i := 0; i < 2; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("old.%d", i))).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := []*Entry{NewEntry(nil, []byte("new.0")).WithContract(contract), NewEntry(nil, []byte("new.1")).WithContract(contract)}
+	if err := db.ReplaceTopic(topic, entries); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v; got %v", ErrQuotaExceeded, err)
+	}
+	vals := [][]byte{[]byte("old.1"), []byte("old.0")}
+	v, err := db.Get(NewQuery(topic).WithContract(contract).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit44.errors")
+	for _, c := range []struct {
+		err    error
+		target error
+	}{
+		{db.Put(nil, []byte("msg")), ErrTopicInvalid},
+		{db.Put(topic, nil), ErrValueInvalid},
+		{db.Delete(nil, topic), ErrMessageIDRequired},
+		{db.Counter([]byte("unit44.*")).Add(1), ErrTopicInvalid},
+		{db.ReplaceTopic([]byte("unit44..."), nil), ErrTopicInvalid},
+	} {
+		if !errors.Is(c.err, c.target) || !errors.Is(c.err, ErrBadRequest) {
+			t.Fatalf("expected %v wrapping %v; got %v", c.target, ErrBadRequest, c.err)
+		}
+	}
+	if _, err := db.Get(NewQuery(topic).WithID(db.NewID()[:8])); !errors.Is(err, ErrMessageIDInvalid) {
+		t.Fatalf("expected %v; got %v", ErrMessageIDInvalid, err)
+	}
+
+	b := db.NewBatch()
+	if err := b.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(topic, []byte("msg")); err != ErrBatchClosed {
+		t.Fatalf("expected %v; got %v", ErrBatchClosed, err)
+	}
+	if err := b.Commit(); err != ErrBatchClosed {
+		t.Fatalf("expected %v; got %v", ErrBatchClosed, err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(topic, []byte("msg")); !errors.Is(err, ErrBatchClosed) {
+		t.Fatalf("expected %v; got %v", ErrBatchClosed, err)
+	}
+
+	if _, err := Open(dbPath); err != ErrLocked {
+		t.Fatalf("expected %v; got %v", ErrLocked, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("msg")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v; got %v", ErrClosed, err)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	cleanup()
+	for _, opt := range []Options{
+		WithBufferSize(1 << 4),
+		WithMemdbSize(0),
+		WithMaxSyncDuration(time.Second, -1),
+		WithWriteStallTimeout(-time.Second),
+		WithTinyBatchMaxBytes(-1),
+		WithLogRecycle(-1),
+		WithBlockSize(3000),
+		WithBlockCacheSize(-1),
+		WithRecoveryWorkers(-1),
+		WithMaxQueryLimit(10),
+		WithBatchMaxEntries(-1),
+		WithSyncPolicy(SyncPolicy{Mode: SyncInterval}),
+		WithLimit(LimitValueSize, -1),
+		WithAckTimeout(-time.Second),
+	} {
+		if err := opt.Validate(); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("expected %v validating option; got %v", ErrInvalidOptions, err)
+		}
+		if _, err := Open(dbPath, opt); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("expected %v; got %v", ErrInvalidOptions, err)
+		}
+	}
+	// Options added later to the builder override options added earlier.
+	opts := NewOptions().With(WithMutable(), WithBufferSize(1<<4))
+	if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v; got %v", ErrInvalidOptions, err)
+	}
+	if err := opts.With(WithBufferSize(1 << 12)).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// The DB is not created if options are invalid.
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no files written; got %v", err)
+	}
+	db, err := Open(dbPath, opts, WithMaxSyncDuration(time.Second, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit10.options"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemFileSystem(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	db, err := Open(dbPath, WithMutable(), WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath, WithFileSystem(mem)); err != ErrLocked {
+		t.Fatalf("expected %v; got %v", ErrLocked, err)
+	}
+	topic := []byte("unit12.mem")
+	var vals [][]byte
+	for i := 0; i < 10; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no files written to disk; got %v", err)
+	}
+
+	db, err = Open(dbPath, WithMutable(), WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v; got %v", vals, v)
+	}
+}
+
+func TestMmapFileSystem(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithFileSystem(fs.NewMmap(".data", ".index")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit14.mmap")
+	var vals [][]byte
+	for i := 0; i < 10; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+		// Sync extends the mapped files, and these are read back after each sync.
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := db.Get(NewQuery(topic).WithLimit(20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("expected %v; got %v", vals, v)
+		}
+	}
+	// Compaction truncates the mapped data file.
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %v after compaction; got %v", vals, v)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := db.Counter([]byte("unit13.count"))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < maxCounterDeltas/2; j++ {
+				if err := c.Add(1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := c.Add(-10); err != nil {
+		t.Fatal(err)
+	}
+	expected := int64(2*maxCounterDeltas - 10)
+	if n, err := c.Get(); err != nil || n != expected {
+		t.Fatalf("expected %d; got %d, %v", expected, n, err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit13.count")).WithLimit(10)); err != nil || len(items) != 1 {
+		t.Fatalf("expected deltas collapsed to a single entry; got %d, %v", len(items), err)
+	}
+	if err := db.Counter([]byte("unit13.*")).Add(1); !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected error adding to wildcard topic; got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n, err := db.Counter([]byte("unit13.count")).Get(); err != nil || n != expected {
+		t.Fatalf("expected %d after reopen; got %d, %v", expected, n, err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit17.repair1"), []byte("unit17.repair2")}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(topics[i%2], []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the data file.
+	dataPath := filePath(dbPath, _FileDesc{fileType: typeData})
+	stat, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(dataPath, stat.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Salvaged == 0 || report.Discarded == 0 || report.Salvaged+report.Discarded != 20 {
+		t.Fatalf("expected entries salvaged and discarded; got %+v", report)
+	}
+	if _, err := os.Stat(dataPath + repairExt); err != nil {
+		t.Fatalf("expected data file moved aside; got %v", err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int64
+	for _, topic := range topics {
+		v, err := db.Get(NewQuery(topic).WithLimit(20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += int64(len(v))
+	}
+	if count != report.Salvaged {
+		t.Fatalf("expected %d entries after repair; got %d", report.Salvaged, count)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit21.verify1"), []byte("unit21.verify2")}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(topics[i%2], []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Entries != 20 || report.Topics != 2 || report.WindowBlocks == 0 {
+		t.Fatalf("expected DB verified; got %+v", report)
+	}
+
+	// Corrupt value of the last message in the data file.
+	dataPath := filePath(dbPath, _FileDesc{fileType: typeData})
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("corrupt"), stat.Size()-7); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if report, err = db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].File != "data" {
+		t.Fatalf("expected corrupted value reported; got %+v", report.Issues)
+	}
+}
+
+func TestBlockReader(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put([]byte("unit22.block"), []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := block.Open(fs.OS, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	nIndexBlocks, err := r.IndexBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages, topics int
+	for idx := int32(0); idx < nIndexBlocks; idx++ {
+		b, err := r.ReadIndexBlock(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range b.Entries[:b.EntryIdx] {
+			m, err := r.ReadMessage(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.KeyVersion() != 1 {
+				t.Fatalf("expected message encrypted with key version 1; got %d", m.KeyVersion())
+			}
+			if len(m.Topic) != 0 {
+				topics++
+			}
+			messages++
+		}
+	}
+	if messages != 20 || topics != 1 {
+		t.Fatalf("expected 20 messages and 1 topic; got %d, %d", messages, topics)
+	}
+	nWinBlocks, err := r.WindowBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs int
+	for idx := int32(0); idx < nWinBlocks; idx++ {
+		b, err := r.ReadWindowBlock(block.Offset(idx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs += int(b.EntryIdx)
+	}
+	if seqs != 20 {
+		t.Fatalf("expected 20 window entries; got %d", seqs)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit23.checksum")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to recover entries from the log into the index and data files.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Corrupt the first message in the data file.
+	f, err := os.OpenFile(filePath(dbPath, _FileDesc{fileType: typeData}), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, idSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	_, err = db.Get(NewQuery(topic).WithLimit(10))
+	var corruption *block.CorruptionError
+	if !errors.As(err, &corruption) || corruption.File != "data" || corruption.Offset != 0 {
+		t.Fatalf("expected data corruption error; got %v", err)
+	}
+}
+
+func TestFilterRepair(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit24.filter")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen DB to sync entries from the log and write the filter.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.LastRun(RunFilterRebuild); ok {
+		t.Fatal("expected filter to be loaded from the filter file")
+	}
+	if db.internal.filter.Test(db.seq() + 1) {
+		t.Fatal("expected filter to not report the next seq")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the filter file.
+	name := filePath(dbPath, _FileDesc{fileType: typeFilter})
+	f, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff}, 100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := Open(dbPath, WithFilterRepair(FilterFail)); err != errFilterCorrupted {
+		t.Fatalf("expected filter corrupted error; got %v", err)
+	}
+	db, err = Open(dbPath, WithFilterRepair(FilterSkip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.internal.filter.Test(db.seq() + 1) {
+		t.Fatal("expected filter to report any seq")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if r, ok := db.LastRun(RunFilterRebuild); !ok || r.Err != "" {
+		t.Fatalf("expected filter rebuild; got %v", r)
+	}
+	for seq := uint64(1); seq <= db.seq(); seq++ {
+		if !db.internal.filter.Test(seq) {
+			t.Fatalf("expected filter to report seq %d", seq)
+		}
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d", len(v))
+	}
+}
+
+func TestFilterGenerations(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	f := &db.internal.filter
+	now := uint32(time.Now().Unix())
+	var seq uint64
+	// The first generation expires, the second generation has entries without TTL.
+	for i := 0; i < filterGenerationSize; i++ {
+		seq++
+		f.Append(seq, now-10)
+	}
+	for i := 0; i < filterGenerationSize; i++ {
+		seq++
+		f.Append(seq, 0)
+	}
+	seq++
+	f.Append(seq, now-10)
+	if !f.Test(1) || !f.Test(seq) {
+		t.Fatal("expected filter to report appended seqs")
+	}
+	if n := f.expire(now); n != 1 {
+		t.Fatalf("expected one generation dropped; got %d", n)
+	}
+	if f.Test(1) || f.covers(1) {
+		t.Fatal("expected seq of the dropped generation not reported")
+	}
+	if !f.Test(filterGenerationSize+1) || !f.Test(seq) {
+		t.Fatal("expected filter to report seqs of remaining generations")
+	}
+
+	if err := f.writeFilterBlock(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Filter{file: f.file}
+	if ok, err := loaded.load(); !ok || err != nil {
+		t.Fatalf("expected filter loaded; got %v, %v", ok, err)
+	}
+	if len(loaded.generations) != 2 {
+		t.Fatalf("expected 2 generations; got %d", len(loaded.generations))
+	}
+	if loaded.Test(1) || !loaded.Test(filterGenerationSize+1) || !loaded.Test(seq) {
+		t.Fatal("expected loaded filter to report seqs of remaining generations")
+	}
+}
+
+func TestFilterParams(t *testing.T) {
+	cleanup()
+	opts := []Options{WithFilterBitsPerKey(20), WithFilterHashes(14)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit24.filter.params")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.LastRun(RunFilterRebuild); ok {
+		t.Fatal("expected filter to be loaded from the filter file")
+	}
+	size := int64(filterHeaderSize + filter.BlockSizeOf(20*filterGenerationSize, 14))
+	if s, err := db.Stats(); err != nil || s.FilterBytes != size || !s.FilterLoaded {
+		t.Fatalf("expected filter of %d bytes loaded; got %+v, %v", size, s, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter written with other parameters is rebuilt.
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := db.LastRun(RunFilterRebuild); !ok || r.Err != "" {
+		t.Fatalf("expected filter rebuild; got %v", r)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, append(opts, WithFilterRepair(FilterRebuildLazy))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, ok := db.LastRun(RunFilterRebuild)
+	for ; !ok; r, ok = db.LastRun(RunFilterRebuild) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Err != "" {
+		t.Fatalf("expected filter rebuild; got %v", r)
+	}
+	if s, err := db.Stats(); err != nil || !s.FilterLoaded {
+		t.Fatalf("expected filter loaded; got %+v, %v", s, err)
+	}
+	for seq := uint64(1); seq <= db.seq(); seq++ {
+		if !db.internal.filter.Test(seq) {
+			t.Fatalf("expected filter to report seq %d", seq)
+		}
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d", len(v))
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit24.cache")
+	var ids [][]byte
+	for i := 0; i < 10; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Reopen DB to sync entries from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable(), WithBlockCacheSize(4*int64(block.Size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	get := func(n int) {
+		v, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != n {
+			t.Fatalf("expected %d messages; got %d", n, len(v))
+		}
+	}
+	get(10)
+	if db.internal.meter.BlockCacheMisses.Count() == 0 {
+		t.Fatal("expected block cache misses")
+	}
+	hits := db.internal.meter.BlockCacheHits.Count()
+	get(10)
+	if db.internal.meter.BlockCacheHits.Count() <= hits {
+		t.Fatal("expected block cache hits")
+	}
+
+	// Deleting the entry writes the index block, the cached block is invalidated.
+	if err := db.Delete(ids[0], topic); err != nil {
+		t.Fatal(err)
+	}
+	get(9)
+	if _, err := db.Get(NewQuery(topic).WithID(ids[0])); err == nil {
+		t.Fatal("expected deleted message not found")
+	}
+
+	c := db.internal.reader.dataFile.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size > c.capacity {
+		t.Fatalf("expected block cache size within %d bytes; got %d", c.capacity, c.size)
+	}
+}
+
+func TestRecoveryWorkers(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithMaxSyncDuration(time.Hour, 1), WithRecoveryWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics := [][]byte{[]byte("unit41.a"), []byte("unit41.b"), []byte("unit41.c")}
+	n := 300
+	for i := 0; i < n; i++ {
+		if err := db.Put(topics[i%len(topics)], []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the memdb to write the entries to the log.
+	time.Sleep(100 * time.Millisecond)
+	if err := db.recoverLog(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries; got %d", n, count)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, topic := range topics {
+		v, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vals [][]byte
+		for i := n - len(topics) + j; i >= 0; i -= len(topics) {
+			vals = append(vals, []byte(fmt.Sprintf("msg.%d", i)))
+		}
+		if !reflect.DeepEqual(vals, v) {
+			t.Fatalf("topic %s: expected %d values in order; got %d", topic, len(vals), len(v))
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryProgress(t *testing.T) {
+	cleanup()
+	var progress []RecoveryProgress
+	db, err := Open(dbPath, WithMutable(), WithMaxSyncDuration(time.Hour, 1), WithRecoveryProgress(func(p RecoveryProgress) {
+		progress = append(progress, p)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit42.test")
+	n := 100
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the memdb to write the entries to the log.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	db.opts.recoveryContext = ctx
+	if err := db.recoverLog(); err != context.Canceled {
+		t.Fatalf("expected %v; got %v", context.Canceled, err)
+	}
+	if count := db.Count(); count != 0 {
+		t.Fatalf("expected no entries applied by a cancelled recovery; got %d", count)
+	}
+
+	db.opts.recoveryContext = context.Background()
+	if err := db.recoverLog(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries; got %d", n, count)
+	}
+	if len(progress) < 2 {
+		t.Fatalf("expected progress of recovered time blocks; got %v", progress)
+	}
+	last := progress[len(progress)-1]
+	if last.Blocks == 0 || last.Entries != int64(n) {
+		t.Fatalf("expected %d entries applied; got %+v", n, last)
+	}
+	if last.BytesRemaining > progress[0].BytesRemaining {
+		t.Fatalf("expected remaining log size to shrink; got %v", progress)
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	cleanup()
+	oldKey := []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
+	newKey := []byte("kbO0sBNsFjmAPXtrXjcLeT4ZfYZMTwNw")
+	opts := []Options{WithMutable(), WithEncryption(), WithEncryptionKey(oldKey), WithValueThreshold(1024)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit24.vlog")
+	r := rand.New(rand.NewSource(1))
+	var ids, vals [][]byte
+	for i := 0; i < 20; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if i%2 == 0 {
+			val = make([]byte, 4096)
+			r.Read(val)
+		}
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, val).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append([][]byte{id}, ids...)
+		vals = append([][]byte{val}, vals...)
+	}
+	// Reopen DB to sync entries from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(n int) {
+		v, err := db.Get(NewQuery(topic).WithLimit(20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != n {
+			t.Fatalf("expected %d messages; got %d", n, len(v))
+		}
+		for i := range v {
+			if !bytes.Equal(v[i], vals[i]) {
+				t.Fatalf("expected value %d of %d bytes; got %d bytes", i, len(vals[i]), len(v[i]))
+			}
+		}
+		if report, err := db.Verify(); err != nil || !report.OK() {
+			t.Fatalf("expected no issues; got %+v, %v", report, err)
+		}
+	}
+	check(20)
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.FileSizes["vlog"] < 10*4096 || s.FileSizes["data"] >= 10*4096 {
+		t.Fatalf("expected large values in the value log; got %v", s.FileSizes)
+	}
+	if v, err := db.Get(NewQuery(topic).WithID(ids[1])); err != nil || !bytes.Equal(v[0], vals[1]) {
+		t.Fatalf("expected value of the ID; got %v", err)
+	}
+
+	// Values in the value log are re-encrypted in place.
+	if err := db.RotateKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Reencrypt(); err != nil || n != 20 {
+		t.Fatalf("expected 20 messages re-encrypted; got %d, %v", n, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts[2] = WithEncryptionKey(newKey)
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(20)
+
+	// Compaction rewrites the value log once most of its values are deleted.
+	for i := 1; i < 16; i += 2 {
+		if err := db.Delete(ids[i], topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var live [][]byte
+	for i, val := range vals {
+		if i >= 16 || i%2 == 0 {
+			live = append(live, val)
+		}
+	}
+	vals = live
+	check(len(vals))
+	if s, err = db.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if s.FileSizes["vlog"] >= 5*4096 {
+		t.Fatalf("expected value log rewritten; got %d bytes", s.FileSizes["vlog"])
+	}
+
+	br, err := block.Open(fs.OS, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	b, err := br.ReadIndexBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e block.IndexEntry
+	for _, e = range b.Entries[:b.EntryIdx] {
+		if e.ValueLog {
+			break
+		}
+	}
+	m, err := br.ReadMessage(e)
+	if err != nil || !e.ValueLog || len(m.Value) != int(e.ValueSize) {
+		t.Fatalf("expected value read from the value log; got %d bytes, %v", len(m.Value), err)
+	}
+
+	// Repair salvages values from the value log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Repair(dbPath, opts...)
+	if err != nil || report.Salvaged != int64(len(vals)) {
+		t.Fatalf("expected %d entries salvaged; got %+v, %v", len(vals), report, err)
+	}
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(len(vals))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOScheduler(t *testing.T) {
+	s := newIOScheduler(1, 1)
+	waiting := func(kind _IOKind) int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.waiting[kind]
+	}
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	access := func(kind _IOKind, name string) {
+		defer wg.Done()
+		s.acquire(kind)
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+		s.release(kind)
+	}
+
+	// A write is in progress while a read and then another write are waiting.
+	s.acquire(ioWrite)
+	wg.Add(2)
+	go access(ioRead, "read")
+	for waiting(ioRead) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go access(ioWrite, "write")
+	for waiting(ioWrite) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.release(ioWrite)
+	wg.Wait()
+	if !reflect.DeepEqual(order, []string{"read", "write"}) {
+		t.Fatalf("expected read admitted before write; got %v", order)
+	}
+
+	cleanup()
+	db, err := Open(dbPath, WithIOScheduler(4, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit25.scheduler")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(topic).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 10 {
+		t.Fatalf("expected 10 messages; got %d", len(v))
+	}
+}
+
+func TestQuerySnapshot(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit19.snapshot"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	v := db.internal.trie.snapshot()
+	if db.internal.trie.snapshot() != v {
+		t.Fatal("expected view shared while the trie is not changed")
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := db.Get(NewQuery([]byte("unit19.snapshot")).WithLimit(100)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 1; i < 50; i++ {
+		if err := db.Put([]byte("unit19.snapshot"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte(fmt.Sprintf("unit19.snapshot%d", i)), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+	if db.internal.trie.snapshot() == v {
+		t.Fatal("expected a new view after topics are added")
+	}
+	if items, err := db.Get(NewQuery([]byte("unit19.snapshot")).WithLimit(100)); err != nil || len(items) != 50 {
+		t.Fatalf("expected 50 entries; got %d, %v", len(items), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeasing(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<4), WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	topic := []byte("unit1.test")
+	var ids [][]byte
+	for i = 0; i < n; i++ {
+		messageID := db.NewID()
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		db.Delete(id, topic)
+	}
+	for i = 0; i < n; i++ {
+		messageID := db.NewID()
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		db.Delete(id, topic)
+	}
+}
+
+func TestSubtreeQuery(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"unit8", "unit8.a", "unit8.b.c", "unit8.b.c.d", "unit9.a"} {
+		if err := db.Put([]byte(topic), []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		for _, topic := range []string{"unit8...", "unit8.#"} {
+			items, err := db.Get(NewQuery([]byte(topic)).WithLimit(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 4 {
+				t.Fatalf("%s: expected 4 messages, got %d", topic, len(items))
+			}
+		}
+		items, err := db.Get(NewQuery([]byte("unit8.b.#")).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 2 {
+			t.Fatalf("unit8.b.#: expected 2 messages, got %d", len(items))
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestQueryStats(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit10.stats")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := NewQuery(topic).WithLimit(10)
+	if _, err := db.Get(q); err != nil {
+		t.Fatal(err)
+	}
+	if st := q.Stats(); st.CacheHits != 3 || st.Visited != 3 || st.Returned != 3 || st.BlocksRead != 0 {
+		t.Fatalf("unexpected stats of memdb query %+v", st)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(q); err != nil {
+		t.Fatal(err)
+	}
+	st := q.Stats()
+	if st.CacheHits != 0 || st.Visited != 3 || st.Returned != 3 || st.BytesDecompressed != 15 {
+		t.Fatalf("unexpected stats of query %+v", st)
+	}
+	// One window block and an index block per entry.
+	if st.BlocksRead != 4 || st.Duration <= 0 {
+		t.Fatalf("unexpected stats of query %+v", st)
+	}
+}
+
+func TestTopicCount(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit11.a")
+	var ids [][]byte
+	for i := 0; i < 5; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit11.b"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("unit11.b?ttl=1h"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	check := func(topic string, want int64) {
+		t.Helper()
+		if n, err := db.TopicCount([]byte(topic), 0, ""); err != nil || n != want {
+			t.Fatalf("%s: expected count %d, got %d %v", topic, want, n, err)
+		}
+	}
+	check("unit11.a", 5)
+	check("unit11...", 9)
+	reopen := func() {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(dbPath, WithMutable()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen()
+	check("unit11.a", 5)
+	check("unit11.b", 4)
+	if err := db.Delete(ids[0], topic); err != nil {
+		t.Fatal(err)
+	}
+	check("unit11.a", 4)
+
+	reopen()
+	if fs.Exists(db.opts.fileSystem, windowCountsPath(dbPath)) {
+		t.Fatal("window counts file is not removed on open")
+	}
+	db.internal.winCounts.blocks = make(map[int64]_WindowCount)
+	if err := db.rebuildWindowCounts(); err != nil {
+		t.Fatal(err)
+	}
+	check("unit11.a", 4)
+	check("unit11...", 8)
+
+	if err := db.SetPolicy(NewPolicy(topic).WithRetention(Retention{MaxCount: 2})); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	check("unit11.a", 2)
+	reopen()
+	defer db.Close()
+	check("unit11.a", 2)
+	check("unit11.b", 4)
+	if n, err := db.TopicCount(topic, contract, ""); err != nil || n != 1 {
+		t.Fatalf("expected count 1 of topic of the contract, got %d %v", n, err)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit12.b?ttl=1h"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("unit12.a"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit12.c"), []byte("msg")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		t.Helper()
+		topics, err := db.Topics(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []TopicInfo{{Topic: "unit12.a", Contract: message.MasterContract, Count: 1}, {Topic: "unit12.b", Contract: message.MasterContract, Count: 3}}
+		if !reflect.DeepEqual(topics, want) {
+			t.Fatalf("expected topics %v, got %v", want, topics)
+		}
+		if topics, err = db.Topics(contract); err != nil || len(topics) != 1 || topics[0].Topic != "unit12.c" {
+			t.Fatalf("unexpected topics of contract %v %v", topics, err)
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestWildcardTopics(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		wtopic []byte
+		topic  []byte
+		msg    []byte
+	}{
+		{[]byte("..."), []byte("unit.b.b1"), []byte("...1")},
+		{[]byte("unit.b..."), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.b...1")},
+		{[]byte("unit.*.b1.b11.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.b11.*.*.b11111.*.1")},
+		{[]byte("unit.*.b1.*.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.*.*.*.b11111.*.1")},
+		{[]byte("unit.b.b1"), []byte("unit.b.b1"), []byte("unit.b.b1.1")},
+		{[]byte("unit.b.b1.b11"), []byte("unit.b.b1.b11"), []byte("unit.b.b1.b11.1")},
+		{[]byte("unit.b"), []byte("unit.b"), []byte("unit.b.1")},
+	}
+	for _, tt := range tests {
+		db.Put(tt.wtopic, tt.msg)
+		if msg, err := db.Get(NewQuery(tt.wtopic).WithLimit(10)); len(msg) == 0 || err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := db.Get(NewQuery(tt.topic).WithLimit(10)); len(msg) == 0 || err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// _SyncRecorder records directory syncs and renames on an in-memory file system.
+type _SyncRecorder struct {
+	*fs.Mem
+	mu  sync.Mutex
+	ops []string
+}
+
+func (r *_SyncRecorder) record(op string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+func (r *_SyncRecorder) Rename(oldpath, newpath string) error {
+	if err := r.Mem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	r.record("rename " + newpath)
+	return nil
+}
+
+func (r *_SyncRecorder) SyncDir(dir string) error {
+	r.record("syncdir " + dir)
+	return nil
+}
+
+func TestDirSync(t *testing.T) {
+	cleanup()
+	rec := &_SyncRecorder{Mem: fs.NewMem()}
+	db, err := Open(dbPath, WithMutable(), WithFileSystem(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit13.sync"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	synced := make(map[string]bool)
+	for _, op := range rec.ops {
+		synced[op] = true
+	}
+	for _, dir := range []string{dbPath, fileDir(dbPath, typeTimeWindow), fileDir(dbPath, typeIndex), fileDir(dbPath, typeData)} {
+		if !synced["syncdir "+dir] {
+			t.Fatalf("expected directory %s synced, got %v", dir, rec.ops)
+		}
+	}
+
+	// The directory is synced after the file is renamed in place.
+	rec.ops = nil
+	name := dbPath + "/unitdb.sync"
+	if err := fs.WriteFileSync(rec, name, []byte("synced"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"rename " + name, "syncdir " + dbPath}; !reflect.DeepEqual(rec.ops, want) {
+		t.Fatalf("expected %v, got %v", want, rec.ops)
+	}
+	if data, err := fs.ReadFile(rec, name); err != nil || string(data) != "synced" {
+		t.Fatalf("unexpected file contents %q %v", data, err)
+	}
+	if fs.Exists(rec, name+".tmp") {
+		t.Fatal("expected temporary file renamed")
+	}
+
+	// Directories are synced on the OS file system.
+	if err := os.MkdirAll(dbPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SyncDir(fs.OS, dbPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultyFileSystem(t *testing.T) {
+	mem := fs.NewMem()
+	faulty := fs.NewFaulty(mem, fs.FaultOptions{Mode: fs.FaultDrop})
+	f, err := fs.Create(faulty, "faulty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("synced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("SYNCED not synced"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	faulty.CrashAfter(1)
+	if _, err := f.Write([]byte("not synced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != fs.ErrCrashed {
+		t.Fatalf("expected %v; got %v", fs.ErrCrashed, err)
+	}
+	if _, err := fs.Create(faulty, "faulty.new"); err == nil {
+		t.Fatal("expected files not created once crashed")
+	}
+	// Writes not yet synced are dropped by the crash.
+	if data, err := fs.ReadFile(mem, "faulty"); err != nil || string(data) != "synced" {
+		t.Fatalf("expected synced contents after crash; got %q %v", data, err)
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	cleanup()
+	mem := fs.NewMem()
+	topic := []byte("unit43.crash")
+	modes := []fs.FaultMode{fs.FaultDrop, fs.FaultTruncate, fs.FaultReorder}
+	committed := make(map[string]bool)
+	rnd := rand.New(rand.NewSource(1))
+
+	// verify opens the DB and checks no committed entry is lost and the DB files are consistent.
+	verify := func(faulty *fs.Faulty) *DB {
+		db, err := Open(dbPath, WithMutable(), WithMaxSyncDuration(time.Hour, 1), WithSyncPolicy(SyncPolicy{Mode: SyncAlways}), WithFileSystem(faulty))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)).WithLimit(10000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]bool)
+		for _, val := range v {
+			found[string(val)] = true
+		}
+		for val := range committed {
+			if !found[val] {
+				t.Fatalf("committed entry %s lost after crash", val)
+			}
+		}
+		report, err := db.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Fatalf("expected no torn state after crash; got %+v", report.Issues)
+		}
+		return db
+	}
+
+	for r := 0; r < 15; r++ {
+		faulty := fs.NewFaulty(mem, fs.FaultOptions{Mode: modes[r%len(modes)], Seed: int64(r)})
+		db := verify(faulty)
+		faulty.CrashAfter(1 + rnd.Intn(200))
+		for b := 0; !faulty.Crashed(); b++ {
+			var vals []string
+			// Entries are committed once the batch commit fsyncs the log.
+			err := db.Batch(func(batch *Batch, completed <-chan struct{}) error {
+				for i := 0; i < 10; i++ {
+					val := fmt.Sprintf("msg.%d.%d.%d", r, b, i)
+					if err := batch.Put(topic, []byte(val)); err != nil {
+						return err
+					}
+					vals = append(vals, val)
+				}
+				return nil
+			})
+			if err != nil {
+				break
+			}
+			for _, val := range vals {
+				committed[val] = true
+			}
+			if b%3 == 2 {
+				db.Sync()
+			}
+		}
+		db.Close()
+		// The lock file is left behind by the crashed process.
+		mem.Remove(dbPath + "/" + prefix + ".lock")
+	}
+	db := verify(fs.NewFaulty(mem, fs.FaultOptions{}))
+	if len(committed) == 0 {
+		t.Fatal("expected entries committed before crashes")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverTornBlocks(t *testing.T) {
+	mem := fs.NewMem()
+	topic := []byte("unit43.torn")
+	var vals [][]byte
+	put := func(db *DB, n int) {
+		for i := 0; i < n; i++ {
+			val := []byte(fmt.Sprintf("msg.%2d", len(vals)))
+			if err := db.Put(topic, val); err != nil {
+				t.Fatal(err)
+			}
+			vals = append([][]byte{val}, vals...)
+		}
+	}
+	db, err := Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(db, 5)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen DB to recover entries from the log into the index and window blocks.
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile, _ := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	winFile, _ := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	indexOff := indexFile.blockOffset(indexFile.blockIndex(1))
+	bs := indexFile.blockSize()
+	var winOff int64
+	for off := int64(0); off < winFile.currSize(); off += bs {
+		r := _WindowReader{winFile: winFile, offset: off}
+		if b, err := r.readWindowBlock(); err == nil && b.entryIdx > 0 {
+			winOff = off
+		}
+	}
+	// Entries put after the sync are in the log as the DB is closed.
+	put(db, 5)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the index and window blocks as if the DB crashed while these were rewritten to append
+	// entries of the log, the blocks keep the first bytes of the rewrite only.
+	tear := func(name string, off int64, rewrite func(old []byte) []byte, n int) {
+		f, err := mem.OpenFile(name, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		old := make([]byte, bs)
+		if _, err := f.ReadAt(old, off); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(rewrite(old)[:n], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tear(filePath(dbPath, _FileDesc{fileType: typeIndex}), indexOff, func(old []byte) []byte {
+		var b _IndexBlock
+		if err := b.unmarshalBinary(old); err != nil {
+			t.Fatal(err)
+		}
+		for seq := uint64(6); seq <= 8; seq++ {
+			b.entries[b.entryIdx] = _IndexEntry{seq: seq, valueSize: 6, msgOffset: 1 << 20}
+			b.entryIdx++
+		}
+		return b.marshalBinary()
+	}, 8+6*16+4)
+	tear(filePath(dbPath, _FileDesc{fileType: typeTimeWindow}), winOff, func(old []byte) []byte {
+		var b _WinBlock
+		if err := b.unmarshalBinary(old); err != nil {
+			t.Fatal(err)
+		}
+		for seq := uint64(6); seq <= 8; seq++ {
+			b.entries[b.entryIdx] = _WinEntry{sequence: seq}
+			b.entryIdx++
+		}
+		return b.marshalBinary()
+	}, 6*12+4)
+	// Window counts are not written by a crashed DB.
+	if err := mem.Remove(windowCountsPath(dbPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithFileSystem(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get(NewQuery(topic).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %d messages after torn blocks are repaired; got %d", len(vals), len(v))
+	}
+	if report, err := db.Verify(); err != nil || !report.OK() {
+		t.Fatalf("expected no torn state after repair; got %+v, %v", report, err)
+	}
+}
+
+func TestTopicStats(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit14.stats")
+	start := time.Now().Add(-time.Second)
+	for i := 0; i < 5; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("unit14.other"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	check := func(entries int64, blocks int) {
+		t.Helper()
+		stats, err := db.TopicStats(topic, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Entries != entries || stats.WindowBlocks != blocks {
+			t.Fatalf("expected %d entries in %d window blocks, got %+v", entries, blocks, stats)
+		}
+		if stats.Bytes < entries*int64(len("msg. 0")) {
+			t.Fatalf("unexpected bytes %d", stats.Bytes)
+		}
+		if stats.Oldest.Before(start) || stats.Newest.Before(stats.Oldest) || stats.Newest.After(time.Now().Add(time.Second)) {
+			t.Fatalf("unexpected timestamps %v %v", stats.Oldest, stats.Newest)
+		}
+	}
+	check(5, 0)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(5, 1)
+	id, err := db.Get(NewQuery(topic).WithLimit(1))
+	if err != nil || len(id) != 1 {
+		t.Fatal(err)
+	}
+	if stats, err := db.TopicStats([]byte("unit14.missing"), 0, ""); err != nil || stats.Entries != 0 || !stats.Oldest.IsZero() {
+		t.Fatalf("unexpected stats of unknown topic %+v %v", stats, err)
+	}
+	if stats, err := db.TopicStats(topic, contract, ""); err != nil || stats.Entries != 1 || stats.WindowBlocks != 1 {
+		t.Fatalf("unexpected stats of topic of the contract %+v %v", stats, err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota(contract, Quota{MaxTopics: 2, MaxMessagesPerDay: 5}); err != nil {
+		t.Fatal(err)
+	}
+	put := func(topic string, val []byte) error {
+		return db.PutEntry(NewEntry([]byte(topic), val).WithContract(contract))
+	}
+	for _, topic := range []string{"unit15.a", "unit15.b", "unit15.a"} {
+		if err := put(topic, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := put("unit15.c", []byte("msg")); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v on new topic, got %v", ErrQuotaExceeded, err)
+	}
+	// Writes to other contracts are not limited.
+	if err := db.Put([]byte("unit15.c"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := put("unit15.b", []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := put("unit15.b", []byte("msg")); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v on daily messages, got %v", ErrQuotaExceeded, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Quotas and messages written today survive reopening the DB.
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stats, err := db.ContractStats(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Topics != 2 || stats.MessagesToday != 5 || stats.Bytes == 0 || stats.Quota == nil || stats.Quota.MaxTopics != 2 {
+		t.Fatalf("unexpected contract stats %+v", stats)
+	}
+	if err := put("unit15.b", []byte("msg")); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v after reopen, got %v", ErrQuotaExceeded, err)
+	}
+
+	// A write to a new topic rejected by quota leaves the topics of the contract unchanged.
+	other, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota(other, Quota{MaxTopics: 2, MaxMessagesPerDay: 1}); err != nil {
+		t.Fatal(err)
+	}
+	putOther := func(topic string) error {
+		return db.PutEntry(NewEntry([]byte(topic), []byte("msg")).WithContract(other))
+	}
+	if err := putOther("unit15.a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := putOther("unit15.b"); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v on daily messages, got %v", ErrQuotaExceeded, err)
+	}
+	if stats, err := db.ContractStats(other); err != nil || stats.Topics != 1 {
+		t.Fatalf("expected 1 topic after rejected write, got %+v", stats)
+	}
+	if err := db.SetQuota(other, Quota{MaxTopics: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putOther("unit15.b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A quota on bytes in observe mode counts writes exceeding it.
+	if err := db.SetQuota(contract, Quota{MaxBytes: stats.Bytes + 1, Mode: LimitObserve}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := put("unit15.a", []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats, err = db.ContractStats(contract); err != nil || stats.Exceeded != 3 {
+		t.Fatalf("unexpected contract stats %+v %v", stats, err)
+	}
+	if err := db.SetQuota(contract, Quota{MaxBytes: stats.Bytes}); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("unit15.a", []byte("0123456789")); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v on bytes, got %v", ErrQuotaExceeded, err)
+	}
+	if err := db.DeleteQuota(contract); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("unit15.d", []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("unit16.a.b"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte("unit16.c"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemdbEntries != 20 || stats.MemdbBytes == 0 || stats.Topics != 2 || stats.TrieNodes != 5 {
+		t.Fatalf("unexpected stats before sync %+v", stats)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if stats, err = db.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 20 || stats.FileSizes["data"] == 0 || stats.FileSizes["index"] == 0 || stats.FileSizes["window"] == 0 || stats.FilterBytes == 0 {
+		t.Fatalf("unexpected stats after sync %+v", stats)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := db.Subscribe([]byte("unit17.a..."), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := db.Subscribe([]byte("unit17.b"), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit17.a.x?ttl=1h"), []byte("msg.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit17.b"), []byte("msg.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit17.c"), []byte("msg.3")); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	if err := b.Put([]byte("unit17.a.y"), []byte("msg.4")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(all.C()); n != 1 {
+		t.Fatalf("expected 1 message before batch commit, got %d", n)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	receive := func(s *Subscription, topic, payload string) Message {
+		t.Helper()
+		select {
+		case m := <-s.C():
+			if string(m.Topic) != topic || string(m.Payload) != payload {
+				t.Fatalf("expected %s %s, got %s %s", topic, payload, m.Topic, m.Payload)
+			}
+			return m
+		default:
+			t.Fatalf("expected message %s", payload)
+		}
+		return Message{}
+	}
+	m := receive(all, "unit17.a.x", "msg.1")
+	if m.ExpiresAt == 0 || m.Contract != message.MasterContract {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	receive(all, "unit17.a.y", "msg.4")
+	m = receive(static, "unit17.b", "msg.2")
+	if len(static.C()) != 0 || len(all.C()) != 0 {
+		t.Fatal("expected no more messages")
+	}
+
+	// ID of the message deletes the message.
+	if err := db.Delete(m.ID, m.Topic); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.Get(NewQuery([]byte("unit17.b")).WithLimit(10)); len(v) != 0 {
+		t.Fatalf("expected message deleted, got %v", v)
+	}
+
+	if err := static.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-static.C(); ok {
+		t.Fatal("expected subscription closed")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-all.C(); ok {
+		t.Fatal("expected subscription closed with the DB")
+	}
+}
+
+func TestChanges(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, topic := range []string{"unit18.a", "unit18.b", "unit18.a"} {
+		if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg.%d", i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Entries in the memdb follow synced entries.
+	for i, topic := range []string{"unit18.b", "unit18.c"} {
+		if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg.%d", i+4))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func(c *ChangeCursor, limit int, expected ...string) []Change {
+		t.Helper()
+		changes, err := c.Next(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != len(expected) {
+			t.Fatalf("expected %d changes, got %d", len(expected), len(changes))
+		}
+		for i, ch := range changes {
+			if got := string(ch.Topic) + " " + string(ch.Payload); got != expected[i] {
+				t.Fatalf("expected %s, got %s", expected[i], got)
+			}
+			if message.ID(ch.ID).Sequence() != ch.Seq {
+				t.Fatalf("expected seq %d in ID, got %d", ch.Seq, message.ID(ch.ID).Sequence())
+			}
+		}
+		return changes
+	}
+	c, err := db.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := next(c, 2, "unit18.a msg.1", "unit18.b msg.2")
+	if c.Seq() != changes[1].Seq {
+		t.Fatalf("expected cursor at seq %d, got %d", changes[1].Seq, c.Seq())
+	}
+
+	// Resume the cursor, deleted entries are skipped.
+	if err := db.Delete(changes[0].ID, changes[0].Topic); err != nil {
+		t.Fatal(err)
+	}
+	c, err = db.Changes(c.Seq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(c, 10, "unit18.a msg.3", "unit18.b msg.4", "unit18.c msg.5")
+	next(c, 10)
+
+	// Cursor waits for an entry with a leased seq.
+	id := db.NewID()
+	if err := db.Put([]byte("unit18.c"), []byte("msg.7")); err != nil {
+		t.Fatal(err)
+	}
+	next(c, 10)
+	if err := db.PutEntry(NewEntry([]byte("unit18.c"), []byte("msg.6")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	next(c, 10, "unit18.c msg.6", "unit18.c msg.7")
+
+	// A leased seq never written is skipped once the settle time passes.
+	db.NewID()
+	if err := db.Put([]byte("unit18.c"), []byte("msg.8")); err != nil {
+		t.Fatal(err)
+	}
+	next(c, 10)
+	next(c.WithSettle(0), 10, "unit18.c msg.8")
+}
+
+func TestGrafanaHandler(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, v := range []string{"1", "2", "6", "n/a"} {
+		if err := db.Put([]byte("unit19.temp"), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := db.GrafanaHandler(0)
+	serve := func(path, body string, resp interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("%s: expected status 200, got %d %s", path, w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var topics []string
+	serve("/search", `{"target":"unit19"}`, &topics)
+	if len(topics) != 1 || topics[0] != "unit19.temp" {
+		t.Fatalf("unexpected topics %v", topics)
+	}
+
+	from := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	to := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	req := fmt.Sprintf(`{"range":{"from":"%s","to":"%s"},"intervalMs":86400000,"targets":[{"target":"unit19.temp"},{"target":"avg:unit19.temp"},{"target":"count:unit19.temp"},{"target":"max:unit19..."}]}`, from, to)
+	var series []struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	serve("/query", req, &series)
+	if len(series) != 4 {
+		t.Fatalf("expected 4 series, got %d", len(series))
+	}
+	if n := len(series[0].Datapoints); n != 3 {
+		t.Fatalf("expected 3 values, got %d", n)
+	}
+	for i, expected := range []float64{3, 4, 6} {
+		dp := series[i+1].Datapoints
+		if len(dp) != 1 || dp[0][0] != expected {
+			t.Fatalf("%s: expected %v, got %v", series[i+1].Target, expected, dp)
+		}
+	}
+
+	// Messages written after the time range are not returned.
+	to = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	req = fmt.Sprintf(`{"range":{"from":"%s","to":"%s"},"targets":[{"target":"count:unit19.temp"}]}`, from, to)
+	serve("/query", req, &series)
+	if len(series) != 1 || len(series[0].Datapoints) != 0 {
+		t.Fatalf("expected no datapoints, got %v", series)
+	}
+}
+
+// _LogReplicator applies records to nodes in order of the log as a Raft state machine would.
+type _LogReplicator struct {
+	nodes []*DB
+	log   [][]byte
+	// err is returned by Propose without committing the record, e.g. once the node lost leadership.
+	err error
+}
+
+func (r *_LogReplicator) Propose(record []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.log = append(r.log, record)
+	var err error
+	for i, node := range r.nodes {
+		if nodeErr := node.ApplyBatch(record); i == 0 {
+			err = nodeErr
+		}
+	}
+	return err
+}
+
+func TestReplicatedBatch(t *testing.T) {
+	cleanup()
+	r := &_LogReplicator{}
+	leader, err := Open(dbPath+"/node1", WithMutable(), WithReplicator(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	r.nodes = append(r.nodes, leader)
+	for _, name := range []string{"node2", "node3"} {
+		node, err := Open(dbPath+"/"+name, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		r.nodes = append(r.nodes, node)
+	}
+	sub, err := r.nodes[2].Subscribe([]byte("unit20..."), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := leader.Put([]byte("unit20.a"), []byte("msg.1")); err != nil {
+		t.Fatal(err)
+	}
+	err = leader.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for i := 2; i <= 4; i++ {
+			if err := b.Put([]byte("unit20.b"), []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.log) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(r.log))
+	}
+	m := <-sub.C()
+	if string(m.Topic) != "unit20.a" || string(m.Payload) != "msg.1" {
+		t.Fatalf("unexpected message %s %s", m.Topic, m.Payload)
+	}
+	if err := leader.Delete(m.ID, m.Topic); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records applied again do not change the nodes.
+	for _, record := range r.log {
+		if err := r.nodes[1].ApplyBatch(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, node := range r.nodes {
+		if v, err := node.Get(NewQuery([]byte("unit20.b")).WithLimit(10)); err != nil || len(v) != 3 {
+			t.Fatalf("node%d: expected 3 messages, got %d %v", i+1, len(v), err)
+		}
+		if v, _ := node.Get(NewQuery([]byte("unit20.a")).WithLimit(10)); len(v) != 0 {
+			t.Fatalf("node%d: expected message deleted, got %d", i+1, len(v))
+		}
+		topics, err := node.Topics(0)
+		if err != nil || len(topics) != 2 {
+			t.Fatalf("node%d: expected 2 topics, got %v %v", i+1, topics, err)
+		}
+		if node.seq() != leader.seq() {
+			t.Fatalf("node%d: expected seq %d, got %d", i+1, leader.seq(), node.seq())
+		}
+	}
+
+	if err := r.nodes[1].ApplyBatch([]byte{0}); err != errRecordInvalid {
+		t.Fatalf("expected invalid record, got %v", err)
+	}
+
+	// Topics are added once a record is applied, a record not committed or not valid leaves topics unchanged.
+	r.err = errors.New("not the leader")
+	if err := leader.Put([]byte("unit20.c"), []byte("msg.5")); err != r.err {
+		t.Fatalf("expected %v, got %v", r.err, err)
+	}
+	r.err = nil
+	if n := leader.internal.topicNames.count(message.MasterContract); n != 2 {
+		t.Fatalf("expected 2 topic names, got %d", n)
+	}
+	node, err := Open(dbPath+"/node4", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	record := r.log[0]
+	if err := node.ApplyBatch(record[:len(record)-1]); err != errRecordInvalid {
+		t.Fatalf("expected invalid record, got %v", err)
+	}
+	if n := node.internal.topicNames.count(message.MasterContract); n != 0 {
+		t.Fatalf("expected no topic names, got %d", n)
+	}
+}
+
+func TestLogShipping(t *testing.T) {
+	cleanup()
+	archive := LogArchive{Path: dbPath + "/archive", Compress: true}
+	// putPrimary writes messages to the primary and closes it, so logs are applied and archived.
+	putPrimary := func(from, to int) {
+		t.Helper()
+		primary, err := Open(dbPath+"/primary", WithLogArchive(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := from; i <= to; i++ {
+			if err := primary.Put([]byte("unit21.a"), []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := primary.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ship := func(upperSeq uint64) (*bytes.Buffer, int) {
+		t.Helper()
+		primary, err := Open(dbPath+"/primary", WithLogArchive(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer primary.Close()
+		var buf bytes.Buffer
+		n, err := primary.ShipLogs(&buf, upperSeq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &buf, n
+	}
+	putPrimary(1, 3)
+
+	replica, err := Open(dbPath + "/replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	buf, logs := ship(replica.UpperSeq())
+	if logs == 0 {
+		t.Fatal("expected logs shipped")
+	}
+	first := buf.Bytes()
+	if n, err := replica.ApplyLogs(bytes.NewReader(first)); err != nil || n != 3 {
+		t.Fatalf("expected 3 entries applied, got %d %v", n, err)
+	}
+	if _, logs := ship(replica.UpperSeq()); logs != 0 {
+		t.Fatalf("expected replica caught up, got %d logs", logs)
+	}
+
+	// Replica catches up on logs written once it applied logs.
+	putPrimary(4, 5)
+	buf, _ = ship(replica.UpperSeq())
+	if n, err := replica.ApplyLogs(buf); err != nil || n != 2 {
+		t.Fatalf("expected 2 entries applied, got %d %v", n, err)
+	}
+	if n, err := replica.ApplyLogs(bytes.NewReader(first)); err != nil || n != 0 {
+		t.Fatalf("expected applied entries skipped, got %d %v", n, err)
+	}
+	if v, err := replica.Get(NewQuery([]byte("unit21.a")).WithLimit(10)); err != nil || len(v) != 5 {
+		t.Fatalf("expected 5 messages, got %d %v", len(v), err)
+	}
+
+	if _, err := replica.ShipLogs(&bytes.Buffer{}, 0); err != errNoLogArchive {
+		t.Fatalf("expected no log archive, got %v", err)
+	}
+}
+
+func TestWindowAppendReplay(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit18.replay")
+	for i := 0; i < 5; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tp := db.internal.trie.all()[0]
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := _WindowReader{winFile: winFile, offset: tp.offset}
+	b, err := r.readWindowBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := append(_WindowEntries(nil), b.entries[:b.entryIdx]...)
+
+	// Replaying entries of the topic does not append these again.
+	buf := db.internal.bufPool.Get()
+	defer db.internal.bufPool.Put(buf)
+	w, err := newWindowWriter(db.fs, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, err := w.append(tp.hash, tp.offset, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != tp.offset || len(w.appended) != 0 {
+		t.Fatalf("expected no entries appended, got %d at %d", len(w.appended), off)
+	}
+	next := newWinEntry(entries[len(entries)-1].seq()+1, 0)
+	if _, err := w.append(tp.hash, tp.offset, append(entries[2:], next)); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.appended) != 1 || w.appended[0].we.seq() != next.seq() {
+		t.Fatalf("expected only the new entry appended, got %v", w.appended)
+	}
+}
+
+// TestSoak runs a mixed workload of puts, batches, deletes, reads, syncs and compactions, checking
+// at each checkpoint that every committed message is readable, deleted messages are not, counts match
+// and Verify finds no orphan or inconsistent blocks. Goroutine counts are checked to catch slow leaks.
+// By default it runs a few checkpoints; run it before a release with -soak, e.g.
+//
+//	go test -run TestSoak -soak=4h -timeout=5h
+func TestSoak(t *testing.T) {
+	cleanup()
+	duration, interval := 2*time.Second, 250*time.Millisecond
+	if *soakDuration > 0 {
+		duration, interval = *soakDuration, 30*time.Second
+	}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<20), WithFreeBlockSize(1<<16), WithMutable(), WithMaxQueryLimit(math.MaxInt32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const (
+		workers  = 4
+		maxLive  = 500 // maxLive bounds messages per topic so memory in use should stay flat.
+		batchLen = 3
+	)
+	// Each worker owns a topic and its model of live messages, payload to ID,
+	// workers hold pause for an operation so checkpoints see a quiescent DB.
+	var pause sync.RWMutex
+	live := make([]map[string][]byte, workers)
+	topics := make([][]byte, workers)
+	for w := range live {
+		live[w] = make(map[string][]byte)
+		topics[w] = []byte(fmt.Sprintf("soak.%d", w))
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			topic, model := topics[w], live[w]
+			var n int
+			put := func(b *Batch) error {
+				n++
+				payload := fmt.Sprintf("w%d.%d", w, n)
+				id := db.NewID()
+				e := NewEntry(topic, []byte(payload)).WithID(id)
+				var err error
+				if b != nil {
+					err = b.PutEntry(e)
+				} else {
+					err = db.PutEntry(e)
+				}
+				model[payload] = id
+				return err
+			}
+			op := func() error {
+				pause.RLock()
+				defer pause.RUnlock()
+				switch r := rnd.Intn(100); {
+				case r < 20 || len(model) >= maxLive:
+					for payload, id := range model {
+						delete(model, payload)
+						return db.Delete(id, topic)
+					}
+					return nil
+				case r < 60:
+					return put(nil)
+				case r < 75:
+					return db.Batch(func(b *Batch, completed <-chan struct{}) error {
+						for i := 0; i < batchLen; i++ {
+							if err := put(b); err != nil {
+								return err
+							}
+						}
+						return nil
+					})
+				default:
+					// Get returns EOF once the topic has no messages.
+					if _, err := db.Get(NewQuery(topic).WithLimit(10)); err != nil && (err != io.EOF || len(model) != 0) {
+						return err
+					}
+					return nil
+				}
+			}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := op(); err != nil {
+					errs <- fmt.Errorf("worker %d: %v", w, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	check := func() error {
+		pause.Lock()
+		defer pause.Unlock()
+		for w, topic := range topics {
+			n, err := db.TopicCount(topic, 0, "")
+			if err != nil {
+				return err
+			}
+			if n != int64(len(live[w])) {
+				return fmt.Errorf("%s: expected count %d, got %d", topic, len(live[w]), n)
+			}
+			// Deleted entries count towards the query limit until these are removed from the time window.
+			items, err := db.Get(NewQuery(topic).WithLimit(math.MaxInt32))
+			if err != nil && len(live[w]) != 0 {
+				return fmt.Errorf("get %s: %v", topic, err)
+			}
+			if len(items) != len(live[w]) {
+				return fmt.Errorf("%s: expected %d messages, got %d", topic, len(live[w]), len(items))
+			}
+			for _, item := range items {
+				if _, ok := live[w][string(item)]; !ok {
+					return fmt.Errorf("%s: unexpected message %s", topic, item)
+				}
+			}
+		}
+		if err := db.Sync(); err != nil {
+			return err
+		}
+		if err := db.Compact(); err != nil {
+			return err
+		}
+		report, err := db.Verify()
+		if err != nil {
+			return err
+		}
+		if !report.OK() {
+			return fmt.Errorf("verify: %+v", report.Issues)
+		}
+		return nil
+	}
+
+	var m runtime.MemStats
+	baseline := -1
+	deadline := time.Now().Add(duration)
+	for round := 0; time.Now().Before(deadline); round++ {
+		select {
+		case err := <-errs:
+			close(stop)
+			wg.Wait()
+			t.Fatal(err)
+		case <-time.After(interval):
+		}
+		if err := check(); err != nil {
+			close(stop)
+			wg.Wait()
+			t.Fatalf("checkpoint %d: %v", round, err)
+		}
+		runtime.ReadMemStats(&m)
+		goroutines := runtime.NumGoroutine()
+		t.Logf("checkpoint %d: goroutines %d heap %d", round, goroutines, m.HeapAlloc)
+		switch {
+		case baseline < 0:
+			baseline = goroutines
+		case goroutines > baseline+workers:
+			close(stop)
+			wg.Wait()
+			t.Fatalf("checkpoint %d: goroutines grew from %d to %d", round, baseline, goroutines)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReopenWindowBlocks(t *testing.T) {
+	mem := fs.NewMem()
+	topic := []byte("unit23.reopen")
+	put := func(from, to int) {
+		t.Helper()
+		db, err := Open(dbPath, WithFileSystem(mem), WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := from; i < to; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entries span more than one window block before reopening, so blocks
+	// synced after reopening are chained to the most recent block of the topic.
+	put(0, 500)
+	put(500, 600)
+	db, err := Open(dbPath, WithFileSystem(mem), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(topic).WithLimit(601))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 600 {
+		t.Fatalf("expected 600 messages, got %d", len(items))
+	}
+	for i, item := range items {
+		if expected := fmt.Sprintf("msg.%d", 599-i); string(item) != expected {
+			t.Fatalf("expected %s, got %s", expected, item)
+		}
+	}
+}
+
+func TestTieredStorage(t *testing.T) {
+	store := fs.NewMemStore()
+	tiered := fs.NewTiered(fs.NewMem(), store, fs.TieredOptions{Suffixes: []string{".data", ".win"}, SegmentSize: 4096})
+	open := func() *DB {
+		t.Helper()
+		db, err := Open(dbPath, WithFileSystem(tiered), WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	topic := []byte("unit22.tiered")
+	payload := func(i int) []byte {
+		return []byte(fmt.Sprintf("msg.%04d.%s", i, strings.Repeat("x", 64)))
+	}
+	verifyMsgs := func(db *DB, n int) {
+		t.Helper()
+		items, err := db.Get(NewQuery(topic).WithLimit(n + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != n {
+			t.Fatalf("expected %d messages, got %d", n, len(items))
+		}
+		for i, item := range items {
+			if expected := payload(n - 1 - i); !bytes.Equal(item, expected) {
+				t.Fatalf("expected %s, got %s", expected, item)
+			}
+		}
+	}
+
+	db := open()
+	for i := 0; i < 500; i++ {
+		if err := db.Put(topic, payload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entries are synced to the data and window files once the DB is closed.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	if err := db.Offload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Keys()) == 0 {
+		t.Fatal("expected segments offloaded")
+	}
+	if r, ok := db.LastRun(RunOffload); !ok || r.BytesReclaimed == 0 {
+		t.Fatalf("expected offload run, got %+v", r)
+	}
+	verifyMsgs(db, 500)
+
+	// Offloaded segments are fetched back when written.
+	for i := 500; i < 600; i++ {
+		if err := db.Put(topic, payload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	defer db.Close()
+	verifyMsgs(db, 600)
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("expected no issues, got %+v", report.Issues)
+	}
+
+	local, err := Open(dbPath, WithFileSystem(fs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if err := local.Offload(); err != errNoTieredStorage {
+		t.Fatalf("expected tiered storage not set, got %v", err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit23.a"), []byte(fmt.Sprintf("msg.a.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry([]byte("unit23.b"), []byte("msg.b.0")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit23.b"), []byte("msg.b.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(id, []byte("unit23.b")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"unit23.a/msg.a.0", "unit23.a/msg.a.1", "unit23.a/msg.a.2", "unit23.b/msg.b.1"}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf, NewQuery([]byte("unit23...")), ExportNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r ExportRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.ID) != len(id) || r.Timestamp.IsZero() {
+			t.Fatalf("unexpected record %+v", r)
+		}
+		got = append(got, r.Topic+"/"+string(r.Payload))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	buf.Reset()
+	if err := db.Export(&buf, NewQuery([]byte("unit23...")), ExportJSON); err != nil {
+		t.Fatal(err)
+	}
+	var records []ExportRecord
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(records))
+	}
+
+	buf.Reset()
+	if err := db.Export(&buf, NewQuery([]byte("unit23.a")).WithLimit(2), ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || !reflect.DeepEqual(rows[0], []string{"topic", "id", "timestamp", "payload"}) {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	// The limit exports the newest entries of the query, oldest first.
+	if rows[1][0] != "unit23.a" || rows[1][3] != "bXNnLmEuMQ==" || rows[2][3] != "bXNnLmEuMg==" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	buf.Reset()
+	if err := db.Export(&buf, NewQuery([]byte("unit23.c")), ExportJSON); err != nil || buf.String() != "[]\n" {
+		t.Fatalf("expected empty array, got %q %v", buf.String(), err)
+	}
+	if err := db.Export(&buf, NewQuery([]byte("unit23.a")), ExportFormat(9)); err != ErrBadRequest {
+		t.Fatalf("expected bad request, got %v", err)
+	}
+}
+
+// writerFunc is an io.Writer calling the function on each write.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestExportChunks(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithDefaultQueryLimit(10), WithMaxQueryLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit23.chunks")
+	n := 2*exportChunk + 5
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%4d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The DB is not locked while records are written, so a sync of entries to the DB files does not wait for the export.
+	var buf bytes.Buffer
+	synced := false
+	w := writerFunc(func(p []byte) (int, error) {
+		if !synced {
+			synced = true
+			done := make(chan error, 1)
+			go func() {
+				done <- db.Sync()
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					return 0, err
+				}
+			case <-time.After(5 * time.Second):
+				return 0, errors.New("export holds the DB locked while records are written")
+			}
+		}
+		return buf.Write(p)
+	})
+	if err := db.Export(w, NewQuery(topic), ExportNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	// A query without a limit exports all entries, more than the max query limit.
+	dec := json.NewDecoder(&buf)
+	var i int
+	for ; dec.More(); i++ {
+		var r ExportRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("msg.%4d", i); string(r.Payload) != want {
+			t.Fatalf("expected %s, got %s", want, r.Payload)
+		}
+	}
+	if i != n {
+		t.Fatalf("expected %d records, got %d", n, i)
+	}
+
+	buf.Reset()
+	if err := db.Export(&buf, NewQuery(topic).WithLimit(exportChunk+1), ExportNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	var first ExportRecord
+	if err := json.NewDecoder(&buf).Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("msg.%4d", n-exportChunk-1); string(first.Payload) != want {
+		t.Fatalf("expected newest entries of the limit oldest first from %s, got %s", want, first.Payload)
+	}
+}
+
+func TestImport(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit24.import")
+	const n = 1000
+	// Entries are imported out of time order, these are sorted by time of their IDs.
+	base := time.Now().Add(-24 * time.Hour).Unix()
+	order := rand.New(rand.NewSource(1)).Perm(n)
+	var i int
+	count, err := db.Import(func() (*Entry, error) {
+		if i == n {
+			return nil, io.EOF
+		}
+		k := order[i]
+		i++
+		id := message.NewID(0)
+		binary.LittleEndian.PutUint32(id[0:4], uid.Apoch(base+int64(k)))
+		return NewEntry(topic, []byte(fmt.Sprintf("msg.%04d", k))).WithID(id), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d entries imported, got %d", n, count)
+	}
+	if err := db.Put(topic, []byte("msg.live")); err != nil {
+		t.Fatal(err)
+	}
+	verify := func(db *DB) {
+		t.Helper()
+		items, err := db.Get(NewQuery(topic).WithLimit(n + 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != n+1 || string(items[0]) != "msg.live" {
+			t.Fatalf("expected %d messages, got %d", n+1, len(items))
+		}
+		for k, item := range items[1:] {
+			if expected := fmt.Sprintf("msg.%04d", n-1-k); string(item) != expected {
+				t.Fatalf("expected %s, got %s", expected, item)
+			}
+		}
+		if c, err := db.TopicCount(topic, 0, ""); err != nil || c != n+1 {
+			t.Fatalf("expected count %d, got %d %v", n+1, c, err)
+		}
+		report, err := db.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Fatalf("expected no issues, got %+v", report.Issues)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	verify(db)
+
+	// Entries exported from the DB are imported to a new topic.
+	var buf bytes.Buffer
+	if err := db.Export(&buf, NewQuery(topic).WithLimit(10), ExportNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(&buf)
+	count, err = db.Import(func() (*Entry, error) {
+		if !dec.More() {
+			return nil, io.EOF
+		}
+		var r ExportRecord
+		if err := dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		return NewEntry([]byte("unit24.copy"), r.Payload).WithID(r.ID), nil
+	})
+	if err != nil || count != 10 {
+		t.Fatalf("expected 10 entries imported, got %d %v", count, err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit24.copy")).WithLimit(20)); err != nil || len(items) != 10 {
+		t.Fatalf("expected 10 messages, got %d %v", len(items), err)
+	}
+	if _, err := db.Import(func() (*Entry, error) { return NewEntry(topic, nil), nil }); err != errValueEmpty {
+		t.Fatalf("expected empty value, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+}
+
+func TestImportCheckpoint(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit24.checkpoint")
+	const n = 10
+	errSource := errors.New("source failed")
+	// source returns the entries of the source, it fails once failAt entries are read.
+	source := func(failAt int) func() (*Entry, error) {
+		var i int
+		return func() (*Entry, error) {
+			switch {
+			case i == failAt:
+				return nil, errSource
+			case i == n:
+				return nil, io.EOF
+			}
+			i++
+			return NewEntry(topic, []byte(fmt.Sprintf("msg.%02d", i-1))), nil
+		}
+	}
+	var checkpoints []int64
+	opts := ImportOptions{BatchSize: 4, Checkpoint: func(offset int64) error {
+		checkpoints = append(checkpoints, offset)
+		return nil
+	}}
+	count, err := db.ImportWithOptions(source(6), opts)
+	if err != errSource || count != 4 {
+		t.Fatalf("expected 4 entries imported and %v, got %d %v", errSource, count, err)
+	}
+	// The import is resumed from the last checkpoint at a limited rate.
+	opts.Skip, opts.Rate = checkpoints[len(checkpoints)-1], 40
+	start := time.Now()
+	if count, err = db.ImportWithOptions(source(-1), opts); err != nil || count != n-4 {
+		t.Fatalf("expected %d entries imported, got %d %v", n-4, count, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected import throttled, took %v", elapsed)
+	}
+	if expected := []int64{4, 8, 10}; !reflect.DeepEqual(checkpoints, expected) {
+		t.Fatalf("expected checkpoints %v, got %v", expected, checkpoints)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(n + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d messages, got %d", n, len(items))
+	}
+	for k, item := range items {
+		if expected := fmt.Sprintf("msg.%02d", n-1-k); string(item) != expected {
+			t.Fatalf("expected %s, got %s", expected, item)
+		}
+	}
+	if _, err := db.ImportWithOptions(source(-1), ImportOptions{Rate: -1}); err != ErrBadRequest {
+		t.Fatalf("expected %v, got %v", ErrBadRequest, err)
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit25.cursor")
+	for i := 0; i < 25; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+		// Messages are paged across synced and memdb entries.
+		if i == 14 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	page := func(db *DB, topic, cursor []byte) ([]string, []byte) {
+		t.Helper()
+		q := NewQuery(topic).WithLimit(10).WithCursor(cursor)
+		items, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []string
+		for _, item := range items {
+			msgs = append(msgs, string(item))
+		}
+		return msgs, q.Cursor()
+	}
+	msgs, cursor := page(db, topic, nil)
+	if len(msgs) != 10 || msgs[0] != "msg.24" || msgs[9] != "msg.15" || cursor == nil {
+		t.Fatalf("unexpected first page %v", msgs)
+	}
+	// Messages written after the first page are not returned by later pages.
+	if err := db.Put(topic, []byte("msg.new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cursor continues the query once the DB is reopened.
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	msgs, cursor = page(db, topic, cursor)
+	if len(msgs) != 10 || msgs[0] != "msg.14" || msgs[9] != "msg.05" || cursor == nil {
+		t.Fatalf("unexpected second page %v", msgs)
+	}
+	msgs, cursor = page(db, topic, cursor)
+	if len(msgs) != 5 || msgs[0] != "msg.04" || msgs[4] != "msg.00" || cursor != nil {
+		t.Fatalf("unexpected last page %v %v", msgs, cursor)
+	}
+
+	if err := db.Put([]byte("unit25.other"), []byte("msg.other")); err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for cursor := []byte(nil); ; {
+		var msgs []string
+		msgs, cursor = page(db, []byte("unit25..."), cursor)
+		all = append(all, msgs...)
+		if cursor == nil {
+			break
+		}
+	}
+	if len(all) != 27 || all[0] != "msg.other" || all[26] != "msg.00" {
+		t.Fatalf("expected 27 messages of topics, got %d %v", len(all), all)
+	}
+
+	_, cursor = page(db, topic, nil)
+	if _, err := db.Get(NewQuery([]byte("unit26.cursor")).WithCursor(cursor)); err != errCursorInvalid {
+		t.Fatalf("expected invalid cursor, got %v", err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithCursor([]byte("cursor"))); err != errCursorInvalid {
+		t.Fatalf("expected invalid cursor, got %v", err)
+	}
+}
+
+func TestQuerySeek(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit27.seek")
+	const n = 100
+	base := time.Now().Add(-time.Hour).Unix()
+	var i int
+	if _, err := db.Import(func() (*Entry, error) {
+		if i == n {
+			return nil, io.EOF
+		}
+		id := message.NewID(0)
+		binary.LittleEndian.PutUint32(id[0:4], uid.Apoch(base+int64(i)))
+		i++
+		return NewEntry(topic, []byte(fmt.Sprintf("msg.%02d", i-1))).WithID(id), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("msg.live")); err != nil {
+		t.Fatal(err)
+	}
+	get := func(q *Query) []string {
+		t.Helper()
+		items, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []string
+		for _, item := range items {
+			msgs = append(msgs, string(item))
+		}
+		return msgs
+	}
+
+	q := NewQuery(topic).WithLimit(10).Seek(time.Unix(base+49, 0))
+	msgs := get(q)
+	if len(msgs) != 10 || msgs[0] != "msg.49" || msgs[9] != "msg.40" {
+		t.Fatalf("unexpected messages from seek time %v", msgs)
+	}
+	// The cursor continues the query from the seek time.
+	msgs = get(NewQuery(topic).WithLimit(10).WithCursor(q.Cursor()))
+	if len(msgs) != 10 || msgs[0] != "msg.39" || msgs[9] != "msg.30" {
+		t.Fatalf("unexpected messages from cursor %v", msgs)
+	}
+
+	q = NewQuery(topic).WithLimit(1).Seek(time.Unix(base+20, 0))
+	if msgs = get(q); len(msgs) != 1 || msgs[0] != "msg.20" {
+		t.Fatalf("unexpected messages from seek time %v", msgs)
+	}
+	msgs = get(NewQuery(topic).WithLimit(3).SeekSeq(q.internal.last))
+	if len(msgs) != 3 || msgs[0] != "msg.20" || msgs[2] != "msg.18" {
+		t.Fatalf("unexpected messages from seek seq %v", msgs)
+	}
+
+	if msgs = get(NewQuery(topic).Seek(time.Unix(base-1, 0))); len(msgs) != 0 {
+		t.Fatalf("expected no messages before the first message, got %v", msgs)
+	}
+	if msgs = get(NewQuery(topic).WithLimit(2).Seek(time.Now())); len(msgs) != 2 || msgs[0] != "msg.live" || msgs[1] != "msg.99" {
+		t.Fatalf("unexpected messages from seek time %v", msgs)
+	}
+}
+
+func TestGetByID(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit28.id")
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids [][]byte
+	for i := 0; i < 10; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		// Messages are read from the block index once synced and from the memdb before.
+		if i == 4 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cid := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.contract")).WithID(cid).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	get := func(db *DB, q *Query) string {
+		t.Helper()
+		items, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 {
+			t.Fatalf("expected one message, got %d", len(items))
+		}
+		return string(items[0])
+	}
+	for i, id := range ids {
+		if msg := get(db, NewQuery(topic).WithID(id)); msg != fmt.Sprintf("msg.%d", i) {
+			t.Fatalf("unexpected message %s of ID %d", msg, i)
+		}
+	}
+	if msg := get(db, NewQuery(topic).WithID(cid).WithContract(contract)); msg != "msg.contract" {
+		t.Fatalf("unexpected message %s of contract", msg)
+	}
+	if _, err := db.Get(NewQuery(topic).WithID(cid)); err != errMsgIDPrefixMismatch {
+		t.Fatalf("expected prefix mismatch, got %v", err)
+	}
+	// Topics sharing the ID prefix do not read messages of each other by ID.
+	oid := db.NewID()
+	if err := db.PutEntry(NewEntry([]byte("unit28.other"), []byte("msg.other")).WithID(oid)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range [][]byte{oid, ids[3], ids[8]} {
+		if _, err := db.Get(NewQuery([]byte("unit28.id.other")).WithID(id)); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected message of other topic not to exist, got %v", err)
+		}
+	}
+	if _, err := db.Get(NewQuery(topic).WithID(oid)); err != errMsgIDDoesNotExist {
+		t.Fatalf("expected message of other topic not to exist, got %v", err)
+	}
+	if _, err := db.Get(NewQuery([]byte("unit28.other")).WithID(ids[3])); err != errMsgIDDoesNotExist {
+		t.Fatalf("expected message of other topic not to exist, got %v", err)
+	}
+	if msg := get(db, NewQuery([]byte("unit28.other")).WithID(oid)); msg != "msg.other" {
+		t.Fatalf("unexpected message %s of other topic", msg)
+	}
+
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(ids[2])); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(ids[7])); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range [][]byte{ids[2], ids[7], db.NewID()} {
+		if _, err := db.Get(NewQuery(topic).WithID(id)); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected message not to exist, got %v", err)
+		}
+	}
+	if _, err := db.Get(NewQuery([]byte("unit28...")).WithID(ids[0])); !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected bad request for wildcard topic, got %v", err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithID(ids[0][:8])); !errors.Is(err, ErrMessageIDInvalid) {
+		t.Fatalf("expected bad request for invalid ID, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if msg := get(db, NewQuery(topic).WithID(ids[9])); msg != "msg.9" {
+		t.Fatalf("unexpected message %s after reopen", msg)
+	}
+	if _, err := db.Get(NewQuery([]byte("unit28.other")).WithID(ids[9])); err != errMsgIDDoesNotExist {
+		t.Fatalf("expected message of other topic not to exist after reopen, got %v", err)
+	}
+}
+
+func TestGetByIDAccessControl(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithAccessControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := db.NewAccessKey(contract, []byte("unit42..."), AccessWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := db.NewAccessKey(contract, []byte("unit42.public"), AccessRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := db.NewID()
+	if err := db.PutEntry(NewEntry([]byte("unit42.secret"), []byte("secret")).WithID(secret).WithContract(contract).WithAccessKey(writer)); err != nil {
+		t.Fatal(err)
+	}
+	public := db.NewID()
+	if err := db.PutEntry(NewEntry([]byte("unit42.public"), []byte("public")).WithID(public).WithContract(contract).WithAccessKey(writer)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// The secret message is read by ID neither from the memdb nor once synced.
+		if _, err := db.Get(NewQuery([]byte("unit42.public")).WithID(secret).WithContract(contract).WithAccessKey(reader)); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected message of other topic not to exist, got %v", err)
+		}
+		if _, err := db.Get(NewQuery([]byte("unit42.secret")).WithID(secret).WithContract(contract).WithAccessKey(reader)); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("expected %v reading other topic, got %v", ErrForbidden, err)
+		}
+		if msgs, err := db.Get(NewQuery([]byte("unit42.public")).WithID(public).WithContract(contract).WithAccessKey(reader)); err != nil || len(msgs) != 1 || string(msgs[0]) != "public" {
+			t.Fatalf("expected public message, got %q, %v", msgs, err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteTopic(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(topic string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("%s.%d", topic, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := func(db *DB, topic string) int64 {
+		t.Helper()
+		n, err := db.TopicCount([]byte(topic), 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// Entries of the topic are deleted from the DB files and from the memdb.
+	put("unit29.delete", 10)
+	put("unit29.delete.child", 5)
+	put("unit29.gone", 5)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	put("unit29.delete", 10)
+	put("unit29.gone", 5)
+	if err := db.DeleteTopic([]byte("unit29.delete"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteTopic([]byte("unit29.gone"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit29.delete")).WithLimit(100)); err != nil || len(items) != 0 {
+		t.Fatalf("expected no messages of deleted topic, got %d %v", len(items), err)
+	}
+	if n := count(db, "unit29.delete"); n != 0 {
+		t.Fatalf("expected no messages of deleted topic, got %d", n)
+	}
+	if n := count(db, "unit29.delete.child"); n != 5 {
+		t.Fatalf("expected 5 messages of child topic, got %d", n)
+	}
+	topics, err := db.Topics(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range topics {
+		if tp.Topic == "unit29.delete" || tp.Topic == "unit29.gone" {
+			t.Fatalf("expected deleted topic %s not to be listed", tp.Topic)
+		}
+	}
+
+	// The topic is written again once deleted.
+	put("unit29.delete", 3)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(db, "unit29.delete"); n != 3 {
+		t.Fatalf("expected 3 messages of topic written again, got %d", n)
+	}
+	if err := db.DeleteTopic([]byte("unit29..."), 0, ""); !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected bad request for wildcard topic, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery([]byte("unit29.delete")).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || string(items[0]) != "unit29.delete.2" {
+		t.Fatalf("expected 3 messages of topic written again after reopen, got %d", len(items))
+	}
+	if n := count(db, "unit29.gone"); n != 0 {
+		t.Fatalf("expected no messages of deleted topic after reopen, got %d", n)
+	}
+	if n := count(db, "unit29..."); n != 8 {
+		t.Fatalf("expected 8 messages of topics after reopen, got %d", n)
+	}
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Entries != 8 || report.Topics != 2 {
+		t.Fatalf("expected DB verified; got %+v", report)
+	}
+	if err := db.DeleteTopic([]byte("unit29.delete"), 0, ""); err != ErrImmutable {
+		t.Fatalf("expected immutable error, got %v", err)
+	}
+}
+
+func TestTx(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit30.tx")
+	var ids [][]byte
+	for i := 0; i < 5; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(get func(*Query) ([][]byte, error), q *Query) []string {
+		t.Helper()
+		items, err := get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []string
+		for _, item := range items {
+			msgs = append(msgs, string(item))
+		}
+		return msgs
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID := db.NewID()
+	if err := tx.PutEntry(NewEntry(topic, []byte("tx.0")).WithID(newID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(topic, []byte("tx.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put([]byte("unit30.other"), []byte("tx.other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DeleteEntry(NewEntry(topic, nil).WithID(ids[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads of the transaction see its own writes, these are not visible to the DB until committed.
+	want := "tx.1 tx.0 msg.4 msg.3 msg.2 msg.0"
+	if msgs := get(tx.Get, NewQuery(topic).WithLimit(10)); strings.Join(msgs, " ") != want {
+		t.Fatalf("expected messages %s, got %v", want, msgs)
+	}
+	if msgs := get(db.Get, NewQuery(topic).WithLimit(10)); len(msgs) != 5 {
+		t.Fatalf("expected 5 committed messages, got %v", msgs)
+	}
+	if msgs := get(tx.Get, NewQuery([]byte("unit30...")).WithLimit(10)); len(msgs) != 7 || msgs[0] != "tx.other" {
+		t.Fatalf("expected messages of topics written by the transaction, got %v", msgs)
+	}
+	if msgs := get(tx.Get, NewQuery(topic).WithID(newID)); len(msgs) != 1 || msgs[0] != "tx.0" {
+		t.Fatalf("expected message of the ID written by the transaction, got %v", msgs)
+	}
+	if _, err := tx.Get(NewQuery(topic).WithID(ids[1])); err != errMsgIDDoesNotExist {
+		t.Fatalf("expected message deleted by the transaction not to exist, got %v", err)
+	}
+	// Messages are paged across committed messages and writes of the transaction.
+	var paged []string
+	for cursor := []byte(nil); ; {
+		q := NewQuery(topic).WithLimit(4).WithCursor(cursor)
+		paged = append(paged, get(tx.Get, q)...)
+		if cursor = q.Cursor(); cursor == nil {
+			break
+		}
+	}
+	if strings.Join(paged, " ") != want {
+		t.Fatalf("expected paged messages %s, got %v", want, paged)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := get(db.Get, NewQuery(topic).WithLimit(10)); strings.Join(msgs, " ") != want {
+		t.Fatalf("expected committed messages %s, got %v", want, msgs)
+	}
+	if _, err := tx.Get(NewQuery(topic)); err != errTxDone {
+		t.Fatalf("expected transaction done, got %v", err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(topic, []byte("tx.rollback")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != errTxDone {
+		t.Fatalf("expected transaction done, got %v", err)
+	}
+	if msgs := get(db.Get, NewQuery(topic).WithLimit(10)); strings.Join(msgs, " ") != want {
+		t.Fatalf("expected messages %s after rollback, got %v", want, msgs)
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit31.batch")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("1")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	pendingID, deletedID := db.NewID(), db.NewID()
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		// Read-modify-write of a message of the DB within the batch.
+		val, err := b.Get(topic, id)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(string(val))
+		if err := b.PutEntry(NewEntry(topic, []byte(strconv.Itoa(n+1))).WithID(pendingID)); err != nil {
+			return err
+		}
+		if val, err = b.Get(topic, pendingID); err != nil || string(val) != "2" {
+			t.Fatalf("expected pending message of the batch, got %s %v", val, err)
+		}
+		if err := b.PutEntry(NewEntry(topic, []byte("3")).WithID(pendingID)); err != nil {
+			return err
+		}
+		if val, err = b.Get(topic, pendingID); err != nil || string(val) != "3" {
+			t.Fatalf("expected last pending message of the batch, got %s %v", val, err)
+		}
+		if err := b.PutEntry(NewEntry(topic, []byte("4")).WithID(deletedID)); err != nil {
+			return err
+		}
+		if err := b.Delete(deletedID, topic); err != nil {
+			return err
+		}
+		if _, err := b.Get(topic, deletedID); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected message deleted by the batch not to exist, got %v", err)
+		}
+		if _, err := b.Get([]byte("unit31.other"), pendingID); err != errMsgIDPrefixMismatch {
+			t.Fatalf("expected prefix mismatch for other topic, got %v", err)
+		}
+		if _, err := b.Get(topic, db.NewID()); err != errMsgIDDoesNotExist {
+			t.Fatalf("expected message not to exist, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery(topic).WithID(pendingID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(items[0]) != "3" {
+		t.Fatalf("expected committed message of the batch, got %s", items[0])
+	}
+}
+
+func TestMemdbWriteStall(t *testing.T) {
+	cleanup()
+	const max = 1 << 15
+	db, err := Open(dbPath, WithMaxMemdbSize(max), WithWriteStallTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit32.stall")
+	val := make([]byte, 1024)
+	var size int64
+	for i := 0; i < 50; i++ {
+		rand.Read(val)
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		if n := db.internal.mem.DataSize(); n > size {
+			size = n
+		}
+	}
+	// The memdb is drained once it exceeds the maximum size, so it holds at most one more entry.
+	if size > max+2*int64(len(val)) {
+		t.Fatalf("expected memdb size up to %d, got %d", max, size)
+	}
+	if db.internal.meter.WriteStalls.Count() == 0 {
+		t.Fatal("expected writes stalled on full memdb")
+	}
+	if n, err := db.TopicCount(topic, 0, ""); err != nil || n != 50 {
+		t.Fatalf("expected 50 messages, got %d %v", n, err)
+	}
+
+	// The memdb is not drained while a sync is in progress, the write fails once the stall timeout is reached.
+	db.opts.writeStallTimeout = 100 * time.Millisecond
+	atomic.StoreInt32(&db.internal.syncHandle.syncInfo.syncStatusOk, 1)
+	var stallErr error
+	for i := 0; i < 100 && stallErr == nil; i++ {
+		rand.Read(val)
+		stallErr = db.Put(topic, val)
+	}
+	atomic.StoreInt32(&db.internal.syncHandle.syncInfo.syncStatusOk, 0)
+	if stallErr != ErrWriteStall {
+		t.Fatalf("expected write stall error, got %v", stallErr)
+	}
+}
+
+// BenchmarkTrie measures concurrent writes and lookups of the trie. Each write looks up offset of its topic,
+// a sync sets offsets of topics written and a new topic is added for every hundred writes.
+func BenchmarkTrie(b *testing.B) {
+	const nTopics = 10000
+	trie := newTrie()
+	topics := make([]*message.Topic, nTopics)
+	for i := range topics {
+		t := new(message.Topic)
+		t.ParseKey([]byte(fmt.Sprintf("unit33.trie.%d", i)))
+		t.Parse(message.MasterContract, true)
+		t.AddContract(message.MasterContract)
+		trie.add(newTopic(t.GetHash(message.MasterContract), int64(i)), t.Parts, t.Depth)
+		topics[i] = t
+	}
+	var added uint64
+	b.Run("write", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for i := 0; pb.Next(); i++ {
+				h := topics[r.Intn(nTopics)].GetHash(message.MasterContract)
+				off, _ := trie.getOffset(h)
+				switch {
+				case i%100 == 0:
+					t := new(message.Topic)
+					t.ParseKey([]byte(fmt.Sprintf("unit33.new.%d", atomic.AddUint64(&added, 1))))
+					t.Parse(message.MasterContract, true)
+					t.AddContract(message.MasterContract)
+					trie.add(newTopic(t.GetHash(message.MasterContract), 0), t.Parts, t.Depth)
+				case i%10 == 0:
+					trie.setOffset(newTopic(h, off+1))
+				}
+			}
+		})
+	})
+	b.Run("lookup", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for i := 0; pb.Next(); i++ {
+				t := topics[r.Intn(nTopics)]
+				// A sync sets offsets of topics while these are looked up.
+				if i%10 == 0 {
+					h := t.GetHash(message.MasterContract)
+					off, _ := trie.getOffset(h)
+					trie.setOffset(newTopic(h, off+1))
+					continue
+				}
+				if tops := trie.lookup(t.Parts, t.Depth, t.TopicType); len(tops) != 1 {
+					b.Fatalf("expected topic, got %d", len(tops))
+				}
+			}
+		})
+	})
+}
+
+// _MetricsRecorder records metrics reported to the metrics sink.
+type _MetricsRecorder struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]int
+}
+
+func (r *_MetricsRecorder) Counter(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *_MetricsRecorder) Gauge(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+func (r *_MetricsRecorder) Histogram(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.histograms[name]++
+}
+
+func TestMetrics(t *testing.T) {
+	cleanup()
+	rec := &_MetricsRecorder{counters: make(map[string]int64), gauges: make(map[string]float64), histograms: make(map[string]int)}
+	db, err := Open(dbPath, WithMetrics(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit33.metrics")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Get(NewQuery(topic).WithLimit(10)); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen DB to sync entries from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMetrics(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, name := range []string{"puts", "gets", "in_msgs", "recovers"} {
+		if rec.counters[name] != 10 {
+			t.Fatalf("expected counter %s 10, got %d", name, rec.counters[name])
+		}
+	}
+	if rec.gauges["count"] != float64(db.Count()) {
+		t.Fatalf("expected count gauge %d, got %v", db.Count(), rec.gauges["count"])
+	}
+	if rec.histograms["sync_seconds"] == 0 {
+		t.Fatal("expected sync duration observed")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit34.flush")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.internal.meter.InMsgs.Count(); n != 10 {
+		t.Fatalf("expected 10 messages synced, got %d", n)
+	}
+	if n := db.internal.mem.Size(); n != 0 {
+		t.Fatalf("expected memdb released, got %d entries", n)
+	}
+	if v, err := db.Get(NewQuery(topic).WithLimit(20)); err != nil || len(v) != 10 {
+		t.Fatalf("expected 10 messages, got %d %v", len(v), err)
+	}
+
+	// Entries put after a flush are written to a new time block.
+	if err := db.Put(topic, []byte("msg.10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.internal.meter.InMsgs.Count(); n != 11 {
+		t.Fatalf("expected 11 messages synced, got %d", n)
+	}
+}
+
+func TestCloseDrain(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit35.drain")
+	var wg sync.WaitGroup
+	var acked int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				b := db.NewBatch()
+				if err := b.Put(topic, []byte(fmt.Sprintf("msg.%d.%d", i, j))); err != nil {
+					b.Abort()
+					return
+				}
+				switch err := b.CommitAsync().Err(); {
+				case err == nil:
+					atomic.AddInt64(&acked, 1)
+				case errors.Is(err, ErrClosed):
+					return
+				default:
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// Writes after close are refused.
+	b := db.NewBatch()
+	b.Put(topic, []byte("msg"))
+	if err := b.Commit(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// Acknowledged commits are recovered from the log.
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.TopicCount(topic, 0, ""); err != nil || int64(n) != atomic.LoadInt64(&acked) {
+		t.Fatalf("expected %d messages, got %d %v", atomic.LoadInt64(&acked), n, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close stops waiting for writes in progress once the drain timeout is reached.
+	db, err = Open(dbPath, WithDrainTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.startWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != ErrDrainTimeout {
+		t.Fatalf("expected ErrDrainTimeout, got %v", err)
+	}
+	db.finishWrite()
+}
+
+func TestHeaders(t *testing.T) {
+	cleanup()
+	key := []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
+	db, err := Open(dbPath, WithMutable(), WithEncryption(), WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit37.headers")
+	sub, err := db.Subscribe(topic, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string][]byte{"content-type": []byte("application/json"), "trace-id": []byte("t1")}
+	e := &Entry{Topic: topic, Payload: []byte(`{"n":1}`), Headers: headers}
+	if err := db.PutEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	if err := b.PutEntry(&Entry{Topic: topic, Payload: []byte("batch"), Headers: map[string][]byte{"schema": []byte("v2")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-sub.C(); !reflect.DeepEqual(m.Headers, headers) {
+		t.Fatalf("expected subscription headers %v, got %v", headers, m.Headers)
+	}
+
+	check := func() {
+		msgs, err := db.GetMessages(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(msgs))
+		}
+		// Messages are returned newest first.
+		if string(msgs[0].Payload) != "batch" || string(msgs[0].Headers["schema"]) != "v2" {
+			t.Fatalf("unexpected message %s %v", msgs[0].Payload, msgs[0].Headers)
+		}
+		if string(msgs[1].Payload) != "plain" || msgs[1].Headers != nil {
+			t.Fatalf("unexpected message %s %v", msgs[1].Payload, msgs[1].Headers)
+		}
+		if string(msgs[2].Payload) != `{"n":1}` || !reflect.DeepEqual(msgs[2].Headers, headers) || string(msgs[2].Topic) != string(topic) {
+			t.Fatalf("unexpected message %s %s %v", msgs[2].Topic, msgs[2].Payload, msgs[2].Headers)
+		}
+		// Get returns payloads without headers.
+		items, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil || len(items) != 3 || string(items[2]) != `{"n":1}` {
+			t.Fatalf("unexpected items %q %v", items, err)
+		}
+		byID, err := db.GetMessages(NewQuery(topic).WithID(msgs[2].ID))
+		if err != nil || len(byID) != 1 || !reflect.DeepEqual(byID[0].Headers, headers) {
+			t.Fatalf("unexpected message by ID %v %v", byID, err)
+		}
+	}
+	check()
+
+	// Headers are kept once entries are synced from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable(), WithEncryption(), WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	large := map[string][]byte{"large": make([]byte, maxHeadersSize)}
+	if err := db.PutEntry(&Entry{Topic: topic, Payload: []byte("msg"), Headers: large}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest, got %v", err)
+	}
+}
+
+func TestContracts(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetContractName(contract, "tenant"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetContractName(12345, "unknown"); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v naming unknown contract, got %v", ErrBadRequest, err)
+	}
+	for _, c := range []uint32{contract, other} {
+		for _, topic := range []string{"contracts.a", "contracts.b"} {
+			if err := db.PutEntry(NewEntry([]byte(topic), []byte("msg")).WithContract(c)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.SetQuota(contract, Quota{MaxTopics: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteContract(0); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v deleting master contract, got %v", ErrBadRequest, err)
+	}
+	if err := db.DeleteContract(contract); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("contracts.a"), []byte("msg")).WithContract(contract)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v writing to deleted contract, got %v", ErrForbidden, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Contracts and deletion survive reopening the DB.
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contracts := db.Contracts()
+	if len(contracts) != 2 {
+		t.Fatalf("expected 2 contracts, got %+v", contracts)
+	}
+	for _, c := range contracts {
+		switch c.Contract {
+		case contract:
+			if c.Name != "tenant" || c.CreatedAt.IsZero() || c.DeletedAt.IsZero() {
+				t.Fatalf("unexpected deleted contract %+v", c)
+			}
+		case other:
+			if c.CreatedAt.IsZero() || !c.DeletedAt.IsZero() {
+				t.Fatalf("unexpected contract %+v", c)
+			}
+		default:
+			t.Fatalf("unexpected contract %+v", c)
+		}
+	}
+	for _, topic := range []string{"contracts.a", "contracts.b"} {
+		if msgs, err := db.Get(NewQuery([]byte(topic)).WithContract(contract).WithLast("1h")); err != nil || len(msgs) != 0 {
+			t.Fatalf("expected no messages of deleted contract, got %d, %v", len(msgs), err)
+		}
+		if msgs, err := db.Get(NewQuery([]byte(topic)).WithContract(other).WithLast("1h")); err != nil || len(msgs) != 1 {
+			t.Fatalf("expected 1 message of other contract, got %d, %v", len(msgs), err)
+		}
+	}
+	if _, ok := db.internal.quotas.get(contract); ok {
+		t.Fatal("expected quota of deleted contract to be removed")
+	}
+	if err := db.PutEntry(NewEntry([]byte("contracts.a"), []byte("msg")).WithContract(contract)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v writing to deleted contract after reopen, got %v", ErrForbidden, err)
+	}
+}
+
+func TestContractKeys(t *testing.T) {
+	cleanup()
+	key := []byte("TenantKeyOfContract1234567890abc")
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetContractKey(contract, key[:16]); err != errBadEncryptionKey {
+		t.Fatalf("expected %v on short key, got %v", errBadEncryptionKey, err)
+	}
+	if err := db.SetContractKey(contract, key); err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit41.keys")
+	for i := 0; i < 3; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte("tenant msg")).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put(topic, []byte("master msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages of the contract are not read or written without its key.
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithContract(contract).WithLast("1h")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v reading without contract key, got %v", ErrForbidden, err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v writing without contract key, got %v", ErrForbidden, err)
+	}
+	if msgs, err := db.Get(NewQuery(topic).WithLast("1h")); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message of master contract, got %d, %v", len(msgs), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath, WithMutable(), WithContractKey(contract, []byte("AnotherKeyOfContract1234567890ab"))); err != errBadEncryptionKey {
+		t.Fatalf("expected %v opening with wrong contract key, got %v", errBadEncryptionKey, err)
+	}
+
+	if db, err = Open(dbPath, WithMutable(), WithContractKey(contract, key)); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	msgs, err := db.Get(NewQuery(topic).WithContract(contract).WithLast("1h"))
+	if err != nil || len(msgs) != 3 || string(msgs[0]) != "tenant msg" {
+		t.Fatalf("expected 3 messages of contract, got %q, %v", msgs, err)
+	}
+
+	// Deleting the key shreds messages of the contract, new messages are encrypted with keys of the DB.
+	if err := db.DeleteContractKey(contract); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := db.Get(NewQuery(topic).WithContract(contract).WithLast("1h")); err != nil || len(msgs) != 0 {
+		t.Fatalf("expected no messages after key is deleted, got %d, %v", len(msgs), err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := db.Get(NewQuery(topic).WithContract(contract).WithLast("1h")); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 new message of contract, got %d, %v", len(msgs), err)
+	}
+}
+
+func TestAccessKeys(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithAccessControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := db.NewAccessKey(contract, []byte("unit42.teams..."), AccessWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := db.NewAccessKey(contract, []byte("unit42.teams.*"), AccessRead, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.NewAccessKey(contract, []byte("unit42"), Access(4), 0); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on invalid access, got %v", ErrBadRequest, err)
+	}
+	topic := []byte("unit42.teams.alpha")
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v without access key, got %v", ErrForbidden, err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract).WithAccessKey(reader)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v writing with read key, got %v", ErrForbidden, err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithAccessKey(writer)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v writing to other contract, got %v", ErrForbidden, err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit42.other"), []byte("msg")).WithContract(contract).WithAccessKey(writer)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v writing to other topic, got %v", ErrForbidden, err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract).WithAccessKey(writer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(NewQuery(topic).WithContract(contract).WithLast("1h")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v reading without access key, got %v", ErrForbidden, err)
+	}
+	if _, err := db.Get(NewQuery([]byte("unit42.teams...")).WithContract(contract).WithLast("1h").WithAccessKey(reader)); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v reading subtree with key of single level, got %v", ErrForbidden, err)
+	}
+	if msgs, err := db.Get(NewQuery(topic).WithContract(contract).WithLast("1h").WithAccessKey(reader)); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d, %v", len(msgs), err)
+	}
+	if _, err := db.ParseAccessKey(writer[:len(writer)-2] + "AA"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected %v on tampered key, got %v", ErrForbidden, err)
+	}
+	if err := db.RevokeAccessKey(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys remain valid and revoked keys remain revoked after reopening the DB.
+	if db, err = Open(dbPath, WithMutable(), WithAccessControl()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract).WithAccessKey(writer)); err != errAccessKeyRevoked {
+		t.Fatalf("expected %v with revoked key, got %v", errAccessKeyRevoked, err)
+	}
+	k, err := db.ParseAccessKey(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Contract != contract || k.Access != AccessRead || string(k.Topic) != "unit42.teams.*" || k.ExpiresAt.IsZero() {
+		t.Fatalf("unexpected access key %+v", k)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithAccessControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := db.NewAccessKey(contract, []byte("unit43..."), AccessWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := db.NewAccessKey(contract, []byte("unit43..."), AccessRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit43.a")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id).WithContract(contract).WithAccessKey(writer)); err != nil {
+		t.Fatal(err)
+	}
+	forbidden := func(name string, err error) {
+		t.Helper()
+		if !errors.Is(err, ErrForbidden) {
+			t.Fatalf("%s: expected %v, got %v", name, ErrForbidden, err)
+		}
+	}
+	for _, key := range []string{"", reader} {
+		forbidden("DeleteEntry", db.DeleteEntry(NewEntry(topic, nil).WithID(id).WithContract(contract).WithAccessKey(key)))
+		forbidden("DeleteTopic", db.DeleteTopic(topic, contract, key))
+		forbidden("ReplaceTopic", db.ReplaceTopic(topic, []*Entry{NewEntry(topic, []byte("new")).WithContract(contract).WithAccessKey(key)}))
+	}
+	forbidden("Delete", db.Delete(id, topic))
+	forbidden("ReplaceTopic", db.ReplaceTopic(topic, nil))
+	for _, key := range []string{"", writer} {
+		_, err := db.Subscribe(topic, contract, key)
+		forbidden("Subscribe", err)
+		_, err = db.SubscribeGroup("workers", topic, contract, key)
+		forbidden("SubscribeGroup", err)
+		_, err = db.Last(topic, contract, key)
+		forbidden("Last", err)
+		_, err = db.TopicStats(topic, contract, key)
+		forbidden("TopicStats", err)
+		_, err = db.TopicCount(topic, contract, key)
+		forbidden("TopicCount", err)
+		_, err = db.Windows(topic, contract, key, time.Time{}, time.Time{})
+		forbidden("Windows", err)
+		forbidden("Export", db.Export(io.Discard, NewQuery(topic).WithContract(contract).WithAccessKey(key), ExportNDJSON))
+	}
+	if n, err := db.TopicCount(topic, contract, reader); err != nil || n != 1 {
+		t.Fatalf("expected count 1 of topic, got %d, %v", n, err)
+	}
+
+	// Keys granting access are accepted.
+	sub, err := db.Subscribe(topic, contract, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if _, err := db.SubscribeGroup("workers", topic, contract, reader); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := db.Last(topic, contract, reader); err != nil || string(m.Payload) != "msg" {
+		t.Fatalf("expected last message, got %v, %v", m, err)
+	}
+	if stats, err := db.TopicStats(topic, contract, reader); err != nil || stats.Entries != 1 {
+		t.Fatalf("expected stats of 1 message, got %+v, %v", stats, err)
+	}
+	if _, err := db.Windows(topic, contract, reader, time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.Export(&buf, NewQuery(topic).WithContract(contract).WithAccessKey(reader), ExportNDJSON); err != nil || buf.Len() == 0 {
+		t.Fatalf("expected exported message, got %d bytes, %v", buf.Len(), err)
+	}
+	if err := db.ReplaceTopic(topic, []*Entry{NewEntry(topic, []byte("new")).WithContract(contract).WithAccessKey(writer)}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := db.Last(topic, contract, reader)
+	if err != nil || string(m.Payload) != "new" {
+		t.Fatalf("expected replaced message, got %v, %v", m, err)
+	}
+	if err := db.DeleteEntry(NewEntry(topic, nil).WithID(m.ID).WithContract(contract).WithAccessKey(writer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteTopic(topic, contract, writer); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.TopicCount(topic, contract, reader); err != nil || n != 0 {
+		t.Fatalf("expected deleted topic, got %d, %v", n, err)
+	}
+}
+
+func TestMatchTopicPattern(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.b", "a.b.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.*", true},
+		{"a.*", "a.b.c", false},
+		{"a.b", "a.*", false},
+		{"a...", "a", true},
+		{"a...", "a.b.c", true},
+		{"a...", "a.b...", true},
+		{"a.#", "a.b", true},
+		{"a.b...", "a...", false},
+		{"a.*", "a...", false},
+		{"a.b", "a.b?ttl=1h", true},
+		{"a.+.c", "a.b.c", true},
+		{"a.b.c", "a.+.c", false},
+	}
+	for _, tt := range tests {
+		if match := matchTopicPattern([]byte(tt.pattern), []byte(tt.topic)); match != tt.match {
+			t.Errorf("matchTopicPattern(%q, %q) = %v, want %v", tt.pattern, tt.topic, match, tt.match)
+		}
+	}
+}
+
+func TestQuotaEviction(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	enforced, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota(enforced, Quota{MaxMessages: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.PutEntry(NewEntry([]byte("unit43.a"), []byte("msg")).WithContract(enforced)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit43.a"), []byte("msg")).WithContract(enforced)); err != ErrQuotaExceeded {
+		t.Fatalf("expected %v on stored messages, got %v", ErrQuotaExceeded, err)
+	}
+
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota(contract, Quota{MaxMessages: 3, Mode: LimitEvict}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		topic := []byte("unit43.a")
+		if i%2 == 1 {
+			topic = []byte("unit43.b")
+		}
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%d", i))).WithContract(contract)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.ContractStats(contract)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 3 || stats.Evicted != 2 || stats.Exceeded != 2 {
+		t.Fatalf("unexpected contract stats %+v", stats)
+	}
+	// The oldest messages of the contract are evicted across its topics.
+	a, err := db.Get(NewQuery([]byte("unit43.a")).WithContract(contract).WithLast("1h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.Get(NewQuery([]byte("unit43.b")).WithContract(contract).WithLast("1h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 2 || string(a[0]) != "msg.4" || string(a[1]) != "msg.2" || len(b) != 1 || string(b[0]) != "msg.3" {
+		t.Fatalf("unexpected messages after eviction %q, %q", a, b)
+	}
+	if _, err := Open(dbPath+".evict", WithLimitMode(LimitEvict)); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v on evict mode of DB limits, got %v", ErrInvalidOptions, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithRateLimit(0.001, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit44.rate")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put(topic, []byte("msg")); err != ErrRateLimited {
+		t.Fatalf("expected %v, got %v", ErrRateLimited, err)
+	}
+	b := db.NewBatch()
+	if err := b.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(); err != ErrRateLimited {
+		t.Fatalf("expected %v on batch commit, got %v", ErrRateLimited, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rate of a contract is limited by its quota, other contracts are not limited.
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota(contract, Quota{Rate: 0.001, Burst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// A batch larger than the burst is admitted once the bucket is full.
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for i := 0; i < 4; i++ {
+			if err := b.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != ErrRateLimited {
+		t.Fatalf("expected %v on contract, got %v", ErrRateLimited, err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.Put(topic, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteQuota(contract); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitMode(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithRateLimit(0.001, 1), WithLimitMode(LimitObserve, LimitRate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit44.rate.observe")
+	// Writes exceeding the rate are accepted and counted in observe mode.
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := db.LimitsExceeded()[LimitRate]; n != 2 {
+		t.Fatalf("expected 2 writes exceeding the rate, got %d", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write rejected by another limit does not take tokens.
+	cleanup()
+	if db, err = Open(dbPath, WithMutable(), WithRateLimit(0.001, 2), WithLimit(LimitTopics, 1)); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit44.rate.other"), []byte("msg")); err != errTooManyTopics {
+		t.Fatalf("expected %v, got %v", errTooManyTopics, err)
+	}
+	if err := db.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("msg")); err != ErrRateLimited {
+		t.Fatalf("expected %v, got %v", ErrRateLimited, err)
+	}
+}
+
+func TestSingleLevelWildcard(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sub, err := db.Subscribe([]byte("unit45.+.temperature"), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for _, topic := range []string{"unit45.dev1.temperature", "unit45.dev2.temperature", "unit45.dev1.humidity", "unit45.dev1.temperature.max", "unit45.temperature"} {
+		if err := db.Put([]byte(topic), []byte(topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		topic string
+		count int
+	}{
+		{"unit45.+.temperature", 2},
+		{"unit45.+", 1},
+		{"unit45.+.+", 3},
+		{"unit45.dev1.+", 2},
+		{"+.dev2.temperature", 1},
+	}
+	for _, tt := range tests {
+		items, err := db.Get(NewQuery([]byte(tt.topic)).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != tt.count {
+			t.Fatalf("%s: expected %d messages, got %d", tt.topic, tt.count, len(items))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-sub.C():
+			if !strings.HasSuffix(string(m.Topic), ".temperature") {
+				t.Fatalf("unexpected message of topic %s", m.Topic)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected message of subscription")
+		}
+	}
+	if err := db.Put([]byte("unit45.+.temperature"), []byte("msg")); !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected %v writing to single-level wildcard, got %v", ErrTopicInvalid, err)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hour := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	put := func(topic string, at time.Time, payload string) {
+		id := db.NewID()
+		binary.LittleEndian.PutUint32(id[0:4], uid.Apoch(at.Unix()))
+		if err := db.PutEntry(NewEntry([]byte(topic), []byte(payload)).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("unit46.dev1", hour.Add(time.Minute), "a")
+	put("unit46.dev2", hour.Add(2*time.Minute), "b")
+	put("unit46.dev1", hour.Add(time.Hour+time.Minute), "c")
+	put("unit46.dev1", hour.Add(time.Hour+3*time.Minute), "d")
+	put("unit46.dev2", hour.Add(time.Hour+2*time.Minute), "e")
+
+	check := func() {
+		buckets, err := db.Aggregate(NewQuery([]byte("unit46.+")).WithLast("4h"), AggCount, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 2 || !buckets[0].Start.Equal(hour) || buckets[0].Count != 2 || buckets[1].Count != 3 || buckets[1].Payload != nil {
+			t.Fatalf("unexpected count buckets %+v", buckets)
+		}
+		buckets, err = db.Aggregate(NewQuery([]byte("unit46...")).WithLast("4h"), AggLast, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 2 || string(buckets[0].Payload) != "b" || string(buckets[1].Payload) != "d" {
+			t.Fatalf("unexpected last buckets %+v", buckets)
+		}
+		buckets, err = db.Aggregate(NewQuery([]byte("unit46.dev1")).WithLast("4h"), AggFirst, 2*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) == 0 || string(buckets[0].Payload) != "a" {
+			t.Fatalf("unexpected first buckets %+v", buckets)
+		}
+		// The sampled message is read with its ID.
+		items, err := db.Get(NewQuery([]byte("unit46.dev1")).WithID(buckets[0].ID))
+		if err != nil || len(items) != 1 || string(items[0]) != "a" {
+			t.Fatalf("unexpected message of sampled ID %q, %v", items, err)
+		}
+	}
+	check()
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if _, err := db.Aggregate(NewQuery([]byte("unit46.dev1")), AggCount, time.Millisecond); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on bucket less than a second, got %v", ErrBadRequest, err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Truncate(10 * time.Minute).Add(-3 * time.Hour)
+	put := func(topic string, at time.Time, payload string) {
+		id := db.NewID()
+		binary.LittleEndian.PutUint32(id[0:4], uid.Apoch(at.Unix()))
+		if err := db.PutEntry(NewEntry([]byte(topic), []byte(payload)).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("unit47.dev1", base.Add(time.Minute), "a")
+	put("unit47.dev1", base.Add(5*time.Minute), "b")
+	put("unit47.dev1", base.Add(12*time.Minute), "c")
+	put("unit47.dev1", base.Add(15*time.Minute), "d")
+	put("unit47.dev2", base.Add(3*time.Minute), "x")
+	put("unit47.dev1", time.Now(), "e")
+
+	if err := db.SetRollup(NewRollup([]byte("unit47..."), []byte("unit47.rollup"))); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on rollup without interval; got %v", ErrBadRequest, err)
+	}
+	if err := db.SetRollup(NewRollup([]byte("unit47..."), []byte("unit47.rollup")).WithRawAge(time.Hour).WithInterval(10 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen DB to check rollups persist.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if rollups := db.Rollups(); len(rollups) != 1 || rollups[0].Interval != 10*time.Minute {
+		t.Fatalf("expected rollup to persist; got %v", rollups)
+	}
+	// Rollup topics are excluded, so running rollups again keeps the samples.
+	for i := 0; i < 2; i++ {
+		if err := db.EnforceRollups(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, ok := db.LastRun(RunRollup)
+	if !ok || r.Err != "" {
+		t.Fatalf("expected rollup run in the run history; got %v", r)
+	}
+	for topic, want := range map[string][]string{
+		"unit47.dev1":               {"e"},
+		"unit47.dev2":               nil,
+		"unit47.rollup.unit47.dev1": {"d", "b"},
+		"unit47.rollup.unit47.dev2": {"x"},
+	} {
+		items, err := db.Get(NewQuery([]byte(topic)).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v of topic %s; got %v", want, topic, got)
+		}
+	}
+	if err := db.DeleteRollup([]byte("unit47..."), 0); err != nil {
+		t.Fatal(err)
+	}
+	if rollups := db.Rollups(); len(rollups) != 0 {
+		t.Fatalf("expected rollup to be deleted; got %v", rollups)
+	}
+}
+
+func TestItemsChan(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit48.items")
+	var n int = 25
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 12 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	items, errC := db.ItemsChan(context.Background(), NewQuery(topic).WithLimit(10))
+	i := n
+	for item := range items {
+		i--
+		if want := fmt.Sprintf("msg.%2d", i); string(item.Payload) != want || string(item.Topic) != string(topic) {
+			t.Fatalf("expected %s of topic %s; got %s of topic %s", want, topic, item.Payload, item.Topic)
+		}
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if i != 0 {
+		t.Fatalf("expected %d items; got %d", n, n-i)
+	}
+
+	items, errC = db.ItemsChan(context.Background(), NewQuery(nil))
+	for range items {
+		t.Fatal("expected no items of query without topic")
+	}
+	if err := <-errC; !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected %v; got %v", ErrTopicInvalid, err)
+	}
+
+	// A consumer stopping early cancels the context to stop the goroutine.
+	ctx, cancel := context.WithCancel(context.Background())
+	items, errC = db.ItemsChan(ctx, NewQuery(topic).WithLimit(5))
+	<-items
+	cancel()
+	select {
+	case err := <-errC:
+		if err != context.Canceled {
+			t.Fatalf("expected %v; got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected goroutine stopped once the context is cancelled")
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit49.filter")
+	var n int = 20
+	for i := 0; i < n; i++ {
+		kind := "info"
+		if i%4 == 0 {
+			kind = "error"
+		}
+		if err := db.Put(topic, []byte(fmt.Sprintf("%s.%2d", kind, i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 10 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Rejected messages are not counted against the limit.
+	q := NewQuery(topic).WithLimit(3).WithFilter(PayloadPrefix([]byte("error")))
+	items, err := db.Get(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{[]byte("error.16"), []byte("error.12"), []byte("error. 8")}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("expected %q; got %q", want, items)
+	}
+	if st := q.Stats(); st.Returned != 3 || st.Filtered == 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	// The cursor continues from the last message returned.
+	items, err = db.Get(NewQuery(topic).WithLimit(3).WithFilter(PayloadPrefix([]byte("error"))).WithCursor(q.Cursor()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = [][]byte{[]byte("error. 4"), []byte("error. 0")}
+	if !reflect.DeepEqual(items, want) {
+		t.Fatalf("expected %q; got %q", want, items)
+	}
+	msgs, err := db.GetMessages(NewQuery(topic).WithLimit(n).WithFilter(func(item *Item) bool {
+		return string(item.Topic) == string(topic) && !bytes.HasPrefix(item.Payload, []byte("error"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != n-5 {
+		t.Fatalf("expected %d messages; got %d", n-5, len(msgs))
+	}
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"device":"sensor-%03d","temperature":%d.%d,"humidity":%d,"status":"ok"}`, i%7, 20+i%5, i%10, 40+i%13))
+	}
+	// A header with an empty name is kept with a payload compressed with a dictionary.
+	headers := map[string][]byte{"type": []byte("json"), "": []byte("x")}
+	put := func(topic string, from, to int, headers map[string][]byte) {
+		for i := from; i < to; i++ {
+			e := NewEntry([]byte(topic), payload(i))
+			e.Headers = headers
+			if err := db.PutEntry(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(topic string, n int) {
+		msgs, err := db.GetMessages(NewQuery([]byte(topic)).WithLimit(n + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != n {
+			t.Fatalf("expected %d messages of topic %s; got %d", n, topic, len(msgs))
+		}
+		for i, m := range msgs {
+			if want := payload(n - 1 - i); !bytes.Equal(m.Payload, want) {
+				t.Fatalf("expected %s; got %s", want, m.Payload)
+			}
+			if m.Headers != nil && !reflect.DeepEqual(m.Headers, headers) {
+				t.Fatalf("unexpected headers %v", m.Headers)
+			}
+		}
+	}
+	if err := db.TrainDictionary([]byte("unit50.a"), 0); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on topic without messages; got %v", ErrBadRequest, err)
+	}
+	put("unit50.a", 0, 20, nil)
+	put("unit50.b", 0, 20, nil)
+	if err := db.TrainDictionary([]byte("unit50.a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	put("unit50.a", 20, 100, headers)
+	put("unit50.b", 20, 100, headers)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := db.TopicStats([]byte("unit50.a"), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.TopicStats([]byte("unit50.b"), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Bytes >= b.Bytes {
+		t.Fatalf("expected values compressed with a dictionary to be smaller; got %d, %d", a.Bytes, b.Bytes)
+	}
+	check("unit50.a", 100)
+
+	// Reopen DB to check dictionaries persist, and train dictionaries from samples.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable(), WithDeflateDictionaries(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("unit50.a", 100)
+	put("unit50.c", 0, 50, nil)
+	if len(db.internal.plugins.dictionaries.ids) != 2 {
+		t.Fatalf("expected dictionary trained from samples; got %d dictionaries", len(db.internal.plugins.dictionaries.ids))
+	}
+	check("unit50.c", 50)
+}
+
+func TestCompressionMinSize(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dbPath, WithCompressionMinSize(64)); err != errPluginMismatch {
+		t.Fatalf("expected %v storing raw values in DB created without it; got %v", errPluginMismatch, err)
+	}
+
+	cleanup()
+	db, err = Open(dbPath, WithMutable(), WithCompressionMinSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiny := []byte("hi")
+	large := bytes.Repeat([]byte("unit51"), 100)
+	if err := db.Put([]byte("unit51.tiny"), tiny); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit51.large"), large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The tiny value is stored raw after the flag byte, the large value is compressed.
+	if st, err := db.TopicStats([]byte("unit51.tiny"), 0, ""); err != nil || st.Bytes != int64(len(tiny)+1) {
+		t.Fatalf("expected raw value of %d bytes; got %+v, %v", len(tiny)+1, st, err)
+	}
+	if st, err := db.TopicStats([]byte("unit51.large"), 0, ""); err != nil || st.Bytes >= int64(len(large)) {
+		t.Fatalf("expected compressed value; got %+v, %v", st, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the option all values are encoded, and raw values are still read.
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("unit51.tiny"), tiny); err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string][][]byte{"unit51.tiny": {tiny, tiny}, "unit51.large": {large}} {
+		items, err := db.Get(NewQuery([]byte(topic)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(items, want) {
+			t.Fatalf("unexpected items of topic %s: %q", topic, items)
+		}
+	}
+}
+
+func TestBatchDuplicates(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	write := func(topic string, policy ConflictPolicy) error {
+		id := db.NewID()
+		return db.Batch(func(b *Batch, completed <-chan struct{}) error {
+			b.SetOptions(WithBatchConflict(policy))
+			// Entries without a message ID are all written.
+			for i := 0; i < 2; i++ {
+				if err := b.Put([]byte(topic), []byte("same")); err != nil {
+					return err
+				}
+			}
+			if err := b.PutEntry(NewEntry([]byte(topic), []byte("first")).WithID(id)); err != nil {
+				return err
+			}
+			return b.PutEntry(NewEntry([]byte(topic), []byte("last")).WithID(id))
+		})
+	}
+	for _, tc := range []struct {
+		topic  string
+		policy ConflictPolicy
+		want   [][]byte
+	}{
+		{"unit52.last", ConflictLastWriterWins, [][]byte{[]byte("same"), []byte("same"), []byte("last")}},
+		{"unit52.first", ConflictFirstWriterWins, [][]byte{[]byte("same"), []byte("same"), []byte("first")}},
+	} {
+		if err := write(tc.topic, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			items, err := db.Get(NewQuery([]byte(tc.topic)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(items, tc.want) {
+				t.Fatalf("expected %q of policy %d; got %q", tc.want, tc.policy, items)
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := write("unit52.error", ConflictError); err != ErrWriteConflict {
+		t.Fatalf("expected %v; got %v", ErrWriteConflict, err)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	cleanup()
+	opts := []Options{WithMutable(), WithDirectIO(DirectIOData | DirectIOWAL)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.opts.fileSystem.(*fs.DirectIO); !ok {
+		t.Fatalf("expected direct IO file system; got %T", db.opts.fileSystem)
+	}
+	topic := []byte("unit14.direct")
+	var vals [][]byte
+	for i := 0; i < 50; i++ {
+		val := bytes.Repeat([]byte{byte('a' + i%26)}, 100*i+1)
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+		if i%10 == 0 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Messages are read back from the files written with direct IO.
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get(NewQuery(topic).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %d messages; got %d", len(vals), len(v))
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithBlockSize(block.MinSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit15.blocks")
+	var vals [][]byte
+	for i := 0; i < 300; i++ {
+		val := []byte(fmt.Sprintf("msg.%3d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		vals = append([][]byte{val}, vals...)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filePath(dbPath, _FileDesc{fileType: typeIndex}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, _ := block.NewLayout(block.MinSize)
+	nBlocks := (300 + layout.EntriesPerIndexBlock - 1) / layout.EntriesPerIndexBlock
+	if stat.Size() != int64(nBlocks*block.MinSize) {
+		t.Fatalf("expected index file of %d blocks of %d bytes; got %d bytes", nBlocks, block.MinSize, stat.Size())
+	}
+
+	// The DB is reopened with the block size it was created with.
+	if _, err := Open(dbPath, WithBlockSize(2*block.Size)); err != errBlockSizeMismatch {
+		t.Fatalf("expected block size mismatch; got %v", err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	v, err := db.Get(NewQuery(topic).WithLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, v) {
+		t.Fatalf("expected %d messages; got %d", len(vals), len(v))
+	}
+	if report, err := db.Verify(); err != nil || !report.OK() {
+		t.Fatalf("expected DB of blocks of %d bytes to verify; got %+v, %v", block.MinSize, report, err)
+	}
+}
+
+func TestChunkedValues(t *testing.T) {
+	cleanup()
+	oldKey := []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
+	newKey := []byte("kbO0sBNsFjmAPXtrXjcLeT4ZfYZMTwNw")
+	opts := []Options{WithMutable(), WithEncryption(), WithEncryptionKey(oldKey)}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit16.chunks")
+	r := rand.New(rand.NewSource(1))
+	var ids, vals [][]byte
+	for i := 0; i < 8; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if i%2 == 0 {
+			val = make([]byte, i*block.ChunkSize+100)
+			r.Read(val)
+		}
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, val).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append([][]byte{id}, ids...)
+		vals = append([][]byte{val}, vals...)
+	}
+	// Reopen DB to sync entries from the log.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		v, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != len(vals) {
+			t.Fatalf("expected %d messages; got %d", len(vals), len(v))
+		}
+		for i := range v {
+			if !bytes.Equal(v[i], vals[i]) {
+				t.Fatalf("expected value %d of %d bytes; got %d bytes", i, len(vals[i]), len(v[i]))
+			}
+		}
+		if report, err := db.Verify(); err != nil || !report.OK() {
+			t.Fatalf("expected no issues; got %+v, %v", report, err)
+		}
+	}
+	check()
+
+	br, err := block.Open(fs.OS, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := br.ReadIndexBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunked int
+	for _, e := range b.Entries[:b.EntryIdx] {
+		m, err := br.ReadMessage(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Value) != int(e.ValueSize) {
+			t.Fatalf("expected value of %d bytes; got %d bytes", e.ValueSize, len(m.Value))
+		}
+		if e.Chunked {
+			chunked++
+		}
+	}
+	br.Close()
+	if chunked != 3 {
+		t.Fatalf("expected 3 values stored in chunks; got %d", chunked)
+	}
+
+	// Chunks of values are re-encrypted in place.
+	if err := db.RotateKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Reencrypt(); err != nil || n != 8 {
+		t.Fatalf("expected 8 messages re-encrypted; got %d, %v", n, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts[2] = WithEncryptionKey(newKey)
+	db, err = Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	// Chunks of a deleted value are freed to reuse for new entries.
+	free := db.internal.freeList.freeSize()
+	if err := db.Delete(ids[1], topic); err != nil {
+		t.Fatal(err)
+	}
+	if freed := db.internal.freeList.freeSize() - free; freed < int64(len(vals[1])) {
+		t.Fatalf("expected chunks of %d bytes freed; got %d bytes", len(vals[1]), freed)
+	}
+	vals = append(vals[:1], vals[2:]...)
+	check()
+
+	// Compaction copies chunks of live values.
+	if err := db.Delete(ids[3], topic); err != nil {
+		t.Fatal(err)
+	}
+	vals = append(vals[:2], vals[3:]...)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestStreamValues(t *testing.T) {
+	for _, opts := range [][]Options{
+		{WithMutable(), WithCodec("none"), WithDeflateDictionaries(10)},
+		{WithMutable(), WithEncryption(), WithEncryptionKey([]byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")), WithCompressionMinSize(64)},
+	} {
+		cleanup()
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topic := []byte("unit17.stream")
+		payload := func(i int) []byte {
+			return []byte(fmt.Sprintf(`{"device":"sensor-%03d","temperature":%d.%d,"status":"ok"}`, i%7, 20+i%5, i%10))
+		}
+		headers := map[string][]byte{"type": []byte("json"), "": []byte("x")}
+		var vals [][]byte
+		for i := 0; i < 12; i++ {
+			val := payload(i)
+			if i >= 10 {
+				// Large values are stored in chunks.
+				val = bytes.Repeat(val, 2*block.ChunkSize/len(val))
+			}
+			e := NewEntry(topic, val)
+			e.Headers = headers
+			if err := db.PutEntry(e); err != nil {
+				t.Fatal(err)
+			}
+			vals = append([][]byte{val}, vals...)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := db.GetMessages(NewQuery(topic).WithLimit(20).WithStreamValues())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != len(vals) {
+			t.Fatalf("expected %d messages; got %d", len(vals), len(msgs))
+		}
+		for i, m := range msgs {
+			if m.Payload != nil || !reflect.DeepEqual(m.Headers, headers) {
+				t.Fatalf("expected streamed message with headers %v; got payload of %d bytes, headers %v", headers, len(m.Payload), m.Headers)
+			}
+			// Each reader reads the payload from its start.
+			for j := 0; j < 2; j++ {
+				val, err := io.ReadAll(m.ValueReader())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(val, vals[i]) {
+					t.Fatalf("expected value %d of %d bytes; got %d bytes", i, len(vals[i]), len(val))
+				}
+			}
+		}
+		v, err := db.Get(NewQuery(topic).WithLimit(20).WithStreamValues())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, vals) {
+			t.Fatalf("expected values read whole by Get")
+		}
+		m, err := db.GetMessages(NewQuery(topic).WithID(msgs[0].ID).WithStreamValues())
+		if err != nil || len(m) != 1 {
+			t.Fatalf("expected message of the ID; got %d, %v", len(m), err)
+		}
+		if val, err := io.ReadAll(m[0].ValueReader()); err != nil || !bytes.Equal(val, vals[0]) {
+			t.Fatalf("expected value of the ID; got %d bytes, %v", len(val), err)
+		}
+		if m, err = db.GetMessages(NewQuery(topic).WithLimit(20).WithStreamValues().WithFilter(PayloadPrefix(payload(11)))); err != nil || len(m) != 1 {
+			t.Fatalf("expected message matching the payload prefix; got %d, %v", len(m), err)
+		}
+		// Payload of a message read without StreamValues is read by the reader.
+		if m, err = db.GetMessages(NewQuery(topic).WithLimit(1)); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := io.ReadAll(m[0].ValueReader()); err != nil || !bytes.Equal(val, m[0].Payload) {
+			t.Fatalf("expected payload; got %d bytes, %v", len(val), err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConsumerOffsets(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit18.orders")
+	if _, err := db.Offset("billing", topic); err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range []string{"", "billing.eu", "billing*", "billing?ttl=1m"} {
+		if err := db.CommitOffset(group, topic, 1); !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("expected %v on group %q; got %v", ErrBadRequest, group, err)
+		}
+	}
+	for i := 1; i <= maxOffsetCommits+10; i++ {
+		if err := db.CommitOffset("billing", topic, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CommitOffset("shipping", topic, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CommitOffset("billing", []byte("unit18.*"), 9); err != nil {
+		t.Fatal(err)
+	}
+	check := func(group string, topic []byte, want uint64) {
+		seq, err := db.Offset(group, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != want {
+			t.Fatalf("expected offset %d of group %s in topic %s; got %d", want, group, topic, seq)
+		}
+	}
+	check("billing", topic, maxOffsetCommits+10)
+	check("shipping", topic, 7)
+	check("billing", []byte("unit18.*"), 9)
+	check("billing", []byte("unit18.returns"), 0)
+
+	// Older offsets are deleted once the group commits maxOffsetCommits offsets.
+	ot, err := offsetTopic("billing", topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQuery(ot).WithContract(SystemContract).WithLimit(maxOffsetCommits)
+	q.internal.trusted = true
+	if items, err := db.Get(q); err != nil || len(items) != 11 {
+		t.Fatalf("expected 11 offsets; got %d, %v", len(items), err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(q); err != nil || len(items) != 1 {
+		t.Fatalf("expected offsets collapsed on compaction; got %d, %v", len(items), err)
+	}
+
+	// Offsets are read after the DB is reopened.
+	if err := db.CommitOffset("billing", topic, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("billing", topic, 3)
+	check("shipping", topic, 7)
+}
+
+func TestConsumerGroups(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithAckTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit19.jobs")
+	if _, err := db.SubscribeGroup("", topic, 0, ""); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on empty group; got %v", ErrBadRequest, err)
+	}
+	a, err := db.SubscribeGroup("workers", topic, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.SubscribeGroup("workers", topic, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.Subscribe(topic, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	receive := func(s *Subscription, n int) []Message {
+		var msgs []Message
+		for len(msgs) < n {
+			select {
+			case m := <-s.C():
+				msgs = append(msgs, m)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("expected %d messages; got %d", n, len(msgs))
+			}
+		}
+		return msgs
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("job.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(sub, 10)
+	// Members of a group take turns receiving messages.
+	delivered := make(map[string]bool)
+	ofA, ofB := receive(a, 5), receive(b, 5)
+	for _, m := range append(ofA, ofB...) {
+		if delivered[string(m.Payload)] {
+			t.Fatalf("message %s delivered to more than one member", m.Payload)
+		}
+		delivered[string(m.Payload)] = true
+	}
+	for _, m := range ofA {
+		if err := a.Ack(m.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sub.Ack(ofA[0].ID); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on ack of a subscription without a group; got %v", ErrBadRequest, err)
+	}
+	if err := a.Ack(ofB[0].ID); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected %v on ack of a message delivered to another member; got %v", ErrBadRequest, err)
+	}
+
+	// Messages of a closed member are redelivered to other members.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(msgs []Message) {
+		for i, m := range msgs {
+			if !bytes.Equal(m.Payload, ofB[i].Payload) {
+				t.Fatalf("expected redelivered message %s; got %s", ofB[i].Payload, m.Payload)
+			}
+		}
+	}
+	check(receive(a, 5))
+	// Messages not acknowledged in time are redelivered.
+	redelivered := receive(a, 5)
+	check(redelivered)
+	for _, m := range redelivered {
+		if err := a.Ack(m.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	// Drain messages redelivered before these are acknowledged.
+	for len(a.C()) > 0 {
+		<-a.C()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := len(a.C()); n != 0 {
+		t.Fatalf("expected acknowledged messages not to be redelivered; got %d", n)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastValueCache(t *testing.T) {
+	cleanup()
+	opts := []Options{WithMutable(), WithLastValueCache()}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := []byte("unit20.a"), []byte("unit20.b")
+	if _, err := db.Last(a, 0, ""); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected %v on topic without messages; got %v", ErrMessageNotFound, err)
+	}
+	if _, err := db.Last([]byte("unit20..."), 0, ""); !errors.Is(err, ErrTopicInvalid) {
+		t.Fatalf("expected %v on wildcard topic; got %v", ErrTopicInvalid, err)
+	}
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(a, []byte(fmt.Sprintf("a.%d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Put(b, []byte("b.0")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(topic []byte, want string) {
+		t.Helper()
+		m, err := db.Last(topic, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Payload) != want || string(m.Topic) != string(topic) {
+			t.Fatalf("expected last message %s of topic %s; got %s of topic %s", want, topic, m.Payload, m.Topic)
+		}
+	}
+	check(a, "a.2")
+	check(b, "b.0")
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(a, []byte("a.3"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check(a, "a.3")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check(a, "a.3")
+
+	// The previous message is returned once the last message is deleted.
+	m, err := db.Last(a, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(m.ID, a); err != nil {
+		t.Fatal(err)
+	}
+	check(a, "a.2")
+
+	// New subscriptions first receive the last message of each topic.
+	sub, err := db.Subscribe([]byte("unit20..."), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for len(got) < 2 {
+		select {
+		case m := <-sub.C():
+			got = append(got, string(m.Payload))
+		case <-time.After(time.Second):
+			t.Fatalf("expected last messages of topics; got %v", got)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"a.2", "b.0"}) {
+		t.Fatalf("expected last messages of topics; got %v", got)
+	}
+	sub.Close()
+
+	// Messages are looked up once the DB is reopened, or if it is opened without the cache.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]Options{opts, {WithMutable()}} {
+		if db, err = Open(dbPath, opts...); err != nil {
+			t.Fatal(err)
+		}
+		check(a, "a.2")
+		check(b, "b.0")
+		if err := db.Close(); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -0,0 +1,309 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// maxDictionarySize is the size of the deflate window, content of a dictionary before the window is not matched.
+	maxDictionarySize = 32 << 10
+
+	// dictionaryHeaderSize is the size of a dictionary record header, i.e. topic hash, dictionary ID and size of the dictionary.
+	dictionaryHeaderSize = 16
+
+	// defaultDictionarySamples is the number of payloads sampled by DB.TrainDictionary if compression dictionaries
+	// are not trained by the DB, see WithDeflateDictionaries.
+	defaultDictionarySamples = 100
+)
+
+type (
+	_Dictionary struct {
+		id      uint32
+		data    []byte
+		writers sync.Pool // deflate writers reset to the dictionary.
+	}
+	// _Dictionaries holds compression dictionaries of topics and payloads sampled to train these.
+	// Dictionaries are appended to the dictionary file and kept once replaced, as messages compressed
+	// with a dictionary are decompressed with it.
+	_Dictionaries struct {
+		mu      sync.RWMutex
+		fsys    fs.FileSystem
+		dirName string
+		size    int64
+		ids     map[uint32]*_Dictionary
+		topics  map[uint64]*_Dictionary // most recent dictionary of the topic.
+		samples map[uint64][][]byte
+	}
+)
+
+func dictionaryPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.dict", prefix))
+}
+
+// openDictionaries reads dictionaries from the DB directory. A partially written record
+// at the end of the file is discarded.
+func openDictionaries(fsys fs.FileSystem, dirName string) (*_Dictionaries, error) {
+	d := &_Dictionaries{fsys: fsys, dirName: dirName, ids: make(map[uint32]*_Dictionary), topics: make(map[uint64]*_Dictionary), samples: make(map[uint64][][]byte)}
+	data, err := fs.ReadFile(fsys, dictionaryPath(dirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	for len(data) >= dictionaryHeaderSize {
+		n := int(binary.LittleEndian.Uint32(data[12:16]))
+		if len(data) < dictionaryHeaderSize+n {
+			break
+		}
+		dict := newDictionary(binary.LittleEndian.Uint32(data[8:12]), data[dictionaryHeaderSize:dictionaryHeaderSize+n])
+		d.ids[dict.id] = dict
+		d.topics[binary.LittleEndian.Uint64(data[:8])] = dict
+		d.size += int64(dictionaryHeaderSize + n)
+		data = data[dictionaryHeaderSize+n:]
+	}
+	return d, nil
+}
+
+func newDictionary(id uint32, data []byte) *_Dictionary {
+	dict := &_Dictionary{id: id, data: data}
+	dict.writers.New = func() interface{} {
+		w, _ := flate.NewWriterDict(nil, flate.BestCompression, dict.data)
+		return w
+	}
+	return dict
+}
+
+// trainDictionary builds a dictionary from payloads. Deflate matches a payload against the dictionary
+// as against preceding data, so the dictionary holds distinct payloads, the most frequent payloads last
+// as these are nearest to the payload, up to the size of the deflate window.
+func trainDictionary(payloads [][]byte) []byte {
+	counts := make(map[string]int, len(payloads))
+	var distinct []string
+	for _, p := range payloads {
+		if counts[string(p)] == 0 {
+			distinct = append(distinct, string(p))
+		}
+		counts[string(p)]++
+	}
+	sort.SliceStable(distinct, func(i, j int) bool {
+		return counts[distinct[i]] < counts[distinct[j]]
+	})
+	var dict []byte
+	for _, p := range distinct {
+		dict = append(dict, p...)
+	}
+	if len(dict) > maxDictionarySize {
+		dict = dict[len(dict)-maxDictionarySize:]
+	}
+	return dict
+}
+
+// add appends the dictionary of the topic to the dictionary file and syncs it, so a dictionary
+// is not lost once messages are compressed with it. Caller must hold the lock.
+func (d *_Dictionaries) add(topicHash uint64, data []byte) error {
+	name := dictionaryPath(d.dirName)
+	created := !fs.Exists(d.fsys, name)
+	f, err := d.fsys.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	id := uint32(len(d.ids) + 1)
+	rec := make([]byte, dictionaryHeaderSize+len(data))
+	binary.LittleEndian.PutUint64(rec[:8], topicHash)
+	binary.LittleEndian.PutUint32(rec[8:12], id)
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(data)))
+	copy(rec[dictionaryHeaderSize:], data)
+	// Discard a partially written record.
+	if err := f.Truncate(d.size); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(rec, d.size); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if created {
+		if err := syncDir(d.fsys, d.dirName); err != nil {
+			return err
+		}
+	}
+	d.size += int64(len(rec))
+	dict := newDictionary(id, rec[dictionaryHeaderSize:])
+	d.ids[id] = dict
+	d.topics[topicHash] = dict
+	delete(d.samples, topicHash)
+	return nil
+}
+
+// set trains a dictionary of the topic from the payloads.
+func (d *_Dictionaries) set(topicHash uint64, payloads [][]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.add(topicHash, trainDictionary(payloads))
+}
+
+// sample adds the payload to samples of a topic without a dictionary, and trains
+// the dictionary of the topic once the topic has the number of samples.
+func (d *_Dictionaries) sample(topicHash uint64, payload []byte, samples int) error {
+	d.mu.RLock()
+	_, ok := d.topics[topicHash]
+	d.mu.RUnlock()
+	if ok {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.topics[topicHash]; ok {
+		return nil
+	}
+	d.samples[topicHash] = append(d.samples[topicHash], append([]byte(nil), payload...))
+	if len(d.samples[topicHash]) < samples {
+		return nil
+	}
+	return d.add(topicHash, trainDictionary(d.samples[topicHash]))
+}
+
+// compress compresses the payload with the dictionary of the topic. It returns false if the topic
+// does not have a dictionary or the payload does not compress with it.
+func (d *_Dictionaries) compress(topicHash uint64, payload []byte) (uint32, []byte, bool) {
+	d.mu.RLock()
+	dict, ok := d.topics[topicHash]
+	d.mu.RUnlock()
+	if !ok {
+		return 0, nil, false
+	}
+	var buf bytes.Buffer
+	w := dict.writers.Get().(*flate.Writer)
+	defer dict.writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return 0, nil, false
+	}
+	if err := w.Close(); err != nil {
+		return 0, nil, false
+	}
+	if buf.Len() >= len(payload) {
+		return 0, nil, false
+	}
+	return dict.id, buf.Bytes(), true
+}
+
+// dictionary returns data of the dictionary of the ID.
+func (d *_Dictionaries) dictionary(id uint64) ([]byte, error) {
+	d.mu.RLock()
+	dict, ok := d.ids[uint32(id)]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, errDictionaryNotFound
+	}
+	return dict.data, nil
+}
+
+// compressPayload compresses the payload of the entry with the dictionary of its topic. It returns the payload
+// prefixed with the ID of the dictionary and true if the payload is compressed, and whether to sample the payload
+// if the DB trains dictionaries.
+func (db *DB) compressPayload(e *Entry) ([]byte, bool, bool) {
+	dicts := db.internal.plugins.dictionaries
+	id, payload, ok := dicts.compress(e.entry.topicHash, e.Payload)
+	if !ok {
+		return e.Payload, false, db.opts.dictionarySamples > 0
+	}
+	return append(appendUvarint(nil, uint64(id)), payload...), true, false
+}
+
+// readDictionaryID reads ID of the dictionary the payload is compressed with from the start of the payload,
+// it returns the dictionary and the size of the ID.
+func readDictionaryID(dicts *_Dictionaries, payload []byte) ([]byte, int, error) {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, 0, errDictionaryNotFound
+	}
+	dict, err := dicts.dictionary(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dict, n, nil
+}
+
+// decompressPayload decompresses the payload compressed with a dictionary.
+func decompressPayload(dicts *_Dictionaries, payload []byte) ([]byte, error) {
+	dict, n, err := readDictionaryID(dicts, payload)
+	if err != nil {
+		return nil, err
+	}
+	r := flate.NewReaderDict(bytes.NewReader(payload[n:]), dict)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errDictionaryNotFound
+	}
+	return data, nil
+}
+
+// TrainDictionary trains a compression dictionary of the topic from its most recent messages, payloads written
+// to the topic later are compressed with the dictionary. It replaces the dictionary of the topic, messages
+// compressed with a replaced dictionary are still read. Use zero contract for the master contract.
+func (db *DB) TrainDictionary(topic []byte, contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return err
+	}
+	if t.TopicType != message.TopicStatic {
+		return errTopicNotStatic
+	}
+	t.AddContract(contract)
+	samples := db.opts.dictionarySamples
+	if samples == 0 {
+		samples = defaultDictionarySamples
+	}
+	q := NewQuery(topic).WithContract(contract).WithLimit(samples)
+	q.internal.trusted = true
+	payloads, err := db.Get(q)
+	if err != nil {
+		return err
+	}
+	if len(payloads) == 0 {
+		return errDictionaryNoSamples
+	}
+	// Messages are returned newest first, the most recent payloads are placed last in the dictionary.
+	for i, j := 0, len(payloads)-1; i < j; i, j = i+1, j-1 {
+		payloads[i], payloads[j] = payloads[j], payloads[i]
+	}
+	return db.internal.plugins.dictionaries.set(t.GetHash(contract), payloads)
+}
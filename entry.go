@@ -35,17 +35,24 @@ type (
 		expiresAt uint32 // expiresAt for recovery from log and not persisted to index file but persisted to the time window file.
 
 		parsed    bool
+		trusted   bool   // trusted entries are written by the DB and not checked against access keys.
+		withTopic bool   // withTopic packs topic into the entry even if the topic exists.
+		newTopic  bool   // newTopic records name of the topic once the entry is committed.
+		sample    bool   // sample samples the payload to train a dictionary once the entry is committed.
 		topicHash uint64 // topicHash for recovery from log and not persisted to the DB.
 		cache     []byte // entry from memdb if it exist.
 	}
 	// Entry entry is a message entry structure.
 	Entry struct {
 		entry      _Entry
-		ID         []byte // The ID of the message.
-		Topic      []byte // The topic of the message.
-		Payload    []byte // The payload of the message.
-		ExpiresAt  uint32 // The time expiry of the message.
-		Contract   uint32 // The contract is used to as salt to hash topic parts and also used as prefix in the message ID.
+		ID         []byte            // The ID of the message.
+		Topic      []byte            // The topic of the message.
+		Payload    []byte            // The payload of the message.
+		ExpiresAt  uint32            // The time expiry of the message in unix seconds, it takes precedence over TTL.
+		TTL        time.Duration     // The time to live of the message, it takes precedence over TTL of the topic.
+		Headers    map[string][]byte // The metadata of the message stored with the payload, such as content type or trace ID.
+		Contract   uint32            // The contract is used to as salt to hash topic parts and also used as prefix in the message ID.
+		AccessKey  string            // The access key granting write access to the topic, see DB.NewAccessKey.
 		Encryption bool
 	}
 )
@@ -88,6 +95,12 @@ func (e *Entry) WithTTL(ttl string) *Entry {
 	return e
 }
 
+// WithAccessKey sets access key on entry.
+func (e *Entry) WithAccessKey(key string) *Entry {
+	e.AccessKey = key
+	return e
+}
+
 // WithEncryption sets encryption on entry.
 func (e *Entry) WithEncryption() *Entry {
 	e.Encryption = true
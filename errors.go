@@ -20,26 +20,144 @@ import (
 	"errors"
 )
 
+// Errors returned by the DB are or wrap one of these errors, use errors.Is to check for these.
+// ErrTopicInvalid, ErrMessageIDRequired, ErrMessageIDInvalid and ErrValueInvalid wrap ErrBadRequest.
 var (
-	errTopicEmpty          = errors.New("Topic is empty")
-	errMsgIDEmpty          = errors.New("Message ID is empty")
-	errMsgIDDeleted        = errors.New("Message ID is deleted")
-	errMsgIDDoesNotExist   = errors.New("Message ID does not exist in database")
-	errMsgIDPrefixMismatch = errors.New("Message ID does not match topic or Contract")
-	errTtlTooLarge         = errors.New("TTL is too large")
-	errTopicTooLarge       = errors.New("Topic is too large")
-	errMsgExpired          = errors.New("Message has expired")
-	errValueEmpty          = errors.New("Payload is empty")
-	errValueTooLarge       = errors.New("value is too large")
+	// ErrTopicInvalid is returned if a topic is empty, too large or cannot be used by the operation.
+	ErrTopicInvalid = newError(ErrBadRequest, "topic is invalid")
+
+	// ErrMessageIDRequired is returned if an operation requires a message ID and none is given.
+	ErrMessageIDRequired = newError(ErrBadRequest, "message ID is required")
+
+	// ErrMessageIDInvalid is returned if a message ID is malformed or does not match the topic or contract.
+	ErrMessageIDInvalid = newError(ErrBadRequest, "message ID is invalid")
+
+	// ErrMessageNotFound is returned if a message does not exist, is deleted or has expired.
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrValueInvalid is returned if a payload is empty or too large.
+	ErrValueInvalid = newError(ErrBadRequest, "payload is invalid")
+
+	// ErrBatchClosed is returned if a batch or transaction is used after it is committed or aborted.
+	ErrBatchClosed = errors.New("batch is closed")
+
+	// ErrCorrupted is returned if a file of the DB is corrupted.
+	ErrCorrupted = errors.New("database is corrupted")
+
+	// ErrClosed is returned if the DB is used after it is closed.
+	ErrClosed = errors.New("database is closed")
+
+	// ErrLocked is returned by Open if the DB is opened by another process.
+	ErrLocked = errors.New("database is locked")
+
+	// ErrImmutable is returned on delete if the DB is not opened with WithMutable.
+	ErrImmutable = errors.New("database is immutable")
+
+	// ErrQuotaExceeded is returned if a write exceeds the quota of the contract.
+	ErrQuotaExceeded = errors.New("quota of the contract is exceeded")
+
+	// ErrWriteConflict is returned by a batch writing an entry written by another batch, see WithBatchConflict.
+	ErrWriteConflict = errors.New("batch write conflict")
+
+	// ErrBadRequest is returned if a request is invalid.
+	ErrBadRequest = errors.New("The request was invalid or cannot be otherwise served")
+
+	// ErrForbidden is returned if a request is refused.
+	ErrForbidden = errors.New("The request is understood, but it has been refused or access is not allowed")
+)
+
+var (
+	errTopicEmpty          = newError(ErrTopicInvalid, "Topic is empty")
+	errTopicTooLarge       = newError(ErrTopicInvalid, "Topic is too large")
+	errTopicNotStatic      = newError(ErrTopicInvalid, "wildcard topic is not supported")
+	errTopicSingleLevel    = newError(ErrTopicInvalid, "single-level wildcard is only supported to query or subscribe")
+	errMsgIDEmpty          = newError(ErrMessageIDRequired, "Message ID is empty")
+	errMsgIDSize           = newError(ErrMessageIDInvalid, "Message ID size is invalid")
+	errMsgIDPrefixMismatch = newError(ErrMessageIDInvalid, "Message ID does not match topic or Contract")
+	errMsgIDDeleted        = newError(ErrMessageNotFound, "Message ID is deleted")
+	errMsgIDDoesNotExist   = newError(ErrMessageNotFound, "Message ID does not exist in database")
+	errMsgExpired          = newError(ErrMessageNotFound, "Message has expired")
+	errTopicNoMessages     = newError(ErrMessageNotFound, "topic has no messages")
+	errValueEmpty          = newError(ErrValueInvalid, "Payload is empty")
+	errValueTooLarge       = newError(ErrValueInvalid, "value is too large")
+	errTtlTooLarge         = newError(ErrBadRequest, "TTL is too large")
+	errTtlNegative         = newError(ErrBadRequest, "TTL is negative")
+	errHeadersTooLarge     = newError(ErrBadRequest, "headers are too large")
+	errHeadersInvalid      = newError(ErrCorrupted, "message headers are corrupted")
+	errContractDeleted     = newError(ErrForbidden, "contract is deleted")
+	errContractNotFound    = newError(ErrBadRequest, "contract does not exist")
+	errContractMaster      = newError(ErrBadRequest, "master contract cannot be deleted")
+	errContractKeyNotSet   = newError(ErrForbidden, "encryption key of the contract is not set")
+	errMsgShredded         = newError(ErrMessageNotFound, "encryption key of the message is deleted")
+	errAccessInvalid       = newError(ErrBadRequest, "access is invalid")
+	errAccessKeyInvalid    = newError(ErrForbidden, "access key is invalid")
+	errAccessKeyExpired    = newError(ErrForbidden, "access key has expired")
+	errAccessKeyRevoked    = newError(ErrForbidden, "access key is revoked")
+	errAccessKeyRequired   = newError(ErrForbidden, "access key is required")
+	errAccessDenied        = newError(ErrForbidden, "access key does not grant access to the topic")
+	errAggregationInvalid  = newError(ErrBadRequest, "aggregation is invalid")
+	errBucketTooSmall      = newError(ErrBadRequest, "aggregation bucket is less than a second")
+	errRollupInvalid       = newError(ErrBadRequest, "rollup prefix, raw age or interval is invalid")
+	errGroupInvalid        = newError(ErrBadRequest, "consumer group name is invalid")
+	errAckInvalid          = newError(ErrBadRequest, "message is not pending acknowledgment by the subscription")
+	errDictionaryNoSamples = newError(ErrBadRequest, "topic has no messages to train a dictionary")
+	errDictionaryNotFound  = newError(ErrCorrupted, "compression dictionary of the message is missing")
+	errTxDone              = newError(ErrBatchClosed, "transaction is already committed or rolled back")
+	errVersion             = newError(ErrCorrupted, "database file format version is not supported")
+	errFilterCorrupted     = newError(ErrCorrupted, "filter file is missing or corrupted")
+	errRecordInvalid       = newError(ErrCorrupted, "replicated batch record is invalid")
 	errEntryInvalid        = errors.New("entry is invalid")
 	errEntryExist          = errors.New("entry exist in database")
-	errImmutable           = errors.New("database is immutable")
 	errFull                = errors.New("database is full")
-	errCorrupted           = errors.New("database is corrupted")
-	errLocked              = errors.New("database is locked")
-	errClosed              = errors.New("database is closed")
+	errTooManyTopics       = errors.New("too many topics")
+	errNotMonotonic        = errors.New("entry is older than the newest entry of the topic")
+	errBadEncryptionKey    = errors.New("encryption key is invalid")
+	errKeyVersion          = errors.New("encryption key version is invalid")
+	errCustomCipher        = errors.New("encryption keys are managed by the custom cipher")
+	errPluginNotRegistered = errors.New("plugin is not registered")
+	errPluginMismatch      = errors.New("plugin does not match plugin the database was created with")
+	errBlockSizeMismatch   = errors.New("block size does not match block size the database was created with")
 	errBatchSeqComplete    = errors.New("batch seq is complete")
-	errWriteConflict       = errors.New("batch write conflict")
-	errBadRequest          = errors.New("The request was invalid or cannot be otherwise served")
-	errForbidden           = errors.New("The request is understood, but it has been refused or access is not allowed")
+	errNoLogArchive        = errors.New("log archive is not set")
+	errNoTieredStorage     = errors.New("tiered storage is not set")
+	errReplicatedImport    = errors.New("import is not supported in replicated mode")
+	errCursorInvalid       = errors.New("query cursor is invalid")
 )
+
+// _Error is an error of the DB with a specific message wrapping one of the exported errors.
+type _Error struct {
+	err error
+	msg string
+}
+
+func newError(err error, msg string) error {
+	return &_Error{err: err, msg: msg}
+}
+
+func (e *_Error) Error() string {
+	return e.msg
+}
+
+func (e *_Error) Unwrap() error {
+	return e.err
+}
+
+// ErrBatchFull is returned when an entry is added to a batch that has reached its size limit,
+// see WithBatchMaxBytes and WithBatchMaxEntries. Write the batch before adding more entries.
+var ErrBatchFull = errors.New("batch is full")
+
+// ErrInvalidOptions is returned by Open if an option is out of range, the error returned describes
+// the option. Use errors.Is to check for it.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// ErrDrainTimeout is returned by Close if puts or batch commits are still in progress once the
+// drain timeout is reached, see WithDrainTimeout. The DB is closed and these writes may be lost.
+var ErrDrainTimeout = errors.New("close timed out draining writes in progress")
+
+// ErrRateLimited is returned when a write exceeds the rate limit of the DB or of the contract of the write,
+// see WithRateLimit and Quota. Retry the write later.
+var ErrRateLimited = errors.New("write rate limit is exceeded")
+
+// ErrWriteStall is returned when a write stalls on a full memdb for longer than the write stall timeout,
+// see WithMaxMemdbSize and WithWriteStallTimeout.
+var ErrWriteStall = errors.New("write stalled on full memdb")
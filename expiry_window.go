@@ -93,11 +93,11 @@ func (wb *_ExpiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEnt
 		return expiredEntries
 	}
 
-	for i := 0; i < wb.maxExpDurations; i++ {
-		// get windows shard.
-		ws := wb.expiryWindows.expiry[i]
+	for _, ws := range wb.expiryWindows.expiry {
+		if len(expiredEntries) > maxResults {
+			break
+		}
 		ws.mu.Lock()
-		defer ws.mu.Unlock()
 		windowTimes := make([]int64, 0, len(ws.windows))
 		for windowTime := range ws.windows {
 			windowTimes = append(windowTimes, windowTime)
@@ -108,18 +108,22 @@ func (wb *_ExpiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEnt
 				break
 			}
 			windowEntries := ws.windows[windowTimes[i]]
-			expiredEntriesCount := 0
+			var pendingEntries _ExpiryWindowEntries
 			for i := range windowEntries {
 				entry := windowEntries[i]
 				if entry.expiryTime() < startTime {
 					expiredEntries = append(expiredEntries, entry)
-					expiredEntriesCount++
+					continue
 				}
+				pendingEntries = append(pendingEntries, entry)
 			}
-			if expiredEntriesCount == len(windowEntries) {
+			if len(pendingEntries) == 0 {
 				delete(ws.windows, windowTimes[i])
+				continue
 			}
+			ws.windows[windowTimes[i]] = pendingEntries
 		}
+		ws.mu.Unlock()
 	}
 	atomic.StoreInt64(&wb.earliestExpiryHash, 0)
 	return expiredEntries
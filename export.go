@@ -0,0 +1,280 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+// ExportFormat is the encoding of entries written by DB.Export.
+type ExportFormat uint8
+
+const (
+	// ExportNDJSON writes an entry per line as a JSON object.
+	ExportNDJSON ExportFormat = iota
+	// ExportJSON writes entries as a JSON array.
+	ExportJSON
+	// ExportCSV writes a header row followed by a row per entry, ID and payload are base64 encoded.
+	ExportCSV
+)
+
+// ExportRecord is an entry written by DB.Export. ID, payload and header values are base64 encoded in JSON,
+// headers are not written in CSV.
+type ExportRecord struct {
+	Topic     string            `json:"topic"`
+	ID        []byte            `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Payload   []byte            `json:"payload"`
+	Headers   map[string][]byte `json:"headers,omitempty"`
+}
+
+var exportCSVHeader = []string{"topic", "id", "timestamp", "payload"}
+
+type _ExportWriter interface {
+	write(r ExportRecord) error
+	close() error
+}
+
+// exportChunk is the number of entries read by Export while the DB is locked, entries read are
+// written once the DB is unlocked, so a slow writer does not block writes and compaction of the DB.
+const exportChunk = 1000
+
+// Export writes entries matching the query to w in the format, oldest entry first.
+// A query without a limit exports all entries matching the query, entries are looked up in pages
+// from the newest entry and read and written in chunks of entries, so the DB is not locked while w is written.
+// Deleted and expired entries are not exported, and the filter of the query is applied to entries within the limit.
+func (db *DB) Export(w io.Writer, q *Query, format ExportFormat) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case len(q.Topic) == 0:
+		return errTopicEmpty
+	case len(q.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	ew, err := newExportWriter(w, format)
+	if err != nil {
+		return err
+	}
+	q.internal.opts = &_QueryOptions{maxQueryLimit: math.MaxInt32}
+	if err := q.parse(); err != nil {
+		return err
+	}
+	if !q.internal.trusted {
+		if err := db.checkAccess(q.AccessKey, q.Contract, q.Topic, AccessRead); err != nil {
+			return err
+		}
+	}
+	entries, err := db.exportEntries(q)
+	if err != nil {
+		return err
+	}
+	var count int64
+	for end := len(entries); end > 0; end -= exportChunk {
+		start := end - exportChunk
+		if start < 0 {
+			start = 0
+		}
+		records, err := db.exportRecords(q, entries[start:end])
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := ew.write(r); err != nil {
+				return err
+			}
+		}
+		count += int64(len(records))
+	}
+	db.internal.meter.OutMsgs.Inc(count)
+	return ew.close()
+}
+
+// exportEntries looks up entries of the query up to its limit in pages of entries, newest entry first.
+// A page continues from the oldest entry of the previous page, and the DB is unlocked between pages.
+func (db *DB) exportEntries(q *Query) ([]_Query, error) {
+	limit := q.Limit
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	var entries []_Query
+	for {
+		q.Limit = exportChunk
+		if limit > 0 && limit-len(entries) < exportChunk {
+			q.Limit = limit - len(entries)
+		}
+		q.internal.winEntries = q.internal.winEntries[:0]
+		mu.RLock()
+		db.internal.compactLock.RLock()
+		err := db.lookup(q)
+		db.internal.compactLock.RUnlock()
+		mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		page := q.internal.winEntries
+		sort.Slice(page, func(i, j int) bool {
+			return page[i].seq > page[j].seq
+		})
+		// Entries are looked up to the limit from each topic of the query.
+		more := len(page) >= q.Limit
+		if more {
+			page = page[:q.Limit]
+		}
+		entries = append(entries, page...)
+		if !more || len(entries) == limit {
+			break
+		}
+		q.internal.before = page[len(page)-1].seq
+	}
+	q.Limit = limit
+	return entries, nil
+}
+
+// exportRecords reads records of the entries, sorted newest entry first, while the DB is locked.
+// It returns the records oldest entry first.
+func (db *DB) exportRecords(q *Query, entries []_Query) ([]ExportRecord, error) {
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	records := make([]ExportRecord, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		wq := entries[i]
+		if wq.seq == 0 {
+			continue
+		}
+		e, err := db.readEntry(wq)
+		if err != nil {
+			if err == errMsgIDDeleted || err == errEntryInvalid {
+				continue
+			}
+			return nil, err
+		}
+		id, val, err := db.internal.reader.readMessage(e)
+		if err != nil {
+			return nil, err
+		}
+		if !message.ID(id).EvalPrefix(q.Contract, q.internal.cutoff) {
+			continue
+		}
+		m, err := db.storedMessage(wq.seq, wq.topicHash, 0, id, val)
+		if err == errMsgShredded {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if q.Filter != nil && !q.Filter(&m) {
+			continue
+		}
+		records = append(records, ExportRecord{
+			Topic:     string(m.Topic),
+			ID:        m.ID,
+			Timestamp: time.Unix(uid.Time(id[0:4]), 0).UTC(),
+			Payload:   m.Payload,
+			Headers:   m.Headers,
+		})
+	}
+	return records, nil
+}
+
+func newExportWriter(w io.Writer, format ExportFormat) (_ExportWriter, error) {
+	switch format {
+	case ExportNDJSON:
+		return &_NDJSONWriter{enc: json.NewEncoder(w)}, nil
+	case ExportJSON:
+		return &_JSONWriter{w: w}, nil
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return nil, err
+		}
+		return &_CSVWriter{w: cw}, nil
+	}
+	return nil, ErrBadRequest
+}
+
+type (
+	_NDJSONWriter struct {
+		enc *json.Encoder
+	}
+	_JSONWriter struct {
+		w     io.Writer
+		count int
+	}
+	_CSVWriter struct {
+		w *csv.Writer
+	}
+)
+
+func (w *_NDJSONWriter) write(r ExportRecord) error {
+	return w.enc.Encode(r)
+}
+
+func (w *_NDJSONWriter) close() error {
+	return nil
+}
+
+func (w *_JSONWriter) write(r ExportRecord) error {
+	sep := ","
+	if w.count == 0 {
+		sep = "["
+	}
+	w.count++
+	if _, err := io.WriteString(w.w, sep); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(data)
+	return err
+}
+
+func (w *_JSONWriter) close() error {
+	end := "]\n"
+	if w.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(w.w, end)
+	return err
+}
+
+func (w *_CSVWriter) write(r ExportRecord) error {
+	return w.w.Write([]string{
+		r.Topic,
+		base64.StdEncoding.EncodeToString(r.ID),
+		r.Timestamp.Format(time.RFC3339),
+		base64.StdEncoding.EncodeToString(r.Payload),
+	})
+}
+
+func (w *_CSVWriter) close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
@@ -23,6 +23,9 @@ import (
 	"os"
 	"path"
 	"sync"
+
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/fs"
 )
 
 // _FileType represent a file type.
@@ -36,8 +39,9 @@ const (
 	typeData
 	typeLease
 	typeFilter
+	typeValueLog
 
-	typeAll = typeInfo | typeTimeWindow | typeIndex | typeData | typeLease | typeFilter
+	typeAll = typeInfo | typeTimeWindow | typeIndex | typeData | typeLease | typeFilter | typeValueLog
 
 	prefix   = "unitdb"
 	indexDir = "index"
@@ -45,24 +49,35 @@ const (
 	winDir   = "window"
 )
 
+// String returns name of the file type.
+func (ft _FileType) String() string {
+	switch ft {
+	case typeInfo:
+		return "info"
+	case typeTimeWindow:
+		return "window"
+	case typeIndex:
+		return "index"
+	case typeData:
+		return "data"
+	case typeLease:
+		return "lease"
+	case typeFilter:
+		return "filter"
+	case typeValueLog:
+		return "vlog"
+	default:
+		return "unknown"
+	}
+}
+
 // _FileDesc is a 'file descriptor'.
 type _FileDesc struct {
 	fileType _FileType
 	num      int16
-	fd       uintptr
 }
 
 func filePath(dirName string, fd _FileDesc) string {
-	name := fmt.Sprintf("%#x-%d", fd.fileType, fd.num)
-	if err := ensureDir(path.Join(dirName, indexDir)); err != nil {
-		return name
-	}
-	if err := ensureDir(path.Join(dirName, dataDir)); err != nil {
-		return name
-	}
-	if err := ensureDir(path.Join(dirName, winDir)); err != nil {
-		return name
-	}
 	switch fd.fileType {
 	case typeInfo:
 		suffix := fmt.Sprintf("%s.info", prefix)
@@ -82,11 +97,19 @@ func filePath(dirName string, fd _FileDesc) string {
 	case typeFilter:
 		suffix := fmt.Sprintf("%s.filter", prefix)
 		return path.Join(dirName, suffix)
+	case typeValueLog:
+		suffix := fmt.Sprintf("%s%04d.vlog", prefix, fd.num)
+		return path.Join(dirName, dataDir, suffix)
 	default:
 		return fmt.Sprintf("%#x-%d", fd.fileType, fd.num)
 	}
 }
 
+// fileDir returns the directory holding files of the given type.
+func fileDir(dirName string, fileType _FileType) string {
+	return path.Dir(filePath(dirName, _FileDesc{fileType: fileType}))
+}
+
 // _LockFile represents a lock file.
 type _LockFile interface {
 	unlock() error
@@ -94,9 +117,13 @@ type _LockFile interface {
 
 type (
 	_File struct {
-		*os.File
-		fd   _FileDesc
-		size int64
+		fs.File
+		fd    _FileDesc
+		size  int64
+		sched *_IOScheduler
+		cache *_BlockCache
+		// layout is the block size of the index and window files, see block.Layout.
+		layout block.Layout
 	}
 	_FileSet struct {
 		mu *sync.RWMutex
@@ -108,33 +135,82 @@ type (
 )
 
 // createLockFile to create lock file.
-func createLockFile(dirName string) (_LockFile, error) {
-	if err := ensureDir(dirName); err != nil {
+func createLockFile(fsys fs.FileSystem, dirName string) (_LockFile, error) {
+	if err := fsys.MkdirAll(dirName, 0777); err != nil {
 		return nil, err
 	}
 	suffix := fmt.Sprintf("%s.lock", prefix)
+	if !fs.IsOS(fsys) {
+		return newFsLockFile(fsys, path.Join(dirName, suffix))
+	}
 
 	return newLockFile(path.Join(dirName, suffix))
 }
 
-func newFile(path string, nFiles int16, fd _FileDesc) (_FileSet, error) {
+// _FsLockFile locks a DB stored on a file system other than the OS file system by exclusively
+// creating the lock file. The lock file is left behind if the process exits without closing the DB.
+type _FsLockFile struct {
+	fsys fs.FileSystem
+	f    fs.File
+	name string
+}
+
+func newFsLockFile(fsys fs.FileSystem, name string) (_LockFile, error) {
+	f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		if os.IsExist(err) {
+			err = os.ErrExist
+		}
+		return nil, err
+	}
+	return &_FsLockFile{fsys: fsys, f: f, name: name}, nil
+}
+
+// unlock removes the lock file.
+func (fl *_FsLockFile) unlock() error {
+	if err := fl.fsys.Remove(fl.name); err != nil {
+		return err
+	}
+	return fl.f.Close()
+}
+
+// syncDir syncs the given directories so the entries created or renamed in these are durable.
+func syncDir(fsys fs.FileSystem, dirs ...string) error {
+	for _, dir := range dirs {
+		if err := fs.SyncDir(fsys, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newFile(fsys fs.FileSystem, dirName string, nFiles int16, fd _FileDesc) (_FileSet, error) {
 	if nFiles == 0 {
 		return _FileSet{}, errors.New("no new file")
 	}
 	fileFlag := os.O_CREATE | os.O_RDWR
 	fileMode := os.FileMode(0666)
-	f := _File{}
+	f := _File{layout: block.DefaultLayout}
 	fs := _FileSet{mu: new(sync.RWMutex), fileMap: make(map[int16]_File, nFiles)}
 	for i := int16(0); i < nFiles; i++ {
 		fd.num = i
-		path := filePath(path, fd)
-		fi, err := os.OpenFile(path, fileFlag, fileMode)
+		name := filePath(dirName, fd)
+		if err := fsys.MkdirAll(path.Dir(name), 0777); err != nil {
+			return fs, err
+		}
+		_, err := fsys.Stat(name)
+		created := os.IsNotExist(err)
+		fi, err := fsys.OpenFile(name, fileFlag, fileMode)
 		if err != nil {
 			return fs, err
 		}
+		// Sync the parent directories so the new file survives a power loss.
+		if created {
+			if err := syncDir(fsys, path.Dir(name), dirName); err != nil {
+				return fs, err
+			}
+		}
 		f.File = fi
-
-		fd.fd = fi.Fd()
 		f.fd = fd
 		stat, err := fi.Stat()
 		if err != nil {
@@ -148,6 +224,9 @@ func newFile(path string, nFiles int16, fd _FileDesc) (_FileSet, error) {
 }
 
 func (f *_File) truncate(size int64) error {
+	if f.cache != nil {
+		defer f.cache.invalidateFrom(f.fd.fileType, size)
+	}
 	if err := f.Truncate(size); err != nil {
 		return err
 	}
@@ -227,6 +306,63 @@ func (fs *_FileSet) getFile(fd _FileDesc) (*_File, error) {
 	return &_File{}, errors.New("file not found")
 }
 
+// setLayout sets the block layout of the files of the file types in the file set.
+func (fs *_FileSet) setLayout(layout block.Layout, fileTypes ..._FileType) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, files := range fs.list {
+		for _, ft := range fileTypes {
+			if files.fd.fileType != ft {
+				continue
+			}
+			files._File.layout = layout
+			for num, f := range files.fileMap {
+				f.layout = layout
+				files.fileMap[num] = f
+			}
+		}
+	}
+}
+
+// replaceFile replaces the file on disk with the file at the given path and reopens it.
+// The *_File is updated in place so the readers and writers holding it use the new file.
+func (fs *_FileSet) replaceFile(fsys fs.FileSystem, dirName string, fd _FileDesc, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, fileset := range fs.list {
+		if fileset.fd.fileType != fd.fileType || fileset.fd.num != fd.num {
+			continue
+		}
+		f := fileset._File
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fileName := filePath(dirName, fd)
+		renameErr := fsys.Rename(name, fileName)
+		if renameErr == nil {
+			renameErr = syncDir(fsys, path.Dir(fileName))
+		}
+		fi, err := fsys.OpenFile(fileName, os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+		if err != nil {
+			return err
+		}
+		stat, err := fi.Stat()
+		if err != nil {
+			return err
+		}
+		f.File = fi
+		f.size = stat.Size()
+		if f.cache != nil {
+			f.cache.invalidateFrom(fd.fileType, 0)
+		}
+		fileset.fileMap[fd.num] = *f
+		return renameErr
+	}
+	return errors.New("file not found")
+}
+
+// sync syncs the files of the file set. Files of the list are synced in reverse order, so data
+// is synced before the index and the info file referring to it.
 func (fs *_FileSet) sync() error {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
@@ -235,6 +371,13 @@ func (fs *_FileSet) sync() error {
 			return err
 		}
 	}
+	for i := len(fs.list) - 1; i >= 0; i-- {
+		for _, f := range fs.list[i].fileMap {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -245,9 +388,27 @@ func (fs *_FileSet) size() (int64, error) {
 	for _, f := range fs.fileMap {
 		size += f.currSize()
 	}
+	for _, files := range fs.list {
+		for _, f := range files.fileMap {
+			size += f.currSize()
+		}
+	}
 	return size, nil
 }
 
+// sizes returns size of the files by file type.
+func (fs *_FileSet) sizes() map[_FileType]int64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	sizes := make(map[_FileType]int64)
+	for _, files := range fs.list {
+		for _, f := range files.fileMap {
+			sizes[files.fd.fileType] += f.currSize()
+		}
+	}
+	return sizes
+}
+
 func (fs *_FileSet) close() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -260,12 +421,3 @@ func (fs *_FileSet) close() error {
 	}
 	return nil
 }
-
-func ensureDir(dirName string) error {
-	err := os.Mkdir(dirName, 0777)
-	if err == nil || os.IsExist(err) {
-		return nil
-	} else {
-		return err
-	}
-}
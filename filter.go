@@ -17,71 +17,472 @@
 package unitdb
 
 import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/unit-io/unitdb/filter"
-	"github.com/unit-io/unitdb/memdb"
 )
 
-// Filter filter is bloom filter generator.
+// FilterRepair sets how a missing or corrupted filter file is handled when the DB is opened.
+type FilterRepair uint8
+
+const (
+	// FilterRebuild rebuilds the filter from index blocks.
+	FilterRebuild FilterRepair = iota
+	// FilterFail fails to open the DB.
+	FilterFail
+	// FilterSkip opens the DB without the filter, so lookups and deletes read index blocks
+	// of every entry. The filter is not written until it is rebuilt.
+	FilterSkip
+	// FilterRebuildLazy opens the DB without waiting for the filter and rebuilds the filter from
+	// index blocks in the background. Lookups and deletes read index blocks until the rebuild completes.
+	FilterRebuildLazy
+)
+
+const (
+	// filterProgressBlocks is the number of index blocks read between progress messages of a filter rebuild.
+	filterProgressBlocks = 1 << 12
+
+	// filterGenerationSize is the number of entries appended to a filter generation before a new
+	// generation is started, it keeps the false positive rate of a generation near 1%.
+	filterGenerationSize = 1 << 14
+
+	// filterHeaderSize is the size of the header of a generation in the filter file, the first and
+	// last seq, the number of entries, the expiry and the checksum of the header.
+	filterHeaderSize = 32
+
+	// neverExpires is the expiry of a generation holding an entry without TTL.
+	neverExpires = math.MaxUint32
+)
+
+// Filter filter is bloom filter generator. Entries are appended to generations of bloom filters,
+// each generation covers the range of seqs of its entries. Once all entries of a generation have
+// expired, the generation is dropped, so the false positive rate does not grow over the DB lifetime.
 type Filter struct {
-	file        _FileSet
-	filterBlock *filter.Generator
-	blockCache  *memdb.DB
-	cacheID     uint64
+	mu   sync.RWMutex
+	file _FileSet
+
+	// generations are ordered from the oldest generation, entries are appended to the last generation.
+	generations []*_FilterGeneration
+	// dirty is the first generation changed since the filter was written.
+	dirty int
+
+	// bits and hashes are the number of bits and hashes of the filter block of a generation.
+	bits, hashes uint64
+
+	// skip is set if the filter is not loaded, Test then reports any entry may exist.
+	skip int32
+
+	// epoch is incremented when the filter is changed, a view
+	// of the filter is read at most once per epoch.
+	epoch uint64
+	view  atomic.Value // *_FilterView
 }
 
-// Append appends an entry to bloom filter.
-func (f *Filter) Append(h uint64) {
-	f.filterBlock.Append(h)
+// _FilterGeneration is a bloom filter of a range of seqs.
+type _FilterGeneration struct {
+	minSeq, maxSeq uint64
+	count          uint64
+	// expiresAt is expiry of the entry expiring last.
+	expiresAt    uint32
+	bits, hashes uint64
+	block        *filter.Generator
 }
 
-// Test tests entry in bloom filter. It returns false if entry definitely does not exist or true may be entry exist in DB.
-func (f *Filter) Test(h uint64) bool {
-	/// Test filter block for presence.
-	fltr, _ := f.getFilterBlock(true)
-	if fltr != nil && !fltr.Test(h) {
-		return false
+// _FilterView is an immutable view of the filter read at an epoch. Tests use a view, so these
+// do not observe the filter while entries are appended.
+type _FilterView struct {
+	epoch       uint64
+	generations []_FilterGenerationView
+}
+
+type _FilterGenerationView struct {
+	minSeq, maxSeq uint64
+	count          uint64
+	block          *filter.Block
+}
+
+func newFilterGeneration(bits, hashes uint64) *_FilterGeneration {
+	return &_FilterGeneration{minSeq: math.MaxUint64, bits: bits, hashes: hashes, block: filter.NewFilterGeneratorSize(bits, hashes)}
+}
+
+func (g *_FilterGeneration) append(seq uint64, expiresAt uint32) {
+	g.block.Append(seq)
+	if seq < g.minSeq {
+		g.minSeq = seq
 	}
-	return true
+	if seq > g.maxSeq {
+		g.maxSeq = seq
+	}
+	if expiresAt == 0 {
+		expiresAt = neverExpires
+	}
+	if expiresAt > g.expiresAt {
+		g.expiresAt = expiresAt
+	}
+	g.count++
 }
 
-// Close finalizes writing filter to file.
-func (f *Filter) close() error {
-	f.writeFilterBlock()
-	if err := f.file.Close(); err != nil {
+// MarshalBinary serializes the generation header and the filter block.
+func (g *_FilterGeneration) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, filterHeaderSize, filterHeaderSize+filter.BlockSizeOf(g.bits, g.hashes))
+	binary.LittleEndian.PutUint64(buf[0:8], g.minSeq)
+	binary.LittleEndian.PutUint64(buf[8:16], g.maxSeq)
+	binary.LittleEndian.PutUint64(buf[16:24], g.count)
+	binary.LittleEndian.PutUint32(buf[24:28], g.expiresAt)
+	binary.LittleEndian.PutUint32(buf[28:32], crc32.Checksum(buf[:28], filterCRCTable))
+	return append(buf, g.block.Finish()...), nil
+}
+
+// UnmarshalBinary de-serializes the generation header and the filter block.
+func (g *_FilterGeneration) UnmarshalBinary(data []byte) error {
+	if len(data) != filterHeaderSize+filter.BlockSizeOf(g.bits, g.hashes) {
+		return filter.ErrCorrupted
+	}
+	if crc32.Checksum(data[:28], filterCRCTable) != binary.LittleEndian.Uint32(data[28:32]) {
+		return filter.ErrCorrupted
+	}
+	block, err := filter.NewFilterGeneratorFromBlockSize(data[filterHeaderSize:], g.bits, g.hashes)
+	if err != nil {
 		return err
 	}
+	g.minSeq = binary.LittleEndian.Uint64(data[0:8])
+	g.maxSeq = binary.LittleEndian.Uint64(data[8:16])
+	g.count = binary.LittleEndian.Uint64(data[16:24])
+	g.expiresAt = binary.LittleEndian.Uint32(data[24:28])
+	g.block = block
 	return nil
 }
 
-// writeFilterBlock writes the filter block.
+var filterCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// params returns the number of bits and hashes of the filter block of a generation.
+func (f *Filter) params() (bits, hashes uint64) {
+	if f.bits == 0 || f.hashes == 0 {
+		return filter.DefaultBits, filter.DefaultHashes
+	}
+	return f.bits, f.hashes
+}
+
+// generationSize returns size in bytes of a generation in the filter file.
+func (f *Filter) generationSize() int64 {
+	return int64(filterHeaderSize + filter.BlockSizeOf(f.params()))
+}
+
+// skipped returns true if the filter is not loaded.
+func (f *Filter) skipped() bool {
+	return atomic.LoadInt32(&f.skip) == 1
+}
+
+// size returns size in bytes of the filter generations held in memory.
+func (f *Filter) size() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return int64(len(f.generations)) * f.generationSize()
+}
+
+// Append appends an entry with its expiry to bloom filter, zero expiry is used for an entry without TTL.
+func (f *Filter) Append(seq uint64, expiresAt uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.generations)
+	if n == 0 || f.generations[n-1].count >= filterGenerationSize {
+		f.generations = append(f.generations, newFilterGeneration(f.params()))
+		n++
+	}
+	f.generations[n-1].append(seq, expiresAt)
+	if f.dirty > n-1 {
+		f.dirty = n - 1
+	}
+	atomic.AddUint64(&f.epoch, 1)
+}
+
+// Test tests entry in bloom filter. It returns false if entry definitely does not exist or true may be entry exist in DB.
+func (f *Filter) Test(seq uint64) bool {
+	if f.skipped() {
+		return true
+	}
+	for _, g := range f.snapshot().generations {
+		if seq >= g.minSeq && seq <= g.maxSeq && g.block.Test(seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if a generation of the filter covers the seq. A seq not covered was
+// either never appended or its generation has expired and was dropped.
+func (f *Filter) covers(seq uint64) bool {
+	if f.skipped() {
+		return true
+	}
+	for _, g := range f.snapshot().generations {
+		if seq >= g.minSeq && seq <= g.maxSeq {
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops generations with all entries expired before now, except the generation entries
+// are appended to. It returns the number of generations dropped.
+func (f *Filter) expire(now uint32) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.generations)
+	if n < 2 {
+		return 0
+	}
+	generations := f.generations[:0]
+	for i, g := range f.generations {
+		if i < n-1 && g.expiresAt < now {
+			continue
+		}
+		generations = append(generations, g)
+	}
+	for i := len(generations); i < n; i++ {
+		f.generations[i] = nil
+	}
+	f.generations = generations
+	dropped := n - len(generations)
+	if dropped > 0 {
+		f.dirty = 0
+		atomic.AddUint64(&f.epoch, 1)
+	}
+	return dropped
+}
+
+// reset drops all generations of the filter.
+func (f *Filter) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generations = nil
+	f.dirty = 0
+	atomic.AddUint64(&f.epoch, 1)
+}
+
+// writeFilterBlock writes the generations changed since the filter was written.
 func (f *Filter) writeFilterBlock() error {
-	d := f.filterBlock.Finish()
-	if _, err := f.file.WriteAt(d, 0); err != nil {
-		return err
+	if f.skipped() {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size := f.generationSize()
+	for i := f.dirty; i < len(f.generations); i++ {
+		if err := f.file.writeMarshalableAt(f.generations[i], int64(i)*size); err != nil {
+			return err
+		}
 	}
+	if n := int64(len(f.generations)) * size; f.file.currSize() > n {
+		if err := f.file.truncate(n); err != nil {
+			return err
+		}
+	}
+	if n := len(f.generations); n > 0 {
+		f.dirty = n - 1
+	}
+	return nil
+}
 
+// snapshot returns the view of the filter at the current epoch. Generations before the last
+// generation are not appended to, so only the filter block of the last generation is copied.
+func (f *Filter) snapshot() *_FilterView {
+	epoch := atomic.LoadUint64(&f.epoch)
+	v, _ := f.view.Load().(*_FilterView)
+	if v != nil && v.epoch == epoch {
+		return v
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	bits, hashes := f.params()
+	view := &_FilterView{epoch: epoch, generations: make([]_FilterGenerationView, len(f.generations))}
+	for i, g := range f.generations {
+		gv := _FilterGenerationView{minSeq: g.minSeq, maxSeq: g.maxSeq, count: g.count}
+		if prev := v.find(gv); i < len(f.generations)-1 && prev != nil {
+			gv.block = prev.block
+		} else {
+			gv.block = filter.NewFilterBlockSize(g.block.Bytes(), bits, hashes)
+		}
+		view.generations[i] = gv
+	}
+	f.view.Store(view)
+	return view
+}
+
+// find returns the generation of the view with the same range of seqs and number of entries.
+func (v *_FilterView) find(gv _FilterGenerationView) *_FilterGenerationView {
+	if v == nil {
+		return nil
+	}
+	for i := range v.generations {
+		if v.generations[i].minSeq == gv.minSeq && v.generations[i].maxSeq == gv.maxSeq && v.generations[i].count == gv.count {
+			return &v.generations[i]
+		}
+	}
 	return nil
 }
 
-func (f *Filter) getFilterBlock(fillCache bool) (*filter.Block, error) {
-	if f.file.currSize() <= 0 {
-		return nil, nil
+// load reads generations of the filter from the filter file. It returns false if the filter
+// file is missing or corrupted, or if it was written with other number of bits or hashes.
+func (f *Filter) load() (bool, error) {
+	size := f.generationSize()
+	bits, hashes := f.params()
+	fileSize := f.file.currSize()
+	if fileSize == 0 || fileSize%size != 0 {
+		return false, nil
 	}
-	var cacheKey uint64
-	if f.blockCache != nil {
-		cacheKey = f.cacheID ^ uint64(f.file.currSize())
-		if data, err := f.blockCache.Get(cacheKey); data != nil {
-			return filter.NewFilterBlock(data), err
+	var generations []*_FilterGeneration
+	for off := int64(0); off < fileSize; off += size {
+		g := &_FilterGeneration{bits: bits, hashes: hashes}
+		if err := f.file.readUnmarshalableAt(g, uint32(size), off); err != nil {
+			if err == filter.ErrCorrupted {
+				return false, nil
+			}
+			return false, err
 		}
+		generations = append(generations, g)
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generations = generations
+	f.dirty = len(generations) - 1
+	atomic.AddUint64(&f.epoch, 1)
+	return true, nil
+}
 
-	raw := make([]byte, f.file.currSize())
-	if _, err := f.file.ReadAt(raw, 0); err != nil {
-		return nil, err
+// loadFilter loads the filter when the DB is opened. A missing or corrupted filter
+// is rebuilt from index blocks unless the filter repair option is set otherwise.
+func (db *DB) loadFilter() error {
+	f := &db.internal.filter
+	ok, err := f.load()
+	if err != nil || ok {
+		return err
+	}
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
 	}
+	// A new DB has no filter block yet.
+	if f.file.currSize() == 0 && indexFile.currSize() == 0 {
+		return nil
+	}
+	switch db.opts.filterRepair {
+	case FilterFail:
+		return errFilterCorrupted
+	case FilterSkip:
+		db.internal.logger.Warn().Str("context", "db.loadFilter").Msg("filter is missing or corrupted, opening without filter")
+		atomic.StoreInt32(&f.skip, 1)
+		return nil
+	case FilterRebuildLazy:
+		db.internal.logger.Warn().Str("context", "db.loadFilter").Msg("filter is missing or corrupted, rebuilding filter in the background")
+		atomic.StoreInt32(&f.skip, 1)
+		f.reset()
+		// Entries synced during the rebuild are appended to the filter by the sync.
+		nIndexBlocks := int32(indexFile.currSize() / indexFile.blockSize())
+		db.internal.closeW.Add(1)
+		go func() {
+			defer db.internal.closeW.Done()
+			db.rebuildFilterLazy(nIndexBlocks)
+		}()
+		return nil
+	}
+	return db.rebuildFilter(indexFile)
+}
 
-	if f.blockCache != nil && fillCache {
-		f.blockCache.Put(cacheKey, raw)
+// rebuildFilter appends entries of index blocks to a new filter and writes the filter block.
+func (db *DB) rebuildFilter(indexFile *_File) (err error) {
+	run := db.internal.runHistory.startRun(RunFilterRebuild)
+	defer func() {
+		run.finish(err)
+	}()
+
+	f := &db.internal.filter
+	f.reset()
+	nIndexBlocks := int32(indexFile.currSize() / indexFile.blockSize())
+	db.internal.logger.Info().Str("context", "db.rebuildFilter").Int32("blocks", nIndexBlocks).Msg("rebuilding filter from index blocks")
+	start := time.Now()
+	var count int64
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		r := _BlockReader{indexFile: indexFile, offset: indexFile.blockOffset(bIdx)}
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		for _, e := range b.entries[:b.entryIdx] {
+			if e.seq == 0 || e.isDeleted() {
+				continue
+			}
+			// Expiry of entries is not in index blocks, so generations rebuilt are not dropped.
+			f.Append(e.seq, 0)
+			count++
+		}
+		if (bIdx+1)%filterProgressBlocks == 0 {
+			db.internal.logger.Info().Str("context", "db.rebuildFilter").Int32("blocks", bIdx+1).Int32("total", nIndexBlocks).Msg("rebuilding filter")
+		}
+	}
+	if err := f.writeFilterBlock(); err != nil {
+		return err
+	}
+	db.internal.logger.Info().Str("context", "db.rebuildFilter").Int64("entries", count).Dur("duration", time.Since(start)).Msg("filter rebuilt")
+	return nil
+}
+
+// rebuildFilterLazy appends entries of index blocks to the filter while the DB is open. Index blocks
+// are read under the compaction lock, so a compaction swapping in the index file waits for the read.
+// The filter is used and written once all index blocks are read, the rebuild is abandoned if the DB is closed.
+func (db *DB) rebuildFilterLazy(nIndexBlocks int32) {
+	var err error
+	run := db.internal.runHistory.startRun(RunFilterRebuild)
+	defer func() {
+		run.finish(err)
+	}()
+
+	f := &db.internal.filter
+	start := time.Now()
+	var count int64
+	readIndexBlock := func(bIdx int32) (_IndexBlock, error) {
+		db.internal.compactLock.RLock()
+		defer db.internal.compactLock.RUnlock()
+		indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+		if err != nil {
+			return _IndexBlock{}, err
+		}
+		r := _BlockReader{indexFile: indexFile, offset: indexFile.blockOffset(bIdx)}
+		return r.readIndexBlock()
+	}
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		select {
+		case <-db.internal.closeC:
+			err = ErrClosed
+			return
+		default:
+		}
+		var b _IndexBlock
+		b, err = readIndexBlock(bIdx)
+		if err != nil {
+			db.internal.logger.Error().Err(err).Str("context", "db.rebuildFilterLazy").Msg("error rebuilding filter")
+			return
+		}
+		for _, e := range b.entries[:b.entryIdx] {
+			if e.seq == 0 || e.isDeleted() {
+				continue
+			}
+			f.Append(e.seq, 0)
+			count++
+		}
+		if (bIdx+1)%filterProgressBlocks == 0 {
+			db.internal.logger.Info().Str("context", "db.rebuildFilterLazy").Int32("blocks", bIdx+1).Int32("total", nIndexBlocks).Msg("rebuilding filter")
+		}
+	}
+	atomic.StoreInt32(&f.skip, 0)
+	if err = f.writeFilterBlock(); err != nil {
+		db.internal.logger.Error().Err(err).Str("context", "db.rebuildFilterLazy").Msg("error writing filter")
+		return
 	}
-	return filter.NewFilterBlock(raw), nil
+	db.internal.logger.Info().Str("context", "db.rebuildFilterLazy").Int64("entries", count).Dur("duration", time.Since(start)).Msg("filter rebuilt")
 }
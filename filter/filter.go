@@ -1,10 +1,34 @@
 package filter
 
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
 const (
-	bloomHashes uint64 = 7
-	bloomBits   uint64 = 160000
+	// DefaultHashes is the default number of hashes of a filter block.
+	DefaultHashes uint64 = 7
+	// DefaultBits is the default number of bits of a filter block.
+	DefaultBits uint64 = 160000
+
+	// checksumSize is the size of the CRC32 checksum appended to a finished filter block.
+	checksumSize = 4
+
+	// BlockSize is the size of a finished filter block, the hash keys and bits followed by the checksum.
+	BlockSize = int(DefaultHashes+(DefaultBits+63)/64)*8 + checksumSize
 )
 
+// BlockSizeOf returns the size of a finished filter block of m bits and k hashes.
+func BlockSizeOf(m, k uint64) int {
+	return int(k+(m+63)/64)*8 + checksumSize
+}
+
+// ErrCorrupted is returned if a filter block is truncated or its checksum does not match.
+var ErrCorrupted = errors.New("filter block is corrupted")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // Generator bloom filter generator.
 type Generator struct {
 	filter *Filter
@@ -12,7 +36,32 @@ type Generator struct {
 
 // NewFilterGenerator returns a new filter generator.
 func NewFilterGenerator() *Generator {
-	return &Generator{filter: newFilter(bloomBits, bloomHashes)}
+	return NewFilterGeneratorSize(DefaultBits, DefaultHashes)
+}
+
+// NewFilterGeneratorSize returns a new filter generator of m bits and k hashes.
+func NewFilterGeneratorSize(m, k uint64) *Generator {
+	return &Generator{filter: newFilter(m, k)}
+}
+
+// NewFilterGeneratorFromBlock returns a filter generator holding keys of a filter block
+// returned by Finish, so keys are appended to the filter block.
+func NewFilterGeneratorFromBlock(b []byte) (*Generator, error) {
+	return NewFilterGeneratorFromBlockSize(b, DefaultBits, DefaultHashes)
+}
+
+// NewFilterGeneratorFromBlockSize returns a filter generator holding keys of a filter block of
+// m bits and k hashes. A block finished with other sizes is reported as corrupted.
+func NewFilterGeneratorFromBlockSize(b []byte, m, k uint64) (*Generator, error) {
+	size := BlockSizeOf(m, k)
+	if len(b) != size {
+		return nil, ErrCorrupted
+	}
+	data := b[:size-checksumSize]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(b[size-checksumSize:]) {
+		return nil, ErrCorrupted
+	}
+	return &Generator{filter: newFilterFromBytes(data, m, k)}, nil
 }
 
 // Append adds a key to the filter block.
@@ -20,9 +69,12 @@ func (b *Generator) Append(h uint64) {
 	b.filter.Add(h)
 }
 
-// Finish finishes building the filter block and returns a slice to its contents.
+// Finish finishes building the filter block and returns a slice to its contents followed by its checksum.
 func (b *Generator) Finish() []byte {
-	return b.filter.Bytes()
+	data := b.filter.Bytes()
+	var sum [checksumSize]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(data, crcTable))
+	return append(data, sum[:]...)
 }
 
 // Bytes returns a slice to filter block contents.
@@ -37,8 +89,13 @@ type Block struct {
 
 // NewFilterBlock returns new filter block, it is used to test key presence in the filter.
 func NewFilterBlock(b []byte) *Block {
+	return NewFilterBlockSize(b, DefaultBits, DefaultHashes)
+}
+
+// NewFilterBlockSize returns new filter block of m bits and k hashes.
+func NewFilterBlockSize(b []byte, m, k uint64) *Block {
 	return &Block{
-		filter: newFilterFromBytes(b, bloomBits, bloomHashes),
+		filter: newFilterFromBytes(b, m, k),
 	}
 }
 
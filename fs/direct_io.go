@@ -0,0 +1,232 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"unsafe"
+)
+
+// directAlign is the alignment of offsets, sizes and memory of reads and writes of a file opened
+// with direct IO. It is the logical block size of most disks and file systems.
+const directAlign = 4096
+
+// DirectIO is a FileSystem of the operating system that opens files with direct IO, so reads and writes
+// of these files bypass the OS page cache. Use it for files written by large sequential syncs to leave
+// the page cache to files read by queries. Reads and writes go through aligned buffers, a write of part
+// of a block reads the block first. Files are opened with direct IO on Linux, on other platforms or if
+// the file system does not support direct IO files are accessed as with OS.
+type DirectIO struct {
+	_OSFileSystem
+	dirs []string
+}
+
+// NewDirectIO creates a FileSystem that opens files in directories with one of the names with direct IO,
+// for example NewDirectIO("data", "window"). Other files are accessed as with OS.
+func NewDirectIO(dirs ...string) *DirectIO {
+	return &DirectIO{dirs: dirs}
+}
+
+// OpenFile opens the named file as os.OpenFile, the file is opened with direct IO if its directory matches.
+func (d *DirectIO) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if directFlag == 0 || !d.match(name) {
+		return d._OSFileSystem.OpenFile(name, flag, perm)
+	}
+	// Files opened for writing only are read to write part of a block.
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := os.OpenFile(name, flag|directFlag, perm)
+	if err != nil {
+		// the file system does not support direct IO.
+		return d._OSFileSystem.OpenFile(name, flag, perm)
+	}
+	return newDirectFile(f, flag&os.O_APPEND != 0)
+}
+
+func (d *DirectIO) match(name string) bool {
+	dir := path.Base(path.Dir(name))
+	for _, m := range d.dirs {
+		if dir == m {
+			return true
+		}
+	}
+	return false
+}
+
+// _DirectFile is a file opened with direct IO. It tracks size of the file, as a write is
+// rounded up to the block size and the file is truncated to its size after the write.
+type _DirectFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	pos    int64
+	append bool
+}
+
+func newDirectFile(f *os.File, append bool) (File, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &_DirectFile{f: f, size: stat.Size(), append: append}, nil
+}
+
+// alignedBuffer returns a buffer of n bytes aligned to directAlign, n is a multiple of directAlign.
+func alignedBuffer(n int64) []byte {
+	buf := make([]byte, n+directAlign)
+	off := int64(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1))
+	if off != 0 {
+		off = directAlign - off
+	}
+	return buf[off : off+n]
+}
+
+// span returns the aligned offset and size of the blocks holding n bytes at off.
+func span(off, n int64) (int64, int64) {
+	start := off &^ (directAlign - 1)
+	end := (off + n + directAlign - 1) &^ (directAlign - 1)
+	return start, end - start
+}
+
+// readBlocks reads the blocks at off into buf, blocks beyond the end of the file are zeroed.
+func (df *_DirectFile) readBlocks(buf []byte, off int64) (int, error) {
+	n, err := df.f.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return n, err
+}
+
+func (df *_DirectFile) ReadAt(p []byte, off int64) (int, error) {
+	df.mu.Lock()
+	size := df.size
+	df.mu.Unlock()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if off+n > size {
+		n = size - off
+	}
+	start, length := span(off, n)
+	buf := alignedBuffer(length)
+	if _, err := df.readBlocks(buf, start); err != nil {
+		return 0, err
+	}
+	copy(p, buf[off-start:off-start+n])
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+func (df *_DirectFile) WriteAt(p []byte, off int64) (int, error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	return df.writeAt(p, off)
+}
+
+func (df *_DirectFile) writeAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start, length := span(off, int64(len(p)))
+	buf := alignedBuffer(length)
+	// Read the first and last blocks if the write covers part of these.
+	first := off != start && start < df.size
+	if first {
+		if _, err := df.readBlocks(buf[:directAlign], start); err != nil {
+			return 0, err
+		}
+	}
+	last := start + length - directAlign
+	if (off+int64(len(p)))%directAlign != 0 && last < df.size && !(first && last == start) {
+		if _, err := df.readBlocks(buf[length-directAlign:], last); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	if _, err := df.f.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > df.size {
+		df.size = end
+	}
+	// Drop the padding of the last block written beyond the end of the file.
+	if start+length > df.size {
+		if err := df.f.Truncate(df.size); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (df *_DirectFile) Read(p []byte) (int, error) {
+	df.mu.Lock()
+	off := df.pos
+	df.mu.Unlock()
+	n, err := df.ReadAt(p, off)
+	df.mu.Lock()
+	df.pos += int64(n)
+	df.mu.Unlock()
+	return n, err
+}
+
+func (df *_DirectFile) Write(p []byte) (int, error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if df.append {
+		df.pos = df.size
+	}
+	n, err := df.writeAt(p, df.pos)
+	df.pos += int64(n)
+	return n, err
+}
+
+func (df *_DirectFile) Truncate(size int64) error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if err := df.f.Truncate(size); err != nil {
+		return err
+	}
+	df.size = size
+	return nil
+}
+
+func (df *_DirectFile) Name() string {
+	return df.f.Name()
+}
+
+func (df *_DirectFile) Stat() (os.FileInfo, error) {
+	return df.f.Stat()
+}
+
+func (df *_DirectFile) Sync() error {
+	return df.f.Sync()
+}
+
+func (df *_DirectFile) Close() error {
+	return df.f.Close()
+}
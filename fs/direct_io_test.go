@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// TestDirectIO checks writes of parts of blocks and reads of a file opened with direct IO
+// against the same writes to a buffer.
+func TestDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "data"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	name := path.Join(dir, "data", "unitdb0000.data")
+	f, err := NewDirectIO("data").OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(*_DirectFile); !ok {
+		t.Skip("direct IO is not supported")
+	}
+
+	var want []byte
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		off := rnd.Int63n(3 * directAlign)
+		p := make([]byte, rnd.Intn(2*directAlign)+1)
+		rnd.Read(p)
+		if _, err := f.WriteAt(p, off); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + int64(len(p)); end > int64(len(want)) {
+			want = append(want, make([]byte, end-int64(len(want)))...)
+		}
+		copy(want[off:], p)
+	}
+	if _, err := f.Write([]byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	copy(want, "tail")
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(want)) {
+		t.Fatalf("expected size %d; got %d", len(want), stat.Size())
+	}
+	got := make([]byte, len(want)+10)
+	n, err := f.ReadAt(got, 0)
+	if n != len(want) || !bytes.Equal(got[:n], want) {
+		t.Fatalf("read %d bytes not matching the writes, err %v", n, err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatal("file not matching the writes")
+	}
+}
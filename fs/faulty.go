@@ -0,0 +1,400 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// ErrCrashed is returned by a Faulty file system once it crashed.
+var ErrCrashed = errors.New("file system crashed")
+
+// FaultMode sets how writes of a file not yet synced survive a crash of a Faulty file system.
+type FaultMode int
+
+const (
+	// FaultDrop drops all writes not yet synced.
+	FaultDrop FaultMode = iota
+	// FaultTruncate keeps a prefix of the writes not yet synced, the last write of the prefix is torn.
+	FaultTruncate
+	// FaultReorder keeps a random subset of the writes not yet synced, as if these reached the disk out of order.
+	FaultReorder
+)
+
+// FaultOptions sets the faults injected by a Faulty file system.
+type FaultOptions struct {
+	// Mode sets how writes not yet synced survive a crash.
+	Mode FaultMode
+
+	// Seed seeds the choice of writes kept and size of torn writes.
+	Seed int64
+}
+
+type (
+	// Faulty is a FileSystem simulating a power failure for crash consistency tests. It tracks writes
+	// and truncates of each file since the file was last synced, on a crash it reverts the writes not yet
+	// synced and keeps some of these as set by the FaultMode. Directory operations are durable once
+	// applied. Once crashed, writes, syncs and directory operations fail with ErrCrashed, open a new
+	// Faulty on the underlying file system to simulate the restart. It is safe for concurrent use.
+	Faulty struct {
+		mu         sync.Mutex
+		fsys       FileSystem
+		opts       FaultOptions
+		rand       *rand.Rand
+		ops        int
+		crashAfter int
+		crashed    bool
+		files      map[string][]_FaultyWrite
+	}
+
+	// _FaultyWrite is a write or truncate not yet synced. It holds the previous contents of the
+	// range written and the previous size of the file to revert it.
+	_FaultyWrite struct {
+		off      int64
+		data     []byte
+		truncate bool
+		old      []byte
+		oldSize  int64
+	}
+
+	// _FaultyHandle is an open file of the Faulty.
+	_FaultyHandle struct {
+		File
+		fs     *Faulty
+		name   string
+		append bool
+		off    int64
+	}
+)
+
+// NewFaulty wraps the file system to inject faults set by the opts.
+func NewFaulty(fsys FileSystem, opts FaultOptions) *Faulty {
+	return &Faulty{fsys: fsys, opts: opts, rand: rand.New(rand.NewSource(opts.Seed)), files: make(map[string][]_FaultyWrite)}
+}
+
+// Ops returns the number of writes, truncates and syncs applied.
+func (f *Faulty) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ops
+}
+
+// CrashAfter arms a crash on the write, truncate or sync that follows the next n of these,
+// the operation is not applied. Setting n to 0 disarms the crash.
+func (f *Faulty) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAfter = 0
+	if n > 0 {
+		f.crashAfter = f.ops + n
+	}
+}
+
+// Crashed reports whether the file system crashed.
+func (f *Faulty) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// Crash simulates a power failure, writes of files not yet synced are reverted as set by the FaultMode.
+func (f *Faulty) Crash() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crash()
+}
+
+// crash reverts writes not yet synced, caller must hold the lock.
+func (f *Faulty) crash() error {
+	if f.crashed {
+		return nil
+	}
+	f.crashed = true
+	for name, writes := range f.files {
+		if err := f.revert(name, writes); err != nil {
+			return err
+		}
+	}
+	f.files = nil
+	return nil
+}
+
+// revert undoes the writes of the file in reverse order and reapplies the writes kept.
+func (f *Faulty) revert(name string, writes []_FaultyWrite) error {
+	file, err := f.fsys.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	for i := len(writes) - 1; i >= 0; i-- {
+		w := writes[i]
+		if err := file.Truncate(w.oldSize); err != nil {
+			return err
+		}
+		if len(w.old) > 0 {
+			if _, err := file.WriteAt(w.old, w.off); err != nil {
+				return err
+			}
+		}
+	}
+	var kept []_FaultyWrite
+	switch f.opts.Mode {
+	case FaultTruncate:
+		n := f.rand.Intn(len(writes) + 1)
+		kept = writes[:n]
+		if n > 0 && !kept[n-1].truncate {
+			torn := kept[n-1]
+			torn.data = torn.data[:f.rand.Intn(len(torn.data)+1)]
+			kept = append(kept[:n-1:n-1], torn)
+		}
+	case FaultReorder:
+		for _, w := range writes {
+			if f.rand.Intn(2) == 0 {
+				kept = append(kept, w)
+			}
+		}
+	}
+	for _, w := range kept {
+		if w.truncate {
+			if err := file.Truncate(w.off); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := file.WriteAt(w.data, w.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// op counts a write, truncate or sync and crashes the file system once the crash armed by
+// CrashAfter is reached, caller must hold the lock.
+func (f *Faulty) op() error {
+	if f.crashed {
+		return ErrCrashed
+	}
+	f.ops++
+	if f.crashAfter > 0 && f.ops > f.crashAfter {
+		if err := f.crash(); err != nil {
+			return err
+		}
+		return ErrCrashed
+	}
+	return nil
+}
+
+// check returns ErrCrashed as a *os.PathError once the file system crashed, caller must hold the lock.
+func (f *Faulty) check(op, name string) error {
+	if f.crashed {
+		return &os.PathError{Op: op, Path: name, Err: ErrCrashed}
+	}
+	return nil
+}
+
+func (f *Faulty) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0
+	if write {
+		if err := f.check("open", name); err != nil {
+			return nil, err
+		}
+	}
+	if flag&os.O_WRONLY != 0 {
+		// The previous contents of a range are read before it is written.
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	if flag&os.O_TRUNC != 0 && Exists(f.fsys, name) {
+		// Truncate on open is tracked as a truncate of the file.
+		file, err := f.fsys.OpenFile(name, flag&^os.O_TRUNC, perm)
+		if err != nil {
+			return nil, err
+		}
+		h := &_FaultyHandle{File: file, fs: f, name: name, append: flag&os.O_APPEND != 0}
+		if err := h.truncate(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return h, nil
+	}
+	file, err := f.fsys.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &_FaultyHandle{File: file, fs: f, name: name, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (f *Faulty) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("remove", name); err != nil {
+		return err
+	}
+	if err := f.fsys.Remove(name); err != nil {
+		return err
+	}
+	delete(f.files, name)
+	return nil
+}
+
+func (f *Faulty) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrCrashed}
+	}
+	if err := f.fsys.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	delete(f.files, newpath)
+	if writes, ok := f.files[oldpath]; ok {
+		f.files[newpath] = writes
+		delete(f.files, oldpath)
+	}
+	return nil
+}
+
+func (f *Faulty) Stat(name string) (os.FileInfo, error) {
+	return f.fsys.Stat(name)
+}
+
+func (f *Faulty) MkdirAll(path string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("mkdir", path); err != nil {
+		return err
+	}
+	return f.fsys.MkdirAll(path, perm)
+}
+
+func (f *Faulty) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return f.fsys.ReadDir(dirname)
+}
+
+// SyncDir syncs the directory if the underlying file system implements DirSyncer.
+func (f *Faulty) SyncDir(dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("sync", dir); err != nil {
+		return err
+	}
+	return SyncDir(f.fsys, dir)
+}
+
+// track records a write of data at off, or a truncate to off if data is nil, with the previous
+// contents of the file. Caller must hold the lock of the Faulty.
+func (h *_FaultyHandle) track(off int64, data []byte, truncate bool) error {
+	stat, err := h.File.Stat()
+	if err != nil {
+		return err
+	}
+	w := _FaultyWrite{off: off, truncate: truncate, oldSize: stat.Size()}
+	end := off + int64(len(data))
+	if truncate {
+		end = stat.Size()
+	} else {
+		w.data = append([]byte(nil), data...)
+	}
+	if end > stat.Size() {
+		end = stat.Size()
+	}
+	if end > off {
+		w.old = make([]byte, end-off)
+		if _, err := h.File.ReadAt(w.old, off); err != nil {
+			return err
+		}
+	}
+	h.fs.files[h.name] = append(h.fs.files[h.name], w)
+	return nil
+}
+
+func (h *_FaultyHandle) Read(p []byte) (int, error) {
+	n, err := h.File.Read(p)
+	h.off += int64(n)
+	return n, err
+}
+
+func (h *_FaultyHandle) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.fs.op(); err != nil {
+		return 0, err
+	}
+	if h.append {
+		stat, err := h.File.Stat()
+		if err != nil {
+			return 0, err
+		}
+		h.off = stat.Size()
+	}
+	if err := h.track(h.off, p, false); err != nil {
+		return 0, err
+	}
+	n, err := h.File.Write(p)
+	h.off += int64(n)
+	return n, err
+}
+
+func (h *_FaultyHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.fs.op(); err != nil {
+		return 0, err
+	}
+	if err := h.track(off, p, false); err != nil {
+		return 0, err
+	}
+	return h.File.WriteAt(p, off)
+}
+
+func (h *_FaultyHandle) Truncate(size int64) error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	return h.truncate(size)
+}
+
+// truncate truncates the file, caller must hold the lock of the Faulty.
+func (h *_FaultyHandle) truncate(size int64) error {
+	if err := h.fs.op(); err != nil {
+		return err
+	}
+	if err := h.track(size, nil, true); err != nil {
+		return err
+	}
+	return h.File.Truncate(size)
+}
+
+// Sync syncs the file, the writes of the file survive a crash once it is synced.
+func (h *_FaultyHandle) Sync() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if err := h.fs.op(); err != nil {
+		return err
+	}
+	if err := h.File.Sync(); err != nil {
+		return err
+	}
+	delete(h.fs.files, h.name)
+	return nil
+}
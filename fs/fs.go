@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fs abstracts the file system the DB stores its files on, so the DB can also run
+// entirely in memory for tests and ephemeral stores, see Mem.
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// File is a file opened from a FileSystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	// Sync commits contents of the file to stable storage. Files of the OS are synced
+	// using fsync, F_FULLFSYNC on macOS and FlushFileBuffers on Windows.
+	Sync() error
+	Truncate(size int64) error
+}
+
+// DirSyncer is implemented by a FileSystem which syncs directories, see SyncDir.
+type DirSyncer interface {
+	// SyncDir commits entries of the named directory to stable storage.
+	SyncDir(name string) error
+}
+
+// FileSystem opens and manages files by name. Errors are reported as *os.PathError
+// so these can be checked using os.IsNotExist and os.IsExist.
+type FileSystem interface {
+	// OpenFile opens the named file with the flag and perm, as os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+
+	// Rename renames oldpath to newpath, replacing newpath if it exists.
+	Rename(oldpath, newpath string) error
+
+	// Stat returns file info of the named file or directory.
+	Stat(name string) (os.FileInfo, error)
+
+	// MkdirAll creates a directory and any parents not yet existing.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// ReadDir returns file info of the directory entries sorted by name.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// OS is the FileSystem of the operating system.
+var OS FileSystem = _OSFileSystem{}
+
+type _OSFileSystem struct{}
+
+func (_OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// avoid a non-nil File holding a nil *os.File.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (_OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (_OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (_OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (_OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (_OSFileSystem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+// Open opens the named file for reading.
+func Open(fsys FileSystem, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file.
+func Create(fsys FileSystem, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// ReadFile reads the named file and returns its contents.
+func ReadFile(fsys FileSystem, name string) ([]byte, error) {
+	f, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes data to the named file, creating it if it does not exist.
+func WriteFile(fsys FileSystem, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SyncDir syncs the directory if the file system implements DirSyncer, so files created
+// or renamed in the directory survive a power loss. It is a no-op on other file systems.
+func SyncDir(fsys FileSystem, dir string) error {
+	if ds, ok := fsys.(DirSyncer); ok {
+		return ds.SyncDir(dir)
+	}
+	return nil
+}
+
+// Allocate reserves disk blocks for size bytes of a file of the OS without changing its size,
+// so writes to the file do not allocate blocks and update metadata of the file system. It is
+// a no-op on other files and on platforms not supporting fallocate.
+func Allocate(f File, size int64) error {
+	switch f := f.(type) {
+	case *os.File:
+		return allocate(f, size)
+	case *_DirectFile:
+		return allocate(f.f, size)
+	}
+	return nil
+}
+
+// WriteFileSync writes data to a temporary file and syncs it, then renames it over the named file
+// and syncs the directory. The named file holds either its previous contents or data after a crash.
+func WriteFileSync(fsys FileSystem, name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	f, err := fsys.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, name); err != nil {
+		return err
+	}
+	return SyncDir(fsys, path.Dir(name))
+}
+
+// Exists reports whether the named file or directory exists.
+func Exists(fsys FileSystem, name string) bool {
+	_, err := fsys.Stat(name)
+	return err == nil
+}
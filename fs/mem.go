@@ -0,0 +1,389 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+	errReadOnly = errors.New("file is not open for writing")
+)
+
+type (
+	// Mem is an in-memory FileSystem. Files are lost once the Mem is no longer referenced,
+	// so use it for unit tests and short-lived caches. It is safe for concurrent use.
+	Mem struct {
+		mu    sync.RWMutex
+		files map[string]*_MemFile
+		dirs  map[string]time.Time
+	}
+
+	_MemFile struct {
+		mu      sync.RWMutex
+		data    []byte
+		perm    os.FileMode
+		modTime time.Time
+	}
+
+	// _MemHandle is an open file of the Mem.
+	_MemHandle struct {
+		mu     sync.Mutex
+		mem    *Mem
+		name   string
+		f      *_MemFile // nil for a directory.
+		flag   int
+		off    int64
+		closed bool
+	}
+
+	_MemFileInfo struct {
+		name    string
+		size    int64
+		mode    os.FileMode
+		modTime time.Time
+	}
+)
+
+// NewMem creates an empty in-memory FileSystem.
+func NewMem() *Mem {
+	return &Mem{files: make(map[string]*_MemFile), dirs: make(map[string]time.Time)}
+}
+
+func cleanPath(name string) string {
+	return path.Clean(strings.Replace(name, "\\", "/", -1))
+}
+
+// hasDir reports whether the parent directory exists, caller must hold the lock.
+func (m *Mem) hasDir(dir string) bool {
+	if dir == "." || dir == "/" {
+		return true
+	}
+	_, ok := m.dirs[dir]
+	return ok
+}
+
+func (m *Mem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = cleanPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hasDir(name) {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+		return &_MemHandle{mem: m, name: name, flag: flag}, nil
+	}
+	f, ok := m.files[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !m.hasDir(path.Dir(name)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &_MemFile{perm: perm, modTime: time.Now()}
+		m.files[name] = f
+	case flag&os.O_TRUNC != 0:
+		f.mu.Lock()
+		f.data = nil
+		f.modTime = time.Now()
+		f.mu.Unlock()
+	}
+	return &_MemHandle{mem: m, name: name, f: f, flag: flag}, nil
+}
+
+func (m *Mem) Remove(name string) error {
+	name = cleanPath(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	prefix := name + "/"
+	for n := range m.files {
+		if strings.HasPrefix(n, prefix) {
+			return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+	for n := range m.dirs {
+		if strings.HasPrefix(n, prefix) {
+			return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *Mem) Rename(oldpath, newpath string) error {
+	oldpath, newpath = cleanPath(oldpath), cleanPath(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[oldpath]
+	if !ok {
+		if _, ok := m.dirs[oldpath]; ok {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errIsDir}
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := m.dirs[newpath]; ok || !m.hasDir(path.Dir(newpath)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = f
+	return nil
+}
+
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	name = cleanPath(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if f, ok := m.files[name]; ok {
+		return f.stat(name), nil
+	}
+	if m.hasDir(name) {
+		return &_MemFileInfo{name: path.Base(name), mode: os.ModeDir | 0777, modTime: m.dirs[name]}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *Mem) MkdirAll(dir string, perm os.FileMode) error {
+	dir = cleanPath(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var dirs []string
+	for d := dir; d != "." && d != "/"; d = path.Dir(d) {
+		if _, ok := m.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: errNotDir}
+		}
+		dirs = append(dirs, d)
+	}
+	for _, d := range dirs {
+		if _, ok := m.dirs[d]; !ok {
+			m.dirs[d] = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *Mem) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = cleanPath(dirname)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.hasDir(dirname) {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for n, f := range m.files {
+		if path.Dir(n) == dirname {
+			infos = append(infos, f.stat(n))
+		}
+	}
+	for n, modTime := range m.dirs {
+		if path.Dir(n) == dirname {
+			infos = append(infos, &_MemFileInfo{name: path.Base(n), mode: os.ModeDir | 0777, modTime: modTime})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (f *_MemFile) stat(name string) *_MemFileInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &_MemFileInfo{name: path.Base(name), size: int64(len(f.data)), mode: f.perm, modTime: f.modTime}
+}
+
+func (f *_MemFile) readAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	// As os.File, a zero length read does not report the end of the file.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *_MemFile) writeAt(p []byte, off int64) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	f.modTime = time.Now()
+	return copy(f.data[off:], p)
+}
+
+// resize grows or shrinks the file, caller must hold the lock.
+func (f *_MemFile) resize(size int64) {
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+		return
+	}
+	if size <= int64(cap(f.data)) {
+		tail := f.data[len(f.data):size]
+		for i := range tail {
+			tail[i] = 0
+		}
+		f.data = f.data[:size]
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, f.data)
+	f.data = data
+}
+
+// check returns an error if the handle is closed, a directory, or not open for writing if write is set.
+func (h *_MemHandle) check(op string, write bool) error {
+	switch {
+	case h.closed:
+		return &os.PathError{Op: op, Path: h.name, Err: os.ErrClosed}
+	case h.f == nil:
+		return &os.PathError{Op: op, Path: h.name, Err: errIsDir}
+	case write && h.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return &os.PathError{Op: op, Path: h.name, Err: errReadOnly}
+	}
+	return nil
+}
+
+func (h *_MemHandle) Name() string {
+	return h.name
+}
+
+func (h *_MemHandle) Read(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := h.f.readAt(p, h.off)
+	h.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *_MemHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.check("read", false); err != nil {
+		return 0, err
+	}
+	return h.f.readAt(p, off)
+}
+
+func (h *_MemHandle) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.check("write", true); err != nil {
+		return 0, err
+	}
+	if h.flag&os.O_APPEND != 0 {
+		h.f.mu.RLock()
+		h.off = int64(len(h.f.data))
+		h.f.mu.RUnlock()
+	}
+	n := h.f.writeAt(p, h.off)
+	h.off += int64(n)
+	return n, nil
+}
+
+func (h *_MemHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.check("write", true); err != nil {
+		return 0, err
+	}
+	return h.f.writeAt(p, off), nil
+}
+
+func (h *_MemHandle) Stat() (os.FileInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, &os.PathError{Op: "stat", Path: h.name, Err: os.ErrClosed}
+	}
+	if h.f == nil {
+		return h.mem.Stat(h.name)
+	}
+	return h.f.stat(h.name), nil
+}
+
+// Sync is a no-op as files of the Mem are not persisted.
+func (h *_MemHandle) Sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return &os.PathError{Op: "sync", Path: h.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (h *_MemHandle) Truncate(size int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.check("truncate", true); err != nil {
+		return err
+	}
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	h.f.resize(size)
+	h.f.modTime = time.Now()
+	return nil
+}
+
+func (h *_MemHandle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return &os.PathError{Op: "close", Path: h.name, Err: os.ErrClosed}
+	}
+	h.closed = true
+	return nil
+}
+
+func (fi *_MemFileInfo) Name() string       { return fi.name }
+func (fi *_MemFileInfo) Size() int64        { return fi.size }
+func (fi *_MemFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *_MemFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *_MemFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *_MemFileInfo) Sys() interface{}   { return nil }
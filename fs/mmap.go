@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"os"
+	"strings"
+)
+
+// Mmap is a FileSystem of the operating system that memory-maps files for reads, so reading blocks
+// of data and index files does not issue a ReadAt syscall. Writes go through the file and the mapping
+// is remapped once a read is beyond the mapped size or the file is truncated.
+// Files are mapped on platforms supporting mmap, on other platforms files are read as with OS.
+type Mmap struct {
+	_OSFileSystem
+	suffixes []string
+}
+
+// NewMmap creates a FileSystem that memory-maps files with names ending with one of the suffixes,
+// for example NewMmap(".data", ".index"). Other files are accessed as with OS.
+func NewMmap(suffixes ...string) *Mmap {
+	return &Mmap{suffixes: suffixes}
+}
+
+// OpenFile opens the named file as os.OpenFile, the file is memory-mapped if its name matches.
+func (m *Mmap) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if !m.match(name) {
+		return f, nil
+	}
+	return newMmapFile(f)
+}
+
+func (m *Mmap) match(name string) bool {
+	for _, suffix := range m.suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOS reports whether files of the file system are files of the operating system.
+func IsOS(fsys FileSystem) bool {
+	switch fsys.(type) {
+	case _OSFileSystem, *Mmap, *DirectIO:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// +build !windows
+
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// _MmapFile is a file with reads served from a shared read-only mapping of the file.
+type _MmapFile struct {
+	*os.File
+
+	mu   sync.RWMutex
+	data []byte
+}
+
+func newMmapFile(f *os.File) (File, error) {
+	mf := &_MmapFile{File: f}
+	if err := mf.remap(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return mf, nil
+}
+
+// remap maps the file to its current size, caller must hold the lock.
+func (mf *_MmapFile) remap() error {
+	stat, err := mf.File.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if mf.data != nil && size == int64(len(mf.data)) {
+		return nil
+	}
+	if err := mf.unmap(); err != nil {
+		return err
+	}
+	if size == 0 || int64(int(size)) != size {
+		return nil
+	}
+	data, err := syscall.Mmap(int(mf.File.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return &os.PathError{Op: "mmap", Path: mf.Name(), Err: err}
+	}
+	mf.data = data
+	return nil
+}
+
+func (mf *_MmapFile) unmap() error {
+	if mf.data == nil {
+		return nil
+	}
+	data := mf.data
+	mf.data = nil
+	if err := syscall.Munmap(data); err != nil {
+		return &os.PathError{Op: "munmap", Path: mf.Name(), Err: err}
+	}
+	return nil
+}
+
+// read copies from the mapping, it returns false if the range is beyond the mapped size.
+func (mf *_MmapFile) read(p []byte, off int64) bool {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	if off < 0 || off+int64(len(p)) > int64(len(mf.data)) {
+		return false
+	}
+	copy(p, mf.data[off:])
+	return true
+}
+
+func (mf *_MmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if mf.read(p, off) {
+		return len(p), nil
+	}
+	// The file is extended by writes, so remap before reading beyond the mapped size.
+	mf.mu.Lock()
+	err := mf.remap()
+	mf.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if mf.read(p, off) {
+		return len(p), nil
+	}
+	return mf.File.ReadAt(p, off)
+}
+
+func (mf *_MmapFile) Truncate(size int64) error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	// Reading a mapping beyond the end of a truncated file faults, so the file is unmapped first.
+	if err := mf.unmap(); err != nil {
+		return err
+	}
+	if err := mf.File.Truncate(size); err != nil {
+		return err
+	}
+	return mf.remap()
+}
+
+func (mf *_MmapFile) Close() error {
+	mf.mu.Lock()
+	err := mf.unmap()
+	mf.mu.Unlock()
+	if cerr := mf.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	amzAlgorithm  = "AWS4-HMAC-SHA256"
+)
+
+// S3Options configures an S3 object store. Google Cloud Storage is used through its S3 compatible
+// XML API with an HMAC key, set Endpoint to "https://storage.googleapis.com" and Region to "auto".
+type S3Options struct {
+	Endpoint  string // Endpoint is the URL of the service, for example "https://s3.us-east-1.amazonaws.com".
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// Client sends requests to the service, http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// S3 is an ObjectStore storing objects in a bucket of an S3 compatible service. Requests use
+// path-style URLs and are signed using AWS signature version 4.
+type S3 struct {
+	opts S3Options
+}
+
+// NewS3 creates an ObjectStore storing objects in the bucket of the options.
+func NewS3(opts S3Options) *S3 {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	opts.Endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+	return &S3{opts: opts}
+}
+
+// Put stores data as the object of the key.
+func (s *S3) Put(key string, data []byte) error {
+	_, err := s.do(http.MethodPut, key, data, nil)
+	return err
+}
+
+// GetRange returns n bytes of the object of the key starting at off.
+func (s *S3) GetRange(key string, off, n int64) ([]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	return s.do(http.MethodGet, key, nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)}})
+}
+
+// Delete deletes the object of the key, deleting an object that does not exist is not an error.
+func (s *S3) Delete(key string) error {
+	_, err := s.do(http.MethodDelete, key, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3) do(method, key string, body []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, s.opts.Endpoint+"/"+s.opts.Bucket+"/"+escapePath(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, time.Now())
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	case resp.StatusCode/100 != 2:
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))}
+	}
+	return data, nil
+}
+
+// sign adds the AWS signature version 4 of the request to its Authorization header.
+// The host, range and x-amz-* headers are signed.
+func (s *S3) sign(req *http.Request, body []byte, t time.Time) {
+	t = t.UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	date := t.Format("20060102")
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	stringToSign := amzAlgorithm + "\n" + t.Format(amzDateFormat) + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), date)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", amzAlgorithm, s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath escapes the object key as required by the signature, unreserved characters and '/' are kept.
+func escapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,807 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSegmentSize is the size of segments a tiered file is split into.
+	defaultSegmentSize = 64 << 20
+
+	// segmentExt is the extension of segment files of a tiered file followed by the segment index.
+	segmentExt = ".seg"
+)
+
+var (
+	errClosed        = errors.New("file already closed")
+	errTieredRename  = errors.New("rename between tiered and local files")
+	errObjectMissing = errors.New("object does not exist")
+
+	errManifestInvalid = errors.New("manifest of tiered file is invalid")
+)
+
+// ObjectStore stores objects by key. It is the remote tier of a Tiered file system, see NewS3 and NewMemStore.
+type ObjectStore interface {
+	// Put stores data as the object of the key, replacing an existing object.
+	Put(key string, data []byte) error
+
+	// GetRange returns n bytes of the object of the key starting at off.
+	GetRange(key string, off, n int64) ([]byte, error)
+
+	// Delete deletes the object of the key.
+	Delete(key string) error
+}
+
+// TieredOptions selects the files of a Tiered file system offloaded to the object store.
+type TieredOptions struct {
+	// Suffixes selects tiered files by name. A file is tiered if its name ends with one of
+	// the suffixes, optionally followed by an extension, so ".data" also tiers "unitdb0000.data.compact".
+	Suffixes []string
+
+	// SegmentSize is the size of segments a tiered file is split into, the default is 64MB.
+	// Segments are offloaded and fetched back as a whole. It is fixed once a file is created.
+	SegmentSize int64
+
+	// KeyPrefix is prepended to keys of objects offloaded to the store.
+	KeyPrefix string
+}
+
+type (
+	// Tiered is a FileSystem keeping recent data on a local file system and offloading cold data to
+	// an object store. A tiered file is stored locally as fixed size segment files and a manifest,
+	// the manifest is the local index of segments offloaded to the store. Reads of an offloaded segment
+	// fetch the range read from the store and a write fetches the segment back to the local file system.
+	// Segments are offloaded by Offload. Files not selected by the options are stored on the local file system.
+	Tiered struct {
+		local FileSystem
+		store ObjectStore
+		opts  TieredOptions
+
+		mu    sync.Mutex
+		files map[string]*_TieredFile // open tiered files by name.
+	}
+
+	// _TieredFile is a tiered file shared by its open handles.
+	_TieredFile struct {
+		t    *Tiered
+		name string
+		refs int
+
+		mu          sync.Mutex
+		segmentSize int64
+		size        int64
+		local       map[int64]File // open local segments, a nil File is a segment not opened yet.
+		remote      map[int64]_RemoteSegment
+	}
+
+	// _RemoteSegment is a segment offloaded to the object store.
+	_RemoteSegment struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	}
+
+	// _Manifest is the local index of a tiered file.
+	_Manifest struct {
+		SegmentSize int64                    `json:"segment_size"`
+		Remote      map[int64]_RemoteSegment `json:"remote,omitempty"`
+	}
+
+	// _TieredHandle is an open handle of a tiered file, handles share the file and keep their own offset.
+	_TieredHandle struct {
+		*_TieredFile
+		off    int64
+		closed bool
+	}
+
+	_TieredFileInfo struct {
+		os.FileInfo
+		size int64
+	}
+)
+
+// NewTiered creates a FileSystem storing files on the local file system and offloading cold
+// segments of files selected by the options to the store.
+func NewTiered(local FileSystem, store ObjectStore, opts TieredOptions) *Tiered {
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	return &Tiered{local: local, store: store, opts: opts, files: make(map[string]*_TieredFile)}
+}
+
+// match reports whether the named file is tiered.
+func (t *Tiered) match(name string) bool {
+	base := path.Base(name)
+	for _, suffix := range t.opts.Suffixes {
+		i := strings.LastIndex(base, suffix)
+		if i < 0 {
+			continue
+		}
+		rest := base[i+len(suffix):]
+		if rest == "" || (rest[0] == '.' && !strings.HasPrefix(rest, segmentExt)) {
+			return true
+		}
+	}
+	return false
+}
+
+func segmentName(name string, idx int64) string {
+	return fmt.Sprintf("%s%s%06d", name, segmentExt, idx)
+}
+
+// OpenFile opens the named file as os.OpenFile.
+func (t *Tiered) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if !t.match(name) {
+		return t.local.OpenFile(name, flag, perm)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[name]
+	if ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !ok {
+		var err error
+		if f, err = t.load(name, flag, perm); err != nil {
+			return nil, err
+		}
+		t.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		if err := f.truncate(0); err != nil {
+			if !ok {
+				delete(t.files, name)
+			}
+			return nil, err
+		}
+	}
+	f.refs++
+	return &_TieredHandle{_TieredFile: f}, nil
+}
+
+// load reads the manifest and local segments of the named file, the manifest is created if flag has O_CREATE.
+func (t *Tiered) load(name string, flag int, perm os.FileMode) (*_TieredFile, error) {
+	mf, err := t.local.OpenFile(name, flag&(os.O_CREATE|os.O_EXCL)|os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(mf)
+	mf.Close()
+	if err != nil {
+		return nil, err
+	}
+	f := &_TieredFile{t: t, name: name, segmentSize: t.opts.SegmentSize, local: make(map[int64]File), remote: make(map[int64]_RemoteSegment)}
+	if len(data) == 0 {
+		if err := f.writeManifest(); err != nil {
+			return nil, err
+		}
+	} else {
+		var m _Manifest
+		if err := json.Unmarshal(data, &m); err != nil || m.SegmentSize <= 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errManifestInvalid}
+		}
+		f.segmentSize = m.SegmentSize
+		for idx, r := range m.Remote {
+			f.remote[idx] = r
+			if end := idx*f.segmentSize + r.Size; end > f.size {
+				f.size = end
+			}
+		}
+	}
+	segments, err := t.segments(name)
+	if err != nil {
+		return nil, err
+	}
+	for idx, size := range segments {
+		// A segment is left behind if offload stopped once the manifest is written.
+		if _, ok := f.remote[idx]; ok {
+			if err := t.local.Remove(segmentName(name, idx)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f.local[idx] = nil
+		if end := idx*f.segmentSize + size; end > f.size {
+			f.size = end
+		}
+	}
+	return f, nil
+}
+
+// segments returns sizes of local segment files of the named file by segment index.
+func (t *Tiered) segments(name string) (map[int64]int64, error) {
+	infos, err := t.local.ReadDir(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	prefix := path.Base(name) + segmentExt
+	segments := make(map[int64]int64)
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+		idx, err := strconv.ParseInt(info.Name()[len(prefix):], 10, 64)
+		if err != nil {
+			continue
+		}
+		segments[idx] = info.Size()
+	}
+	return segments, nil
+}
+
+// Remove removes the named file, a tiered file is removed with its segments and offloaded objects.
+func (t *Tiered) Remove(name string) error {
+	if !t.match(name) {
+		return t.local.Remove(name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[name]
+	if !ok {
+		var err error
+		if f, err = t.load(name, os.O_RDONLY, 0); err != nil {
+			return err
+		}
+	}
+	if err := f.truncate(0); err != nil {
+		return err
+	}
+	if err := t.local.Remove(name); err != nil {
+		return err
+	}
+	delete(t.files, name)
+	return nil
+}
+
+// Rename renames oldpath to newpath, replacing newpath if it exists. A tiered file is renamed with
+// its segments, offloaded objects keep their keys.
+func (t *Tiered) Rename(oldpath, newpath string) error {
+	oldTiered, newTiered := t.match(oldpath), t.match(newpath)
+	switch {
+	case !oldTiered && !newTiered:
+		return t.local.Rename(oldpath, newpath)
+	case oldTiered != newTiered:
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errTieredRename}
+	}
+	if _, err := t.local.Stat(oldpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, err := t.local.Stat(newpath); err == nil {
+		if err := t.Remove(newpath); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	segments, err := t.segments(oldpath)
+	if err != nil {
+		return err
+	}
+	if f, ok := t.files[oldpath]; ok {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for idx, lf := range f.local {
+			if lf != nil {
+				lf.Close()
+				f.local[idx] = nil
+			}
+		}
+		f.name = newpath
+		delete(t.files, oldpath)
+		t.files[newpath] = f
+	}
+	// The manifest is renamed last, segments of an interrupted rename are recovered by renaming again.
+	for idx := range segments {
+		if err := t.local.Rename(segmentName(oldpath, idx), segmentName(newpath, idx)); err != nil {
+			return err
+		}
+	}
+	return t.local.Rename(oldpath, newpath)
+}
+
+// Stat returns file info of the named file, size of a tiered file includes its offloaded segments.
+func (t *Tiered) Stat(name string) (os.FileInfo, error) {
+	info, err := t.local.Stat(name)
+	if err != nil || !t.match(name) {
+		return info, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.files[name]
+	if !ok {
+		if f, err = t.load(name, os.O_RDONLY, 0); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return _TieredFileInfo{FileInfo: info, size: f.size}, nil
+}
+
+// MkdirAll creates a directory and any parents on the local file system.
+func (t *Tiered) MkdirAll(path string, perm os.FileMode) error {
+	return t.local.MkdirAll(path, perm)
+}
+
+// ReadDir returns file info of the directory entries, segment files of tiered files are not listed.
+func (t *Tiered) ReadDir(dirname string) ([]os.FileInfo, error) {
+	infos, err := t.local.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	entries := infos[:0]
+	for _, info := range infos {
+		if i := strings.LastIndex(info.Name(), segmentExt); i > 0 && t.match(info.Name()[:i]) {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	return entries, nil
+}
+
+// SyncDir syncs the directory of the local file system.
+func (t *Tiered) SyncDir(name string) error {
+	return SyncDir(t.local, name)
+}
+
+// Offload moves full segments of open tiered files not written since cutoff to the object store,
+// the last segment of a file is kept local as writes are appended to it.
+// It returns the number of bytes offloaded.
+func (t *Tiered) Offload(cutoff time.Time) (int64, error) {
+	t.mu.Lock()
+	files := make([]*_TieredFile, 0, len(t.files))
+	for _, f := range t.files {
+		files = append(files, f)
+	}
+	t.mu.Unlock()
+	var size int64
+	for _, f := range files {
+		n, err := f.offload(cutoff)
+		size += n
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+func (f *_TieredFile) writeManifest() error {
+	data, err := json.Marshal(_Manifest{SegmentSize: f.segmentSize, Remote: f.remote})
+	if err != nil {
+		return err
+	}
+	return WriteFileSync(f.t.local, f.name, data, 0666)
+}
+
+// segment returns the local segment of the index, an offloaded segment is fetched from the store.
+// A segment not yet written is created if create is set, otherwise nil is returned. Caller must hold the lock.
+func (f *_TieredFile) segment(idx int64, create bool) (File, error) {
+	if _, ok := f.remote[idx]; ok {
+		if err := f.fetch(idx); err != nil {
+			return nil, err
+		}
+	}
+	lf, ok := f.local[idx]
+	if lf != nil || (!ok && !create) {
+		return lf, nil
+	}
+	lf, err := f.t.local.OpenFile(segmentName(f.name, idx), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f.local[idx] = lf
+	return lf, nil
+}
+
+// fetch moves an offloaded segment back to the local file system. Caller must hold the lock.
+func (f *_TieredFile) fetch(idx int64) error {
+	r := f.remote[idx]
+	data, err := f.t.store.GetRange(r.Key, 0, r.Size)
+	if err != nil {
+		return err
+	}
+	lf, err := Create(f.t.local, segmentName(f.name, idx))
+	if err != nil {
+		return err
+	}
+	if _, err := lf.Write(data); err != nil {
+		lf.Close()
+		return err
+	}
+	if err := lf.Sync(); err != nil {
+		lf.Close()
+		return err
+	}
+	f.local[idx] = lf
+	delete(f.remote, idx)
+	if err := f.writeManifest(); err != nil {
+		return err
+	}
+	return f.t.store.Delete(r.Key)
+}
+
+// offload moves full segments not written since cutoff to the store.
+func (f *_TieredFile) offload(cutoff time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refs == 0 {
+		return 0, nil
+	}
+	last := (f.size - 1) / f.segmentSize
+	var idxs []int64
+	for idx := range f.local {
+		if idx < last {
+			idxs = append(idxs, idx)
+		}
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	var size int64
+	for _, idx := range idxs {
+		name := segmentName(f.name, idx)
+		info, err := f.t.local.Stat(name)
+		if err != nil {
+			return size, err
+		}
+		if info.Size() != f.segmentSize || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		data, err := ReadFile(f.t.local, name)
+		if err != nil {
+			return size, err
+		}
+		key := fmt.Sprintf("%s%s.%d%s%06d", f.t.opts.KeyPrefix, path.Base(f.name), time.Now().UnixNano(), segmentExt, idx)
+		if err := f.t.store.Put(key, data); err != nil {
+			return size, err
+		}
+		f.remote[idx] = _RemoteSegment{Key: key, Size: int64(len(data))}
+		if err := f.writeManifest(); err != nil {
+			return size, err
+		}
+		if lf := f.local[idx]; lf != nil {
+			lf.Close()
+		}
+		delete(f.local, idx)
+		if err := f.t.local.Remove(name); err != nil {
+			return size, err
+		}
+		size += int64(len(data))
+	}
+	return size, nil
+}
+
+func (f *_TieredFile) readAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for n < len(p) && off < f.size {
+		idx, segOff := off/f.segmentSize, off%f.segmentSize
+		m := int64(len(p) - n)
+		if rest := f.segmentSize - segOff; m > rest {
+			m = rest
+		}
+		if rest := f.size - off; m > rest {
+			m = rest
+		}
+		if err := f.readSegment(idx, segOff, p[n:n+int(m)]); err != nil {
+			return n, err
+		}
+		n += int(m)
+		off += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readSegment reads p from the segment at off, an offloaded segment is read from the store.
+// Bytes beyond the end of a segment read as zero. Caller must hold the lock.
+func (f *_TieredFile) readSegment(idx, off int64, p []byte) error {
+	n := 0
+	if r, ok := f.remote[idx]; ok {
+		if size := r.Size - off; size > 0 {
+			if size > int64(len(p)) {
+				size = int64(len(p))
+			}
+			data, err := f.t.store.GetRange(r.Key, off, size)
+			if err != nil {
+				return err
+			}
+			n = copy(p, data)
+		}
+	} else {
+		lf, err := f.segment(idx, false)
+		if err != nil {
+			return err
+		}
+		if lf != nil {
+			if n, err = lf.ReadAt(p, off); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return nil
+}
+
+func (f *_TieredFile) writeAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		idx, segOff := off/f.segmentSize, off%f.segmentSize
+		m := int64(len(p) - n)
+		if rest := f.segmentSize - segOff; m > rest {
+			m = rest
+		}
+		lf, err := f.segment(idx, true)
+		if err != nil {
+			return n, err
+		}
+		if _, err := lf.WriteAt(p[n:n+int(m)], segOff); err != nil {
+			return n, err
+		}
+		n += int(m)
+		off += m
+		if off > f.size {
+			f.size = off
+		}
+	}
+	return n, nil
+}
+
+// truncate changes size of the file, segments beyond the size are removed. Caller must not hold the lock.
+func (f *_TieredFile) truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for idx, r := range f.remote {
+		if idx*f.segmentSize >= size {
+			keys = append(keys, r.Key)
+			delete(f.remote, idx)
+		}
+	}
+	for idx, lf := range f.local {
+		if idx*f.segmentSize < size {
+			continue
+		}
+		if lf != nil {
+			lf.Close()
+		}
+		delete(f.local, idx)
+		if err := f.t.local.Remove(segmentName(f.name, idx)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(keys) != 0 {
+		if err := f.writeManifest(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := f.t.store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	if idx, segOff := size/f.segmentSize, size%f.segmentSize; segOff != 0 {
+		lf, err := f.segment(idx, size < f.size)
+		if err != nil {
+			return err
+		}
+		if lf != nil {
+			if err := lf.Truncate(segOff); err != nil {
+				return err
+			}
+		}
+	}
+	f.size = size
+	return nil
+}
+
+func (f *_TieredFile) sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, lf := range f.local {
+		if lf == nil {
+			continue
+		}
+		if err := lf.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes local segments once all handles of the file are closed.
+func (f *_TieredFile) close() error {
+	t := f.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	if t.files[f.name] == f {
+		delete(t.files, f.name)
+	}
+	var err error
+	for idx, lf := range f.local {
+		if lf == nil {
+			continue
+		}
+		if err1 := lf.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+		f.local[idx] = nil
+	}
+	return err
+}
+
+func (h *_TieredHandle) Name() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.name
+}
+
+func (h *_TieredHandle) Read(p []byte) (int, error) {
+	if h.closed {
+		return 0, errClosed
+	}
+	n, err := h.readAt(p, h.off)
+	h.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *_TieredHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, errClosed
+	}
+	return h.readAt(p, off)
+}
+
+func (h *_TieredHandle) Write(p []byte) (int, error) {
+	if h.closed {
+		return 0, errClosed
+	}
+	n, err := h.writeAt(p, h.off)
+	h.off += int64(n)
+	return n, err
+}
+
+func (h *_TieredHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, errClosed
+	}
+	return h.writeAt(p, off)
+}
+
+func (h *_TieredHandle) Stat() (os.FileInfo, error) {
+	if h.closed {
+		return nil, errClosed
+	}
+	name := h.Name()
+	info, err := h.t.local.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return _TieredFileInfo{FileInfo: info, size: h.size}, nil
+}
+
+func (h *_TieredHandle) Sync() error {
+	if h.closed {
+		return errClosed
+	}
+	return h.sync()
+}
+
+func (h *_TieredHandle) Truncate(size int64) error {
+	if h.closed {
+		return errClosed
+	}
+	return h.truncate(size)
+}
+
+func (h *_TieredHandle) Close() error {
+	if h.closed {
+		return errClosed
+	}
+	h.closed = true
+	return h.close()
+}
+
+func (fi _TieredFileInfo) Size() int64 {
+	return fi.size
+}
+
+type (
+	// MemStore is an in-memory ObjectStore, use it to test a Tiered file system. It is safe for concurrent use.
+	MemStore struct {
+		mu      sync.RWMutex
+		objects map[string][]byte
+	}
+)
+
+// NewMemStore creates an empty in-memory ObjectStore.
+func NewMemStore() *MemStore {
+	return &MemStore{objects: make(map[string][]byte)}
+}
+
+// Put stores a copy of data as the object of the key.
+func (s *MemStore) Put(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// GetRange returns a copy of n bytes of the object of the key starting at off.
+func (s *MemStore) GetRange(key string, off, n int64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: key, Err: errObjectMissing}
+	}
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	if end := off + n; end < int64(len(data)) {
+		data = data[:end]
+	}
+	return append([]byte(nil), data[off:]...), nil
+}
+
+// Delete deletes the object of the key.
+func (s *MemStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// Keys returns keys of the stored objects sorted.
+func (s *MemStore) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
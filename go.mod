@@ -13,6 +13,7 @@ require (
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 	google.golang.org/grpc v1.39.0
+	google.golang.org/protobuf v1.26.0
 )
 
 replace github.com/unit-io/unitdb-go => /src/github.com/unit-io/unitdb-go
@@ -0,0 +1,304 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+// Aggregations of the Grafana datasource, a target "avg:sensors.temp" averages values of messages of
+// the topic per interval of the query. A target without an aggregation returns the values of messages.
+var grafanaAggregations = map[string]func(vals []float64) float64{
+	"count": func(vals []float64) float64 { return float64(len(vals)) },
+	"sum":   sumValues,
+	"avg":   func(vals []float64) float64 { return sumValues(vals) / float64(len(vals)) },
+	"min": func(vals []float64) float64 {
+		m := math.Inf(1)
+		for _, v := range vals {
+			m = math.Min(m, v)
+		}
+		return m
+	},
+	"max": func(vals []float64) float64 {
+		m := math.Inf(-1)
+		for _, v := range vals {
+			m = math.Max(m, v)
+		}
+		return m
+	},
+}
+
+type (
+	_GrafanaHandler struct {
+		db       *DB
+		contract uint32
+	}
+
+	_GrafanaQuery struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		IntervalMs    int64 `json:"intervalMs"`
+		MaxDataPoints int   `json:"maxDataPoints"`
+		Targets       []struct {
+			Target string `json:"target"`
+			Type   string `json:"type"`
+		} `json:"targets"`
+	}
+
+	_GrafanaSeries struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"` // value and unix time in milliseconds.
+	}
+
+	_Point struct {
+		time  time.Time
+		value []byte
+	}
+)
+
+func sumValues(vals []float64) float64 {
+	var s float64
+	for _, v := range vals {
+		s += v
+	}
+	return s
+}
+
+// GrafanaHandler returns an HTTP handler implementing the Grafana JSON datasource (SimpleJSON) API
+// for topics of the contract, use zero contract for the master contract. Mount it at the URL of the datasource.
+//
+// A query target is a topic, wildcard topics included, and returns numeric values of messages of the topic
+// written in the time range of the query. Prefix the topic with count, sum, avg, min or max and a colon,
+// e.g. "avg:sensors.temp", to aggregate values per interval of the query. Messages with a payload that is
+// not a number are only counted. At most the maximum query limit of the DB of the most recent messages
+// are read per target.
+func (db *DB) GrafanaHandler(contract uint32) http.Handler {
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return &_GrafanaHandler{db: db, contract: contract}
+}
+
+func (h *_GrafanaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	var err error
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "":
+		// Grafana tests the datasource with a GET request.
+		resp = struct{}{}
+	case "/search":
+		resp, err = h.search(r)
+	case "/query":
+		resp, err = h.query(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ResponseHandler(w, r, b)
+}
+
+// search returns topics of the contract containing the target of the request.
+func (h *_GrafanaHandler) search(r *http.Request) ([]string, error) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	topics, err := h.db.Topics(h.contract)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(topics))
+	for _, t := range topics {
+		if strings.Contains(t.Topic, req.Target) {
+			names = append(names, t.Topic)
+		}
+	}
+	return names, nil
+}
+
+func (h *_GrafanaHandler) query(r *http.Request) ([]_GrafanaSeries, error) {
+	var req _GrafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	from, to := req.Range.From, req.Range.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval <= 0 && req.MaxDataPoints > 0 {
+		interval = to.Sub(from) / time.Duration(req.MaxDataPoints)
+	}
+	if interval < time.Second {
+		// Message IDs hold time in seconds.
+		interval = time.Second
+	}
+	series := make([]_GrafanaSeries, 0, len(req.Targets))
+	for _, t := range req.Targets {
+		if t.Target == "" {
+			continue
+		}
+		topic, agg := t.Target, ""
+		if i := strings.IndexByte(t.Target, ':'); i > 0 {
+			if _, ok := grafanaAggregations[t.Target[:i]]; ok {
+				topic, agg = t.Target[i+1:], t.Target[:i]
+			}
+		}
+		points, err := h.db.points([]byte(topic), h.contract, from, to)
+		if err != nil {
+			return nil, err
+		}
+		s := _GrafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+		if agg == "" {
+			for _, p := range points {
+				if v, ok := parseValue(p.value); ok {
+					s.Datapoints = append(s.Datapoints, [2]float64{v, float64(p.time.UnixNano() / int64(time.Millisecond))})
+				}
+			}
+		} else {
+			s.Datapoints = aggregate(points, from, interval, agg)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// aggregate aggregates values of points per interval starting from the time, points are in time order.
+func aggregate(points []_Point, from time.Time, interval time.Duration, agg string) [][2]float64 {
+	datapoints := [][2]float64{}
+	fn := grafanaAggregations[agg]
+	var vals []float64
+	var bucket int64 = -1
+	flush := func() {
+		if bucket < 0 || (agg != "count" && len(vals) == 0) {
+			return
+		}
+		ts := from.Add(time.Duration(bucket) * interval)
+		datapoints = append(datapoints, [2]float64{fn(vals), float64(ts.UnixNano() / int64(time.Millisecond))})
+	}
+	for _, p := range points {
+		b := int64(p.time.Sub(from) / interval)
+		if b != bucket {
+			flush()
+			bucket, vals = b, vals[:0]
+		}
+		v, ok := parseValue(p.value)
+		if !ok {
+			if agg != "count" {
+				continue
+			}
+			v = 1
+		}
+		vals = append(vals, v)
+	}
+	flush()
+	return datapoints
+}
+
+// parseValue parses the payload of a message as a number.
+func parseValue(payload []byte) (float64, bool) {
+	v, err := strconv.ParseFloat(string(bytes.TrimSpace(payload)), 64)
+	return v, err == nil
+}
+
+// points returns payloads of messages of the topic written between from and to in time order.
+func (db *DB) points(topic []byte, contract uint32, from, to time.Time) ([]_Point, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	q := NewQuery(topic).WithContract(contract).WithLimit(db.opts.queryOptions.maxQueryLimit)
+	q.internal.opts = &db.opts.queryOptions
+	if err := q.parse(); err != nil {
+		return nil, err
+	}
+	if !from.IsZero() {
+		q.internal.cutoff = from.Unix()
+	}
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	if err := db.lookup(q); err != nil {
+		return nil, err
+	}
+	sort.Slice(q.internal.winEntries, func(i, j int) bool {
+		return q.internal.winEntries[i].seq < q.internal.winEntries[j].seq
+	})
+	var points []_Point
+	for _, wq := range q.internal.winEntries {
+		if wq.seq == 0 {
+			continue
+		}
+		e, err := db.readEntry(wq)
+		if err != nil {
+			if err == errMsgIDDeleted || err == errEntryInvalid {
+				continue
+			}
+			return nil, err
+		}
+		id, val, err := db.internal.reader.readMessage(e)
+		if err != nil {
+			return nil, err
+		}
+		if !message.ID(id).EvalPrefix(q.Contract, q.internal.cutoff) {
+			continue
+		}
+		ts := time.Unix(uid.Time(id[0:4]), 0)
+		if ts.After(to) {
+			continue
+		}
+		val, err = db.decodeValue(id, val)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, _Point{time: ts, value: val})
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].time.Before(points[j].time)
+	})
+	return points, nil
+}
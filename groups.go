@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// defaultAckTimeout is the time after which a message delivered to a member of a consumer group
+// is redelivered if the member has not acknowledged it, see WithAckTimeout.
+const defaultAckTimeout = 30 * time.Second
+
+type (
+	// _Group is a consumer group of subscriptions to a topic competing for its messages, see DB.SubscribeGroup.
+	_Group struct {
+		mu      sync.Mutex
+		members []*Subscription
+		next    int                        // The next is index of the member the next message is delivered to.
+		pending map[uint64]*_GroupDelivery // The pending are messages not yet acknowledged, by seq.
+	}
+
+	// _GroupDelivery is a message delivered to a member of a group, it is redelivered if the member
+	// does not acknowledge it before the deadline.
+	_GroupDelivery struct {
+		msg      Message
+		member   *Subscription // The member is nil if the message is waiting for a member to redeliver it to.
+		deadline time.Time
+	}
+)
+
+// groupKey returns the key of the consumer group subscribed to the topic of the contract.
+func groupKey(group string, contract uint32, topic []byte) string {
+	return group + "/" + strconv.FormatUint(uint64(contract), 10) + "/" + string(topicName(topic))
+}
+
+// deliver sends the message to the next member of the group, skipping the member the message is redelivered from
+// if the group has other members. The message is left waiting for a member if no member keeps up.
+func (g *_Group) deliver(d *_GroupDelivery, now time.Time, ackTimeout time.Duration) bool {
+	from := d.member
+	d.member = nil
+	for i := 0; i < len(g.members); i++ {
+		s := g.members[(g.next+i)%len(g.members)]
+		if s == from && len(g.members) > 1 {
+			continue
+		}
+		select {
+		case s.c <- d.msg:
+			g.next = (g.next + i + 1) % len(g.members)
+			d.member, d.deadline = s, now.Add(ackTimeout)
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// publish delivers the message to one member of the group.
+func (g *_Group) publish(m Message, now time.Time, ackTimeout time.Duration) {
+	d := &_GroupDelivery{msg: m}
+	if !g.deliver(d, now, ackTimeout) {
+		atomic.AddInt64(&g.members[g.next].dropped, 1)
+		return
+	}
+	g.pending[message.ID(m.ID).Sequence()] = d
+}
+
+// redeliver redelivers messages of members that left the group or did not acknowledge these in time,
+// in order of their seqs.
+func (g *_Group) redeliver(now time.Time, ackTimeout time.Duration) {
+	if len(g.members) == 0 {
+		return
+	}
+	var seqs []uint64
+	for seq, d := range g.pending {
+		if d.member == nil || now.After(d.deadline) {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		g.deliver(g.pending[seq], now, ackTimeout)
+	}
+}
+
+// leave removes the member from the group, messages the member has not acknowledged are redelivered
+// to other members.
+func (g *_Group) leave(s *Subscription, now time.Time, ackTimeout time.Duration) {
+	for i, m := range g.members {
+		if m == s {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	if g.next >= len(g.members) {
+		g.next = 0
+	}
+	for _, d := range g.pending {
+		if d.member == s {
+			d.member = nil
+		}
+	}
+	g.redeliver(now, ackTimeout)
+}
+
+// SubscribeGroup subscribes to messages written to the topic of the contract as a member of the named consumer group,
+// use zero contract for the master contract. Each message is delivered to one member of the group, members
+// of a group take turns receiving messages.
+//
+// A member acknowledges a message once it is processed, see Subscription.Ack. A message is redelivered to another
+// member of the group if the member it is delivered to is closed or does not acknowledge the message within the ack
+// timeout, see WithAckTimeout, so a message is delivered at least once while the group has members. Messages pending
+// acknowledgment are kept in memory and are redelivered to the next member joining a group left without members.
+// Messages are dropped if no member of the group keeps up, see Subscription.Dropped.
+//
+// The access key must grant read access to the topic, see WithAccessControl.
+func (db *DB) SubscribeGroup(group string, topic []byte, contract uint32, accessKey string) (*Subscription, error) {
+	if group == "" || strings.ContainsAny(group, "/") {
+		return nil, errGroupInvalid
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	s, err := db.newSubscription(topic, contract, accessKey)
+	if err != nil {
+		return nil, err
+	}
+	db.internal.subscriptions.join(s, groupKey(group, contract, topic))
+	return s, nil
+}
+
+// Ack acknowledges the message of the ID delivered to the subscription as a member of a consumer group,
+// so the message is not redelivered, see DB.SubscribeGroup.
+func (s *Subscription) Ack(id []byte) error {
+	g := s.group
+	if g == nil || len(id) != message.ID(nil).Size() {
+		return errAckInvalid
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seq := message.ID(id).Sequence()
+	if d, ok := g.pending[seq]; !ok || d.member != s {
+		return errAckInvalid
+	}
+	delete(g.pending, seq)
+	return nil
+}
+
+func (db *DB) startRedeliverer(interval time.Duration) {
+	redelivererTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-redelivererTicker.C:
+				db.internal.subscriptions.redeliver(time.Now())
+			case <-db.internal.closeC:
+				redelivererTicker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// WriteHandoff transfers entries a DB has accepted but not yet synced to its index and data files,
+// so a replica promoted to primary does not lose the most recent writes of a primary that is still alive.
+// The primary writes its unsynced entries using WriteHandoff and the promoting replica applies these using ApplyHandoff.
+//
+// Each entry is written as its length followed by the entry as stored in the memdb, i.e. entry header,
+// message ID, topic (only on first entry of a topic) and the encoded value.
+//
+// WriteHandoff writes entries not yet synced to the DB to w in sequence order. It returns number of entries written.
+func (db *DB) WriteHandoff(w io.Writer) (int, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	seqs := db.internal.mem.Keys()
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	bw := bufio.NewWriter(w)
+	var n int
+	scratch := make([]byte, 4)
+	for _, seq := range seqs {
+		data, err := db.internal.mem.Get(seq)
+		if err != nil || len(data) < entrySize+idSize {
+			continue
+		}
+		binary.LittleEndian.PutUint32(scratch, uint32(len(data)))
+		if _, err := bw.Write(scratch); err != nil {
+			return n, err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// ApplyHandoff reads entries written by WriteHandoff of the primary and puts these into the DB.
+// Entries already in the DB are skipped, and entries of a topic unknown to the DB are skipped
+// if the entry does not carry the topic. It returns number of entries applied.
+func (db *DB) ApplyHandoff(r io.Reader) (int, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(r)
+	var n int
+	scratch := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, scratch); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(scratch))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return n, err
+		}
+		applied, err := db.applyHandoffEntry(data)
+		if err != nil {
+			return n, err
+		}
+		if applied {
+			n++
+		}
+	}
+}
+
+func (db *DB) applyHandoffEntry(data []byte) (bool, error) {
+	if len(data) < entrySize+idSize {
+		return false, errEntryInvalid
+	}
+	var m _Entry
+	if err := m.UnmarshalBinary(data[:entrySize]); err != nil {
+		return false, err
+	}
+	if len(data) != entrySize+idSize+int(m.topicSize)+int(m.valueSize) {
+		return false, errEntryInvalid
+	}
+	if m.seq == 0 {
+		return false, errEntryInvalid
+	}
+	if db.exists(m.seq) {
+		return false, nil
+	}
+	var t *message.Topic
+	if m.topicSize != 0 {
+		t = new(message.Topic)
+		if err := t.Unmarshal(data[entrySize+idSize : entrySize+idSize+int(m.topicSize)]); err != nil {
+			return false, err
+		}
+	} else if _, ok := db.internal.trie.getOffset(m.topicHash); !ok {
+		db.internal.logger.Warn().Str("context", "db.applyHandoff").Uint64("seq", m.seq).Msg("topic of the entry is unknown")
+		return false, nil
+	}
+
+	timeID, err := db.internal.mem.Put(m.seq, data)
+	if err != nil {
+		return false, err
+	}
+	if ok := db.internal.timeWindow.add(timeID, m.topicHash, newWinEntry(m.seq, m.expiresAt)); !ok {
+		return false, ErrForbidden
+	}
+	db.internal.lastValues.set(m.topicHash, m.seq, m.expiresAt)
+	if t != nil {
+		db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth)
+	}
+	// Advance the DB sequence so new entries do not reuse sequence of the applied entry.
+	for {
+		seq := db.seq()
+		if seq >= m.seq || atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, seq, m.seq) {
+			break
+		}
+	}
+	db.internal.meter.Puts.Inc(1)
+	return true, nil
+}
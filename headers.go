@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// maxHeadersSize is the maximum size of encoded headers of a message.
+const maxHeadersSize = 1 << 16
+
+// encodeHeaders appends the headers to dst. Headers are encoded as the number of headers
+// followed by the length prefixed name and value of each header, in order of names.
+func encodeHeaders(dst []byte, headers map[string][]byte) []byte {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dst = appendUvarint(dst, uint64(len(names)))
+	for _, name := range names {
+		dst = appendUvarint(dst, uint64(len(name)))
+		dst = append(dst, name...)
+		dst = appendUvarint(dst, uint64(len(headers[name])))
+		dst = append(dst, headers[name]...)
+	}
+	return dst
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+// decodeHeaders decodes headers encoded by encodeHeaders from the start of data.
+// It returns the headers and the rest of data.
+func decodeHeaders(data []byte) (map[string][]byte, []byte, error) {
+	next := func() ([]byte, error) {
+		n, l := binary.Uvarint(data)
+		if l <= 0 || n > uint64(len(data)-l) {
+			return nil, errHeadersInvalid
+		}
+		b := data[l : l+int(n)]
+		data = data[l+int(n):]
+		return b, nil
+	}
+	count, l := binary.Uvarint(data)
+	if l <= 0 || count > uint64(len(data)) {
+		return nil, nil, errHeadersInvalid
+	}
+	data = data[l:]
+	headers := make(map[string][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		name, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		headers[string(name)] = value
+	}
+	return headers, data, nil
+}
+
+// readHeaders reads headers encoded by encodeHeaders from the start of r, leaving r at the rest of data.
+// It returns the headers and the size of the encoded headers.
+func readHeaders(r *bufio.Reader) (map[string][]byte, int, error) {
+	hr := &_HeadersReader{r: r}
+	next := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(hr)
+		if err != nil || n > uint64(maxHeadersSize-hr.n) {
+			return nil, errHeadersInvalid
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errHeadersInvalid
+		}
+		hr.n += int(n)
+		return b, nil
+	}
+	count, err := binary.ReadUvarint(hr)
+	if err != nil || count > maxHeadersSize {
+		return nil, 0, errHeadersInvalid
+	}
+	headers := make(map[string][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		name, err := next()
+		if err != nil {
+			return nil, 0, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, 0, err
+		}
+		headers[string(name)] = value
+	}
+	return headers, hr.n, nil
+}
+
+// _HeadersReader counts bytes of encoded headers read by readHeaders, up to the max headers size.
+type _HeadersReader struct {
+	r *bufio.Reader
+	n int
+}
+
+func (hr *_HeadersReader) ReadByte() (byte, error) {
+	if hr.n >= maxHeadersSize {
+		return 0, errHeadersInvalid
+	}
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.n++
+	}
+	return b, err
+}
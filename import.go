@@ -0,0 +1,266 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+// importBatchSize is number of entries sorted and written to the DB files at once by DB.Import.
+const importBatchSize = 1 << 16
+
+// ImportOptions sets how DB.ImportWithOptions writes entries to the DB files.
+type ImportOptions struct {
+	// BatchSize is number of entries sorted and written to the DB files at once, it defaults to 65536.
+	BatchSize int
+
+	// Rate limits number of entries imported per second, so a backfill does not take all I/O of the DB
+	// from writes and queries. Zero rate does not limit the import.
+	Rate float64
+
+	// Skip skips the first entries returned by next, set it to the offset of the last checkpoint
+	// to resume an import from the same source.
+	Skip int64
+
+	// Checkpoint is called once a batch is written to the DB files, with the offset of the source
+	// up to which entries are imported. An error returned by Checkpoint stops the import.
+	Checkpoint func(offset int64) error
+}
+
+// Import loads entries returned by next into the DB until next returns io.EOF, it returns number of entries imported.
+// Entries are written to the data, index and window blocks directly, bypassing the memdb and the WAL, use it
+// to backfill a DB with a large number of messages. Subscribers are not notified of imported entries.
+//
+// Entries are read in batches sorted by time, the time of an entry is the time of its ID or the time it is read
+// if it does not have an ID. Imported entries are assigned a new seq, so only the time of an ID is retained.
+// Entries written by previous batches are kept if an error is returned.
+func (db *DB) Import(next func() (*Entry, error)) (int64, error) {
+	return db.ImportWithOptions(next, ImportOptions{})
+}
+
+// ImportWithOptions imports entries as Import does, with the batch size, rate and checkpoint of the opts.
+// A failed import is resumed by calling it again with the source reset and Skip set to the offset of the
+// last checkpoint, entries written by previous batches are then not imported twice.
+func (db *DB) ImportWithOptions(next func() (*Entry, error), opts ImportOptions) (int64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if db.opts.replicator != nil {
+		return 0, errReplicatedImport
+	}
+	if opts.BatchSize < 0 || opts.Rate < 0 || opts.Skip < 0 {
+		return 0, ErrBadRequest
+	}
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = importBatchSize
+	}
+	var throttle *_TokenBucket
+	if opts.Rate > 0 {
+		throttle = newTokenBucket(opts.Rate, int64(batchSize), time.Now())
+	}
+	db.internal.closeW.Add(1)
+	defer db.internal.closeW.Done()
+	// Imported messages bypass the memdb, so the last-value index is rebuilt by reads.
+	defer db.internal.lastValues.reset()
+
+	offset := opts.Skip
+	for i := int64(0); i < opts.Skip; i++ {
+		if _, err := next(); err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	var count int64
+	entries := make([]*Entry, 0, batchSize)
+	for {
+		e, err := next()
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		if e != nil {
+			if err := db.checkImportEntry(e); err != nil {
+				return count, err
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) == batchSize || (err == io.EOF && len(entries) > 0) {
+			if err := db.waitImport(throttle, len(entries)); err != nil {
+				return count, err
+			}
+			n, err := db.importEntries(entries)
+			count += n
+			if err != nil {
+				return count, err
+			}
+			offset += int64(len(entries))
+			if opts.Checkpoint != nil {
+				if err := opts.Checkpoint(offset); err != nil {
+					return count, err
+				}
+			}
+			entries = entries[:0]
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+	}
+}
+
+// waitImport waits until n entries are imported at the rate of the throttle, it returns ErrClosed if the DB is closed.
+func (db *DB) waitImport(throttle *_TokenBucket, n int) error {
+	if throttle == nil {
+		return nil
+	}
+	for !throttle.available(float64(n), time.Now()) {
+		wait := (math.Min(float64(n), throttle.burst) - throttle.tokens) / throttle.rate
+		select {
+		case <-time.After(time.Duration(wait * float64(time.Second))):
+		case <-db.internal.closeC:
+			return ErrClosed
+		}
+	}
+	throttle.tokens -= float64(n)
+	return nil
+}
+
+// checkImportEntry validates the entry and sets time of the entry to its ID.
+func (db *DB) checkImportEntry(e *Entry) error {
+	switch {
+	case len(e.Topic) == 0:
+		return errTopicEmpty
+	case len(e.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	case len(e.Payload) == 0:
+		return errValueEmpty
+	case len(e.Payload) > maxValueLength:
+		return errValueTooLarge
+	case e.ID != nil && len(e.ID) != message.ID(nil).Size():
+		return ErrBadRequest
+	}
+	if e.ID == nil {
+		e.ID = message.NewID(0)
+	}
+	return db.checkEntryLimits(e)
+}
+
+// importEntries sorts entries by time and writes these to the DB files.
+func (db *DB) importEntries(entries []*Entry) (int64, error) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return uid.Time(entries[i].ID[0:4]) < uid.Time(entries[j].ID[0:4])
+	})
+
+	// Import writes blocks of the DB files so it excludes sync.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	for _, e := range entries {
+		// Entry is assigned a new seq once it is committed, the time of the ID is retained.
+		id := message.NewID(0)
+		copy(id[0:4], e.ID[0:4])
+		e.ID = id
+		e.entry.trusted = true
+		if err := db.encodeEntry(e); err != nil {
+			return 0, err
+		}
+		if err := db.checkTopicLimit(e); err != nil {
+			return 0, err
+		}
+		if err := db.checkQuota(e); err != nil {
+			return 0, err
+		}
+		if err := db.commitEntry(e); err != nil {
+			return 0, err
+		}
+		if e.entry.topicSize != 0 {
+			t := new(message.Topic)
+			rawTopic := e.entry.cache[entrySize+idSize : entrySize+idSize+e.entry.topicSize]
+			t.Unmarshal(rawTopic)
+			db.internal.trie.add(newTopic(e.entry.topicHash, 0), t.Parts, t.Depth)
+		}
+	}
+
+	h := &_SyncHandle{DB: db}
+	if ok := h.startSync(); !ok {
+		return 0, ErrBadRequest
+	}
+	defer h.finish()
+	// Readers are blocked until the window blocks the topics point to are written.
+	db.internal.compactLock.Lock()
+	defer db.internal.compactLock.Unlock()
+	if err := h.importBlocks(entries); err != nil {
+		// Entries are counted once synced, so the blocks are rolled back without uncounting these.
+		h.syncInfo.count = 0
+		h.abort()
+		return 0, err
+	}
+	count := h.syncInfo.count
+	if err := h.sync(false); err != nil {
+		return 0, err
+	}
+	db.internal.meter.Puts.Inc(count)
+	return count, nil
+}
+
+// importBlocks appends entries sorted by seq to the index and data blocks, and to window blocks of their topics.
+func (db *_SyncHandle) importBlocks(entries []*Entry) error {
+	winEntries := make(map[uint64]_WindowEntries)
+	var topicHashes []uint64
+	for _, e := range entries {
+		if err := db.blockWriter.append(_IndexEntry{
+			seq:       e.entry.seq,
+			topicSize: e.entry.topicSize,
+			valueSize: e.entry.valueSize,
+			cache:     e.entry.cache[entrySize:],
+		}); err != nil {
+			return err
+		}
+		if _, ok := winEntries[e.entry.topicHash]; !ok {
+			topicHashes = append(topicHashes, e.entry.topicHash)
+		}
+		winEntries[e.entry.topicHash] = append(winEntries[e.entry.topicHash], newWinEntry(e.entry.seq, e.entry.expiresAt))
+		db.syncInfo.upperSeq = e.entry.seq
+		db.syncInfo.count++
+		db.syncInfo.inBytes += int64(e.entry.valueSize)
+	}
+	for _, topicHash := range topicHashes {
+		topicOff, ok := db.internal.trie.getOffset(topicHash)
+		if !ok {
+			return ErrBadRequest
+		}
+		wOff, err := db.windowWriter.append(topicHash, topicOff, winEntries[topicHash])
+		if err != nil {
+			return err
+		}
+		if ok := db.internal.trie.setOffset(_Topic{hash: topicHash, offset: wOff}); !ok {
+			return ErrBadRequest
+		}
+	}
+	for _, e := range entries {
+		db.internal.filter.Append(e.entry.seq, e.entry.expiresAt)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+)
+
+// _IOKind is the kind of disk access admitted by the I/O scheduler.
+type _IOKind int
+
+const (
+	ioRead _IOKind = iota
+	ioWrite
+)
+
+// _IOScheduler alternates disk access to the DB files between reads and writes under contention, so
+// a large sync or a compaction does not starve queries and queries do not starve sync. Reads are
+// admitted together and writes are admitted together, but reads and writes are not admitted at once.
+// Once as many reads as the read weight are admitted while writes are waiting, the waiting writes
+// are admitted next, and the other way around.
+type _IOScheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	weight  [2]int
+	active  [2]int
+	waiting [2]int
+	turns   [2]int // turns admitted since the other kind was last admitted.
+}
+
+// newIOScheduler returns an I/O scheduler admitting reads and writes in turns of the given weights.
+func newIOScheduler(reads, writes int) *_IOScheduler {
+	if reads < 1 {
+		reads = 1
+	}
+	if writes < 1 {
+		writes = 1
+	}
+	s := &_IOScheduler{weight: [2]int{reads, writes}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// admit returns true if disk access of the kind is admitted.
+func (s *_IOScheduler) admit(kind _IOKind) bool {
+	other := 1 - kind
+	if s.active[other] > 0 {
+		return false
+	}
+	return s.waiting[other] == 0 || s.turns[kind] < s.weight[kind]
+}
+
+// acquire waits until disk access of the kind is admitted.
+func (s *_IOScheduler) acquire(kind _IOKind) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting[kind]++
+	for !s.admit(kind) {
+		s.cond.Wait()
+	}
+	s.waiting[kind]--
+	s.active[kind]++
+	s.turns[kind]++
+	s.turns[1-kind] = 0
+}
+
+// release completes disk access of the kind.
+func (s *_IOScheduler) release(kind _IOKind) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[kind]--
+	s.cond.Broadcast()
+}
+
+// ReadAt reads from the file, the read is admitted by the I/O scheduler if it is set.
+func (f *_File) ReadAt(p []byte, off int64) (int, error) {
+	if f.sched == nil {
+		return f.File.ReadAt(p, off)
+	}
+	f.sched.acquire(ioRead)
+	defer f.sched.release(ioRead)
+	return f.File.ReadAt(p, off)
+}
+
+// WriteAt writes to the file, the write is admitted by the I/O scheduler if it is set.
+// Pages written are invalidated in the block cache once the write completes.
+func (f *_File) WriteAt(p []byte, off int64) (int, error) {
+	if f.cache != nil {
+		defer f.cache.invalidate(f.fd.fileType, off, int64(len(p)))
+	}
+	if f.sched == nil {
+		return f.File.WriteAt(p, off)
+	}
+	f.sched.acquire(ioWrite)
+	defer f.sched.release(ioWrite)
+	return f.File.WriteAt(p, off)
+}
+
+// setScheduler sets the I/O scheduler of the files of the file set.
+func (fs *_FileSet) setScheduler(s *_IOScheduler) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, files := range fs.list {
+		files._File.sched = s
+		for num, f := range files.fileMap {
+			f.sched = s
+			files.fileMap[num] = f
+		}
+	}
+}
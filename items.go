@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// Item is a message streamed by DB.ItemsChan.
+type Item = Message
+
+// ValueReader returns a reader of the payload of the message, each call returns a new reader reading
+// the payload from its start. Payload of a message read by a query with StreamValues set is nil, and it is
+// decoded and decompressed by the reader as it is read rather than in memory, so large payloads are read
+// with it in parts. The reader fails with the error decoding the payload, if any.
+func (m *Message) ValueReader() io.Reader {
+	if m.value != nil {
+		return m.value()
+	}
+	return bytes.NewReader(m.Payload)
+}
+
+// ItemsChan streams messages matching the query, newest message first, so consumers can range over
+// messages and pipeline these as needed. Messages are read in pages of the query limit by a goroutine
+// prefetching the next page while the consumer reads the current page, and all messages matching the
+// query are streamed.
+//
+// The items channel is closed once all messages are sent or the query fails, and a failed query sends
+// its error on the error channel before it is closed. Cancel the context to stop the goroutine if the
+// consumer stops before draining the items channel, the error of the context is then sent on the error channel.
+func (db *DB) ItemsChan(ctx context.Context, q *Query) (<-chan *Item, <-chan error) {
+	limit := q.Limit
+	switch {
+	case limit <= 0:
+		limit = db.opts.queryOptions.defaultQueryLimit
+	case limit > db.opts.queryOptions.maxQueryLimit:
+		limit = db.opts.queryOptions.maxQueryLimit
+	}
+	items := make(chan *Item, limit)
+	errC := make(chan error, 1)
+	page := *q
+	page.Limit = limit
+	page.internal.winEntries = nil
+	go func() {
+		defer close(errC)
+		defer close(items)
+		for {
+			if err := ctx.Err(); err != nil {
+				errC <- err
+				return
+			}
+			msgs, err := db.GetMessages(&page)
+			if err != nil {
+				errC <- err
+				return
+			}
+			for i := range msgs {
+				select {
+				case items <- &msgs[i]:
+				case <-db.internal.closeC:
+					errC <- ErrClosed
+					return
+				case <-ctx.Done():
+					errC <- ctx.Err()
+					return
+				}
+			}
+			cursor := page.Cursor()
+			if cursor == nil || len(page.ID) != 0 {
+				return
+			}
+			// The cursor is older than the seek position of the query.
+			page.internal.cursor = cursor
+			page.internal.seekSeq, page.internal.seekTime = 0, 0
+		}
+	}()
+	return items, errC
+}
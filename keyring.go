@@ -0,0 +1,491 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/crypto"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// keySize is the size of an encryption key.
+	keySize = 32
+
+	// maxKeyVersion is the maximum key version. The key version is stored in the low bits of the flag byte
+	// of the message ID, the zero version is used for messages that are not encrypted.
+	maxKeyVersion = block.KeyVersionMask - 1
+
+	// contractKeyVersion is the key version of messages encrypted with the key of their contract.
+	contractKeyVersion = block.KeyVersionMask
+)
+
+// contractKeyCheck is sealed with the key of a contract to check the key when it is set.
+var contractKeyCheck = []byte("unitdb contract key")
+
+// _Keyring holds encryption keys by version. New messages are encrypted with the active key
+// and messages encrypted with an older key are decrypted with the key of their version.
+// The keyring is persisted sealed with the active key, so the DB is opened with the active key.
+// A custom cipher manages its own keys, so it is the only key version and it is not persisted.
+//
+// Keys of contracts are not persisted, only a check sealed with the key of each contract is written
+// to the contract keys file, so messages of a contract are decrypted only if its key is set.
+type _Keyring struct {
+	mu      sync.RWMutex
+	fsys    fs.FileSystem
+	path    string
+	active  uint8
+	custom  bool
+	suite   CipherSuite
+	keys    map[uint8][]byte
+	ciphers map[uint8]crypto.Cipher
+
+	contractsPath   string
+	contractChecks  map[uint32][]byte
+	contractCiphers map[uint32]crypto.Cipher
+}
+
+// _ContractKeyRecord is a contract bound to an encryption key persisted to the contract keys file.
+type _ContractKeyRecord struct {
+	Contract uint32 `json:"contract"`
+	Check    []byte `json:"check"`
+}
+
+func keyringPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.keyring", prefix))
+}
+
+func contractKeysPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.contractkeys", prefix))
+}
+
+// openKeyring reads the keyring from the DB directory. If there is no keyring
+// the key or the custom cipher if it is set is used as first key version.
+func openKeyring(fsys fs.FileSystem, dirName string, key []byte, custom crypto.Cipher, suite CipherSuite) (*_Keyring, error) {
+	kr := &_Keyring{fsys: fsys, path: keyringPath(dirName), suite: suite, keys: make(map[uint8][]byte), ciphers: make(map[uint8]crypto.Cipher)}
+	sealed, err := fs.ReadFile(fsys, kr.path)
+	if os.IsNotExist(err) {
+		if custom != nil {
+			kr.active, kr.custom = 1, true
+			kr.ciphers[1] = custom
+			return kr, nil
+		}
+		return kr, kr.add(1, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if custom != nil {
+		return nil, errCustomCipher
+	}
+	c, err := crypto.NewPayloadCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.Open(nil, sealed, 0)
+	if err != nil {
+		return nil, errBadEncryptionKey
+	}
+	if len(data) < 1 || (len(data)-1)%(keySize+1) != 0 {
+		return nil, ErrCorrupted
+	}
+	for off := 1; off < len(data); off += keySize + 1 {
+		if err := kr.add(data[off], data[off+1:off+1+keySize]); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := kr.keys[data[0]]; !ok {
+		return nil, ErrCorrupted
+	}
+	kr.active = data[0]
+	return kr, nil
+}
+
+// add adds key version to the keyring and makes it the active key.
+func (kr *_Keyring) add(version uint8, key []byte) error {
+	c, err := kr.suite(key)
+	if err != nil {
+		return err
+	}
+	kr.keys[version] = append([]byte(nil), key...)
+	kr.ciphers[version] = c
+	kr.active = version
+	return nil
+}
+
+// cipher returns the active key version and its cipher to encrypt new messages.
+func (kr *_Keyring) cipher() (uint8, crypto.Cipher) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active, kr.ciphers[kr.active]
+}
+
+// cipherOf returns the cipher of the key version to decrypt a message.
+func (kr *_Keyring) cipherOf(version uint8) (crypto.Cipher, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	c, ok := kr.ciphers[version]
+	if !ok {
+		return nil, errKeyVersion
+	}
+	return c, nil
+}
+
+// openContractKeys reads contracts bound to an encryption key from the DB directory and sets the keys of contracts.
+func (kr *_Keyring) openContractKeys(dirName string, keys map[uint32][]byte) error {
+	kr.contractsPath = contractKeysPath(dirName)
+	kr.contractChecks = make(map[uint32][]byte)
+	kr.contractCiphers = make(map[uint32]crypto.Cipher)
+	data, err := fs.ReadFile(kr.fsys, kr.contractsPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		var records []_ContractKeyRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return ErrCorrupted
+		}
+		for _, r := range records {
+			kr.contractChecks[r.Contract] = r.Check
+		}
+	}
+	for contract, key := range keys {
+		if err := kr.setContractKey(contract, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setContractKey sets the key of the contract. The contract is bound to the key if it is not bound to a key,
+// otherwise the key must be the key the contract is bound to.
+func (kr *_Keyring) setContractKey(contract uint32, key []byte) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	c, err := kr.suite(key)
+	if err != nil {
+		return err
+	}
+	ad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ad, contract)
+	if check, ok := kr.contractChecks[contract]; ok {
+		data, err := c.Decrypt(nil, append([]byte(nil), check...), ad)
+		if err != nil || !bytes.Equal(data, contractKeyCheck) {
+			return errBadEncryptionKey
+		}
+		kr.contractCiphers[contract] = c
+		return nil
+	}
+	check, err := c.Encrypt(nil, contractKeyCheck, ad)
+	if err != nil {
+		return err
+	}
+	kr.contractChecks[contract] = check
+	if err := kr.writeContractKeys(); err != nil {
+		delete(kr.contractChecks, contract)
+		return err
+	}
+	kr.contractCiphers[contract] = c
+	return nil
+}
+
+// deleteContractKey unbinds the contract from its key, messages encrypted with the key can no longer be decrypted.
+func (kr *_Keyring) deleteContractKey(contract uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	check, ok := kr.contractChecks[contract]
+	if !ok {
+		return nil
+	}
+	delete(kr.contractChecks, contract)
+	if err := kr.writeContractKeys(); err != nil {
+		kr.contractChecks[contract] = check
+		return err
+	}
+	delete(kr.contractCiphers, contract)
+	return nil
+}
+
+// contractCipher returns the cipher of the contract if the contract is bound to a key.
+// It returns an error if the contract is bound to a key that is not set.
+func (kr *_Keyring) contractCipher(contract uint32) (crypto.Cipher, bool, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if _, ok := kr.contractChecks[contract]; !ok {
+		return nil, false, nil
+	}
+	c, ok := kr.contractCiphers[contract]
+	if !ok {
+		return nil, true, errContractKeyNotSet
+	}
+	return c, true, nil
+}
+
+// writeContractKeys writes contracts bound to a key to a temporary file renamed over the contract keys file.
+// Caller must hold the lock.
+func (kr *_Keyring) writeContractKeys() error {
+	records := make([]_ContractKeyRecord, 0, len(kr.contractChecks))
+	for contract, check := range kr.contractChecks {
+		records = append(records, _ContractKeyRecord{Contract: contract, Check: check})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Contract < records[j].Contract
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(kr.fsys, kr.contractsPath, data, os.FileMode(0600))
+}
+
+// rotate adds a new key version, makes it the active key and persists the keyring sealed with the new key.
+func (kr *_Keyring) rotate(key []byte) (uint8, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.custom {
+		return 0, errCustomCipher
+	}
+	if kr.active == maxKeyVersion {
+		return 0, errKeyVersion
+	}
+	version := kr.active + 1
+	prev := kr.active
+	if err := kr.add(version, key); err != nil {
+		return 0, err
+	}
+	if err := kr.write(key); err != nil {
+		delete(kr.keys, version)
+		delete(kr.ciphers, version)
+		kr.active = prev
+		return 0, err
+	}
+	return version, nil
+}
+
+// write seals keys with the active key and writes these to a temporary file renamed over the keyring file.
+func (kr *_Keyring) write(key []byte) error {
+	data := make([]byte, 1, 1+len(kr.keys)*(keySize+1))
+	data[0] = kr.active
+	for version, k := range kr.keys {
+		data = append(data, version)
+		data = append(data, k...)
+	}
+	c, err := crypto.NewPayloadCipher(key)
+	if err != nil {
+		return err
+	}
+	sealed, err := c.Seal(nil, data, 0)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(kr.fsys, kr.path, sealed, os.FileMode(0600))
+}
+
+// RotateKey adds a new encryption key. New messages are encrypted with the new key while messages
+// encrypted with previous keys are still decrypted with their key. The DB must be opened with the new key
+// afterwards, see WithEncryptionKey. Use Reencrypt to encrypt existing messages with the new key.
+// Keys of a custom cipher are not rotated by the DB, see WithCipher.
+func (db *DB) RotateKey(key []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if len(key) != keySize {
+		return errBadEncryptionKey
+	}
+	version, err := db.internal.keyring.rotate(key)
+	if err != nil {
+		return err
+	}
+	db.internal.logger.Info().Str("context", "db.RotateKey").Int("version", int(version)).Msg("encryption key rotated")
+	return nil
+}
+
+// SetContractKey sets encryption key of the contract, use zero contract for the master contract.
+// If the contract is not bound to a key then new messages of the contract are encrypted with the key
+// instead of keys of the DB, otherwise the key must be the key the contract is bound to.
+// The key is not stored in the DB, so it is set each time the DB is opened, see WithContractKey.
+// Messages of a contract bound to a key cannot be read or written until its key is set.
+func (db *DB) SetContractKey(contract uint32, key []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if len(key) != keySize {
+		return errBadEncryptionKey
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.keyring.setContractKey(contract, key)
+}
+
+// DeleteContractKey unbinds the contract from its encryption key. Messages of the contract encrypted
+// with the key can no longer be decrypted, so these are crypto-shredded and skipped by queries.
+// New messages of the contract are encrypted with keys of the DB unless a new key is set.
+func (db *DB) DeleteContractKey(contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.keyring.deleteContractKey(contract)
+}
+
+// Reencrypt encrypts messages stored with a previous key version with the active key.
+// Messages encrypted with the key of their contract are not re-encrypted.
+// It returns the number of messages re-encrypted.
+func (db *DB) Reencrypt() (int64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+
+	// Re-encryption rewrites data blocks in place, so it excludes sync and compaction.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	return db.reencrypt()
+}
+
+func (db *DB) reencrypt() (int64, error) {
+	version, c := db.internal.keyring.cipher()
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return 0, err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return 0, err
+	}
+	vlogFile, err := db.fs.getFile(_FileDesc{fileType: typeValueLog})
+	if err != nil {
+		return 0, err
+	}
+	type rewrite struct {
+		file *_File
+		off  int64
+		data []byte
+		// msg is set if the data is a message, unlike a value in the value log or a chunk.
+		msg bool
+	}
+	var count int64
+	nIndexBlocks := int32(indexFile.currSize() / indexFile.blockSize())
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		r := _BlockReader{indexFile: indexFile, offset: indexFile.blockOffset(bIdx)}
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return count, err
+		}
+		var rewrites []rewrite
+		for _, e := range b.entries[:b.entryIdx] {
+			if e.seq == 0 || e.isDeleted() {
+				continue
+			}
+			msg, err := readMessageData(dataFile, vlogFile, e)
+			if err != nil {
+				return count, err
+			}
+			// Messages encrypted with the key of their contract are not encrypted with keys of the DB.
+			v := msg[idSize-1] & block.KeyVersionMask
+			if v == 0 || v == version || v == contractKeyVersion {
+				continue
+			}
+			old, err := db.internal.keyring.cipherOf(v)
+			if err != nil {
+				return count, err
+			}
+			ad := msg[:idSize-1]
+			val, err := old.Decrypt(nil, msg[idSize+int(e.topicSize):], ad)
+			if err != nil {
+				return count, err
+			}
+			if val, err = c.Encrypt(nil, val, ad); err != nil {
+				return count, err
+			}
+			// Messages are rewritten in place, so a cipher changing the size of the value cannot re-encrypt.
+			if len(val) != int(e.valueSize) {
+				return count, ErrCorrupted
+			}
+			msg[idSize-1] = msg[idSize-1]&^block.KeyVersionMask | version
+			copy(msg[idSize+int(e.topicSize):], val)
+			if e.valueLog {
+				// The value is rewritten in the value log and the message with the value pointer in the data file.
+				n := idSize + int(e.topicSize)
+				rec, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+				if err != nil {
+					return count, err
+				}
+				var p block.ValuePointer
+				if err := p.UnmarshalBinary(rec[n : n+block.ValuePointerSize]); err != nil {
+					return count, err
+				}
+				rewrites = append(rewrites, rewrite{file: vlogFile, off: p.Offset, data: block.AppendChecksum(val)})
+				msg = append(msg[:n:n], rec[n:n+block.ValuePointerSize]...)
+			}
+			if e.chunked {
+				// Chunks of the value are rewritten and the message with the value pointers of the chunks.
+				n := idSize + int(e.topicSize)
+				rec, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+				if err != nil {
+					return count, err
+				}
+				ptrs, err := block.UnmarshalChunks(rec[n : len(rec)-block.ChecksumSize])
+				if err != nil {
+					return count, err
+				}
+				chunk := val
+				for _, p := range ptrs {
+					if int(p.Size) > len(chunk) {
+						return count, ErrCorrupted
+					}
+					rewrites = append(rewrites, rewrite{file: dataFile, off: p.Offset, data: block.AppendChecksum(append([]byte(nil), chunk[:p.Size]...))})
+					chunk = chunk[p.Size:]
+				}
+				msg = append(msg[:n:n], rec[n:len(rec)-block.ChecksumSize]...)
+			}
+			rewrites = append(rewrites, rewrite{file: dataFile, off: e.msgOffset, data: block.AppendChecksum(msg), msg: true})
+		}
+		if len(rewrites) == 0 {
+			continue
+		}
+		// Block readers while messages are rewritten in place.
+		db.internal.compactLock.Lock()
+		for _, rw := range rewrites {
+			if _, err := rw.file.WriteAt(rw.data, rw.off); err != nil {
+				db.internal.compactLock.Unlock()
+				return count, err
+			}
+			if rw.msg {
+				count++
+			}
+		}
+		db.internal.compactLock.Unlock()
+	}
+	return count, nil
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// _LastValue is the seq and expiry of the most recent message of a topic.
+	_LastValue struct {
+		seq       uint64
+		expiresAt uint32
+	}
+
+	// _LastValues is the last-value index of the DB, it holds the most recent message of topics written
+	// or read by DB.Last since the DB is opened, by topic hash, see WithLastValueCache. The index is nil
+	// unless the DB is opened with the last-value cache.
+	_LastValues struct {
+		mu     sync.RWMutex
+		values map[uint64]_LastValue
+	}
+)
+
+func newLastValues() *_LastValues {
+	return &_LastValues{values: make(map[uint64]_LastValue)}
+}
+
+// set sets the message of the seq as the most recent message of the topic, unless the topic has a newer message.
+func (lv *_LastValues) set(topicHash, seq uint64, expiresAt uint32) {
+	if lv == nil {
+		return
+	}
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	if v, ok := lv.values[topicHash]; ok && v.seq > seq {
+		return
+	}
+	lv.values[topicHash] = _LastValue{seq: seq, expiresAt: expiresAt}
+}
+
+func (lv *_LastValues) get(topicHash uint64) (_LastValue, bool) {
+	if lv == nil {
+		return _LastValue{}, false
+	}
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	v, ok := lv.values[topicHash]
+	return v, ok
+}
+
+// remove removes the message of the seq from the index once it is deleted or expired,
+// unless the topic has a newer message.
+func (lv *_LastValues) remove(topicHash, seq uint64) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	if v, ok := lv.values[topicHash]; ok && v.seq == seq {
+		delete(lv.values, topicHash)
+	}
+}
+
+// reset clears the index, e.g. once messages are written bypassing the memdb.
+func (lv *_LastValues) reset() {
+	if lv == nil {
+		return
+	}
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	lv.values = make(map[uint64]_LastValue)
+}
+
+// lastValue reads the most recent message of the topic by its seq in the last-value index. It returns false
+// if the topic is not in the index or its message is deleted, expired or cannot be decrypted any more,
+// so the message is looked up by a query.
+func (db *DB) lastValue(topicHash uint64) (Message, bool) {
+	lv := db.internal.lastValues
+	v, ok := lv.get(topicHash)
+	if !ok {
+		return Message{}, false
+	}
+	if v.expiresAt != 0 && v.expiresAt <= uint32(time.Now().Unix()) {
+		lv.remove(topicHash, v.seq)
+		return Message{}, false
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	e, err := db.readEntry(_Query{seq: v.seq})
+	if err != nil {
+		lv.remove(topicHash, v.seq)
+		return Message{}, false
+	}
+	id, val, err := db.internal.reader.readMessage(e)
+	if err != nil {
+		return Message{}, false
+	}
+	m, err := db.storedMessage(v.seq, topicHash, v.expiresAt, id, val)
+	if err != nil {
+		lv.remove(topicHash, v.seq)
+		return Message{}, false
+	}
+	return m, true
+}
+
+// Last returns the most recent message of the topic of the contract, use zero contract for the master contract.
+// A DB opened with WithLastValueCache reads the message by its seq from the last-value index, rather than
+// looking up messages of the topic in the time window. It returns ErrMessageNotFound if the topic has no messages.
+// The access key must grant read access to the topic, see WithAccessControl.
+func (db *DB) Last(topic []byte, contract uint32, accessKey string) (Message, error) {
+	if err := db.ok(); err != nil {
+		return Message{}, err
+	}
+	if err := db.checkAccess(accessKey, contract, topic, AccessRead); err != nil {
+		return Message{}, err
+	}
+	return db.last(topic, contract)
+}
+
+// last returns the most recent message of the topic of the contract, see Last.
+func (db *DB) last(topic []byte, contract uint32) (Message, error) {
+	switch {
+	case len(topic) == 0:
+		return Message{}, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return Message{}, errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return Message{}, err
+	}
+	if t.TopicType != message.TopicStatic {
+		return Message{}, errTopicNotStatic
+	}
+	t.AddContract(contract)
+	topicHash := t.GetHash(contract)
+	if m, ok := db.lastValue(topicHash); ok {
+		return m, nil
+	}
+	// Deleted messages are looked up but not returned, so the limit grows while the topic has more messages.
+	for limit := 1; ; limit *= 8 {
+		if limit > db.opts.queryOptions.maxQueryLimit {
+			limit = db.opts.queryOptions.maxQueryLimit
+		}
+		q := NewQuery(topic).WithContract(contract).WithLimit(limit)
+		q.internal.trusted = true
+		msgs, err := db.GetMessages(q)
+		if err != nil {
+			return Message{}, err
+		}
+		if len(msgs) != 0 {
+			db.internal.lastValues.set(topicHash, message.ID(msgs[0].ID).Sequence(), msgs[0].ExpiresAt)
+			return msgs[0], nil
+		}
+		if q.Stats().Visited < limit || limit == db.opts.queryOptions.maxQueryLimit {
+			return Message{}, errTopicNoMessages
+		}
+	}
+}
+
+// retain delivers the most recent message of each topic matching the new subscription, so the subscriber
+// starts from the current state of the topics. Topics written before their names are recorded by the DB
+// are not matched, see DB.Topics.
+func (db *DB) retain(s *Subscription) {
+	var msgs []Message
+	for _, topicHash := range s.topicHashes(db.internal.trie) {
+		m, ok := db.lastValue(topicHash)
+		if !ok {
+			n, ok := db.internal.topicNames.get(topicHash)
+			if !ok {
+				continue
+			}
+			var err error
+			if m, err = db.last([]byte(n.name), n.contract); err != nil {
+				continue
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return message.ID(msgs[i].ID).Sequence() < message.ID(msgs[j].ID).Sequence()
+	})
+	ss := db.internal.subscriptions
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	// The subscription is closed while its messages are read.
+	if _, ok := ss.subs[s]; !ok {
+		return
+	}
+	for _, m := range msgs {
+		select {
+		case s.c <- m:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
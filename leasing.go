@@ -21,6 +21,7 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/unitdb/hash"
 )
@@ -36,7 +37,7 @@ type _Lease struct {
 	file                  _FileSet
 	leases                []*_Leases
 	blocks                []*_FreeBlocks
-	size                  int64 // Total size of free blocks.
+	size                  int64 // Total size of free blocks, accessed atomically.
 	minimumFreeBlocksSize int64 // Minimum free blocks size before free blocks are reused for new allocation.
 	consistent            *hash.Consistent
 }
@@ -167,7 +168,7 @@ func (l *_Lease) freeBlock(off int64, size uint32) {
 	}
 	fbs.fb = append(fbs.fb, _FreeBlock{offset: off, size: size})
 	fbs.cache[off] = true
-	l.size += int64(size)
+	atomic.AddInt64(&l.size, int64(size))
 }
 
 func (l *_Lease) free(seq uint64, off int64, size uint32) {
@@ -177,11 +178,16 @@ func (l *_Lease) free(seq uint64, off int64, size uint32) {
 	l.freeBlock(off, size)
 }
 
+// freeSize returns total size of free blocks.
+func (l *_Lease) freeSize() int64 {
+	return atomic.LoadInt64(&l.size)
+}
+
 func (l *_Lease) allocate(size uint32) int64 {
 	if size == 0 {
 		panic("unable to allocate zero bytes")
 	}
-	if l.size < l.minimumFreeBlocksSize {
+	if atomic.LoadInt64(&l.size) < l.minimumFreeBlocksSize {
 		return -1
 	}
 	fbs := l.freeBlocks(uint64(size))
@@ -201,10 +207,22 @@ func (l *_Lease) allocate(size uint32) int64 {
 		fbs.fb[i].offset += int64(size)
 	}
 	delete(fbs.cache, off)
-	l.size -= int64(size)
+	atomic.AddInt64(&l.size, -int64(size))
 	return off
 }
 
+// reset drops all free blocks, for example once compaction has rewritten the data file.
+func (l *_Lease) reset() {
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		fbs.fb = nil
+		fbs.cache = make(map[int64]bool)
+		fbs.Unlock()
+	}
+	atomic.StoreInt64(&l.size, 0)
+}
+
 func (l *_Lease) read() error {
 	off := int64(0)
 	blocks := &_FreeBlocks{cache: make(map[int64]bool)}
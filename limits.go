@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Limit is a limit applied on writes to the DB.
+type Limit uint8
+
+const (
+	// LimitTopicSize limits the size of a topic in bytes.
+	LimitTopicSize Limit = iota
+	// LimitValueSize limits the size of a value in bytes.
+	LimitValueSize
+	// LimitTopics limits the number of topics in the DB.
+	LimitTopics
+	// LimitDBSize limits the size of the DB files in bytes.
+	LimitDBSize
+	// LimitRate limits the rate of messages written to the DB and by contracts, it is set by WithRateLimit
+	// and by quotas of contracts, so WithLimit ignores it and only its mode is set by WithLimitMode.
+	LimitRate
+
+	nLimits
+)
+
+// String returns name of the limit.
+func (l Limit) String() string {
+	switch l {
+	case LimitTopicSize:
+		return "topic_size"
+	case LimitValueSize:
+		return "value_size"
+	case LimitTopics:
+		return "topics"
+	case LimitDBSize:
+		return "db_size"
+	case LimitRate:
+		return "rate"
+	default:
+		return "unknown"
+	}
+}
+
+// LimitMode sets how a limit is applied when it is exceeded.
+type LimitMode uint8
+
+const (
+	// LimitEnforce rejects a write that exceeds the limit.
+	LimitEnforce LimitMode = iota
+	// LimitObserve accepts a write that exceeds the limit, it only counts and logs the exceeded limit.
+	// It is used to measure impact of a limit before it is enforced.
+	LimitObserve
+	// LimitEvict accepts a write that exceeds a quota on stored bytes or messages of a contract and evicts
+	// the oldest messages of the contract, see Quota. It is only a mode of quotas, not of limits of the DB.
+	LimitEvict
+)
+
+// _Limits holds the limit values and modes. Zero value of a limit is unlimited.
+type _Limits struct {
+	values [nLimits]int64
+	modes  [nLimits]LimitMode
+}
+
+// checkLimit checks value against the limit and returns err if limit is exceeded and enforced.
+func (db *DB) checkLimit(limit Limit, value int64, err error) error {
+	max := db.opts.limits.values[limit]
+	if max == 0 || value <= max {
+		return nil
+	}
+	return db.exceedLimit(limit, value, max, err)
+}
+
+// exceedLimit counts a write exceeding the limit and returns err if the limit is enforced.
+// In observe mode the write is logged and accepted.
+func (db *DB) exceedLimit(limit Limit, value, max int64, err error) error {
+	db.internal.meter.LimitsExceeded.Inc(1)
+	atomic.AddInt64(&db.internal.limitsExceeded[limit], 1)
+	if db.opts.limits.modes[limit] == LimitObserve {
+		db.internal.logger.Warn().Str("context", "db.checkLimit").Str("limit", limit.String()).Int64("value", value).Int64("max", max).Msg("limit exceeded")
+		return nil
+	}
+	return err
+}
+
+// checkEntryLimits checks limits on the entry before it is written to the DB.
+func (db *DB) checkEntryLimits(e *Entry) error {
+	if err := db.checkLimit(LimitTopicSize, int64(len(e.Topic)), errTopicTooLarge); err != nil {
+		return err
+	}
+	if err := db.checkLimit(LimitValueSize, int64(len(e.Payload)), errValueTooLarge); err != nil {
+		return err
+	}
+	return db.checkLimit(LimitDBSize, atomic.LoadInt64(&db.internal.fileSize), errFull)
+}
+
+// checkTopicLimit checks the limit on number of topics before a new topic is added to the DB.
+func (db *DB) checkTopicLimit(e *Entry) error {
+	// topic is packed only on the first entry of a new topic.
+	if e.entry.topicSize == 0 {
+		return nil
+	}
+	return db.checkLimit(LimitTopics, int64(db.internal.trie.Count()+1), errTooManyTopics)
+}
+
+// LimitsExceeded returns number of writes exceeding each limit, including writes accepted in observe mode.
+func (db *DB) LimitsExceeded() map[Limit]int64 {
+	exceeded := make(map[Limit]int64)
+	for l := Limit(0); l < nLimits; l++ {
+		if n := atomic.LoadInt64(&db.internal.limitsExceeded[l]); n > 0 {
+			exceeded[l] = n
+		}
+	}
+	return exceeded
+}
+
+// waitMemdb stalls a write while size of the memdb exceeds its maximum size. The stalled write syncs
+// entries to the DB files, so the memdb is drained even if the background sync is not yet due.
+// It returns ErrWriteStall if the memdb is not drained within the write stall timeout.
+func (db *DB) waitMemdb() error {
+	max := db.opts.maxMemdbSize
+	if max == 0 || db.internal.mem.DataSize() <= max {
+		return nil
+	}
+	db.internal.meter.WriteStalls.Inc(1)
+	deadline := time.Now().Add(db.opts.writeStallTimeout)
+	for {
+		if err := db.Sync(); err != nil {
+			return err
+		}
+		if db.internal.mem.DataSize() <= max {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrWriteStall
+		}
+		// Entries of the time block being written are synced once the time block is complete.
+		time.Sleep(10 * time.Millisecond)
+		if err := db.ok(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/unit-io/unitdb/memdb"
+	"github.com/unit-io/unitdb/wal"
+)
+
+// _ShippedLog summarizes entries of a log archived by the primary.
+type _ShippedLog struct {
+	log    wal.ArchivedLog
+	puts   bool
+	maxSeq uint64
+}
+
+// UpperSeq returns the highest seq written to or applied to the DB. A replica sends its upper seq to the
+// primary to catch up on logs it has not applied, see DB.ShipLogs.
+func (db *DB) UpperSeq() uint64 {
+	return db.seq()
+}
+
+// ShipLogs writes logs applied to the DB of the primary that a replica with the upper seq has not yet applied,
+// in the order these were written to the write ahead log. The primary keeps applied logs in the log archive,
+// see WithLogArchive, and the replica replays these using ApplyLogs. It returns number of logs written.
+//
+// Logs are shipped once the primary syncs these to the DB, so replicas lag behind the primary. Logs shipped
+// start from the first log with an entry the replica has not applied, a replica may receive a log again as
+// entries are not always written to logs in seq order, entries already applied are skipped by ApplyLogs.
+// Entries deleted once synced to the primary are not shipped, as deletes of synced entries are not logged.
+func (db *DB) ShipLogs(w io.Writer, upperSeq uint64) (int, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	archive := db.opts.logArchive
+	if archive.Path == "" {
+		return 0, errNoLogArchive
+	}
+	logs, err := wal.ArchivedLogs(db.opts.fileSystem, archive.Path)
+	if err != nil {
+		return 0, err
+	}
+	var shipped []_ShippedLog
+	for _, l := range logs {
+		s := _ShippedLog{log: l}
+		err := db.readArchivedLog(l, func(key uint64, val []byte, deleted bool) error {
+			if !deleted {
+				s.puts = true
+				if key > s.maxSeq {
+					s.maxSeq = key
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The log is removed by the archive retention.
+				continue
+			}
+			return 0, err
+		}
+		shipped = append(shipped, s)
+	}
+	// Start from the first log with an entry not applied to the replica, including logs of deletes
+	// written before the log.
+	start := len(shipped)
+	for i, s := range shipped {
+		if s.maxSeq > upperSeq {
+			start = i
+			break
+		}
+	}
+	for start > 0 && !shipped[start-1].puts {
+		start--
+	}
+
+	bw := bufio.NewWriter(w)
+	var n int
+	scratch := make([]byte, 4)
+	for _, s := range shipped[start:] {
+		data, err := db.readLog(s.log)
+		if err != nil {
+			return n, err
+		}
+		binary.LittleEndian.PutUint32(scratch, uint32(len(data)))
+		if _, err := bw.Write(scratch); err != nil {
+			return n, err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// ApplyLogs reads logs written by ShipLogs of the primary and replays entries of the logs into the DB
+// of the replica, as entries of a handoff are applied, see DB.ApplyHandoff. Entries already in the DB are
+// skipped and the DB sequence is advanced to the seq of the entries applied. It returns number of entries applied.
+func (db *DB) ApplyLogs(r io.Reader) (int, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(r)
+	var n int
+	scratch := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, scratch); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(scratch))
+		if _, err := io.ReadFull(br, data); err != nil {
+			return n, err
+		}
+		_, records, err := wal.ReadLog(data)
+		if err != nil {
+			return n, err
+		}
+		for _, record := range records {
+			err := memdb.LogRecords(record, func(key uint64, val []byte, deleted bool) error {
+				if deleted {
+					return db.applyLogDelete(key)
+				}
+				applied, err := db.applyHandoffEntry(val)
+				if applied {
+					n++
+				}
+				return err
+			})
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// applyLogDelete deletes the entry deleted from the memdb of the primary.
+func (db *DB) applyLogDelete(seq uint64) error {
+	var topicHash uint64
+	if data, _ := db.internal.mem.Get(seq); data != nil {
+		var e _Entry
+		if err := e.UnmarshalBinary(data[:entrySize]); err == nil {
+			topicHash = e.topicHash
+		}
+	}
+	return db.delete(topicHash, seq)
+}
+
+// readLog reads the archived log, decompressing it if it is compressed.
+func (db *DB) readLog(l wal.ArchivedLog) ([]byte, error) {
+	r, err := wal.OpenArchivedLog(db.opts.fileSystem, l.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// readArchivedLog calls f for each record of entries of the archived log.
+func (db *DB) readArchivedLog(l wal.ArchivedLog, f func(key uint64, val []byte, deleted bool) error) error {
+	data, err := db.readLog(l)
+	if err != nil {
+		return err
+	}
+	_, records, err := wal.ReadLog(data)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := memdb.LogRecords(record, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
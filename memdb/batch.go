@@ -68,6 +68,9 @@ func (b *Batch) Put(key uint64, data []byte) error {
 
 	block.Lock()
 	defer block.Unlock()
+	if block.released {
+		return errForbidden
+	}
 	ikey := iKey(false, key)
 	if err := block.put(ikey, data); err != nil {
 		return err
@@ -86,10 +89,10 @@ func (b *Batch) Write() error {
 		<-b.writeLockC
 	}()
 	b.batchGroup = append(b.batchGroup, b.tinyLog.timeID())
-	b.db.internal.logManager.writeWait(b.tinyLog)
+	err := b.db.internal.logManager.writeWait(b.tinyLog)
 	b.newTinyLog()
 
-	return nil
+	return err
 }
 
 // Commit commits changes to the DB. In batch operation commit is managed and client is not allowed to call Commit.
@@ -119,6 +122,9 @@ func (b *Batch) Commit() error {
 //Abort aborts batch or perform cleanup operation on batch complete.
 func (b *Batch) Abort() error {
 	_assert(!b.managed, "managed batch abort not allowed")
+	if b.db == nil {
+		return nil
+	}
 	for _, ID := range b.batchGroup {
 		if err := b.db.releaseLog(ID); err != nil {
 			return err
@@ -53,6 +53,7 @@ type (
 
 		timeRefs   []_TimeID
 		lastOffset int64 // last offset of block data written to the log
+		released   bool  // block data is returned to the buffer pool
 	}
 )
 
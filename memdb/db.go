@@ -19,7 +19,6 @@ package memdb
 import (
 	"encoding/binary"
 	"errors"
-	"os"
 	"sort"
 	"sync"
 	"time"
@@ -55,7 +54,7 @@ func Open(opts ...Options) (*DB, error) {
 	}
 
 	// Make sure we have a directory.
-	if err := os.MkdirAll(options.logFilePath, 0777); err != nil {
+	if err := options.fileSystem.MkdirAll(options.logFilePath, 0777); err != nil {
 		return nil, errors.New("DB.Open, Unable to create db dir")
 	}
 
@@ -69,7 +68,7 @@ func Open(opts ...Options) (*DB, error) {
 		// buffer pool
 		buffer: bufPool,
 	}
-	logOpts := wal.Options{Path: options.logFilePath + "/" + logDir, BufferSize: options.bufferSize, Reset: options.logResetFlag}
+	logOpts := wal.Options{Path: options.logFilePath + "/" + LogDir, BufferSize: options.bufferSize, Reset: options.logResetFlag, Sync: options.logSyncPolicy, Archive: options.logArchive, FileSystem: options.fileSystem, Preallocate: options.logPreallocate, RecycleLogs: options.logRecycle}
 	wal, err := wal.New(logOpts)
 	if err != nil {
 		wal.Close()
@@ -101,7 +100,7 @@ func Open(opts ...Options) (*DB, error) {
 	db.newQueryManager()
 
 	// Log Manager
-	db.newLogManager(&_TinyLogOptions{poolCapacity: nPoolSize, writeInterval: options.logInterval, blockDuration: options.timeBlockDuration})
+	db.newLogManager(&_TinyLogOptions{poolCapacity: nPoolSize, writeInterval: options.logInterval, maxBytes: options.logMaxBytes, blockDuration: options.timeBlockDuration})
 
 	return db, nil
 }
@@ -112,6 +111,8 @@ func (db *DB) Close() error {
 		return err
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if db.timeBlocks != nil {
 		db.timeBlocks = nil
 		db.version = -1
@@ -181,6 +182,12 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 		return nil, err
 	}
 
+	db.internal.queryManager.Lock()
+	defer db.internal.queryManager.Unlock()
+	return db.get(key)
+}
+
+func (db *DB) get(key uint64) ([]byte, error) {
 	db.mu.RLock()
 	// Get time block
 	blockKey := db.blockKey(key)
@@ -252,7 +259,7 @@ func (db *DB) Get(key uint64) ([]byte, error) {
 	// reset timeBlock and start over
 	db.internal.queryManager.timeFilters[blockKey] = &_TimeFilter{timeRecords: make(map[_TimeID]*filter.Block), filter: filter.NewFilterGenerator()}
 
-	return db.Get(key)
+	return db.get(key)
 }
 
 // BlockIterator iterates all time blocks from DB committed to the WAL.
@@ -321,12 +328,7 @@ func (db *DB) Delete(key uint64) error {
 			_, ok := block.records[ikey]
 			block.RUnlock()
 			if !ok {
-				r.RLock()
-				fltr := r.timeRecords[timeID]
-				r.RUnlock()
-				if !fltr.Test(key) {
-					return errEntryDoesNotExist
-				}
+				// Keys put after a batch block is added can be in an older block, see seek.
 				continue
 			}
 
@@ -335,6 +337,11 @@ func (db *DB) Delete(key uint64) error {
 			defer timeLock.RUnlock()
 
 			block.Lock()
+			if _, ok := block.records[ikey]; !ok || block.released {
+				// The key is deleted or the block is released concurrently since it is looked up.
+				block.Unlock()
+				return errEntryDoesNotExist
+			}
 			block.delete(key)
 			db.internal.meter.Dels.Inc(1)
 			if block.count == 0 {
@@ -379,11 +386,15 @@ func (db *DB) Put(key uint64, data []byte) (int64, error) {
 
 	block.Lock()
 	defer block.Unlock()
+	if block.released {
+		return 0, errForbidden
+	}
 	ikey := iKey(false, key)
 	if err := block.put(ikey, data); err != nil {
 		return int64(timeID), err
 	}
 	db.addTimeFilter(timeID, key)
+	db.internal.logManager.grow(len(data))
 
 	db.internal.meter.Puts.Inc(1)
 
@@ -417,11 +428,42 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 	return b.Commit()
 }
 
+// Flush writes entries put to the DB to the WAL and waits for the write to complete.
+// Once it returns the time blocks of these entries are returned by BlockIterator.
+func (db *DB) Flush() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	return db.internal.logManager.flush(0)
+}
+
+// FlushAfter flushes the DB as Flush does, and entries put once it returns are in a time block
+// after the time ID, so these are ordered after entries of a batch with the time ID.
+func (db *DB) FlushAfter(timeID int64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	return db.internal.logManager.flush(_TimeID(timeID) + 1)
+}
+
 // Free frees time block from DB for a provided time ID and releases block from WAL.
 func (db *DB) Free(timeID int64) error {
 	return db.releaseLog(_TimeID(timeID))
 }
 
+// LogSize returns total size of the write ahead logs not yet released.
+func (db *DB) LogSize() int64 {
+	return db.internal.wal.Size()
+}
+
+// VerifyLog verifies the write ahead logs not yet released. It returns number of
+// logs verified and an error for each log that is torn or corrupted.
+func (db *DB) VerifyLog() (int, []error) {
+	return db.internal.wal.Verify()
+}
+
 // Size returns the total number of entries in DB.
 func (db *DB) Size() int64 {
 	size := int64(0)
@@ -436,3 +478,23 @@ func (db *DB) Size() int64 {
 
 	return size
 }
+
+// DataSize returns the total size in bytes of entries held in DB.
+func (db *DB) DataSize() int64 {
+	size := int64(0)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, block := range db.timeBlocks {
+		block.RLock()
+		size += block.data.Size()
+		block.RUnlock()
+	}
+
+	return size
+}
+
+// QueueLen returns number of tiny logs queued to commit to the write ahead log.
+func (db *DB) QueueLen() int {
+	return db.internal.logManager.queueLen()
+}
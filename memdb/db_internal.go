@@ -32,7 +32,8 @@ import (
 const (
 	dbVersion = 1.0
 
-	logDir = "logs"
+	// LogDir is the directory of the WAL in the log file path.
+	LogDir = "logs"
 
 	nPoolSize = 27
 
@@ -132,6 +133,10 @@ func (db *DB) cap() float64 {
 func (db *DB) addTimeBlock(timeID _TimeID) (ok bool) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.timeBlocks == nil {
+		// DB is closed.
+		return false
+	}
 	if _, ok := db.timeBlocks[timeID]; !ok {
 		db.timeBlocks[timeID] = &_Block{data: db.internal.buffer.Get(), records: make(map[_Key]int64)}
 		return true
@@ -224,12 +229,8 @@ func (db *DB) seek(key uint64, cutoff int64) error {
 				}
 				return nil
 			}
-			r.RLock()
-			fltr := r.timeRecords[timeID]
-			r.RUnlock()
-			if !fltr.Test(key) {
-				return errEntryDoesNotExist
-			}
+			// A batch writes to a time block newer than the current time block, so the time filter
+			// of a newer block does not rule out keys put to an older block after it is added.
 		}
 	}
 
@@ -297,8 +298,11 @@ func (db *DB) tinyWrite(tinyLog *_TinyLog) error {
 }
 
 // tinyCommit commits tiny log to DB.
-func (db *DB) tinyCommit(tinyLog *_TinyLog) error {
-	defer tinyLog.abort()
+func (db *DB) tinyCommit(tinyLog *_TinyLog) (err error) {
+	defer func() {
+		tinyLog.err = err
+		tinyLog.abort()
+	}()
 
 	if err := db.tinyWrite(tinyLog); err != nil {
 		return err
@@ -312,6 +316,11 @@ func (db *DB) tinyCommit(tinyLog *_TinyLog) error {
 }
 
 func (db *DB) releaseLog(timeID _TimeID) error {
+	// Data of the released block is reused by a new time block so it is removed from the query plan.
+	db.internal.queryManager.Lock()
+	defer db.internal.queryManager.Unlock()
+	delete(db.internal.queryManager.timeBlocks, timeID)
+
 	db.mu.RLock()
 	block, ok := db.timeBlocks[timeID]
 	db.mu.RUnlock()
@@ -319,8 +328,10 @@ func (db *DB) releaseLog(timeID _TimeID) error {
 		return errEntryDoesNotExist
 	}
 
-	block.RLock()
-	defer block.RUnlock()
+	// The block is locked so a tiny log of the block being written to the WAL reads its data
+	// before the data is returned to the buffer pool.
+	block.Lock()
+	defer block.Unlock()
 	for _, timeRef := range block.timeRefs {
 		if err := db.internal.wal.SignalLogApplied(int64(timeRef)); err != nil {
 			return err
@@ -332,6 +343,7 @@ func (db *DB) releaseLog(timeID _TimeID) error {
 	delete(db.timeBlocks, _TimeID(timeID))
 	db.internal.timeMark.timeUnref(timeID)
 
+	block.released = true
 	db.internal.buffer.Put(block.data)
 
 	return nil
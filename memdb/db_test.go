@@ -17,8 +17,10 @@
 package memdb
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSimple(t *testing.T) {
@@ -206,3 +208,149 @@ func TestLogRelease(t *testing.T) {
 	}
 	verifyAndClose()
 }
+
+// TestKeyCollision checks pending entries are keyed by the full key, so keys of the same block
+// and keys differing only in high bits do not overwrite each other in the DB or in the log.
+func TestKeyCollision(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []uint64{1, 1 ^ 1<<32, 1 ^ 1<<63}
+	for k := uint64(2); len(keys) < 6; k++ {
+		if db.blockKey(k) == db.blockKey(1) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if _, err := db.Put(k, []byte(fmt.Sprintf("msg.%d", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verifyMsgs := func() {
+		if size := db.Size(); size != int64(len(keys)) {
+			t.Fatalf("expected %d records; got %d", len(keys), size)
+		}
+		for _, k := range keys {
+			v, err := db.Get(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := fmt.Sprintf("msg.%d", k); string(v) != expected {
+				t.Fatalf("key %d: expected %s; got %s", k, expected, v)
+			}
+		}
+	}
+	verifyMsgs()
+
+	// Close and open db to recover entries from log file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(WithLogFilePath("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyMsgs()
+
+	for _, k := range keys {
+		if err := db.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := db.Size(); size != 0 {
+		t.Fatalf("expected zero records; got %d", size)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutAfterBatch(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A batch writes to a time block newer than the current time block of later puts.
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(1, []byte("msg.1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for k := uint64(2); k < 10; k++ {
+		if _, err := db.Put(k, []byte(fmt.Sprintf("msg.%d", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k := uint64(1); k < 10; k++ {
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("key %d: %v", k, err)
+		}
+		if expected := fmt.Sprintf("msg.%d", k); string(v) != expected {
+			t.Fatalf("key %d: expected %s; got %s", k, expected, v)
+		}
+	}
+	for k := uint64(1); k < 10; k++ {
+		if err := db.Delete(k); err != nil {
+			t.Fatalf("key %d: %v", k, err)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for k := uint64(1); k < 10; k++ {
+		if _, err := db.Put(k, []byte(fmt.Sprintf("msg.%d", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Flushed entries are committed to the WAL, so these are returned by the block iterator.
+	var n int
+	if err := db.BlockIterator(func(timeID int64, keys []uint64) (bool, error) {
+		n += len(keys)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 9 {
+		t.Fatalf("expected 9 keys; got %d", n)
+	}
+	if db.LogSize() == 0 {
+		t.Fatal("expected entries written to the log")
+	}
+}
+
+func TestLogMaxBytes(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset(), WithLogInterval(time.Hour), WithLogMaxBytes(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for k := uint64(1); k < 10; k++ {
+		if _, err := db.Put(k, []byte(fmt.Sprintf("message.%08d", k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The tiny log exceeds max bytes, so it is written to the WAL well before the log interval.
+	deadline := time.Now().Add(5 * time.Second)
+	for db.LogSize() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected entries written to the log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
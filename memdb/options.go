@@ -18,6 +18,9 @@ package memdb
 
 import (
 	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/wal"
 )
 
 type _Options struct {
@@ -34,7 +37,25 @@ type _Options struct {
 
 	logInterval time.Duration
 
+	// logMaxBytes sets size in bytes of entries put to the tiny log before it is written to the WAL ahead of logInterval.
+	logMaxBytes int64
+
 	timeBlockDuration time.Duration
+
+	// logSyncPolicy sets durability policy of logs written to the WAL.
+	logSyncPolicy wal.SyncPolicy
+
+	// logArchive sets the policy for logs applied to the DB, applied logs are deleted by default.
+	logArchive wal.ArchiveOptions
+
+	// logPreallocate sets size in bytes of disk blocks reserved for a log.
+	logPreallocate int64
+
+	// logRecycle sets the number of applied log files reused to write new logs.
+	logRecycle int
+
+	// fileSystem is the file system logs are stored on.
+	fileSystem fs.FileSystem
 }
 
 // Options it contains configurable options and flags for DB.
@@ -76,6 +97,9 @@ func WithDefaultOptions() Options {
 		if o.timeBlockDuration == 0 {
 			o.timeBlockDuration = 1 * time.Second
 		}
+		if o.fileSystem == nil {
+			o.fileSystem = fs.OS
+		}
 	})
 }
 
@@ -114,6 +138,49 @@ func WithLogInterval(dur time.Duration) Options {
 	})
 }
 
+// WithLogMaxBytes sets size in bytes of entries put to the DB after which these are written to the WAL
+// without waiting for the log interval. Zero writes entries on the log interval only.
+func WithLogMaxBytes(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logMaxBytes = size
+	})
+}
+
+// WithLogSyncPolicy sets when logs written to the WAL are fsynced.
+func WithLogSyncPolicy(policy wal.SyncPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logSyncPolicy = policy
+	})
+}
+
+// WithLogArchive sets the policy for logs applied to the DB, see wal.ArchiveOptions.
+func WithLogArchive(archive wal.ArchiveOptions) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logArchive = archive
+	})
+}
+
+// WithLogPreallocate sets size in bytes of disk blocks reserved for a log before it is written to the WAL.
+func WithLogPreallocate(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logPreallocate = size
+	})
+}
+
+// WithLogRecycle sets the number of applied log files the WAL reuses to write new logs.
+func WithLogRecycle(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logRecycle = n
+	})
+}
+
+// WithFileSystem sets the file system logs are stored on.
+func WithFileSystem(fsys fs.FileSystem) Options {
+	return newFuncOption(func(o *_Options) {
+		o.fileSystem = fsys
+	})
+}
+
 // WithTimeBlockInterval sets interval for a time block. Block is pushed to the queue to write it to the log file.
 func WithTimeBlockInterval(dur time.Duration) Options {
 	return newFuncOption(func(o *_Options) {
@@ -16,6 +16,8 @@
 
 package memdb
 
+import "sync"
+
 type _QueryManager struct {
 	timeRcord   _TimeID
 	timeFilters map[_BlockKey]*_TimeFilter
@@ -23,4 +25,6 @@ type _QueryManager struct {
 
 	cutoff _TimeID
 	limit  int
+
+	sync.Mutex // guards query plan as Get caches time blocks released from the DB.
 }
@@ -77,6 +77,27 @@ func (db *DB) delete(key uint64) error {
 	return errEntryDoesNotExist
 }
 
+// LogRecords calls f for each record of a log record written to the WAL by the DB, in the order these were written.
+// A deleted record holds the key deleted from the DB, val of a deleted record is the time ID of the entry deleted.
+func LogRecords(logData []byte, f func(key uint64, val []byte, deleted bool) error) error {
+	var off int
+	for off < len(logData) {
+		if off+4 > len(logData) {
+			return errLogInvalid
+		}
+		dataLen := int(binary.LittleEndian.Uint32(logData[off : off+4]))
+		if dataLen < 13 || off+dataLen > len(logData) {
+			return errLogInvalid
+		}
+		data := logData[off+4 : off+dataLen]
+		off += dataLen
+		if err := f(binary.LittleEndian.Uint64(data[1:9]), data[9:], data[0] == 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // startRecovery recovers pending entries from the WAL.
 func (db *DB) startRecovery() error {
 	db.mu.RLock()
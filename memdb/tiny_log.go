@@ -19,6 +19,7 @@ package memdb
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,6 +39,9 @@ type _TinyLog struct {
 
 	managed  bool
 	doneChan chan struct{}
+
+	// err is the error writing the log to the WAL, it is set before doneChan is closed.
+	err error
 }
 
 func (l *_TinyLog) ID() _TimeID {
@@ -61,6 +65,12 @@ type (
 		// writeInterval default value is 100ms, setting writeInterval to zero disables writing the log to the WAL.
 		writeInterval time.Duration
 
+		// maxBytes is size of entries put to the tiny log after which it is written
+		// to the WAL before the writeInterval elapses.
+		//
+		// Default value is zero, the log is written on the writeInterval only.
+		maxBytes int64
+
 		// timeout controls how often log pool kill idle jobs.
 		//
 		// Default value is 2 seconds
@@ -83,15 +93,21 @@ type (
 		logCount int
 	}
 	_TinyLogManager struct {
+		// logSize is size of entries put to the tiny log, it is accessed atomically
+		// and kept first in the struct for 64-bit alignment.
+		logSize int64
+
 		mu         sync.RWMutex
 		db         *DB
 		opts       *_TinyLogOptions
 		tinyLog    *_TinyLog
 		writeQueue chan *_TinyLog
 		logQueue   chan *_TinyLog
+		full       chan struct{}
 		stop       chan struct{}
 		stopOnce   sync.Once
 		stopWg     sync.WaitGroup
+		stopped    bool
 	}
 )
 
@@ -119,9 +135,14 @@ func (src *_TinyLogOptions) withDefaultOptions() *_TinyLogOptions {
 	return &opts
 }
 
-func (p *_TinyLogManager) newTinyLog() {
+// newTinyLog starts a new tiny log. Its time ID is not before minTimeID, so a time
+// block is not written to again once a later time block is started.
+func (p *_TinyLogManager) newTinyLog(minTimeID _TimeID) {
 	timeNow := time.Now().UTC()
 	timeID := _TimeID(timeNow.Truncate(p.opts.blockDuration).UnixNano())
+	if timeID < minTimeID {
+		timeID = minTimeID
+	}
 	p.db.addTimeBlock(timeID)
 	p.db.internal.timeMark.add(timeID)
 	p.tinyLog = &_TinyLog{id: _TimeID(timeNow.UnixNano()), _TimeID: timeID, managed: false, doneChan: make(chan struct{})}
@@ -135,10 +156,21 @@ func (db *DB) newLogManager(opts *_TinyLogOptions) {
 		tinyLog:    &_TinyLog{},
 		writeQueue: make(chan *_TinyLog, 1),
 		logQueue:   make(chan *_TinyLog, opts.poolCapacity),
+		full:       make(chan struct{}, 1),
 		stop:       make(chan struct{}),
 	}
 
-	logManager.newTinyLog()
+	// start the first tiny log after time blocks recovered from the log
+	// so new writes do not share a block with recovered entries.
+	var minTimeID _TimeID
+	db.mu.RLock()
+	for timeID := range db.timeBlocks {
+		if timeID >= minTimeID {
+			minTimeID = timeID + 1
+		}
+	}
+	db.mu.RUnlock()
+	logManager.newTinyLog(minTimeID)
 
 	// start the write loop
 	go logManager.writeLoop(opts.writeInterval)
@@ -163,11 +195,31 @@ func (p *_TinyLogManager) timeID() _TimeID {
 	return p.tinyLog.timeID()
 }
 
+// grow adds size of an entry put to the tiny log, it signals the write loop
+// once the tiny log reaches maxBytes.
+func (p *_TinyLogManager) grow(n int) {
+	if p.opts.maxBytes <= 0 {
+		return
+	}
+	if atomic.AddInt64(&p.logSize, int64(n)) < p.opts.maxBytes {
+		return
+	}
+	select {
+	case p.full <- struct{}{}:
+	default:
+	}
+}
+
 // size returns maximum number of concurrent jobs.
 func (p *_TinyLogManager) size() int {
 	return p.opts.poolCapacity
 }
 
+// queueLen returns number of logs queued to commit to the WAL.
+func (p *_TinyLogManager) queueLen() int {
+	return len(p.writeQueue) + len(p.logQueue)
+}
+
 // close tells dispatcher to exit, and wether or not complete queued jobs.
 func (p *_TinyLogManager) close(wait bool) {
 	p.stopOnce.Do(func() {
@@ -189,13 +241,37 @@ func (p *_TinyLogManager) write() {
 	}
 }
 
-// writeWait enqueues the log and waits for it to be executed.
-func (p *_TinyLogManager) writeWait(tinyLog *_TinyLog) {
+// writeWait enqueues the log and waits for it to be executed. It returns the error writing the log to the WAL.
+func (p *_TinyLogManager) writeWait(tinyLog *_TinyLog) error {
 	if tinyLog == nil {
-		return
+		return nil
+	}
+	// The write queue is closed once the log manager is stopped.
+	p.mu.RLock()
+	if p.stopped {
+		p.mu.RUnlock()
+		return errClosed
 	}
 	p.writeQueue <- tinyLog
+	p.mu.RUnlock()
 	<-tinyLog.doneChan
+	return tinyLog.err
+}
+
+// flush writes the current tiny log to the WAL and waits for the write to complete.
+// The next tiny log starts a new time block, so the flushed time block is released once written.
+// The time block is not before minTimeID.
+func (p *_TinyLogManager) flush(minTimeID _TimeID) error {
+	p.mu.Lock()
+	tinyLog := p.tinyLog
+	if minTimeID <= tinyLog.timeID() {
+		minTimeID = tinyLog.timeID() + 1
+	}
+	p.newTinyLog(minTimeID)
+	atomic.StoreInt64(&p.logSize, 0)
+	p.mu.Unlock()
+
+	return p.writeWait(tinyLog)
 }
 
 // writeLoop enqueue the tiny log to the log pool.
@@ -211,34 +287,42 @@ func (p *_TinyLogManager) writeLoop(interval time.Duration) {
 	for {
 		select {
 		case <-p.stop:
+			p.mu.Lock()
 			p.write()
+			p.stopped = true
 			close(p.writeQueue)
+			p.mu.Unlock()
 
 			return
 		case <-writeC:
-			// check buffer pool backoff and capacity for excess memory usage
-			// before writing tiny log to the WAL.
-			switch {
-			case p.db.cap() > 0.7:
-				block, ok := p.db.timeBlock(p.db.timeID())
-				if !ok {
-					break
-				}
-				block.RLock()
-				size := block.data.Size()
-				block.RUnlock()
-				if size < 1<<20 {
-					break
-				}
-				fallthrough
-			default:
-				p.mu.Lock()
-				p.write()
-				p.newTinyLog()
-				p.mu.Unlock()
-			}
+			p.writeTinyLog()
+		case <-p.full:
+			p.writeTinyLog()
+		}
+	}
+}
+
+// writeTinyLog enqueues the tiny log to write and starts a new tiny log.
+func (p *_TinyLogManager) writeTinyLog() {
+	// check buffer pool backoff and capacity for excess memory usage
+	// before writing tiny log to the WAL.
+	if p.db.cap() > 0.7 {
+		block, ok := p.db.timeBlock(p.db.timeID())
+		if !ok {
+			return
+		}
+		block.RLock()
+		size := block.data.Size()
+		block.RUnlock()
+		if size < 1<<20 {
+			return
 		}
 	}
+	p.mu.Lock()
+	p.write()
+	p.newTinyLog(p.tinyLog.timeID())
+	atomic.StoreInt64(&p.logSize, 0)
+	p.mu.Unlock()
 }
 
 // dispatch handles tiny log commit for the jobs in queue.
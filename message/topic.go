@@ -33,13 +33,17 @@ const (
 	TopicInvalid = uint8(iota)
 	TopicStatic
 	TopicWildcard
-	TopicWildcardSymbol = '*'
-	TopicGenericSymbol  = "..."
-	TopicSeparator      = '.' // The separator character.
-	TopicMaxDepth       = 100 // Maximum depth for topic using a separator
+	TopicWildcardSymbol    = '*'
+	TopicGenericSymbol     = "..."
+	TopicSubtreeSymbol     = '#'
+	TopicSingleLevelSymbol = '+'
+	TopicSeparator         = '.' // The separator character.
+	TopicMaxDepth          = 100 // Maximum depth for topic using a separator
 
 	// Wildcard wildcard is hash for wildcard topic such as '*' or '...'
 	Wildcard = uint32(857445537)
+	// SingleLevel is hash for single-level wildcard '+' of a query topic, it matches any part at its level.
+	SingleLevel = uint32(1297743379)
 )
 
 // TopicOption represents a key/value pair option.
@@ -255,6 +259,10 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 
 	depth := uint8(0)
 	q := []byte(TopicGenericSymbol)
+	// The subtree symbol is same as the generic symbol i.e. "unit8.#" is parsed as "unit8...".
+	if n := len(topic.Topic); n > 0 && topic.Topic[n-1] == TopicSubtreeSymbol && (n == 1 || topic.Topic[n-2] == TopicSeparator) {
+		topic.Topic = append(topic.Topic[:n-1:n-1], q...)
+	}
 	if bytes.HasSuffix(topic.Topic, q) {
 		depth++
 		topic.Topic = bytes.TrimRight(topic.Topic, string(TopicGenericSymbol))
@@ -280,6 +288,10 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 			continue
 		}
 		part.Hash = hash.WithSalt(p, contract)
+		if len(p) == 1 && p[0] == TopicSingleLevelSymbol {
+			part.Hash = SingleLevel
+			topic.TopicType = TopicWildcard
+		}
 		topic.Parts = append(topic.Parts, part)
 		if wildchars > 0 {
 			if idx-wildcharcount-1 >= 0 {
@@ -40,6 +40,48 @@ type Meter struct {
 	OutMsgs    metrics.Counter
 	InBytes    metrics.Counter
 	OutBytes   metrics.Counter
+
+	LimitsExceeded metrics.Counter
+	TimeAdjusted   metrics.Counter
+	TimeRejected   metrics.Counter
+	WriteStalls    metrics.Counter
+
+	BlockCacheHits   metrics.Counter
+	BlockCacheMisses metrics.Counter
+
+	sink Metrics
+}
+
+// Metrics is a sink the DB reports metrics to in addition to the meter, see WithMetrics.
+// It lets metrics be exported to statsd, expvar or any other registry. Counter names are
+// those of the Varz JSON fields, the "seq", "count" and "file_size" gauges and the
+// "sync_seconds" histogram are reported on each sync. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Counter adds delta to the named counter.
+	Counter(name string, delta int64)
+	// Gauge sets the named gauge to value.
+	Gauge(name string, value float64)
+	// Histogram records value as an observation of the named histogram.
+	Histogram(name string, value float64)
+}
+
+// _SinkCounter is a meter counter also reporting changes to the metrics sink.
+type _SinkCounter struct {
+	metrics.Counter
+	name string
+	sink Metrics
+}
+
+// Dec decrements the counter by the given amount.
+func (c _SinkCounter) Dec(i int64) {
+	c.Counter.Dec(i)
+	c.sink.Counter(c.name, -i)
+}
+
+// Inc increments the counter by the given amount.
+func (c _SinkCounter) Inc(i int64) {
+	c.Counter.Inc(i)
+	c.sink.Counter(c.name, i)
 }
 
 // NewMeter provide meter to capture statistics.
@@ -59,6 +101,14 @@ func NewMeter() *Meter {
 		OutMsgs:    metrics.NewCounter(),
 		InBytes:    metrics.NewCounter(),
 		OutBytes:   metrics.NewCounter(),
+
+		LimitsExceeded: metrics.NewCounter(),
+		TimeAdjusted:   metrics.NewCounter(),
+		TimeRejected:   metrics.NewCounter(),
+		WriteStalls:    metrics.NewCounter(),
+
+		BlockCacheHits:   metrics.NewCounter(),
+		BlockCacheMisses: metrics.NewCounter(),
 	}
 
 	c.TimeSeries.Time(func() {})
@@ -72,10 +122,59 @@ func NewMeter() *Meter {
 	Metrics.GetOrRegister("InMsgs", c.InMsgs)
 	Metrics.GetOrRegister("OutMsgs", c.OutMsgs)
 	Metrics.GetOrRegister("InBytes", c.InBytes)
+	Metrics.GetOrRegister("LimitsExceeded", c.LimitsExceeded)
+	Metrics.GetOrRegister("TimeAdjusted", c.TimeAdjusted)
+	Metrics.GetOrRegister("TimeRejected", c.TimeRejected)
+	Metrics.GetOrRegister("WriteStalls", c.WriteStalls)
+	Metrics.GetOrRegister("BlockCacheHits", c.BlockCacheHits)
+	Metrics.GetOrRegister("BlockCacheMisses", c.BlockCacheMisses)
 
 	return c
 }
 
+// setSink reports changes of the meter counters to the metrics sink.
+func (m *Meter) setSink(sink Metrics) {
+	m.sink = sink
+	for _, c := range []struct {
+		name    string
+		counter *metrics.Counter
+	}{
+		{"gets", &m.Gets},
+		{"puts", &m.Puts},
+		{"leases", &m.Leases},
+		{"syncs", &m.Syncs},
+		{"recovers", &m.Recovers},
+		{"aborts", &m.Aborts},
+		{"dels", &m.Dels},
+		{"in_msgs", &m.InMsgs},
+		{"out_msgs", &m.OutMsgs},
+		{"in_bytes", &m.InBytes},
+		{"out_bytes", &m.OutBytes},
+		{"limits_exceeded", &m.LimitsExceeded},
+		{"time_adjusted", &m.TimeAdjusted},
+		{"time_rejected", &m.TimeRejected},
+		{"write_stalls", &m.WriteStalls},
+		{"block_cache_hits", &m.BlockCacheHits},
+		{"block_cache_misses", &m.BlockCacheMisses},
+	} {
+		*c.counter = _SinkCounter{Counter: *c.counter, name: c.name, sink: sink}
+	}
+}
+
+// gauge sets the named gauge of the metrics sink, if any.
+func (m *Meter) gauge(name string, value float64) {
+	if m.sink != nil {
+		m.sink.Gauge(name, value)
+	}
+}
+
+// histogram records value of the named histogram of the metrics sink, if any.
+func (m *Meter) histogram(name string, value float64) {
+	if m.sink != nil {
+		m.sink.Histogram(name, value)
+	}
+}
+
 // UnregisterAll unregister all metrics from meter.
 func (m *Meter) UnregisterAll() {
 	m.Metrics.UnregisterAll()
@@ -113,6 +212,29 @@ type Varz struct {
 	// Range     		 time.Duration `json:"range"`    // Event duration range (Max-Min).
 	// // Per-second rate based on event duration avg. via Metrics.Cumulative / Metrics.Samples.
 	// Rate 			float64 `json:"rate"`
+
+	// Most recent maintenance runs.
+	LastExpiry     *RunReport `json:"last_expiry,omitempty"`
+	LastCompaction *RunReport `json:"last_compaction,omitempty"`
+	LastRetention  *RunReport `json:"last_retention,omitempty"`
+
+	// Compaction in progress and fraction of blocks processed.
+	Compacting         bool    `json:"compacting"`
+	CompactionProgress float64 `json:"compaction_progress"`
+
+	// Number of writes exceeding each limit, including writes accepted in observe mode.
+	LimitsExceeded map[string]int64 `json:"limits_exceeded,omitempty"`
+
+	// Number of writes older than the newest entry of their topic adjusted or rejected, see WithMonotonicTime.
+	TimeAdjusted int64 `json:"time_adjusted"`
+	TimeRejected int64 `json:"time_rejected"`
+
+	// Number of writes stalled on a full memdb, see WithMaxMemdbSize.
+	WriteStalls int64 `json:"write_stalls"`
+
+	// Number of reads of index and data blocks served from or missed in the block cache, see WithBlockCacheSize.
+	BlockCacheHits   int64 `json:"block_cache_hits"`
+	BlockCacheMisses int64 `json:"block_cache_misses"`
 }
 
 func uptime(d time.Duration) string {
@@ -156,6 +278,27 @@ func (db *DB) Varz() (*Varz, error) {
 	v.OutMsgs = db.internal.meter.OutMsgs.Count()
 	v.InBytes = db.internal.meter.InBytes.Count()
 	v.OutBytes = db.internal.meter.OutBytes.Count()
+	if r, ok := db.LastRun(RunExpiry); ok {
+		v.LastExpiry = &r
+	}
+	if r, ok := db.LastRun(RunCompaction); ok {
+		v.LastCompaction = &r
+	}
+	if r, ok := db.LastRun(RunRetention); ok {
+		v.LastRetention = &r
+	}
+	v.Compacting, v.CompactionProgress = db.internal.compaction.status()
+	v.TimeAdjusted = db.internal.meter.TimeAdjusted.Count()
+	v.TimeRejected = db.internal.meter.TimeRejected.Count()
+	v.WriteStalls = db.internal.meter.WriteStalls.Count()
+	v.BlockCacheHits = db.internal.meter.BlockCacheHits.Count()
+	v.BlockCacheMisses = db.internal.meter.BlockCacheMisses.Count()
+	for l, n := range db.LimitsExceeded() {
+		if v.LimitsExceeded == nil {
+			v.LimitsExceeded = make(map[string]int64)
+		}
+		v.LimitsExceeded[l.String()] = n
+	}
 	ts := db.internal.meter.TimeSeries.Snapshot()
 	v.HMean = float64(ts.HMean())
 	v.P50 = float64(ts.P50())
@@ -178,7 +321,7 @@ func (db *DB) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	v, _ := db.Varz()
 	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		logger.Error().Msg("metrics: Error marshaling response to /varz request: " + err.Error())
+		db.internal.logger.Error().Msg("metrics: Error marshaling response to /varz request: " + err.Error())
 	}
 
 	// Handle response
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SystemContract is the contract of internal topics written by the DB.
+const SystemContract = uint32(3376684801)
+
+// MeterTopic is the internal topic periodic meter snapshots are written to, see WithMeterHistory.
+// Snapshots are stored as JSON encoded Varz and these can be queried as any other topic
+// using the system contract, i.e. NewQuery(MeterTopic).WithContract(SystemContract).
+var MeterTopic = []byte("unitdb.meter")
+
+// snapshotMeter writes a snapshot of the meter to the meter topic.
+func (db *DB) snapshotMeter() error {
+	v, err := db.Varz()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e := NewEntry(MeterTopic, data).WithContract(SystemContract)
+	e.entry.trusted = true
+	if db.opts.meterHistoryTTL > 0 {
+		e.ExpiresAt = uint32(time.Now().Add(db.opts.meterHistoryTTL).Unix())
+	}
+	return db.PutEntry(e)
+}
+
+// MeterHistory returns meter snapshots written in the last duration, most recent snapshot first.
+// The duration is parsed as Query.WithLast, for example "1h".
+func (db *DB) MeterHistory(last string) ([]Varz, error) {
+	q := NewQuery(MeterTopic).WithContract(SystemContract).WithLimit(db.opts.queryOptions.maxQueryLimit).WithLast(last)
+	q.internal.trusted = true
+	items, err := db.Get(q)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Varz, 0, len(items))
+	for _, item := range items {
+		var v Varz
+		if err := json.Unmarshal(item, &v); err != nil {
+			return history, err
+		}
+		history = append(history, v)
+	}
+	return history, nil
+}
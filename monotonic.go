@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+// MonotonicMode sets how an entry is handled if its timestamp is older than the newest entry of its topic.
+// Timestamp of an entry is the time of its message ID, so entries with IDs generated by sources
+// with clock skew could otherwise be missed by time range queries, see Query.WithLast.
+type MonotonicMode uint8
+
+const (
+	// MonotonicOff accepts entries in any time order.
+	MonotonicOff MonotonicMode = iota
+	// MonotonicReject rejects an entry older than the newest entry of its topic.
+	MonotonicReject
+	// MonotonicAdjust sets timestamp of an entry older than the newest entry of its topic to the time of the newest entry.
+	MonotonicAdjust
+)
+
+// _TopicClocks holds timestamp of the newest entry per topic.
+type _TopicClocks struct {
+	mu     sync.Mutex
+	newest map[uint64]int64
+}
+
+func newTopicClocks() *_TopicClocks {
+	return &_TopicClocks{newest: make(map[uint64]int64)}
+}
+
+// checkTime checks timestamp of the message ID against the newest entry of the topic
+// and rejects or adjusts the message ID as per monotonic mode of the DB.
+func (db *DB) checkTime(topicHash uint64, id message.ID) error {
+	if db.opts.monotonicMode == MonotonicOff {
+		return nil
+	}
+	c := db.internal.topicClocks
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	newest, ok := c.newest[topicHash]
+	if !ok {
+		newest = db.newestTime(topicHash)
+	}
+	ts := uid.Time(id[0:4])
+	if ts < newest {
+		if db.opts.monotonicMode == MonotonicReject {
+			db.internal.meter.TimeRejected.Inc(1)
+			return errNotMonotonic
+		}
+		binary.LittleEndian.PutUint32(id[0:4], uid.Apoch(newest))
+		db.internal.meter.TimeAdjusted.Inc(1)
+	}
+	return nil
+}
+
+// advanceTime records the time of the message ID prefix as newest time of the topic, once the entry
+// checked by checkTime is committed.
+func (db *DB) advanceTime(topicHash uint64, prefix []byte) {
+	if db.opts.monotonicMode == MonotonicOff {
+		return
+	}
+	c := db.internal.topicClocks
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts := uid.Time(prefix[0:4]); ts > c.newest[topicHash] {
+		c.newest[topicHash] = ts
+	}
+}
+
+// newestTime returns timestamp of the most recent entry of the topic in the DB. It is used
+// on first write to a topic after the DB is opened.
+func (db *DB) newestTime(topicHash uint64) int64 {
+	var seq uint64
+	for _, we := range db.internal.timeWindow.ilookup(topicHash, math.MaxInt32) {
+		if we.seq() > seq {
+			seq = we.seq()
+		}
+	}
+	if off, ok := db.internal.trie.getOffset(topicHash); ok {
+		if winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow}); err == nil && off+winFile.blockSize() <= winFile.currSize() {
+			r := _WindowReader{winFile: winFile, offset: off}
+			if b, err := r.readWindowBlock(); err == nil && b.topicHash == topicHash && b.entryIdx > 0 {
+				if s := b.entries[b.entryIdx-1].seq(); s > seq {
+					seq = s
+				}
+			}
+		}
+	}
+	if seq == 0 {
+		return 0
+	}
+	e, err := db.readEntry(_Query{seq: seq})
+	if err != nil {
+		return 0
+	}
+	id, _, err := db.internal.reader.readMessage(e)
+	if err != nil {
+		return 0
+	}
+	return uid.Time(id[0:4])
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// maxOffsetCommits is the number of offsets committed by a consumer group to a topic before older offsets are deleted.
+const maxOffsetCommits = 1000
+
+// _Offsets tracks number of offsets committed since the DB is opened, by the internal topic of the offsets.
+// Commits hold the read lock while a collapse holds the write lock, so an offset committed while older
+// offsets are deleted is not lost.
+type _Offsets struct {
+	mu sync.RWMutex
+
+	commitsMu sync.Mutex
+	commits   map[string]int
+}
+
+func newOffsets() *_Offsets {
+	return &_Offsets{commits: make(map[string]int)}
+}
+
+// commit counts an offset committed to the topic and returns number of offsets of the topic.
+func (o *_Offsets) commit(topic []byte) int {
+	o.commitsMu.Lock()
+	defer o.commitsMu.Unlock()
+	o.commits[string(topic)]++
+	return o.commits[string(topic)]
+}
+
+// offsetTopic returns the internal topic offsets of the consumer group in the topic are committed to.
+// The topic is hashed, so offsets of a wildcard topic or a topic too large to be a part of the internal
+// topic are committed as well.
+func offsetTopic(group string, topic []byte) ([]byte, error) {
+	switch {
+	case group == "" || strings.ContainsAny(group, ".?*+#"):
+		return nil, errGroupInvalid
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	h := fnv.New64a()
+	h.Write(topicName(topic))
+	return []byte(fmt.Sprintf("unitdb.offsets.%s.%016x", group, h.Sum64())), nil
+}
+
+// CommitOffset commits seq as the offset of the consumer group in the topic, so a consumer resumes reading the topic
+// from the offset after a restart, see DB.Offset. The offset is usually the seq of the last message the consumer
+// has processed, and a consumer reading the DB with DB.Changes resumes it with the offset as fromSeq.
+//
+// Offsets are stored in the DB as messages of an internal topic of the system contract, and offsets older than
+// the last committed offset are deleted once a group commits maxOffsetCommits offsets to a topic and on DB.Compact
+// if the DB is mutable. The group name must not contain topic separators or wildcards.
+func (db *DB) CommitOffset(group string, topic []byte, seq uint64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	ot, err := offsetTopic(group, topic)
+	if err != nil {
+		return err
+	}
+	offsets := db.internal.offsets
+	offsets.mu.RLock()
+	e := NewEntry(ot, encodeOffset(seq)).WithContract(SystemContract)
+	e.entry.trusted = true
+	err = db.PutEntry(e)
+	offsets.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	// Collapse replaces entries of the topic, so offsets of an immutable DB are not deleted.
+	if offsets.commit(ot) < maxOffsetCommits || db.opts.flags.immutable {
+		return nil
+	}
+	return db.collapseOffset(ot)
+}
+
+// Offset returns the offset last committed by the consumer group in the topic, see DB.CommitOffset.
+// It returns zero if the group has not committed an offset to the topic.
+func (db *DB) Offset(group string, topic []byte) (uint64, error) {
+	ot, err := offsetTopic(group, topic)
+	if err != nil {
+		return 0, err
+	}
+	return db.offset(ot)
+}
+
+func (db *DB) offset(topic []byte) (uint64, error) {
+	q := NewQuery(topic).WithContract(SystemContract).WithLimit(1)
+	q.internal.trusted = true
+	items, err := db.Get(q)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+	if len(items[0]) != 8 {
+		return 0, errEntryInvalid
+	}
+	return binary.LittleEndian.Uint64(items[0]), nil
+}
+
+// collapseOffset replaces offsets committed to the internal topic with a single entry of the last offset.
+func (db *DB) collapseOffset(topic []byte) error {
+	offsets := db.internal.offsets
+	offsets.mu.Lock()
+	defer offsets.mu.Unlock()
+	seq, err := db.offset(topic)
+	if err != nil {
+		return err
+	}
+	e := NewEntry(topic, encodeOffset(seq)).WithContract(SystemContract)
+	e.entry.trusted = true
+	if err := db.ReplaceTopic(topic, []*Entry{e}); err != nil {
+		return err
+	}
+	offsets.commitsMu.Lock()
+	offsets.commits[string(topic)] = 1
+	offsets.commitsMu.Unlock()
+	return nil
+}
+
+// collapseOffsets collapses offsets committed since the DB is opened.
+func (db *DB) collapseOffsets() error {
+	offsets := db.internal.offsets
+	offsets.commitsMu.Lock()
+	var pending [][]byte
+	for topic, n := range offsets.commits {
+		if n > 1 {
+			pending = append(pending, []byte(topic))
+		}
+	}
+	offsets.commitsMu.Unlock()
+	for _, topic := range pending {
+		if err := db.collapseOffset(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeOffset(seq uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, seq)
+	return buf
+}
@@ -17,11 +17,39 @@
 package unitdb
 
 import (
+	"context"
+	"fmt"
+	"runtime"
 	"time"
 
+	"github.com/rs/zerolog"
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/crypto"
+	"github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/wal"
 )
 
+// SyncPolicy is the durability policy of commits written to the write ahead log.
+// Set Mode to SyncAlways to fsync on every commit, SyncInterval to fsync commits
+// every Interval (group commit) or SyncNone to leave commits in the OS cache.
+type SyncPolicy = wal.SyncPolicy
+
+const (
+	// SyncNone leaves commits in the OS cache.
+	SyncNone = wal.SyncNone
+	// SyncAlways fsyncs every commit.
+	SyncAlways = wal.SyncAlways
+	// SyncInterval fsyncs commits every interval.
+	SyncInterval = wal.SyncInterval
+)
+
+// LogArchive is the policy for logs of the write ahead log once these are applied to the DB.
+// Set Path to keep applied logs in the archive directory, e.g. to ship logs to replicas using DB.ShipLogs.
+type LogArchive = wal.ArchiveOptions
+
 // _Flags holds various DB flags.
 type _Flags struct {
 	// immutable set immutable flag on database.
@@ -32,6 +60,9 @@ type _Flags struct {
 
 	// backgroundKeyExpiry sets flag to run key expirer.
 	backgroundKeyExpiry bool
+
+	// lastValueCache sets flag to keep the most recent message of each topic in the last-value index.
+	lastValueCache bool
 }
 
 // _BatchOptions is used to set options when using batch operation.
@@ -39,6 +70,9 @@ type _BatchOptions struct {
 	contract      uint32
 	encryption    bool
 	writeInterval time.Duration
+	maxBytes      int64
+	maxEntries    int
+	conflict      ConflictPolicy
 }
 
 // _QueryOptions is used to set options for DB query.
@@ -68,19 +102,169 @@ type _Options struct {
 	// encryptionKey is used for message encryption.
 	encryptionKey []byte
 
+	// contractKeys are encryption keys of contracts, see WithContractKey.
+	contractKeys map[uint32][]byte
+
+	// cipher is a custom cipher used for message encryption instead of the encryption key.
+	cipher crypto.Cipher
+
 	// bufferSize sets Size of buffer to use for pooling.
 	bufferSize int64
 
 	// memdbSize sets Size of blockcache.
 	memdbSize int64
 
+	// blockSize sets size in bytes of index and window blocks of a new DB, see WithBlockSize.
+	blockSize int32
+
+	// maxMemdbSize sets maximum size in bytes of entries held in the memdb, writes stall once it is exceeded.
+	maxMemdbSize int64
+
+	// tinyBatchFlushInterval sets how often entries put to the memdb are written to the write ahead log.
+	tinyBatchFlushInterval time.Duration
+
+	// tinyBatchMaxBytes sets size in bytes of entries put to the memdb after which these are written to the write ahead log.
+	tinyBatchMaxBytes int64
+
+	// writeStallTimeout sets the amount of time a write stalls before it fails with ErrWriteStall.
+	writeStallTimeout time.Duration
+
+	// drainTimeout sets the amount of time Close waits for writes in progress, it waits until these complete if it is not set.
+	drainTimeout time.Duration
+
+	// blockCacheSize sets size in bytes of the cache of index and data blocks read by queries.
+	blockCacheSize int64
+
+	// valueThreshold sets size in bytes of values stored in the value log, values are stored in the data file if it is not set.
+	valueThreshold int
+
+	// recoveryWorkers sets the number of workers decoding entries recovered from the write ahead log.
+	recoveryWorkers int
+
+	// recoveryContext cancels the write ahead log recovery when the DB is opened.
+	recoveryContext context.Context
+
+	// recoveryProgress is called with the progress of the write ahead log recovery, it is not set by default.
+	recoveryProgress func(RecoveryProgress)
+
 	// freeBlockSize minimum freeblocks size before free blocks are allocated and reused.
 	freeBlockSize int64
+
+	// compactionInterval sets the amount of time between background compactions.
+	//
+	// Setting the value to 0 disables the background compaction.
+	compactionInterval time.Duration
+
+	// expiryScanInterval sets the amount of time between background scans for expired entries.
+	expiryScanInterval time.Duration
+
+	// limits sets the limits applied on writes and whether limits are enforced or observed.
+	limits _Limits
+
+	// reencryptInterval sets the amount of time between background runs encrypting messages
+	// stored with a previous key version with the active key.
+	//
+	// Setting the value to 0 disables the background re-encryption.
+	reencryptInterval time.Duration
+
+	// meterHistoryInterval sets the amount of time between meter snapshots written to the meter topic.
+	//
+	// Setting the value to 0 disables the meter history.
+	meterHistoryInterval time.Duration
+
+	// meterHistoryTTL sets TTL of meter snapshots.
+	meterHistoryTTL time.Duration
+
+	// metrics is the sink metrics are reported to in addition to the meter.
+	metrics Metrics
+
+	// retentionInterval sets the amount of time between background runs enforcing retention of topic policies.
+	retentionInterval time.Duration
+
+	// ackTimeout sets the amount of time before messages delivered to a member of a consumer group and not acknowledged are redelivered.
+	ackTimeout time.Duration
+
+	// syncPolicy sets durability policy of commits written to the write ahead log.
+	syncPolicy SyncPolicy
+
+	// logArchive sets the policy for logs applied to the DB, applied logs are deleted by default.
+	logArchive LogArchive
+
+	// logPreallocate sets size in bytes of disk blocks reserved for a log of the write ahead log.
+	logPreallocate int64
+
+	// logRecycle sets the number of applied log files reused to write new logs.
+	logRecycle int
+
+	// logger is the logger of the DB, it defaults to the package logger writing to stderr.
+	logger *zerolog.Logger
+
+	// logLevel sets minimum level of messages logged by the DB.
+	logLevel *zerolog.Level
+
+	// rateLimit and rateBurst limit the rate of messages written to the DB per second, see WithRateLimit.
+	rateLimit float64
+	rateBurst int64
+
+	// accessControl requires an access key to put, delete and get messages, see WithAccessControl.
+	accessControl bool
+
+	// monotonicMode sets how entries older than the newest entry of their topic are handled.
+	monotonicMode MonotonicMode
+
+	// fileSystem is the file system the DB files and logs are stored on.
+	fileSystem fs.FileSystem
+
+	// directIO selects files opened with direct IO, see WithDirectIO.
+	directIO DirectIORole
+
+	// tieredStore is the object store cold segments of data and window files are offloaded to, it is not set by default.
+	tieredStore fs.ObjectStore
+
+	// coldAfter sets the amount of time since a segment is last written before it is offloaded to the tiered store.
+	coldAfter time.Duration
+
+	// alerts sets the alert thresholds and the hook called when an alert fires.
+	alerts _Alerts
+
+	// codec is name of the registered codec values are compressed with.
+	codec string
+
+	// compressionMinSize is the size of the smallest value encoded by the codec, smaller values are stored raw.
+	compressionMinSize int
+
+	// dictionarySamples is the number of payloads of a topic sampled to train its compression dictionary,
+	// dictionaries are not trained if it is zero, see WithDeflateDictionaries.
+	dictionarySamples int
+
+	// cipherSuite is name of the registered cipher suite values are encrypted with.
+	cipherSuite string
+
+	// compactionFilter is name of the registered compaction filter, it is not set by default.
+	compactionFilter string
+
+	// filterRepair sets how a missing or corrupted filter file is handled when the DB is opened.
+	filterRepair FilterRepair
+
+	// filterBits and filterHashes are the number of bits and hashes of a filter generation,
+	// the filter defaults are used if these are not set.
+	filterBits, filterHashes uint64
+
+	// ioReads and ioWrites set the number of reads and writes of the DB files admitted in turn
+	// under contention. Setting the values to 0 disables the I/O scheduler.
+	ioReads, ioWrites int
+
+	// replicator replicates writes of the DB, writes are applied locally if it is not set.
+	replicator Replicator
 }
 
 // Options it contains configurable options and flags for DB.
 type Options interface {
 	set(*_Options)
+
+	// Validate returns an error wrapping ErrInvalidOptions if the option set on the default options
+	// is out of range. Open validates the options in the same way.
+	Validate() error
 }
 
 // fOption wraps a function that modifies options and flags into an
@@ -93,12 +277,156 @@ func (fo *fOption) set(o *_Options) {
 	fo.f(o)
 }
 
+func (fo *fOption) Validate() error {
+	return newOptions(fo).validate()
+}
+
 func newFuncOption(f func(*_Options)) *fOption {
 	return &fOption{
 		f: f,
 	}
 }
 
+// OptionsBuilder composes options of the DB on top of the default options, options added later
+// override options added earlier. It is an Options itself, so it is passed to Open as is.
+//	opts := unitdb.NewOptions().With(unitdb.WithMutable()).With(unitdb.WithBufferSize(1 << 20))
+//	if err := opts.Validate(); err != nil {
+//		...
+//	}
+//	db, err := unitdb.Open("unitdb", opts)
+type OptionsBuilder struct {
+	opts []Options
+}
+
+// NewOptions returns a builder of the default options.
+func NewOptions() *OptionsBuilder {
+	return &OptionsBuilder{}
+}
+
+// With adds the options to the builder and returns the builder.
+func (b *OptionsBuilder) With(opts ...Options) *OptionsBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+func (b *OptionsBuilder) set(o *_Options) {
+	for _, opt := range b.opts {
+		if opt != nil {
+			opt.set(o)
+		}
+	}
+}
+
+// Validate returns an error wrapping ErrInvalidOptions describing the first option out of range.
+func (b *OptionsBuilder) Validate() error {
+	return newOptions(b).validate()
+}
+
+// newOptions returns the default options modified by opts.
+func newOptions(opts ...Options) *_Options {
+	options := &_Options{}
+	WithDefaultOptions().set(options)
+	WithDefaultFlags().set(options)
+	WithDefaultQueryOptions().set(options)
+	for _, opt := range opts {
+		if opt != nil {
+			opt.set(options)
+		}
+	}
+	if options.directIO != 0 && options.fileSystem == fs.OS {
+		options.fileSystem = fs.NewDirectIO(options.directIO.dirs()...)
+	}
+	if _, ok := options.fileSystem.(*fs.Tiered); !ok && options.tieredStore != nil {
+		options.fileSystem = fs.NewTiered(options.fileSystem, options.tieredStore, fs.TieredOptions{Suffixes: tieredSuffixes})
+	}
+	return options
+}
+
+// minBlockSize returns size of a block of the DB, the buffer and the memdb hold at least a block.
+func (o *_Options) minBlockSize() int64 {
+	if o.blockSize != 0 {
+		return int64(o.blockSize)
+	}
+	return block.Size
+}
+
+// validBlockSize reports whether the size is a valid block size, see block.NewLayout.
+func validBlockSize(size int32) bool {
+	_, err := block.NewLayout(size)
+	return err == nil
+}
+
+// validate returns ErrInvalidOptions describing the first option out of range.
+func (o *_Options) validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case o.maxSyncDurations <= 0 || o.syncDurationType <= 0:
+		return invalid("sync duration %d x %v is not positive", o.maxSyncDurations, o.syncDurationType)
+	case o.blockSize != 0 && !validBlockSize(o.blockSize):
+		return invalid("block size %d is not a power of two between %d and %d bytes", o.blockSize, block.MinSize, block.MaxSize)
+	case o.bufferSize < o.minBlockSize():
+		return invalid("buffer size %d is smaller than a block of %d bytes", o.bufferSize, o.minBlockSize())
+	case o.memdbSize < o.minBlockSize():
+		return invalid("memdb size %d is smaller than a block of %d bytes", o.memdbSize, o.minBlockSize())
+	case o.maxMemdbSize < 0:
+		return invalid("max memdb size %d is negative", o.maxMemdbSize)
+	case o.logPreallocate < 0 || o.logRecycle < 0:
+		return invalid("log preallocate size %d or recycle count %d is negative", o.logPreallocate, o.logRecycle)
+	case o.tinyBatchFlushInterval < 0 || o.tinyBatchMaxBytes < 0:
+		return invalid("tiny batch flush interval %v or max bytes %d is negative", o.tinyBatchFlushInterval, o.tinyBatchMaxBytes)
+	case o.writeStallTimeout <= 0:
+		return invalid("write stall timeout %v is not positive", o.writeStallTimeout)
+	case o.drainTimeout < 0:
+		return invalid("drain timeout %v is negative", o.drainTimeout)
+	case o.rateLimit < 0 || o.rateBurst < 0:
+		return invalid("rate limit %v or burst %d is negative", o.rateLimit, o.rateBurst)
+	case o.compressionMinSize < 0:
+		return invalid("compression min size %d is negative", o.compressionMinSize)
+	case o.dictionarySamples < 0:
+		return invalid("dictionary samples %d is negative", o.dictionarySamples)
+	case o.blockCacheSize < 0:
+		return invalid("block cache size %d is negative", o.blockCacheSize)
+	case o.valueThreshold < 0:
+		return invalid("value threshold %d is negative", o.valueThreshold)
+	case o.recoveryWorkers <= 0:
+		return invalid("recovery workers %d is not positive", o.recoveryWorkers)
+	case o.freeBlockSize < 0:
+		return invalid("free block size %d is negative", o.freeBlockSize)
+	case o.compactionInterval < 0 || o.reencryptInterval < 0 || o.meterHistoryInterval < 0 || o.meterHistoryTTL < 0:
+		return invalid("background interval is negative")
+	case o.expiryScanInterval <= 0 || o.retentionInterval <= 0:
+		return invalid("expiry scan interval %v or retention interval %v is not positive", o.expiryScanInterval, o.retentionInterval)
+	case o.ackTimeout <= 0:
+		return invalid("ack timeout %v is not positive", o.ackTimeout)
+	case o.ioReads < 0 || o.ioWrites < 0:
+		return invalid("I/O scheduler weights %d and %d are negative", o.ioReads, o.ioWrites)
+	case o.batchOptions.writeInterval < 0 || o.batchOptions.maxBytes < 0 || o.batchOptions.maxEntries < 0:
+		return invalid("batch write interval or batch limit is negative")
+	case o.queryOptions.defaultQueryLimit <= 0 || o.queryOptions.maxQueryLimit < o.queryOptions.defaultQueryLimit:
+		return invalid("default query limit %d is not positive or larger than max query limit %d", o.queryOptions.defaultQueryLimit, o.queryOptions.maxQueryLimit)
+	case o.syncPolicy.Mode == SyncInterval && o.syncPolicy.Interval <= 0:
+		return invalid("sync policy interval %v is not positive", o.syncPolicy.Interval)
+	case o.tieredStore != nil && o.coldAfter <= 0:
+		return invalid("tiered storage cold after %v is not positive", o.coldAfter)
+	}
+	for limit, value := range o.limits.values {
+		if value < 0 {
+			return invalid("%v limit %d is negative", Limit(limit), value)
+		}
+		if o.limits.modes[limit] == LimitEvict {
+			return invalid("%v limit mode is evict, evict only applies to quotas", Limit(limit))
+		}
+	}
+	for contract, key := range o.contractKeys {
+		if len(key) != keySize {
+			return invalid("encryption key of contract %d is not %d bytes", contract, keySize)
+		}
+	}
+	return nil
+}
+
 // WithDefaultFlags will open DB with some default values.
 //   immutable: True
 //   encryption: False
@@ -132,6 +460,23 @@ func WithBackgroundKeyExpiry() Options {
 	})
 }
 
+// WithLastValueCache keeps the seq of the most recent message of each topic in memory, so DB.Last reads the
+// message of a topic without looking up the time window, and new subscriptions first receive the most recent
+// message of each topic these match, see DB.Subscribe.
+func WithLastValueCache() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.lastValueCache = true
+	})
+}
+
+// WithExpiryScanInterval sets the amount of time between background scans
+// to delete entries with an expired TTL. It is used with background key expiry.
+func WithExpiryScanInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.expiryScanInterval = dur
+	})
+}
+
 // WithDefaultBatchOptions will set some default values for Batch operation.
 //   contract: MasterContract
 //   encryption: False
@@ -163,6 +508,30 @@ func WithBatchWriteInterval(dur time.Duration) Options {
 	})
 }
 
+// WithBatchMaxBytes limits size in bytes of entries a batch holds before it is written,
+// Put and Delete return ErrBatchFull if the entry exceeds the limit. Zero is unlimited.
+func WithBatchMaxBytes(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.batchOptions.maxBytes = size
+	})
+}
+
+// WithBatchMaxEntries limits number of entries a batch holds before it is written,
+// Put and Delete return ErrBatchFull if the batch has the maximum entries. Zero is unlimited.
+func WithBatchMaxEntries(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.batchOptions.maxEntries = n
+	})
+}
+
+// WithBatchConflict sets how an entry of the batch is written if an entry with the same message ID
+// is already written by another batch or put. The default policy is ConflictLastWriterWins.
+func WithBatchConflict(policy ConflictPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.batchOptions.conflict = policy
+	})
+}
+
 // WithDefaultQueryOptions will set some default values for Query operation.
 //   defaultQueryLimit: 1000
 //   maxQueryLimit: 100000
@@ -191,9 +560,54 @@ func WithDefaultOptions() Options {
 		if o.freeBlockSize == 0 {
 			o.freeBlockSize = 1 << 27 // minimum size of (128MB).
 		}
+		if o.writeStallTimeout == 0 {
+			o.writeStallTimeout = 10 * time.Second
+		}
+		if o.blockCacheSize == 0 {
+			o.blockCacheSize = 1 << 23 // size of block cache (8MB).
+		}
+		if o.recoveryWorkers == 0 {
+			o.recoveryWorkers = runtime.NumCPU()
+		}
+		if o.recoveryContext == nil {
+			o.recoveryContext = context.Background()
+		}
+		if o.limits.values[LimitTopicSize] == 0 {
+			o.limits.values[LimitTopicSize] = maxTopicLength
+		}
+		if o.limits.values[LimitValueSize] == 0 {
+			o.limits.values[LimitValueSize] = maxValueLength
+		}
+		if o.expiryScanInterval == 0 {
+			o.expiryScanInterval = time.Minute * maxExpDur
+		}
+		if o.retentionInterval == 0 {
+			o.retentionInterval = time.Minute
+		}
+		if o.ackTimeout == 0 {
+			o.ackTimeout = defaultAckTimeout
+		}
 		if o.encryptionKey == nil {
 			o.encryptionKey = []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
 		}
+		if o.logger == nil {
+			o.logger = &logger
+		}
+		if o.fileSystem == nil {
+			o.fileSystem = fs.OS
+		}
+		if o.codec == "" {
+			o.codec = DefaultCodec
+		}
+		if o.cipherSuite == "" {
+			o.cipherSuite = DefaultCipherSuite
+		}
+		if o.filterBits == 0 {
+			o.filterBits = filter.DefaultBits
+		}
+		if o.filterHashes == 0 {
+			o.filterHashes = filter.DefaultHashes
+		}
 	})
 }
 
@@ -205,6 +619,173 @@ func WithMaxSyncDuration(dur time.Duration, interval int) Options {
 	})
 }
 
+// WithSyncPolicy sets when commits written to the write ahead log are fsynced.
+// By default commits are not fsynced.
+func WithSyncPolicy(policy SyncPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.syncPolicy = policy
+	})
+}
+
+// WithLogArchive sets the policy for logs of the write ahead log applied to the DB, see LogArchive.
+func WithLogArchive(archive LogArchive) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logArchive = archive
+	})
+}
+
+// WithLogPreallocate sets size in bytes of disk blocks reserved using fallocate for a log of the
+// write ahead log before it is written, so commits do not extend the file. Set it to the usual size
+// of a commit. It is a no-op on platforms other than Linux.
+func WithLogPreallocate(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logPreallocate = size
+	})
+}
+
+// WithLogRecycle sets the number of log files of the write ahead log kept once these are applied
+// to the DB and reused to write new logs, instead of deleting these and creating new files.
+// Logs are not recycled if these are archived, see WithLogArchive.
+func WithLogRecycle(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logRecycle = n
+	})
+}
+
+// WithLogger sets the logger of the DB to route DB logs to the application logging pipeline.
+func WithLogger(l zerolog.Logger) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logger = &l
+	})
+}
+
+// WithLogLevel sets minimum level of messages logged by the DB.
+func WithLogLevel(level zerolog.Level) Options {
+	return newFuncOption(func(o *_Options) {
+		o.logLevel = &level
+	})
+}
+
+// WithRateLimit limits the rate of messages written to the DB per second, with bursts of up to burst messages.
+// A zero burst defaults to the rate. Writes exceeding the rate return ErrRateLimited, use Quota to limit
+// the rate of writes per contract. Setting the rate to 0 removes the limit. Use WithLimitMode with
+// LimitRate to only count and log writes exceeding the rate.
+func WithRateLimit(rate float64, burst int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.rateLimit = rate
+		o.rateBurst = burst
+	})
+}
+
+// WithAccessControl requires an access key granting access to the topic to put, delete and get messages,
+// see DB.NewAccessKey. Writes, deletes and topic replaces require write access, and queries, subscriptions,
+// exports and topic statistics require read access. Without access control only access keys that are set
+// are checked.
+func WithAccessControl() Options {
+	return newFuncOption(func(o *_Options) {
+		o.accessControl = true
+	})
+}
+
+// WithMonotonicTime rejects or adjusts timestamp of entries older than the newest entry of their topic.
+func WithMonotonicTime(mode MonotonicMode) Options {
+	return newFuncOption(func(o *_Options) {
+		o.monotonicMode = mode
+	})
+}
+
+// WithIOScheduler alternates disk access to the DB files between query reads and sync or compaction writes
+// under contention. Up to reads consecutive reads are admitted while writes are waiting and up to writes
+// consecutive writes are admitted while reads are waiting, so a higher weight prioritizes reads or writes.
+func WithIOScheduler(reads, writes int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.ioReads = reads
+		o.ioWrites = writes
+	})
+}
+
+// WithFilterRepair sets how a missing or corrupted filter file is handled when the DB is opened,
+// by default the filter is rebuilt from index blocks.
+func WithFilterRepair(mode FilterRepair) Options {
+	return newFuncOption(func(o *_Options) {
+		o.filterRepair = mode
+	})
+}
+
+// WithFilterBitsPerKey sets the number of bits of the filter per entry, by default the filter uses about
+// 10 bits per entry. More bits per entry lower the false positive rate of lookups of entries that do not exist
+// and grow the memory and the filter file size. The filter of an existing DB written with other bits per entry
+// is handled as a missing filter when the DB is opened, see WithFilterRepair.
+func WithFilterBitsPerKey(bitsPerKey int) Options {
+	return newFuncOption(func(o *_Options) {
+		if bitsPerKey > 0 {
+			o.filterBits = uint64(bitsPerKey) * filterGenerationSize
+		}
+	})
+}
+
+// WithFilterHashes sets the number of hashes of the filter, by default the filter uses 7 hashes. The number
+// of hashes with the lowest false positive rate is about 0.7 times the bits per entry. The filter of an
+// existing DB written with other number of hashes is handled as a missing filter when the DB is opened.
+func WithFilterHashes(hashes int) Options {
+	return newFuncOption(func(o *_Options) {
+		if hashes > 0 {
+			o.filterHashes = uint64(hashes)
+		}
+	})
+}
+
+// WithFileSystem sets the file system the DB files and logs are stored on. Use fs.NewMem()
+// to run the DB entirely in memory, for example in unit tests or for short-lived caches.
+func WithFileSystem(fsys fs.FileSystem) Options {
+	return newFuncOption(func(o *_Options) {
+		o.fileSystem = fsys
+	})
+}
+
+// DirectIORole selects files of the DB opened with direct IO, see WithDirectIO.
+type DirectIORole uint8
+
+const (
+	// DirectIOData opens data, value log, index and window files with direct IO.
+	DirectIOData DirectIORole = 1 << iota
+	// DirectIOWAL opens logs of the write ahead log with direct IO.
+	DirectIOWAL
+)
+
+// dirs returns names of the directories of files opened with direct IO.
+func (r DirectIORole) dirs() []string {
+	var dirs []string
+	if r&DirectIOData != 0 {
+		dirs = append(dirs, dataDir, indexDir, winDir)
+	}
+	if r&DirectIOWAL != 0 {
+		dirs = append(dirs, memdb.LogDir)
+	}
+	return dirs
+}
+
+// WithDirectIO opens files of the roles with direct IO so these bypass the OS page cache, see fs.DirectIO.
+// Use DirectIOData to keep syncs of large batches from evicting blocks queries read from the page cache,
+// and DirectIOWAL for logs written once and read only on recovery. It applies to the OS file system,
+// it is ignored if the DB is stored on a file system set by WithFileSystem.
+func WithDirectIO(roles DirectIORole) Options {
+	return newFuncOption(func(o *_Options) {
+		o.directIO = roles
+	})
+}
+
+// WithTieredStorage offloads segments of data and window files not written for the coldAfter duration
+// to the object store, see fs.NewS3. Index, filter and logs are kept on the file system and queries
+// fetch offloaded blocks from the store on demand. Tiered storage is set when the DB is created,
+// a DB created without it cannot be opened with it.
+func WithTieredStorage(store fs.ObjectStore, coldAfter time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.tieredStore = store
+		o.coldAfter = coldAfter
+	})
+}
+
 // WithDefaultQueryLimit limits maximum number of records to fetch
 // if the DB Get or DB Iterator method does not specify a limit.
 func WithDefaultQueryLimit(limit int) Options {
@@ -236,6 +817,105 @@ func WithMemdbSize(size int64) Options {
 	})
 }
 
+// WithBlockSize sets size in bytes of index and window blocks of a new DB. The size is a power of two
+// between 1KB and 64KB, it is 4KB by default. Larger blocks suit volumes with high latency per request,
+// such as network volumes, smaller blocks suit SSDs.
+//
+// The block size is recorded in the DB info file when the DB is created, the DB is reopened with
+// the block size it was created with. Open returns an error if the size does not match.
+func WithBlockSize(size int32) Options {
+	return newFuncOption(func(o *_Options) {
+		o.blockSize = size
+	})
+}
+
+// WithMaxMemdbSize sets maximum size in bytes of entries held in the memdb. Once the memdb exceeds
+// the size, writes stall until entries are synced to the DB files. Zero is unlimited.
+//
+// Entries of the time block of the memdb being written are synced once the time block is complete,
+// i.e. every second, so the size should be larger than the size of entries written in a second.
+func WithMaxMemdbSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.maxMemdbSize = size
+	})
+}
+
+// WithTinyBatchFlushInterval sets how often entries put outside of a batch are written to the
+// write ahead log. Such entries are buffered in a tiny batch until the interval elapses or the
+// tiny batch reaches the size set by WithTinyBatchMaxBytes, whichever comes first. It is 15ms by default.
+func WithTinyBatchFlushInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.tinyBatchFlushInterval = dur
+	})
+}
+
+// WithTinyBatchMaxBytes sets size in bytes of entries buffered in a tiny batch after which these
+// are written to the write ahead log without waiting for the flush interval. Zero is unlimited.
+func WithTinyBatchMaxBytes(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.tinyBatchMaxBytes = size
+	})
+}
+
+// WithWriteStallTimeout sets the amount of time a write stalls on a full memdb before
+// it fails with ErrWriteStall, see WithMaxMemdbSize. It is 10 seconds by default.
+func WithWriteStallTimeout(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.writeStallTimeout = dur
+	})
+}
+
+// WithDrainTimeout sets the amount of time Close waits for puts and batch commits in progress
+// before it closes the DB and returns ErrDrainTimeout. By default Close waits until these complete.
+func WithDrainTimeout(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.drainTimeout = dur
+	})
+}
+
+// WithBlockCacheSize sets size in bytes of the LRU cache of index and data blocks read by queries
+// and point lookups, it is 8MB by default. Setting the size to 0 disables the block cache.
+func WithBlockCacheSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.blockCacheSize = size
+	})
+}
+
+// WithValueThreshold stores values of size bytes or larger in a separate value log, the data file holds
+// a pointer to the value instead. It keeps the data file small and compaction does not copy large values.
+// Values are stored in the data file by default. Compaction rewrites the value log once more than half
+// of it is taken by values of deleted or expired entries.
+func WithValueThreshold(size int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.valueThreshold = size
+	})
+}
+
+// WithRecoveryWorkers sets the number of workers decoding entries of the write ahead log replayed when
+// the DB is opened, it is the number of CPUs by default. Entries are appended to the DB in order.
+func WithRecoveryWorkers(n int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.recoveryWorkers = n
+	})
+}
+
+// WithRecoveryContext cancels the write ahead log recovery once ctx is done, e.g. to time out the start
+// of a supervised process. Open returns the error of ctx and the log not yet applied is recovered when the
+// DB is opened next.
+func WithRecoveryContext(ctx context.Context) Options {
+	return newFuncOption(func(o *_Options) {
+		o.recoveryContext = ctx
+	})
+}
+
+// WithRecoveryProgress sets a callback called with the progress of the write ahead log recovery
+// each time a time block of the log is applied to the DB and once the recovery is done.
+func WithRecoveryProgress(f func(RecoveryProgress)) Options {
+	return newFuncOption(func(o *_Options) {
+		o.recoveryProgress = f
+	})
+}
+
 // WithFreeBlockSize sets minimum freeblocks size
 // before free blocks are allocated and reused.
 func WithFreeBlockSize(size int64) Options {
@@ -244,9 +924,181 @@ func WithFreeBlockSize(size int64) Options {
 	})
 }
 
+// WithCompactionInterval sets the amount of time between background compactions
+// to reclaim disk space of deleted and expired entries.
+func WithCompactionInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.compactionInterval = dur
+	})
+}
+
+// WithRetentionInterval sets the amount of time between background runs
+// deleting entries exceeding retention limits of topic policies.
+func WithRetentionInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.retentionInterval = dur
+	})
+}
+
+// WithAckTimeout sets the amount of time after which a message delivered to a member of a consumer group
+// is redelivered to another member if it is not acknowledged, see DB.SubscribeGroup.
+func WithAckTimeout(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.ackTimeout = dur
+	})
+}
+
+// WithReencryptInterval sets the amount of time between background runs encrypting
+// messages stored with a previous key version with the active key, see DB.RotateKey.
+func WithReencryptInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.reencryptInterval = dur
+	})
+}
+
+// WithMeterHistory writes a snapshot of the meter to the meter topic at every interval
+// so historical DB stats can be queried, see DB.MeterHistory. Snapshots expire after ttl, a zero ttl keeps snapshots.
+func WithMeterHistory(interval, ttl time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.meterHistoryInterval = interval
+		o.meterHistoryTTL = ttl
+	})
+}
+
+// WithMetrics reports DB metrics to the given sink in addition to the meter, see Metrics.
+func WithMetrics(m Metrics) Options {
+	return newFuncOption(func(o *_Options) {
+		o.metrics = m
+	})
+}
+
+// WithLimit sets a limit on writes to the DB. Setting the value to 0 removes the limit, except for topic size
+// and value size limits which are then set to the maximum topic and value size supported by the DB.
+// Topic size and value size limits cannot be set larger than maximum topic and value size supported by the DB.
+// The rate limit is set by WithRateLimit.
+func WithLimit(limit Limit, value int64) Options {
+	return newFuncOption(func(o *_Options) {
+		if limit < nLimits && limit != LimitRate {
+			o.limits.values[limit] = value
+		}
+	})
+}
+
+// WithLimitMode sets mode of the given limits, or mode of all limits if no limit is given.
+// In observe mode a write exceeding the limit is accepted and only counted and logged.
+func WithLimitMode(mode LimitMode, limits ...Limit) Options {
+	return newFuncOption(func(o *_Options) {
+		if len(limits) == 0 {
+			for l := range o.limits.modes {
+				o.limits.modes[l] = mode
+			}
+			return
+		}
+		for _, l := range limits {
+			if l < nLimits {
+				o.limits.modes[l] = mode
+			}
+		}
+	})
+}
+
+// WithAlert sets threshold of an alert, the alert fires when its value exceeds the threshold.
+// Setting the threshold to 0 removes the alert. Alerts are checked at every sync interval, see WithAlertHook.
+func WithAlert(alert Alert, threshold int64) Options {
+	return newFuncOption(func(o *_Options) {
+		if alert < nAlerts {
+			o.alerts.thresholds[alert] = threshold
+		}
+	})
+}
+
+// WithAlertHook sets the hook called when an alert fires. Alerts are logged if the hook is not set.
+func WithAlertHook(hook func(AlertEvent)) Options {
+	return newFuncOption(func(o *_Options) {
+		o.alerts.hook = hook
+	})
+}
+
+// WithReplicator sets the replicator writes of the DB are proposed to, see Replicator.
+// Batches, puts and deletes are applied to the DB once these are committed to the replicated log.
+func WithReplicator(r Replicator) Options {
+	return newFuncOption(func(o *_Options) {
+		o.replicator = r
+	})
+}
+
 // WithEncryptionKey sets encryption key to use for data encryption.
 func WithEncryptionKey(key []byte) Options {
 	return newFuncOption(func(o *_Options) {
 		o.encryptionKey = key
 	})
 }
+
+// WithContractKey sets encryption key of the contract, use zero contract for the master contract.
+// Keys of contracts are not stored in the DB, so the key must be set each time the DB is opened
+// to read or write messages of the contract, see DB.SetContractKey.
+func WithContractKey(contract uint32, key []byte) Options {
+	return newFuncOption(func(o *_Options) {
+		if o.contractKeys == nil {
+			o.contractKeys = make(map[uint32][]byte)
+		}
+		if contract == 0 {
+			contract = message.MasterContract
+		}
+		o.contractKeys[contract] = key
+	})
+}
+
+// WithCodec sets name of the registered codec values are compressed with, see RegisterCodec.
+// The codec cannot be changed once the DB is created.
+func WithCodec(name string) Options {
+	return newFuncOption(func(o *_Options) {
+		o.codec = name
+	})
+}
+
+// WithCompressionMinSize stores values smaller than size bytes without encoding these by the codec, as
+// compressing tiny payloads wastes CPU and can grow these. Values of a DB created with a compression min size
+// start with a byte telling whether the value is encoded, so storing raw values cannot be enabled once the DB
+// is created without it. A DB created with it may be opened with a different size, or without it to encode
+// all values.
+func WithCompressionMinSize(size int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.compressionMinSize = size
+	})
+}
+
+// WithDeflateDictionaries trains a deflate dictionary for each topic from the first samples payloads
+// written to the topic, payloads written to the topic later are deflated with the dictionary.
+// Small payloads of a topic sharing keys and values, such as JSON telemetry, compress better with
+// a dictionary than on their own. Setting samples to 0 stops training dictionaries, payloads of topics
+// with a trained dictionary are still compressed with it, see DB.TrainDictionary.
+func WithDeflateDictionaries(samples int) Options {
+	return newFuncOption(func(o *_Options) {
+		o.dictionarySamples = samples
+	})
+}
+
+// WithCipherSuite sets name of the registered cipher suite creating ciphers of encryption keys, see RegisterCipherSuite.
+// The cipher suite cannot be changed once the DB is created.
+func WithCipherSuite(name string) Options {
+	return newFuncOption(func(o *_Options) {
+		o.cipherSuite = name
+	})
+}
+
+// WithCompactionFilter sets name of the registered compaction filter dropping entries on compaction,
+// see RegisterCompactionFilter.
+func WithCompactionFilter(name string) Options {
+	return newFuncOption(func(o *_Options) {
+		o.compactionFilter = name
+	})
+}
+
+// WithCipher sets a custom cipher to use for message encryption instead of the default cipher using
+// the encryption key. The custom cipher manages its own keys, so DB.RotateKey is not supported with it.
+func WithCipher(c crypto.Cipher) Options {
+	return newFuncOption(func(o *_Options) {
+		o.cipher = c
+	})
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// Retention limits history kept for a topic. Zero value of a limit is unlimited.
+	Retention struct {
+		MaxAge   time.Duration `json:"max_age,omitempty"`   // The maximum age of a message.
+		MaxCount int64         `json:"max_count,omitempty"` // The maximum number of messages kept for a topic.
+		MaxBytes int64         `json:"max_bytes,omitempty"` // The maximum size of message values kept for a topic.
+	}
+	// Policy is a policy applied to a topic, or to all topics under a prefix if the topic is
+	// a wildcard topic such as "teams.alpha...".
+	Policy struct {
+		Topic     []byte    // The topic or topic prefix the policy applies to.
+		Contract  uint32    // The contract of the topic.
+		Retention Retention // The retention limits of the topic.
+		// The default TTL of messages written to the topic without a TTL.
+		TTL time.Duration
+	}
+
+	// _PolicyRecord is a policy persisted to the policy file.
+	_PolicyRecord struct {
+		Topic     string        `json:"topic"`
+		Contract  uint32        `json:"contract"`
+		Retention Retention     `json:"retention"`
+		TTL       time.Duration `json:"ttl,omitempty"`
+	}
+	// _TopicTTL is a default TTL of a policy matched against topics of new entries.
+	_TopicTTL struct {
+		contract uint32
+		parts    [][]byte
+		prefix   bool // The policy applies to the topic and all topics under it.
+		ttl      time.Duration
+	}
+	// _PolicyTable holds policies keyed by contract and topic and persists these to the policy file.
+	_PolicyTable struct {
+		mu       sync.RWMutex
+		fsys     fs.FileSystem
+		path     string
+		policies map[string]Policy
+		ttls     []_TopicTTL // ttls sorted from most to least specific topic.
+	}
+)
+
+// NewPolicy creates a new policy for the topic.
+func NewPolicy(topic []byte) *Policy {
+	return &Policy{Topic: topic}
+}
+
+// WithContract sets contract on policy.
+func (p *Policy) WithContract(contract uint32) *Policy {
+	p.Contract = contract
+	return p
+}
+
+// WithRetention sets retention limits on policy.
+func (p *Policy) WithRetention(r Retention) *Policy {
+	p.Retention = r
+	return p
+}
+
+// WithTTL sets default TTL of messages written to the topic without a TTL.
+func (p *Policy) WithTTL(ttl time.Duration) *Policy {
+	p.TTL = ttl
+	return p
+}
+
+func (r Retention) isSet() bool {
+	return r.MaxAge > 0 || r.MaxCount > 0 || r.MaxBytes > 0
+}
+
+func policyPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.policy", prefix))
+}
+
+func policyKey(contract uint32, topic []byte) string {
+	return fmt.Sprintf("%d:%s", contract, topic)
+}
+
+// openPolicyTable reads policies from the policy file in the DB directory.
+func openPolicyTable(fsys fs.FileSystem, dirName string) (*_PolicyTable, error) {
+	t := &_PolicyTable{fsys: fsys, path: policyPath(dirName), policies: make(map[string]Policy)}
+	data, err := fs.ReadFile(fsys, t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var records []_PolicyRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, ErrCorrupted
+	}
+	for _, r := range records {
+		t.policies[policyKey(r.Contract, []byte(r.Topic))] = Policy{Topic: []byte(r.Topic), Contract: r.Contract, Retention: r.Retention, TTL: r.TTL}
+	}
+	t.setTTLs()
+	return t, nil
+}
+
+// setTTLs rebuilds default TTLs from policies. Caller must hold the lock.
+func (t *_PolicyTable) setTTLs() {
+	t.ttls = t.ttls[:0]
+	for _, p := range t.policies {
+		if p.TTL <= 0 {
+			continue
+		}
+		topic := p.Topic
+		if i := bytes.IndexByte(topic, '?'); i >= 0 {
+			topic = topic[:i]
+		}
+		prefix := bytes.HasSuffix(topic, []byte(message.TopicGenericSymbol))
+		topic = bytes.TrimSuffix(topic, []byte(message.TopicGenericSymbol))
+		t.ttls = append(t.ttls, _TopicTTL{contract: p.Contract, parts: bytes.FieldsFunc(topic, isTopicSeparator), prefix: prefix, ttl: p.TTL})
+	}
+	sort.Slice(t.ttls, func(i, j int) bool {
+		if len(t.ttls[i].parts) != len(t.ttls[j].parts) {
+			return len(t.ttls[i].parts) > len(t.ttls[j].parts)
+		}
+		return !t.ttls[i].prefix && t.ttls[j].prefix
+	})
+}
+
+func isTopicSeparator(c rune) bool {
+	return c == message.TopicSeparator
+}
+
+// match matches topic parts with the policy topic, a '*' part of the policy topic matches any part.
+func (tt _TopicTTL) match(contract uint32, parts [][]byte) bool {
+	if tt.contract != contract || len(parts) < len(tt.parts) || (!tt.prefix && len(parts) != len(tt.parts)) {
+		return false
+	}
+	for i, part := range tt.parts {
+		if !(len(part) == 1 && part[0] == message.TopicWildcardSymbol) && !bytes.Equal(part, parts[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ttl returns default TTL of the most specific policy matching the topic.
+func (t *_PolicyTable) ttl(contract uint32, topic []byte) (time.Duration, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.ttls) == 0 {
+		return 0, false
+	}
+	parts := bytes.FieldsFunc(topic, isTopicSeparator)
+	for _, tt := range t.ttls {
+		if tt.match(contract, parts) {
+			return tt.ttl, true
+		}
+	}
+	return 0, false
+}
+
+// write writes policies to a temporary file and renames it over the policy file. Caller must hold the lock.
+func (t *_PolicyTable) write() error {
+	records := make([]_PolicyRecord, 0, len(t.policies))
+	for _, p := range t.policies {
+		records = append(records, _PolicyRecord{Topic: string(p.Topic), Contract: p.Contract, Retention: p.Retention, TTL: p.TTL})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Contract != records[j].Contract {
+			return records[i].Contract < records[j].Contract
+		}
+		return records[i].Topic < records[j].Topic
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(t.fsys, t.path, data, os.FileMode(0666))
+}
+
+func (t *_PolicyTable) set(p Policy) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.policies[policyKey(p.Contract, p.Topic)] = p
+	t.setTTLs()
+	return t.write()
+}
+
+func (t *_PolicyTable) remove(contract uint32, topic []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := policyKey(contract, topic)
+	if _, ok := t.policies[key]; !ok {
+		return nil
+	}
+	delete(t.policies, key)
+	t.setTTLs()
+	return t.write()
+}
+
+// list returns policies sorted by contract and topic.
+func (t *_PolicyTable) list() []Policy {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	policies := make([]Policy, 0, len(t.policies))
+	for _, p := range t.policies {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Contract != policies[j].Contract {
+			return policies[i].Contract < policies[j].Contract
+		}
+		return string(policies[i].Topic) < string(policies[j].Topic)
+	})
+	return policies
+}
+
+// SetPolicy sets policy on a topic or topic prefix. It replaces an existing policy of the topic.
+// The policy is persisted, retention is enforced by a background job and default TTL is applied
+// to new entries of the topic that do not specify a TTL, using the policy of the most specific topic.
+func (db *DB) SetPolicy(p *Policy) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if len(p.Topic) == 0 {
+		return errTopicEmpty
+	}
+	if p.Contract == 0 {
+		p.Contract = message.MasterContract
+	}
+	if _, _, err := db.parseTopic(p.Contract, p.Topic); err != nil {
+		return err
+	}
+	return db.internal.policies.set(Policy{Topic: append([]byte(nil), p.Topic...), Contract: p.Contract, Retention: p.Retention, TTL: p.TTL})
+}
+
+// DeletePolicy removes policy of the topic. Use zero contract for the master contract.
+func (db *DB) DeletePolicy(topic []byte, contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.policies.remove(contract, topic)
+}
+
+// Policies returns policies set on the DB.
+func (db *DB) Policies() []Policy {
+	return db.internal.policies.list()
+}
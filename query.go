@@ -17,32 +17,67 @@
 package unitdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"time"
 
 	"github.com/unit-io/unitdb/message"
 )
 
+const (
+	cursorVersion = 1
+	cursorSize    = 17 // version, prefix of the query and seq of the last message returned.
+)
+
 // Query represents a topic to query and optional contract information.
 type (
 	_Query struct {
 		topicHash uint64
 		seq       uint64
+		expiresAt uint32
 	}
 	_InternalQuery struct {
 		parts      []message.Part // The parts represents a topic which contains a contract and a list of hashes for various parts of the topic.
 		depth      uint8
 		topicType  uint8
-		prefix     uint64 // The prefix is generated from contract and first of the topic.
-		cutoff     int64  // The cutoff is time limit check on message IDs.
+		prefix     uint64              // The prefix is generated from contract and first of the topic.
+		cutoff     int64               // The cutoff is time limit check on message IDs.
+		cursor     []byte              // The cursor of a previous query to continue from.
+		before     uint64              // The before is seq of the last message returned by the previous query.
+		last       uint64              // The last is seq of the last message returned by the query.
+		seekSeq    uint64              // The seekSeq is seq of the newest message to return.
+		seekTime   int64               // The seekTime is time of the newest message to return.
+		skip       map[uint64]struct{} // The skip are seqs of messages not to return, set by the transaction of the query.
+		seqs       []uint64            // The seqs are seqs of messages returned, collected if skip is set.
+		trusted    bool                // The trusted is set on queries of the DB that are not checked against access keys.
 		winEntries []_Query
+		stats      QueryStats
 
 		opts *_QueryOptions
 	}
+	// QueryStats are counters of the read path of a query, see Query.Stats.
+	QueryStats struct {
+		BlocksRead        int           `json:"blocks_read"` // Number of window and index blocks read from the DB files.
+		CacheHits         int           `json:"cache_hits"`  // Number of entries read from the memdb.
+		Visited           int           `json:"visited"`     // Number of entries looked up for the query.
+		Returned          int           `json:"returned"`
+		Filtered          int           `json:"filtered"` // Number of messages rejected by the filter of the query.
+		BytesDecompressed int64         `json:"bytes_decompressed"`
+		Duration          time.Duration `json:"duration"`
+	}
 	Query struct {
-		internal _InternalQuery
-		Topic    []byte // The topic of the message.
-		Contract uint32 // The contract is used as prefix in the message ID.
-		Limit    int    // The maximum number of elements to return.
+		internal  _InternalQuery
+		Topic     []byte // The topic of the message.
+		ID        []byte // The ID of the message to get, if set only the message of the ID is returned.
+		Contract  uint32 // The contract is used as prefix in the message ID.
+		Limit     int    // The maximum number of elements to return.
+		AccessKey string // The access key granting read access to the topic, see DB.NewAccessKey.
+		// The filter of messages to return, messages it rejects are skipped and not counted against the limit.
+		Filter func(item *Item) bool
+		// StreamValues leaves Payload of returned messages nil, payloads are read by Message.ValueReader.
+		// Payloads are decoded as these are read if the codec is a StreamCodec, see WithCodec.
+		StreamValues bool
 	}
 )
 
@@ -56,18 +91,98 @@ func NewQuery(topic []byte) *Query {
 	}
 }
 
+// Stats returns counters of the read path of the last DB.Get call of the query,
+// use these to log and alert on expensive queries.
+func (q *Query) Stats() QueryStats {
+	return q.internal.stats
+}
+
 // WithContract sets contract on query.
 func (q *Query) WithContract(contract uint32) *Query {
 	q.Contract = contract
 	return q
 }
 
+// WithAccessKey sets access key on query.
+func (q *Query) WithAccessKey(key string) *Query {
+	q.AccessKey = key
+	return q
+}
+
+// WithFilter sets filter on query. The filter is called with each message matching the query once
+// the message is decoded, and returns false to skip the message.
+func (q *Query) WithFilter(filter func(item *Item) bool) *Query {
+	q.Filter = filter
+	return q
+}
+
+// PayloadPrefix returns a query filter matching messages with a payload starting with the prefix.
+func PayloadPrefix(prefix []byte) func(item *Item) bool {
+	return func(item *Item) bool {
+		if item.value == nil {
+			return bytes.HasPrefix(item.Payload, prefix)
+		}
+		p := make([]byte, len(prefix))
+		if _, err := io.ReadFull(item.ValueReader(), p); err != nil {
+			return false
+		}
+		return bytes.Equal(p, prefix)
+	}
+}
+
+// WithStreamValues sets the query to stream payloads of messages, see Message.ValueReader.
+func (q *Query) WithStreamValues() *Query {
+	q.StreamValues = true
+	return q
+}
+
 // WithLimit sets query limit.
 func (q *Query) WithLimit(limit int) *Query {
 	q.Limit = limit
 	return q
 }
 
+// WithCursor sets a cursor returned by Query.Cursor of a previous query of the topic,
+// DB.Get then returns messages older than messages returned by the previous query.
+func (q *Query) WithCursor(cursor []byte) *Query {
+	q.internal.cursor = cursor
+	return q
+}
+
+// Cursor returns an opaque cursor to continue the query from the last message returned by DB.Get.
+// It returns nil if DB.Get returned fewer messages than the limit, as there are no older messages.
+// The cursor holds the seq of the message, so it can be persisted and used once the DB is reopened.
+func (q *Query) Cursor() []byte {
+	if q.internal.last == 0 {
+		return nil
+	}
+	cursor := make([]byte, cursorSize)
+	cursor[0] = cursorVersion
+	binary.LittleEndian.PutUint64(cursor[1:9], q.internal.prefix)
+	binary.LittleEndian.PutUint64(cursor[9:17], q.internal.last)
+	return cursor
+}
+
+// Seek sets the query to start from the newest message written at or before the time, DB.Get returns
+// messages older than the time. Messages are found by seq, assuming message time increases with seq,
+// as it does for messages written without an ID.
+func (q *Query) Seek(ts time.Time) *Query {
+	q.internal.seekTime = ts.Unix()
+	return q
+}
+
+// SeekSeq sets the query to start from the message of the seq, DB.Get returns messages with seq up to the seq.
+func (q *Query) SeekSeq(seq uint64) *Query {
+	q.internal.seekSeq = seq
+	return q
+}
+
+// WithID sets the ID of the message to get.
+func (q *Query) WithID(id []byte) *Query {
+	q.ID = id
+	return q
+}
+
 // WithLast sets query duration to fetch stored messages.
 func (q *Query) WithLast(dur string) *Query {
 	base := time.Now()
@@ -97,7 +212,7 @@ func (q *Query) parse() error {
 	// Parse the topic.
 	topic.Parse(q.Contract, true)
 	if topic.TopicType == message.TopicInvalid {
-		return errBadRequest
+		return ErrTopicInvalid
 	}
 	topic.AddContract(q.Contract)
 	q.internal.parts = topic.Parts
@@ -119,5 +234,16 @@ func (q *Query) parse() error {
 	if q.Limit == 0 {
 		q.Limit = q.internal.opts.defaultQueryLimit
 	}
+	q.internal.before = 0
+	if q.internal.cursor != nil {
+		c := q.internal.cursor
+		if len(c) != cursorSize || c[0] != cursorVersion || binary.LittleEndian.Uint64(c[1:9]) != q.internal.prefix {
+			return errCursorInvalid
+		}
+		q.internal.before = binary.LittleEndian.Uint64(c[9:17])
+	}
+	if seq := q.internal.seekSeq; seq != 0 && (q.internal.before == 0 || seq < q.internal.before) {
+		q.internal.before = seq + 1
+	}
 	return nil
 }
@@ -0,0 +1,423 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// Quota limits usage of a contract, so tenants with their own contract share the DB. Zero value of a limit is unlimited.
+	// Quotas apply under the limits of the DB, see WithLimit, and retention of topics of a contract is set by topic policies.
+	// In LimitEvict mode writes exceeding the quota on stored bytes or messages are accepted and the oldest messages
+	// of the contract are evicted by the retention job, see WithRetentionInterval.
+	Quota struct {
+		MaxTopics         int64     `json:"max_topics,omitempty"`           // The maximum number of topics of the contract.
+		MaxBytes          int64     `json:"max_bytes,omitempty"`            // The maximum size of message values stored for the contract.
+		MaxMessages       int64     `json:"max_messages,omitempty"`         // The maximum number of messages stored for the contract.
+		MaxMessagesPerDay int64     `json:"max_messages_per_day,omitempty"` // The maximum number of messages written to the contract per UTC day.
+		Rate              float64   `json:"rate,omitempty"`                 // The maximum rate of messages written to the contract per second.
+		Burst             int64     `json:"burst,omitempty"`                // The maximum number of messages written at once above the rate, it defaults to the rate.
+		Mode              LimitMode `json:"mode,omitempty"`                 // Whether a write exceeding the quota is rejected, only counted or evicts oldest messages.
+	}
+	// ContractStats is usage of a contract and its quota, see DB.ContractStats.
+	ContractStats struct {
+		Contract      uint32 `json:"contract"`
+		Topics        int64  `json:"topics"`         // Number of topics of the contract.
+		Bytes         int64  `json:"bytes"`          // Size of message values stored, excluding deleted and expired messages.
+		Messages      int64  `json:"messages"`       // Number of messages stored, excluding deleted and expired messages.
+		MessagesToday int64  `json:"messages_today"` // Number of messages written to the contract in the current UTC day.
+		Exceeded      int64  `json:"exceeded"`       // Number of writes exceeding the quota, including writes accepted in observe or evict mode.
+		Evicted       int64  `json:"evicted"`        // Number of messages evicted since the DB is opened.
+		Quota         *Quota `json:"quota,omitempty"`
+	}
+
+	// _QuotaRecord is a quota and messages written on a day to a contract persisted to the quota file.
+	_QuotaRecord struct {
+		Contract uint32 `json:"contract"`
+		Quota    *Quota `json:"quota,omitempty"`
+		Day      int64  `json:"day,omitempty"`
+		Messages int64  `json:"messages,omitempty"`
+	}
+	// _ContractUsage is usage of a contract counted against its quota.
+	_ContractUsage struct {
+		bytes       int64
+		stored      int64 // number of messages stored.
+		storedValid bool  // bytes and stored are counted from the DB since it is opened.
+		day         int64
+		messages    int64
+		exceeded    int64
+		evicted     int64
+	}
+	// _QuotaTable holds quotas and usage by contract and persists these to the quota file.
+	_QuotaTable struct {
+		mu     sync.Mutex
+		fsys   fs.FileSystem
+		path   string
+		quotas map[uint32]Quota
+		usage  map[uint32]*_ContractUsage
+		rates  int32 // number of quotas with a rate limit.
+	}
+)
+
+func quotaPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.quota", prefix))
+}
+
+// today returns the current UTC day as number of days since the epoch.
+func today() int64 {
+	return time.Now().Unix() / int64(24*time.Hour/time.Second)
+}
+
+// openQuotaTable reads quotas and messages written today from the quota file in the DB directory.
+func openQuotaTable(fsys fs.FileSystem, dirName string) (*_QuotaTable, error) {
+	t := &_QuotaTable{fsys: fsys, path: quotaPath(dirName), quotas: make(map[uint32]Quota), usage: make(map[uint32]*_ContractUsage)}
+	data, err := fs.ReadFile(fsys, t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var records []_QuotaRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, ErrCorrupted
+	}
+	for _, r := range records {
+		if r.Quota != nil {
+			t.quotas[r.Contract] = *r.Quota
+		}
+		if r.Messages > 0 {
+			t.usage[r.Contract] = &_ContractUsage{day: r.Day, messages: r.Messages}
+		}
+	}
+	t.countRates()
+	return t, nil
+}
+
+// countRates counts quotas with a rate limit. Caller must hold the lock.
+func (t *_QuotaTable) countRates() {
+	var rates int32
+	for _, q := range t.quotas {
+		if q.Rate > 0 {
+			rates++
+		}
+	}
+	atomic.StoreInt32(&t.rates, rates)
+}
+
+// hasRate returns true if a quota has a rate limit.
+func (t *_QuotaTable) hasRate() bool {
+	return atomic.LoadInt32(&t.rates) > 0
+}
+
+// usageOf returns usage of the contract, messages written are reset on a new day. Caller must hold the lock.
+func (t *_QuotaTable) usageOf(contract uint32) *_ContractUsage {
+	u, ok := t.usage[contract]
+	if !ok {
+		u = &_ContractUsage{}
+		t.usage[contract] = u
+	}
+	if day := today(); u.day != day {
+		u.day, u.messages = day, 0
+	}
+	return u
+}
+
+// write writes quotas and messages written today to a temporary file renamed over the quota file.
+// The quota file is not created until a quota is set. Caller must hold the lock.
+func (t *_QuotaTable) write() error {
+	if len(t.quotas) == 0 && !fs.Exists(t.fsys, t.path) {
+		return nil
+	}
+	day := today()
+	byContract := make(map[uint32]*_QuotaRecord)
+	for contract, q := range t.quotas {
+		q := q
+		byContract[contract] = &_QuotaRecord{Contract: contract, Quota: &q}
+	}
+	for contract, u := range t.usage {
+		if u.day != day || u.messages == 0 {
+			continue
+		}
+		r, ok := byContract[contract]
+		if !ok {
+			r = &_QuotaRecord{Contract: contract}
+			byContract[contract] = r
+		}
+		r.Day, r.Messages = u.day, u.messages
+	}
+	records := make([]_QuotaRecord, 0, len(byContract))
+	for _, r := range byContract {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Contract < records[j].Contract
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(t.fsys, t.path, data, os.FileMode(0666))
+}
+
+func (t *_QuotaTable) set(contract uint32, q Quota) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.quotas[contract] = q
+	t.countRates()
+	return t.write()
+}
+
+func (t *_QuotaTable) remove(contract uint32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.quotas[contract]; !ok {
+		return nil
+	}
+	delete(t.quotas, contract)
+	t.countRates()
+	return t.write()
+}
+
+// evictions returns quotas in evict mode with a limit on stored bytes or messages by contract.
+func (t *_QuotaTable) evictions() map[uint32]Quota {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var evictions map[uint32]Quota
+	for contract, q := range t.quotas {
+		if q.Mode != LimitEvict || (q.MaxBytes == 0 && q.MaxMessages == 0) {
+			continue
+		}
+		if evictions == nil {
+			evictions = make(map[uint32]Quota)
+		}
+		evictions[contract] = q
+	}
+	return evictions
+}
+
+// evicted counts messages evicted from the contract, stored bytes and messages of the contract are recounted.
+func (t *_QuotaTable) evicted(contract uint32, count int64) {
+	if count == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageOf(contract)
+	u.evicted += count
+	u.storedValid = false
+}
+
+func (t *_QuotaTable) get(contract uint32) (Quota, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.quotas[contract]
+	return q, ok
+}
+
+// close persists messages written today, so the daily quota holds if the DB is reopened on the same day.
+func (t *_QuotaTable) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.write()
+}
+
+// exceedQuota counts a write exceeding the quota of the contract and returns an error if the quota is enforced.
+// Caller must hold the lock of the quota table.
+func (db *DB) exceedQuota(contract uint32, u *_ContractUsage, q Quota, name string, value, max int64) error {
+	db.internal.meter.LimitsExceeded.Inc(1)
+	u.exceeded++
+	switch {
+	case q.Mode == LimitObserve:
+		db.internal.logger.Warn().Str("context", "db.checkQuota").Uint32("contract", contract).Str("quota", name).Int64("value", value).Int64("max", max).Msg("quota exceeded")
+		return nil
+	case q.Mode == LimitEvict && (name == "bytes" || name == "messages"):
+		// Oldest messages of the contract are evicted by the retention job.
+		return nil
+	}
+	return ErrQuotaExceeded
+}
+
+// checkTopicQuota checks the quota on number of topics of the contract before a new topic is added to the DB.
+func (db *DB) checkTopicQuota(contract uint32) error {
+	t := db.internal.quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.quotas[contract]
+	if !ok || q.MaxTopics == 0 {
+		return nil
+	}
+	if n := db.internal.topicNames.count(contract) + 1; n > q.MaxTopics {
+		return db.exceedQuota(contract, t.usageOf(contract), q, "topics", n, q.MaxTopics)
+	}
+	return nil
+}
+
+// checkQuota checks quota of the contract of the entry and counts the entry in usage of the contract if it is accepted.
+func (db *DB) checkQuota(e *Entry) error {
+	t := db.internal.quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageOf(e.Contract)
+	size := int64(e.entry.valueSize)
+	if q, ok := t.quotas[e.Contract]; ok {
+		if q.MaxMessagesPerDay > 0 && u.messages+1 > q.MaxMessagesPerDay {
+			if err := db.exceedQuota(e.Contract, u, q, "messages_per_day", u.messages+1, q.MaxMessagesPerDay); err != nil {
+				return err
+			}
+		}
+		if q.MaxBytes > 0 || q.MaxMessages > 0 {
+			if !u.storedValid {
+				bytes, stored, err := db.contractUsage(e.Contract)
+				if err != nil {
+					return err
+				}
+				u.bytes, u.stored, u.storedValid = bytes, stored, true
+			}
+			if exceeds(q.MaxBytes, u.bytes+size) {
+				if err := db.exceedQuota(e.Contract, u, q, "bytes", u.bytes+size, q.MaxBytes); err != nil {
+					return err
+				}
+			}
+			if exceeds(q.MaxMessages, u.stored+1) {
+				if err := db.exceedQuota(e.Contract, u, q, "messages", u.stored+1, q.MaxMessages); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	u.messages++
+	u.bytes += size
+	u.stored++
+	return nil
+}
+
+// contractUsage returns size of message values and number of messages of topics of the contract,
+// excluding deleted and expired messages.
+func (db *DB) contractUsage(contract uint32) (bytes, stored int64, err error) {
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	for _, tp := range db.internal.trie.all() {
+		if n, ok := db.internal.topicNames.get(tp.hash); !ok || n.contract != contract {
+			continue
+		}
+		seqs, _, err := db.liveSeqs(tp)
+		if err != nil {
+			return bytes, stored, err
+		}
+		for _, seq := range seqs {
+			if e, err := db.readEntry(_Query{seq: seq}); err == nil {
+				bytes += int64(e.valueSize)
+				stored++
+			}
+		}
+	}
+	return bytes, stored, nil
+}
+
+// recountQuotas recounts stored bytes and messages of contracts with a quota on these. Bytes and messages written
+// are added to usage of a contract as these are written, but deleted and expired messages are only subtracted when recounted.
+func (db *DB) recountQuotas() error {
+	t := db.internal.quotas
+	t.mu.Lock()
+	var contracts []uint32
+	for contract, q := range t.quotas {
+		if q.MaxBytes > 0 || q.MaxMessages > 0 {
+			contracts = append(contracts, contract)
+		}
+	}
+	t.mu.Unlock()
+	for _, contract := range contracts {
+		bytes, stored, err := db.contractUsage(contract)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		u := t.usageOf(contract)
+		u.bytes, u.stored, u.storedValid = bytes, stored, true
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// SetQuota sets quota of the contract, it replaces an existing quota of the contract.
+// Use zero contract for the master contract. The quota is persisted and applies to new writes,
+// topics and messages stored before the quota is set are not removed.
+func (db *DB) SetQuota(contract uint32, q Quota) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.quotas.set(contract, q)
+}
+
+// DeleteQuota removes quota of the contract. Use zero contract for the master contract.
+func (db *DB) DeleteQuota(contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.quotas.remove(contract)
+}
+
+// ContractStats returns usage of the contract and its quota. Use zero contract for the master contract.
+// Stored bytes are counted from window blocks and index entries of all topics of the contract.
+func (db *DB) ContractStats(contract uint32) (ContractStats, error) {
+	if err := db.ok(); err != nil {
+		return ContractStats{}, err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	bytes, stored, err := db.contractUsage(contract)
+	if err != nil {
+		return ContractStats{}, err
+	}
+	t := db.internal.quotas
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageOf(contract)
+	u.bytes, u.stored, u.storedValid = bytes, stored, true
+	stats := ContractStats{
+		Contract:      contract,
+		Topics:        db.internal.topicNames.count(contract),
+		Bytes:         bytes,
+		Messages:      stored,
+		MessagesToday: u.messages,
+		Exceeded:      u.exceeded,
+		Evicted:       u.evicted,
+	}
+	if q, ok := t.quotas[contract]; ok {
+		stats.Quota = &q
+	}
+	return stats, nil
+}
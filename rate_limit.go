@@ -0,0 +1,142 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// _TokenBucket admits writes at a rate per second with bursts of up to burst writes.
+	_TokenBucket struct {
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+	// _RateLimiter holds the token bucket of the DB and token buckets of contracts with a rate limit.
+	_RateLimiter struct {
+		mu        sync.Mutex
+		global    *_TokenBucket
+		contracts map[uint32]*_TokenBucket
+	}
+)
+
+func newTokenBucket(rate float64, burst int64, now time.Time) *_TokenBucket {
+	b := &_TokenBucket{last: now}
+	b.set(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// set sets rate and burst of the bucket, burst defaults to the rate.
+func (b *_TokenBucket) set(rate float64, burst int64) {
+	if burst <= 0 {
+		burst = int64(math.Ceil(rate))
+	}
+	b.rate, b.burst = rate, float64(burst)
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// available refills the bucket and returns true if n tokens can be taken. A write larger than the burst
+// is admitted once the bucket is full, so tokens are taken in debt and later writes wait for the bucket to refill.
+func (b *_TokenBucket) available(n float64, now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	return b.tokens >= math.Min(n, b.burst)
+}
+
+func newRateLimiter(rate float64, burst int64) *_RateLimiter {
+	l := &_RateLimiter{contracts: make(map[uint32]*_TokenBucket)}
+	if rate > 0 {
+		l.global = newTokenBucket(rate, burst, time.Now())
+	}
+	return l
+}
+
+// _RateTake holds the tokens checked for a write, these are taken once the write is accepted.
+type _RateTake struct {
+	l       *_RateLimiter
+	buckets []*_TokenBucket
+	takes   []float64
+}
+
+// take takes the tokens from the buckets. Writes checked concurrently may take tokens in debt,
+// so later writes wait for the buckets to refill.
+func (t *_RateTake) take() {
+	if t == nil {
+		return
+	}
+	t.l.mu.Lock()
+	defer t.l.mu.Unlock()
+	for i, b := range t.buckets {
+		b.tokens -= t.takes[i]
+	}
+}
+
+// allow checks tokens for writes of messages by contract in the bucket of the DB and in buckets of
+// contracts with a rate limit. It returns the tokens to take from all buckets once the write is accepted,
+// or the bucket without enough tokens and the number of tokens it lacks them for.
+func (l *_RateLimiter) allow(counts map[uint32]int64, quotas *_QuotaTable) (*_RateTake, *_TokenBucket, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var total int64
+	t := &_RateTake{l: l}
+	for contract, n := range counts {
+		total += n
+		q, ok := quotas.get(contract)
+		if !ok || q.Rate <= 0 {
+			delete(l.contracts, contract)
+			continue
+		}
+		b, ok := l.contracts[contract]
+		if !ok {
+			b = newTokenBucket(q.Rate, q.Burst, now)
+			l.contracts[contract] = b
+		}
+		b.set(q.Rate, q.Burst)
+		t.buckets, t.takes = append(t.buckets, b), append(t.takes, float64(n))
+	}
+	if l.global != nil {
+		t.buckets, t.takes = append(t.buckets, l.global), append(t.takes, float64(total))
+	}
+	for i, b := range t.buckets {
+		if !b.available(t.takes[i], now) {
+			return nil, b, t.takes[i]
+		}
+	}
+	return t, nil, 0
+}
+
+// checkRate checks rate limits of the DB and of contracts on writes of messages by contract, see WithRateLimit.
+// The caller takes the returned tokens once the write is accepted, so a rejected write does not take tokens.
+// A write exceeding the rate in observe mode is accepted without taking tokens.
+func (db *DB) checkRate(counts map[uint32]int64) (*_RateTake, error) {
+	if db.internal.rateLimiter.global == nil && !db.internal.quotas.hasRate() {
+		return nil, nil
+	}
+	t, b, n := db.internal.rateLimiter.allow(counts, db.internal.quotas)
+	if b != nil {
+		return nil, db.exceedLimit(LimitRate, int64(n), int64(b.burst), ErrRateLimited)
+	}
+	return t, nil
+}
@@ -19,8 +19,12 @@ package unitdb
 import (
 	"errors"
 	"fmt"
+	"io"
 	"sort"
+	"sync"
+	"sync/atomic"
 
+	"github.com/unit-io/unitdb/block"
 	"github.com/unit-io/unitdb/message"
 	// _ "net/http/pprof"
 )
@@ -42,6 +46,85 @@ func (db *_SyncHandle) recoverWindowBlocks(windowEntries map[uint64]_WindowEntri
 	return nil
 }
 
+// RecoveryProgress is the progress of the write ahead log recovery reported while the DB is opened.
+type RecoveryProgress struct {
+	// Blocks is the number of time blocks of the log applied to the DB.
+	Blocks int
+	// Entries is the number of entries applied to the DB.
+	Entries int64
+	// BytesRemaining is the size of the log not yet applied.
+	BytesRemaining int64
+}
+
+// _RecoveredEntry is an entry of the memdb decoded by a recovery worker.
+type _RecoveredEntry struct {
+	e         _IndexEntry
+	topicHash uint64
+	expiresAt uint32
+	topic     *message.Topic
+	err       error
+}
+
+// decodeEntries looks up and decodes entries of a time block, seqs are split into contiguous ranges
+// decoded by the recovery workers and entries are returned in the order of seqs.
+func (db *_SyncHandle) decodeEntries(timeID int64, seqs []uint64) []_RecoveredEntry {
+	entries := make([]_RecoveredEntry, len(seqs))
+	n := db.opts.recoveryWorkers
+	if n > len(seqs) {
+		n = len(seqs)
+	}
+	if n < 1 {
+		n = 1
+	}
+	size := (len(seqs) + n - 1) / n
+	var wg sync.WaitGroup
+	for start := 0; start < len(seqs); start += size {
+		end := start + size
+		if end > len(seqs) {
+			end = len(seqs)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				entries[i] = db.decodeEntry(timeID, seqs[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return entries
+}
+
+func (db *_SyncHandle) decodeEntry(timeID int64, seq uint64) _RecoveredEntry {
+	memdata, err := db.internal.mem.Lookup(timeID, seq)
+	if err != nil || memdata == nil {
+		return _RecoveredEntry{err: err}
+	}
+	var m _Entry
+	if err := m.UnmarshalBinary(memdata[:entrySize]); err != nil {
+		return _RecoveredEntry{err: err}
+	}
+	r := _RecoveredEntry{
+		e: _IndexEntry{
+			seq:       m.seq,
+			topicSize: m.topicSize,
+			valueSize: m.valueSize,
+
+			cache: memdata[entrySize:],
+		},
+		topicHash: m.topicHash,
+		expiresAt: m.expiresAt,
+	}
+	if m.topicSize != 0 {
+		rawtopic, _ := db.internal.reader.readTopic(r.e)
+		r.topic = new(message.Topic)
+		if err := r.topic.Unmarshal(rawtopic); err != nil {
+			return _RecoveredEntry{err: err}
+		}
+	}
+	return r
+}
+
 func (db *_SyncHandle) startRecovery() error {
 	// p := profile.Start(profile.MemProfile, profile.ProfilePath("."), profile.NoShutdownHook)
 	// defer p.Stop()
@@ -49,18 +132,38 @@ func (db *_SyncHandle) startRecovery() error {
 	defer func() {
 		db.internal.closeW.Done()
 	}()
-	fmt.Println("db.recoverLog: start recovery")
+	// The DB sequence is persisted on sync, so it is behind entries of the log after a crash.
+	// Advance it so the entries are recovered and new entries do not reuse their sequence.
+	var last uint64
+	for _, seq := range db.internal.mem.Keys() {
+		if seq > last {
+			last = seq
+		}
+	}
+	for {
+		seq := db.seq()
+		if seq >= last || atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, seq, last) {
+			break
+		}
+	}
 	if ok := db.startSync(); !ok {
 		return nil
 	}
 	defer func() {
 		db.finish()
 	}()
+	db.internal.logger.Info().Str("context", "db.recoverLog").Int64("log_size", db.internal.mem.LogSize()).Msg("start recovery")
 
 	var err1 error
+	var progress RecoveryProgress
+	ctx := db.opts.recoveryContext
 	pendingEntries := make(map[uint64]_WindowEntries)
 
 	err := db.internal.mem.All(func(timeID int64, seqs []uint64) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			err1 = err
+			return true, err
+		}
 		winEntries := make(map[uint64]_WindowEntries)
 		sort.Slice(seqs[:], func(i, j int) bool {
 			return seqs[i] < seqs[j]
@@ -68,48 +171,50 @@ func (db *_SyncHandle) startRecovery() error {
 		if seqs[len(seqs)-1] > db.syncInfo.upperSeq {
 			db.syncInfo.upperSeq = seqs[len(seqs)-1]
 		}
-		for _, seq := range seqs {
-			memdata, err := db.internal.mem.Lookup(timeID, seq)
-			if err != nil || memdata == nil {
-				db.syncInfo.entriesInvalid++
-				logger.Error().Err(err).Str("context", "mem.Get")
-				err1 = err
-				continue
+		// Entries are decoded by the recovery workers and appended in order of seqs.
+		entries := db.decodeEntries(timeID, seqs)
+		markers := make(map[uint64]uint64)
+		for _, r := range entries {
+			if r.err == nil && r.e.seq != 0 && r.e.valueSize == 0 && r.e.seq > markers[r.topicHash] {
+				markers[r.topicHash] = r.e.seq
 			}
-			var m _Entry
-			if err = m.UnmarshalBinary(memdata[:entrySize]); err != nil {
+		}
+		if err := db.replaceTopics(markers, pendingEntries); err != nil {
+			return true, err
+		}
+		for _, r := range entries {
+			if r.err != nil || r.e.seq == 0 {
 				db.syncInfo.entriesInvalid++
-				err1 = err
+				db.internal.logger.Error().Err(r.err).Str("context", "mem.Get")
+				err1 = r.err
 				continue
 			}
-			e := _IndexEntry{
-				seq:       m.seq,
-				topicSize: m.topicSize,
-				valueSize: m.valueSize,
-
-				cache: memdata[entrySize:],
+			// Entries of a replaced topic written before the replace marker are deleted.
+			if r.e.valueSize == 0 || r.e.seq < markers[r.topicHash] {
+				continue
 			}
+			e := r.e
+			exist := false
 			if err := db.blockWriter.append(e); err != nil {
-				if err == errEntryExist {
-					continue
+				if err != errEntryExist {
+					return true, err
 				}
-				return true, err
+				// The entry was synced before the filter was written, its window entry may not
+				// be synced, window entries already in window blocks are not appended again.
+				exist = true
 			}
-			if m.topicSize != 0 {
-				rawtopic, _ := db.internal.reader.readTopic(e)
-
-				t := new(message.Topic)
-				if err := t.Unmarshal(rawtopic); err != nil {
-					return false, err
-				}
-				db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth)
+			if r.topic != nil {
+				db.internal.trie.add(newTopic(r.topicHash, 0), r.topic.Parts, r.topic.Depth)
 			}
-			if _, ok := winEntries[m.topicHash]; ok {
-				winEntries[m.topicHash] = append(winEntries[m.topicHash], newWinEntry(e.seq, m.expiresAt))
+			if _, ok := winEntries[r.topicHash]; ok {
+				winEntries[r.topicHash] = append(winEntries[r.topicHash], newWinEntry(e.seq, r.expiresAt))
 			} else {
-				winEntries[m.topicHash] = _WindowEntries{newWinEntry(m.seq, m.expiresAt)}
+				winEntries[r.topicHash] = _WindowEntries{newWinEntry(e.seq, r.expiresAt)}
+			}
+			db.internal.filter.Append(e.seq, r.expiresAt)
+			if exist {
+				continue
 			}
-			db.internal.filter.Append(e.seq)
 			db.syncInfo.count++
 			db.syncInfo.inBytes += int64(e.valueSize)
 		}
@@ -129,10 +234,11 @@ func (db *_SyncHandle) startRecovery() error {
 			}
 		}
 		if err := db.recoverWindowBlocks(winEntries); err != nil {
-			logger.Error().Err(err).Str("context", "db.recoverWindowBlocks")
+			db.internal.logger.Error().Err(err).Str("context", "db.recoverWindowBlocks")
 			return true, err
 		}
 		// timeRelease := db.internal.timeWindow.release()
+		count := db.syncInfo.count
 		if err := db.sync(true); err != nil {
 			return true, err
 		}
@@ -144,6 +250,9 @@ func (db *_SyncHandle) startRecovery() error {
 				return true, err
 			}
 		}
+		progress.Blocks++
+		progress.Entries += count
+		db.reportRecovery(progress)
 
 		return false, nil
 	})
@@ -155,11 +264,64 @@ func (db *_SyncHandle) startRecovery() error {
 	}
 
 	if err := db.recoverWindowBlocks(pendingEntries); err != nil {
-		logger.Error().Err(err).Str("context", "db.recoverWindowBlocks")
+		db.internal.logger.Error().Err(err).Str("context", "db.recoverWindowBlocks")
 		return err
 	}
 
-	return db.sync(true)
+	progress.Entries += db.syncInfo.count
+	if err := db.sync(true); err != nil {
+		return err
+	}
+	db.reportRecovery(progress)
+	db.internal.logger.Info().Str("context", "db.recoverLog").Int("blocks", progress.Blocks).Int64("entries", progress.Entries).Msg("recovery done")
+	return nil
+}
+
+// replaceTopics deletes entries of topics written before their replace marker, so a topic replaced by
+// ReplaceTopic is replaced if the DB crashed before entries of the topic were deleted. Entries of the
+// log synced by recovery and window entries pending for the topic are deleted.
+func (db *_SyncHandle) replaceTopics(markers map[uint64]uint64, pendingEntries map[uint64]_WindowEntries) error {
+	// Entries of time blocks of the log before the markers are already synced.
+	for h, markerSeq := range markers {
+		pending := pendingEntries[h][:0]
+		for _, we := range pendingEntries[h] {
+			if we.seq() > markerSeq {
+				pending = append(pending, we)
+			}
+		}
+		pendingEntries[h] = pending
+		off, ok := db.internal.trie.getOffset(h)
+		if !ok {
+			continue
+		}
+		seqs, err := db.topicSeqs(h, off)
+		if err != nil {
+			return err
+		}
+		deleted := seqs[:0]
+		for _, seq := range seqs {
+			if seq < markerSeq {
+				deleted = append(deleted, seq)
+			}
+		}
+		// Index blocks of the recovery are written by its block writer, so entries are deleted with it.
+		count, _, err := db.reclaimEntries(db.blockWriter, deleted)
+		if err != nil {
+			return err
+		}
+		db.internal.winCounts.removeTopic(h)
+		db.internal.meter.Dels.Inc(count)
+	}
+	return nil
+}
+
+// reportRecovery calls the recovery progress callback with the progress and the size of the log not yet applied.
+func (db *_SyncHandle) reportRecovery(progress RecoveryProgress) {
+	if db.opts.recoveryProgress == nil {
+		return
+	}
+	progress.BytesRemaining = db.internal.mem.LogSize()
+	db.opts.recoveryProgress(progress)
 }
 
 func (db *DB) recoverLog() error {
@@ -176,3 +338,147 @@ func (db *DB) recoverLog() error {
 
 	return nil
 }
+
+// recoverBlocks repairs index and window blocks torn by a crash before the log is recovered. Blocks are
+// rewritten in place as entries are synced, so a block torn by a crash keeps the entries synced before
+// the crash and the entries of the log are appended to it again by the log recovery. Entries of the log
+// whose message was not written to the data file before the crash are removed from index blocks, and
+// window blocks chained to a block that was not written are chained to the previous block of the topic.
+func (db *DB) recoverBlocks() error {
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	vlogFile, err := db.fs.getFile(_FileDesc{fileType: typeValueLog})
+	if err != nil {
+		return err
+	}
+	logSeqs := make(map[uint64]struct{})
+	for _, seq := range db.internal.mem.Keys() {
+		logSeqs[seq] = struct{}{}
+	}
+
+	// A block extended but not written before the crash is truncated.
+	for _, f := range []*_File{indexFile, winFile} {
+		if size := f.currSize(); size%f.blockSize() != 0 {
+			if err := f.truncate(size - size%f.blockSize()); err != nil {
+				return err
+			}
+		}
+	}
+
+	var repaired int
+	nIndexBlocks := int32(indexFile.currSize() / indexFile.blockSize())
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		off := indexFile.blockOffset(bIdx)
+		buf, err := indexFile.slice(off, off+indexFile.blockSize())
+		if err != nil {
+			return err
+		}
+		var b _IndexBlock
+		torn := false
+		if err := b.unmarshalBinary(buf); err != nil {
+			if err != block.ErrChecksum {
+				return err
+			}
+			if err := b.unmarshalTorn(buf); err != nil {
+				return err
+			}
+			torn = true
+		}
+		n := uint16(0)
+		for _, e := range b.entries[:b.entryIdx] {
+			if _, ok := logSeqs[e.seq]; ok || torn {
+				if indexFile.blockIndex(e.seq) != bIdx {
+					continue
+				}
+				if !e.isDeleted() {
+					if _, err := readMessageData(dataFile, vlogFile, e); err != nil {
+						if !errors.Is(err, block.ErrChecksum) && err != io.EOF && err != io.ErrUnexpectedEOF {
+							return err
+						}
+						continue
+					}
+				}
+			}
+			b.entries[n] = e
+			n++
+		}
+		if n == b.entryIdx && !torn {
+			continue
+		}
+		for i := n; i < b.entryIdx; i++ {
+			b.entries[i] = _IndexEntry{}
+		}
+		b.entryIdx = n
+		if _, err := indexFile.WriteAt(b.marshalBinary(), off); err != nil {
+			return err
+		}
+		repaired++
+	}
+
+	nWinBlocks := int32(winFile.currSize() / winFile.blockSize())
+	blocks := make([]_WinBlock, nWinBlocks)
+	dirty := make(map[int32]bool)
+	for wIdx := int32(0); wIdx < nWinBlocks; wIdx++ {
+		off := winFile.blockOffset(wIdx)
+		buf, err := winFile.slice(off, off+winFile.blockSize())
+		if err != nil {
+			return err
+		}
+		if err := blocks[wIdx].unmarshalBinary(buf); err != nil {
+			if err != block.ErrChecksum {
+				return err
+			}
+			if err := blocks[wIdx].unmarshalTorn(buf); err != nil {
+				return err
+			}
+			if blocks[wIdx].entryIdx == 0 {
+				blocks[wIdx] = winFile.newWinBlock()
+			}
+			dirty[wIdx] = true
+		}
+	}
+	for wIdx, b := range blocks {
+		if b.entryIdx == 0 || b.next == 0 {
+			continue
+		}
+		next := int32(b.next / winFile.blockSize())
+		if next < int32(wIdx) && blocks[next].entryIdx != 0 && blocks[next].topicHash == b.topicHash {
+			continue
+		}
+		// The previous block of the topic was not written, the block is chained to the block before it.
+		b.next = 0
+		for prev := int32(wIdx) - 1; prev >= 0; prev-- {
+			if blocks[prev].entryIdx != 0 && blocks[prev].topicHash == b.topicHash && winFile.blockOffset(prev) < blocks[wIdx].next {
+				b.next = winFile.blockOffset(prev)
+				break
+			}
+		}
+		blocks[wIdx] = b
+		dirty[int32(wIdx)] = true
+	}
+	for wIdx := range dirty {
+		if _, err := winFile.WriteAt(blocks[wIdx].marshalBinary(), winFile.blockOffset(wIdx)); err != nil {
+			return err
+		}
+		repaired++
+	}
+
+	if repaired == 0 {
+		return nil
+	}
+	db.internal.logger.Warn().Str("context", "db.recoverBlocks").Int("blocks", repaired).Msg("repaired blocks torn by a crash")
+	if err := indexFile.Sync(); err != nil {
+		return err
+	}
+	return winFile.Sync()
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/unit-io/unitdb/crypto"
+	"github.com/unit-io/unitdb/fs"
+)
+
+const (
+	// DefaultCodec is the name of the codec values are compressed with by default.
+	DefaultCodec = "snappy"
+
+	// DefaultCipherSuite is the name of the cipher suite values are encrypted with by default.
+	DefaultCipherSuite = "mac"
+)
+
+// Codec compresses values before these are stored in the DB and decompresses values read from the DB.
+type Codec interface {
+	// Encode appends the encoded src to dst and returns the resulting byte slice.
+	Encode(dst, src []byte) []byte
+
+	// Decode appends the decoded src to dst and returns the resulting byte slice.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// StreamCodec is a codec decoding values incrementally. Payloads of messages read by a query with
+// StreamValues set are decoded by its reader as these are read, see Message.ValueReader.
+type StreamCodec interface {
+	Codec
+
+	// NewReader returns a reader of the decoded src.
+	NewReader(src io.Reader) io.Reader
+}
+
+// CipherSuite creates the cipher of an encryption key, see WithEncryptionKey.
+type CipherSuite func(key []byte) (crypto.Cipher, error)
+
+// CompactionFilter is called by compaction for each live entry with the message ID and the decoded value,
+// the entry is dropped if the filter returns true.
+type CompactionFilter func(id, value []byte) bool
+
+// registry holds codecs, cipher suites and compaction filters registered by name. Codec and cipher suite
+// names are persisted in the DB directory, so a DB is not opened with a codec or a cipher suite other
+// than the one its values are stored with.
+var registry = struct {
+	mu                sync.RWMutex
+	codecs            map[string]Codec
+	cipherSuites      map[string]CipherSuite
+	compactionFilters map[string]CompactionFilter
+}{
+	codecs:            make(map[string]Codec),
+	cipherSuites:      make(map[string]CipherSuite),
+	compactionFilters: make(map[string]CompactionFilter),
+}
+
+func init() {
+	RegisterCodec(DefaultCodec, snappyCodec{})
+	RegisterCodec("none", noneCodec{})
+	RegisterCipherSuite(DefaultCipherSuite, crypto.NewCipher)
+}
+
+// RegisterCodec makes a codec available by the name, see WithCodec.
+// If RegisterCodec is called twice with the same name or if codec is nil, it panics.
+func RegisterCodec(name string, codec Codec) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if codec == nil {
+		panic("unitdb: RegisterCodec codec is nil")
+	}
+	if _, dup := registry.codecs[name]; dup {
+		panic("unitdb: RegisterCodec called twice for codec " + name)
+	}
+	registry.codecs[name] = codec
+}
+
+// RegisterCipherSuite makes a cipher suite available by the name, see WithCipherSuite.
+// If RegisterCipherSuite is called twice with the same name or if suite is nil, it panics.
+func RegisterCipherSuite(name string, suite CipherSuite) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if suite == nil {
+		panic("unitdb: RegisterCipherSuite suite is nil")
+	}
+	if _, dup := registry.cipherSuites[name]; dup {
+		panic("unitdb: RegisterCipherSuite called twice for cipher suite " + name)
+	}
+	registry.cipherSuites[name] = suite
+}
+
+// RegisterCompactionFilter makes a compaction filter available by the name, see WithCompactionFilter.
+// If RegisterCompactionFilter is called twice with the same name or if filter is nil, it panics.
+func RegisterCompactionFilter(name string, filter CompactionFilter) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if filter == nil {
+		panic("unitdb: RegisterCompactionFilter filter is nil")
+	}
+	if _, dup := registry.compactionFilters[name]; dup {
+		panic("unitdb: RegisterCompactionFilter called twice for compaction filter " + name)
+	}
+	registry.compactionFilters[name] = filter
+}
+
+// Codecs returns a sorted list of names of the registered codecs.
+func Codecs() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	names := make([]string, 0, len(registry.codecs))
+	for name := range registry.codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(dst, src []byte) []byte {
+	return snappy.Encode(dst, src)
+}
+
+func (snappyCodec) Decode(dst, src []byte) ([]byte, error) {
+	return snappy.Decode(dst, src)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Encode(dst, src []byte) []byte {
+	return append(dst[:0], src...)
+}
+
+func (noneCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst[:0], src...), nil
+}
+
+func (noneCodec) NewReader(src io.Reader) io.Reader {
+	return src
+}
+
+// Values of a DB storing raw values start with a byte telling whether the value is encoded by the codec.
+const (
+	rawValue     = 0
+	encodedValue = 1
+)
+
+// _Plugins holds the plugins the DB is opened with.
+type _Plugins struct {
+	Codec       string `json:"codec"`
+	CipherSuite string `json:"cipher_suite"`
+	// RawValues is set if values smaller than the compression min size are stored without encoding
+	// by the codec, see WithCompressionMinSize.
+	RawValues bool `json:"raw_values,omitempty"`
+
+	codec            Codec
+	cipherSuite      CipherSuite
+	compactionFilter CompactionFilter
+	// Compression dictionaries of topics, see WithDeflateDictionaries.
+	dictionaries *_Dictionaries
+	// minCompressSize is the size of the smallest value encoded by the codec if the DB stores raw values.
+	minCompressSize int
+}
+
+func pluginsPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.plugins", prefix))
+}
+
+// openPlugins looks up the plugins of the options and checks codec and cipher suite against the
+// names persisted in the DB directory. Names are persisted on first open, a DB created before
+// names were persisted uses the default codec and cipher suite. Storing raw values is persisted
+// with the names, it is set once the DB is created with a compression min size.
+func openPlugins(fsys fs.FileSystem, dirName string, opts *_Options, created bool) (*_Plugins, error) {
+	p := &_Plugins{Codec: opts.codec, CipherSuite: opts.cipherSuite, RawValues: opts.compressionMinSize > 0, minCompressSize: opts.compressionMinSize}
+	registry.mu.RLock()
+	var ok bool
+	p.codec, ok = registry.codecs[p.Codec]
+	if ok {
+		p.cipherSuite, ok = registry.cipherSuites[p.CipherSuite]
+	}
+	if ok && opts.compactionFilter != "" {
+		p.compactionFilter, ok = registry.compactionFilters[opts.compactionFilter]
+	}
+	registry.mu.RUnlock()
+	if !ok {
+		return nil, errPluginNotRegistered
+	}
+	dictionaries, err := openDictionaries(fsys, dirName)
+	if err != nil {
+		return nil, err
+	}
+	p.dictionaries = dictionaries
+
+	name := pluginsPath(dirName)
+	data, err := fs.ReadFile(fsys, name)
+	switch {
+	case os.IsNotExist(err):
+		persisted := _Plugins{Codec: p.Codec, CipherSuite: p.CipherSuite, RawValues: p.RawValues}
+		if !created {
+			persisted = _Plugins{Codec: DefaultCodec, CipherSuite: DefaultCipherSuite}
+		}
+		if persisted.Codec != p.Codec || persisted.CipherSuite != p.CipherSuite || persisted.RawValues != p.RawValues {
+			return nil, errPluginMismatch
+		}
+		if data, err = json.Marshal(persisted); err != nil {
+			return nil, err
+		}
+		return p, fs.WriteFileSync(fsys, name, data, os.FileMode(0666))
+	case err != nil:
+		return nil, err
+	}
+	var persisted _Plugins
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, ErrCorrupted
+	}
+	// A DB storing raw values is opened without a compression min size to encode all values.
+	if persisted.Codec != p.Codec || persisted.CipherSuite != p.CipherSuite || (p.RawValues && !persisted.RawValues) {
+		return nil, errPluginMismatch
+	}
+	p.RawValues = persisted.RawValues
+	return p, nil
+}
+
+// encode encodes the value by the codec. A DB storing raw values prefixes the value with a byte
+// telling whether the value is encoded, values smaller than the compression min size are not encoded.
+func (p *_Plugins) encode(value []byte) []byte {
+	if !p.RawValues {
+		return p.codec.Encode(nil, value)
+	}
+	if len(value) < p.minCompressSize {
+		return append([]byte{rawValue}, value...)
+	}
+	return append([]byte{encodedValue}, p.codec.Encode(nil, value)...)
+}
+
+// decode decodes the value encoded by encode.
+func (p *_Plugins) decode(value []byte) ([]byte, error) {
+	if !p.RawValues {
+		return p.codec.Decode(nil, value)
+	}
+	if len(value) == 0 {
+		return nil, ErrCorrupted
+	}
+	switch value[0] {
+	case rawValue:
+		return append([]byte(nil), value[1:]...), nil
+	case encodedValue:
+		return p.codec.Decode(nil, value[1:])
+	default:
+		return nil, ErrCorrupted
+	}
+}
+
+// decodeReader returns a function opening readers of the value encoded by encode. The value is decoded
+// by each reader as it is read if the codec is a StreamCodec, otherwise it is decoded once in memory.
+func (p *_Plugins) decodeReader(value []byte) (func() io.Reader, error) {
+	if p.RawValues {
+		if len(value) == 0 {
+			return nil, ErrCorrupted
+		}
+		switch value[0] {
+		case rawValue:
+			return func() io.Reader { return bytes.NewReader(value[1:]) }, nil
+		case encodedValue:
+			value = value[1:]
+		default:
+			return nil, ErrCorrupted
+		}
+	}
+	if sc, ok := p.codec.(StreamCodec); ok {
+		return func() io.Reader { return sc.NewReader(bytes.NewReader(value)) }, nil
+	}
+	val, err := p.codec.Decode(nil, value)
+	if err != nil {
+		return nil, err
+	}
+	return func() io.Reader { return bytes.NewReader(val) }, nil
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// repairExt is the suffix of DB files moved aside by Repair.
+	repairExt = ".bak"
+
+	// repairSyncEntries is the number of salvaged entries applied to the DB between syncs.
+	repairSyncEntries = 10000
+)
+
+// RepairReport reports the entries salvaged by Repair.
+type RepairReport struct {
+	Salvaged      int64 `json:"salvaged"`       // Entries salvaged into the repaired DB.
+	Discarded     int64 `json:"discarded"`      // Entries discarded as these could not be read or their topic is lost.
+	CorruptBlocks int64 `json:"corrupt_blocks"` // Index blocks discarded with all of their entries.
+}
+
+// _SalvagedEntry is an entry read from the index and data files, its value is stored as encoded in the data file.
+type _SalvagedEntry struct {
+	seq       uint64
+	topicHash uint64
+	expiresAt uint32
+	id        []byte
+	value     []byte
+}
+
+// Repair repairs a DB that fails to open as its index or data file is torn or corrupted. It salvages
+// entries that are read and decoded from the index and data files, moves the DB files aside with
+// a .bak suffix and rebuilds the DB from salvaged entries and the write ahead log. The trie, the
+// window blocks and the filter are rebuilt as entries are synced to the repaired DB.
+//
+// The DB is repaired with the options it is opened with, so entries can be decoded and decrypted.
+func Repair(path string, opts ...Options) (*RepairReport, error) {
+	options := newOptions(opts...)
+	fsys := options.fileSystem
+	report := &RepairReport{}
+	layout, err := repairLayout(fsys, path, options.blockSize)
+	if err != nil {
+		return report, err
+	}
+	entries, topics, err := salvage(fsys, path, options, layout, report)
+	if err != nil {
+		return report, err
+	}
+
+	// Move the DB files aside, the keyring, the policies and the write ahead log are kept.
+	for _, fileType := range []_FileType{typeInfo, typeTimeWindow, typeIndex, typeData, typeLease, typeFilter, typeValueLog} {
+		name := filePath(path, _FileDesc{fileType: fileType})
+		if !fs.Exists(fsys, name) {
+			continue
+		}
+		if err := fsys.Rename(name, name+repairExt); err != nil {
+			return report, err
+		}
+		if err := syncDir(fsys, fileDir(path, fileType)); err != nil {
+			return report, err
+		}
+	}
+
+	// Window counts are rebuilt from the repaired window blocks.
+	if err := fsys.Remove(windowCountsPath(path)); err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+
+	// The DB is rebuilt with the block size it was created with.
+	db, err := Open(path, append(opts, WithBlockSize(layout.Size))...)
+	if err != nil {
+		return report, err
+	}
+	defer db.Close()
+	emitted := make(map[uint64]bool)
+	for _, se := range entries {
+		// The first entry of a topic carries the topic, as the entry that carried it may be deleted or lost.
+		var rawTopic []byte
+		if !emitted[se.topicHash] {
+			rawTopic = topics[se.topicHash]
+		}
+		m := _Entry{seq: se.seq, topicSize: uint16(len(rawTopic)), valueSize: uint32(len(se.value)), expiresAt: se.expiresAt, topicHash: se.topicHash}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return report, err
+		}
+		data = append(data, se.id...)
+		data = append(data, rawTopic...)
+		data = append(data, se.value...)
+		applied, err := db.applyHandoffEntry(data)
+		if err != nil {
+			return report, err
+		}
+		if !applied {
+			continue
+		}
+		emitted[se.topicHash] = true
+		report.Salvaged++
+		if report.Salvaged%repairSyncEntries == 0 {
+			if err := db.Sync(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		return report, err
+	}
+	db.internal.logger.Info().Str("context", "db.Repair").Int64("salvaged", report.Salvaged).Int64("discarded", report.Discarded).Int64("corrupt_blocks", report.CorruptBlocks).Msg("DB repaired")
+	return report, nil
+}
+
+// salvage reads live entries from the index and data files in sequence order. It returns entries
+// and topics of the entries by topic hash. Entries are skipped if the topic of the entry is unknown.
+func salvage(fsys fs.FileSystem, path string, options *_Options, layout block.Layout, report *RepairReport) ([]_SalvagedEntry, map[uint64][]byte, error) {
+	lock, err := createLockFile(fsys, path)
+	if err != nil {
+		if err == os.ErrExist {
+			err = ErrLocked
+		}
+		return nil, nil, err
+	}
+	defer lock.unlock()
+
+	plugins, err := openPlugins(fsys, path, options, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyring, err := openKeyring(fsys, path, options.encryptionKey, options.cipher, plugins.cipherSuite)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := keyring.openContractKeys(path, options.contractKeys); err != nil {
+		return nil, nil, err
+	}
+	winData, err := readRepairFile(fsys, path, typeTimeWindow)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexData, err := readRepairFile(fsys, path, typeIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataFile, err := fs.Open(fsys, filePath(path, _FileDesc{fileType: typeData}))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	var dataSize int64
+	if dataFile != nil {
+		defer dataFile.Close()
+		stat, err := dataFile.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		dataSize = stat.Size()
+	}
+	vlogFile, err := fs.Open(fsys, filePath(path, _FileDesc{fileType: typeValueLog}))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if vlogFile != nil {
+		defer vlogFile.Close()
+	}
+
+	// Topic hash and expiry of entries are read from window blocks.
+	type winInfo struct {
+		topicHash uint64
+		expiresAt uint32
+	}
+	wins := make(map[uint64]winInfo)
+	size := int(layout.Size)
+	for off := 0; off+size <= len(winData); off += size {
+		var b _WinBlock
+		if err := b.unmarshalBinary(winData[off : off+size]); err != nil || int(b.entryIdx) > len(b.entries) {
+			continue
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.seq() != 0 {
+				wins[we.seq()] = winInfo{topicHash: b.topicHash, expiresAt: we.expiryTime()}
+			}
+		}
+	}
+
+	var entries []_SalvagedEntry
+	topics := make(map[uint64][]byte)
+	for off := 0; off+size <= len(indexData); off += size {
+		bIdx := int32(off / size)
+		var b _IndexBlock
+		if err := b.unmarshalBinary(indexData[off : off+size]); err != nil || int(b.entryIdx) > len(b.entries) {
+			report.CorruptBlocks++
+			continue
+		}
+		for _, e := range b.entries[:b.entryIdx] {
+			if e.seq == 0 || e.msgOffset == -1 {
+				continue
+			}
+			if layout.Index(e.seq) != bIdx || e.msgOffset < 0 || e.msgOffset+int64(e.mSize()) > dataSize {
+				report.Discarded++
+				continue
+			}
+			msg := make([]byte, e.mSize())
+			if _, err := dataFile.ReadAt(msg, e.msgOffset); err != nil {
+				report.Discarded++
+				continue
+			}
+			if e.valueSize != 0 {
+				if msg, err = block.VerifyMessage(msg); err != nil {
+					report.Discarded++
+					continue
+				}
+			}
+			if e.valueLog && e.valueSize != 0 {
+				n := idSize + int(e.topicSize)
+				var p block.ValuePointer
+				if vlogFile == nil || p.UnmarshalBinary(msg[n:]) != nil {
+					report.Discarded++
+					continue
+				}
+				rec := make([]byte, int64(p.Size)+block.ChecksumSize)
+				if _, err := vlogFile.ReadAt(rec, p.Offset); err != nil {
+					report.Discarded++
+					continue
+				}
+				val, err := block.VerifyMessage(rec)
+				if err != nil {
+					report.Discarded++
+					continue
+				}
+				msg = append(msg[:n:n], val...)
+			}
+			if e.chunked && e.valueSize != 0 {
+				n := idSize + int(e.topicSize)
+				val, err := salvageChunks(dataFile, msg[n:])
+				if err != nil {
+					report.Discarded++
+					continue
+				}
+				msg = append(msg[:n:n], val...)
+			}
+			id := msg[:idSize]
+			w, ok := wins[e.seq]
+			if e.topicSize != 0 {
+				t := new(message.Topic)
+				rawTopic := msg[idSize : idSize+int(e.topicSize)]
+				if err := t.Unmarshal(rawTopic); err != nil {
+					report.Discarded++
+					continue
+				}
+				w.topicHash, ok = t.GetHash(binary.LittleEndian.Uint32(id[4:8])), true
+				topics[w.topicHash] = rawTopic
+			}
+			if e.isDeleted() {
+				continue
+			}
+			value := msg[idSize+int(e.topicSize):]
+			if !ok {
+				report.Discarded++
+				continue
+			}
+			// The cipher may decrypt in place, so a copy of the value is decoded.
+			// Messages of a contract with its key not set are salvaged without decoding these.
+			if _, err := decodeValue(keyring, plugins, id, append([]byte(nil), value...)); err != nil && err != errContractKeyNotSet {
+				report.Discarded++
+				continue
+			}
+			if w.expiresAt != 0 && newWinEntry(e.seq, w.expiresAt).isExpired() {
+				continue
+			}
+			entries = append(entries, _SalvagedEntry{seq: e.seq, topicHash: w.topicHash, expiresAt: w.expiresAt, id: id, value: value})
+		}
+	}
+
+	// Entries of a topic with the topic lost are discarded.
+	salvaged := entries[:0]
+	for _, se := range entries {
+		if _, ok := topics[se.topicHash]; !ok {
+			report.Discarded++
+			continue
+		}
+		salvaged = append(salvaged, se)
+	}
+	sort.Slice(salvaged, func(i, j int) bool {
+		return salvaged[i].seq < salvaged[j].seq
+	})
+	return salvaged, topics, nil
+}
+
+// salvageChunks reads the value stored in chunks of the value pointers from the data file.
+func salvageChunks(dataFile fs.File, data []byte) ([]byte, error) {
+	ptrs, err := block.UnmarshalChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	for _, p := range ptrs {
+		rec := make([]byte, int64(p.Size)+block.ChecksumSize)
+		if _, err := dataFile.ReadAt(rec, p.Offset); err != nil {
+			return nil, err
+		}
+		chunk, err := block.VerifyMessage(rec)
+		if err != nil {
+			return nil, err
+		}
+		val = append(val, chunk...)
+	}
+	return val, nil
+}
+
+// repairLayout returns the block layout of the DB to repair read from the info file. The block size
+// option is used if the info file is missing or corrupted.
+func repairLayout(fsys fs.FileSystem, path string, blockSize int32) (block.Layout, error) {
+	data, err := readRepairFile(fsys, path, typeInfo)
+	if err != nil {
+		return block.Layout{}, err
+	}
+	var inf _DBInfo
+	if len(data) >= int(fixed) {
+		inf.UnmarshalBinary(data)
+	}
+	if !bytes.Equal(inf.header.signature[:], signature[:]) {
+		inf.blockSize = blockSize
+	}
+	layout, err := inf.layout(blockSize)
+	if err == ErrCorrupted {
+		return _DBInfo{blockSize: blockSize}.layout(blockSize)
+	}
+	return layout, err
+}
+
+// readRepairFile reads the DB file of the file type, a missing file is read as empty.
+func readRepairFile(fsys fs.FileSystem, path string, fileType _FileType) ([]byte, error) {
+	data, err := fs.ReadFile(fsys, filePath(path, _FileDesc{fileType: fileType}))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
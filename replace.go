@@ -0,0 +1,205 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"github.com/unit-io/unitdb/message"
+)
+
+// ReplaceTopic replaces all entries of the topic with the entries, so topics used as configuration
+// can be replaced without readers observing partially updated contents. The topic of the entries is
+// set to the topic and the contract of the entries is used, all entries must use the same contract.
+// Empty entries delete all entries of the topic of the master contract. The access key of each entry
+// must grant write access to the topic, so with access control empty entries do not replace the topic,
+// use DeleteTopic to delete it, see WithAccessControl.
+//
+// New entries and a replace marker of the topic are encoded and written to the write ahead log in one record
+// first, and entries of the topic are then swapped while readers are blocked. If the DB crashes before entries
+// of the topic are deleted, recovery deletes entries of the topic written before the marker, so the topic is
+// either replaced or keeps its entries. If entries of the topic are not deleted the record is released, so the
+// topic keeps its entries. Entries put to the topic concurrently with ReplaceTopic may or may not be replaced.
+func (db *DB) ReplaceTopic(topic []byte, entries []*Entry) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.flags.immutable:
+		return ErrImmutable
+	case len(topic) == 0:
+		return errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	contract := message.MasterContract
+	if len(entries) > 0 && entries[0].Contract != 0 {
+		contract = entries[0].Contract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return err
+	}
+	if t.TopicType != message.TopicStatic {
+		return errTopicNotStatic
+	}
+	if len(entries) == 0 {
+		if err := db.checkAccess("", contract, topic, AccessWrite); err != nil {
+			return err
+		}
+	}
+	t.AddContract(contract)
+	topicHash := t.GetHash(contract)
+	// The marker seq is leased before seqs of the new entries, so recovery keeps the new entries.
+	marker := _Entry{seq: db.nextSeq(), topicHash: topicHash}
+	markerData, err := marker.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// Stage new entries, these are not visible to readers until swapped. The first entry carries the topic
+	// as entries of the topic carrying it may not be synced to the DB yet and are removed by the swap.
+	for i, e := range entries {
+		e.entry.withTopic = i == 0
+		if e.Contract == 0 {
+			e.Contract = message.MasterContract
+		}
+		switch {
+		case e.Contract != contract:
+			return ErrBadRequest
+		case len(e.Payload) == 0:
+			return errValueEmpty
+		case len(e.Payload) > maxValueLength:
+			return errValueTooLarge
+		}
+		e.Topic = topic
+		if err := db.checkEntryLimits(e); err != nil {
+			return err
+		}
+		if err := db.encodeEntry(e); err != nil {
+			return err
+		}
+		if err := db.checkQuota(e); err != nil {
+			return err
+		}
+		if err := db.commitEntry(e); err != nil {
+			return err
+		}
+	}
+
+	// Replacing entries deletes persisted entries so it excludes sync, and readers are blocked while entries are swapped.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	db.internal.compactLock.Lock()
+	defer db.internal.compactLock.Unlock()
+
+	// The marker and new entries are written to the log in one record before entries of the topic are deleted,
+	// these are not visible to readers until added to the time window. The record is released if the topic
+	// keeps its entries.
+	mb := db.internal.mem.NewBatch()
+	timeID := mb.TimeID()
+	if err := mb.Put(marker.seq, markerData); err != nil {
+		mb.Abort()
+		return err
+	}
+	for _, e := range entries {
+		if err := mb.Put(e.entry.seq, e.entry.cache); err != nil {
+			mb.Abort()
+			return err
+		}
+	}
+	if err := mb.Write(); err != nil {
+		mb.Abort()
+		return err
+	}
+	if err := db.deleteTopicEntries(topicHash); err != nil {
+		mb.Abort()
+		return err
+	}
+	if err := mb.Commit(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if ok := db.internal.timeWindow.add(timeID, topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt)); !ok {
+			return ErrForbidden
+		}
+		db.internal.lastValues.set(topicHash, e.entry.seq, e.entry.expiresAt)
+		if e.entry.topicSize != 0 {
+			db.internal.trie.add(newTopic(topicHash, 0), t.Parts, t.Depth)
+		}
+		db.internal.meter.Puts.Inc(1)
+		if db.internal.subscriptions.active() {
+			db.internal.subscriptions.publish(db.internal.trie, topicHash, newMessage(e))
+		}
+		e.reset()
+	}
+	// Entries put after the topic is replaced are synced after the new entries.
+	return db.internal.mem.FlushAfter(timeID)
+}
+
+// deleteTopicEntries deletes persisted entries of the topic and entries of the topic not yet synced to the DB.
+// Entries of the topic are left if persisted entries are not deleted. Caller must hold the sync lock and the compact lock.
+func (db *DB) deleteTopicEntries(topicHash uint64) error {
+	if off, ok := db.internal.trie.getOffset(topicHash); ok {
+		seqs, err := db.topicSeqs(topicHash, off)
+		if err != nil {
+			return err
+		}
+		count, _, err := db.reclaim(seqs)
+		if err != nil {
+			return err
+		}
+		db.internal.winCounts.removeTopic(topicHash)
+		db.internal.meter.Dels.Inc(count)
+	}
+	for _, seq := range db.internal.timeWindow.removeTopic(topicHash) {
+		if err := db.internal.mem.Delete(seq); err == nil {
+			db.internal.meter.Dels.Inc(1)
+		}
+	}
+	return nil
+}
+
+// topicSeqs returns seqs of persisted entries of the topic. It follows window blocks from the most recent block.
+func (db *DB) topicSeqs(topicHash uint64, off int64) ([]uint64, error) {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for off+winFile.blockSize() <= winFile.currSize() {
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return nil, err
+		}
+		if b.topicHash != topicHash {
+			break
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.seq() != 0 {
+				seqs = append(seqs, we.seq())
+			}
+		}
+		if b.next == 0 {
+			break
+		}
+		off = b.next
+	}
+	return seqs, nil
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/uid"
+)
+
+// EnforceRetention deletes entries of topics exceeding the retention limits of their policies, and evicts
+// oldest entries of contracts exceeding their quota in LimitEvict mode.
+// Retention is also enforced by a background job, see WithRetentionInterval.
+func (db *DB) EnforceRetention() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return db.enforceRetention()
+}
+
+func (db *DB) enforceRetention() (err error) {
+	var policies []Policy
+	for _, p := range db.internal.policies.list() {
+		if p.Retention.isSet() {
+			policies = append(policies, p)
+		}
+	}
+	evictions := db.internal.quotas.evictions()
+	if len(policies) == 0 && len(evictions) == 0 {
+		return nil
+	}
+
+	// Retention deletes entries so it excludes sync, expirer and compaction.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	run := db.internal.runHistory.startRun(RunRetention)
+	defer func() {
+		run.finish(err)
+	}()
+	for _, p := range policies {
+		seqs, refs, err := db.retainedOut(p)
+		if err != nil {
+			return err
+		}
+		count, size, err := db.reclaim(seqs)
+		run.reclaim(count, size)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			db.internal.winCounts.remove(ref.off, ref.we)
+		}
+	}
+	for contract, q := range evictions {
+		seqs, refs, err := db.evictedOut(contract, q)
+		if err != nil {
+			return err
+		}
+		count, size, err := db.reclaim(seqs)
+		run.reclaim(count, size)
+		db.internal.quotas.evicted(contract, count)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			db.internal.winCounts.remove(ref.off, ref.we)
+		}
+	}
+	return nil
+}
+
+// _WindowRef is an entry of the window block at the offset.
+type _WindowRef struct {
+	off int64
+	we  _WinEntry
+}
+
+// retainedOut returns seqs of persisted entries of topics matching the policy which exceed its retention limits
+// and their window blocks. Entries of a topic are visited from newest to oldest, so limits on count and size keep
+// the most recent entries. If the policy only limits count, entries of window blocks within the limit are counted
+// from counts of window blocks without reading these entries.
+func (db *DB) retainedOut(p Policy) ([]uint64, []_WindowRef, error) {
+	t, _, err := db.parseTopic(p.Contract, p.Topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.AddContract(p.Contract)
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, nil, err
+	}
+	var cutoff int64
+	if p.Retention.MaxAge > 0 {
+		cutoff = time.Now().Add(-p.Retention.MaxAge).Unix()
+	}
+	countOnly := cutoff == 0 && p.Retention.MaxBytes == 0
+	now := uint32(time.Now().Unix())
+	var seqs []uint64
+	var refs []_WindowRef
+	for _, topic := range db.internal.trie.lookup(t.Parts, t.Depth, t.TopicType) {
+		var count, size int64
+		for off := topic.offset; off+winFile.blockSize() <= winFile.currSize(); {
+			if c, ok := db.internal.winCounts.get(off); ok && countOnly && c.topicHash == topic.hash {
+				if n, exact := c.live(now); exact && !exceeds(p.Retention.MaxCount, count+n) {
+					count += n
+					if c.next == 0 {
+						break
+					}
+					off = c.next
+					continue
+				}
+			}
+			r := _WindowReader{winFile: winFile, offset: off}
+			b, err := r.readWindowBlock()
+			if err != nil {
+				return nil, nil, err
+			}
+			if b.topicHash != topic.hash {
+				break
+			}
+			for i := int(b.entryIdx) - 1; i >= 0; i-- {
+				we := b.entries[i]
+				if we.seq() == 0 || we.isExpired() {
+					continue
+				}
+				e, err := db.internal.reader.readIndexEntry(we.seq())
+				if err != nil || e.isDeleted() {
+					continue
+				}
+				count++
+				size += int64(e.valueSize)
+				if exceeds(p.Retention.MaxCount, count) || exceeds(p.Retention.MaxBytes, size) {
+					seqs = append(seqs, we.seq())
+					refs = append(refs, _WindowRef{off: off, we: we})
+					continue
+				}
+				if cutoff > 0 {
+					id, _, err := db.internal.reader.readMessage(e)
+					if err != nil {
+						return nil, nil, err
+					}
+					if uid.Time(id[0:4]) < cutoff {
+						seqs = append(seqs, we.seq())
+						refs = append(refs, _WindowRef{off: off, we: we})
+					}
+				}
+			}
+			if b.next == 0 {
+				break
+			}
+			off = b.next
+		}
+	}
+	return seqs, refs, nil
+}
+
+// evictedOut returns seqs of persisted entries of topics of the contract exceeding its quota on stored bytes
+// or messages and their window blocks. Entries of all topics of the contract are ordered by seq, so the most
+// recently written entries are kept and the oldest entries are evicted.
+func (db *DB) evictedOut(contract uint32, q Quota) ([]uint64, []_WindowRef, error) {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, nil, err
+	}
+	type stored struct {
+		size int64
+		ref  _WindowRef
+	}
+	var entries []stored
+	seen := make(map[uint64]struct{})
+	for _, topic := range db.internal.trie.all() {
+		if n, ok := db.internal.topicNames.get(topic.hash); !ok || n.contract != contract {
+			continue
+		}
+		for off := topic.offset; off+winFile.blockSize() <= winFile.currSize(); {
+			r := _WindowReader{winFile: winFile, offset: off}
+			b, err := r.readWindowBlock()
+			if err != nil {
+				return nil, nil, err
+			}
+			if b.topicHash != topic.hash {
+				break
+			}
+			for _, we := range b.entries[:b.entryIdx] {
+				if we.seq() == 0 || we.isExpired() {
+					continue
+				}
+				if _, ok := seen[we.seq()]; ok {
+					continue
+				}
+				seen[we.seq()] = struct{}{}
+				e, err := db.internal.reader.readIndexEntry(we.seq())
+				if err != nil || e.isDeleted() {
+					continue
+				}
+				entries = append(entries, stored{size: int64(e.valueSize), ref: _WindowRef{off: off, we: we}})
+			}
+			if b.next == 0 {
+				break
+			}
+			off = b.next
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ref.we.seq() > entries[j].ref.we.seq()
+	})
+	var seqs []uint64
+	var refs []_WindowRef
+	var count, size int64
+	for _, se := range entries {
+		count++
+		size += se.size
+		if exceeds(q.MaxMessages, count) || exceeds(q.MaxBytes, size) {
+			seqs = append(seqs, se.ref.we.seq())
+			refs = append(refs, se.ref)
+		}
+	}
+	return seqs, refs, nil
+}
+
+func exceeds(max, value int64) bool {
+	return max > 0 && value > max
+}
@@ -0,0 +1,397 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+type (
+	// Rollup downsamples messages of a topic, or of all topics under a wildcard topic such as
+	// "sensors...", once these are older than RawAge. The newest message of each interval of a topic
+	// is written to the rollup topic, i.e. the prefix followed by the topic, and raw messages of the
+	// interval are deleted, so topics keep recent raw messages and a bounded history of samples.
+	Rollup struct {
+		Topic    []byte        // The topic or topic prefix the rollup applies to.
+		Contract uint32        // The contract of the topic.
+		Prefix   []byte        // The prefix of rollup topics, such as "rollup.1m".
+		RawAge   time.Duration // The age of raw messages to roll up.
+		Interval time.Duration // The interval of samples, one message is kept per interval of a topic.
+	}
+
+	// _RollupRecord is a rollup persisted to the rollup file.
+	_RollupRecord struct {
+		Topic    string        `json:"topic"`
+		Contract uint32        `json:"contract"`
+		Prefix   string        `json:"prefix"`
+		RawAge   time.Duration `json:"raw_age"`
+		Interval time.Duration `json:"interval"`
+	}
+	// _RollupTable holds rollups keyed by contract and topic and persists these to the rollup file.
+	_RollupTable struct {
+		mu      sync.RWMutex
+		fsys    fs.FileSystem
+		path    string
+		rollups map[string]Rollup
+	}
+)
+
+// NewRollup creates a new rollup of the topic writing samples to topics under the prefix.
+func NewRollup(topic, prefix []byte) *Rollup {
+	return &Rollup{Topic: topic, Prefix: prefix}
+}
+
+// WithContract sets contract on rollup.
+func (r *Rollup) WithContract(contract uint32) *Rollup {
+	r.Contract = contract
+	return r
+}
+
+// WithRawAge sets the age of raw messages to roll up.
+func (r *Rollup) WithRawAge(age time.Duration) *Rollup {
+	r.RawAge = age
+	return r
+}
+
+// WithInterval sets the interval of samples.
+func (r *Rollup) WithInterval(interval time.Duration) *Rollup {
+	r.Interval = interval
+	return r
+}
+
+// topic returns the rollup topic of the raw topic.
+func (r Rollup) topic(name string) []byte {
+	topic := make([]byte, 0, len(r.Prefix)+1+len(name))
+	topic = append(topic, r.Prefix...)
+	topic = append(topic, message.TopicSeparator)
+	return append(topic, name...)
+}
+
+// isRollupTopic reports whether the topic is a rollup topic of the rollup.
+func (r Rollup) isRollupTopic(name string) bool {
+	return bytes.HasPrefix([]byte(name), append(append([]byte(nil), r.Prefix...), message.TopicSeparator))
+}
+
+func rollupPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.rollup", prefix))
+}
+
+// openRollupTable reads rollups from the rollup file in the DB directory.
+func openRollupTable(fsys fs.FileSystem, dirName string) (*_RollupTable, error) {
+	t := &_RollupTable{fsys: fsys, path: rollupPath(dirName), rollups: make(map[string]Rollup)}
+	data, err := fs.ReadFile(fsys, t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	var records []_RollupRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, ErrCorrupted
+	}
+	for _, r := range records {
+		t.rollups[policyKey(r.Contract, []byte(r.Topic))] = Rollup{Topic: []byte(r.Topic), Contract: r.Contract, Prefix: []byte(r.Prefix), RawAge: r.RawAge, Interval: r.Interval}
+	}
+	return t, nil
+}
+
+// write writes rollups to the rollup file. Caller must hold the lock.
+func (t *_RollupTable) write() error {
+	records := make([]_RollupRecord, 0, len(t.rollups))
+	for _, r := range t.rollups {
+		records = append(records, _RollupRecord{Topic: string(r.Topic), Contract: r.Contract, Prefix: string(r.Prefix), RawAge: r.RawAge, Interval: r.Interval})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Contract != records[j].Contract {
+			return records[i].Contract < records[j].Contract
+		}
+		return records[i].Topic < records[j].Topic
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileSync(t.fsys, t.path, data, os.FileMode(0666))
+}
+
+func (t *_RollupTable) set(r Rollup) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollups[policyKey(r.Contract, r.Topic)] = r
+	return t.write()
+}
+
+func (t *_RollupTable) remove(contract uint32, topic []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := policyKey(contract, topic)
+	if _, ok := t.rollups[key]; !ok {
+		return nil
+	}
+	delete(t.rollups, key)
+	return t.write()
+}
+
+// list returns rollups sorted by contract and topic.
+func (t *_RollupTable) list() []Rollup {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rollups := make([]Rollup, 0, len(t.rollups))
+	for _, r := range t.rollups {
+		rollups = append(rollups, r)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if rollups[i].Contract != rollups[j].Contract {
+			return rollups[i].Contract < rollups[j].Contract
+		}
+		return string(rollups[i].Topic) < string(rollups[j].Topic)
+	})
+	return rollups
+}
+
+// SetRollup sets rollup on a topic or topic prefix. It replaces an existing rollup of the topic.
+// The rollup is persisted and run by the background job enforcing retention, see WithRetentionInterval.
+// Rollup topics are excluded from the rollup, so the prefix may be under the topic of the rollup.
+func (db *DB) SetRollup(r *Rollup) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.flags.immutable:
+		return ErrImmutable
+	case len(r.Topic) == 0:
+		return errTopicEmpty
+	case len(r.Prefix) == 0 || r.RawAge <= 0 || r.Interval < time.Second:
+		return errRollupInvalid
+	}
+	if r.Contract == 0 {
+		r.Contract = message.MasterContract
+	}
+	if _, _, err := db.parseTopic(r.Contract, r.Topic); err != nil {
+		return err
+	}
+	t, _, err := db.parseTopic(r.Contract, r.Prefix)
+	if err != nil {
+		return err
+	}
+	if t.TopicType != message.TopicStatic {
+		return errTopicNotStatic
+	}
+	return db.internal.rollups.set(Rollup{Topic: append([]byte(nil), r.Topic...), Contract: r.Contract, Prefix: append([]byte(nil), r.Prefix...), RawAge: r.RawAge, Interval: r.Interval})
+}
+
+// DeleteRollup removes rollup of the topic. Use zero contract for the master contract.
+// Rollup topics written by the rollup are kept.
+func (db *DB) DeleteRollup(topic []byte, contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	return db.internal.rollups.remove(contract, topic)
+}
+
+// Rollups returns rollups set on the DB.
+func (db *DB) Rollups() []Rollup {
+	return db.internal.rollups.list()
+}
+
+// EnforceRollups rolls up raw messages older than the raw age of rollups.
+// Rollups are also run by a background job, see WithRetentionInterval.
+func (db *DB) EnforceRollups() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return db.enforceRollups()
+}
+
+func (db *DB) enforceRollups() (err error) {
+	rollups := db.internal.rollups.list()
+	if len(rollups) == 0 || db.opts.flags.immutable {
+		return nil
+	}
+
+	// Rollup deletes entries so it excludes sync, expirer and compaction.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	run := db.internal.runHistory.startRun(RunRollup)
+	defer func() {
+		run.finish(err)
+	}()
+	for _, r := range rollups {
+		count, size, err := db.rollup(r)
+		run.reclaim(count, size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollup rolls up persisted entries of topics matching the rollup. Intervals ending after the raw age are left
+// for a later run, so an interval is rolled up once unless older messages of the interval are written later.
+// Samples are written before raw entries are deleted, so a failed run may leave raw entries but not lose samples.
+// Caller must hold the sync lock.
+func (db *DB) rollup(r Rollup) (count, size int64, err error) {
+	t, _, err := db.parseTopic(r.Contract, r.Topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	t.AddContract(r.Contract)
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return 0, 0, err
+	}
+	interval := int64(r.Interval / time.Second)
+	cutoff := time.Now().Add(-r.RawAge).Unix()
+	cutoff -= cutoff % interval
+
+	type sample struct {
+		ts int64
+		we _WinEntry
+		e  _IndexEntry
+	}
+	for _, topic := range db.internal.trie.lookup(t.Parts, t.Depth, t.TopicType) {
+		n, ok := db.internal.topicNames.get(topic.hash)
+		if !ok || n.contract != r.Contract || r.isRollupTopic(n.name) {
+			continue
+		}
+		samples := make(map[int64]*sample)
+		var seqs []uint64
+		var refs []_WindowRef
+		for off := topic.offset; off+winFile.blockSize() <= winFile.currSize(); {
+			wr := _WindowReader{winFile: winFile, offset: off}
+			b, err := wr.readWindowBlock()
+			if err != nil {
+				return count, size, err
+			}
+			if b.topicHash != topic.hash {
+				break
+			}
+			for _, we := range b.entries[:b.entryIdx] {
+				if we.seq() == 0 || we.isExpired() {
+					continue
+				}
+				e, err := db.internal.reader.readIndexEntry(we.seq())
+				if err != nil || e.isDeleted() {
+					continue
+				}
+				id, err := db.internal.reader.readID(e)
+				if err != nil {
+					return count, size, err
+				}
+				ts := uid.Time(id[0:4])
+				if ts >= cutoff {
+					continue
+				}
+				start := ts - ts%interval
+				if s, ok := samples[start]; !ok || ts > s.ts || ts == s.ts && we.seq() > s.we.seq() {
+					samples[start] = &sample{ts: ts, we: we, e: e}
+				}
+				seqs = append(seqs, we.seq())
+				refs = append(refs, _WindowRef{off: off, we: we})
+			}
+			if b.next == 0 {
+				break
+			}
+			off = b.next
+		}
+		if len(seqs) == 0 {
+			continue
+		}
+		starts := make([]int64, 0, len(samples))
+		for start := range samples {
+			starts = append(starts, start)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+		for _, start := range starts {
+			s := samples[start]
+			if err := db.putSample(r, n.name, s.e, s.we.expiryTime()); err != nil {
+				return count, size, err
+			}
+		}
+		c, s, err := db.reclaim(seqs)
+		count += c
+		size += s
+		if err != nil {
+			return count, size, err
+		}
+		for _, ref := range refs {
+			db.internal.winCounts.remove(ref.off, ref.we)
+		}
+	}
+	return count, size, nil
+}
+
+// putSample writes the message of the entry to the rollup topic of the raw topic. The sample keeps
+// the time, headers and TTL of the message. Messages with a deleted encryption key are not sampled.
+func (db *DB) putSample(r Rollup, name string, e _IndexEntry, expiresAt uint32) error {
+	id, val, err := db.internal.reader.readMessage(e)
+	if err != nil {
+		return err
+	}
+	headers, payload, err := decodeMessage(db.internal.keyring, db.internal.plugins, id, val)
+	if err == errMsgShredded {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sampleID := message.NewID(db.nextSeq())
+	copy(sampleID[0:4], id[0:4])
+	se := NewEntry(r.topic(name), payload).WithContract(r.Contract).WithID(sampleID)
+	se.Headers = headers
+	se.ExpiresAt = expiresAt
+	se.entry.trusted = true
+	if err := db.setEntry(se); err != nil {
+		return err
+	}
+	timeID, err := db.internal.mem.Put(se.entry.seq, se.entry.cache)
+	if err != nil {
+		return err
+	}
+	if ok := db.internal.timeWindow.add(timeID, se.entry.topicHash, newWinEntry(se.entry.seq, se.entry.expiresAt)); !ok {
+		return ErrForbidden
+	}
+	db.internal.lastValues.set(se.entry.topicHash, se.entry.seq, se.entry.expiresAt)
+	if se.entry.topicSize != 0 {
+		t := new(message.Topic)
+		rawTopic := se.entry.cache[entrySize+idSize : entrySize+idSize+se.entry.topicSize]
+		t.Unmarshal(rawTopic)
+		db.internal.trie.add(newTopic(se.entry.topicHash, 0), t.Parts, t.Depth)
+	}
+	db.internal.meter.Puts.Inc(1)
+	if db.internal.subscriptions.active() {
+		db.internal.subscriptions.publish(db.internal.trie, se.entry.topicHash, newMessage(se))
+	}
+	return nil
+}
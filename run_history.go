@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxRunHistory is the number of maintenance runs kept in the run history.
+	maxRunHistory = 64
+)
+
+// RunKind is the kind of maintenance job recorded in the run history.
+type RunKind uint8
+
+const (
+	// RunExpiry is a run of the expirer deleting entries with an expired TTL.
+	RunExpiry RunKind = iota
+	// RunCompaction is a run of the compactor reclaiming deleted and expired space.
+	RunCompaction
+	// RunRetention is a run of the retention job deleting entries exceeding retention limits of topic policies.
+	RunRetention
+	// RunFilterRebuild is a rebuild of a missing or corrupted filter from index blocks when the DB is opened.
+	RunFilterRebuild
+	// RunOffload is a run offloading cold segments of data and window files to the tiered store,
+	// bytes reclaimed are the bytes offloaded.
+	RunOffload
+	// RunRollup is a run of the rollup job downsampling messages of topics with rollup rules,
+	// entries dropped are the raw messages deleted.
+	RunRollup
+)
+
+// String returns name of the maintenance job.
+func (k RunKind) String() string {
+	switch k {
+	case RunExpiry:
+		return "expiry"
+	case RunCompaction:
+		return "compaction"
+	case RunRetention:
+		return "retention"
+	case RunFilterRebuild:
+		return "filter_rebuild"
+	case RunOffload:
+		return "offload"
+	case RunRollup:
+		return "rollup"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes run kind as its name so reports are readable in the /varz output.
+func (k RunKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes run kind from its name.
+func (k *RunKind) UnmarshalText(text []byte) error {
+	for kind := RunExpiry; kind <= RunRollup; kind++ {
+		if kind.String() == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return ErrBadRequest
+}
+
+// RunReport reports a single maintenance run.
+type RunReport struct {
+	Kind           RunKind       `json:"kind"`
+	Start          time.Time     `json:"start"`
+	Duration       time.Duration `json:"duration"`
+	BytesReclaimed int64         `json:"bytes_reclaimed"`
+	EntriesDropped int64         `json:"entries_dropped"`
+	Err            string        `json:"error,omitempty"`
+}
+
+// _RunHistory is a ring buffer of most recent maintenance runs.
+type _RunHistory struct {
+	mu    sync.RWMutex
+	runs  [maxRunHistory]RunReport
+	next  int
+	count int
+}
+
+func newRunHistory() *_RunHistory {
+	return &_RunHistory{}
+}
+
+// startRun starts a run report for the given kind. Call finish on the report to add it to the history.
+func (h *_RunHistory) startRun(kind RunKind) *_Run {
+	return &_Run{history: h, report: RunReport{Kind: kind, Start: time.Now()}}
+}
+
+func (h *_RunHistory) add(r RunReport) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runs[h.next] = r
+	h.next = (h.next + 1) % maxRunHistory
+	if h.count < maxRunHistory {
+		h.count++
+	}
+}
+
+// list returns runs from the history with most recent run first.
+func (h *_RunHistory) list() []RunReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	runs := make([]RunReport, 0, h.count)
+	for i := 1; i <= h.count; i++ {
+		runs = append(runs, h.runs[(h.next-i+maxRunHistory)%maxRunHistory])
+	}
+	return runs
+}
+
+// last returns most recent run for the given kind.
+func (h *_RunHistory) last(kind RunKind) (RunReport, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for i := 1; i <= h.count; i++ {
+		r := h.runs[(h.next-i+maxRunHistory)%maxRunHistory]
+		if r.Kind == kind {
+			return r, true
+		}
+	}
+	return RunReport{}, false
+}
+
+// _Run is a maintenance run in progress.
+type _Run struct {
+	history *_RunHistory
+	report  RunReport
+}
+
+// reclaim adds reclaimed bytes and dropped entries to the run.
+func (r *_Run) reclaim(entries, bytes int64) {
+	r.report.EntriesDropped += entries
+	r.report.BytesReclaimed += bytes
+}
+
+// finish completes the run and adds its report to the history.
+func (r *_Run) finish(err error) {
+	r.report.Duration = time.Since(r.report.Start)
+	if err != nil {
+		r.report.Err = err.Error()
+	}
+	r.history.add(r.report)
+}
+
+// RunHistory returns reports of recent maintenance runs (expiry, compaction, retention, filter rebuild and offload) with most recent run first.
+// It is used to confirm background maintenance is running and reclaiming space.
+func (db *DB) RunHistory() []RunReport {
+	return db.internal.runHistory.list()
+}
+
+// LastRun returns report of most recent maintenance run for the given kind.
+func (db *DB) LastRun(kind RunKind) (RunReport, bool) {
+	return db.internal.runHistory.last(kind)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package schema holds the protobuf wire schema of entries, queries, items and stats shared
+// by the gRPC server, change streams and exports. Clients in other languages are generated from
+// unitdb.proto, see docs/usage.md.
+package schema
+
+import (
+	"time"
+
+	"github.com/unit-io/unitdb"
+)
+
+//go:generate protoc -I.. --go_out=.. --go_opt=paths=source_relative ../schema/unitdb.proto
+
+// EntryOf returns the wire entry of the DB entry.
+func EntryOf(e *unitdb.Entry) *Entry {
+	return &Entry{
+		Id:         e.ID,
+		Topic:      string(e.Topic),
+		Payload:    e.Payload,
+		Contract:   e.Contract,
+		ExpiresAt:  e.ExpiresAt,
+		Encryption: e.Encryption,
+	}
+}
+
+// ToEntry returns the DB entry of the wire entry.
+func (x *Entry) ToEntry() *unitdb.Entry {
+	e := unitdb.NewEntry([]byte(x.GetTopic()), x.GetPayload()).WithID(x.GetId()).WithContract(x.GetContract())
+	e.ExpiresAt = x.GetExpiresAt()
+	e.Encryption = x.GetEncryption()
+	return e
+}
+
+// ToQuery returns the DB query of the wire query.
+func (x *Query) ToQuery() *unitdb.Query {
+	q := unitdb.NewQuery([]byte(x.GetTopic())).WithContract(x.GetContract()).WithLimit(int(x.GetLimit()))
+	if x.GetLast() != "" {
+		q.WithLast(x.GetLast())
+	}
+	return q
+}
+
+// StatsOf returns the wire stats of the DB variables.
+func StatsOf(v *unitdb.Varz) *Stats {
+	return &Stats{
+		Seq:           v.Seq,
+		Count:         v.Count,
+		Gets:          v.Gets,
+		Puts:          v.Puts,
+		Leases:        v.Leases,
+		Syncs:         v.Syncs,
+		Recovers:      v.Recovers,
+		Aborts:        v.Aborts,
+		Dels:          v.Dels,
+		InMsgs:        v.InMsgs,
+		OutMsgs:       v.OutMsgs,
+		InBytes:       v.InBytes,
+		OutBytes:      v.OutBytes,
+		UptimeSeconds: int64(v.Now.Sub(v.Start) / time.Second),
+	}
+}
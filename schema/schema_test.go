@@ -0,0 +1,50 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEntry(t *testing.T) {
+	in := &Entry{Id: []byte("id"), Topic: "unit1.test", Payload: []byte("msg"), Contract: 3376684800, ExpiresAt: 1700000000, Encryption: true}
+	data, err := proto.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Entry
+	if err := proto.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	e := out.ToEntry()
+	if string(e.ID) != "id" || string(e.Topic) != "unit1.test" || string(e.Payload) != "msg" ||
+		e.Contract != 3376684800 || e.ExpiresAt != 1700000000 || !e.Encryption {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if !proto.Equal(EntryOf(e), in) {
+		t.Fatalf("entry does not round trip")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	q := (&Query{Topic: "unit1.test", Contract: 3376684800, Limit: 10, Last: "1h"}).ToQuery()
+	if string(q.Topic) != "unit1.test" || q.Contract != 3376684800 || q.Limit != 10 {
+		t.Fatalf("unexpected query %+v", q)
+	}
+}
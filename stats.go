@@ -0,0 +1,55 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+// Stats is a snapshot of the state of the DB, see DB.Stats.
+type Stats struct {
+	Entries      uint64           `json:"entries"`       // Number of entries in the DB.
+	Topics       int              `json:"topics"`        // Number of topics in the DB.
+	FileSizes    map[string]int64 `json:"file_sizes"`    // Size of the DB files in bytes by file type, i.e. info, window, index, data, vlog, lease and filter.
+	MemdbEntries int64            `json:"memdb_entries"` // Number of entries in the memdb not yet synced to the DB.
+	MemdbBytes   int64            `json:"memdb_bytes"`   // Size of entries in the memdb.
+	WALBytes     int64            `json:"wal_bytes"`     // Size of the write ahead log not yet applied to the DB.
+	CommitQueue  int              `json:"commit_queue"`  // Number of logs queued to commit to the write ahead log.
+	FilterBytes  int64            `json:"filter_bytes"`  // Size of the filter held in memory.
+	FilterLoaded bool             `json:"filter_loaded"` // False if the DB is open without the filter or the filter is rebuilt in the background.
+	TrieNodes    int              `json:"trie_nodes"`    // Number of nodes of the topic trie.
+}
+
+// Stats returns a snapshot of the state of the DB, so applications can export health information of the DB.
+// Unlike Varz, Stats reports sizes of the DB files and in memory structures rather than counters of operations.
+func (db *DB) Stats() (Stats, error) {
+	if err := db.ok(); err != nil {
+		return Stats{}, err
+	}
+	s := Stats{
+		Entries:      db.Count(),
+		Topics:       db.internal.trie.Count(),
+		FileSizes:    make(map[string]int64),
+		MemdbEntries: db.internal.mem.Size(),
+		MemdbBytes:   db.internal.mem.DataSize(),
+		WALBytes:     db.internal.mem.LogSize(),
+		CommitQueue:  db.internal.mem.QueueLen(),
+		FilterBytes:  db.internal.filter.size(),
+		FilterLoaded: !db.internal.filter.skipped(),
+		TrieNodes:    db.internal.trie.nodes(),
+	}
+	for ft, size := range db.fs.sizes() {
+		s.FileSizes[ft.String()] = size
+	}
+	return s, nil
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// subscriptionBufferSize is the number of messages buffered for a subscription, messages
+// are dropped if the subscriber does not keep up.
+const subscriptionBufferSize = 1024
+
+type (
+	// Message is an entry delivered to a subscription or read by DB.GetMessages.
+	Message struct {
+		ID        []byte // The ID of the message, use it to delete the message.
+		Topic     []byte // The topic the message is written to, without topic options.
+		Payload   []byte
+		Contract  uint32
+		ExpiresAt uint32            // The expiry of the message in unix time seconds, zero if the message does not expire.
+		Headers   map[string][]byte // The headers of the message, nil if the message is written without headers.
+
+		value func() io.Reader // opens readers of the payload streamed by a query, see ValueReader.
+	}
+
+	// Subscription delivers messages written to topics matching its topic, see DB.Subscribe.
+	Subscription struct {
+		subs      *_Subscriptions
+		parts     []message.Part
+		depth     uint8
+		topicType uint8
+		c         chan Message
+		dropped   int64
+		group     *_Group // The group is the consumer group of the subscription, nil if it is not a member of a group.
+
+		// hashes are topics matching the subscription at the trie epoch.
+		mu     sync.Mutex
+		epoch  uint64
+		hashes map[uint64]struct{}
+
+		closeOnce sync.Once
+	}
+
+	// _Subscriptions holds subscriptions of the DB and consumer groups of subscriptions by group key.
+	_Subscriptions struct {
+		mu         sync.RWMutex
+		subs       map[*Subscription]struct{}
+		groups     map[string]*_Group
+		ackTimeout time.Duration
+		n          int32
+	}
+)
+
+func newSubscriptions(ackTimeout time.Duration) *_Subscriptions {
+	return &_Subscriptions{subs: make(map[*Subscription]struct{}), groups: make(map[string]*_Group), ackTimeout: ackTimeout}
+}
+
+// active reports whether the DB has any subscription, so writes skip building messages otherwise.
+func (ss *_Subscriptions) active() bool {
+	return atomic.LoadInt32(&ss.n) > 0
+}
+
+func (ss *_Subscriptions) add(s *Subscription) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.subs[s] = struct{}{}
+	atomic.StoreInt32(&ss.n, int32(len(ss.subs)))
+}
+
+// join adds the subscription as a member of the consumer group of the key, messages waiting for
+// a member of the group are redelivered to it.
+func (ss *_Subscriptions) join(s *Subscription, key string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	g, ok := ss.groups[key]
+	if !ok {
+		g = &_Group{pending: make(map[uint64]*_GroupDelivery)}
+		ss.groups[key] = g
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s.group = g
+	g.members = append(g.members, s)
+	g.redeliver(time.Now(), ss.ackTimeout)
+	ss.subs[s] = struct{}{}
+	atomic.StoreInt32(&ss.n, int32(len(ss.subs)))
+}
+
+func (ss *_Subscriptions) remove(s *Subscription) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.subs[s]; !ok {
+		return false
+	}
+	delete(ss.subs, s)
+	atomic.StoreInt32(&ss.n, int32(len(ss.subs)))
+	if g := s.group; g != nil {
+		g.mu.Lock()
+		g.leave(s, time.Now(), ss.ackTimeout)
+		g.mu.Unlock()
+	}
+	return true
+}
+
+// publish delivers messages to subscriptions matching their topics.
+func (ss *_Subscriptions) publish(t *_Trie, topicHash uint64, msgs ...Message) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for s := range ss.subs {
+		if s.group != nil || !s.match(t, topicHash) {
+			continue
+		}
+		for _, m := range msgs {
+			select {
+			case s.c <- m:
+			default:
+				atomic.AddInt64(&s.dropped, 1)
+			}
+		}
+	}
+	now := time.Now()
+	for _, g := range ss.groups {
+		g.mu.Lock()
+		// Members of a group subscribe to the same topic.
+		if len(g.members) != 0 && g.members[0].match(t, topicHash) {
+			for _, m := range msgs {
+				g.publish(m, now, ss.ackTimeout)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// redeliver redelivers messages of consumer groups not acknowledged in time.
+func (ss *_Subscriptions) redeliver(now time.Time) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, g := range ss.groups {
+		g.mu.Lock()
+		g.redeliver(now, ss.ackTimeout)
+		g.mu.Unlock()
+	}
+}
+
+// closeAll closes subscriptions when the DB is closed.
+func (ss *_Subscriptions) closeAll() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for s := range ss.subs {
+		delete(ss.subs, s)
+		s.closeOnce.Do(func() { close(s.c) })
+	}
+	ss.groups = make(map[string]*_Group)
+	atomic.StoreInt32(&ss.n, 0)
+}
+
+// match reports whether the topic matches the subscription. Topics matching the subscription
+// are looked up in the trie again once the trie is changed, e.g. a new topic is added.
+func (s *Subscription) match(t *_Trie, topicHash uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := t.snapshot()
+	if s.hashes == nil || v.epoch != s.epoch {
+		var tops _Topics
+		v.ilookup(s.parts, s.depth, s.topicType, &tops, v.root)
+		s.hashes = make(map[uint64]struct{}, len(tops))
+		for _, tp := range tops {
+			s.hashes[tp.hash] = struct{}{}
+		}
+		s.epoch = v.epoch
+	}
+	_, ok := s.hashes[topicHash]
+	return ok
+}
+
+// topicHashes returns hashes of topics matching the subscription.
+func (s *Subscription) topicHashes(t *_Trie) []uint64 {
+	s.match(t, 0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([]uint64, 0, len(s.hashes))
+	for topicHash := range s.hashes {
+		hashes = append(hashes, topicHash)
+	}
+	return hashes
+}
+
+// C returns the channel messages are delivered to. The channel is closed when the subscription
+// or the DB is closed.
+func (s *Subscription) C() <-chan Message {
+	return s.c
+}
+
+// Dropped returns number of messages dropped as the subscriber did not keep up.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close removes the subscription from the DB and closes its channel.
+func (s *Subscription) Close() error {
+	if s.subs.remove(s) {
+		s.closeOnce.Do(func() { close(s.c) })
+	}
+	return nil
+}
+
+// newMessage returns the message of the entry set by setEntry, the payload and headers are
+// copied as the caller may modify these once the entry is written.
+func newMessage(e *Entry) Message {
+	id := make([]byte, message.ID(nil).Size())
+	copy(id, e.entry.cache[entrySize:entrySize+8])
+	binary.LittleEndian.PutUint64(id[8:], e.entry.seq)
+	m := Message{
+		ID:        id,
+		Topic:     append([]byte(nil), topicName(e.Topic)...),
+		Payload:   append([]byte(nil), e.Payload...),
+		Contract:  e.Contract,
+		ExpiresAt: e.entry.expiresAt,
+	}
+	if len(e.Headers) != 0 {
+		m.Headers = make(map[string][]byte, len(e.Headers))
+		for name, value := range e.Headers {
+			m.Headers[name] = append([]byte(nil), value...)
+		}
+	}
+	return m
+}
+
+// storedMessage returns the message of an entry read from the DB. The ID of a stored entry only holds
+// the prefix of the message ID and the value is decoded, see DB.decodeValue.
+func (db *DB) storedMessage(seq, topicHash uint64, expiresAt uint32, id, val []byte) (Message, error) {
+	headers, payload, err := decodeMessage(db.internal.keyring, db.internal.plugins, id, val)
+	if err != nil {
+		return Message{}, err
+	}
+	m := Message{
+		ID:        make([]byte, message.ID(nil).Size()),
+		Payload:   payload,
+		Headers:   headers,
+		Contract:  binary.LittleEndian.Uint32(id[4:8]),
+		ExpiresAt: expiresAt,
+	}
+	copy(m.ID, id[:8])
+	binary.LittleEndian.PutUint64(m.ID[8:], seq)
+	if n, ok := db.internal.topicNames.get(topicHash); ok {
+		m.Topic = []byte(n.name)
+	}
+	return m, nil
+}
+
+// Subscribe subscribes to messages written to the topic of the contract, use zero contract for the master contract.
+// A wildcard topic subscribes to all topics it matches, including topics first written after Subscribe.
+// Messages are delivered once these are written by DB.Put or committed by a batch, messages written
+// before Subscribe are not delivered, use DB.Get to read these.
+//
+// Messages of a topic written by one goroutine are delivered in order. Delivery does not block writes,
+// messages are dropped if the subscriber does not keep up, see Subscription.Dropped.
+//
+// A subscription to a DB opened with WithLastValueCache first receives the most recent message of each topic
+// it matches, a message written while the subscription is created may then be delivered twice.
+//
+// The access key must grant read access to the topic, see WithAccessControl.
+func (db *DB) Subscribe(topic []byte, contract uint32, accessKey string) (*Subscription, error) {
+	s, err := db.newSubscription(topic, contract, accessKey)
+	if err != nil {
+		return nil, err
+	}
+	db.internal.subscriptions.add(s)
+	if db.internal.lastValues != nil {
+		db.retain(s)
+	}
+	return s, nil
+}
+
+// newSubscription returns a subscription to the topic of the contract, it is not added to subscriptions of the DB.
+func (db *DB) newSubscription(topic []byte, contract uint32, accessKey string) (*Subscription, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	if err := db.checkAccess(accessKey, contract, topic, AccessRead); err != nil {
+		return nil, err
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(contract)
+	s := &Subscription{
+		subs:      db.internal.subscriptions,
+		parts:     t.Parts,
+		depth:     t.Depth,
+		topicType: t.TopicType,
+		c:         make(chan Message, subscriptionBufferSize),
+	}
+	return s, nil
+}
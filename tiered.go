@@ -0,0 +1,60 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+const (
+	// offloadInterval is the amount of time between background runs offloading cold segments to the tiered store.
+	offloadInterval = time.Hour
+)
+
+// tieredSuffixes selects the data, value log and window files offloaded to the tiered store.
+var tieredSuffixes = []string{".data", ".vlog", ".win"}
+
+// Offload moves segments of data and window files not written for the cold duration set by
+// WithTieredStorage to the object store. It runs in the background once an hour.
+func (db *DB) Offload() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return db.offload()
+}
+
+func (db *DB) offload() (err error) {
+	t, ok := db.opts.fileSystem.(*fs.Tiered)
+	if !ok {
+		return errNoTieredStorage
+	}
+
+	// Offload excludes sync and compaction as these write and replace the files.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	run := db.internal.runHistory.startRun(RunOffload)
+	defer func() {
+		run.finish(err)
+	}()
+	size, err := t.Offload(time.Now().Add(-db.opts.coldAfter))
+	run.reclaim(0, size)
+	return err
+}
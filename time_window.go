@@ -17,11 +17,14 @@
 package unitdb
 
 import (
-	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/rs/zerolog"
+	"github.com/unit-io/unitdb/block"
 	"github.com/unit-io/unitdb/hash"
 )
 
@@ -32,7 +35,7 @@ type (
 	}
 	_WinBlock struct {
 		topicHash uint64
-		entries   [entriesPerWindowBlock]_WinEntry
+		entries   []_WinEntry
 
 		// Next stores offset that links multiple winBlocks for a topic hash.
 		// Most recent offset is stored into the trie to iterate entries in reverse time order.
@@ -68,40 +71,59 @@ func (b _WinBlock) cutoff(cutoff int64) bool {
 	return b.cutoffTime != 0 && b.cutoffTime < cutoff
 }
 
-// marshalBinary serialized window block into binary data.
+// marshalBinary serialized window block into binary data, see block.WindowBlock.
 func (b _WinBlock) marshalBinary() []byte {
-	buf := make([]byte, blockSize)
-	data := buf
-	for i := 0; i < entriesPerWindowBlock; i++ {
-		e := b.entries[i]
-		binary.LittleEndian.PutUint64(buf[:8], e.sequence)
-		binary.LittleEndian.PutUint32(buf[8:12], e.expiresAt)
-		buf = buf[12:]
+	wb := block.WindowBlock{TopicHash: b.topicHash, Entries: make([]block.WindowEntry, len(b.entries)), Next: b.next, CutoffTime: b.cutoffTime, EntryIdx: b.entryIdx}
+	for i, e := range b.entries {
+		wb.Entries[i] = block.WindowEntry{Seq: e.sequence, ExpiresAt: e.expiresAt}
 	}
-	binary.LittleEndian.PutUint64(buf[:8], uint64(b.cutoffTime))
-	binary.LittleEndian.PutUint64(buf[8:16], b.topicHash)
-	binary.LittleEndian.PutUint64(buf[16:24], uint64(b.next))
-	binary.LittleEndian.PutUint16(buf[24:26], b.entryIdx)
+	data, _ := wb.MarshalBinary()
 	return data
 }
 
-// unmarshalBinary de-serialized window block from binary data.
+// unmarshalBinary de-serialized window block from binary data, see block.WindowBlock.
+// The layout of the block is of the size of the data.
 func (b *_WinBlock) unmarshalBinary(data []byte) error {
-	for i := 0; i < entriesPerWindowBlock; i++ {
-		_ = data[12] // bounds check hint to compiler; see golang.org/issue/14808.
-		b.entries[i].sequence = binary.LittleEndian.Uint64(data[:8])
-		b.entries[i].expiresAt = binary.LittleEndian.Uint32(data[8:12])
-		data = data[12:]
+	layout, err := block.NewLayout(int32(len(data)))
+	if err != nil {
+		return err
+	}
+	wb := layout.NewWindowBlock()
+	if err := wb.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	b.setBlock(wb)
+	return nil
+}
+
+// unmarshalTorn de-serialized entries of a window block torn by a crash, see block.WindowBlock.UnmarshalTorn.
+func (b *_WinBlock) unmarshalTorn(data []byte) error {
+	layout, err := block.NewLayout(int32(len(data)))
+	if err != nil {
+		return err
+	}
+	wb := layout.NewWindowBlock()
+	if err := wb.UnmarshalTorn(data); err != nil {
+		return err
 	}
-	b.cutoffTime = int64(binary.LittleEndian.Uint64(data[:8]))
-	b.topicHash = binary.LittleEndian.Uint64(data[8:16])
-	b.next = int64(binary.LittleEndian.Uint64(data[16:24]))
-	b.entryIdx = binary.LittleEndian.Uint16(data[24:26])
+	b.setBlock(wb)
 	return nil
 }
 
-func winBlockOffset(idx int32) int64 {
-	return int64(blockSize * idx)
+func (b *_WinBlock) setBlock(wb block.WindowBlock) {
+	b.entries = make([]_WinEntry, len(wb.Entries))
+	for i, e := range wb.Entries {
+		b.entries[i] = _WinEntry{sequence: e.Seq, expiresAt: e.ExpiresAt}
+	}
+	b.cutoffTime = wb.CutoffTime
+	b.topicHash = wb.TopicHash
+	b.next = wb.Next
+	b.entryIdx = wb.EntryIdx
+}
+
+// newWinBlock returns an empty window block of the layout of the window file.
+func (f *_File) newWinBlock() _WinBlock {
+	return _WinBlock{entries: make([]_WinEntry, f.layout.EntriesPerWindowBlock)}
 }
 
 type (
@@ -110,16 +132,33 @@ type (
 		expDurationType     time.Duration
 		maxExpDurations     int
 		backgroundKeyExpiry bool
+		logger              zerolog.Logger
 	}
 	_TimeWindowBucket struct {
 		sync.RWMutex
 		windowBlocks       *_WindowBlocks
 		expiryWindowBucket *_ExpiryWindowBucket
 		opts               *_TimeOptions
+		logger             zerolog.Logger
+
+		// scanIdx is the next window block to scan for expired entries.
+		scanIdx int32
 	}
 )
 
 type _WindowEntries []_WinEntry
+
+// before returns entries with seq less than the seq.
+func (wEntries _WindowEntries) before(seq uint64) _WindowEntries {
+	entries := make(_WindowEntries, 0, len(wEntries))
+	for _, we := range wEntries {
+		if we.seq() < seq {
+			entries = append(entries, we)
+		}
+	}
+	return entries
+}
+
 type _Key struct {
 	timeID    int64
 	topicHash uint64
@@ -162,6 +201,7 @@ func newTimeWindowBucket(opts *_TimeOptions) *_TimeWindowBucket {
 	l := &_TimeWindowBucket{}
 	l.windowBlocks = newWindowBlocks()
 	l.expiryWindowBucket = newExpiryWindowBucket(opts.backgroundKeyExpiry, opts.expDurationType, opts.maxExpDurations)
+	l.logger = opts.logger
 	return l
 }
 
@@ -185,84 +225,97 @@ func (tw *_TimeWindowBucket) add(timeID int64, topicHash uint64, e _WinEntry) (o
 	}
 	return true
 }
-func (tw *_TimeWindowBucket) release() func(timeID int64) error {
-	releasedKeys := make(map[int64][]_Key)
+
+// removeTopic removes window entries of the topic not yet synced to the DB and returns their seqs.
+func (tw *_TimeWindowBucket) removeTopic(topicHash uint64) (seqs []uint64) {
+	b := tw.windowBlocks.getWindowBlock(topicHash)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, wEntries := range b.entries {
+		if key.topicHash != topicHash {
+			continue
+		}
+		for _, we := range wEntries {
+			seqs = append(seqs, we.seq())
+		}
+		delete(b.entries, key)
+	}
+	return seqs
+}
+
+// release removes window entries of the time block once these are synced to the DB.
+// Keys are collected on release as a batch committed during the sync adds entries to its time block.
+func (tw *_TimeWindowBucket) release(timeID int64) error {
+	var released bool
 	for i := 0; i < nShards; i++ {
 		wb := tw.windowBlocks.window[i]
-		wb.mu.RLock()
+		wb.mu.Lock()
 		for k := range wb.entries {
-			if _, ok := releasedKeys[k.timeID]; ok {
-				releasedKeys[k.timeID] = append(releasedKeys[k.timeID], k)
-			} else {
-				releasedKeys[k.timeID] = []_Key{k}
+			if k.timeID == timeID {
+				delete(wb.entries, k)
+				released = true
 			}
 		}
-		wb.mu.RUnlock()
+		wb.mu.Unlock()
 	}
-
-	return func(timeID int64) error {
-		keys, ok := releasedKeys[timeID]
-		if !ok {
-			return errBadRequest
-		}
-		for _, k := range keys {
-			b := tw.windowBlocks.getWindowBlock(k.topicHash)
-			b.mu.Lock()
-			delete(b.entries, k)
-			b.mu.Unlock()
-		}
-
-		return nil
+	if !released {
+		return ErrBadRequest
 	}
+
+	return nil
 }
 
 // ilookup lookups window entries from timeWindowBucket and not yet sync to DB.
+// It returns the most recent entries of the topic by seq, as entries of a batch are added under the time ID of the batch.
 func (tw *_TimeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries _WindowEntries) {
 	winEntries = make([]_WinEntry, 0)
 	// get windowBlock shard.
 	b := tw.windowBlocks.getWindowBlock(topicHash)
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	var l int
-	var expiryCount int
 
-	for key := range b.entries {
+	for key, wEntries := range b.entries {
 		if key.topicHash != topicHash {
 			continue
 		}
-		wEntries := b.entries[key]
-		if len(wEntries) > 0 {
-			l = limit + expiryCount - l
-			if len(wEntries) < l {
-				l = len(wEntries)
-			}
-			for i := len(wEntries) - 1; i >= len(wEntries)-l; i-- {
-				we := wEntries[i]
-				if we.isExpired() {
-					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
-					}
-					// if id is expired it does not return an error but continue the iteration.
-					continue
-				}
-				winEntries = append(winEntries, we)
+		winEntries = append(winEntries, wEntries...)
+	}
+	sort.Slice(winEntries, func(i, j int) bool {
+		return winEntries[i].seq() > winEntries[j].seq()
+	})
+	entries := winEntries[:0]
+	for _, we := range winEntries {
+		if len(entries) == limit {
+			break
+		}
+		if we.isExpired() {
+			if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
+				tw.logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 			}
+			// if id is expired it does not return an error but continue the iteration.
+			continue
 		}
+		entries = append(entries, we)
 	}
-	return winEntries
+	return entries
 }
 
 // lookup lookups window entries from window file.
-func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff int64, limit int) (winEntries _WindowEntries) {
+// Entries with seq not less than the before seq are skipped, unless before is zero.
+// It also returns number of window blocks read from the window file.
+func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff int64, before uint64, limit int) (winEntries _WindowEntries, blocks int) {
 	winEntries = make([]_WinEntry, 0)
-	winEntries = tw.ilookup(topicHash, limit)
+	if before == 0 {
+		winEntries = tw.ilookup(topicHash, limit)
+	} else {
+		winEntries = tw.ilookup(topicHash, math.MaxInt32).before(before)
+	}
 	if len(winEntries) >= limit {
-		return winEntries
+		return winEntries, blocks
 	}
 	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
-		return winEntries
+		return winEntries, blocks
 	}
 	next := func(blockOff int64, f func(_WinBlock) (bool, error)) error {
 		for {
@@ -271,6 +324,7 @@ func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff
 			if err != nil {
 				return err
 			}
+			blocks++
 			if stop, err := f(b); stop || err != nil {
 				return err
 			}
@@ -286,14 +340,18 @@ func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff
 		if b.topicHash != topicHash {
 			return true, nil
 		}
-		if len(winEntries) > limit-int(b.entryIdx) {
+		entries := _WindowEntries(b.entries[:b.entryIdx])
+		if before != 0 {
+			entries = entries.before(before)
+		}
+		if len(winEntries) > limit-len(entries) {
 			limit = limit - len(winEntries)
-			for i := len(b.entries[:b.entryIdx]) - 1; i >= len(b.entries[:b.entryIdx])-limit; i-- {
-				we := b.entries[i]
+			for i := len(entries) - 1; i >= len(entries)-limit; i-- {
+				we := entries[i]
 				if we.isExpired() {
 					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
 						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+						tw.logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 					}
 					// if id is expired it does not return an error but continue the iteration.
 					continue
@@ -304,12 +362,12 @@ func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff
 				return true, nil
 			}
 		}
-		for i := len(b.entries[:b.entryIdx]) - 1; i >= 0; i-- {
-			we := b.entries[i]
+		for i := len(entries) - 1; i >= 0; i-- {
+			we := entries[i]
 			if we.isExpired() {
 				if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
 					expiryCount++
-					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+					tw.logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 				}
 				// if id is expired it does not return an error but continue the iteration.
 				continue
@@ -323,10 +381,39 @@ func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff
 		return false, nil
 	})
 	if err != nil {
-		return winEntries
+		return winEntries, blocks
 	}
 
-	return winEntries
+	return winEntries, blocks
+}
+
+// scanExpiry scans window blocks from window file and adds entries with an expired TTL to the expiry window.
+// It scans at most maxBlocks in a call and the next call resumes the scan from the following block.
+func (tw *_TimeWindowBucket) scanExpiry(fs *_FileSet, maxBlocks int32) error {
+	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	nBlocks := int32(winFile.currSize() / winFile.blockSize())
+	for i := int32(0); i < maxBlocks && i < nBlocks; i++ {
+		if tw.scanIdx >= nBlocks {
+			tw.scanIdx = 0
+		}
+		r := _WindowReader{winFile: winFile, offset: winFile.blockOffset(tw.scanIdx)}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.isExpired() {
+				if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
+					return err
+				}
+			}
+		}
+		tw.scanIdx++
+	}
+	return nil
 }
 
 func (b _WinBlock) validation(topicHash uint64) error {
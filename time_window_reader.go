@@ -18,6 +18,8 @@ package unitdb
 
 import (
 	"io"
+
+	"github.com/unit-io/unitdb/block"
 )
 
 type _WindowReader struct {
@@ -37,42 +39,57 @@ func newWindowReader(fs *_FileSet) *_WindowReader {
 	w.winFile = winFile
 
 	if winFile.currSize() > 0 {
-		w.windowIdx = int32(winFile.currSize() / int64(blockSize))
+		w.windowIdx = int32(winFile.currSize() / winFile.blockSize())
 	}
 	return w
 }
 
 func (r *_WindowReader) readWindowBlock() (_WinBlock, error) {
-	buf, err := r.winFile.slice(r.offset, r.offset+int64(blockSize))
+	buf, err := r.winFile.slice(r.offset, r.offset+r.winFile.blockSize())
 	if err != nil {
 		return _WinBlock{}, err
 	}
 	if err := r.winBlock.unmarshalBinary(buf); err != nil {
+		if err == block.ErrChecksum {
+			return _WinBlock{}, &block.CorruptionError{File: "window", Offset: r.offset}
+		}
 		return _WinBlock{}, err
 	}
 
 	return r.winBlock, nil
 }
 
-// blockIterator iterates all window blocks from disk.
+// blockIterator iterates topics of window blocks from disk. It calls f with first seq of the topic
+// and offset of the most recent window block of the topic, so new blocks are chained to it.
 func (r *_WindowReader) blockIterator(f func(startSeq, topicHash uint64, off int64) (bool, error)) (err error) {
+	type _FirstBlock struct {
+		seq       uint64
+		topicHash uint64
+	}
+	var firstBlocks []_FirstBlock
+	lastOffsets := make(map[uint64]int64)
 	windowIdx := int32(0)
 	nBlocks := r.windowIdx
 	for windowIdx <= nBlocks {
-		r.offset = winBlockOffset(windowIdx)
+		r.offset = r.winFile.blockOffset(windowIdx)
 		b, err := r.readWindowBlock()
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				break
 			}
 			return err
 		}
 		windowIdx++
+		if b.topicHash != 0 && r.offset > lastOffsets[b.topicHash] {
+			lastOffsets[b.topicHash] = r.offset
+		}
 		if b.entryIdx == 0 || b.next != 0 {
 			continue
 		}
-		// fmt.Println("timeWindow.blockIterator: topicHash, seq ", b.topicHash, b.entries[0].sequence)
-		if stop, err := f(b.entries[0].sequence, b.topicHash, r.offset); stop || err != nil {
+		firstBlocks = append(firstBlocks, _FirstBlock{seq: b.entries[0].sequence, topicHash: b.topicHash})
+	}
+	for _, b := range firstBlocks {
+		if stop, err := f(b.seq, b.topicHash, lastOffsets[b.topicHash]); stop || err != nil {
 			return err
 		}
 	}
@@ -28,14 +28,25 @@ type _WindowWriter struct {
 	winBlocks map[int32]_WinBlock // map[windowIdx]winBlock
 	winLeases map[int32][]uint64  // map[blockIdx][]seq
 
+	// appended holds entries appended since last reset to count these once synced.
+	appended []_WindowAppend
+
 	fs      *_FileSet
 	buffer  *bpool.Buffer
 	winFile *_File
 	offset  int64
 }
 
+// _WindowAppend is an entry appended to a window block.
+type _WindowAppend struct {
+	wIdx      int32
+	topicHash uint64
+	we        _WinEntry
+}
+
 func newWindowWriter(fs *_FileSet, buf *bpool.Buffer) (*_WindowWriter, error) {
-	w := &_WindowWriter{windowIdx: -1, winBlocks: make(map[int32]_WinBlock), winLeases: make(map[int32][]uint64), fs: fs, buffer: buf}
+	// Window block at zero offset is not used, as zero offset of the next block ends a chain of window blocks of a topic.
+	w := &_WindowWriter{windowIdx: 0, winBlocks: make(map[int32]_WinBlock), winLeases: make(map[int32][]uint64), fs: fs, buffer: buf}
 	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
 		return nil, err
@@ -43,14 +54,14 @@ func newWindowWriter(fs *_FileSet, buf *bpool.Buffer) (*_WindowWriter, error) {
 	w.winFile = winFile
 	w.offset = winFile.currSize()
 	if w.offset > 0 {
-		w.windowIdx = int32(w.offset / int64(blockSize))
+		w.windowIdx = int32(w.offset / winFile.blockSize())
 	}
 
 	return w, nil
 }
 
 func (w *_WindowWriter) del(seq uint64, winIdx int32) error {
-	r := _WindowReader{winFile: w.winFile, offset: winBlockOffset(winIdx)}
+	r := _WindowReader{winFile: w.winFile, offset: w.winFile.blockOffset(winIdx)}
 	b, err := r.readWindowBlock()
 	if err != nil {
 		return err
@@ -70,7 +81,7 @@ func (w *_WindowWriter) del(seq uint64, winIdx int32) error {
 	b.entryIdx--
 
 	i := entryIdx
-	for ; i < entriesPerIndexBlock-1; i++ {
+	for ; i < len(b.entries)-1; i++ {
 		b.entries[i] = b.entries[i+1]
 	}
 	b.entries[i] = _WinEntry{}
@@ -79,20 +90,89 @@ func (w *_WindowWriter) del(seq uint64, winIdx int32) error {
 	return nil
 }
 
-// append appends window entries to buffer.
+// synced returns seqs of entries of the topic in window blocks from the block at the offset
+// back to the first block with all entries older than the seq.
+func (w *_WindowWriter) synced(topicHash uint64, off int64, seq uint64) (map[uint64]struct{}, error) {
+	var seqs map[uint64]struct{}
+	for off > 0 {
+		b, ok := w.winBlocks[int32(off/w.winFile.blockSize())]
+		if !ok {
+			if off+w.winFile.blockSize() > w.winFile.currSize() {
+				break
+			}
+			r := _WindowReader{winFile: w.winFile, offset: off}
+			var err error
+			if b, err = r.readWindowBlock(); err != nil {
+				return nil, err
+			}
+		}
+		if b.topicHash != topicHash {
+			break
+		}
+		var maxSeq uint64
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.sequence == 0 {
+				continue
+			}
+			if seqs == nil {
+				seqs = make(map[uint64]struct{})
+			}
+			seqs[we.sequence] = struct{}{}
+			if we.sequence > maxSeq {
+				maxSeq = we.sequence
+			}
+		}
+		if maxSeq < seq {
+			break
+		}
+		off = b.next
+	}
+	return seqs, nil
+}
+
+// dedup removes entries already in window blocks of the topic. Recovery replays entries of a sync
+// interrupted after window blocks were written, these entries must not be appended again.
+func (w *_WindowWriter) dedup(topicHash uint64, off int64, wEntries _WindowEntries) (_WindowEntries, error) {
+	if off == 0 || len(wEntries) == 0 {
+		return wEntries, nil
+	}
+	minSeq := wEntries[0].sequence
+	for _, we := range wEntries[1:] {
+		if we.sequence < minSeq {
+			minSeq = we.sequence
+		}
+	}
+	seqs, err := w.synced(topicHash, off, minSeq)
+	if err != nil || len(seqs) == 0 {
+		return wEntries, err
+	}
+	entries := make(_WindowEntries, 0, len(wEntries))
+	for _, we := range wEntries {
+		if _, ok := seqs[we.sequence]; !ok {
+			entries = append(entries, we)
+		}
+	}
+	return entries, nil
+}
+
+// append appends window entries to buffer. Entries already in window blocks of the topic are skipped,
+// so appending the same entries again does not add these twice.
 func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntries) (newOff int64, err error) {
 	var b _WinBlock
 	var ok bool
 	var wIdx int32
+	if wEntries, err = w.dedup(topicHash, off, wEntries); err != nil {
+		return 0, err
+	}
 	if off == 0 {
 		w.windowIdx++
 		wIdx = w.windowIdx
 	} else {
-		wIdx = int32(off / int64(blockSize))
+		wIdx = int32(off / w.winFile.blockSize())
 	}
 	b, ok = w.winBlocks[wIdx]
-	if !ok && off > 0 {
-		if wIdx <= w.windowIdx {
+	if !ok {
+		if off > 0 && wIdx <= w.windowIdx {
 			r := _WindowReader{winFile: w.winFile, offset: off}
 			b, err = r.readWindowBlock()
 			if err != nil {
@@ -100,6 +180,8 @@ func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntr
 			}
 			b.validation(topicHash)
 			b.leased = true
+		} else {
+			b = w.winFile.newWinBlock()
 		}
 	}
 	b.topicHash = topicHash
@@ -107,26 +189,28 @@ func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntr
 		if we.sequence == 0 {
 			continue
 		}
-		if b.entryIdx == entriesPerWindowBlock {
+		if int(b.entryIdx) == len(b.entries) {
 			topicHash := b.topicHash
-			next := int64(blockSize * wIdx)
+			next := w.winFile.blockOffset(wIdx)
 			// set approximate cutoff on winBlock.
 			b.cutoffTime = time.Now().Unix()
 			w.winBlocks[wIdx] = b
 			w.windowIdx++
 			wIdx = w.windowIdx
-			b = _WinBlock{topicHash: topicHash, next: next}
+			b = w.winFile.newWinBlock()
+			b.topicHash, b.next = topicHash, next
 		}
 		if b.leased {
 			w.winLeases[wIdx] = append(w.winLeases[wIdx], we.sequence)
 		}
 		b.entries[b.entryIdx] = _WinEntry{sequence: we.sequence, expiresAt: we.expiresAt}
+		w.appended = append(w.appended, _WindowAppend{wIdx: wIdx, topicHash: topicHash, we: b.entries[b.entryIdx]})
 		b.dirty = true
 		b.entryIdx++
 	}
 	w.winBlocks[wIdx] = b
 
-	return int64(blockSize * wIdx), nil
+	return w.winFile.blockOffset(wIdx), nil
 }
 
 func (w *_WindowWriter) write() error {
@@ -134,7 +218,7 @@ func (w *_WindowWriter) write() error {
 		if !b.leased || !b.dirty {
 			continue
 		}
-		off := int64(blockSize * bIdx)
+		off := w.winFile.blockOffset(bIdx)
 		if _, err := w.winFile.WriteAt(b.marshalBinary(), off); err != nil {
 			return err
 		}
@@ -162,7 +246,7 @@ func (w *_WindowWriter) write() error {
 	for _, blocks := range winBlocks {
 		if len(blocks) == 1 {
 			bIdx := blocks[0]
-			off := int64(blockSize * bIdx)
+			off := w.winFile.blockOffset(bIdx)
 			b := w.winBlocks[bIdx]
 			buf := b.marshalBinary()
 			if _, err := w.winFile.WriteAt(buf, off); err != nil {
@@ -173,7 +257,7 @@ func (w *_WindowWriter) write() error {
 			// fmt.Println("timeWindow.write: topicHash, seq ", b.topicHash, b.entries[0])
 			continue
 		}
-		blockOff := int64(blockSize * blocks[0])
+		blockOff := w.winFile.blockOffset(blocks[0])
 		for bIdx := blocks[0]; bIdx <= blocks[1]; bIdx++ {
 			b := w.winBlocks[bIdx]
 			w.buffer.Write(b.marshalBinary())
@@ -206,6 +290,7 @@ func (w *_WindowWriter) rollback() error {
 
 func (w *_WindowWriter) reset() error {
 	w.buffer.Reset()
+	w.appended = w.appended[:0]
 	w.offset = w.winFile.currSize()
 
 	return nil
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+// topicNameHeaderSize is the size of a topic name record header, i.e. topic hash, contract and size of the name.
+const topicNameHeaderSize = 14
+
+// TopicInfo is a topic known to the DB and number of its messages, see DB.Topics.
+type TopicInfo struct {
+	Topic    string `json:"topic"`
+	Contract uint32 `json:"contract"`
+	Count    int64  `json:"count"` // Number of messages excluding deleted and expired messages.
+}
+
+type (
+	_TopicName struct {
+		contract uint32
+		name     string
+	}
+	// _TopicNames holds names of topics by topic hash, as the trie only holds hashes of topic parts.
+	// Names are appended to the topic names file when a topic is first written.
+	_TopicNames struct {
+		mu     sync.RWMutex
+		file   fs.File
+		size   int64
+		names  map[uint64]_TopicName
+		counts map[uint32]int64 // number of topics by contract
+	}
+)
+
+func topicNamesPath(dirName string) string {
+	return path.Join(dirName, fmt.Sprintf("%s.topics", prefix))
+}
+
+// openTopicNames reads topic names from the DB directory. A partially written record
+// at the end of the file is discarded.
+func openTopicNames(fsys fs.FileSystem, dirName string) (*_TopicNames, error) {
+	created := !fs.Exists(fsys, topicNamesPath(dirName))
+	f, err := fsys.OpenFile(topicNamesPath(dirName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		if err := syncDir(fsys, dirName); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	tn := &_TopicNames{file: f, names: make(map[uint64]_TopicName), counts: make(map[uint32]int64)}
+	for len(data) >= topicNameHeaderSize {
+		n := int(binary.LittleEndian.Uint16(data[12:14]))
+		if len(data) < topicNameHeaderSize+n {
+			break
+		}
+		tn.names[binary.LittleEndian.Uint64(data[:8])] = _TopicName{
+			contract: binary.LittleEndian.Uint32(data[8:12]),
+			name:     string(data[topicNameHeaderSize : topicNameHeaderSize+n]),
+		}
+		tn.counts[binary.LittleEndian.Uint32(data[8:12])]++
+		tn.size += int64(topicNameHeaderSize + n)
+		data = data[topicNameHeaderSize+n:]
+	}
+	if len(data) > 0 {
+		if err := f.Truncate(tn.size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return tn, nil
+}
+
+// add appends name of the topic to the topic names file if the topic is not known.
+func (tn *_TopicNames) add(topicHash uint64, contract uint32, name []byte) error {
+	tn.mu.RLock()
+	_, ok := tn.names[topicHash]
+	tn.mu.RUnlock()
+	if ok {
+		return nil
+	}
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	if _, ok := tn.names[topicHash]; ok {
+		return nil
+	}
+	rec := make([]byte, topicNameHeaderSize+len(name))
+	binary.LittleEndian.PutUint64(rec[:8], topicHash)
+	binary.LittleEndian.PutUint32(rec[8:12], contract)
+	binary.LittleEndian.PutUint16(rec[12:14], uint16(len(name)))
+	copy(rec[topicNameHeaderSize:], name)
+	if _, err := tn.file.WriteAt(rec, tn.size); err != nil {
+		return err
+	}
+	tn.size += int64(len(rec))
+	tn.names[topicHash] = _TopicName{contract: contract, name: string(name)}
+	tn.counts[contract]++
+	return nil
+}
+
+func (tn *_TopicNames) get(topicHash uint64) (_TopicName, bool) {
+	tn.mu.RLock()
+	defer tn.mu.RUnlock()
+	n, ok := tn.names[topicHash]
+	return n, ok
+}
+
+// count returns number of topics of the contract.
+func (tn *_TopicNames) count(contract uint32) int64 {
+	tn.mu.RLock()
+	defer tn.mu.RUnlock()
+	return tn.counts[contract]
+}
+
+// topics returns names of topics of the contract.
+func (tn *_TopicNames) topics(contract uint32) []string {
+	tn.mu.RLock()
+	defer tn.mu.RUnlock()
+	var names []string
+	for _, n := range tn.names {
+		if n.contract == contract {
+			names = append(names, n.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (tn *_TopicNames) close() error {
+	if err := tn.file.Sync(); err != nil {
+		tn.file.Close()
+		return err
+	}
+	return tn.file.Close()
+}
+
+// topicName returns the topic without its options, i.e. the topic up to the '?'.
+func topicName(topic []byte) []byte {
+	if i := bytes.IndexByte(topic, '?'); i >= 0 {
+		return topic[:i]
+	}
+	return topic
+}
+
+// Topics returns topics of the contract known to the DB with number of their messages, sorted by topic.
+// A zero contract returns topics of the master contract.
+// Names of topics are recorded when a topic is first written, so topics first written before
+// topic names were recorded by the DB are not returned.
+func (db *DB) Topics(contract uint32) ([]TopicInfo, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	var topics []TopicInfo
+	for _, tp := range db.internal.trie.all() {
+		n, ok := db.internal.topicNames.get(tp.hash)
+		if !ok || n.contract != contract {
+			continue
+		}
+		count, err := db.blockCount(tp)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, TopicInfo{Topic: n.name, Contract: n.contract, Count: count + db.memCount(tp.hash)})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Topic < topics[j].Topic
+	})
+	return topics, nil
+}
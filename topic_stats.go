@@ -0,0 +1,155 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"math"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
+)
+
+// TopicStats holds statistics of messages of a topic, see DB.TopicStats.
+type TopicStats struct {
+	Entries      int64     `json:"entries"`       // Number of messages excluding deleted and expired messages.
+	Bytes        int64     `json:"bytes"`         // Size of values of messages as stored, i.e. after compression and encryption.
+	Oldest       time.Time `json:"oldest"`        // Timestamp of the first message written.
+	Newest       time.Time `json:"newest"`        // Timestamp of the last message written.
+	WindowBlocks int       `json:"window_blocks"` // Number of window blocks of the topic in the window file.
+}
+
+// TopicStats returns statistics of messages of the topic. Messages not yet synced to the DB are included.
+// A wildcard topic returns statistics of all topics it matches. Oldest and Newest are zero if the topic has no messages.
+// If the contract is zero then it uses master contract. The access key must grant read access to the topic,
+// see WithAccessControl.
+//
+// TopicStats reads window blocks and index entries of all messages of the topic, for number of messages only use DB.TopicCount.
+func (db *DB) TopicStats(topic []byte, contract uint32, accessKey string) (TopicStats, error) {
+	var stats TopicStats
+	if err := db.ok(); err != nil {
+		return stats, err
+	}
+	switch {
+	case len(topic) == 0:
+		return stats, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return stats, errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	if err := db.checkAccess(accessKey, contract, topic, AccessRead); err != nil {
+		return stats, err
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return stats, err
+	}
+	t.AddContract(contract)
+
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	first, last := uint64(math.MaxUint64), uint64(0)
+	for _, tp := range db.internal.trie.lookup(t.Parts, t.Depth, t.TopicType) {
+		seqs, blocks, err := db.liveSeqs(tp)
+		if err != nil {
+			return stats, err
+		}
+		stats.WindowBlocks += blocks
+		for _, seq := range seqs {
+			e, err := db.readEntry(_Query{seq: seq})
+			if err != nil {
+				// Entry is deleted.
+				continue
+			}
+			stats.Entries++
+			stats.Bytes += int64(e.valueSize)
+			if seq < first {
+				first = seq
+			}
+			if seq > last {
+				last = seq
+			}
+		}
+	}
+	if stats.Entries == 0 {
+		return stats, nil
+	}
+	if stats.Oldest, err = db.entryTime(first); err != nil {
+		return stats, err
+	}
+	stats.Newest, err = db.entryTime(last)
+	return stats, err
+}
+
+// liveSeqs returns seqs of entries of the topic that are not expired, from the memdb and from
+// window blocks of the topic. It also returns number of window blocks of the topic.
+func (db *DB) liveSeqs(tp _Topic) ([]uint64, int, error) {
+	seen := make(map[uint64]struct{})
+	var seqs []uint64
+	add := func(we _WinEntry) {
+		if we.seq() == 0 || we.isExpired() {
+			return
+		}
+		if _, ok := seen[we.seq()]; ok {
+			return
+		}
+		seen[we.seq()] = struct{}{}
+		seqs = append(seqs, we.seq())
+	}
+	for _, we := range db.internal.timeWindow.ilookup(tp.hash, math.MaxInt32) {
+		add(we)
+	}
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return seqs, 0, err
+	}
+	var blocks int
+	for off := tp.offset; off+winFile.blockSize() <= winFile.currSize(); {
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return seqs, blocks, err
+		}
+		if b.topicHash != tp.hash {
+			break
+		}
+		blocks++
+		for _, we := range b.entries[:b.entryIdx] {
+			add(we)
+		}
+		if b.next == 0 {
+			break
+		}
+		off = b.next
+	}
+	return seqs, blocks, nil
+}
+
+// entryTime returns timestamp of the entry from its message ID.
+func (db *DB) entryTime(seq uint64) (time.Time, error) {
+	e, err := db.readEntry(_Query{seq: seq})
+	if err != nil {
+		return time.Time{}, err
+	}
+	id, _, err := db.internal.reader.readMessage(e)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(uid.Time(id[0:4]), 0), nil
+}
@@ -18,12 +18,16 @@ package unitdb
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/unitdb/message"
 )
 
 const (
 	nul = 0x0
+
+	// nOffsetShards is the number of shards holding offsets of topics.
+	nOffsetShards = 64
 )
 
 type _Topic struct {
@@ -69,7 +73,7 @@ func (n *_Node) orphan() {
 	}
 
 	delete(n.parent.children, n.part)
-	if len(n.parent.children) == 0 {
+	if len(n.parent.children) == 0 && len(n.parent.topics) == 0 {
 		n.parent.orphan()
 	}
 }
@@ -90,20 +94,48 @@ func newTopicTrie() *_TopicTrie {
 	}
 }
 
+// _OffsetShard holds offsets of the most recent window block of topics, by topic hash.
+type _OffsetShard struct {
+	sync.RWMutex
+	offsets map[uint64]int64
+}
+
 // _Trie trie data structure to store topic parts
 type _Trie struct {
-	sync.RWMutex
-	mutex     _Mutex
-	topicTrie *_TopicTrie
+	sync.RWMutex // guards the topic trie, topics are added and removed under the write lock.
+	topicTrie    *_TopicTrie
+
+	// Offsets of topics are set on every sync, so these are held in shards apart from the topic trie,
+	// and a write or sync to a topic only locks the shard of its topic.
+	shards [nOffsetShards]*_OffsetShard
+
+	// epoch is incremented on every topic added to or removed from the trie, a view
+	// is taken at most once per epoch and it is shared by the lookups.
+	epoch uint64
+	view  atomic.Value // *_TrieView
+}
+
+// _TrieView is an immutable copy of the trie at an epoch. A lookup walks a view,
+// so it does not observe topics added by a sync that races with it.
+type _TrieView struct {
+	epoch uint64
+	root  *_Node
 }
 
 // newTrie new trie creates a Trie with an initialized Trie.
-// Mutex is used to lock concurent read/write on a contract, and it does not lock entire trie.
 func newTrie() *_Trie {
-	return &_Trie{
-		mutex:     newMutex(),
+	t := &_Trie{
 		topicTrie: newTopicTrie(),
 	}
+	for i := range t.shards {
+		t.shards[i] = &_OffsetShard{offsets: make(map[uint64]int64)}
+	}
+	return t
+}
+
+// shard returns the offset shard of the topic. Upper half of the topic hash is the hash of the topic parts.
+func (t *_Trie) shard(topicHash uint64) *_OffsetShard {
+	return t.shards[(topicHash>>32)%nOffsetShards]
 }
 
 // Count returns the number of topics in the Trie.
@@ -113,12 +145,25 @@ func (t *_Trie) Count() int {
 	return len(t.topicTrie.summary)
 }
 
+// nodes returns the number of nodes in the Trie, excluding the root node.
+func (t *_Trie) nodes() int {
+	t.RLock()
+	defer t.RUnlock()
+	var count func(n *_Node) int
+	count = func(n *_Node) int {
+		c := len(n.children)
+		for _, child := range n.children {
+			c += count(child)
+		}
+		return c
+	}
+	return count(t.topicTrie.root)
+}
+
 // add adds a topic to trie.
 func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool) {
-	// Get mutex
-	mu := t.mutex.getMutex(topic.hash)
-	mu.Lock()
-	defer mu.Unlock()
+	t.Lock()
+	defer t.Unlock()
 	if _, ok := t.topicTrie.summary[topic.hash]; ok {
 		return false
 	}
@@ -128,39 +173,94 @@ func (t *_Trie) add(topic _Topic, parts []message.Part, depth uint8) (added bool
 			hash:      p.Hash,
 			wildchars: p.Wildchars,
 		}
-		t.RLock()
 		child, ok := curr.children[newPart]
-		t.RUnlock()
 		if !ok {
 			child = &_Node{
 				part:     newPart,
 				parent:   curr,
 				children: make(map[_Part]*_Node),
 			}
-			t.Lock()
 			curr.children[newPart] = child
-			t.Unlock()
 		}
 		curr = child
 	}
-	t.Lock()
-	curr.topics.addUnique(topic)
+	curr.depth = depth
+	// Nodes hold topic hashes, offsets of topics are only held by the offset shards.
+	curr.topics.addUnique(_Topic{hash: topic.hash})
 	t.topicTrie.summary[topic.hash] = curr
-	t.Unlock()
+	s := t.shard(topic.hash)
+	s.Lock()
+	s.offsets[topic.hash] = topic.offset
+	s.Unlock()
+	t.epoch++
 	added = true
-	curr.depth = depth
 	return
 }
 
-// lookup returns window entry set for given topic.
-func (t *_Trie) lookup(query []message.Part, depth, topicType uint8) (tops _Topics) {
+// remove removes a topic from trie, nodes left without topics and children are removed from the trie.
+func (t *_Trie) remove(topicHash uint64) (removed bool) {
+	t.Lock()
+	defer t.Unlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return false
+	}
+	for i, topic := range curr.topics {
+		if topic.hash == topicHash {
+			curr.topics = append(curr.topics[:i], curr.topics[i+1:]...)
+			break
+		}
+	}
+	if len(curr.topics) == 0 && len(curr.children) == 0 {
+		curr.orphan()
+	}
+	delete(t.topicTrie.summary, topicHash)
+	s := t.shard(topicHash)
+	s.Lock()
+	delete(s.offsets, topicHash)
+	s.Unlock()
+	t.epoch++
+	return true
+}
+
+// snapshot returns a view of the trie at the current epoch. The view is copied
+// from the trie only if the trie is changed since the last view was taken.
+func (t *_Trie) snapshot() *_TrieView {
 	t.RLock()
 	defer t.RUnlock()
-	t.ilookup(query, depth, topicType, &tops, t.topicTrie.root)
+	if v, ok := t.view.Load().(*_TrieView); ok && v.epoch == t.epoch {
+		return v
+	}
+	v := &_TrieView{epoch: t.epoch, root: t.topicTrie.root.clone()}
+	t.view.Store(v)
+	return v
+}
+
+// clone copies the node and its children, the copy does not link to its parent.
+func (n *_Node) clone() *_Node {
+	c := &_Node{
+		part:     n.part,
+		depth:    n.depth,
+		children: make(map[_Part]*_Node, len(n.children)),
+		topics:   append(_Topics(nil), n.topics...),
+	}
+	for part, child := range n.children {
+		c.children[part] = child.clone()
+	}
+	return c
+}
+
+// lookup returns window entry set for given topic.
+func (t *_Trie) lookup(query []message.Part, depth, topicType uint8) (tops _Topics) {
+	v := t.snapshot()
+	v.ilookup(query, depth, topicType, &tops, v.root)
+	for i := range tops {
+		tops[i].offset, _ = t.getOffset(tops[i].hash)
+	}
 	return
 }
 
-func (t *_Trie) ilookup(query []message.Part, depth, topicType uint8, tops *_Topics, currNode *_Node) {
+func (v *_TrieView) ilookup(query []message.Part, depth, topicType uint8, tops *_Topics, currNode *_Node) {
 	// Add topics from the current branch.
 	if currNode.depth == depth || (topicType == message.TopicStatic && currNode.part.hash == message.Wildcard) {
 		for _, topic := range currNode.topics {
@@ -174,37 +274,62 @@ func (t *_Trie) ilookup(query []message.Part, depth, topicType uint8, tops *_Top
 	}
 
 	q := query[0]
+	// A multi-level wildcard at the end of the query matches the subtree of the current branch.
+	if len(query) == 1 && q.Hash == message.Wildcard && topicType == message.TopicWildcard {
+		v.subtree(tops, currNode)
+		return
+	}
 	// Go through the wildcard match branch.
 	for part, n := range currNode.children {
 		switch {
 		case part.hash == q.Hash && q.Wildchars == part.wildchars:
-			t.ilookup(query[1:], depth, topicType, tops, n)
+			v.ilookup(query[1:], depth, topicType, tops, n)
 		case part.hash == q.Hash && uint8(len(query)) >= part.wildchars+1:
-			t.ilookup(query[part.wildchars+1:], depth, topicType, tops, n)
+			v.ilookup(query[part.wildchars+1:], depth, topicType, tops, n)
+		case q.Hash == message.SingleLevel && part.hash != message.Wildcard:
+			// A single-level wildcard matches any part at its level.
+			v.ilookup(query[1:], depth, topicType, tops, n)
 		case part.hash == message.Wildcard:
-			t.ilookup(query[:], depth, topicType, tops, n)
+			v.ilookup(query[:], depth, topicType, tops, n)
 		}
 	}
 }
 
-func (t *_Trie) getOffset(topicHash uint64) (off int64, ok bool) {
+// subtree adds topics of the node and of all its descendants.
+func (v *_TrieView) subtree(tops *_Topics, currNode *_Node) {
+	for _, topic := range currNode.topics {
+		tops.addUnique(topic)
+	}
+	for _, n := range currNode.children {
+		v.subtree(tops, n)
+	}
+}
+
+// all returns all topics of the trie.
+func (t *_Trie) all() (tops _Topics) {
 	t.RLock()
 	defer t.RUnlock()
-	if curr, ok := t.topicTrie.summary[topicHash]; ok {
-		for _, topic := range curr.topics {
-			if topic.hash == topicHash {
-				return topic.offset, ok
-			}
-		}
+	for hash := range t.topicTrie.summary {
+		off, _ := t.getOffset(hash)
+		tops = append(tops, newTopic(hash, off))
 	}
+	return
+}
+
+func (t *_Trie) getOffset(topicHash uint64) (off int64, ok bool) {
+	s := t.shard(topicHash)
+	s.RLock()
+	defer s.RUnlock()
+	off, ok = s.offsets[topicHash]
 	return off, ok
 }
 
 func (t *_Trie) setOffset(topic _Topic) (ok bool) {
-	t.Lock()
-	defer t.Unlock()
-	if curr, ok := t.topicTrie.summary[topic.hash]; ok {
-		curr.topics.addUnique(topic)
+	s := t.shard(topic.hash)
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.offsets[topic.hash]; ok {
+		s.offsets[topic.hash] = topic.offset
 		return ok
 	}
 	return false
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// _TxWrite is a message written by the transaction, not yet committed to the DB.
+	_TxWrite struct {
+		topicHash uint64
+		seq       uint64
+		payload   []byte
+	}
+
+	// Tx is an interactive transaction. Entries are written to a batch committed to the DB on Commit,
+	// and reads of the transaction return messages of the DB together with its own uncommitted writes.
+	// Reads are not isolated from messages committed to the DB by others while the transaction is open.
+	Tx struct {
+		db     *DB
+		batch  *Batch
+		trie   *_Trie // topics written by the transaction.
+		writes []_TxWrite
+		// skip are seqs written or deleted by the transaction, messages of these seqs in the DB are not returned.
+		skip map[uint64]struct{}
+	}
+)
+
+// Begin starts an interactive transaction. The transaction must be completed using Commit or Rollback.
+func (db *DB) Begin() (*Tx, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	return &Tx{db: db, batch: db.batch(), trie: newTrie(), skip: make(map[uint64]struct{})}, nil
+}
+
+// SetOptions sets batch options of the transaction.
+func (tx *Tx) SetOptions(opts ...Options) {
+	tx.batch.SetOptions(opts...)
+}
+
+// Put adds entry to the transaction for given topic->key/value.
+func (tx *Tx) Put(topic, payload []byte) error {
+	return tx.PutEntry(NewEntry(topic, payload).WithContract(tx.batch.opts.batchOptions.contract))
+}
+
+// PutEntry adds entry to the transaction, the entry is returned by Get of the transaction before it is committed.
+// It is safe to modify the contents of the argument after PutEntry returns but not before.
+func (tx *Tx) PutEntry(e *Entry) error {
+	if tx.db == nil {
+		return errTxDone
+	}
+	payload := append([]byte(nil), e.Payload...)
+	if err := tx.batch.PutEntry(e); err != nil {
+		return err
+	}
+	entry, err := tx.lastEntry()
+	if err != nil {
+		return err
+	}
+	t, _, err := tx.db.parseTopic(e.Contract, e.Topic)
+	if err != nil {
+		return err
+	}
+	t.AddContract(e.Contract)
+	tx.trie.add(newTopic(entry.topicHash, 0), t.Parts, t.Depth)
+	tx.remove(entry.seq)
+	tx.writes = append(tx.writes, _TxWrite{topicHash: entry.topicHash, seq: entry.seq, payload: payload})
+	tx.skip[entry.seq] = struct{}{}
+	return nil
+}
+
+// Delete adds delete entry to the transaction for given key.
+func (tx *Tx) Delete(id, topic []byte) error {
+	return tx.DeleteEntry(NewEntry(topic, nil).WithID(id))
+}
+
+// DeleteEntry adds entry for deletion to the transaction, the entry is not returned by Get of the transaction
+// before it is committed.
+func (tx *Tx) DeleteEntry(e *Entry) error {
+	if tx.db == nil {
+		return errTxDone
+	}
+	id := message.ID(e.ID)
+	if err := tx.batch.DeleteEntry(e); err != nil {
+		return err
+	}
+	seq := id.Sequence()
+	tx.remove(seq)
+	tx.skip[seq] = struct{}{}
+	return nil
+}
+
+// Get return items matching the query parameter, including messages written and excluding messages deleted
+// by the transaction.
+func (tx *Tx) Get(q *Query) ([][]byte, error) {
+	if tx.db == nil {
+		return nil, errTxDone
+	}
+	if len(q.ID) == message.ID(nil).Size() {
+		seq := message.ID(q.ID).Sequence()
+		if _, ok := tx.skip[seq]; ok {
+			for _, w := range tx.writes {
+				if w.seq == seq {
+					return [][]byte{w.payload}, nil
+				}
+			}
+			return nil, errMsgIDDoesNotExist
+		}
+	}
+	q.internal.skip = tx.skip
+	items, err := tx.db.Get(q)
+	seqs := q.internal.seqs
+	q.internal.skip, q.internal.seqs = nil, nil
+	if err != nil || len(q.ID) != 0 {
+		return items, err
+	}
+
+	topics := tx.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+	if len(topics) == 0 {
+		return items, nil
+	}
+	var writes []_TxWrite
+	for _, w := range tx.writes {
+		if q.internal.before != 0 && w.seq >= q.internal.before {
+			continue
+		}
+		for _, topic := range topics {
+			if topic.hash == w.topicHash {
+				writes = append(writes, w)
+				break
+			}
+		}
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].seq > writes[j].seq
+	})
+	// Messages of the DB and writes of the transaction are merged newest first.
+	merged := make([][]byte, 0, len(items)+len(writes))
+	var last uint64
+	for i, j := 0, 0; len(merged) < q.Limit && (i < len(items) || j < len(writes)); {
+		if j == len(writes) || (i < len(items) && seqs[i] > writes[j].seq) {
+			merged = append(merged, items[i])
+			last = seqs[i]
+			i++
+			continue
+		}
+		merged = append(merged, writes[j].payload)
+		last = writes[j].seq
+		j++
+	}
+	q.internal.last = last
+	if len(merged) < q.Limit {
+		q.internal.last = 0
+	}
+	q.internal.stats.Returned = len(merged)
+	return merged, nil
+}
+
+// Commit commits entries of the transaction to the DB.
+func (tx *Tx) Commit() error {
+	if tx.db == nil {
+		return errTxDone
+	}
+	tx.db = nil
+	return tx.batch.Commit()
+}
+
+// Rollback discards entries of the transaction.
+func (tx *Tx) Rollback() error {
+	if tx.db == nil {
+		return errTxDone
+	}
+	tx.db = nil
+	tx.batch.Abort()
+	return nil
+}
+
+// lastEntry returns the entry last added to the batch of the transaction.
+func (tx *Tx) lastEntry() (_Entry, error) {
+	var e _Entry
+	off := tx.batch.index[len(tx.batch.index)-1].offset
+	data, err := tx.batch.buffer.Slice(off+4, off+entrySize+4)
+	if err != nil {
+		return e, err
+	}
+	err = e.UnmarshalBinary(data)
+	return e, err
+}
+
+// remove removes a write of the seq from writes of the transaction.
+func (tx *Tx) remove(seq uint64) {
+	for i, w := range tx.writes {
+		if w.seq == seq {
+			tx.writes = append(tx.writes[:i], tx.writes[i+1:]...)
+			return
+		}
+	}
+}
@@ -46,6 +46,11 @@ func NewApoch() uint32 {
 	return math.MaxUint32 - now
 }
 
+// Apoch returns the apoch of the time in seconds, i.e. the time portion of an ID.
+func Apoch(sec int64) uint32 {
+	return math.MaxUint32 - uint32(sec-Offset)
+}
+
 // NewUnique return unique value to use generating unique id.
 func NewUnique() uint32 {
 	b := make([]byte, 4)
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unit-io/unitdb/block"
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/wal"
+)
+
+// VerifyIssue is an inconsistency found by Verify.
+type VerifyIssue struct {
+	File      string `json:"file"`   // File is one of index, data, window, filter, trie or log.
+	Offset    int64  `json:"offset"` // Offset of the block in the file, or time ID of the log.
+	Seq       uint64 `json:"seq,omitempty"`
+	TopicHash uint64 `json:"topic_hash,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+// VerifyReport reports the blocks, entries, topics and logs checked by Verify and the inconsistencies found.
+type VerifyReport struct {
+	IndexBlocks  int64         `json:"index_blocks"`
+	WindowBlocks int64         `json:"window_blocks"`
+	Entries      int64         `json:"entries"`
+	Topics       int64         `json:"topics"`
+	Logs         int64         `json:"logs"`
+	Issues       []VerifyIssue `json:"issues"`
+}
+
+// OK returns true if Verify found no inconsistencies.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *VerifyReport) add(file string, off int64, seq, topicHash uint64, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, VerifyIssue{File: file, Offset: off, Seq: seq, TopicHash: topicHash, Msg: fmt.Sprintf(format, args...)})
+}
+
+// addCorruption adds an issue if err is a corruption error, other errors are returned.
+func (r *VerifyReport) addCorruption(err error, seq, topicHash uint64) error {
+	var e *block.CorruptionError
+	if !errors.As(err, &e) {
+		return err
+	}
+	r.add(e.File, e.Offset, seq, topicHash, "checksum mismatch")
+	return nil
+}
+
+// Verify checks integrity of the DB. It walks index blocks and reads their entries from the data
+// file, verifying checksums and decrypting and decoding the values, confirms the filter reports
+// each entry, walks window blocks and the window block of every topic in the trie, and verifies
+// the write ahead logs. Verify returns an error only if it fails to read the DB files.
+func (db *DB) Verify() (*VerifyReport, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	// Verify reads blocks written by sync and compaction, so it excludes these.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+
+	report := &VerifyReport{}
+	if err := db.verifyIndex(report); err != nil {
+		return report, err
+	}
+	if err := db.verifyWindows(report); err != nil {
+		return report, err
+	}
+	if err := db.verifyTrie(report); err != nil {
+		return report, err
+	}
+	n, errs := db.internal.mem.VerifyLog()
+	report.Logs = int64(n)
+	for _, err := range errs {
+		if e, ok := err.(*wal.LogError); ok {
+			report.add("log", e.TimeID, 0, 0, "%v", e.Err)
+			continue
+		}
+		return report, err
+	}
+	return report, nil
+}
+
+// verifyIndex checks index blocks and reads entries of the blocks from the data file and the value log.
+func (db *DB) verifyIndex(report *VerifyReport) error {
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	vlogFile, err := db.fs.getFile(_FileDesc{fileType: typeValueLog})
+	if err != nil {
+		return err
+	}
+	indexSize, dataSize := indexFile.currSize(), dataFile.currSize()
+	if indexSize%indexFile.blockSize() != 0 {
+		report.add("index", indexSize, 0, 0, "index file size is not a multiple of block size")
+	}
+	nIndexBlocks := int32(indexSize / indexFile.blockSize())
+	for bIdx := int32(0); bIdx < nIndexBlocks; bIdx++ {
+		off := indexFile.blockOffset(bIdx)
+		r := _BlockReader{indexFile: indexFile, offset: off}
+		b, err := r.readIndexBlock()
+		report.IndexBlocks++
+		if err != nil {
+			if err := report.addCorruption(err, 0, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if int(b.entryIdx) > len(b.entries) {
+			report.add("index", off, 0, 0, "block has %d entries", b.entryIdx)
+			continue
+		}
+		for _, e := range b.entries[:b.entryIdx] {
+			if e.seq == 0 || e.msgOffset == -1 {
+				continue
+			}
+			if indexFile.blockIndex(e.seq) != bIdx {
+				report.add("index", off, e.seq, 0, "entry belongs to block %d", indexFile.blockIndex(e.seq))
+				continue
+			}
+			report.Entries++
+			// Generations of the filter with all entries expired are dropped.
+			if db.internal.filter.covers(e.seq) && !db.internal.filter.Test(e.seq) {
+				report.add("filter", 0, e.seq, 0, "filter does not report the entry")
+			}
+			if e.msgOffset < 0 || e.msgOffset+int64(e.mSize()) > dataSize {
+				report.add("data", e.msgOffset, e.seq, 0, "message of %d bytes is outside of the data file of %d bytes", e.mSize(), dataSize)
+				continue
+			}
+			msg, err := readMessageData(dataFile, vlogFile, e)
+			if err != nil {
+				if err := report.addCorruption(err, e.seq, 0); err != nil {
+					return err
+				}
+				continue
+			}
+			if e.topicSize != 0 {
+				t := new(message.Topic)
+				if err := t.Unmarshal(msg[idSize : idSize+int(e.topicSize)]); err != nil {
+					report.add("data", e.msgOffset, e.seq, 0, "topic cannot be read: %v", err)
+				}
+			}
+			if e.isDeleted() {
+				continue
+			}
+			// Messages of a contract with its key deleted or not set cannot be decoded.
+			_, err = db.decodeValue(msg[:idSize], msg[idSize+int(e.topicSize):])
+			if err != nil && err != errMsgShredded && err != errContractKeyNotSet {
+				report.add("data", e.msgOffset, e.seq, 0, "value cannot be decoded: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyWindows checks window blocks and the links of window blocks of a topic.
+func (db *DB) verifyWindows(report *VerifyReport) error {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	winSize := winFile.currSize()
+	if winSize%winFile.blockSize() != 0 {
+		report.add("window", winSize, 0, 0, "window file size is not a multiple of block size")
+	}
+	nWinBlocks := int32(winSize / winFile.blockSize())
+	for wIdx := int32(0); wIdx < nWinBlocks; wIdx++ {
+		off := winFile.blockOffset(wIdx)
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		report.WindowBlocks++
+		if err != nil {
+			if err := report.addCorruption(err, 0, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if int(b.entryIdx) > len(b.entries) {
+			report.add("window", off, 0, b.topicHash, "block has %d entries", b.entryIdx)
+			continue
+		}
+		if b.next == 0 {
+			continue
+		}
+		if b.next%winFile.blockSize() != 0 || b.next+winFile.blockSize() > winSize || b.next == off {
+			report.add("window", off, 0, b.topicHash, "block links to invalid offset %d", b.next)
+			continue
+		}
+		r = _WindowReader{winFile: winFile, offset: b.next}
+		next, err := r.readWindowBlock()
+		if err != nil {
+			// A corrupted block is reported as window blocks are walked.
+			if errors.Is(err, block.ErrChecksum) {
+				continue
+			}
+			return err
+		}
+		if next.topicHash != b.topicHash {
+			report.add("window", off, 0, b.topicHash, "block links to block at offset %d of another topic", b.next)
+		}
+	}
+	return nil
+}
+
+// verifyTrie checks that the trie offset of each topic points at a window block of the topic.
+func (db *DB) verifyTrie(report *VerifyReport) error {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	winSize := winFile.currSize()
+	for _, tp := range db.internal.trie.all() {
+		report.Topics++
+		// A topic not yet synced has zero offset and no window block.
+		if tp.offset%winFile.blockSize() != 0 || tp.offset+winFile.blockSize() > winSize {
+			if tp.offset != 0 {
+				report.add("trie", tp.offset, 0, tp.hash, "topic offset is outside of the window file")
+			}
+			continue
+		}
+		r := _WindowReader{winFile: winFile, offset: tp.offset}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			// A corrupted block is reported as window blocks are walked.
+			if errors.Is(err, block.ErrChecksum) {
+				continue
+			}
+			return err
+		}
+		if b.topicHash != tp.hash && tp.offset != 0 {
+			report.add("trie", tp.offset, 0, tp.hash, "topic offset points at window block of topic %d", b.topicHash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wal
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+const archiveGzipExt = ".gz"
+
+// ArchiveOptions is the policy for logs signaled as applied. By default applied logs are deleted.
+type ArchiveOptions struct {
+	// Path is the directory applied logs are moved to. Applied logs are deleted if Path is empty.
+	Path string
+
+	// Compress compresses archived logs using gzip.
+	Compress bool
+
+	// Retention is the duration an archived log is kept. Zero keeps archived logs until removed by the hook or an operator.
+	Retention time.Duration
+
+	// Hook is called after a log is archived with the time ID and path of the archived log,
+	// for example to ship archived logs to a remote store. An error returned by Hook is returned by SignalLogApplied.
+	Hook func(timeID int64, archivePath string) error
+}
+
+func archivePath(dirName string, timeID int64, compress bool) string {
+	suffix := strconv.FormatInt(timeID, 10) + logExt
+	if compress {
+		suffix += archiveGzipExt
+	}
+	return path.Join(dirName, suffix)
+}
+
+// archive moves the log to the archive directory, compressing it if the policy says so.
+func (fs *_FileStore) archive(timeID int64, opts ArchiveOptions) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if !fs.opened {
+		// trying to use file store, but not open.
+		return nil
+	}
+
+	log := logPath(fs.dirName, timeID)
+	if !exists(fs.fsys, log) {
+		return nil
+	}
+	if err := fs.fsys.MkdirAll(opts.Path, os.FileMode(0770)); err != nil {
+		return err
+	}
+
+	dst := archivePath(opts.Path, timeID, opts.Compress)
+	if !opts.Compress {
+		if err := fs.fsys.Rename(log, dst); err == nil {
+			syncDir(fs.fsys, opts.Path)
+			return nil
+		}
+		// The archive directory may be on another device, fall back to copy.
+	}
+	if err := copyLog(fs.fsys, log, dst, opts.Compress); err != nil {
+		return err
+	}
+	return fs.fsys.Remove(log)
+}
+
+// copyLog copies the log to a temporary file renamed to dst once it is written completely.
+func copyLog(fsys fs.FileSystem, src, dst string, compress bool) error {
+	in, err := fs.Open(fsys, src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + tmpExt
+	out, err := fs.Create(fsys, tmp)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser = out
+	if compress {
+		w = gzip.NewWriter(out)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		fsys.Remove(tmp)
+		return err
+	}
+	if compress {
+		if err := w.Close(); err != nil {
+			out.Close()
+			fsys.Remove(tmp)
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		fsys.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	if err := fsys.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return fs.SyncDir(fsys, path.Dir(dst))
+}
+
+// pruneArchive removes archived logs older than the retention duration.
+func pruneArchive(fsys fs.FileSystem, opts ArchiveOptions) error {
+	if opts.Path == "" || opts.Retention <= 0 {
+		return nil
+	}
+	files, err := fsys.ReadDir(opts.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cutoff := time.Now().Add(-opts.Retention)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, logExt) && !strings.HasSuffix(name, logExt+archiveGzipExt) {
+			// skipping file, not an archived log.
+			continue
+		}
+		if f.ModTime().Before(cutoff) {
+			if err := fsys.Remove(path.Join(opts.Path, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ArchivedLog is a log in the archive directory, see ArchivedLogs.
+type ArchivedLog struct {
+	TimeID int64
+	Path   string
+}
+
+// ArchivedLogs returns logs in the archive directory in time order. A nil file system is the OS file system.
+func ArchivedLogs(fsys fs.FileSystem, dirName string) ([]ArchivedLog, error) {
+	if fsys == nil {
+		fsys = fs.OS
+	}
+	files, err := fsys.ReadDir(dirName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var logs []ArchivedLog
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), archiveGzipExt)
+		if !strings.HasSuffix(name, logExt) {
+			// skipping file, not an archived log.
+			continue
+		}
+		timeID, err := strconv.ParseInt(strings.TrimSuffix(name, logExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		logs = append(logs, ArchivedLog{TimeID: timeID, Path: path.Join(dirName, f.Name())})
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].TimeID < logs[j].TimeID
+	})
+	return logs, nil
+}
+
+// OpenArchivedLog opens a log archived by the WAL on the file system for reading,
+// decompressing it if it is compressed. A nil file system is the OS file system.
+func OpenArchivedLog(fsys fs.FileSystem, archivePath string) (io.ReadCloser, error) {
+	if fsys == nil {
+		fsys = fs.OS
+	}
+	f, err := fs.Open(fsys, archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(archivePath, archiveGzipExt) {
+		return f, nil
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &_ArchiveReader{Reader: r, f: f}, nil
+}
+
+type _ArchiveReader struct {
+	*gzip.Reader
+	f fs.File
+}
+
+func (r *_ArchiveReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
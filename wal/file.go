@@ -19,29 +19,41 @@ package wal
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/fs"
 )
 
 type (
 	_FileStore struct {
 		sync.RWMutex
+		fsys    fs.FileSystem
 		dirName string
 		opened  bool
+
+		// preallocate is size in bytes of disk blocks reserved for a log before it is written.
+		preallocate int64
+
+		// recycle is the maximum number of applied logs kept to write new logs to.
+		recycle int
+		free    []string
 	}
 	_FileInfos []os.FileInfo
 )
 
-func openFile(dirName string, bufferSize int64) (*_FileStore, error) {
+func openFile(fsys fs.FileSystem, dirName string, opts Options) (*_FileStore, error) {
 	fs := &_FileStore{
-		dirName: dirName,
-		opened:  false,
+		fsys:        fsys,
+		dirName:     dirName,
+		opened:      false,
+		preallocate: opts.Preallocate,
+		recycle:     opts.RecycleLogs,
 	}
 
 	// if no store directory was specified, by default use the current working directory.
@@ -50,31 +62,84 @@ func openFile(dirName string, bufferSize int64) (*_FileStore, error) {
 	}
 
 	// if store dir does not exists then create it.
-	if !exists(dirName) {
+	if !exists(fsys, dirName) {
 		perms := os.FileMode(0770)
-		if err := os.MkdirAll(fs.dirName, perms); err != nil {
+		if err := fsys.MkdirAll(fs.dirName, perms); err != nil {
 			return nil, err
 		}
 	}
 	fs.opened = true
+	fs.openFree()
 
 	return fs, nil
 }
 
+// openFree lists the recycled logs of the store directory, it removes logs beyond the recycle limit.
+func (fs *_FileStore) openFree() {
+	files, err := fs.fsys.ReadDir(fs.dirName)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), freeExt) {
+			continue
+		}
+		name := path.Join(fs.dirName, f.Name())
+		if len(fs.free) >= fs.recycle {
+			fs.fsys.Remove(name)
+			continue
+		}
+		fs.free = append(fs.free, name)
+	}
+}
+
+// create opens the temporary file of a log. It reuses a recycled log if there is one, so
+// writing the log does not create a file and reserves disk blocks if preallocate is set.
+func (fs *_FileStore) create(tmp string) (fs.File, error) {
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if n := len(fs.free); n > 0 {
+		name := fs.free[n-1]
+		fs.free = fs.free[:n-1]
+		if err := fs.fsys.Rename(name, tmp); err == nil {
+			flag = os.O_RDWR
+		}
+	}
+	f, err := fs.fsys.OpenFile(tmp, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if flag == os.O_RDWR {
+		// drop the previous log written to the recycled file.
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if fs.preallocate > 0 {
+		if err := allocate(f, fs.preallocate); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
 func (fs *_FileStore) close() {
 	fs.Lock()
 	defer fs.Unlock()
 	fs.opened = false
 }
 
-func (fs *_FileStore) put(info _LogInfo, data *bpool.Buffer) error {
+// put writes the log to a temporary file renamed to the log file. If fsync is set the log
+// is flushed to the disk before put returns.
+func (fs *_FileStore) put(info _LogInfo, data *bpool.Buffer, fsync bool) error {
 	fs.Lock()
 	defer fs.Unlock()
 	if !fs.opened {
 		return errors.New("Trying to use file store, but not open")
 	}
 	tmp := tmpPath(fs.dirName, info.timeID)
-	f, err := os.Create(tmp)
+	f, err := fs.create(tmp)
 	if err != nil {
 		return err
 	}
@@ -88,16 +153,25 @@ func (fs *_FileStore) put(info _LogInfo, data *bpool.Buffer) error {
 	if _, err := f.WriteAt(data.Bytes(), int64(logHeaderSize)); err != nil {
 		return err
 	}
+	if fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
 	log := logPath(fs.dirName, info.timeID)
 
-	if err := os.Rename(tmp, log); err != nil {
+	if err := fs.fsys.Rename(tmp, log); err != nil {
 		return err
 	}
+	if fsync {
+		syncDir(fs.fsys, fs.dirName)
+	}
 
-	if !exists(log) {
+	if !exists(fs.fsys, log) {
 		return errors.New(fmt.Sprintf("file not created, %s", log))
 	}
 
@@ -116,11 +190,11 @@ func (fs *_FileStore) read(timeID int64, data *bpool.Buffer) _LogInfo {
 	}
 
 	log := logPath(fs.dirName, timeID)
-	if !exists(log) {
+	if !exists(fs.fsys, log) {
 		return info
 	}
 
-	f, err := os.Open(log)
+	f, err := fs.fsys.OpenFile(log, os.O_RDONLY, 0)
 	if err != nil {
 		return info
 	}
@@ -128,7 +202,7 @@ func (fs *_FileStore) read(timeID int64, data *bpool.Buffer) _LogInfo {
 	buf := make([]byte, uint32(logHeaderSize))
 	if _, err := f.ReadAt(buf, 0); err != nil {
 		f.Close()
-		os.Rename(log, corruptPath(fs.dirName, timeID))
+		fs.fsys.Rename(log, corruptPath(fs.dirName, timeID))
 
 		// log was unreadable, return nil
 		return info
@@ -136,7 +210,7 @@ func (fs *_FileStore) read(timeID int64, data *bpool.Buffer) _LogInfo {
 
 	if err := info.UnmarshalBinary(buf); err != nil {
 		f.Close()
-		os.Rename(log, corruptPath(fs.dirName, timeID))
+		fs.fsys.Rename(log, corruptPath(fs.dirName, timeID))
 
 		// log was unreadable, return nil
 		return info
@@ -148,7 +222,7 @@ func (fs *_FileStore) read(timeID int64, data *bpool.Buffer) _LogInfo {
 
 	if _, err := f.ReadAt(data.Internal(), int64(logHeaderSize)); err != nil {
 		f.Close()
-		os.Rename(log, corruptPath(fs.dirName, timeID))
+		fs.fsys.Rename(log, corruptPath(fs.dirName, timeID))
 
 		// log was unreadable, return nil
 		return info
@@ -168,7 +242,7 @@ func (fs *_FileStore) all() []int64 {
 		return nil
 	}
 
-	files, err := ioutil.ReadDir(fs.dirName)
+	files, err := fs.fsys.ReadDir(fs.dirName)
 	if err != nil {
 		return nil
 	}
@@ -195,6 +269,26 @@ func (fs *_FileStore) all() []int64 {
 	return timeIDs
 }
 
+// size returns total size of the logs in the file store.
+func (fs *_FileStore) size() int64 {
+	fs.RLock()
+	defer fs.RUnlock()
+	if !fs.opened {
+		return 0
+	}
+	files, err := fs.fsys.ReadDir(fs.dirName)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), logExt) {
+			size += f.Size()
+		}
+	}
+	return size
+}
+
 func (fs *_FileStore) del(timeID int64) {
 	fs.Lock()
 	defer fs.Unlock()
@@ -205,11 +299,57 @@ func (fs *_FileStore) del(timeID int64) {
 	}
 
 	log := logPath(fs.dirName, timeID)
-	if !exists(log) {
+	if !exists(fs.fsys, log) {
 		return
 	}
 
-	os.Remove(log)
+	if len(fs.free) < fs.recycle {
+		free := freePath(fs.dirName, timeID)
+		if err := fs.fsys.Rename(log, free); err == nil {
+			fs.free = append(fs.free, free)
+			return
+		}
+	}
+	fs.fsys.Remove(log)
+}
+
+// sync fsyncs the logs. Logs already applied and removed from the file store are skipped.
+func (fs *_FileStore) sync(timeIDs []int64) error {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	if !fs.opened {
+		// trying to use file store, but not open.
+		return nil
+	}
+
+	for _, timeID := range timeIDs {
+		f, err := fs.fsys.OpenFile(logPath(fs.dirName, timeID), os.O_RDONLY, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	syncDir(fs.fsys, fs.dirName)
+	return nil
+}
+
+// syncDir fsyncs the directory so renamed logs persist. It is best effort as
+// not all platforms support fsync of a directory.
+func syncDir(fsys fs.FileSystem, dirName string) {
+	fs.SyncDir(fsys, dirName)
+}
+
+// allocate reserves disk blocks for size bytes of the log file.
+func allocate(f fs.File, size int64) error {
+	return fs.Allocate(f, size)
 }
 
 // reset removes all persisted logs from file store.
@@ -229,13 +369,18 @@ func tmpPath(dirName string, timeID int64) string {
 	return path.Join(dirName, suffix)
 }
 
+func freePath(dirName string, timeID int64) string {
+	suffix := strconv.FormatInt(timeID, 10) + freeExt
+	return path.Join(dirName, suffix)
+}
+
 func corruptPath(dirName string, timeID int64) string {
 	suffix := strconv.FormatInt(timeID, 10) + corruptExt
 	return path.Join(dirName, suffix)
 }
 
-func exists(file string) bool {
-	if _, err := os.Stat(file); err != nil {
+func exists(fsys fs.FileSystem, file string) bool {
+	if _, err := fsys.Stat(file); err != nil {
 		if os.IsNotExist(err) {
 			return false
 		}
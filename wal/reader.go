@@ -19,6 +19,7 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/uid"
@@ -91,3 +92,32 @@ func (r *Reader) Next() ([]byte, bool, error) {
 	r.offset += int64(dataLen)
 	return data, true, nil
 }
+
+// ReadLog reads a log as written by the WAL, e.g. an archived log, and returns time ID and records of the log.
+func ReadLog(data []byte) (int64, [][]byte, error) {
+	if len(data) < logHeaderSize {
+		return 0, nil, errors.New("log header is torn")
+	}
+	info := _LogInfo{}
+	if err := info.UnmarshalBinary(data[:logHeaderSize]); err != nil {
+		return 0, nil, err
+	}
+	data = data[logHeaderSize:]
+	if int64(info.size) != int64(len(data)) {
+		return 0, nil, fmt.Errorf("log size %d does not match header size %d", len(data), info.size)
+	}
+	records := make([][]byte, 0, info.count)
+	var off uint32
+	for i := uint32(0); i < info.count; i++ {
+		if off+4 > info.size {
+			return 0, nil, fmt.Errorf("record %d of %d is torn", i, info.count)
+		}
+		dataLen := binary.LittleEndian.Uint32(data[off : off+4])
+		if dataLen < 4 || dataLen > info.size-off {
+			return 0, nil, fmt.Errorf("record %d of %d has invalid size %d", i, info.count, dataLen)
+		}
+		records = append(records, data[off+4:off+dataLen])
+		off += dataLen
+	}
+	return info.timeID, records, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LogError is an error of a log found by Verify.
+type LogError struct {
+	TimeID int64
+	Err    error
+}
+
+func (e *LogError) Error() string {
+	return fmt.Sprintf("log %d: %v", e.TimeID, e.Err)
+}
+
+// Verify reads the logs of the WAL and checks that the header of each log matches its size
+// and that the records of the log are within the log. It returns number of logs verified
+// and a LogError for each log that is torn or corrupted.
+func (wal *WAL) Verify() (int, []error) {
+	if err := wal.ok(); err != nil {
+		return 0, []error{err}
+	}
+	var n int
+	var errs []error
+	for _, timeID := range wal.logStore.all() {
+		err := wal.logStore.verify(timeID)
+		if os.IsNotExist(err) {
+			// log is released while logs are verified.
+			continue
+		}
+		n++
+		if err != nil {
+			errs = append(errs, &LogError{TimeID: timeID, Err: err})
+		}
+	}
+	return n, errs
+}
+
+func (fs *_FileStore) verify(timeID int64) error {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	f, err := fs.fsys.OpenFile(logPath(fs.dirName, timeID), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < int64(logHeaderSize) {
+		return errors.New("log header is torn")
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return err
+	}
+	info := _LogInfo{}
+	if err := info.UnmarshalBinary(data[:logHeaderSize]); err != nil {
+		return err
+	}
+	data = data[logHeaderSize:]
+	if int64(info.size) != int64(len(data)) {
+		return fmt.Errorf("log size %d does not match header size %d", len(data), info.size)
+	}
+	var off uint32
+	for i := uint32(0); i < info.count; i++ {
+		if off+4 > info.size {
+			return fmt.Errorf("record %d of %d is torn", i, info.count)
+		}
+		dataLen := binary.LittleEndian.Uint32(data[off : off+4])
+		if dataLen < 4 || dataLen > info.size-off {
+			return fmt.Errorf("record %d of %d has invalid size %d", i, info.count, dataLen)
+		}
+		off += dataLen
+	}
+	if off != info.size {
+		return fmt.Errorf("log has %d bytes after the last record", info.size-off)
+	}
+	return nil
+}
@@ -20,8 +20,10 @@ import (
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/fs"
 )
 
 const (
@@ -30,9 +32,30 @@ const (
 	logExt     = ".log"
 	tmpExt     = ".tmp"
 	corruptExt = ".CORRUPT"
+	freeExt    = ".free"
+)
+
+// SyncMode sets when logs written to the WAL are fsynced.
+type SyncMode uint8
+
+const (
+	// SyncNone leaves logs in the OS cache, a log may be lost if the OS crashes.
+	SyncNone SyncMode = iota
+	// SyncAlways fsyncs each log before the commit returns.
+	SyncAlways
+	// SyncInterval fsyncs logs written in the last interval together (group commit).
+	SyncInterval
 )
 
 type (
+	// SyncPolicy is the durability policy of logs written to the WAL.
+	SyncPolicy struct {
+		Mode SyncMode
+
+		// Interval is the amount of time between fsync of logs if Mode is SyncInterval.
+		Interval time.Duration
+	}
+
 	// WALInfo provides WAL stats.
 	WALInfo struct {
 		logCountWritten int64
@@ -55,7 +78,12 @@ type (
 
 		opts Options
 
+		// pending holds time IDs of logs written but not yet fsynced if sync mode is SyncInterval.
+		syncMu  sync.Mutex
+		pending []int64
+
 		// close
+		closeC chan struct{}
 		closed uint32
 	}
 
@@ -65,15 +93,35 @@ type (
 		Path       string
 		BufferSize int64
 		Reset      bool
+
+		// Archive is the policy for logs signaled as applied.
+		Archive ArchiveOptions
+
+		// Sync is the durability policy of logs, by default logs are not fsynced.
+		Sync SyncPolicy
+
+		// FileSystem is the file system logs are stored on, by default the OS file system.
+		FileSystem fs.FileSystem
+
+		// Preallocate is size in bytes of disk blocks reserved for a log file before the log is written.
+		Preallocate int64
+
+		// RecycleLogs is the maximum number of applied log files kept and reused to write new logs
+		// instead of creating files. Applied logs are deleted if it is not set.
+		RecycleLogs int
 	}
 )
 
 func newWal(opts Options) (wal *WAL, err error) {
+	if opts.FileSystem == nil {
+		opts.FileSystem = fs.OS
+	}
 	wal = &WAL{
 		bufPool: bpool.NewBufferPool(opts.BufferSize, nil),
 		opts:    opts,
+		closeC:  make(chan struct{}),
 	}
-	wal.logStore, err = openFile(opts.Path, opts.BufferSize)
+	wal.logStore, err = openFile(opts.FileSystem, opts.Path, opts)
 	if err != nil {
 		return wal, err
 	}
@@ -85,6 +133,10 @@ func newWal(opts Options) (wal *WAL, err error) {
 
 	wal.recoverWal()
 
+	if opts.Sync.Mode == SyncInterval && opts.Sync.Interval > 0 {
+		wal.startSyncer(opts.Sync.Interval)
+	}
+
 	return wal, nil
 }
 
@@ -100,8 +152,16 @@ func (wal *WAL) Close() error {
 		return errors.New("wal is closed")
 	}
 
+	close(wal.closeC)
 	// Make sure sync thread isn't running.
 	wal.wg.Wait()
+	// Logs not yet applied are recovered on open, so these are fsynced whatever the sync policy.
+	wal.syncMu.Lock()
+	wal.pending = wal.pending[:0]
+	wal.syncMu.Unlock()
+	if err := wal.logStore.sync(wal.logStore.all()); err != nil {
+		return err
+	}
 
 	// fmt.Println("wal.close: WALInfo ", wal.WALInfo)
 	wal.logStore.close()
@@ -114,10 +174,52 @@ func (wal *WAL) put(log _LogInfo, data *bpool.Buffer) error {
 	wal.logCountWritten++
 	wal.entriesWritten += int64(log.count)
 
-	return wal.logStore.put(log, data)
+	if err := wal.logStore.put(log, data, wal.opts.Sync.Mode == SyncAlways); err != nil {
+		return err
+	}
+	if wal.opts.Sync.Mode == SyncInterval {
+		wal.syncMu.Lock()
+		wal.pending = append(wal.pending, log.timeID)
+		wal.syncMu.Unlock()
+	}
+	return nil
 }
 
-// SignalLogApplied informs the WAL that it is safe to reuse blocks.
+// startSyncer fsyncs logs written since the last run at every interval.
+func (wal *WAL) startSyncer(interval time.Duration) {
+	wal.wg.Add(1)
+	syncTicker := time.NewTicker(interval)
+	go func() {
+		defer wal.wg.Done()
+		for {
+			select {
+			case <-syncTicker.C:
+				// a failed fsync is retried on next run.
+				wal.syncPending()
+			case <-wal.closeC:
+				syncTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// syncPending fsyncs logs written but not yet fsynced.
+func (wal *WAL) syncPending() error {
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	if len(wal.pending) == 0 {
+		return nil
+	}
+	if err := wal.logStore.sync(wal.pending); err != nil {
+		return err
+	}
+	wal.pending = wal.pending[:0]
+	return nil
+}
+
+// SignalLogApplied informs the WAL that it is safe to reuse blocks. The applied log
+// is deleted or archived as per the archive policy.
 func (wal *WAL) SignalLogApplied(timeID int64) error {
 	wal.mu.RLock()
 	wal.wg.Add(1)
@@ -127,9 +229,26 @@ func (wal *WAL) SignalLogApplied(timeID int64) error {
 	}()
 
 	wal.logCountApplied++
-	wal.logStore.del(timeID)
+	archive := wal.opts.Archive
+	if archive.Path == "" {
+		wal.logStore.del(timeID)
+		return nil
+	}
+	if err := wal.logStore.archive(timeID, archive); err != nil {
+		return err
+	}
+	if archive.Hook != nil {
+		if err := archive.Hook(timeID, archivePath(archive.Path, timeID, archive.Compress)); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return pruneArchive(wal.opts.FileSystem, archive)
+}
+
+// Size returns total size of the logs written to the WAL and not yet applied.
+func (wal *WAL) Size() int64 {
+	return wal.logStore.size()
 }
 
 // Reset removes all persistested logs from log store.
@@ -19,8 +19,12 @@ package wal
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 var (
@@ -174,3 +178,237 @@ func TestSimple(t *testing.T) {
 	}
 
 }
+
+func TestVerify(t *testing.T) {
+	wal, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i = 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := <-logWriter.Append(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-logWriter.SignalInitWrite(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	if count, errs := wal.Verify(); count != 1 || len(errs) != 0 {
+		t.Fatalf("expected 1 log verified; got %d, %v", count, errs)
+	}
+
+	// Tear the log.
+	log := logPath(dbPath+"/"+logDir, int64(n))
+	stat, err := os.Stat(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(log, stat.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	_, errs := wal.Verify()
+	if len(errs) != 1 {
+		t.Fatalf("expected torn log reported; got %v", errs)
+	}
+	if e, ok := errs[0].(*LogError); !ok || e.TimeID != int64(n) {
+		t.Fatalf("expected log error of log %d; got %v", n, errs[0])
+	}
+}
+
+func TestArchive(t *testing.T) {
+	os.RemoveAll(dbPath)
+	var archived []string
+	archive := ArchiveOptions{
+		Path:     dbPath + "/archive",
+		Compress: true,
+		Hook: func(timeID int64, archivePath string) error {
+			archived = append(archived, archivePath)
+			return nil
+		},
+	}
+	wal, err := New(Options{Path: dbPath + "/" + logDir, BufferSize: 1 << 8, Archive: archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i = 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := <-logWriter.Append(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-logWriter.SignalInitWrite(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.SignalLogApplied(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(fs.OS, logPath(dbPath+"/"+logDir, int64(n))) {
+		t.Fatal("applied log not moved to archive")
+	}
+	if len(archived) != 1 || archived[0] != archivePath(archive.Path, int64(n), true) {
+		t.Fatalf("archive hook called with %v", archived)
+	}
+	r, err := OpenArchivedLog(nil, archived[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) <= logHeaderSize {
+		t.Fatalf("archived log size %d", len(data))
+	}
+
+	// Archived logs older than retention are removed on next applied log.
+	archive.Retention = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	if err := pruneArchive(fs.OS, archive); err != nil {
+		t.Fatal(err)
+	}
+	if exists(fs.OS, archived[0]) {
+		t.Fatal("archived log not removed after retention")
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{{Mode: SyncAlways}, {Mode: SyncInterval, Interval: time.Millisecond}} {
+		os.RemoveAll(dbPath)
+		wal, err := New(Options{Path: dbPath + "/" + logDir, BufferSize: 1 << 8, Sync: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(100); err != nil {
+			t.Fatal(err)
+		}
+		if policy.Mode == SyncInterval {
+			time.Sleep(10 * time.Millisecond)
+			wal.syncMu.Lock()
+			pending := len(wal.pending)
+			wal.syncMu.Unlock()
+			if pending != 0 {
+				t.Fatalf("expected logs to be fsynced; got %d pending", pending)
+			}
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wal, err = New(Options{Path: dbPath + "/" + logDir, BufferSize: 1 << 8, Sync: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wal.recoveredTimeIDs) != 1 {
+			t.Fatalf("expected log to be recovered; got %v", wal.recoveredTimeIDs)
+		}
+		wal.Close()
+	}
+}
+
+func TestRecycleLogs(t *testing.T) {
+	os.RemoveAll(dbPath)
+	dir := dbPath + "/" + logDir
+	opts := Options{Path: dir, BufferSize: 1 << 8, Preallocate: 1 << 12, RecycleLogs: 1}
+	wal, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { wal.Close() }()
+
+	write := func(timeID int64, n int) {
+		logWriter, err := wal.NewWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := <-logWriter.Append([]byte(fmt.Sprintf("msg.%d.%d", timeID, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-logWriter.SignalInitWrite(timeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(1, 100)
+	if err := wal.SignalLogApplied(1); err != nil {
+		t.Fatal(err)
+	}
+	if exists(fs.OS, logPath(dir, 1)) || !exists(fs.OS, freePath(dir, 1)) {
+		t.Fatal("applied log not recycled")
+	}
+
+	// The recycled log is reused to write the next log, entries of the previous log are dropped.
+	write(2, 10)
+	if exists(fs.OS, freePath(dir, 1)) {
+		t.Fatal("recycled log not reused")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if wal, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals []string
+	if err := r.Iterator(func(timeID int64) (bool, error) {
+		for {
+			val, ok, err := r.Next()
+			if !ok || err != nil {
+				break
+			}
+			vals = append(vals, string(val))
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 10 || vals[0] != "msg.2.0" || vals[9] != "msg.2.9" {
+		t.Fatalf("expected entries of the recycled log; got %v", vals)
+	}
+
+	// Only RecycleLogs applied logs are kept.
+	write(3, 10)
+	if err := wal.SignalLogApplied(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.SignalLogApplied(3); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(fs.OS, freePath(dir, 2)) || exists(fs.OS, freePath(dir, 3)) || exists(fs.OS, logPath(dir, 3)) {
+		t.Fatal("expected a single recycled log")
+	}
+}
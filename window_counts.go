@@ -0,0 +1,414 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// windowCountSize is the size of a persisted window count.
+	windowCountSize = 36
+
+	// windowCountsHeaderSize is the size of the header of the window counts file,
+	// i.e. size of the window file, number of window counts and checksum of the window counts.
+	windowCountsHeaderSize = 16
+)
+
+var errWindowCountsCorrupted = errors.New("window counts are corrupted")
+
+// _WindowCount counts entries of a window block that are not deleted. Entries with a TTL are also
+// counted in expiring and these are excluded from the count once latest expiry of the block has passed.
+type _WindowCount struct {
+	topicHash uint64
+	next      int64
+	count     uint32
+	expiring  uint32
+	expiresAt uint32
+}
+
+// live returns number of entries of the window block not deleted or expired. The count is exact
+// unless the block has entries with a TTL and only some of these are expired.
+func (c _WindowCount) live(now uint32) (n int64, exact bool) {
+	switch {
+	case c.expiring == 0:
+		return int64(c.count), true
+	case c.expiresAt <= now:
+		return int64(c.count - c.expiring), true
+	default:
+		return int64(c.count), false
+	}
+}
+
+func (c *_WindowCount) add(we _WinEntry) {
+	c.count++
+	if we.expiresAt != 0 {
+		c.expiring++
+		if we.expiresAt > c.expiresAt {
+			c.expiresAt = we.expiresAt
+		}
+	}
+}
+
+func (c *_WindowCount) remove(we _WinEntry) {
+	if c.count > 0 {
+		c.count--
+	}
+	if we.expiresAt != 0 && c.expiring > 0 {
+		c.expiring--
+	}
+}
+
+// _WindowCounts holds entry counts of window blocks by offset of the window block. Counts are
+// maintained when entries are synced or deleted, so topics are counted without reading entries.
+// Counts are persisted beside window blocks when the DB is closed, the file is removed when the DB
+// is opened so counts are rebuilt from window and index blocks if the DB is not closed.
+type _WindowCounts struct {
+	mu     sync.RWMutex
+	fsys   fs.FileSystem
+	path   string
+	blocks map[int64]_WindowCount
+}
+
+func windowCountsPath(dirName string) string {
+	return path.Join(dirName, winDir, fmt.Sprintf("%s.count", prefix))
+}
+
+func newWindowCounts(fsys fs.FileSystem, dirName string) *_WindowCounts {
+	return &_WindowCounts{fsys: fsys, path: windowCountsPath(dirName), blocks: make(map[int64]_WindowCount)}
+}
+
+func (wc *_WindowCounts) get(off int64) (_WindowCount, bool) {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	c, ok := wc.blocks[off]
+	return c, ok
+}
+
+// merge adds entries appended to window blocks by the window writer once these are synced.
+func (wc *_WindowCounts) merge(w *_WindowWriter) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	for _, a := range w.appended {
+		off := w.winFile.blockOffset(a.wIdx)
+		c := wc.blocks[off]
+		c.topicHash = a.topicHash
+		c.next = w.winBlocks[a.wIdx].next
+		c.add(a.we)
+		wc.blocks[off] = c
+	}
+}
+
+// remove removes deleted entry from count of the window block.
+func (wc *_WindowCounts) remove(off int64, we _WinEntry) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if c, ok := wc.blocks[off]; ok {
+		c.remove(we)
+		wc.blocks[off] = c
+	}
+}
+
+// removeTopic removes counts of window blocks of the topic.
+func (wc *_WindowCounts) removeTopic(topicHash uint64) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	for off, c := range wc.blocks {
+		if c.topicHash == topicHash {
+			delete(wc.blocks, off)
+		}
+	}
+}
+
+func (wc *_WindowCounts) marshalBinary(winSize int64) []byte {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	data := make([]byte, windowCountsHeaderSize+len(wc.blocks)*windowCountSize)
+	binary.LittleEndian.PutUint64(data[:8], uint64(winSize))
+	binary.LittleEndian.PutUint32(data[8:12], uint32(len(wc.blocks)))
+	buf := data[windowCountsHeaderSize:]
+	for off, c := range wc.blocks {
+		binary.LittleEndian.PutUint64(buf[:8], uint64(off))
+		binary.LittleEndian.PutUint64(buf[8:16], c.topicHash)
+		binary.LittleEndian.PutUint64(buf[16:24], uint64(c.next))
+		binary.LittleEndian.PutUint32(buf[24:28], c.count)
+		binary.LittleEndian.PutUint32(buf[28:32], c.expiring)
+		binary.LittleEndian.PutUint32(buf[32:36], c.expiresAt)
+		buf = buf[windowCountSize:]
+	}
+	binary.LittleEndian.PutUint32(data[12:16], crc32.ChecksumIEEE(data[windowCountsHeaderSize:]))
+	return data
+}
+
+func (wc *_WindowCounts) unmarshalBinary(data []byte, winSize int64) error {
+	if len(data) < windowCountsHeaderSize {
+		return errWindowCountsCorrupted
+	}
+	n := int(binary.LittleEndian.Uint32(data[8:12]))
+	buf := data[windowCountsHeaderSize:]
+	switch {
+	case int64(binary.LittleEndian.Uint64(data[:8])) != winSize:
+		return errWindowCountsCorrupted
+	case len(buf) != n*windowCountSize:
+		return errWindowCountsCorrupted
+	case binary.LittleEndian.Uint32(data[12:16]) != crc32.ChecksumIEEE(buf):
+		return errWindowCountsCorrupted
+	}
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.blocks = make(map[int64]_WindowCount, n)
+	for ; len(buf) > 0; buf = buf[windowCountSize:] {
+		wc.blocks[int64(binary.LittleEndian.Uint64(buf[:8]))] = _WindowCount{
+			topicHash: binary.LittleEndian.Uint64(buf[8:16]),
+			next:      int64(binary.LittleEndian.Uint64(buf[16:24])),
+			count:     binary.LittleEndian.Uint32(buf[24:28]),
+			expiring:  binary.LittleEndian.Uint32(buf[28:32]),
+			expiresAt: binary.LittleEndian.Uint32(buf[32:36]),
+		}
+	}
+	return nil
+}
+
+// write writes window counts to a temporary file renamed over the window counts file.
+func (wc *_WindowCounts) write(winSize int64) error {
+	return fs.WriteFileSync(wc.fsys, wc.path, wc.marshalBinary(winSize), os.FileMode(0666))
+}
+
+// loadWindowCounts reads window counts written when the DB was closed and removes the file.
+// Counts are rebuilt if the file is missing or it does not match the window file.
+func (db *DB) loadWindowCounts() error {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	wc := db.internal.winCounts
+	data, err := fs.ReadFile(wc.fsys, wc.path)
+	switch {
+	case err == nil:
+		if err := wc.fsys.Remove(wc.path); err != nil {
+			return err
+		}
+		if err := wc.unmarshalBinary(data, winFile.currSize()); err == nil {
+			return nil
+		}
+		db.internal.logger.Warn().Str("context", "db.loadWindowCounts").Msg("window counts do not match window blocks")
+	case !os.IsNotExist(err):
+		return err
+	case winFile.currSize() == 0:
+		return nil
+	}
+	return db.rebuildWindowCounts()
+}
+
+// rebuildWindowCounts counts entries of window blocks that are not deleted in the index.
+func (db *DB) rebuildWindowCounts() error {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	blocks := make(map[int64]_WindowCount)
+	var indexBlock _IndexBlock
+	indexIdx := int32(-1)
+	nWinBlocks := int32(winFile.currSize() / winFile.blockSize())
+	for wIdx := int32(0); wIdx < nWinBlocks; wIdx++ {
+		r := _WindowReader{winFile: winFile, offset: winFile.blockOffset(wIdx)}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		if b.entryIdx == 0 {
+			continue
+		}
+		c := _WindowCount{topicHash: b.topicHash, next: b.next}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.seq() == 0 {
+				continue
+			}
+			if bIdx := indexFile.blockIndex(we.seq()); bIdx != indexIdx {
+				if indexFile.blockOffset(bIdx)+indexFile.blockSize() > indexFile.currSize() {
+					continue
+				}
+				br := _BlockReader{indexFile: indexFile, offset: indexFile.blockOffset(bIdx)}
+				if indexBlock, err = br.readIndexBlock(); err != nil {
+					return err
+				}
+				indexIdx = bIdx
+			}
+			for _, e := range indexBlock.entries[:indexBlock.entryIdx] {
+				if e.seq == we.seq() && !e.isDeleted() {
+					c.add(we)
+					break
+				}
+			}
+		}
+		blocks[winFile.blockOffset(wIdx)] = c
+	}
+	wc := db.internal.winCounts
+	wc.mu.Lock()
+	wc.blocks = blocks
+	wc.mu.Unlock()
+	return nil
+}
+
+// uncount removes a deleted entry of the topic from count of its window block.
+// It follows window blocks of the topic from the most recent block.
+func (db *DB) uncount(topicHash, seq uint64) error {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	off, ok := db.internal.trie.getOffset(topicHash)
+	for ok && off != 0 && off+winFile.blockSize() <= winFile.currSize() {
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		if b.topicHash != topicHash {
+			return nil
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.seq() == seq {
+				db.internal.winCounts.remove(off, we)
+				return nil
+			}
+		}
+		off = b.next
+	}
+	return nil
+}
+
+// TopicCount returns number of entries of topics matching the topic, excluding deleted and expired entries.
+// Entries synced to the DB are counted from counts of window blocks maintained at sync, so entries are read
+// only from window blocks having entries with a TTL of which some but not all are expired. If the contract is zero
+// then it uses master contract. The access key must grant read access to the topic, see WithAccessControl.
+func (db *DB) TopicCount(topic []byte, contract uint32, accessKey string) (int64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	switch {
+	case len(topic) == 0:
+		return 0, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return 0, errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	if err := db.checkAccess(accessKey, contract, topic, AccessRead); err != nil {
+		return 0, err
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return 0, err
+	}
+	t.AddContract(contract)
+
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	var count int64
+	for _, tp := range db.internal.trie.lookup(t.Parts, t.Depth, t.TopicType) {
+		count += db.memCount(tp.hash)
+		n, err := db.blockCount(tp)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// memCount counts entries of the topic not yet synced to the DB.
+func (db *DB) memCount(topicHash uint64) int64 {
+	b := db.internal.timeWindow.windowBlocks.getWindowBlock(topicHash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var count int64
+	for key, wEntries := range b.entries {
+		if key.topicHash != topicHash {
+			continue
+		}
+		for _, we := range wEntries {
+			if we.isExpired() {
+				continue
+			}
+			if data, err := db.internal.mem.Get(we.seq()); err == nil && data != nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// blockCount counts entries of window blocks of the topic from the most recent block.
+func (db *DB) blockCount(tp _Topic) (int64, error) {
+	now := uint32(time.Now().Unix())
+	var count int64
+	for off := tp.offset; off != 0; {
+		c, ok := db.internal.winCounts.get(off)
+		if !ok || c.topicHash != tp.hash {
+			break
+		}
+		n, exact := c.live(now)
+		if !exact {
+			var err error
+			if n, err = db.scanCount(off); err != nil {
+				return count, err
+			}
+		}
+		count += n
+		off = c.next
+	}
+	return count, nil
+}
+
+// scanCount counts entries of the window block that are not expired or deleted.
+func (db *DB) scanCount(off int64) (int64, error) {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return 0, err
+	}
+	r := _WindowReader{winFile: winFile, offset: off}
+	b, err := r.readWindowBlock()
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, we := range b.entries[:b.entryIdx] {
+		if we.seq() == 0 || we.isExpired() {
+			continue
+		}
+		if e, err := db.internal.reader.readIndexEntry(we.seq()); err == nil && !e.isDeleted() {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// Window is a summary of a window of entries of a topic. Entries synced to the DB are
+// summarized per window block and entries not yet synced are summarized per memdb time block.
+// Time range of a window block is approximate as a block records time when it was filled.
+type Window struct {
+	TopicHash uint64    `json:"topic_hash"`
+	Start     time.Time `json:"start"` // Start is zero for the oldest window block of a topic.
+	End       time.Time `json:"end"`
+	Count     int64     `json:"count"` // Number of entries excluding deleted and expired entries.
+	Bytes     int64     `json:"bytes"` // Size of values of the entries.
+	FirstSeq  uint64    `json:"first_seq"`
+	LastSeq   uint64    `json:"last_seq"`
+}
+
+// Windows returns summaries of windows of topics matching the topic with entries written between from and to,
+// most recent window first. A zero from or to leaves the range open, if the contract is zero then it uses master
+// contract. The access key must grant read access to the topic, see WithAccessControl. It only reads window
+// and index blocks, entries are not read from the data file.
+func (db *DB) Windows(topic []byte, contract uint32, accessKey string, from, to time.Time) ([]Window, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	if err := db.checkAccess(accessKey, contract, topic, AccessRead); err != nil {
+		return nil, err
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(contract)
+
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	var windows []Window
+	for _, tp := range db.internal.trie.lookup(t.Parts, t.Depth, t.TopicType) {
+		windows = append(windows, db.memWindows(tp.hash, from, to)...)
+		w, err := db.blockWindows(tp, from, to)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w...)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].LastSeq > windows[j].LastSeq
+	})
+	return windows, nil
+}
+
+// memWindows summarizes entries of the topic not yet synced to the DB.
+func (db *DB) memWindows(topicHash uint64, from, to time.Time) []Window {
+	b := db.internal.timeWindow.windowBlocks.getWindowBlock(topicHash)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var windows []Window
+	for key, wEntries := range b.entries {
+		if key.topicHash != topicHash {
+			continue
+		}
+		ts := time.Unix(0, key.timeID)
+		if ts.Before(from) || ts.After(to) {
+			continue
+		}
+		w := Window{TopicHash: topicHash, Start: ts, End: ts}
+		for _, we := range wEntries {
+			if we.isExpired() {
+				continue
+			}
+			data, err := db.internal.mem.Get(we.seq())
+			if err != nil || data == nil {
+				continue
+			}
+			var e _Entry
+			if err := e.UnmarshalBinary(data[:entrySize]); err != nil {
+				continue
+			}
+			w.add(we.seq(), e.valueSize)
+		}
+		if w.Count > 0 {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// blockWindows summarizes window blocks of the topic. It follows window blocks from the most recent block.
+func (db *DB) blockWindows(tp _Topic, from, to time.Time) ([]Window, error) {
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return nil, err
+	}
+	var windows []Window
+	var indexBlock _IndexBlock
+	indexIdx := int32(-1)
+	end := time.Now()
+	for off := tp.offset; off+winFile.blockSize() <= winFile.currSize(); {
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return nil, err
+		}
+		if b.topicHash != tp.hash {
+			break
+		}
+		if b.cutoffTime != 0 {
+			end = time.Unix(b.cutoffTime, 0)
+		}
+		if end.Before(from) {
+			break
+		}
+		var start time.Time
+		if b.next != 0 {
+			r := _WindowReader{winFile: winFile, offset: b.next}
+			prev, err := r.readWindowBlock()
+			if err != nil {
+				return nil, err
+			}
+			if prev.cutoffTime != 0 {
+				start = time.Unix(prev.cutoffTime, 0)
+			}
+		}
+		if !start.After(to) {
+			w := Window{TopicHash: tp.hash, Start: start, End: end}
+			for _, we := range b.entries[:b.entryIdx] {
+				if we.seq() == 0 || we.isExpired() {
+					continue
+				}
+				if bIdx := indexFile.blockIndex(we.seq()); bIdx != indexIdx {
+					br := _BlockReader{indexFile: indexFile, offset: indexFile.blockOffset(bIdx)}
+					if indexBlock, err = br.readIndexBlock(); err != nil {
+						return nil, err
+					}
+					indexIdx = bIdx
+				}
+				for _, e := range indexBlock.entries[:indexBlock.entryIdx] {
+					if e.seq == we.seq() && !e.isDeleted() {
+						w.add(e.seq, e.valueSize)
+						break
+					}
+				}
+			}
+			if w.Count > 0 {
+				windows = append(windows, w)
+			}
+		}
+		if b.next == 0 {
+			break
+		}
+		off = b.next
+	}
+	return windows, nil
+}
+
+func (w *Window) add(seq uint64, size uint32) {
+	if w.Count == 0 || seq < w.FirstSeq {
+		w.FirstSeq = seq
+	}
+	if seq > w.LastSeq {
+		w.LastSeq = seq
+	}
+	w.Count++
+	w.Bytes += int64(size)
+}